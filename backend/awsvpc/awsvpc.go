@@ -22,6 +22,7 @@ import (
 	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/mitchellh/goamz/ec2"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/backend/cloud"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 	"net"
@@ -29,16 +30,22 @@ import (
 )
 
 type AwsVpcBackend struct {
+	backend.HealthState
+
 	sm      subnet.Manager
 	network string
 	config  *subnet.Config
 	cfg     struct {
 		RouteTableID string
+		cloud.Config
 	}
-	lease  *subnet.Lease
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	lease      *subnet.Lease
+	instanceID string
+	ec2c       *ec2.EC2
+	worker     *cloud.Worker
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
 }
 
 func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backend {
@@ -61,6 +68,10 @@ func (m *AwsVpcBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Su
 			return nil, fmt.Errorf("error decoding VPC backend config: %v", err)
 		}
 	}
+	if err := m.cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid VPC backend config: %v", err)
+	}
+	m.worker = cloud.NewWorker(m.cfg.Config, &m.HealthState)
 
 	// Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
@@ -101,9 +112,10 @@ func (m *AwsVpcBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Su
 		return nil, fmt.Errorf("error getting AWS credentials from environment: %v", err)
 	}
 	ec2c := ec2.New(auth, region)
+	m.instanceID, m.ec2c = instanceID, ec2c
 
 	if _, err = m.disableSrcDestCheck(instanceID, ec2c); err != nil {
-		log.Info("Warning- disabling source destination check falied!: %v", err)
+		log.Warningf("Disabling the source/destination check failed: %v", err)
 	}
 
 	if m.cfg.RouteTableID == "" {
@@ -115,7 +127,24 @@ func (m *AwsVpcBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Su
 
 	log.Info("RouteRouteTableID: ", m.cfg.RouteTableID)
 
-	matchingRouteFound, err := m.checkMatchingRoutes(instanceID, l.Subnet.String(), ec2c)
+	// programmed by the worker so that a slow or failing EC2 API
+	// degrades the backend instead of holding up the start
+	sn := l.Subnet.String()
+	m.worker.Submit(sn, func(ctx context.Context) error {
+		return m.programRoute(sn)
+	})
+
+	return &backend.SubnetDef{
+		Net: l.Subnet,
+		MTU: extIface.MTU,
+	}, nil
+}
+
+// programRoute points the route for subnet at this instance
+func (m *AwsVpcBackend) programRoute(subnet string) error {
+	instanceID, ec2c := m.instanceID, m.ec2c
+
+	matchingRouteFound, err := m.checkMatchingRoutes(instanceID, subnet, ec2c)
 	if err != nil {
 		log.Errorf("Error describing route tables: %v", err)
 
@@ -128,23 +157,20 @@ func (m *AwsVpcBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Su
 	}
 
 	if !matchingRouteFound {
-		if _, err := ec2c.DeleteRoute(m.cfg.RouteTableID, l.Subnet.String()); err != nil {
+		if _, err := ec2c.DeleteRoute(m.cfg.RouteTableID, subnet); err != nil {
 			if ec2err, ok := err.(*ec2.Error); !ok || ec2err.Code != "InvalidRoute.NotFound" {
 				// an error other than the route not already existing occurred
-				return nil, fmt.Errorf("error deleting existing route for %s: %v", l.Subnet.String(), err)
+				return fmt.Errorf("error deleting existing route for %s: %v", subnet, err)
 			}
 		}
 
 		// Add the route for this machine's subnet
-		if _, err := m.createRoute(instanceID, l.Subnet.String(), ec2c); err != nil {
-			return nil, fmt.Errorf("unable to add route %s: %v", l.Subnet.String(), err)
+		if _, err := m.createRoute(instanceID, subnet, ec2c); err != nil {
+			return fmt.Errorf("unable to add route %s: %v", subnet, err)
 		}
 	}
 
-	return &backend.SubnetDef{
-		Net: l.Subnet,
-		MTU: extIface.MTU,
-	}, nil
+	return nil
 }
 
 func (m *AwsVpcBackend) checkMatchingRoutes(instanceID, subnet string, ec2c *ec2.EC2) (bool, error) {
@@ -217,7 +243,14 @@ func (m *AwsVpcBackend) detectRouteTableID(instanceID string, ec2c *ec2.EC2) err
 }
 
 func (m *AwsVpcBackend) Run() {
+	m.wg.Add(1)
+	go func() {
+		m.worker.Run(m.ctx)
+		m.wg.Done()
+	}()
+
 	subnet.LeaseRenewer(m.ctx, m.sm, m.network, m.lease)
+	m.wg.Wait()
 }
 
 func (m *AwsVpcBackend) Stop() {
@@ -0,0 +1,267 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// defaults of the Config fields
+const (
+	DefaultAPITimeout       = 30
+	DefaultAPIRetries       = 3
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 60
+)
+
+// HealthKind is the kind of problem the worker reports while its breaker is open
+const HealthKind = "cloud-api"
+
+// Config is embedded in the backend config of the cloud backends.
+// Times are in seconds, zero values pick the defaults.
+type Config struct {
+	APITimeout       int
+	APIRetries       int
+	BreakerThreshold int
+	BreakerCooldown  int
+}
+
+func (c *Config) Validate() error {
+	if c.APITimeout < 0 || c.APIRetries < 0 || c.BreakerThreshold < 0 || c.BreakerCooldown < 0 {
+		return fmt.Errorf("APITimeout, APIRetries, BreakerThreshold and BreakerCooldown must not be negative")
+	}
+	return nil
+}
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// Health is what the worker degrades while its breaker is open,
+// satisfied by backend.HealthState
+type Health interface {
+	SetDegraded(kind string, err error)
+	SetHealthy(kind string)
+}
+
+// Op is a call (or a sequence of calls) to a cloud API. It is abandoned
+// once ctx is done; calls that take no context keep running in the
+// background but their result is ignored.
+type Op func(ctx context.Context) error
+
+// time between the retries of a failed op; replaced in tests
+var retryDelay = time.Second
+
+// Worker runs cloud API calls off the backend's event loop. Each op is
+// queued under a key (e.g. the subnet of the route it programs) and a
+// newer op replaces a pending one of the same key. Ops get a timeout per
+// attempt and a bounded number of retries, after which they go back to
+// the end of the queue so that other keys are not held up.
+//
+// After BreakerThreshold ops in a row fail, the breaker opens: the
+// backend is marked degraded and ops are only kept pending for
+// BreakerCooldown. Then a single op is tried; if it succeeds the breaker
+// closes and all pending ops are reconciled, otherwise it opens again.
+type Worker struct {
+	timeout   time.Duration
+	retries   int
+	threshold int
+	cooldown  time.Duration
+	health    Health
+
+	mux       sync.Mutex
+	pending   map[string]*pendingOp
+	queue     []string
+	failures  int
+	openUntil time.Time
+	kick      chan struct{}
+}
+
+type pendingOp struct {
+	op  Op
+	gen int
+}
+
+func NewWorker(cfg Config, health Health) *Worker {
+	return &Worker{
+		timeout:   time.Duration(orDefault(cfg.APITimeout, DefaultAPITimeout)) * time.Second,
+		retries:   orDefault(cfg.APIRetries, DefaultAPIRetries),
+		threshold: orDefault(cfg.BreakerThreshold, DefaultBreakerThreshold),
+		cooldown:  time.Duration(orDefault(cfg.BreakerCooldown, DefaultBreakerCooldown)) * time.Second,
+		health:    health,
+		pending:   make(map[string]*pendingOp),
+		kick:      make(chan struct{}, 1),
+	}
+}
+
+// Submit queues op under key, replacing an op still pending for it
+func (w *Worker) Submit(key string, op Op) {
+	w.mux.Lock()
+	if p, ok := w.pending[key]; ok {
+		p.op = op
+		p.gen++
+	} else {
+		w.pending[key] = &pendingOp{op: op}
+		w.queue = append(w.queue, key)
+	}
+	w.mux.Unlock()
+
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the keys of the ops not done yet, in queue order
+func (w *Worker) Pending() []string {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return append([]string(nil), w.queue...)
+}
+
+// Open tells whether the breaker is open
+func (w *Worker) Open() bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return !w.openUntil.IsZero()
+}
+
+// Run processes the queued ops until ctx is done
+func (w *Worker) Run(ctx context.Context) {
+	for {
+		key, p, wait := w.next()
+		if p == nil {
+			var timer <-chan time.Time
+			if wait > 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-w.kick:
+			case <-timer:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		err := w.attempt(ctx, p.op)
+		if ctx.Err() != nil {
+			return
+		}
+		w.done(key, p.gen, err)
+	}
+}
+
+// next returns the first queued op, or nil and how long until the
+// breaker lets the next one through
+func (w *Worker) next() (string, *pendingOp, time.Duration) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if len(w.queue) == 0 {
+		return "", nil, 0
+	}
+	if !w.openUntil.IsZero() {
+		if wait := w.openUntil.Sub(time.Now()); wait > 0 {
+			return "", nil, wait
+		}
+	}
+
+	key := w.queue[0]
+	p := w.pending[key]
+	// copy so that a Submit while the op runs is not mistaken for it
+	return key, &pendingOp{op: p.op, gen: p.gen}, 0
+}
+
+// attempt runs op up to retries times, giving up on an attempt after timeout
+func (w *Worker) attempt(ctx context.Context, op Op) error {
+	var err error
+	for i := 0; i < w.retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err = w.call(ctx, op); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (w *Worker) call(ctx context.Context, op Op) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- op(ctx)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %v", w.timeout)
+	}
+}
+
+func (w *Worker) done(key string, gen int, err error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.queue = w.queue[1:]
+
+	if err == nil {
+		if w.pending[key].gen == gen {
+			delete(w.pending, key)
+		} else {
+			// resubmitted while running
+			w.queue = append(w.queue, key)
+		}
+
+		w.failures = 0
+		if !w.openUntil.IsZero() {
+			log.Infof("Cloud API calls succeed again, closing the circuit breaker (%v pending)", len(w.queue))
+			w.openUntil = time.Time{}
+			w.health.SetHealthy(HealthKind)
+		}
+		return
+	}
+
+	// keep it pending, behind the ops of other keys
+	w.queue = append(w.queue, key)
+	w.failures++
+	log.Errorf("Cloud API call for %v failed (will retry): %v", key, err)
+
+	if w.failures >= w.threshold {
+		if w.openUntil.IsZero() {
+			log.Warningf("%v cloud API calls failed in a row, deferring calls for %v", w.failures, w.cooldown)
+		}
+		w.openUntil = time.Now().Add(w.cooldown)
+		w.health.SetDegraded(HealthKind, fmt.Errorf("circuit breaker open after %v failed calls, last: %v", w.failures, err))
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+)
+
+// flakyCloud programs routes, failing (or hanging on) the subnets in broken
+type flakyCloud struct {
+	mux    sync.Mutex
+	broken map[string]bool
+	hang   bool
+	routes map[string]bool
+	calls  int
+}
+
+func newFlakyCloud(broken ...string) *flakyCloud {
+	c := &flakyCloud{broken: make(map[string]bool), routes: make(map[string]bool)}
+	for _, sn := range broken {
+		c.broken[sn] = true
+	}
+	return c
+}
+
+func (c *flakyCloud) fix() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.broken = make(map[string]bool)
+}
+
+func (c *flakyCloud) programmed(sn string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.routes[sn]
+}
+
+func (c *flakyCloud) callCount() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.calls
+}
+
+func (c *flakyCloud) createRoute(sn string) Op {
+	return func(ctx context.Context) error {
+		c.mux.Lock()
+		c.calls++
+		broken, hang := c.broken[sn], c.hang
+		c.mux.Unlock()
+
+		if broken {
+			if hang {
+				<-ctx.Done()
+			}
+			return errors.New("InternalError")
+		}
+
+		c.mux.Lock()
+		c.routes[sn] = true
+		c.mux.Unlock()
+		return nil
+	}
+}
+
+func testWorker(cfg Config, health Health) *Worker {
+	w := NewWorker(cfg, health)
+	w.timeout = 20 * time.Millisecond
+	return w
+}
+
+func withFastRetries() func() {
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	return func() {
+		retryDelay = delay
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v", what)
+}
+
+func TestWorkerKeepsProcessing(t *testing.T) {
+	defer withFastRetries()()
+
+	c := newFlakyCloud("10.1.1.0/24")
+	c.hang = true
+	health := &backend.HealthState{}
+	w := testWorker(Config{BreakerThreshold: 100}, health)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	for _, sn := range []string{"10.1.1.0/24", "10.1.2.0/24", "10.1.3.0/24"} {
+		w.Submit(sn, c.createRoute(sn))
+	}
+
+	waitFor(t, "the routes of the healthy subnets", func() bool {
+		return c.programmed("10.1.2.0/24") && c.programmed("10.1.3.0/24")
+	})
+
+	if c.programmed("10.1.1.0/24") {
+		t.Error("route of the failing subnet got programmed")
+	}
+	if p := w.Pending(); len(p) != 1 || p[0] != "10.1.1.0/24" {
+		t.Errorf("expected only the failing subnet pending, got %v", p)
+	}
+	if err := health.Health(); err != nil {
+		t.Errorf("worker degraded below the breaker threshold: %v", err)
+	}
+}
+
+func TestWorkerBreaker(t *testing.T) {
+	defer withFastRetries()()
+
+	c := newFlakyCloud("10.1.1.0/24", "10.1.2.0/24")
+	health := &backend.HealthState{}
+	w := testWorker(Config{APIRetries: 2, BreakerThreshold: 2}, health)
+	w.cooldown = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.Submit("10.1.1.0/24", c.createRoute("10.1.1.0/24"))
+	w.Submit("10.1.2.0/24", c.createRoute("10.1.2.0/24"))
+
+	waitFor(t, "the breaker to open", w.Open)
+	if health.Health() == nil {
+		t.Error("backend not degraded with the breaker open")
+	}
+
+	// no calls are made while the breaker is open
+	calls := c.callCount()
+	w.Submit("10.1.3.0/24", c.createRoute("10.1.3.0/24"))
+	time.Sleep(50 * time.Millisecond)
+	if n := c.callCount(); n != calls {
+		t.Errorf("%v calls made with the breaker open", n-calls)
+	}
+	if len(w.Pending()) != 3 {
+		t.Errorf("expected 3 pending routes, got %v", w.Pending())
+	}
+
+	c.fix()
+
+	waitFor(t, "the pending routes to be reconciled", func() bool {
+		return len(w.Pending()) == 0
+	})
+	for _, sn := range []string{"10.1.1.0/24", "10.1.2.0/24", "10.1.3.0/24"} {
+		if !c.programmed(sn) {
+			t.Errorf("route for %v not programmed", sn)
+		}
+	}
+	if w.Open() {
+		t.Error("breaker still open")
+	}
+	if err := health.Health(); err != nil {
+		t.Errorf("backend still degraded: %v", err)
+	}
+}
+
+func TestWorkerReplacesPending(t *testing.T) {
+	c := newFlakyCloud()
+	w := testWorker(Config{}, &backend.HealthState{})
+
+	var got []string
+	w.Submit("a", func(ctx context.Context) error { got = append(got, "first"); return nil })
+	w.Submit("a", func(ctx context.Context) error { got = append(got, "second"); return nil })
+	w.Submit("b", c.createRoute("b"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	waitFor(t, "the ops to run", func() bool { return len(w.Pending()) == 0 })
+	if len(got) != 1 || got[0] != "second" {
+		t.Errorf("expected only the latest op to run, got %v", got)
+	}
+}
@@ -23,6 +23,12 @@ import (
 type SubnetDef struct {
 	Net ip.IP4Net
 	MTU int
+	// Gateway is the address reserved for the node in Net, filled
+	// in from the config of the network rather than by the backend
+	Gateway ip.IP4
+	// LinkIndex is the device the backend routes the whole network
+	// to, 0 if it routes to each peer itself
+	LinkIndex int
 }
 
 type Backend interface {
@@ -31,3 +37,20 @@ type Backend interface {
 	Stop()
 	Name() string
 }
+
+// RouteSourcer is implemented by backends that route to each peer over a
+// device without an address in the network, e.g. host-gw over the
+// external interface. Traffic of the host to the peers is then sent from
+// src (e.g. the address of a local bridge) rather than that of the device.
+// It is called after Init and before Run.
+type RouteSourcer interface {
+	SetRouteSource(src ip.IP4)
+}
+
+// Readier is implemented by backends that have to install routes for the
+// existing leases before the data path is usable. Backends that don't
+// implement it are ready as soon as they run.
+type Readier interface {
+	// Ready is closed once the initial lease snapshot has been applied
+	Ready() <-chan struct{}
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// IFNAMSIZ less the terminating NUL
+const maxDeviceNameLen = 15
+
+// ValidateDeviceName checks that name is a name the kernel accepts for a
+// network device
+func ValidateDeviceName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("device name must not be empty")
+	case len(name) > maxDeviceNameLen:
+		return fmt.Errorf("device name %q is longer than %v characters", name, maxDeviceNameLen)
+	case name == "." || name == "..":
+		return fmt.Errorf("device name %q is reserved", name)
+	case strings.ContainsAny(name, "/: \t\n\r\v\f"):
+		return fmt.Errorf("device name %q must not contain '/', ':' or whitespace", name)
+	}
+	return nil
+}
+
+// DeviceNet is the address of a device the whole network is routed to:
+// the gateway of the lease sn with the prefix of the network (e.g. /16)
+// rather than that of the lease (e.g. /24)
+func DeviceNet(config *subnet.Config, sn ip.IP4Net) ip.IP4Net {
+	return ip.IP4Net{
+		IP:        config.Gateway(sn),
+		PrefixLen: config.Network.PrefixLen,
+	}
+}
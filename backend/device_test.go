@@ -0,0 +1,63 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestValidateDeviceName(t *testing.T) {
+	valid := []string{"flannel0", "flannel.1", "vx-overlay_15", "abcdefghijklmno"}
+	for _, name := range valid {
+		if err := ValidateDeviceName(name); err != nil {
+			t.Errorf("%q rejected: %v", name, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "abcdefghijklmnop", "flannel/0", "flannel:0", "flannel 0", "flannel\t0"}
+	for _, name := range invalid {
+		if err := ValidateDeviceName(name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestDeviceNet(t *testing.T) {
+	_, n, err := net.ParseCIDR("10.1.5.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := ip.FromIPNet(n)
+
+	for _, tc := range []struct {
+		config   string
+		expected string
+	}{
+		{`{ "Network": "10.1.0.0/16" }`, "10.1.5.1/16"},
+		{`{ "Network": "10.1.0.0/16", "GatewayOffset": 10 }`, "10.1.5.10/16"},
+	} {
+		cfg, err := subnet.ParseConfig(tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dn := DeviceNet(cfg, sn); dn.String() != tc.expected {
+			t.Errorf("device of %v with %v is addressed %v, expected the gateway %v", sn, tc.config, dn, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// EgressLimit is the part of a backend config that caps the egress rate
+// of the flannel device, to protect the underlay on shared nodes. It is
+// applied as a tc token bucket filter and is up to each node.
+type EgressLimit struct {
+	// EgressRate is the rate in tc units (e.g. "100mbit"), empty for no limit
+	EgressRate string `json:",omitempty"`
+	// EgressBurst is the size of the bucket in tc units (e.g. "64kb"),
+	// defaults to 10ms worth of EgressRate
+	EgressBurst string `json:",omitempty"`
+}
+
+// runs tc with args; replaced in tests
+var runTC = func(args ...string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %v: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// bits per second of the rate units of tc
+var rateUnits = map[string]float64{
+	"bit": 1, "kbit": 1e3, "mbit": 1e6, "gbit": 1e9, "tbit": 1e12,
+	"bps": 8, "kbps": 8e3, "mbps": 8e6, "gbps": 8e9, "tbps": 8e12,
+}
+
+// bytes of the size units of tc
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1, "k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20, "g": 1 << 30, "gb": 1 << 30,
+	"kbit": 1 << 10 / 8, "mbit": 1 << 20 / 8, "gbit": 1 << 30 / 8,
+}
+
+var quantityRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([a-z]*)$`)
+
+func parseQuantity(s string, units map[string]float64) (float64, error) {
+	parts := quantityRegex.FindStringSubmatch(strings.ToLower(s))
+	if parts == nil {
+		return 0, fmt.Errorf("%q is not a number followed by a unit", s)
+	}
+	unit, ok := units[parts[2]]
+	if !ok {
+		return 0, fmt.Errorf("%q has an unknown unit %q", s, parts[2])
+	}
+	n, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%q is not positive", s)
+	}
+	return n * unit, nil
+}
+
+// parseRate returns the bits per second of a tc rate (e.g. "100mbit"),
+// which unlike tc itself requires a unit
+func parseRate(s string) (float64, error) {
+	return parseQuantity(s, rateUnits)
+}
+
+// smallest default burst, a few full sized packets
+const minBurst = 16 << 10
+
+// Enabled tells whether a limit is configured
+func (l *EgressLimit) Enabled() bool {
+	return l.EgressRate != ""
+}
+
+// Validate checks the rate and burst before anything is set up with them
+func (l *EgressLimit) Validate() error {
+	if !l.Enabled() {
+		if l.EgressBurst != "" {
+			return fmt.Errorf("EgressBurst requires EgressRate")
+		}
+		return nil
+	}
+	if _, err := parseRate(l.EgressRate); err != nil {
+		return fmt.Errorf("bad EgressRate: %v", err)
+	}
+	if l.EgressBurst != "" {
+		if _, err := parseQuantity(l.EgressBurst, sizeUnits); err != nil {
+			return fmt.Errorf("bad EgressBurst: %v", err)
+		}
+	}
+	return nil
+}
+
+func (l *EgressLimit) burst() string {
+	if l.EgressBurst != "" {
+		return l.EgressBurst
+	}
+	// validated
+	rate, _ := parseRate(l.EgressRate)
+	burst := int(rate / 8 / 100)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return fmt.Sprintf("%vb", burst)
+}
+
+// Apply sets up the limit as the root qdisc of dev, replacing whatever
+// is there
+func (l *EgressLimit) Apply(dev string) error {
+	if !l.Enabled() {
+		return nil
+	}
+	if err := runTC("qdisc", "replace", "dev", dev, "root", "tbf", "rate", l.EgressRate, "burst", l.burst(), "latency", "50ms"); err != nil {
+		return fmt.Errorf("failed to limit the egress of %v: %v", dev, err)
+	}
+	log.Infof("Limited the egress of %v to %v (burst %v)", dev, l.EgressRate, l.burst())
+	return nil
+}
+
+// Remove deletes the root qdisc of dev set up by Apply
+func (l *EgressLimit) Remove(dev string) {
+	if !l.Enabled() {
+		return
+	}
+	if err := runTC("qdisc", "del", "dev", dev, "root"); err != nil {
+		log.Warningf("Failed to remove the egress limit of %v: %v", dev, err)
+	}
+}
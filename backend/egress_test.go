@@ -0,0 +1,92 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEgressLimitValidate(t *testing.T) {
+	for _, tc := range []struct {
+		limit EgressLimit
+		valid bool
+	}{
+		{EgressLimit{}, true},
+		{EgressLimit{EgressRate: "100mbit"}, true},
+		{EgressLimit{EgressRate: "1.5Gbit", EgressBurst: "64kb"}, true},
+		{EgressLimit{EgressRate: "100"}, false},
+		{EgressLimit{EgressRate: "100mb"}, false},
+		{EgressLimit{EgressRate: "0mbit"}, false},
+		{EgressLimit{EgressRate: "-1mbit"}, false},
+		{EgressLimit{EgressRate: "fast"}, false},
+		{EgressLimit{EgressRate: "100mbit", EgressBurst: "lots"}, false},
+		{EgressLimit{EgressBurst: "64kb"}, false},
+	} {
+		if err := tc.limit.Validate(); (err == nil) != tc.valid {
+			t.Errorf("Validate(%+v): expected valid=%v, got %v", tc.limit, tc.valid, err)
+		}
+	}
+}
+
+func withTC() (*[]string, func()) {
+	var cmds []string
+	orig := runTC
+	runTC = func(args ...string) error {
+		cmds = append(cmds, strings.Join(args, " "))
+		return nil
+	}
+	return &cmds, func() { runTC = orig }
+}
+
+func TestEgressLimitApply(t *testing.T) {
+	cmds, restore := withTC()
+	defer restore()
+
+	l := EgressLimit{EgressRate: "100mbit"}
+	if err := l.Apply("flannel.1"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	l.Remove("flannel.1")
+
+	// 10ms of 100mbit
+	expected := []string{
+		"qdisc replace dev flannel.1 root tbf rate 100mbit burst 125000b latency 50ms",
+		"qdisc del dev flannel.1 root",
+	}
+	if !reflect.DeepEqual(*cmds, expected) {
+		t.Errorf("expected tc %q, got %q", expected, *cmds)
+	}
+
+	*cmds = nil
+	l = EgressLimit{EgressRate: "1mbit", EgressBurst: "64kb"}
+	if err := l.Apply("flannel0"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if len(*cmds) != 1 || !strings.Contains((*cmds)[0], "rate 1mbit burst 64kb") {
+		t.Errorf("burst not passed on: %q", *cmds)
+	}
+
+	*cmds = nil
+	l = EgressLimit{}
+	if err := l.Apply("flannel0"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	l.Remove("flannel0")
+	if len(*cmds) != 0 {
+		t.Errorf("tc run without a limit: %q", *cmds)
+	}
+}
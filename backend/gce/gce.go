@@ -38,6 +38,7 @@
 package gce
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"strings"
@@ -51,6 +52,7 @@ import (
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/backend/cloud"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
@@ -59,12 +61,21 @@ var metadataEndpoint = "http://169.254.169.254/computeMetadata/v1"
 
 var replacer = strings.NewReplacer(".", "-", "/", "-")
 
+// inserting a route includes waiting for the operation to finish
+const defaultAPITimeout = 120
+
 type GCEBackend struct {
-	network        string
-	project        string
-	sm             subnet.Manager
-	config         *subnet.Config
+	backend.HealthState
+
+	network string
+	project string
+	sm      subnet.Manager
+	config  *subnet.Config
+	cfg     struct {
+		cloud.Config
+	}
 	lease          *subnet.Lease
+	worker         *cloud.Worker
 	ctx            context.Context
 	cancel         context.CancelFunc
 	wg             sync.WaitGroup
@@ -87,6 +98,19 @@ func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backe
 }
 
 func (g *GCEBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
+	if len(g.config.Backend) > 0 {
+		if err := json.Unmarshal(g.config.Backend, &g.cfg); err != nil {
+			return nil, fmt.Errorf("error decoding GCE backend config: %v", err)
+		}
+	}
+	if err := g.cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid GCE backend config: %v", err)
+	}
+	if g.cfg.APITimeout == 0 {
+		g.cfg.APITimeout = defaultAPITimeout
+	}
+	g.worker = cloud.NewWorker(g.cfg.Config, &g.HealthState)
+
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(extIP),
 	}
@@ -143,32 +167,52 @@ func (g *GCEBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Subne
 		return nil, fmt.Errorf("error getting instance from compute service: %v", err)
 	}
 
-	found, err := g.handleMatchingRoute(l.Subnet.String())
+	// programmed by the worker so that a slow or failing compute API
+	// degrades the backend instead of holding up the start
+	sn := l.Subnet.String()
+	g.worker.Submit(sn, func(ctx context.Context) error {
+		return g.programRoute(ctx, sn)
+	})
+
+	return &backend.SubnetDef{
+		Net: l.Subnet,
+		MTU: extIface.MTU,
+	}, nil
+}
+
+// programRoute points the route for subnet at this instance
+func (g *GCEBackend) programRoute(ctx context.Context, subnet string) error {
+	found, err := g.handleMatchingRoute(ctx, subnet)
 	if err != nil {
-		return nil, fmt.Errorf("error handling matching route: %v", err)
+		return fmt.Errorf("error handling matching route: %v", err)
 	}
 
 	if !found {
-		operation, err := g.insertRoute(l.Subnet.String())
+		operation, err := g.insertRoute(subnet)
 		if err != nil {
-			return nil, fmt.Errorf("error inserting route: %v", err)
+			return fmt.Errorf("error inserting route: %v", err)
 		}
 
-		err = g.pollOperationStatus(operation.Name)
+		err = g.pollOperationStatus(ctx, operation.Name)
 		if err != nil {
-			return nil, fmt.Errorf("insert operaiton failed: ", err)
+			return fmt.Errorf("insert operation failed: %v", err)
 		}
 	}
 
-	return &backend.SubnetDef{
-		Net: l.Subnet,
-		MTU: extIface.MTU,
-	}, nil
+	return nil
 }
 
 func (g *GCEBackend) Run() {
 	log.Info("GCE backend running")
+
+	g.wg.Add(1)
+	go func() {
+		g.worker.Run(g.ctx)
+		g.wg.Done()
+	}()
+
 	subnet.LeaseRenewer(g.ctx, g.sm, g.network, g.lease)
+	g.wg.Wait()
 }
 
 func (g *GCEBackend) Stop() {
@@ -180,7 +224,7 @@ func (g *GCEBackend) Name() string {
 	return "gce"
 }
 
-func (g *GCEBackend) pollOperationStatus(operationName string) error {
+func (g *GCEBackend) pollOperationStatus(ctx context.Context, operationName string) error {
 	for i := 0; i < 100; i++ {
 		operation, err := g.computeService.GlobalOperations.Get(g.project, operationName).Do()
 		if err != nil {
@@ -198,14 +242,19 @@ func (g *GCEBackend) pollOperationStatus(operationName string) error {
 		if operation.Status == "DONE" {
 			return nil
 		}
-		time.Sleep(time.Second)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	return fmt.Errorf("timeout waiting for operation to finish")
 }
 
 //returns true if an exact matching rule is found
-func (g *GCEBackend) handleMatchingRoute(subnet string) (bool, error) {
+func (g *GCEBackend) handleMatchingRoute(ctx context.Context, subnet string) (bool, error) {
 	matchingRoute, err := g.getRoute(subnet)
 	if err != nil {
 		if apiError, ok := err.(*googleapi.Error); ok {
@@ -228,7 +277,7 @@ func (g *GCEBackend) handleMatchingRoute(subnet string) (bool, error) {
 		return false, fmt.Errorf("error deleting conflicting route : %v", err)
 	}
 
-	err = g.pollOperationStatus(operation.Name)
+	err = g.pollOperationStatus(ctx, operation.Name)
 	if err != nil {
 		return false, fmt.Errorf("delete operation failed: %v", err)
 	}
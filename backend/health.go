@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HealthReporter is implemented by backends that can tell when their
+// data path is broken (e.g. a device is gone or routes fail to install)
+type HealthReporter interface {
+	// Health returns nil while healthy and why the backend is degraded otherwise
+	Health() error
+}
+
+// FailureThreshold is the number of failures in a row after which
+// CountFailure degrades a backend
+const FailureThreshold = 3
+
+// HealthState is embedded by backends to implement HealthReporter. Each
+// kind of problem (e.g. "device", "routes") is tracked on its own. The
+// zero value is healthy.
+type HealthState struct {
+	mux      sync.Mutex
+	problems map[string]error
+	failures map[string]int
+}
+
+// SetDegraded marks the backend as degraded by err until SetHealthy(kind)
+func (h *HealthState) SetDegraded(kind string, err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.problems == nil {
+		h.problems = make(map[string]error)
+	}
+	h.problems[kind] = err
+}
+
+// SetHealthy clears the problem of kind, along with its count of failures
+func (h *HealthState) SetHealthy(kind string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	delete(h.problems, kind)
+	delete(h.failures, kind)
+}
+
+// CountFailure records a failed operation of kind, which degrades the
+// backend once it fails FailureThreshold times in a row. SetHealthy
+// resets the count.
+func (h *HealthState) CountFailure(kind string, err error) {
+	h.mux.Lock()
+	if h.failures == nil {
+		h.failures = make(map[string]int)
+	}
+	h.failures[kind]++
+	n := h.failures[kind]
+	h.mux.Unlock()
+
+	if n >= FailureThreshold {
+		h.SetDegraded(kind, fmt.Errorf("%v failures in a row, last: %v", n, err))
+	}
+}
+
+// Health returns the problems of the backend, nil if there are none
+func (h *HealthState) Health() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if len(h.problems) == 0 {
+		return nil
+	}
+
+	problems := make([]string, 0, len(h.problems))
+	for kind, err := range h.problems {
+		problems = append(problems, fmt.Sprintf("%v: %v", kind, err))
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%v", strings.Join(problems, "; "))
+}
+
+// HealthGauge returns the value of a gauge of r's health:
+// 1 while healthy, 0 while degraded
+func HealthGauge(r HealthReporter) func() float64 {
+	return func() float64 {
+		if r.Health() != nil {
+			return 0
+		}
+		return 1
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"net"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// the vendored netlink does not parse the nexthops of multipath routes
+const multipathValue = "via multipath"
+
+func routeValue(r netlink.Route) string {
+	if r.Gw == nil {
+		return multipathValue
+	}
+	return "via " + r.Gw.String()
+}
+
+// DiffState compares the routes to the subnets of leases with those in
+// the main table. Routes in other tables can't be listed and are left out.
+func (rb *HostgwBackend) DiffState(extIface *net.Interface, leases []subnet.Lease) (*backend.StateDiff, error) {
+	if err := rb.configure(extIface); err != nil {
+		return nil, err
+	}
+
+	desired := []backend.StateEntry{}
+	for i := range leases {
+		r, skipped := rb.desiredRoute(&leases[i])
+		if skipped != "" || !r.inMainTable() {
+			continue
+		}
+
+		value := multipathValue
+		if !r.isMultipath() {
+			value = routeValue(r.Route)
+		}
+		desired = append(desired, backend.StateEntry{Kind: backend.StateRoute, Key: r.Dst.String(), Value: value})
+	}
+
+	routes, err := routeList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	actual := []backend.StateEntry{}
+	for _, r := range routes {
+		// routes via a device (e.g. to the local subnet) are not ours
+		if r.Dst == nil || (r.Gw == nil && r.LinkIndex != 0) {
+			continue
+		}
+		if !rb.config.Network.Contains(ip.FromIP(r.Dst.IP)) {
+			continue
+		}
+		actual = append(actual, backend.StateEntry{Kind: backend.StateRoute, Key: r.Dst.String(), Value: routeValue(r)})
+	}
+
+	return backend.DiffState(desired, actual), nil
+}
@@ -16,6 +16,7 @@ package hostgw
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
 	"sync"
@@ -25,6 +26,7 @@ import (
 	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/errlog"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
@@ -33,33 +35,108 @@ const (
 	routeCheckRetries = 10
 )
 
+// replaced in tests
+var (
+	routeReplace    = ip.ReplaceRoute
+	routeDel        = netlink.RouteDel
+	rawRouteReplace = doRawRouteReplace
+	rawRouteDel     = doRawRouteDel
+	routesTo        = ip.RoutesTo
+	routeList       = netlink.RouteList
+	ifaceAddrs      = (*net.Interface).Addrs
+	logTakeover     = log.Warningf
+)
+
 type HostgwBackend struct {
-	sm       subnet.Manager
-	network  string
+	sm      subnet.Manager
+	network string
+	config  *subnet.Config
+	cfg     struct {
+		// RequireReachable limits the routes to the peers that are
+		// on a link shared with this node or in ReachableNetworks
+		RequireReachable  bool
+		ReachableNetworks []ip.IP4Net
+
+		// RouteMetric is the priority of the installed routes,
+		// zero leaves it to the kernel
+		RouteMetric int
+
+		// RoutingTable is the table routes are installed in (zero is
+		// the main table), unless the Tenant of the peer is mapped to
+		// a table of its own in TenantRoutingTables
+		RoutingTable        int
+		TenantRoutingTables map[string]int
+	}
+	reach    *reachability
 	lease    *subnet.Lease
 	extIface *net.Interface
 	extIP    net.IP
+	// preferred source of the routes, nil for the kernel's choice
+	routeSrc net.IP
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
-	rl       []netlink.Route
+	rl       []route
+	errs     *errlog.Limiter
+	backend.ReadyFlag
+	backend.HealthState
+	backend.RouteTracker
+	backend.VerifyState
 }
 
-func New(sm subnet.Manager, network string) backend.Backend {
+func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backend {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	b := &HostgwBackend{
 		sm:      sm,
 		network: network,
+		config:  config,
 		ctx:     ctx,
 		cancel:  cancel,
+		errs:    errlog.NewLimiter(errlog.DefaultInterval),
 	}
 	return b
 }
 
-func (rb *HostgwBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
+// configure decodes the backend config and sets up what routing over
+// extIface needs
+func (rb *HostgwBackend) configure(extIface *net.Interface) error {
 	rb.extIface = extIface
+
+	if len(rb.config.Backend) > 0 {
+		if err := json.Unmarshal(rb.config.Backend, &rb.cfg); err != nil {
+			return fmt.Errorf("error decoding host-gw backend config: %v", err)
+		}
+	}
+
+	if rb.cfg.RouteMetric < 0 {
+		return fmt.Errorf("RouteMetric must not be negative, got %v", rb.cfg.RouteMetric)
+	}
+
+	if rb.cfg.RoutingTable < 0 {
+		return fmt.Errorf("RoutingTable must not be negative, got %v", rb.cfg.RoutingTable)
+	}
+	for tenant, table := range rb.cfg.TenantRoutingTables {
+		if table <= 0 {
+			return fmt.Errorf("routing table of tenant %q must be positive, got %v", tenant, table)
+		}
+	}
+
+	if rb.cfg.RequireReachable {
+		reach, err := newReachability(rb.cfg.ReachableNetworks, extIface)
+		if err != nil {
+			return fmt.Errorf("failed to determine the networks of %v: %v", extIface.Name, err)
+		}
+		rb.reach = reach
+	}
+	return nil
+}
+
+func (rb *HostgwBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
 	rb.extIP = extIP
+	if err := rb.configure(extIface); err != nil {
+		return nil, err
+	}
 
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(extIP),
@@ -97,11 +174,11 @@ func (rb *HostgwBackend) Run() {
 	evts := make(chan []subnet.Event)
 	rb.wg.Add(1)
 	go func() {
-		subnet.WatchLeases(rb.ctx, rb.sm, rb.network, evts)
+		subnet.WatchLeasesMarked(rb.ctx, rb.sm, rb.network, evts)
 		rb.wg.Done()
 	}()
 
-	rb.rl = make([]netlink.Route, 0, 10)
+	rb.rl = make([]route, 0, 10)
 	rb.wg.Add(1)
 	go func() {
 		rb.routeCheck(rb.ctx)
@@ -113,7 +190,12 @@ func (rb *HostgwBackend) Run() {
 	for {
 		select {
 		case evtBatch := <-evts:
-			rb.handleSubnetEvents(evtBatch)
+			batch, done := subnet.SplitSnapshotDone(evtBatch)
+			rb.handleSubnetEvents(batch)
+			if done {
+				// routes to the existing leases are in place
+				rb.SetReady()
+			}
 
 		case <-rb.ctx.Done():
 			return
@@ -135,40 +217,71 @@ func (rb *HostgwBackend) handleSubnetEvents(batch []subnet.Event) {
 		case subnet.SubnetAdded:
 			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
 
-			if evt.Lease.Attrs.BackendType != "host-gw" {
-				log.Warningf("Ignoring non-host-gw subnet: type=%v", evt.Lease.Attrs.BackendType)
+			route, skipped := rb.desiredRoute(&evt.Lease)
+			if skipped == backend.RouteSkippedMismatch {
+				rb.errs.Warningf(evt.Lease.Subnet.String(), "Ignoring non-host-gw subnet %v: type=%v", evt.Lease.Subnet, evt.Lease.Attrs.BackendType)
+				rb.SetRouteState(evt.Lease.Subnet, backend.RouteSkippedMismatch)
+				continue
+			}
+			reachable := skipped == ""
+
+			// the lease may have been updated to point to a new PublicIP
+			if old := rb.findRouteTo(route.Dst); old != nil && (!reachable || !routeEqual(*old, route)) {
+				log.Infof("Subnet %v moved from %v to %v", evt.Lease.Subnet, old, route)
+				if err := delRoute(*old); err != nil {
+					log.Errorf("Error deleting route to %v via %v: %v", evt.Lease.Subnet, old, err)
+				} else {
+					rb.notify(evt.Lease.Subnet, old.peer(), backend.RouteRemoved)
+				}
+				rb.removeFromRouteList(*old)
+			}
+
+			if !reachable {
+				rb.errs.Infof(evt.Lease.Subnet.String(), "Skipping route to %v: %v is not reachable", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
+				rb.SetRouteState(evt.Lease.Subnet, backend.RouteSkippedUnreachable)
 				continue
 			}
 
-			route := netlink.Route{
-				Dst:       evt.Lease.Subnet.ToIPNet(),
-				Gw:        evt.Lease.Attrs.PublicIP.ToIP(),
-				LinkIndex: rb.extIface.Index,
+			if rb.findRouteTo(route.Dst) == nil {
+				rb.checkTakeover(route)
 			}
-			if err := netlink.RouteAdd(&route); err != nil {
-				log.Errorf("Error adding route to %v via %v: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, err)
+			if err := rb.installRoute(route); err != nil {
+				rb.errs.Errorf(evt.Lease.Subnet.String(), "Error adding route to %v via %v: %v", evt.Lease.Subnet, route, err)
+				rb.CountFailure("routes", err)
+				rb.SetRouteState(evt.Lease.Subnet, backend.FailedRouteState(err))
 				continue
 			}
+			rb.errs.Clear(evt.Lease.Subnet.String())
+			rb.SetHealthy("routes")
+			rb.SetRouteState(evt.Lease.Subnet, backend.RouteInstalled)
 			rb.addToRouteList(route)
+			rb.notify(evt.Lease.Subnet, route.peer(), backend.RouteAdded)
 
 		case subnet.SubnetRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			rb.ForgetRoute(evt.Lease.Subnet)
+			rb.errs.Clear(evt.Lease.Subnet.String())
 
 			if evt.Lease.Attrs.BackendType != "host-gw" {
 				log.Warningf("Ignoring non-host-gw subnet: type=%v", evt.Lease.Attrs.BackendType)
 				continue
 			}
 
-			route := netlink.Route{
-				Dst:       evt.Lease.Subnet.ToIPNet(),
-				Gw:        evt.Lease.Attrs.PublicIP.ToIP(),
-				LinkIndex: rb.extIface.Index,
+			route := rb.routeForLease(&evt.Lease)
+			if rb.reach != nil {
+				// delete what was installed, if anything
+				old := rb.findRouteTo(route.Dst)
+				if old == nil {
+					continue
+				}
+				route = *old
 			}
-			if err := netlink.RouteDel(&route); err != nil {
+			if err := delRoute(route); err != nil {
 				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
 				continue
 			}
 			rb.removeFromRouteList(route)
+			rb.notify(evt.Lease.Subnet, route.peer(), backend.RouteRemoved)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -176,11 +289,53 @@ func (rb *HostgwBackend) handleSubnetEvents(batch []subnet.Event) {
 	}
 }
 
-func (rb *HostgwBackend) addToRouteList(route netlink.Route) {
+func (rb *HostgwBackend) notify(sn ip.IP4Net, peer ip.IP4, action string) {
+	backend.NotifyRouteChange(rb.sm, backend.RouteChange{Network: rb.network, Subnet: sn, PeerIP: peer, Action: action})
+}
+
+// desiredRoute returns the route to the subnet of l and, if it is to be
+// left out, the backend.RouteSkipped* state saying why
+func (rb *HostgwBackend) desiredRoute(l *subnet.Lease) (route, string) {
+	if l.Attrs.BackendType != "host-gw" {
+		return route{}, backend.RouteSkippedMismatch
+	}
+
+	r := rb.routeForLease(l)
+	if !rb.reach.filter(&r) {
+		return r, backend.RouteSkippedUnreachable
+	}
+	return r, ""
+}
+
+func (rb *HostgwBackend) routeForLease(l *subnet.Lease) route {
+	table := rb.cfg.RoutingTable
+	if t, ok := rb.cfg.TenantRoutingTables[l.Attrs.Tenant]; ok && l.Attrs.Tenant != "" {
+		table = t
+	}
+	r := routeForLease(l, rb.extIface.Index, rb.cfg.RouteMetric, table)
+	r.Src = rb.routeSrc
+	return r
+}
+
+func (rb *HostgwBackend) SetRouteSource(src ip.IP4) {
+	rb.routeSrc = src.ToIP()
+}
+
+func (rb *HostgwBackend) addToRouteList(route route) {
 	rb.rl = append(rb.rl, route)
 }
 
-func (rb *HostgwBackend) removeFromRouteList(route netlink.Route) {
+func (rb *HostgwBackend) findRouteTo(dst *net.IPNet) *route {
+	for _, r := range rb.rl {
+		if r.Dst.IP.Equal(dst.IP) && bytes.Equal(r.Dst.Mask, dst.Mask) {
+			route := r
+			return &route
+		}
+	}
+	return nil
+}
+
+func (rb *HostgwBackend) removeFromRouteList(route route) {
 	for index, r := range rb.rl {
 		if routeEqual(r, route) {
 			rb.rl = append(rb.rl[:index], rb.rl[index+1:]...)
@@ -189,6 +344,27 @@ func (rb *HostgwBackend) removeFromRouteList(route netlink.Route) {
 	}
 }
 
+// checkTakeover logs the routes to the destination of r that were not
+// installed by flannel and that installing r is about to replace. Only
+// routes of the main table without a metric can be listed (and thus
+// checked), a route with another metric is not replaced anyway.
+func (rb *HostgwBackend) checkTakeover(r route) {
+	if r.metric > 0 || !r.inMainTable() {
+		return
+	}
+
+	existing, err := routesTo(r.Dst)
+	if err != nil {
+		log.Warningf("Failed to list routes to %v: %v", r.Dst, err)
+		return
+	}
+	for _, nr := range existing {
+		if !r.installed(nr) {
+			logTakeover("Replacing route to %v (%v) that was not installed by flannel with one via %v", r.Dst, nr, r)
+		}
+	}
+}
+
 func (rb *HostgwBackend) routeCheck(ctx context.Context) {
 	for {
 		select {
@@ -201,36 +377,36 @@ func (rb *HostgwBackend) routeCheck(ctx context.Context) {
 }
 
 func (rb *HostgwBackend) checkSubnetExistInRoutes() {
-	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	routeList, err := routeList(nil, netlink.FAMILY_V4)
 	if err == nil {
 		for _, route := range rb.rl {
+			if !route.inMainTable() {
+				// RouteList only lists the main table
+				continue
+			}
 			exist := false
 			for _, r := range routeList {
 				if r.Dst == nil {
 					continue
 				}
-				if routeEqual(r, route) {
+				if route.installed(r) {
 					exist = true
 					break
 				}
 			}
 			if !exist {
-				if err := netlink.RouteAdd(&route); err != nil {
+				rb.checkTakeover(route)
+				if err := rb.installRoute(route); err != nil {
 					if nerr, ok := err.(net.Error); !ok {
-						log.Errorf("Error recovering route to %v: %v, %v", route.Dst, route.Gw, nerr)
+						log.Errorf("Error recovering route to %v: %v, %v", route.Dst, route, nerr)
 					}
+					rb.CountFailure("routes", err)
 					continue
 				} else {
-					log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
+					log.Infof("Route recovered %v : %v", route.Dst, route)
+					rb.SetHealthy("routes")
 				}
 			}
 		}
 	}
 }
-
-func routeEqual(x, y netlink.Route) bool {
-	if x.Dst.IP.Equal(y.Dst.IP) && x.Gw.Equal(y.Gw) && bytes.Equal(x.Dst.Mask, y.Dst.Mask) {
-		return true
-	}
-	return false
-}
@@ -0,0 +1,873 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink/nl"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/health"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// snapshotManager hands out its snapshot once release is closed
+// followed by what is sent on events
+type snapshotManager struct {
+	subnet.Manager
+	release  chan struct{}
+	snapshot []subnet.Lease
+	events   chan subnet.Event
+	window   time.Duration
+
+	mux     sync.Mutex
+	changes []backend.RouteChange
+}
+
+func (m *snapshotManager) CoalesceWindow() time.Duration {
+	return m.window
+}
+
+func (m *snapshotManager) RouteChanged(c backend.RouteChange) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.changes = append(m.changes, c)
+}
+
+func (m *snapshotManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if cursor == nil {
+		select {
+		case <-m.release:
+			return subnet.WatchResult{Snapshot: m.snapshot, Cursor: "1"}, nil
+		case <-ctx.Done():
+			return subnet.WatchResult{}, ctx.Err()
+		}
+	}
+
+	select {
+	case e := <-m.events:
+		return subnet.WatchResult{Events: []subnet.Event{e}, Cursor: "2"}, nil
+	case <-ctx.Done():
+		return subnet.WatchResult{}, ctx.Err()
+	}
+}
+
+func newTestBackend(t *testing.T, snapshot []subnet.Lease) (*HostgwBackend, *snapshotManager) {
+	sm := &snapshotManager{
+		release:  make(chan struct{}),
+		snapshot: snapshot,
+		events:   make(chan subnet.Event),
+	}
+
+	rb := New(sm, "", &subnet.Config{}).(*HostgwBackend)
+	rb.extIface = &net.Interface{Index: 1}
+	rb.lease = &subnet.Lease{Expiration: time.Now().Add(24 * time.Hour)}
+	return rb, sm
+}
+
+func mustParseIP4Net(t *testing.T, s string) ip.IP4Net {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip.FromIPNet(n)
+}
+
+func TestReadyAfterSnapshot(t *testing.T) {
+	var mux sync.Mutex
+	added := 0
+
+	routeReplace = func(r *netlink.Route) error {
+		mux.Lock()
+		defer mux.Unlock()
+		added++
+		return nil
+	}
+	defer func() { routeReplace = ip.ReplaceRoute }()
+
+	snapshot := []subnet.Lease{
+		{
+			Subnet: mustParseIP4Net(t, "10.1.1.0/24"),
+			Attrs:  &subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("1.1.1.1")), BackendType: "host-gw"},
+		},
+		{
+			Subnet: mustParseIP4Net(t, "10.1.2.0/24"),
+			Attrs:  &subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("1.1.1.2")), BackendType: "host-gw"},
+		},
+	}
+
+	rb, sm := newTestBackend(t, snapshot)
+	go rb.Run()
+	defer rb.Stop()
+
+	select {
+	case <-rb.Ready():
+		t.Fatal("backend is ready before the lease snapshot was applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(sm.release)
+
+	select {
+	case <-rb.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend did not become ready after the lease snapshot")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if added != len(snapshot) {
+		t.Errorf("expected %v routes to be added before ready, got %v", len(snapshot), added)
+	}
+}
+
+func TestReadyEmptyCluster(t *testing.T) {
+	rb, sm := newTestBackend(t, nil)
+	close(sm.release)
+
+	go rb.Run()
+	defer rb.Stop()
+
+	select {
+	case <-rb.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend without peers did not become ready")
+	}
+}
+
+func TestMultipathLease(t *testing.T) {
+	var singles []*netlink.Route
+	var multis []route
+
+	routeReplace = func(r *netlink.Route) error {
+		singles = append(singles, r)
+		return nil
+	}
+	rawRouteReplace = func(r route) error {
+		multis = append(multis, r)
+		return nil
+	}
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		rawRouteReplace = doRawRouteReplace
+	}()
+
+	rb, _ := newTestBackend(t, nil)
+
+	pip1 := ip.FromIP(net.ParseIP("1.1.1.1"))
+	pip2 := ip.FromIP(net.ParseIP("2.2.2.2"))
+	pip3 := ip.FromIP(net.ParseIP("3.3.3.3"))
+
+	rb.handleSubnetEvents([]subnet.Event{
+		{
+			Type: subnet.SubnetAdded,
+			Lease: subnet.Lease{
+				Subnet: mustParseIP4Net(t, "10.1.1.0/24"),
+				Attrs: &subnet.LeaseAttrs{
+					PublicIP:    pip1,
+					PublicIPs:   []subnet.WeightedIP{{IP: pip1, Weight: 2}, {IP: pip2}, {IP: pip3, Weight: 1000}},
+					BackendType: "host-gw",
+				},
+			},
+		},
+		{
+			Type: subnet.SubnetAdded,
+			Lease: subnet.Lease{
+				Subnet: mustParseIP4Net(t, "10.1.2.0/24"),
+				Attrs: &subnet.LeaseAttrs{
+					PublicIP:    pip2,
+					PublicIPs:   []subnet.WeightedIP{{IP: pip2, Weight: 1}},
+					BackendType: "host-gw",
+				},
+			},
+		},
+	})
+
+	if len(multis) != 1 {
+		t.Fatalf("expected one multipath route, got %v", len(multis))
+	}
+
+	nhs := multis[0].nexthops
+	if len(nhs) != 3 {
+		t.Fatalf("expected three nexthops, got %v", len(nhs))
+	}
+	if !nhs[0].gw.Equal(pip1.ToIP()) || nhs[0].weight != 2 {
+		t.Errorf("bad first nexthop: %v weight %v", nhs[0].gw, nhs[0].weight)
+	}
+	if !nhs[1].gw.Equal(pip2.ToIP()) || nhs[1].weight != 1 {
+		t.Errorf("bad second nexthop: %v weight %v", nhs[1].gw, nhs[1].weight)
+	}
+	if !nhs[2].gw.Equal(pip3.ToIP()) || nhs[2].weight != subnet.MaxIPWeight {
+		t.Errorf("bad third nexthop: %v weight %v", nhs[2].gw, nhs[2].weight)
+	}
+
+	// a single advertised IP is a plain route
+	if len(singles) != 1 || !singles[0].Gw.Equal(pip2.ToIP()) {
+		t.Errorf("expected a single nexthop route via %v, got %v", pip2, singles)
+	}
+}
+
+func TestMultipathData(t *testing.T) {
+	nhs := []nexthop{
+		{net.ParseIP("1.1.1.1"), 3},
+		{net.ParseIP("2.2.2.2"), 1},
+	}
+
+	data := multipathData(nhs, 7)
+
+	// rtnexthop (8 bytes) + RTA_GATEWAY (4 byte header + IPv4) each
+	if len(data) != 2*16 {
+		t.Fatalf("unexpected RTA_MULTIPATH payload length %v", len(data))
+	}
+
+	if data[3] != 2 || data[16+3] != 0 {
+		t.Errorf("weights not encoded as rtnh_hops: %v, %v", data[3], data[16+3])
+	}
+
+	if !net.IP(data[12:16]).Equal(nhs[0].gw) || !net.IP(data[28:32]).Equal(nhs[1].gw) {
+		t.Errorf("gateways not encoded: %v", data)
+	}
+}
+
+func TestCoalescedAddRemove(t *testing.T) {
+	var mux sync.Mutex
+	calls := 0
+
+	routeReplace = func(r *netlink.Route) error {
+		mux.Lock()
+		defer mux.Unlock()
+		calls++
+		return nil
+	}
+	routeDel = func(r *netlink.Route) error {
+		mux.Lock()
+		defer mux.Unlock()
+		calls++
+		return nil
+	}
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		routeDel = netlink.RouteDel
+	}()
+
+	rb, sm := newTestBackend(t, nil)
+	sm.window = 100 * time.Millisecond
+	close(sm.release)
+
+	go rb.Run()
+	defer rb.Stop()
+
+	<-rb.Ready()
+
+	l := subnet.Lease{
+		Subnet: mustParseIP4Net(t, "10.1.1.0/24"),
+		Attrs:  &subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("1.1.1.1")), BackendType: "host-gw"},
+	}
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: l}
+	sm.events <- subnet.Event{Type: subnet.SubnetRemoved, Lease: l}
+
+	time.Sleep(300 * time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	if calls != 0 {
+		t.Errorf("expected no route changes for a lease added and removed within the window, got %v", calls)
+	}
+}
+
+func hostgwLease(t *testing.T, sn string, pips ...string) subnet.Lease {
+	attrs := &subnet.LeaseAttrs{BackendType: "host-gw"}
+	for _, s := range pips {
+		pip := ip.FromIP(net.ParseIP(s))
+		attrs.PublicIPs = append(attrs.PublicIPs, subnet.WeightedIP{IP: pip, Weight: 1})
+	}
+	attrs.PublicIP = attrs.PublicIPs[0].IP
+	if len(pips) == 1 {
+		attrs.PublicIPs = nil
+	}
+
+	return subnet.Lease{Subnet: mustParseIP4Net(t, sn), Attrs: attrs}
+}
+
+func TestUnreachablePeers(t *testing.T) {
+	added := make(map[string]route)
+	routeReplace = func(r *netlink.Route) error {
+		added[r.Dst.String()] = route{Route: *r}
+		return nil
+	}
+	rawRouteReplace = func(r route) error {
+		added[r.Dst.String()] = r
+		return nil
+	}
+	ifaceAddrs = func(*net.Interface) ([]net.Addr, error) {
+		_, ipn, _ := net.ParseCIDR("192.168.1.10/24")
+		ipn.IP = net.ParseIP("192.168.1.10")
+		return []net.Addr{ipn}, nil
+	}
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		rawRouteReplace = doRawRouteReplace
+		ifaceAddrs = (*net.Interface).Addrs
+	}()
+
+	rb, _ := newTestBackend(t, nil)
+
+	reach, err := newReachability([]ip.IP4Net{mustParseIP4Net(t, "10.20.0.0/16")}, rb.extIface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.reach = reach
+
+	rb.handleSubnetEvents([]subnet.Event{
+		// on the shared link
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "192.168.1.11")},
+		// in the allow-list
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.2.0/24", "10.20.3.4")},
+		// neither
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.3.0/24", "172.16.0.1")},
+		// only one of its uplinks is reachable
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.4.0/24", "172.16.0.2", "192.168.1.12")},
+	})
+
+	for _, sn := range []string{"10.1.1.0/24", "10.1.2.0/24", "10.1.4.0/24"} {
+		if _, ok := added[sn]; !ok {
+			t.Errorf("no route to reachable peer subnet %v", sn)
+		}
+	}
+	if r, ok := added["10.1.3.0/24"]; ok {
+		t.Errorf("route to unreachable peer subnet 10.1.3.0/24 via %v", r)
+	}
+
+	if r := added["10.1.4.0/24"]; r.isMultipath() || !r.Gw.Equal(net.ParseIP("192.168.1.12")) {
+		t.Errorf("expected a plain route via the reachable uplink, got %v", r)
+	}
+	if len(rb.rl) != 3 {
+		t.Errorf("expected 3 routes in the route list, got %v", len(rb.rl))
+	}
+
+	// nothing to delete for the unreachable peer
+	deleted := 0
+	routeDel = func(r *netlink.Route) error {
+		deleted++
+		return nil
+	}
+	defer func() { routeDel = netlink.RouteDel }()
+
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetRemoved, Lease: hostgwLease(t, "10.1.3.0/24", "172.16.0.1")},
+	})
+	if deleted != 0 {
+		t.Errorf("deleted %v routes for a peer without a route", deleted)
+	}
+}
+
+func TestRouteMetric(t *testing.T) {
+	var added []route
+	routeReplace = func(r *netlink.Route) error {
+		t.Errorf("route with a metric added without its priority: %v", r)
+		return nil
+	}
+	rawRouteReplace = func(r route) error {
+		added = append(added, r)
+		return nil
+	}
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		rawRouteReplace = doRawRouteReplace
+	}()
+
+	rb, _ := newTestBackend(t, nil)
+	rb.cfg.RouteMetric = 50
+
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "1.1.1.1")},
+	})
+
+	if len(added) != 1 {
+		t.Fatalf("expected 1 route, got %v", len(added))
+	}
+	if added[0].metric != 50 {
+		t.Errorf("route installed with metric %v", added[0].metric)
+	}
+
+	var prio []byte
+	for _, attr := range routeAttrs(added[0]) {
+		if attr.Type == syscall.RTA_PRIORITY {
+			prio = attr.Data
+		}
+	}
+	if prio == nil {
+		t.Fatal("RTA_PRIORITY missing from the route request")
+	}
+	if m := nl.NativeEndian().Uint32(prio); m != 50 {
+		t.Errorf("RTA_PRIORITY is %v", m)
+	}
+}
+
+func TestRouteSource(t *testing.T) {
+	var added []*netlink.Route
+	routeReplace = func(r *netlink.Route) error {
+		added = append(added, r)
+		return nil
+	}
+	defer func() { routeReplace = ip.ReplaceRoute }()
+
+	rb, _ := newTestBackend(t, nil)
+	src, err := ip.ParseIP4("10.1.5.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.SetRouteSource(src)
+
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "1.1.1.1")},
+	})
+
+	if len(added) != 1 {
+		t.Fatalf("expected 1 route, got %v", len(added))
+	}
+	if !added[0].Src.Equal(net.ParseIP("10.1.5.1")) {
+		t.Errorf("route installed with source %v", added[0].Src)
+	}
+
+	// and so do the routes added with raw requests
+	var prefsrc net.IP
+	for _, attr := range routeAttrs(route{Route: *added[0], metric: 50}) {
+		if attr.Type == syscall.RTA_PREFSRC {
+			prefsrc = net.IP(attr.Data)
+		}
+	}
+	if !prefsrc.Equal(net.ParseIP("10.1.5.1")) {
+		t.Errorf("RTA_PREFSRC is %v", prefsrc)
+	}
+}
+
+func tenantLease(t *testing.T, sn, pip, tenant string) subnet.Lease {
+	l := hostgwLease(t, sn, pip)
+	l.Attrs.Tenant = tenant
+	return l
+}
+
+func TestTenantRoutingTables(t *testing.T) {
+	tables := make(map[string]int)
+	routeReplace = func(r *netlink.Route) error {
+		t.Errorf("route added to the main table: %v", r)
+		return nil
+	}
+	rawRouteReplace = func(r route) error {
+		tables[r.Dst.String()] = r.table
+		return nil
+	}
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		rawRouteReplace = doRawRouteReplace
+	}()
+
+	rb, _ := newTestBackend(t, nil)
+	rb.cfg.RoutingTable = 10
+	rb.cfg.TenantRoutingTables = map[string]int{"blue": 100, "red": 300}
+
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: tenantLease(t, "10.1.1.0/24", "1.1.1.1", "blue")},
+		{Type: subnet.SubnetAdded, Lease: tenantLease(t, "10.1.2.0/24", "1.1.1.2", "red")},
+		{Type: subnet.SubnetAdded, Lease: tenantLease(t, "10.1.3.0/24", "1.1.1.3", "")},
+		{Type: subnet.SubnetAdded, Lease: tenantLease(t, "10.1.4.0/24", "1.1.1.4", "green")},
+	})
+
+	expected := map[string]int{
+		"10.1.1.0/24": 100,
+		"10.1.2.0/24": 300,
+		"10.1.3.0/24": 10,
+		"10.1.4.0/24": 10,
+	}
+	for sn, table := range expected {
+		if tables[sn] != table {
+			t.Errorf("route to %v installed in table %v, expected %v", sn, tables[sn], table)
+		}
+	}
+
+	// ids past 255 only fit in RTA_TABLE
+	r := rb.findRouteTo(mustParseIP4Net(t, "10.1.2.0/24").ToIPNet())
+	if r == nil {
+		t.Fatal("route to 10.1.2.0/24 not tracked")
+	}
+	var table []byte
+	for _, attr := range routeAttrs(*r) {
+		if attr.Type == syscall.RTA_TABLE {
+			table = attr.Data
+		}
+	}
+	if table == nil || nl.NativeEndian().Uint32(table) != 300 {
+		t.Errorf("RTA_TABLE not set to 300: %v", table)
+	}
+}
+
+func scrapeGauge(t *testing.T, m *health.Metrics, series string) string {
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+	t.Fatalf("series %v not found in:\n%v", series, rec.Body.String())
+	return ""
+}
+
+func TestRouteFailuresDegradeHealth(t *testing.T) {
+	failing := true
+	routeReplace = func(r *netlink.Route) error {
+		if failing {
+			return syscall.ENETUNREACH
+		}
+		return nil
+	}
+	defer func() { routeReplace = ip.ReplaceRoute }()
+
+	rb, _ := newTestBackend(t, nil)
+
+	m := health.NewMetrics()
+	m.AddGauge("flannel_backend_healthy", "test", map[string]string{"backend": rb.Name()}, backend.HealthGauge(rb))
+	series := `flannel_backend_healthy{backend="host-gw"}`
+
+	if v := scrapeGauge(t, m, series); v != "1" {
+		t.Errorf("expected a fresh backend to be healthy, gauge is %v", v)
+	}
+
+	for i := 1; i <= backend.FailureThreshold; i++ {
+		if i == backend.FailureThreshold && rb.Health() != nil {
+			t.Errorf("degraded after %v failures: %v", i-1, rb.Health())
+		}
+		rb.handleSubnetEvents([]subnet.Event{
+			{Type: subnet.SubnetAdded, Lease: hostgwLease(t, fmt.Sprintf("10.1.%v.0/24", i), "1.1.1.1")},
+		})
+	}
+
+	if rb.Health() == nil {
+		t.Errorf("still healthy after %v route failures", backend.FailureThreshold)
+	}
+	if v := scrapeGauge(t, m, series); v != "0" {
+		t.Errorf("expected the gauge to flip to degraded, got %v", v)
+	}
+
+	failing = false
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.10.0/24", "1.1.1.1")},
+	})
+
+	if err := rb.Health(); err != nil {
+		t.Errorf("still degraded after a route was installed: %v", err)
+	}
+	if v := scrapeGauge(t, m, series); v != "1" {
+		t.Errorf("expected the gauge to flip back to healthy, got %v", v)
+	}
+}
+
+func TestRouteChangesNotified(t *testing.T) {
+	routeReplace = func(r *netlink.Route) error { return nil }
+	routeDel = func(r *netlink.Route) error { return nil }
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		routeDel = netlink.RouteDel
+	}()
+
+	rb, sm := newTestBackend(t, nil)
+
+	l := hostgwLease(t, "10.1.1.0/24", "1.1.1.1")
+	moved := hostgwLease(t, "10.1.1.0/24", "1.1.1.2")
+	rb.handleSubnetEvents([]subnet.Event{{Type: subnet.SubnetAdded, Lease: l}})
+	rb.handleSubnetEvents([]subnet.Event{{Type: subnet.SubnetAdded, Lease: moved}})
+	rb.handleSubnetEvents([]subnet.Event{{Type: subnet.SubnetRemoved, Lease: moved}})
+
+	sn := l.Subnet
+	expected := []backend.RouteChange{
+		{Subnet: sn, PeerIP: l.Attrs.PublicIP, Action: backend.RouteAdded},
+		{Subnet: sn, PeerIP: l.Attrs.PublicIP, Action: backend.RouteRemoved},
+		{Subnet: sn, PeerIP: moved.Attrs.PublicIP, Action: backend.RouteAdded},
+		{Subnet: sn, PeerIP: moved.Attrs.PublicIP, Action: backend.RouteRemoved},
+	}
+
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	if len(sm.changes) != len(expected) {
+		t.Fatalf("expected %v route changes, got %+v", len(expected), sm.changes)
+	}
+	for i, c := range sm.changes {
+		if c != expected[i] {
+			t.Errorf("change %v: expected %+v, got %+v", i, expected[i], c)
+		}
+	}
+}
+
+func TestRouteStateGauge(t *testing.T) {
+	routeReplace = func(r *netlink.Route) error {
+		if r.Dst.String() == "10.1.4.0/24" {
+			return syscall.ENETUNREACH
+		}
+		return nil
+	}
+	routeDel = func(r *netlink.Route) error {
+		return nil
+	}
+	ifaceAddrs = func(*net.Interface) ([]net.Addr, error) {
+		_, ipn, _ := net.ParseCIDR("192.168.1.10/24")
+		ipn.IP = net.ParseIP("192.168.1.10")
+		return []net.Addr{ipn}, nil
+	}
+	defer func() {
+		routeReplace = ip.ReplaceRoute
+		routeDel = netlink.RouteDel
+		ifaceAddrs = (*net.Interface).Addrs
+	}()
+
+	rb, _ := newTestBackend(t, nil)
+	reach, err := newReachability(nil, rb.extIface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.reach = reach
+
+	m := health.NewMetrics()
+	m.AddGaugeFamily("flannel_peer_route", "test", func() []health.Sample {
+		samples := []health.Sample{}
+		for sn, state := range rb.RouteStates() {
+			samples = append(samples, health.Sample{Labels: map[string]string{"subnet": sn.String(), "state": state}, Value: 1})
+		}
+		return samples
+	})
+
+	vxlan := hostgwLease(t, "10.1.3.0/24", "192.168.1.13")
+	vxlan.Attrs.BackendType = "vxlan"
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "192.168.1.11")},
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.2.0/24", "172.16.0.1")},
+		{Type: subnet.SubnetAdded, Lease: vxlan},
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.4.0/24", "192.168.1.14")},
+	})
+
+	for sn, state := range map[string]string{
+		"10.1.1.0/24": backend.RouteInstalled,
+		"10.1.2.0/24": backend.RouteSkippedUnreachable,
+		"10.1.3.0/24": backend.RouteSkippedMismatch,
+		"10.1.4.0/24": backend.RouteFailed,
+	} {
+		series := fmt.Sprintf(`flannel_peer_route{state=%q,subnet=%q}`, state, sn)
+		if v := scrapeGauge(t, m, series); v != "1" {
+			t.Errorf("expected %v to be 1, got %v", series, v)
+		}
+	}
+
+	// removed leases drop out of the gauge
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetRemoved, Lease: hostgwLease(t, "10.1.1.0/24", "192.168.1.11")},
+	})
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "10.1.1.0/24") {
+		t.Errorf("removed subnet still in the gauge:\n%v", rec.Body.String())
+	}
+}
+
+func TestRouteTakeover(t *testing.T) {
+	// the kernel's main table, by destination
+	table := map[string]netlink.Route{}
+	routesTo = func(dst *net.IPNet) ([]netlink.Route, error) {
+		if r, ok := table[dst.String()]; ok {
+			return []netlink.Route{r}, nil
+		}
+		return []netlink.Route{}, nil
+	}
+	routeReplace = func(r *netlink.Route) error {
+		table[r.Dst.String()] = *r
+		return nil
+	}
+	var takeovers []string
+	logTakeover = func(format string, args ...interface{}) {
+		takeovers = append(takeovers, fmt.Sprintf(format, args...))
+	}
+	defer func() {
+		routesTo = ip.RoutesTo
+		routeReplace = ip.ReplaceRoute
+		logTakeover = log.Warningf
+	}()
+
+	// a leftover pointing elsewhere, e.g. from before the peer moved
+	_, dst, _ := net.ParseCIDR("10.1.1.0/24")
+	table[dst.String()] = netlink.Route{Dst: dst, Gw: net.ParseIP("9.9.9.9"), LinkIndex: 1}
+	// one of our own, which flannel left behind on a crash
+	_, own, _ := net.ParseCIDR("10.1.2.0/24")
+	table[own.String()] = netlink.Route{Dst: own, Gw: net.ParseIP("2.2.2.2").To4(), LinkIndex: 1}
+
+	rb, _ := newTestBackend(t, nil)
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "1.1.1.1")},
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.2.0/24", "2.2.2.2")},
+	})
+
+	if gw := table[dst.String()].Gw; !gw.Equal(net.ParseIP("1.1.1.1")) {
+		t.Errorf("conflicting route was not replaced, goes via %v", gw)
+	}
+	if len(takeovers) != 1 || !strings.Contains(takeovers[0], "9.9.9.9") {
+		t.Errorf("expected the takeover of the route via 9.9.9.9 to be logged, got %v", takeovers)
+	}
+	if states := rb.RouteStates(); states[mustParseIP4Net(t, "10.1.1.0/24")] != backend.RouteInstalled {
+		t.Errorf("replacing route not reported as installed: %v", states)
+	}
+}
+
+func TestDiffState(t *testing.T) {
+	kernel := []netlink.Route{
+		// in sync
+		{Dst: mustParseIP4Net(t, "10.1.1.0/24").ToIPNet(), Gw: net.ParseIP("1.1.1.1"), LinkIndex: 1},
+		// via the old PublicIP of the peer
+		{Dst: mustParseIP4Net(t, "10.1.2.0/24").ToIPNet(), Gw: net.ParseIP("1.1.1.7"), LinkIndex: 1},
+		// left behind by a missed removal
+		{Dst: mustParseIP4Net(t, "10.1.9.0/24").ToIPNet(), Gw: net.ParseIP("1.1.1.9"), LinkIndex: 1},
+		// multipath, its nexthops aren't parsed
+		{Dst: mustParseIP4Net(t, "10.1.4.0/24").ToIPNet()},
+		// the local subnet and routes off the overlay aren't ours
+		{Dst: mustParseIP4Net(t, "10.1.5.0/24").ToIPNet(), LinkIndex: 3},
+		{Dst: mustParseIP4Net(t, "192.168.0.0/24").ToIPNet(), Gw: net.ParseIP("1.1.1.1"), LinkIndex: 1},
+		{Gw: net.ParseIP("1.1.1.254"), LinkIndex: 1},
+	}
+	routeList = func(link netlink.Link, family int) ([]netlink.Route, error) {
+		return kernel, nil
+	}
+	defer func() { routeList = netlink.RouteList }()
+
+	rb := New(nil, "", &subnet.Config{Network: mustParseIP4Net(t, "10.1.0.0/16")}).(*HostgwBackend)
+	d, err := rb.DiffState(&net.Interface{Index: 1}, []subnet.Lease{
+		hostgwLease(t, "10.1.1.0/24", "1.1.1.1"),
+		hostgwLease(t, "10.1.2.0/24", "1.1.1.2"),
+		hostgwLease(t, "10.1.3.0/24", "1.1.1.3"),
+		hostgwLease(t, "10.1.4.0/24", "1.1.1.4", "1.1.2.4"),
+		{Subnet: mustParseIP4Net(t, "10.1.6.0/24"), Attrs: &subnet.LeaseAttrs{BackendType: "udp"}},
+	})
+	if err != nil {
+		t.Fatalf("DiffState failed: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	d.Write(buf)
+	expected := `missing: route 10.1.3.0/24 via 1.1.1.3
+extra: route 10.1.9.0/24 via 1.1.1.9
+mismatched: route 10.1.2.0/24 via 1.1.1.2, kernel has via 1.1.1.7
+`
+	if buf.String() != expected {
+		t.Errorf("expected diff:\n%v\ngot:\n%v", expected, buf.String())
+	}
+}
+
+func TestEmptyBackendData(t *testing.T) {
+	added := make(map[string]bool)
+	routeReplace = func(r *netlink.Route) error {
+		added[r.Dst.String()] = true
+		return nil
+	}
+	defer func() { routeReplace = ip.ReplaceRoute }()
+
+	rb, _ := newTestBackend(t, nil)
+
+	empty := hostgwLease(t, "10.1.1.0/24", "1.1.1.1")
+	null := hostgwLease(t, "10.1.2.0/24", "1.1.1.2")
+	null.Attrs.BackendData = json.RawMessage("null")
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: empty},
+		{Type: subnet.SubnetAdded, Lease: null},
+	})
+
+	for _, l := range []subnet.Lease{empty, null} {
+		if !added[l.Subnet.String()] {
+			t.Errorf("no route to %v, host-gw needs no backend data", l.Subnet)
+		}
+		if s := rb.RouteStates()[l.Subnet]; s != backend.RouteInstalled {
+			t.Errorf("route to %v is %q", l.Subnet, s)
+		}
+	}
+}
+
+func TestVerifyRoutes(t *testing.T) {
+	// the kernel's main table, which the route to 10.1.1.0/24 never
+	// makes it into although adding it succeeds
+	table := map[string]netlink.Route{}
+	replaced := map[string]int{}
+	routesTo = func(dst *net.IPNet) ([]netlink.Route, error) {
+		if r, ok := table[dst.String()]; ok {
+			return []netlink.Route{r}, nil
+		}
+		return []netlink.Route{}, nil
+	}
+	routeReplace = func(r *netlink.Route) error {
+		replaced[r.Dst.String()]++
+		if r.Dst.String() != "10.1.1.0/24" {
+			table[r.Dst.String()] = *r
+		}
+		return nil
+	}
+	defer func() {
+		routesTo = ip.RoutesTo
+		routeReplace = ip.ReplaceRoute
+	}()
+
+	rb, _ := newTestBackend(t, nil)
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "1.1.1.1")},
+	})
+	if states := rb.RouteStates(); states[mustParseIP4Net(t, "10.1.1.0/24")] != backend.RouteInstalled {
+		t.Errorf("without verifying, expected the route to be taken as installed: %v", states)
+	}
+
+	rb, _ = newTestBackend(t, nil)
+	rb.SetVerifyRoutes()
+	replaced = map[string]int{}
+	rb.handleSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "1.1.1.1")},
+		{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.2.0/24", "2.2.2.2")},
+	})
+
+	states := rb.RouteStates()
+	if s := states[mustParseIP4Net(t, "10.1.1.0/24")]; s != backend.RouteUnverified {
+		t.Errorf("missing route: expected state %v, got %v", backend.RouteUnverified, s)
+	}
+	if s := states[mustParseIP4Net(t, "10.1.2.0/24")]; s != backend.RouteInstalled {
+		t.Errorf("present route: expected state %v, got %v", backend.RouteInstalled, s)
+	}
+	if replaced["10.1.1.0/24"] != 2 || replaced["10.1.2.0/24"] != 1 {
+		t.Errorf("expected the missing route to be installed once more and the other once, got %v", replaced)
+	}
+
+	// the route installed after it reset the count of failures
+	for i := 0; i < backend.FailureThreshold; i++ {
+		rb.handleSubnetEvents([]subnet.Event{
+			{Type: subnet.SubnetAdded, Lease: hostgwLease(t, "10.1.1.0/24", "1.1.1.1")},
+		})
+	}
+	if err := rb.Health(); err == nil || !strings.Contains(err.Error(), "not in effect") {
+		t.Errorf("expected the backend to be degraded by repeated verify failures, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink/nl"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+type nexthop struct {
+	gw     net.IP
+	weight uint
+}
+
+// route is a route to a remote subnet. Nodes advertising several public
+// IPs get an ECMP route with a nexthop per IP, in which case Gw is unset.
+type route struct {
+	netlink.Route
+	nexthops []nexthop
+	// priority of the route, zero leaves it to the kernel
+	metric int
+	// routing table of the route, zero is the main table
+	table int
+}
+
+func routeForLease(l *subnet.Lease, linkIndex, metric, table int) route {
+	r := route{
+		Route: netlink.Route{
+			Dst:       l.Subnet.ToIPNet(),
+			LinkIndex: linkIndex,
+		},
+		metric: metric,
+		table:  table,
+	}
+
+	if len(l.Attrs.PublicIPs) <= 1 {
+		r.Gw = l.Attrs.PublicIP.ToIP()
+		return r
+	}
+
+	for _, pip := range l.Attrs.PublicIPs {
+		// peers may advertise weights their own flannel would reject
+		w := pip.Weight
+		switch {
+		case w == 0:
+			w = 1
+		case w > subnet.MaxIPWeight:
+			w = subnet.MaxIPWeight
+		}
+		r.nexthops = append(r.nexthops, nexthop{pip.IP.ToIP(), w})
+	}
+	return r
+}
+
+// peer returns the gateway of r, the first one of an ECMP route
+func (r route) peer() ip.IP4 {
+	if r.isMultipath() {
+		return ip.FromIP(r.nexthops[0].gw)
+	}
+	return ip.FromIP(r.Gw)
+}
+
+func (r route) isMultipath() bool {
+	return len(r.nexthops) > 0
+}
+
+func (r route) inMainTable() bool {
+	return r.table == 0 || r.table == syscall.RT_TABLE_MAIN
+}
+
+func (r route) String() string {
+	if !r.isMultipath() {
+		return r.Gw.String()
+	}
+
+	buf := bytes.Buffer{}
+	for i, nh := range r.nexthops {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(nh.gw.String())
+	}
+	return buf.String()
+}
+
+func routeEqual(x, y route) bool {
+	if !x.Dst.IP.Equal(y.Dst.IP) || !bytes.Equal(x.Dst.Mask, y.Dst.Mask) || !x.Gw.Equal(y.Gw) || !x.Src.Equal(y.Src) {
+		return false
+	}
+
+	if x.table != y.table || len(x.nexthops) != len(y.nexthops) {
+		return false
+	}
+	for i := range x.nexthops {
+		if !x.nexthops[i].gw.Equal(y.nexthops[i].gw) || x.nexthops[i].weight != y.nexthops[i].weight {
+			return false
+		}
+	}
+	return true
+}
+
+// installed reports whether nr (as returned by RouteList) is r.
+// The vendored netlink does not parse RTA_MULTIPATH (nor RTA_PRIORITY)
+// so multipath routes can only be matched on their destination.
+func (r route) installed(nr netlink.Route) bool {
+	if nr.Dst == nil || !nr.Dst.IP.Equal(r.Dst.IP) || !bytes.Equal(nr.Dst.Mask, r.Dst.Mask) {
+		return false
+	}
+	if r.isMultipath() {
+		return nr.Gw == nil
+	}
+	return nr.Gw.Equal(r.Gw)
+}
+
+// addRoute installs r, replacing whatever route to the destination (with
+// the same metric and table) there is, so that leftovers of a crash or
+// routes set up by others don't keep flannel's from being installed.
+// The vendored netlink supports neither multipath routes nor route
+// priorities nor tables, such routes are added (and deleted) with raw
+// requests.
+func addRoute(r route) error {
+	if r.isMultipath() || r.metric > 0 || !r.inMainTable() {
+		return rawRouteReplace(r)
+	}
+	return routeReplace(&r.Route)
+}
+
+// installRoute adds r, reading it back afterwards if verifying
+func (rb *HostgwBackend) installRoute(r route) error {
+	return rb.Install(func() error { return addRoute(r) }, func() error { return verifyRoute(r) })
+}
+
+// verifyRoute checks that r is installed. Routes in other tables than
+// the main one can't be listed and pass unchecked.
+func verifyRoute(r route) error {
+	if !r.inMainTable() {
+		return nil
+	}
+	routes, err := routesTo(r.Dst)
+	if err != nil {
+		return err
+	}
+	for _, nr := range routes {
+		if r.installed(nr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching route to %v", r.Dst)
+}
+
+func delRoute(r route) error {
+	if r.metric > 0 || !r.inMainTable() {
+		// without the priority the kernel deletes whichever
+		// route to Dst it finds first, possibly not ours
+		return rawRouteDel(r)
+	}
+	// deleting by destination works for both kinds
+	return routeDel(&netlink.Route{Dst: r.Dst, Gw: r.Gw, LinkIndex: r.LinkIndex})
+}
+
+func routeAttrs(r route) []*nl.RtAttr {
+	native := nl.NativeEndian()
+
+	attrs := []*nl.RtAttr{nl.NewRtAttr(syscall.RTA_DST, r.Dst.IP.To4())}
+
+	if r.isMultipath() {
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_MULTIPATH, multipathData(r.nexthops, r.LinkIndex)))
+	} else {
+		oif := make([]byte, 4)
+		native.PutUint32(oif, uint32(r.LinkIndex))
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_GATEWAY, r.Gw.To4()), nl.NewRtAttr(syscall.RTA_OIF, oif))
+	}
+
+	if r.Src != nil {
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_PREFSRC, r.Src.To4()))
+	}
+
+	if !r.inMainTable() {
+		table := make([]byte, 4)
+		native.PutUint32(table, uint32(r.table))
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_TABLE, table))
+	}
+
+	if r.metric > 0 {
+		prio := make([]byte, 4)
+		native.PutUint32(prio, uint32(r.metric))
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_PRIORITY, prio))
+	}
+
+	return attrs
+}
+
+func doRawRoute(proto, flags int, r route) error {
+	req := nl.NewNetlinkRequest(proto, flags)
+
+	msg := nl.NewRtMsg()
+	msg.Family = syscall.AF_INET
+	dstLen, _ := r.Dst.Mask.Size()
+	msg.Dst_len = uint8(dstLen)
+	if !r.inMainTable() {
+		// rtm_table only holds ids below 256, RTA_TABLE any
+		msg.Table = syscall.RT_TABLE_UNSPEC
+		if r.table < 256 {
+			msg.Table = uint8(r.table)
+		}
+	}
+	req.AddData(msg)
+
+	for _, attr := range routeAttrs(r) {
+		req.AddData(attr)
+	}
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func doRawRouteReplace(r route) error {
+	return doRawRoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK, r)
+}
+
+func doRawRouteDel(r route) error {
+	return doRawRoute(syscall.RTM_DELROUTE, syscall.NLM_F_ACK, r)
+}
+
+const sizeofRtNexthop = 8
+
+// multipathData encodes nexthops as the payload of RTA_MULTIPATH:
+// a struct rtnexthop, followed by its RTA_GATEWAY, per nexthop
+func multipathData(nhs []nexthop, linkIndex int) []byte {
+	native := nl.NativeEndian()
+	buf := []byte{}
+
+	for _, nh := range nhs {
+		gw := nl.NewRtAttr(syscall.RTA_GATEWAY, nh.gw.To4()).Serialize()
+
+		rtnh := make([]byte, sizeofRtNexthop)
+		native.PutUint16(rtnh[0:2], uint16(sizeofRtNexthop+len(gw)))
+		rtnh[2] = 0                    // rtnh_flags
+		rtnh[3] = uint8(nh.weight - 1) // rtnh_hops
+		native.PutUint32(rtnh[4:8], uint32(linkIndex))
+
+		buf = append(buf, rtnh...)
+		buf = append(buf, gw...)
+	}
+
+	return buf
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"net"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// reachability tells the peers that can be routed to directly. A nil
+// reachability lets every peer through.
+type reachability struct {
+	nets []ip.IP4Net
+}
+
+// newReachability allows the peers in nets and those on the networks
+// of the addresses of iface (i.e. on a shared link)
+func newReachability(nets []ip.IP4Net, iface *net.Interface) (*reachability, error) {
+	r := &reachability{}
+	r.nets = append(r.nets, nets...)
+
+	addrs, err := ifaceAddrs(iface)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			r.nets = append(r.nets, ip.FromIPNet(ipn).Network())
+		}
+	}
+
+	return r, nil
+}
+
+func (r *reachability) reachable(a ip.IP4) bool {
+	if r == nil {
+		return true
+	}
+
+	for _, n := range r.nets {
+		if n.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter drops the nexthops of rt that are not reachable and reports
+// whether any are left
+func (r *reachability) filter(rt *route) bool {
+	if !rt.isMultipath() {
+		return r.reachable(ip.FromIP(rt.Gw))
+	}
+
+	nhs := []nexthop{}
+	for _, nh := range rt.nexthops {
+		if r.reachable(ip.FromIP(nh.gw)) {
+			nhs = append(nhs, nh)
+		}
+	}
+
+	switch len(nhs) {
+	case 0:
+		return false
+	case 1:
+		// back to a plain route
+		rt.Gw = nhs[0].gw
+		rt.nexthops = nil
+	default:
+		rt.nexthops = nhs
+	}
+	return true
+}
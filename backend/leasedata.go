@@ -0,0 +1,44 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// ErrNoBackendData is returned by DecodeBackendData for a lease without
+// BackendData, e.g. one of an older agent or of another backend
+var ErrNoBackendData = errors.New("lease carries no backend data")
+
+// DecodeBackendData decodes the BackendData of a peer lease into v. It
+// returns ErrNoBackendData if there is none: an empty value or JSON null.
+//
+// Backends that need it (vxlan, for the VTEP MAC) skip such leases with
+// RouteSkippedNoData and log it once. Those that route with the PublicIP
+// alone (host-gw, udp) never look at it, so empty BackendData is fine.
+func DecodeBackendData(attrs *subnet.LeaseAttrs, v interface{}) error {
+	if attrs == nil {
+		return ErrNoBackendData
+	}
+	data := bytes.TrimSpace(attrs.BackendData)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return ErrNoBackendData
+	}
+	return json.Unmarshal(data, v)
+}
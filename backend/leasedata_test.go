@@ -0,0 +1,42 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestDecodeBackendData(t *testing.T) {
+	for _, data := range []string{"", " ", "null"} {
+		var v struct{ VtepMAC string }
+		if err := DecodeBackendData(&subnet.LeaseAttrs{BackendData: json.RawMessage(data)}, &v); err != ErrNoBackendData {
+			t.Errorf("%q: expected ErrNoBackendData, got %v", data, err)
+		}
+	}
+	if err := DecodeBackendData(nil, &struct{}{}); err != ErrNoBackendData {
+		t.Errorf("nil attributes: expected ErrNoBackendData, got %v", err)
+	}
+
+	var v struct{ VtepMAC string }
+	if err := DecodeBackendData(&subnet.LeaseAttrs{BackendData: json.RawMessage(`{"VtepMAC": "aa:bb:cc:00:00:01"}`)}, &v); err != nil || v.VtepMAC != "aa:bb:cc:00:00:01" {
+		t.Errorf("failed to decode backend data: %v, %+v", err, v)
+	}
+	if err := DecodeBackendData(&subnet.LeaseAttrs{BackendData: json.RawMessage(`{"VtepMAC":`)}, &v); err == nil || err == ErrNoBackendData {
+		t.Errorf("expected a decoding error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ExternalLinker is implemented by backends that create a device of their
+// own. SetExternalLink, called before Init, has them leave setting the
+// device up to another component (e.g. an orchestrator that would race
+// with flannel doing so) and wait for it to be up before routing to it.
+type ExternalLinker interface {
+	SetExternalLink()
+}
+
+// replaced in tests
+var (
+	linkSetUp      = netlink.LinkSetUp
+	linkUpInterval = time.Second
+
+	linkIsUp = func(index int) (bool, error) {
+		link, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return false, err
+		}
+		return link.Attrs().Flags&net.FlagUp != 0, nil
+	}
+)
+
+// LinkState is embedded by backends to implement ExternalLinker. The zero
+// value has the backend set its device up.
+type LinkState struct {
+	external bool
+}
+
+func (ls *LinkState) SetExternalLink() {
+	ls.external = true
+}
+
+// BringUp sets link up or, if that is left to another component, waits
+// until it is up or ctx is done
+func (ls *LinkState) BringUp(ctx context.Context, link netlink.Link) error {
+	name := link.Attrs().Name
+	if !ls.external {
+		if err := linkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set interface %v to UP state: %v", name, err)
+		}
+		return nil
+	}
+
+	for logged := false; ; {
+		up, err := linkIsUp(link.Attrs().Index)
+		if err != nil {
+			return fmt.Errorf("failed to check the state of interface %v: %v", name, err)
+		}
+		if up {
+			return nil
+		}
+		if !logged {
+			log.Infof("Waiting for interface %v to be set up", name)
+			logged = true
+		}
+
+		select {
+		case <-time.After(linkUpInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestBringUpExternal(t *testing.T) {
+	var setUp, checks int
+	origSetUp, origIsUp, origInterval := linkSetUp, linkIsUp, linkUpInterval
+	linkSetUp = func(link netlink.Link) error {
+		setUp++
+		return nil
+	}
+	linkIsUp = func(index int) (bool, error) {
+		// brought up by someone else on the third look
+		checks++
+		return checks >= 3, nil
+	}
+	linkUpInterval = time.Millisecond
+	defer func() {
+		linkSetUp, linkIsUp, linkUpInterval = origSetUp, origIsUp, origInterval
+	}()
+
+	link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "flannel0", Index: 7}}
+
+	ls := LinkState{}
+	ls.SetExternalLink()
+	if err := ls.BringUp(context.Background(), link); err != nil {
+		t.Fatalf("BringUp failed: %v", err)
+	}
+	if setUp != 0 {
+		t.Errorf("link set up %v times with an external manager", setUp)
+	}
+	if checks != 3 {
+		t.Errorf("expected BringUp to wait for the link to be up, checked %v times", checks)
+	}
+
+	// and gives up with the backend
+	checks = -1000
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ls.BringUp(ctx, link); err != context.Canceled {
+		t.Errorf("expected BringUp to be canceled, got %v", err)
+	}
+
+	if err := (&LinkState{}).BringUp(context.Background(), link); err != nil {
+		t.Fatalf("BringUp failed: %v", err)
+	}
+	if setUp != 1 {
+		t.Errorf("expected the link to be set up once by default, got %v", setUp)
+	}
+}
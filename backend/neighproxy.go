@@ -0,0 +1,109 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// NeighProxy is the part of a backend config that has the flannel device
+// answer ARP (and NDP) requests on behalf of the addresses routed through
+// it, for setups where pods reach their gateway without a bridge
+type NeighProxy struct {
+	ProxyARP bool `json:",omitempty"`
+	ProxyNDP bool `json:",omitempty"`
+}
+
+// where the sysctls are; replaced in tests
+var procSys = "/proc/sys"
+
+func proxyARPPath(dev string) string {
+	return filepath.Join(procSys, "net/ipv4/conf", dev, "proxy_arp")
+}
+
+func proxyNDPPath(dev string) string {
+	return filepath.Join(procSys, "net/ipv6/conf", dev, "proxy_ndp")
+}
+
+// writeSysctl sets the sysctl at path to value and reads it back, as
+// some are silently ignored (or clamped) by the kernel
+func writeSysctl(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if got := strings.TrimSpace(string(b)); got != value {
+		return fmt.Errorf("%v is %v after setting it to %v", path, got, value)
+	}
+	return nil
+}
+
+// Apply turns proxying on dev on or, as the device may be left over from
+// a run with it enabled, off
+func (p *NeighProxy) Apply(dev string) error {
+	for _, s := range []struct {
+		path    string
+		enabled bool
+	}{
+		{proxyARPPath(dev), p.ProxyARP},
+		{proxyNDPPath(dev), p.ProxyNDP},
+	} {
+		value := "0"
+		if s.enabled {
+			value = "1"
+		}
+		err := writeSysctl(s.path, value)
+		switch {
+		case err == nil:
+			if s.enabled {
+				log.Infof("Enabled %v of %v", filepath.Base(s.path), dev)
+			}
+		case !s.enabled && os.IsNotExist(err):
+			// e.g. IPv6 is disabled, nothing to turn off
+		case s.enabled:
+			return fmt.Errorf("failed to enable %v of %v: %v", filepath.Base(s.path), dev, err)
+		default:
+			log.Warningf("Failed to disable %v of %v: %v", filepath.Base(s.path), dev, err)
+		}
+	}
+	return nil
+}
+
+// Remove turns off the proxying enabled by Apply
+func (p *NeighProxy) Remove(dev string) {
+	for _, s := range []struct {
+		path    string
+		enabled bool
+	}{
+		{proxyARPPath(dev), p.ProxyARP},
+		{proxyNDPPath(dev), p.ProxyNDP},
+	} {
+		if !s.enabled {
+			continue
+		}
+		if err := writeSysctl(s.path, "0"); err != nil && !os.IsNotExist(err) {
+			log.Warningf("Failed to disable %v of %v: %v", filepath.Base(s.path), dev, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withProcSys points procSys at a temp dir with the proxy sysctls of dev
+// set to 0
+func withProcSys(t *testing.T, dev string) func() {
+	dir, err := ioutil.TempDir("", "flannel-sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := procSys
+	procSys = dir
+
+	for _, path := range []string{proxyARPPath(dev), proxyNDPPath(dev)} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		procSys = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func readSysctl(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestNeighProxy(t *testing.T) {
+	defer withProcSys(t, "flannel.1")()
+
+	p := NeighProxy{ProxyARP: true}
+	if err := p.Apply("flannel.1"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if v := readSysctl(t, proxyARPPath("flannel.1")); v != "1" {
+		t.Errorf("proxy_arp not enabled: %v", v)
+	}
+	if v := readSysctl(t, proxyNDPPath("flannel.1")); v != "0" {
+		t.Errorf("proxy_ndp enabled without ProxyNDP: %v", v)
+	}
+
+	p.Remove("flannel.1")
+	if v := readSysctl(t, proxyARPPath("flannel.1")); v != "0" {
+		t.Errorf("proxy_arp not disabled on teardown: %v", v)
+	}
+
+	// a device left with it enabled has it disabled again
+	if err := ioutil.WriteFile(proxyARPPath("flannel.1"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p = NeighProxy{}
+	if err := p.Apply("flannel.1"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if v := readSysctl(t, proxyARPPath("flannel.1")); v != "0" {
+		t.Errorf("proxy_arp left enabled: %v", v)
+	}
+
+	// no such device, or no IPv6
+	if err := p.Apply("flannel.2"); err != nil {
+		t.Errorf("Apply with proxying disabled failed on missing sysctls: %v", err)
+	}
+	p = NeighProxy{ProxyNDP: true}
+	if err := p.Apply("flannel.2"); err == nil {
+		t.Error("Apply succeeded without the proxy_ndp sysctl")
+	}
+}
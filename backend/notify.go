@@ -0,0 +1,49 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	RouteAdded   = "add"
+	RouteRemoved = "remove"
+)
+
+// RouteChange is a route to the subnet of a peer that a backend added or
+// removed
+type RouteChange struct {
+	Network string    `json:"network"`
+	Subnet  ip.IP4Net `json:"subnet"`
+	PeerIP  ip.IP4    `json:"peerIP"`
+	// RouteAdded or RouteRemoved
+	Action string `json:"action"`
+}
+
+// RouteNotifier is implemented by Managers that want to hear about the
+// routes their backends change
+type RouteNotifier interface {
+	RouteChanged(c RouteChange)
+}
+
+// NotifyRouteChange tells sm about c if sm is a RouteNotifier. Backends
+// call it once the change is in place.
+func NotifyRouteChange(sm subnet.Manager, c RouteChange) {
+	if n, ok := sm.(RouteNotifier); ok {
+		n.RouteChanged(c)
+	}
+}
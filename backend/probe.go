@@ -0,0 +1,219 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Capability is a feature of the host (kernel module, device, tool, ...)
+// that a backend needs in order to work
+type Capability struct {
+	Name  string
+	Check func() error
+}
+
+// ProbeResult is the outcome of checking a Capability, Err is nil if the
+// capability is present
+type ProbeResult struct {
+	Capability string
+	Err        error
+}
+
+// Probe checks all of caps
+func Probe(caps []Capability) []ProbeResult {
+	results := make([]ProbeResult, len(caps))
+	for i, c := range caps {
+		results[i] = ProbeResult{c.Name, c.Check()}
+	}
+	return results
+}
+
+// UndeterminedError is returned by the check of a capability that could
+// not tell whether the host has it. Require lets the capability pass
+// with a warning.
+type UndeterminedError struct {
+	Err error
+}
+
+func (e *UndeterminedError) Error() string {
+	return fmt.Sprintf("can't tell: %v", e.Err)
+}
+
+// CapabilityError reports the capabilities found missing for a backend
+// (or another feature, e.g. IP masquerading)
+type CapabilityError struct {
+	Name    string
+	Missing []ProbeResult
+}
+
+func (e *CapabilityError) Error() string {
+	missing := make([]string, len(e.Missing))
+	for i, r := range e.Missing {
+		missing[i] = fmt.Sprintf("%v (%v)", r.Capability, r.Err)
+	}
+	return fmt.Sprintf("%v is not supported by this host, missing %v", e.Name, strings.Join(missing, "; "))
+}
+
+// Require checks caps and returns a *CapabilityError naming the missing
+// ones, if any. Those that could not be checked are only warned about.
+func Require(name string, caps []Capability) error {
+	var missing []ProbeResult
+	for _, r := range Probe(caps) {
+		if ue, ok := r.Err.(*UndeterminedError); ok {
+			log.Warningf("Can't tell whether the host has %v for %v, trying anyway: %v", r.Capability, name, ue.Err)
+			continue
+		}
+		if r.Err != nil {
+			missing = append(missing, r)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &CapabilityError{name, missing}
+	}
+	return nil
+}
+
+// replaced in tests
+var (
+	hostRoot      = "/"
+	lookPath      = exec.LookPath
+	kernelRelease = unameRelease
+)
+
+func hostPath(p string) string {
+	return filepath.Join(hostRoot, p)
+}
+
+func unameRelease() (string, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b), nil
+}
+
+// KernelModule is present if the module is loaded, built into the
+// kernel or can be loaded on demand
+func KernelModule(name string) Capability {
+	return Capability{
+		Name: fmt.Sprintf("%v kernel module", name),
+		Check: func() error {
+			if _, err := os.Stat(hostPath("/sys/module/" + name)); err == nil {
+				return nil
+			}
+
+			release, err := kernelRelease()
+			if err != nil {
+				return fmt.Errorf("not loaded and failed to determine kernel release: %v", err)
+			}
+
+			dir := hostPath("/lib/modules/" + release)
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				// e.g. in a container without it bind mounted, the
+				// module may well load once the backend needs it
+				return &UndeterminedError{Err: fmt.Errorf("not loaded and %v does not exist", dir)}
+			}
+			for _, index := range []string{"modules.builtin", "modules.dep"} {
+				found, err := moduleListed(filepath.Join(dir, index), name)
+				if err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("not loaded and failed to read %v: %v", index, err)
+				}
+				if found {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("not loaded and not available in %v", dir)
+		},
+	}
+}
+
+// moduleListed looks for name in a modules.dep style index whose lines
+// start with the path of the module (e.g. "kernel/drivers/net/vxlan.ko:")
+func moduleListed(index, name string) (bool, error) {
+	f, err := os.Open(index)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		p := s.Text()
+		if i := strings.IndexByte(p, ':'); i >= 0 {
+			p = p[:i]
+		}
+
+		base := filepath.Base(p)
+		if i := strings.Index(base, ".ko"); i >= 0 {
+			base = base[:i]
+		}
+		// modules can be named with either dashes or underscores
+		if strings.Replace(base, "-", "_", -1) == strings.Replace(name, "-", "_", -1) {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// DeviceNode is present if the device node at path exists
+func DeviceNode(name, path string) Capability {
+	return Capability{
+		Name: fmt.Sprintf("%v (%v)", name, path),
+		Check: func() error {
+			fi, err := os.Stat(hostPath(path))
+			switch {
+			case os.IsNotExist(err):
+				return fmt.Errorf("does not exist")
+			case err != nil:
+				return err
+			case fi.Mode()&os.ModeDevice == 0:
+				return fmt.Errorf("not a device")
+			}
+			return nil
+		},
+	}
+}
+
+// Executable is present if name is found in PATH
+func Executable(name string) Capability {
+	return Capability{
+		Name: name,
+		Check: func() error {
+			if _, err := lookPath(name); err != nil {
+				return fmt.Errorf("not found in PATH")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withHostRoot(t *testing.T, release string) (string, func()) {
+	dir, err := ioutil.TempDir("", "flannel-probe")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	root, uname := hostRoot, kernelRelease
+	hostRoot = dir
+	kernelRelease = func() (string, error) { return release, nil }
+
+	return dir, func() {
+		hostRoot, kernelRelease = root, uname
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKernelModule(t *testing.T) {
+	root, restore := withHostRoot(t, "4.2.0-test")
+	defer restore()
+
+	if err := os.MkdirAll(filepath.Join(root, "sys/module/tun"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "lib/modules/4.2.0-test/modules.dep"),
+		"kernel/drivers/net/vxlan.ko: kernel/net/ipv4/udp_tunnel.ko\n"+
+			"kernel/net/bridge/br_netfilter.ko.xz: kernel/net/bridge/bridge.ko\n")
+	writeFile(t, filepath.Join(root, "lib/modules/4.2.0-test/modules.builtin"),
+		"kernel/net/ipv4/ip_gre.ko\n")
+
+	for _, m := range []string{"tun", "vxlan", "br_netfilter", "br-netfilter", "ip_gre"} {
+		if err := KernelModule(m).Check(); err != nil {
+			t.Errorf("%v reported missing: %v", m, err)
+		}
+	}
+
+	if err := KernelModule("geneve").Check(); err == nil {
+		t.Error("geneve reported present")
+	}
+}
+
+func TestKernelModuleNoModules(t *testing.T) {
+	_, restore := withHostRoot(t, "4.2.0-test")
+	defer restore()
+
+	// no /lib/modules at all, e.g. a container without it bind mounted
+	err := KernelModule("vxlan").Check()
+	if _, ok := err.(*UndeterminedError); !ok {
+		t.Fatalf("expected vxlan to be undetermined, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "/lib/modules/4.2.0-test") {
+		t.Errorf("error does not say where the module was looked for: %v", err)
+	}
+
+	if err := Require("vxlan backend", []Capability{KernelModule("vxlan")}); err != nil {
+		t.Errorf("Require failed on an undetermined module: %v", err)
+	}
+}
+
+func TestExecutable(t *testing.T) {
+	defer func(f func(string) (string, error)) { lookPath = f }(lookPath)
+	lookPath = func(name string) (string, error) {
+		if name == "iptables" {
+			return "/sbin/iptables", nil
+		}
+		return "", errors.New("not found")
+	}
+
+	if err := Executable("iptables").Check(); err != nil {
+		t.Errorf("iptables reported missing: %v", err)
+	}
+	if err := Executable("ip6tables").Check(); err == nil {
+		t.Error("ip6tables reported present")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	present := func() error { return nil }
+	missing := func() error { return errors.New("not loaded") }
+
+	if err := Require("test", []Capability{{"a", present}, {"b", present}}); err != nil {
+		t.Errorf("Require failed with all capabilities present: %v", err)
+	}
+
+	err := Require("test", []Capability{{"a", present}, {"b", missing}, {"c", missing}})
+	cerr, ok := err.(*CapabilityError)
+	if !ok {
+		t.Fatalf("Require returned %T, expected *CapabilityError", err)
+	}
+
+	if len(cerr.Missing) != 2 || cerr.Missing[0].Capability != "b" || cerr.Missing[1].Capability != "c" {
+		t.Errorf("wrong missing capabilities: %v", cerr.Missing)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "b (not loaded)") || strings.Contains(msg, "a (") {
+		t.Errorf("error does not name exactly the missing capabilities: %v", msg)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync"
+)
+
+// ReadyFlag is embedded by backends to implement Readier. The zero
+// value is not ready.
+type ReadyFlag struct {
+	once sync.Once
+	mux  sync.Mutex
+	ch   chan struct{}
+}
+
+func (f *ReadyFlag) channel() chan struct{} {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.ch == nil {
+		f.ch = make(chan struct{})
+	}
+	return f.ch
+}
+
+// SetReady marks the flag as ready, subsequent calls are no-ops
+func (f *ReadyFlag) SetReady() {
+	f.once.Do(func() {
+		close(f.channel())
+	})
+}
+
+// Ready returns a channel that is closed once SetReady was called
+func (f *ReadyFlag) Ready() <-chan struct{} {
+	return f.channel()
+}
+
+// IsReady reports whether SetReady was called
+func (f *ReadyFlag) IsReady() bool {
+	select {
+	case <-f.Ready():
+		return true
+	default:
+		return false
+	}
+}
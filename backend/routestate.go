@@ -0,0 +1,81 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// states of the route to the subnet of a peer
+const (
+	RouteInstalled = "installed"
+	// installing it failed, or the lease could not be decoded
+	RouteFailed = "failed"
+	// the kernel accepted it, but it could not be read back
+	RouteUnverified = "unverified"
+
+	// reasons for leaving a route out on purpose
+	RouteSkippedMismatch    = "skipped_backend_mismatch"
+	RouteSkippedUnreachable = "skipped_unreachable"
+	RouteSkippedFiltered    = "skipped_filtered"
+	RouteSkippedNotReady    = "skipped_not_ready"
+	RouteSkippedLimit       = "skipped_route_limit"
+	RouteSkippedNoData      = "skipped_no_backend_data"
+)
+
+// RouteStateReporter is implemented by backends that track the state of
+// the route to each peer subnet
+type RouteStateReporter interface {
+	// RouteStates returns the state of the route to each subnet
+	// the backend was told about, one of the Route* constants
+	RouteStates() map[ip.IP4Net]string
+}
+
+// RouteTracker is embedded by backends to implement RouteStateReporter.
+// The zero value tracks no subnets.
+type RouteTracker struct {
+	mux    sync.Mutex
+	states map[ip.IP4Net]string
+}
+
+// SetRouteState records the state of the route to sn
+func (t *RouteTracker) SetRouteState(sn ip.IP4Net, state string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.states == nil {
+		t.states = make(map[ip.IP4Net]string)
+	}
+	t.states[sn] = state
+}
+
+// ForgetRoute stops tracking sn, once its lease is gone
+func (t *RouteTracker) ForgetRoute(sn ip.IP4Net) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.states, sn)
+}
+
+func (t *RouteTracker) RouteStates() map[ip.IP4Net]string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	states := make(map[ip.IP4Net]string, len(t.states))
+	for sn, s := range t.states {
+		states[sn] = s
+	}
+	return states
+}
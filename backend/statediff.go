@@ -0,0 +1,166 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// kinds of kernel state kept by backends
+const (
+	StateRoute = "route"
+	StateFDB   = "fdb"
+	StateNeigh = "neigh"
+)
+
+// StateEntry is a route, FDB entry or neighbor identified by Key (e.g. the
+// destination of a route) with Value (e.g. "via 10.0.0.2"). Key and Value
+// are in the form the iproute2 tools show them in.
+type StateEntry struct {
+	Kind  string
+	Key   string
+	Value string
+}
+
+func (e StateEntry) String() string {
+	return fmt.Sprintf("%v %v %v", e.Kind, e.Key, e.Value)
+}
+
+// StateMismatch is an entry present in the kernel with another value than
+// the lease set implies
+type StateMismatch struct {
+	Kind    string
+	Key     string
+	Desired string
+	Actual  string
+}
+
+// StateDiff lists where the kernel state diverges from the lease set
+type StateDiff struct {
+	Missing    []StateEntry
+	Extra      []StateEntry
+	Mismatched []StateMismatch
+}
+
+// StateDiffer is implemented by backends that can compare the kernel state
+// against the one implied by the leases of the network. DiffState is
+// called instead of Init, on a backend that is not run, and must not
+// change anything.
+type StateDiffer interface {
+	DiffState(extIface *net.Interface, leases []subnet.Lease) (*StateDiff, error)
+}
+
+type stateKey struct {
+	kind, key string
+}
+
+// DiffState returns the entries of desired that are not in actual, those of
+// actual that are not in desired and those that are in both with another
+// value. An entry of actual matching one of desired in value is never
+// reported, even if others have the same key.
+func DiffState(desired, actual []StateEntry) *StateDiff {
+	have := make(map[stateKey][]string)
+	for _, e := range actual {
+		k := stateKey{e.Kind, e.Key}
+		have[k] = append(have[k], e.Value)
+	}
+
+	d := &StateDiff{}
+	for _, e := range desired {
+		k := stateKey{e.Kind, e.Key}
+		values, ok := have[k]
+		if !ok {
+			d.Missing = append(d.Missing, e)
+			continue
+		}
+
+		if i := indexOf(values, e.Value); i >= 0 {
+			have[k] = append(values[:i:i], values[i+1:]...)
+		} else {
+			d.Mismatched = append(d.Mismatched, StateMismatch{e.Kind, e.Key, e.Value, values[0]})
+			have[k] = values[1:]
+		}
+		if len(have[k]) == 0 {
+			delete(have, k)
+		}
+	}
+	for k, values := range have {
+		for _, v := range values {
+			d.Extra = append(d.Extra, StateEntry{k.kind, k.key, v})
+		}
+	}
+
+	sort.Sort(byKindAndKey(d.Missing))
+	sort.Sort(byKindAndKey(d.Extra))
+	sort.Sort(mismatchesByKindAndKey(d.Mismatched))
+	return d
+}
+
+func indexOf(values []string, v string) int {
+	for i, x := range values {
+		if x == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// Empty reports whether the kernel state matches the lease set
+func (d *StateDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mismatched) == 0
+}
+
+// Write prints d to w, one entry per line
+func (d *StateDiff) Write(w io.Writer) {
+	for _, e := range d.Missing {
+		fmt.Fprintf(w, "missing: %v\n", e)
+	}
+	for _, e := range d.Extra {
+		fmt.Fprintf(w, "extra: %v\n", e)
+	}
+	for _, m := range d.Mismatched {
+		fmt.Fprintf(w, "mismatched: %v %v %v, kernel has %v\n", m.Kind, m.Key, m.Desired, m.Actual)
+	}
+}
+
+type byKindAndKey []StateEntry
+
+func (s byKindAndKey) Len() int      { return len(s) }
+func (s byKindAndKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byKindAndKey) Less(i, j int) bool {
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	if s[i].Key != s[j].Key {
+		return s[i].Key < s[j].Key
+	}
+	return s[i].Value < s[j].Value
+}
+
+type mismatchesByKindAndKey []StateMismatch
+
+func (s mismatchesByKindAndKey) Len() int      { return len(s) }
+func (s mismatchesByKindAndKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s mismatchesByKindAndKey) Less(i, j int) bool {
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	return s[i].Key < s[j].Key
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffState(t *testing.T) {
+	desired := []StateEntry{
+		{StateRoute, "10.1.1.0/24", "via 1.1.1.1"},
+		{StateRoute, "10.1.2.0/24", "via 1.1.1.2"},
+		{StateFDB, "aa:bb:cc:00:00:01", "dst 1.1.1.1"},
+	}
+	actual := []StateEntry{
+		{StateRoute, "10.1.2.0/24", "via 1.1.1.7"},
+		{StateRoute, "10.1.1.0/24", "via 1.1.1.9"},
+		{StateRoute, "10.1.1.0/24", "via 1.1.1.1"},
+		{StateNeigh, "10.1.1.5", "lladdr aa:bb:cc:00:00:01"},
+	}
+
+	d := DiffState(desired, actual)
+	expected := &StateDiff{
+		Missing: []StateEntry{{StateFDB, "aa:bb:cc:00:00:01", "dst 1.1.1.1"}},
+		Extra: []StateEntry{
+			{StateNeigh, "10.1.1.5", "lladdr aa:bb:cc:00:00:01"},
+			// a duplicate next to the matching route
+			{StateRoute, "10.1.1.0/24", "via 1.1.1.9"},
+		},
+		Mismatched: []StateMismatch{{StateRoute, "10.1.2.0/24", "via 1.1.1.2", "via 1.1.1.7"}},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("expected %+v, got %+v", expected, d)
+	}
+
+	if !DiffState(desired, desired).Empty() {
+		t.Error("diff of matching states is not empty")
+	}
+}
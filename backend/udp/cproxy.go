@@ -28,6 +28,41 @@ import (
 	"github.com/coreos/flannel/pkg/ip"
 )
 
+// cProxy is the single threaded data path (proxy.c), it is told about
+// routes over a control socket
+type cProxy struct {
+	tun   *os.File
+	conn  *net.UDPConn
+	ctl   *os.File
+	ctl2  *os.File
+	tunIP ip.IP4
+	mtu   int
+}
+
+func newCProxy(tun *os.File, conn *net.UDPConn, tunIP ip.IP4, mtu int) (*cProxy, error) {
+	ctl, ctl2, err := newCtlSockets()
+	if err != nil {
+		return nil, err
+	}
+	return &cProxy{tun, conn, ctl, ctl2, tunIP, mtu}, nil
+}
+
+func (p *cProxy) run() {
+	runCProxy(p.tun, p.conn, p.ctl2, p.tunIP, p.mtu)
+}
+
+func (p *cProxy) setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int) {
+	setRoute(p.ctl, dst, nextHopIP, nextHopPort)
+}
+
+func (p *cProxy) removeRoute(dst ip.IP4Net) {
+	removeRoute(p.ctl, dst)
+}
+
+func (p *cProxy) stop() {
+	stopProxy(p.ctl)
+}
+
 func runCProxy(tun *os.File, conn *net.UDPConn, ctl *os.File, tunIP ip.IP4, tunMTU int) {
 	var log_errors int
 	if log.V(1) {
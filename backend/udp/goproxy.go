@@ -0,0 +1,334 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// packets queued per worker before the readers block
+const workerQueueLen = 64
+
+// goProxy is the data path used with more than one worker. A reader of
+// the TUN device and a reader of the UDP socket hand packets to the
+// workers, which do the route lookups and writes. Packets of a flow
+// always go to the same worker so that they stay in order.
+type goProxy struct {
+	tun   io.ReadWriter
+	conn  net.PacketConn
+	tunIP ip.IP4
+	mtu   int
+
+	mux    sync.RWMutex
+	routes []goRoute
+
+	bufs    sync.Pool
+	workers []chan job
+	done    chan struct{}
+	once    sync.Once
+}
+
+type goRoute struct {
+	dst     ip.IP4Net
+	nextHop *net.UDPAddr
+}
+
+type job struct {
+	buf []byte
+	pkt []byte
+	// from the TUN device, to be sent to a peer
+	encap bool
+}
+
+func newGoProxy(tun io.ReadWriter, conn net.PacketConn, tunIP ip.IP4, mtu, workers int) *goProxy {
+	p := &goProxy{
+		tun:     tun,
+		conn:    conn,
+		tunIP:   tunIP,
+		mtu:     mtu,
+		workers: make([]chan job, workers),
+		done:    make(chan struct{}),
+	}
+	p.bufs.New = func() interface{} {
+		return make([]byte, mtu)
+	}
+	for i := range p.workers {
+		p.workers[i] = make(chan job, workerQueueLen)
+	}
+	return p
+}
+
+func (p *goProxy) run() {
+	wg := sync.WaitGroup{}
+	for _, w := range p.workers {
+		wg.Add(1)
+		go func(w chan job) {
+			p.work(w)
+			wg.Done()
+		}(w)
+	}
+
+	// a reader blocked in read(2) of the TUN device only notices
+	// the stop with the next packet, so readers are not waited for
+	go p.read(p.tun.Read, true)
+	go p.read(func(b []byte) (int, error) {
+		n, _, err := p.conn.ReadFrom(b)
+		return n, err
+	}, false)
+
+	<-p.done
+	wg.Wait()
+}
+
+func (p *goProxy) stop() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	if c, ok := p.conn.(interface {
+		SetReadDeadline(t time.Time) error
+	}); ok {
+		c.SetReadDeadline(time.Now())
+	}
+}
+
+func (p *goProxy) read(read func([]byte) (int, error), encap bool) {
+	for {
+		buf := p.bufs.Get().([]byte)
+		n, err := read(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+					p.bufs.Put(buf)
+					continue
+				}
+				log.Error("UDP proxy read failed: ", err)
+				p.stop()
+			}
+			return
+		}
+
+		if n < ipv4HeaderLen {
+			if log.V(1) {
+				log.Errorf("UDP proxy received a packet too small: %v bytes", n)
+			}
+			p.bufs.Put(buf)
+			continue
+		}
+
+		pkt := buf[:n]
+		w := p.workers[flowHash(pkt)%uint32(len(p.workers))]
+		select {
+		case w <- job{buf, pkt, encap}:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *goProxy) work(jobs chan job) {
+	for {
+		select {
+		case j := <-jobs:
+			if j.encap {
+				p.tunToUDP(j.pkt)
+			} else {
+				p.udpToTun(j.pkt)
+			}
+			p.bufs.Put(j.buf)
+
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *goProxy) tunToUDP(pkt []byte) {
+	nextHop := p.findRoute(ip.FromIP(net.IP(pkt[16:20])))
+	if nextHop == nil {
+		p.sendNetUnreachable(pkt)
+		return
+	}
+
+	if !decrementTTL(pkt) {
+		return
+	}
+
+	if _, err := p.conn.WriteTo(pkt, nextHop); err != nil && log.V(1) {
+		log.Errorf("UDP send to %v failed: %v", nextHop, err)
+	}
+}
+
+func (p *goProxy) udpToTun(pkt []byte) {
+	if !decrementTTL(pkt) {
+		return
+	}
+
+	for {
+		_, err := p.tun.Write(pkt)
+		if err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil && log.V(1) {
+			log.Error("TUN send failed: ", err)
+		}
+		return
+	}
+}
+
+func (p *goProxy) setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	dst = dst.Network()
+	nextHop := &net.UDPAddr{IP: nextHopIP.ToIP(), Port: nextHopPort}
+	for i := range p.routes {
+		if p.routes[i].dst.Equal(dst) {
+			p.routes[i].nextHop = nextHop
+			return
+		}
+	}
+	p.routes = append(p.routes, goRoute{dst, nextHop})
+}
+
+func (p *goProxy) removeRoute(dst ip.IP4Net) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	dst = dst.Network()
+	for i := range p.routes {
+		if p.routes[i].dst.Equal(dst) {
+			p.routes = append(p.routes[:i], p.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *goProxy) findRoute(dst ip.IP4) *net.UDPAddr {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	for _, r := range p.routes {
+		if r.dst.Contains(dst) {
+			return r.nextHop
+		}
+	}
+	return nil
+}
+
+const (
+	ipv4HeaderLen = 20
+	icmpHeaderLen = 8
+	// options included
+	maxIPv4HeaderLen = 60
+)
+
+// flowHash hashes (FNV-1a) the addresses, protocol and, for TCP and UDP,
+// ports of pkt. The ports of fragments are left out as only the first
+// fragment carries them.
+func flowHash(pkt []byte) uint32 {
+	h := uint32(2166136261)
+	add := func(b []byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+	}
+
+	add(pkt[9:10])
+	add(pkt[12:20])
+
+	proto := pkt[9]
+	hdrLen := int(pkt[0]&0x0f) * 4
+	// mask the DF bit, leaving MF and the fragment offset
+	fragmented := binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0
+	if (proto == syscall.IPPROTO_TCP || proto == syscall.IPPROTO_UDP) && !fragmented && len(pkt) >= hdrLen+4 {
+		add(pkt[hdrLen : hdrLen+4])
+	}
+	return h
+}
+
+// decrementTTL returns false if the packet is to be discarded
+func decrementTTL(pkt []byte) bool {
+	pkt[8]--
+	if pkt[8] == 0 {
+		if log.V(1) {
+			log.Errorf("Discarding IP packet %v -> %v due to zero TTL", net.IP(pkt[12:16]), net.IP(pkt[16:20]))
+		}
+		return false
+	}
+
+	// patch up the checksum (see RFC 1624)
+	sum := uint32(binary.BigEndian.Uint16(pkt[10:12])) + 0x100
+	binary.BigEndian.PutUint16(pkt[10:12], uint16(sum+sum>>16))
+	return true
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func (p *goProxy) sendNetUnreachable(offender []byte) {
+	hdrLen := int(offender[0]&0x0f) * 4
+	if hdrLen < ipv4HeaderLen || hdrLen > maxIPv4HeaderLen || len(offender) < hdrLen+8 {
+		return
+	}
+
+	// RFC 792: no ICMPs about ICMPs, and only about first fragments
+	if offender[9] == syscall.IPPROTO_ICMP || binary.BigEndian.Uint16(offender[6:8])&0x1fff != 0 {
+		return
+	}
+
+	pkt := make([]byte, ipv4HeaderLen+icmpHeaderLen+hdrLen+8)
+
+	pkt[0] = 4<<4 | ipv4HeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 8
+	pkt[9] = syscall.IPPROTO_ICMP
+	a, b, c, d := p.tunIP.Octets()
+	pkt[12], pkt[13], pkt[14], pkt[15] = a, b, c, d
+	copy(pkt[16:20], offender[12:16])
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4HeaderLen]))
+
+	icmp := pkt[ipv4HeaderLen:]
+	icmp[0] = 3 // destination unreachable
+	icmp[1] = 0 // net unreachable
+	copy(icmp[icmpHeaderLen:], offender[:hdrLen+8])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	if _, err := p.tun.Write(pkt); err != nil && log.V(1) {
+		log.Error("Failed to send ICMP net unreachable: ", err)
+	}
+}
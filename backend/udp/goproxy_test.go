@@ -0,0 +1,303 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// fakeTun hands out what is sent on in and records what is written
+type fakeTun struct {
+	in chan []byte
+
+	mux sync.Mutex
+	out [][]byte
+}
+
+func (t *fakeTun) Read(b []byte) (int, error) {
+	pkt, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, pkt), nil
+}
+
+func (t *fakeTun) Write(b []byte) (int, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.out = append(t.out, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (t *fakeTun) written() [][]byte {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.out
+}
+
+// fakeConn hands out what is sent on in and records what is sent,
+// taking a while now and then to give other workers a chance to overtake
+type fakeConn struct {
+	net.PacketConn
+	in      chan []byte
+	stopped chan struct{}
+	once    sync.Once
+
+	mux sync.Mutex
+	out [][]byte
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(b, pkt), nil, nil
+	case <-c.stopped:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if rand.Intn(10) == 0 {
+		time.Sleep(50 * time.Microsecond)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.out = append(c.out, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.once.Do(func() {
+		close(c.stopped)
+	})
+	return nil
+}
+
+func (c *fakeConn) written() [][]byte {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.out
+}
+
+func newFakes() (*fakeTun, *fakeConn) {
+	return &fakeTun{in: make(chan []byte)}, &fakeConn{in: make(chan []byte), stopped: make(chan struct{})}
+}
+
+// testPacket is a UDP datagram of flow sport carrying seq
+func testPacket(src, dst string, sport uint16, seq uint32) []byte {
+	pkt := make([]byte, ipv4HeaderLen+8+4)
+	pkt[0] = 4<<4 | ipv4HeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = syscall.IPPROTO_UDP
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4HeaderLen]))
+
+	binary.BigEndian.PutUint16(pkt[20:22], sport)
+	binary.BigEndian.PutUint16(pkt[22:24], 80)
+	binary.BigEndian.PutUint32(pkt[28:32], seq)
+	return pkt
+}
+
+func mustParseIP4Net(t testing.TB, s string) ip.IP4Net {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip.FromIPNet(n)
+}
+
+func waitForPackets(t *testing.T, written func() [][]byte, n int) [][]byte {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pkts := written()
+		if len(pkts) >= n {
+			return pkts
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v packets, got %v", n, len(pkts))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkFlowOrder fails if the packets of a flow are out of order
+func checkFlowOrder(t *testing.T, dir string, pkts [][]byte) {
+	last := make(map[uint16]uint32)
+	for _, pkt := range pkts {
+		if pkt[8] != 63 {
+			t.Errorf("%v: TTL not decremented: %v", dir, pkt[8])
+		}
+		if checksum(pkt[:ipv4HeaderLen]) != 0 {
+			t.Errorf("%v: bad IP header checksum after decrementing TTL", dir)
+		}
+
+		flow := binary.BigEndian.Uint16(pkt[20:22])
+		seq := binary.BigEndian.Uint32(pkt[28:32])
+		if prev, ok := last[flow]; ok && seq != prev+1 {
+			t.Fatalf("%v: packet %v of flow %v follows %v", dir, seq, flow, prev)
+		}
+		last[flow] = seq
+	}
+}
+
+func TestGoProxyFlowOrdering(t *testing.T) {
+	const flows, perFlow = 16, 200
+
+	tun, conn := newFakes()
+	p := newGoProxy(tun, conn, ip.FromIP(net.ParseIP("10.1.1.0")), 1472, 4)
+	p.setRoute(mustParseIP4Net(t, "10.1.2.0/24"), ip.FromIP(net.ParseIP("1.1.1.2")), defaultPort)
+	p.setRoute(mustParseIP4Net(t, "10.1.3.0/24"), ip.FromIP(net.ParseIP("1.1.1.3")), defaultPort)
+
+	go p.run()
+	defer func() {
+		p.stop()
+		close(tun.in)
+	}()
+
+	go func() {
+		for seq := uint32(0); seq < perFlow; seq++ {
+			for f := 0; f < flows; f++ {
+				dst := fmt.Sprintf("10.1.%v.%v", 2+f%2, 2+f)
+				tun.in <- testPacket("10.1.1.2", dst, uint16(1000+f), seq)
+				conn.in <- testPacket(dst, "10.1.1.2", uint16(1000+f), seq)
+			}
+		}
+	}()
+
+	checkFlowOrder(t, "encap", waitForPackets(t, conn.written, flows*perFlow))
+	checkFlowOrder(t, "decap", waitForPackets(t, tun.written, flows*perFlow))
+}
+
+func TestGoProxyNetUnreachable(t *testing.T) {
+	tun, conn := newFakes()
+	p := newGoProxy(tun, conn, ip.FromIP(net.ParseIP("10.1.1.0")), 1472, 2)
+	go p.run()
+	defer func() {
+		p.stop()
+		close(tun.in)
+	}()
+
+	tun.in <- testPacket("10.1.1.2", "10.1.9.2", 1000, 0)
+
+	icmp := waitForPackets(t, tun.written, 1)[0]
+	if icmp[9] != syscall.IPPROTO_ICMP || icmp[20] != 3 || icmp[21] != 0 {
+		t.Fatalf("expected an ICMP net unreachable, got %v", icmp)
+	}
+	if !net.IP(icmp[16:20]).Equal(net.ParseIP("10.1.1.2")) {
+		t.Errorf("ICMP sent to %v instead of the sender", net.IP(icmp[16:20]))
+	}
+	if checksum(icmp[:ipv4HeaderLen]) != 0 || checksum(icmp[ipv4HeaderLen:]) != 0 {
+		t.Error("bad ICMP checksums")
+	}
+	if len(conn.written()) != 0 {
+		t.Error("packet without a route was sent")
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	a := testPacket("10.1.1.2", "10.1.2.2", 1000, 0)
+	b := testPacket("10.1.1.2", "10.1.2.2", 1000, 1)
+	c := testPacket("10.1.1.2", "10.1.2.2", 1001, 0)
+
+	if flowHash(a) != flowHash(b) {
+		t.Error("packets of a flow hash differently")
+	}
+	if flowHash(a) == flowHash(c) {
+		t.Error("ports are not hashed")
+	}
+
+	// MF set: ports are not hashed as later fragments lack them
+	binary.BigEndian.PutUint16(a[6:8], 0x2000)
+	binary.BigEndian.PutUint16(c[6:8], 0x2000)
+	if flowHash(a) != flowHash(c) {
+		t.Error("ports of a fragment are hashed")
+	}
+}
+
+// countingConn counts the packets sent and closes sent after n of them
+type countingConn struct {
+	*net.UDPConn
+	count int64
+	n     int64
+	sent  chan struct{}
+}
+
+func (c *countingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.UDPConn.WriteTo(b, addr)
+	if atomic.AddInt64(&c.count, 1) == c.n {
+		close(c.sent)
+	}
+	return n, err
+}
+
+func benchmarkGoProxy(b *testing.B, workers int) {
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	conn := &countingConn{UDPConn: c, n: int64(b.N), sent: make(chan struct{})}
+
+	pkts := make([][]byte, 64)
+	for f := range pkts {
+		pkts[f] = testPacket("10.1.1.2", "10.1.2.2", uint16(1000+f), 0)
+		pkts[f] = append(pkts[f], make([]byte, 1400)...)
+	}
+
+	tun := &fakeTun{in: make(chan []byte, 1024)}
+	p := newGoProxy(tun, conn, ip.FromIP(net.ParseIP("10.1.1.0")), 1472, workers)
+	sinkAddr := sink.LocalAddr().(*net.UDPAddr)
+	p.setRoute(mustParseIP4Net(b, "10.1.2.0/24"), ip.FromIP(sinkAddr.IP), sinkAddr.Port)
+
+	go p.run()
+	defer func() {
+		p.stop()
+		close(tun.in)
+	}()
+
+	b.SetBytes(int64(len(pkts[0])))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			tun.in <- pkts[i%len(pkts)]
+		}
+	}()
+	<-conn.sent
+}
+
+func BenchmarkGoProxy1Worker(b *testing.B)  { benchmarkGoProxy(b, 1) }
+func BenchmarkGoProxy2Workers(b *testing.B) { benchmarkGoProxy(b, 2) }
+func BenchmarkGoProxy4Workers(b *testing.B) { benchmarkGoProxy(b, 4) }
+func BenchmarkGoProxy8Workers(b *testing.B) { benchmarkGoProxy(b, 8) }
@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// socket options of the encapsulation socket, zero values leave the
+// kernel defaults in place
+type socketConfig struct {
+	SendBuffer int
+	RecvBuffer int
+	Mark       int
+	DSCP       int
+}
+
+// sockopts is the subset of setsockopt(2)/getsockopt(2) used to tune the socket
+type sockopts interface {
+	SetsockoptInt(level, opt, value int) error
+	GetsockoptInt(level, opt int) (int, error)
+}
+
+type fdSockopts int
+
+func (fd fdSockopts) SetsockoptInt(level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
+
+func (fd fdSockopts) GetsockoptInt(level, opt int) (int, error) {
+	return syscall.GetsockoptInt(int(fd), level, opt)
+}
+
+func (cfg *socketConfig) validate() error {
+	if cfg.SendBuffer < 0 || cfg.RecvBuffer < 0 {
+		return fmt.Errorf("socket buffer sizes must not be negative")
+	}
+	if cfg.DSCP < 0 || cfg.DSCP > 63 {
+		return fmt.Errorf("DSCP must be between 0 and 63, got %v", cfg.DSCP)
+	}
+	return nil
+}
+
+func configureSocket(s sockopts, cfg *socketConfig) error {
+	if cfg.SendBuffer > 0 {
+		if err := s.SetsockoptInt(syscall.SOL_SOCKET, syscall.SO_SNDBUF, cfg.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set SO_SNDBUF: %v", err)
+		}
+	}
+
+	if cfg.RecvBuffer > 0 {
+		if err := s.SetsockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUF, cfg.RecvBuffer); err != nil {
+			return fmt.Errorf("failed to set SO_RCVBUF: %v", err)
+		}
+	}
+
+	if cfg.Mark > 0 {
+		if err := s.SetsockoptInt(syscall.SOL_SOCKET, syscall.SO_MARK, cfg.Mark); err != nil {
+			return fmt.Errorf("failed to set SO_MARK: %v", err)
+		}
+	}
+
+	if cfg.DSCP > 0 {
+		// DSCP occupies the upper six bits of the TOS byte
+		if err := s.SetsockoptInt(syscall.IPPROTO_IP, syscall.IP_TOS, cfg.DSCP<<2); err != nil {
+			return fmt.Errorf("failed to set IP_TOS: %v", err)
+		}
+	}
+
+	// the kernel doubles (and clamps) the requested buffer sizes
+	// so report what we actually ended up with
+	sndbuf, err := s.GetsockoptInt(syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if err != nil {
+		return fmt.Errorf("failed to get SO_SNDBUF: %v", err)
+	}
+	rcvbuf, err := s.GetsockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		return fmt.Errorf("failed to get SO_RCVBUF: %v", err)
+	}
+	log.Infof("UDP socket buffers: send=%v receive=%v", sndbuf, rcvbuf)
+
+	return nil
+}
+
+func configureConn(conn *net.UDPConn, cfg *socketConfig) error {
+	// unlike File(), this leaves the socket non-blocking for the
+	// Go proxy's reads and writes
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cerr error
+	if err := rc.Control(func(fd uintptr) {
+		cerr = configureSocket(fdSockopts(fd), cfg)
+	}); err != nil {
+		return err
+	}
+	return cerr
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type sockopt struct {
+	level, opt int
+}
+
+type mockSockopts struct {
+	set map[sockopt]int
+}
+
+func (m *mockSockopts) SetsockoptInt(level, opt, value int) error {
+	m.set[sockopt{level, opt}] = value
+	return nil
+}
+
+func (m *mockSockopts) GetsockoptInt(level, opt int) (int, error) {
+	// mimic the kernel doubling buffer sizes
+	return 2 * m.set[sockopt{level, opt}], nil
+}
+
+func TestConfigureSocket(t *testing.T) {
+	s := &mockSockopts{set: make(map[sockopt]int)}
+	cfg := &socketConfig{
+		SendBuffer: 1 << 20,
+		RecvBuffer: 2 << 20,
+		Mark:       0x42,
+		DSCP:       46,
+	}
+
+	if err := configureSocket(s, cfg); err != nil {
+		t.Fatalf("configureSocket failed: %v", err)
+	}
+
+	expected := map[sockopt]int{
+		{syscall.SOL_SOCKET, syscall.SO_SNDBUF}: 1 << 20,
+		{syscall.SOL_SOCKET, syscall.SO_RCVBUF}: 2 << 20,
+		{syscall.SOL_SOCKET, syscall.SO_MARK}:   0x42,
+		{syscall.IPPROTO_IP, syscall.IP_TOS}:    46 << 2,
+	}
+
+	for o, v := range expected {
+		if s.set[o] != v {
+			t.Errorf("sockopt %v: expected %v, got %v", o, v, s.set[o])
+		}
+	}
+}
+
+func TestConfigureSocketDefaults(t *testing.T) {
+	s := &mockSockopts{set: make(map[sockopt]int)}
+
+	if err := configureSocket(s, &socketConfig{}); err != nil {
+		t.Fatalf("configureSocket failed: %v", err)
+	}
+
+	if len(s.set) != 0 {
+		t.Errorf("configureSocket set options with default config: %v", s.set)
+	}
+}
+
+func TestSocketConfigValidate(t *testing.T) {
+	for _, cfg := range []socketConfig{{DSCP: 64}, {DSCP: -1}, {SendBuffer: -1}} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("validate accepted %+v", cfg)
+		}
+	}
+}
+
+func TestConfigureConnNonBlocking(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := configureConn(conn, &socketConfig{RecvBuffer: 1 << 16}); err != nil {
+		t.Fatalf("configureConn failed: %v", err)
+	}
+
+	// deadlines only hold for sockets left non-blocking
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Errorf("expected the read to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("read past its deadline still blocked, the socket was made blocking")
+		// unblock it
+		if c, err := net.Dial("udp", conn.LocalAddr().String()); err == nil {
+			c.Write([]byte{0})
+			c.Close()
+		}
+		<-done
+	}
+}
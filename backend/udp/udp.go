@@ -16,6 +16,7 @@ package udp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -34,6 +35,8 @@ import (
 const (
 	encapOverhead = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
 	defaultPort   = 8285
+
+	defaultDeviceName = "flannel%d"
 )
 
 type UdpBackend struct {
@@ -42,17 +45,37 @@ type UdpBackend struct {
 	config  *subnet.Config
 	cfg     struct {
 		Port int
+		// name of the TUN device, %d is replaced by the
+		// first number that makes it unique
+		DeviceName string
+		// goroutines moving packets, flows are spread over them
+		Workers int
+		socketConfig
+		backend.EgressLimit
 	}
-	lease  *subnet.Lease
-	ctl    *os.File
-	ctl2   *os.File
-	tun    *os.File
-	conn   *net.UDPConn
-	mtu    int
-	tunNet ip.IP4Net
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	lease    *subnet.Lease
+	proxy    proxy
+	tun      *os.File
+	tunName  string
+	tunIndex int
+	conn     *net.UDPConn
+	mtu      int
+	tunNet   ip.IP4Net
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	backend.ReadyFlag
+	backend.HealthState
+	backend.RouteTracker
+	backend.LinkState
+}
+
+// proxy moves packets between the TUN device and the UDP socket
+type proxy interface {
+	run()
+	setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int)
+	removeRoute(dst ip.IP4Net)
+	stop()
 }
 
 func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backend {
@@ -66,9 +89,17 @@ func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backe
 		cancel:  cancel,
 	}
 	be.cfg.Port = defaultPort
+	be.cfg.DeviceName = defaultDeviceName
 	return &be
 }
 
+// Capabilities lists what the host needs to run the UDP backend
+func Capabilities() []backend.Capability {
+	return []backend.Capability{
+		backend.DeviceNode("TUN device", "/dev/net/tun"),
+	}
+}
+
 func (m *UdpBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
 	// Parse our configuration
 	if len(m.config.Backend) > 0 {
@@ -77,6 +108,19 @@ func (m *UdpBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Subne
 		}
 	}
 
+	if err := m.cfg.socketConfig.validate(); err != nil {
+		return nil, fmt.Errorf("invalid UDP backend config: %v", err)
+	}
+	if m.cfg.Workers < 0 {
+		return nil, fmt.Errorf("invalid UDP backend config: Workers must not be negative")
+	}
+	if err := backend.ValidateDeviceName(m.cfg.DeviceName); err != nil {
+		return nil, fmt.Errorf("invalid UDP backend config: %v", err)
+	}
+	if err := m.cfg.EgressLimit.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid UDP backend config: %v", err)
+	}
+
 	// Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(extIP),
@@ -94,12 +138,7 @@ func (m *UdpBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Subne
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
-	// Tunnel's subnet is that of the whole overlay network (e.g. /16)
-	// and not that of the individual host (e.g. /24)
-	m.tunNet = ip.IP4Net{
-		IP:        l.Subnet.IP,
-		PrefixLen: m.config.Network.PrefixLen,
-	}
+	m.tunNet = backend.DeviceNet(m.config, l.Subnet)
 
 	// TUN MTU will be smaller b/c of encap (IP+UDP hdrs)
 	m.mtu = extIface.MTU - encapOverhead
@@ -113,14 +152,24 @@ func (m *UdpBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Subne
 		return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
 	}
 
-	m.ctl, m.ctl2, err = newCtlSockets()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create control socket: %v", err)
+	if err = configureConn(m.conn, &m.cfg.socketConfig); err != nil {
+		return nil, fmt.Errorf("failed to configure UDP socket: %v", err)
+	}
+
+	if m.cfg.Workers > 1 {
+		log.Infof("Spreading UDP encapsulation over %v workers", m.cfg.Workers)
+		m.proxy = newGoProxy(m.tun, m.conn, m.tunNet.IP, m.mtu, m.cfg.Workers)
+	} else {
+		m.proxy, err = newCProxy(m.tun, m.conn, m.tunNet.IP, m.mtu)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create control socket: %v", err)
+		}
 	}
 
 	return &backend.SubnetDef{
-		Net: l.Subnet,
-		MTU: m.mtu,
+		Net:       l.Subnet,
+		MTU:       m.mtu,
+		LinkIndex: m.tunIndex,
 	}, nil
 }
 
@@ -129,7 +178,10 @@ func (m *UdpBackend) Run() {
 	m.wg.Add(2)
 
 	go func() {
-		runCProxy(m.tun, m.conn, m.ctl2, m.tunNet.IP, m.mtu)
+		m.proxy.run()
+		if m.ctx.Err() == nil {
+			m.SetDegraded("proxy", errors.New("packet proxy exited"))
+		}
 		m.wg.Done()
 	}()
 
@@ -141,11 +193,12 @@ func (m *UdpBackend) Run() {
 	m.monitorEvents()
 
 	m.wg.Wait()
+	m.cfg.EgressLimit.Remove(m.tunName)
 }
 
 func (m *UdpBackend) Stop() {
-	if m.ctl != nil {
-		stopProxy(m.ctl)
+	if m.proxy != nil {
+		m.proxy.stop()
 	}
 
 	m.cancel()
@@ -167,55 +220,55 @@ func newCtlSockets() (*os.File, *os.File, error) {
 }
 
 func (m *UdpBackend) initTun() error {
-	var tunName string
 	var err error
 
-	m.tun, tunName, err = ip.OpenTun("flannel%d")
+	m.tun, m.tunName, err = ip.OpenTun(m.cfg.DeviceName)
 	if err != nil {
 		return fmt.Errorf("Failed to open TUN device: %v", err)
 	}
 
-	err = configureIface(tunName, m.tunNet, m.mtu)
+	m.tunIndex, err = m.configureIface(m.tunName, m.tunNet, m.mtu)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return m.cfg.EgressLimit.Apply(m.tunName)
 }
 
-func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
+// configureIface sets up the TUN device and returns its index
+func (m *UdpBackend) configureIface(ifname string, ipn ip.IP4Net, mtu int) (int, error) {
 	iface, err := netlink.LinkByName(ifname)
 	if err != nil {
-		return fmt.Errorf("failed to lookup interface %v", ifname)
+		return 0, fmt.Errorf("failed to lookup interface %v", ifname)
 	}
 
 	err = netlink.AddrAdd(iface, &netlink.Addr{ipn.ToIPNet(), ""})
 	if err != nil {
-		return fmt.Errorf("failed to add IP address %v to %v: %v", ipn.String(), ifname, err)
+		return 0, fmt.Errorf("failed to add IP address %v to %v: %v", ipn.String(), ifname, err)
 	}
 
 	err = netlink.LinkSetMTU(iface, mtu)
 	if err != nil {
-		return fmt.Errorf("failed to set MTU for %v: %v", ifname, err)
+		return 0, fmt.Errorf("failed to set MTU for %v: %v", ifname, err)
 	}
 
-	err = netlink.LinkSetUp(iface)
-	if err != nil {
-		return fmt.Errorf("failed to set interface %v to UP state: %v", ifname, err)
+	if err = m.BringUp(m.ctx, iface); err != nil {
+		return 0, err
 	}
 
-	// explicitly add a route since there might be a route for a subnet already
-	// installed by Docker and then it won't get auto added
-	err = netlink.RouteAdd(&netlink.Route{
+	// explicitly install a route since there might be a route for a subnet already
+	// installed by Docker and then it won't get auto added; replace it
+	// rather than keep it, it points somewhere else
+	err = ip.ReplaceLinkRoute(&netlink.Route{
 		LinkIndex: iface.Attrs().Index,
 		Scope:     netlink.SCOPE_UNIVERSE,
 		Dst:       ipn.Network().ToIPNet(),
 	})
-	if err != nil && err != syscall.EEXIST {
-		return fmt.Errorf("Failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
 	}
 
-	return nil
+	return iface.Attrs().Index, nil
 }
 
 func (m *UdpBackend) monitorEvents() {
@@ -225,14 +278,19 @@ func (m *UdpBackend) monitorEvents() {
 
 	m.wg.Add(1)
 	go func() {
-		subnet.WatchLeases(m.ctx, m.sm, m.network, evts)
+		subnet.WatchLeasesMarked(m.ctx, m.sm, m.network, evts)
 		m.wg.Done()
 	}()
 
 	for {
 		select {
 		case evtBatch := <-evts:
-			m.processSubnetEvents(evtBatch)
+			batch, done := subnet.SplitSnapshotDone(evtBatch)
+			m.processSubnetEvents(batch)
+			if done {
+				// routes to the existing leases are in place
+				m.SetReady()
+			}
 
 		case <-m.ctx.Done():
 			return
@@ -240,18 +298,30 @@ func (m *UdpBackend) monitorEvents() {
 	}
 }
 
+func (m *UdpBackend) notify(l *subnet.Lease, action string) {
+	c := backend.RouteChange{Network: m.network, Subnet: l.Subnet, Action: action}
+	if l.Attrs != nil {
+		c.PeerIP = l.Attrs.PublicIP
+	}
+	backend.NotifyRouteChange(m.sm, c)
+}
+
 func (m *UdpBackend) processSubnetEvents(batch []subnet.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.SubnetAdded:
 			log.Info("Subnet added: ", evt.Lease.Subnet)
 
-			setRoute(m.ctl, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, m.cfg.Port)
+			m.proxy.setRoute(evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, m.cfg.Port)
+			m.SetRouteState(evt.Lease.Subnet, backend.RouteInstalled)
+			m.notify(&evt.Lease, backend.RouteAdded)
 
 		case subnet.SubnetRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
 
-			removeRoute(m.ctl, evt.Lease.Subnet)
+			m.proxy.removeRoute(evt.Lease.Subnet)
+			m.ForgetRoute(evt.Lease.Subnet)
+			m.notify(&evt.Lease, backend.RouteRemoved)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
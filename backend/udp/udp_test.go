@@ -0,0 +1,66 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// routeRecorder is a proxy that only records its routes
+type routeRecorder struct {
+	routes map[ip.IP4Net]ip.IP4
+}
+
+func (p *routeRecorder) run()  {}
+func (p *routeRecorder) stop() {}
+
+func (p *routeRecorder) setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int) {
+	p.routes[dst] = nextHopIP
+}
+
+func (p *routeRecorder) removeRoute(dst ip.IP4Net) {
+	delete(p.routes, dst)
+}
+
+func TestEmptyBackendData(t *testing.T) {
+	m := New(nil, "", &subnet.Config{}).(*UdpBackend)
+	p := &routeRecorder{routes: make(map[ip.IP4Net]ip.IP4)}
+	m.proxy = p
+
+	pip := ip.FromIP(net.ParseIP("192.168.0.1"))
+	leases := []subnet.Lease{
+		{Subnet: mustParseIP4Net(t, "10.1.1.0/24"), Attrs: &subnet.LeaseAttrs{PublicIP: pip}},
+		{Subnet: mustParseIP4Net(t, "10.1.2.0/24"), Attrs: &subnet.LeaseAttrs{PublicIP: pip, BackendData: json.RawMessage("null")}},
+	}
+	m.processSubnetEvents([]subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: leases[0]},
+		{Type: subnet.SubnetAdded, Lease: leases[1]},
+	})
+
+	for _, l := range leases {
+		if p.routes[l.Subnet] != pip {
+			t.Errorf("no route to %v, udp needs no backend data", l.Subnet)
+		}
+		if s := m.RouteStates()[l.Subnet]; s != backend.RouteInstalled {
+			t.Errorf("route to %v is %q", l.Subnet, s)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// RouteVerifier is implemented by backends that can read the routes (or
+// FDB entries) they install back. SetVerifyRoutes, called before Init,
+// has them check that each one took effect rather than trusting the
+// kernel's reply.
+type RouteVerifier interface {
+	SetVerifyRoutes()
+}
+
+// VerifyError is returned by Install for an entry that was installed
+// without an error but could not be read back
+type VerifyError struct {
+	Err error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("installed but not in effect: %v", e.Err)
+}
+
+// FailedRouteState is the state of a route that installing failed with err
+func FailedRouteState(err error) string {
+	if _, ok := err.(*VerifyError); ok {
+		return RouteUnverified
+	}
+	return RouteFailed
+}
+
+// VerifyState is embedded by backends to implement RouteVerifier. The
+// zero value does not verify.
+type VerifyState struct {
+	verify bool
+}
+
+func (v *VerifyState) SetVerifyRoutes() {
+	v.verify = true
+}
+
+// Install calls install and, when verifying, check to read the entry
+// back. An entry that check doesn't find is installed once more before
+// giving up with a *VerifyError.
+func (v *VerifyState) Install(install, check func() error) error {
+	if err := install(); err != nil || !v.verify {
+		return err
+	}
+
+	err := check()
+	if err == nil {
+		return nil
+	}
+	log.Warningf("Installed entry is not in effect, installing it again: %v", err)
+
+	if err := install(); err != nil {
+		return err
+	}
+	if err := check(); err != nil {
+		return &VerifyError{err}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// bpf(2) commands
+const (
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfMapGetNextKey = 4
+	bpfObjGet        = 7
+)
+
+// set by the arch specific files; zero means bpf(2) is not known
+var sysBPF uintptr
+
+type bpfObjGetAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpfMap is a BPF map pinned to bpffs by whoever loaded the XDP program
+type bpfMap struct {
+	fd int
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	if sysBPF == 0 {
+		return 0, fmt.Errorf("bpf(2) is not supported on this architecture")
+	}
+
+	r, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func openPinnedBPFMap(path string) (fastPathMap, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	attr := bpfObjGetAttr{pathname: uint64(uintptr(unsafe.Pointer(p)))}
+	fd, err := bpf(bpfObjGet, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	// the attr only holds p as an integer
+	runtime.KeepAlive(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pinned BPF map %v: %v", path, err)
+	}
+
+	return &bpfMap{int(fd)}, nil
+}
+
+func (m *bpfMap) Update(key, value []byte) error {
+	attr := bpfMapElemAttr{
+		mapFd: uint32(m.fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func (m *bpfMap) Delete(key []byte) error {
+	attr := bpfMapElemAttr{
+		mapFd: uint32(m.fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+	}
+	_, err := bpf(bpfMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func (m *bpfMap) Keys() ([][]byte, error) {
+	var keys [][]byte
+	var cur []byte
+	for {
+		next := make([]byte, fastPathKeySize)
+		attr := bpfMapElemAttr{
+			mapFd: uint32(m.fd),
+			// the value field holds the next key
+			value: uint64(uintptr(unsafe.Pointer(&next[0]))),
+		}
+		// no key starts at the first one
+		if cur != nil {
+			attr.key = uint64(uintptr(unsafe.Pointer(&cur[0])))
+		}
+		_, err := bpf(bpfMapGetNextKey, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(cur)
+		runtime.KeepAlive(next)
+		switch {
+		case err == syscall.ENOENT:
+			return keys, nil
+		case err != nil:
+			return nil, err
+		}
+		keys = append(keys, next)
+		cur = next
+	}
+}
+
+func (m *bpfMap) Close() error {
+	return syscall.Close(m.fd)
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink/nl"
+)
+
+// IFLA_VXLAN_* attributes missing from the vendored netlink
+const (
+	iflaVxlanUDPCSum        = 18 // IFLA_VXLAN_UDP_CSUM
+	iflaVxlanUDPZeroCSum6Tx = 19 // IFLA_VXLAN_UDP_ZERO_CSUM6_TX
+	iflaVxlanUDPZeroCSum6Rx = 20 // IFLA_VXLAN_UDP_ZERO_CSUM6_RX
+)
+
+// checksumConfig is the UDP checksum behaviour of the VXLAN device,
+// unset fields leave it to the kernel
+type checksumConfig struct {
+	// UDPCSum computes checksums of encapsulated IPv4 packets
+	UDPCSum *bool
+	// UDP6ZeroCSumTx/Rx send and accept encapsulated IPv6
+	// packets without a checksum
+	UDP6ZeroCSumTx *bool
+	UDP6ZeroCSumRx *bool
+}
+
+func (c *checksumConfig) isDefault() bool {
+	return c.UDPCSum == nil && c.UDP6ZeroCSumTx == nil && c.UDP6ZeroCSumRx == nil
+}
+
+func boolAttr(v bool) []byte {
+	if v {
+		return nl.Uint8Attr(1)
+	}
+	return nl.Uint8Attr(0)
+}
+
+func (c *checksumConfig) attrs() []*nl.RtAttr {
+	attrs := []*nl.RtAttr{}
+	for _, a := range []struct {
+		typ int
+		val *bool
+	}{
+		{iflaVxlanUDPCSum, c.UDPCSum},
+		{iflaVxlanUDPZeroCSum6Tx, c.UDP6ZeroCSumTx},
+		{iflaVxlanUDPZeroCSum6Rx, c.UDP6ZeroCSumRx},
+	} {
+		if a.val != nil {
+			attrs = append(attrs, nl.NewRtAttr(a.typ, boolAttr(*a.val)))
+		}
+	}
+	return attrs
+}
+
+// creates the VXLAN link; replaced in tests
+var linkAdd = addVxlanLink
+
+// addVxlanLink is netlink.LinkAdd, with the checksum attributes added
+// to the request if any are set
+func addVxlanLink(link *netlink.Vxlan, csum checksumConfig) error {
+	if csum.isDefault() {
+		return netlink.LinkAdd(link)
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(link.Name)))
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(link.Type()))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	for _, attr := range vxlanInfoData(link, csum) {
+		nl.NewRtAttrChild(data, int(attr.Type), attr.Data)
+	}
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return err
+	}
+
+	// netlink.LinkAdd fills in the index, so do we
+	created, err := netlink.LinkByName(link.Name)
+	if err != nil {
+		return err
+	}
+	link.Index = created.Attrs().Index
+	return nil
+}
+
+// vxlanInfoData returns the IFLA_INFO_DATA attributes of the fields of
+// link that flannel sets
+func vxlanInfoData(link *netlink.Vxlan, csum checksumConfig) []*nl.RtAttr {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(nl.IFLA_VXLAN_ID, nl.Uint32Attr(uint32(link.VxlanId))),
+		nl.NewRtAttr(nl.IFLA_VXLAN_LEARNING, boolAttr(link.Learning)),
+	}
+	if link.VtepDevIndex != 0 {
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_VXLAN_LINK, nl.Uint32Attr(uint32(link.VtepDevIndex))))
+	}
+	if ip := link.SrcAddr.To4(); ip != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_VXLAN_LOCAL, []byte(ip)))
+	}
+	if link.Age > 0 {
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_VXLAN_AGEING, nl.Uint32Attr(uint32(link.Age))))
+	}
+	if link.Port > 0 {
+		// the kernel takes the port in network order
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(link.Port))
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_VXLAN_PORT, port))
+	}
+	return append(attrs, csum.attrs()...)
+}
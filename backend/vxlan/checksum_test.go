@@ -0,0 +1,79 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+)
+
+func TestChecksumPassedToLinkAdd(t *testing.T) {
+	var cfg struct {
+		VNI int
+		checksumConfig
+	}
+	backend := `{"VNI": 1, "UDPCSum": true, "UDP6ZeroCSumTx": false, "UDP6ZeroCSumRx": true}`
+	if err := json.Unmarshal([]byte(backend), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var added checksumConfig
+	linkAdd = func(link *netlink.Vxlan, csum checksumConfig) error {
+		added = csum
+		return errors.New("not creating links in tests")
+	}
+	defer func() {
+		linkAdd = addVxlanLink
+	}()
+
+	if _, err := newVXLANDevice(&vxlanDeviceAttrs{vni: 1, name: "flannel.1", csum: cfg.checksumConfig}); err == nil {
+		t.Fatal("newVXLANDevice succeeded without a link")
+	}
+
+	if added.UDPCSum == nil || !*added.UDPCSum {
+		t.Errorf("UDPCSum not passed through: %v", added.UDPCSum)
+	}
+	if added.UDP6ZeroCSumTx == nil || *added.UDP6ZeroCSumTx {
+		t.Errorf("UDP6ZeroCSumTx not passed through: %v", added.UDP6ZeroCSumTx)
+	}
+	if added.UDP6ZeroCSumRx == nil || !*added.UDP6ZeroCSumRx {
+		t.Errorf("UDP6ZeroCSumRx not passed through: %v", added.UDP6ZeroCSumRx)
+	}
+
+	expected := map[uint16]byte{
+		iflaVxlanUDPCSum:        1,
+		iflaVxlanUDPZeroCSum6Tx: 0,
+		iflaVxlanUDPZeroCSum6Rx: 1,
+	}
+	found := 0
+	for _, attr := range vxlanInfoData(&netlink.Vxlan{VxlanId: 1}, added) {
+		if v, ok := expected[attr.Type]; ok {
+			found++
+			if len(attr.Data) != 1 || attr.Data[0] != v {
+				t.Errorf("attribute %v is %v, expected %v", attr.Type, attr.Data, v)
+			}
+		}
+	}
+	if found != len(expected) {
+		t.Errorf("expected %v checksum attributes in the request, got %v", len(expected), found)
+	}
+
+	if !(&checksumConfig{}).isDefault() || len((&checksumConfig{}).attrs()) != 0 {
+		t.Error("unset checksum config is not left to the kernel")
+	}
+}
@@ -34,6 +34,12 @@ type vxlanDeviceAttrs struct {
 	vtepIndex int
 	vtepAddr  net.IP
 	vtepPort  int
+	ageing    int
+	csum      checksumConfig
+	// static disables resolving neighbors on L3 misses
+	static bool
+	// hwAddr, if set, is assigned to the device
+	hwAddr net.HardwareAddr
 }
 
 type vxlanDevice struct {
@@ -61,23 +67,37 @@ func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
 		SrcAddr:      devAttrs.vtepAddr,
 		Port:         devAttrs.vtepPort,
 		Learning:     false,
+		Age:          devAttrs.ageing,
 	}
 
-	link, err := ensureLink(link)
+	link, err := ensureLink(link, devAttrs.csum)
 	if err != nil {
 		return nil, err
 	}
-	// this enables ARP requests being sent to userspace via netlink
+
+	if len(devAttrs.hwAddr) > 0 {
+		if err := netlink.LinkSetHardwareAddr(link, devAttrs.hwAddr); err != nil {
+			return nil, fmt.Errorf("failed to set %v address to %v: %v", devAttrs.name, devAttrs.hwAddr, err)
+		}
+		link.HardwareAddr = devAttrs.hwAddr
+	}
+
+	// this enables ARP requests being sent to userspace via netlink;
+	// reset explicitly as an existing device is reused
+	solicit := "3"
+	if devAttrs.static {
+		solicit = "0"
+	}
 	sysctlPath := fmt.Sprintf("/proc/sys/net/ipv4/neigh/%s/app_solicit", devAttrs.name)
-	sysctlSet(sysctlPath, "3")
+	sysctlSet(sysctlPath, solicit)
 
 	return &vxlanDevice{
 		link: link,
 	}, nil
 }
 
-func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
-	err := netlink.LinkAdd(vxlan)
+func ensureLink(vxlan *netlink.Vxlan, csum checksumConfig) (*netlink.Vxlan, error) {
+	err := linkAdd(vxlan, csum)
 	if err == syscall.EEXIST {
 		// it's ok if the device already exists as long as config is similar
 		existing, err := netlink.LinkByName(vxlan.Name)
@@ -92,12 +112,12 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 
 		// delete existing
 		log.Warningf("%q already exists with incompatable configuration: %v; recreating device", vxlan.Name, incompat)
-		if err = netlink.LinkDel(existing); err != nil {
+		if err = linkDel(existing); err != nil {
 			return nil, fmt.Errorf("failed to delete interface: %v", err)
 		}
 
 		// create new
-		if err = netlink.LinkAdd(vxlan); err != nil {
+		if err = linkAdd(vxlan, csum); err != nil {
 			return nil, fmt.Errorf("failed to create vxlan interface: %v", err)
 		}
 	} else if err != nil {
@@ -117,29 +137,37 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 	return vxlan, nil
 }
 
-func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
+// Configure addresses the device with ipn, has bringUp set it up and
+// routes the network to it
+func (dev *vxlanDevice) Configure(ipn ip.IP4Net, bringUp func(netlink.Link) error) error {
 	setAddr4(dev.link, ipn.ToIPNet())
 
-	if err := netlink.LinkSetUp(dev.link); err != nil {
-		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
+	if err := bringUp(dev.link); err != nil {
+		return err
 	}
 
-	// explicitly add a route since there might be a route for a subnet already
-	// installed by Docker and then it won't get auto added
+	// explicitly install a route since there might be a route for a subnet already
+	// installed by Docker and then it won't get auto added; replace it
+	// rather than keep it, it points somewhere else
 	route := netlink.Route{
 		LinkIndex: dev.link.Attrs().Index,
 		Scope:     netlink.SCOPE_UNIVERSE,
 		Dst:       ipn.Network().ToIPNet(),
 	}
-	if err := netlink.RouteAdd(&route); err != nil && err != syscall.EEXIST {
+	if err := ip.ReplaceLinkRoute(&route); err != nil {
 		return fmt.Errorf("failed to add route (%s -> %s): %v", ipn.Network().String(), dev.link.Attrs().Name, err)
 	}
 
 	return nil
 }
 
+// replaced in tests
+var linkDel = netlink.LinkDel
+
 func (dev *vxlanDevice) Destroy() {
-	netlink.LinkDel(dev.link)
+	if err := linkDel(dev.link); err != nil {
+		log.Warningf("Failed to delete VXLAN device %v: %v", dev.link.Name, err)
+	}
 }
 
 func (dev *vxlanDevice) MACAddr() net.HardwareAddr {
@@ -161,15 +189,21 @@ func (dev *vxlanDevice) GetL2List() ([]netlink.Neigh, error) {
 }
 
 func (dev *vxlanDevice) AddL2(n neigh) error {
-	log.Infof("calling NeighAdd: %v, %v", n.IP, n.MAC)
-	return netlink.NeighAdd(&netlink.Neigh{
+	entry := &netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Family:       syscall.AF_BRIDGE,
 		Flags:        netlink.NTF_SELF,
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
-	})
+	}
+	if isFloodEntry(n.MAC) {
+		// one entry for the all-zeros MAC per VTEP
+		log.Infof("calling NeighAppend: %v, %v", n.IP, n.MAC)
+		return netlink.NeighAppend(entry)
+	}
+	log.Infof("calling NeighAdd: %v, %v", n.IP, n.MAC)
+	return netlink.NeighAdd(entry)
 }
 
 func (dev *vxlanDevice) DelL2(n neigh) error {
@@ -234,7 +268,7 @@ func isNeighResolving(state int) bool {
 func (dev *vxlanDevice) processNeighMsg(msg syscall.NetlinkMessage, misses chan *netlink.Neigh) {
 	neigh, err := netlink.NeighDeserialize(msg.Data)
 	if err != nil {
-		log.Error("Failed to deserialize netlink ndmsg: %v", err)
+		log.Errorf("Failed to deserialize netlink ndmsg: %v", err)
 		return
 	}
 
@@ -0,0 +1,110 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestCustomDeviceName(t *testing.T) {
+	var added string
+	linkAdd = func(link *netlink.Vxlan, csum checksumConfig) error {
+		added = link.Name
+		return errors.New("not creating links in tests")
+	}
+	var deleted string
+	linkDel = func(link netlink.Link) error {
+		deleted = link.Attrs().Name
+		return nil
+	}
+	defer func() {
+		linkAdd = addVxlanLink
+		linkDel = netlink.LinkDel
+	}()
+
+	if _, err := newVXLANDevice(&vxlanDeviceAttrs{vni: 1, name: "overlay0"}); err == nil {
+		t.Fatal("newVXLANDevice succeeded without a link")
+	}
+	if added != "overlay0" {
+		t.Errorf("device created as %q, expected overlay0", added)
+	}
+
+	dev := &vxlanDevice{link: &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "overlay0"}}}
+	dev.Destroy()
+	if deleted != "overlay0" {
+		t.Errorf("deleted device %q, expected overlay0", deleted)
+	}
+}
+
+func TestInvalidDeviceName(t *testing.T) {
+	for _, name := range []string{"flannel-overlay-0", "flannel/0", "flannel 0"} {
+		config := &subnet.Config{Backend: []byte(`{"DeviceName": "` + name + `"}`)}
+		vb := New(nil, "", config)
+
+		_, err := vb.Init(&net.Interface{}, net.ParseIP("10.0.0.1"))
+		if err == nil || !strings.Contains(err.Error(), "invalid VXLAN backend config") {
+			t.Errorf("DeviceName %q: expected a config error, got %v", name, err)
+		}
+	}
+}
+
+func TestProbeVXLANLink(t *testing.T) {
+	var addErr error
+	var added, deleted []string
+	linkAdd = func(link *netlink.Vxlan, csum checksumConfig) error {
+		if link.Learning {
+			t.Error("probe device created with learning on")
+		}
+		added = append(added, link.Name)
+		return addErr
+	}
+	linkDel = func(link netlink.Link) error {
+		deleted = append(deleted, link.Attrs().Name)
+		return nil
+	}
+	defer func() {
+		linkAdd = addVxlanLink
+		linkDel = netlink.LinkDel
+	}()
+
+	if err := probeVXLANLink(); err != nil {
+		t.Errorf("probe failed: %v", err)
+	}
+	if len(added) != 1 || len(deleted) != 1 || deleted[0] != added[0] {
+		t.Errorf("probe device not created and deleted once: added %v, deleted %v", added, deleted)
+	}
+
+	addErr = syscall.EPERM
+	if _, ok := probeVXLANLink().(*backend.UndeterminedError); !ok {
+		t.Error("probe without the permission to create devices is not undetermined")
+	}
+
+	addErr = syscall.EOPNOTSUPP
+	err := probeVXLANLink()
+	if _, ok := err.(*backend.UndeterminedError); ok || err == nil {
+		t.Errorf("expected the probe to fail on an unsupported device, got %v", err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("probe deleted a device it failed to create: %v", deleted)
+	}
+}
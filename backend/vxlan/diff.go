@@ -0,0 +1,108 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// replaced in tests
+var (
+	linkByName = netlink.LinkByName
+	neighList  = netlink.NeighList
+)
+
+// DiffState compares the FDB entries and neighbors of the VXLAN device with
+// those implied by leases. Neighbors are added on L3 misses, so only those
+// in the kernel are checked (against the VTEP of the subnet they're in)
+// and none are ever missing, unless NeighborMode is "static" and the
+// gateway of every lease must have one.
+func (vb *VXLANBackend) DiffState(extIface *net.Interface, leases []subnet.Lease) (*backend.StateDiff, error) {
+	devName, err := vb.parseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := linkByName(devName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find VXLAN device %v: %v", devName, err)
+	}
+
+	desired := []backend.StateEntry{}
+	var rts routes
+	for i := range leases {
+		vtep, err := leaseVTEP(&leases[i])
+		if err != nil || len(vtep.MAC) == 0 {
+			continue
+		}
+		rts.set(leases[i].Subnet, vtep.IP, vtep.MAC)
+		desired = append(desired, fdbEntry(vtep))
+		// none for the lease of this node, whose VTEP is the device
+		if vb.cfg.NeighborMode == neighStatic && !bytes.Equal(vtep.MAC, link.Attrs().HardwareAddr) {
+			desired = append(desired, neighEntry(neigh{IP: vb.config.Gateway(leases[i].Subnet), MAC: vtep.MAC}))
+		}
+	}
+
+	fdbTable, err := neighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the FDB of %v: %v", devName, err)
+	}
+	neighs, err := neighList(link.Attrs().Index, syscall.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the neighbors of %v: %v", devName, err)
+	}
+
+	actual := []backend.StateEntry{}
+	for _, n := range fdbTable {
+		// e.g. the entry of the device's own address
+		if n.IP.To4() == nil {
+			continue
+		}
+		actual = append(actual, fdbEntry(neigh{IP: ip.FromIP(n.IP), MAC: n.HardwareAddr}))
+	}
+	for _, n := range neighs {
+		if n.IP.To4() == nil || len(n.HardwareAddr) == 0 {
+			continue
+		}
+		addr := ip.FromIP(n.IP)
+		if !vb.config.Network.Contains(addr) {
+			continue
+		}
+		// what handleL3Miss would have added
+		if rt := rts.findByNetwork(addr); rt != nil && vb.cfg.NeighborMode != neighStatic {
+			desired = append(desired, neighEntry(neigh{IP: addr, MAC: rt.vtepMAC}))
+		}
+		actual = append(actual, neighEntry(neigh{IP: addr, MAC: n.HardwareAddr}))
+	}
+
+	return backend.DiffState(desired, actual), nil
+}
+
+func fdbEntry(n neigh) backend.StateEntry {
+	return backend.StateEntry{Kind: backend.StateFDB, Key: n.MAC.String(), Value: "dst " + n.IP.String()}
+}
+
+func neighEntry(n neigh) backend.StateEntry {
+	return backend.StateEntry{Kind: backend.StateNeigh, Key: n.IP.String(), Value: "lladdr " + n.MAC.String()}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func mustParseMAC(t *testing.T, s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mac
+}
+
+func TestDiffState(t *testing.T) {
+	kernel := map[int][]netlink.Neigh{
+		syscall.AF_BRIDGE: {
+			// in sync
+			{IP: net.ParseIP("192.168.0.1"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:01")},
+			// the VTEP moved to another host
+			{IP: net.ParseIP("192.168.0.7"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:02")},
+			// left behind by a missed removal
+			{IP: net.ParseIP("192.168.0.9"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:09")},
+			// the device's own address, not a VTEP
+			{HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:ff")},
+		},
+		syscall.AF_INET: {
+			{IP: net.ParseIP("10.1.1.5"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:01")},
+			{IP: net.ParseIP("10.1.2.5"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:01")},
+			{IP: net.ParseIP("10.1.9.5"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:09")},
+			// unresolved
+			{IP: net.ParseIP("10.1.3.5")},
+			// not on the overlay
+			{IP: net.ParseIP("172.16.0.1"), HardwareAddr: mustParseMAC(t, "aa:bb:cc:00:00:01")},
+		},
+	}
+
+	linkByName = func(name string) (netlink.Link, error) {
+		if name != "flannel.1" {
+			return nil, fmt.Errorf("no link %v", name)
+		}
+		return &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Index: 7, Name: name}}, nil
+	}
+	neighList = func(index, family int) ([]netlink.Neigh, error) {
+		if index != 7 {
+			return nil, fmt.Errorf("no link %v", index)
+		}
+		return kernel[family], nil
+	}
+	defer func() {
+		linkByName = netlink.LinkByName
+		neighList = netlink.NeighList
+	}()
+
+	leases := []subnet.Lease{
+		vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01"),
+		vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02"),
+		vxlanLease(t, "10.1.3.0/24", "192.168.0.3", "aa:bb:cc:00:00:03"),
+		{Subnet: ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.1.4.0")), PrefixLen: 24}, Attrs: &subnet.LeaseAttrs{BackendType: "udp"}},
+	}
+
+	config := &subnet.Config{Network: ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.1.0.0")), PrefixLen: 16}}
+	vb := New(nil, "", config).(*VXLANBackend)
+
+	d, err := vb.DiffState(&net.Interface{Index: 1}, leases)
+	if err != nil {
+		t.Fatalf("DiffState failed: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	d.Write(buf)
+	expected := `missing: fdb aa:bb:cc:00:00:03 dst 192.168.0.3
+extra: fdb aa:bb:cc:00:00:09 dst 192.168.0.9
+extra: neigh 10.1.9.5 lladdr aa:bb:cc:00:00:09
+mismatched: fdb aa:bb:cc:00:00:02 dst 192.168.0.2, kernel has dst 192.168.0.7
+mismatched: neigh 10.1.2.5 lladdr aa:bb:cc:00:00:02, kernel has lladdr aa:bb:cc:00:00:01
+`
+	if buf.String() != expected {
+		t.Errorf("expected diff:\n%v\ngot:\n%v", expected, buf.String())
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"net"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// fastPathMap is the map consulted by an XDP program to forward packets
+// for known peer subnets without going through the kernel routing code.
+// flannel does not load the program itself; it only keeps the map in
+// sync with the lease set.
+//
+// Keys use the LPM trie layout: a 32 bit prefix length in host order
+// followed by the subnet address in network order (8 bytes). Values are
+// the VTEP address in network order followed by the VTEP MAC and two
+// bytes of padding (12 bytes).
+type fastPathMap interface {
+	Update(key, value []byte) error
+	Delete(key []byte) error
+	Keys() ([][]byte, error)
+	Close() error
+}
+
+const fastPathKeySize = 8
+
+// opens the pinned map at path; replaced in tests
+var openFastPathMap = openPinnedBPFMap
+
+type fastPath struct {
+	m fastPathMap
+}
+
+// newFastPath opens the map pinned at path. An error means the kernel
+// (or the node setup) lacks what is needed and routing should be left
+// to the kernel.
+func newFastPath(path string) (*fastPath, error) {
+	m, err := openFastPathMap(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fastPath{m}, nil
+}
+
+func putIP4(b []byte, a ip.IP4) {
+	b[0], b[1], b[2], b[3] = a.Octets()
+}
+
+func fastPathKey(sn ip.IP4Net) []byte {
+	key := make([]byte, fastPathKeySize)
+	ip.NativeEndian.PutUint32(key[0:4], uint32(sn.PrefixLen))
+	putIP4(key[4:8], sn.IP)
+	return key
+}
+
+func fastPathSubnet(key []byte) ip.IP4Net {
+	return ip.IP4Net{IP: ip.FromBytes(key[4:8]), PrefixLen: uint(ip.NativeEndian.Uint32(key[0:4]))}
+}
+
+func fastPathValue(vtepIP ip.IP4, vtepMAC net.HardwareAddr) []byte {
+	val := make([]byte, 12)
+	putIP4(val[0:4], vtepIP)
+	copy(val[4:10], vtepMAC)
+	return val
+}
+
+func (fp *fastPath) add(sn ip.IP4Net, vtepIP ip.IP4, vtepMAC net.HardwareAddr) {
+	if err := fp.m.Update(fastPathKey(sn), fastPathValue(vtepIP, vtepMAC)); err != nil {
+		log.Errorf("Failed to add %v to XDP fast path: %v", sn, err)
+	}
+}
+
+func (fp *fastPath) remove(sn ip.IP4Net) {
+	if err := fp.m.Delete(fastPathKey(sn)); err != nil {
+		log.Errorf("Failed to remove %v from XDP fast path: %v", sn, err)
+	}
+}
+
+// prune removes the entries of the subnets not in live, e.g. those of
+// leases that went away while flannel was not running
+func (fp *fastPath) prune(live map[ip.IP4Net]bool) {
+	keys, err := fp.m.Keys()
+	if err != nil {
+		log.Errorf("Failed to list the XDP fast path entries: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		if len(key) != fastPathKeySize {
+			continue
+		}
+		if sn := fastPathSubnet(key); !live[sn] {
+			log.Infof("Removing stale XDP fast path entry of %v", sn)
+			if err := fp.m.Delete(key); err != nil {
+				log.Errorf("Failed to remove %v from XDP fast path: %v", sn, err)
+			}
+		}
+	}
+}
+
+func (fp *fastPath) close() {
+	fp.m.Close()
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+type mockFastPathMap struct {
+	entries map[string][]byte
+	closed  bool
+}
+
+func (m *mockFastPathMap) Update(key, value []byte) error {
+	m.entries[string(key)] = value
+	return nil
+}
+
+func (m *mockFastPathMap) Delete(key []byte) error {
+	delete(m.entries, string(key))
+	return nil
+}
+
+func (m *mockFastPathMap) Keys() ([][]byte, error) {
+	keys := [][]byte{}
+	for k := range m.entries {
+		keys = append(keys, []byte(k))
+	}
+	return keys, nil
+}
+
+func (m *mockFastPathMap) Close() error {
+	m.closed = true
+	return nil
+}
+
+func mockFastPathLoader(m *mockFastPathMap, err error) func() {
+	orig := openFastPathMap
+	openFastPathMap = func(path string) (fastPathMap, error) {
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return func() { openFastPathMap = orig }
+}
+
+func TestFastPathUpdates(t *testing.T) {
+	m := &mockFastPathMap{entries: make(map[string][]byte)}
+	defer mockFastPathLoader(m, nil)()
+
+	fp, err := newFastPath("/sys/fs/bpf/flannel")
+	if err != nil {
+		t.Fatalf("newFastPath failed: %v", err)
+	}
+
+	sn := ip.IP4Net{IP: ip.IP4(0x0a010200), PrefixLen: 24}
+	vtep := ip.IP4(0xc0a80001)
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+
+	fp.add(sn, vtep, mac)
+
+	val, ok := m.entries[string(fastPathKey(sn))]
+	if !ok {
+		t.Fatalf("fast path entry for %v not added", sn)
+	}
+	expected := []byte{192, 168, 0, 1, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0, 0}
+	if !bytes.Equal(val, expected) {
+		t.Errorf("fast path entry mismatch: expected %v, got %v", expected, val)
+	}
+
+	key := fastPathKey(sn)
+	if !bytes.Equal(key[4:], []byte{10, 1, 2, 0}) || ip.NativeEndian.Uint32(key[:4]) != 24 {
+		t.Errorf("fast path key has wrong layout: %v", key)
+	}
+
+	fp.remove(sn)
+	if len(m.entries) != 0 {
+		t.Errorf("fast path entry for %v not removed", sn)
+	}
+
+	fp.close()
+	if !m.closed {
+		t.Error("fast path map not closed")
+	}
+}
+
+func TestFastPathPrune(t *testing.T) {
+	m := &mockFastPathMap{entries: make(map[string][]byte)}
+	defer mockFastPathLoader(m, nil)()
+
+	fp, err := newFastPath("/sys/fs/bpf/flannel")
+	if err != nil {
+		t.Fatalf("newFastPath failed: %v", err)
+	}
+
+	live := ip.IP4Net{IP: ip.IP4(0x0a010200), PrefixLen: 24}
+	gone := ip.IP4Net{IP: ip.IP4(0x0a010300), PrefixLen: 24}
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	// left behind by an earlier run
+	fp.add(live, ip.IP4(0xc0a80001), mac)
+	fp.add(gone, ip.IP4(0xc0a80002), mac)
+
+	if sn := fastPathSubnet(fastPathKey(gone)); sn != gone {
+		t.Fatalf("fast path key of %v decoded as %v", gone, sn)
+	}
+
+	fp.prune(map[ip.IP4Net]bool{live: true})
+	if _, ok := m.entries[string(fastPathKey(gone))]; ok {
+		t.Errorf("stale fast path entry for %v not removed", gone)
+	}
+	if _, ok := m.entries[string(fastPathKey(live))]; !ok {
+		t.Errorf("fast path entry for %v removed", live)
+	}
+}
+
+func TestFastPathUnsupported(t *testing.T) {
+	defer mockFastPathLoader(nil, errors.New("no bpf"))()
+
+	if _, err := newFastPath("/sys/fs/bpf/flannel"); err == nil {
+		t.Fatal("newFastPath succeeded without kernel support")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// fdb is the forwarding database of the VXLAN device; faked in tests
+type fdb interface {
+	GetL2List() ([]netlink.Neigh, error)
+	AddL2(n neigh) error
+	DelL2(n neigh) error
+}
+
+// addL2 adds the FDB entry of n, reading it back afterwards if verifying
+func (vb *VXLANBackend) addL2(n neigh) error {
+	return vb.Install(func() error { return vb.fdb.AddL2(n) }, func() error { return vb.verifyL2(n) })
+}
+
+func (vb *VXLANBackend) verifyL2(n neigh) error {
+	entries, err := vb.fdb.GetL2List()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IP.Equal(n.IP.ToIP()) && bytes.Equal(e.HardwareAddr, n.MAC) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no FDB entry for %v at %v", n.MAC, n.IP)
+}
+
+// resync is a lease snapshot to reconcile the FDB with, fetched after gen
+// lease event batches were handled
+type resync struct {
+	gen    uint64
+	events []subnet.Event
+}
+
+// fdbReconciler periodically sends the current lease snapshot to resyncs
+// so that entries left behind by missed lease events get cleaned up
+func (vb *VXLANBackend) fdbReconciler(ctx context.Context, interval time.Duration, resyncs chan<- resync) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		gen := atomic.LoadUint64(&vb.evtGen)
+		wr, err := vb.sm.WatchLeases(ctx, vb.network, nil)
+		if err != nil {
+			if err != context.Canceled {
+				log.Error("FDB reconcile: failed to retrieve leases: ", err)
+			}
+			continue
+		}
+
+		select {
+		case resyncs <- resync{gen, snapshotEvents(wr.Snapshot)}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleResync reconciles the FDB with the snapshot of r. It is skipped
+// if lease events were handled since the snapshot was fetched: it may
+// lack the leases they added and would remove their entries.
+func (vb *VXLANBackend) handleResync(r resync) error {
+	if r.gen != atomic.LoadUint64(&vb.evtGen) {
+		log.V(1).Info("FDB reconcile: lease events arrived since the snapshot was fetched, skipping it")
+		return nil
+	}
+	return vb.handleInitialSubnetEvents(r.events)
+}
+
+func snapshotEvents(leases []subnet.Lease) []subnet.Event {
+	batch := make([]subnet.Event, len(leases))
+	for i, l := range leases {
+		batch[i] = subnet.Event{Type: subnet.SubnetAdded, Lease: l}
+	}
+	return batch
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+type mockFDB struct {
+	entries map[string]neigh
+}
+
+func (m *mockFDB) GetL2List() ([]netlink.Neigh, error) {
+	l := []netlink.Neigh{}
+	for _, n := range m.entries {
+		l = append(l, netlink.Neigh{IP: n.IP.ToIP(), HardwareAddr: n.MAC})
+	}
+	return l, nil
+}
+
+// entries are keyed by the VTEP address, flood entries by "flood/" and it
+func fdbKey(n neigh) string {
+	if isFloodEntry(n.MAC) {
+		return "flood/" + n.IP.String()
+	}
+	return n.IP.String()
+}
+
+func (m *mockFDB) AddL2(n neigh) error {
+	m.entries[fdbKey(n)] = n
+	return nil
+}
+
+func (m *mockFDB) DelL2(n neigh) error {
+	delete(m.entries, fdbKey(n))
+	return nil
+}
+
+// snapshotManager returns leases as the snapshot of every watch reset
+type snapshotManager struct {
+	subnet.Manager
+	leases []subnet.Lease
+}
+
+func (m *snapshotManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	return subnet.WatchResult{Snapshot: m.leases, Cursor: "1"}, nil
+}
+
+func vxlanLease(t *testing.T, sn, pip, mac string) subnet.Lease {
+	_, ipn, err := net.ParseCIDR(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(hw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return subnet.Lease{
+		Subnet: ip.FromIPNet(ipn),
+		Attrs: &subnet.LeaseAttrs{
+			PublicIP:    ip.FromIP(net.ParseIP(pip)),
+			BackendType: "vxlan",
+			BackendData: json.RawMessage(data),
+		},
+	}
+}
+
+func TestFDBReconcile(t *testing.T) {
+	live := vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01")
+	missing := vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02")
+
+	sm := &snapshotManager{leases: []subnet.Lease{live, missing}}
+	f := &mockFDB{entries: make(map[string]neigh)}
+
+	vb := New(sm, "", &subnet.Config{}).(*VXLANBackend)
+	vb.fdb = f
+
+	if err := vb.handleInitialSubnetEvents(snapshotEvents(sm.leases)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the removal of a lease and the addition of an unrelated stale
+	// entry both go unnoticed
+	sm.leases = []subnet.Lease{live}
+	staleMAC, _ := net.ParseMAC("aa:bb:cc:00:00:99")
+	f.entries["192.168.0.99"] = neigh{IP: ip.FromIP(net.ParseIP("192.168.0.99")), MAC: staleMAC}
+	delete(f.entries, "192.168.0.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resyncs := make(chan resync)
+	go vb.fdbReconciler(ctx, 10*time.Millisecond, resyncs)
+
+	select {
+	case r := <-resyncs:
+		if err := vb.handleResync(r); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconciler did not resync")
+	}
+
+	if len(f.entries) != 1 {
+		t.Errorf("expected only the FDB entry of the live lease, got %v", f.entries)
+	}
+	if _, ok := f.entries["192.168.0.1"]; !ok {
+		t.Error("FDB entry of the live lease was not restored")
+	}
+
+	if vb.rts.find(missing.Subnet) != nil {
+		t.Errorf("route to the gone subnet %v was kept", missing.Subnet)
+	}
+	if vb.rts.find(live.Subnet) == nil {
+		t.Errorf("route to the live subnet %v was removed", live.Subnet)
+	}
+}
+
+func TestFDBReconcileStaleSnapshot(t *testing.T) {
+	live := vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01")
+	added := vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02")
+
+	sm := &snapshotManager{leases: []subnet.Lease{live}}
+	f := &mockFDB{entries: make(map[string]neigh)}
+
+	vb := New(sm, "", &subnet.Config{}).(*VXLANBackend)
+	vb.fdb = f
+
+	if err := vb.handleInitialSubnetEvents(snapshotEvents(sm.leases)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resyncs := make(chan resync)
+	go vb.fdbReconciler(ctx, 10*time.Millisecond, resyncs)
+
+	var r resync
+	select {
+	case r = <-resyncs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconciler did not resync")
+	}
+
+	// a lease added between the fetch of the snapshot and its use
+	vb.handleSubnetEvents([]subnet.Event{{Type: subnet.SubnetAdded, Lease: added}})
+	if err := vb.handleResync(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := f.entries["192.168.0.2"]; !ok {
+		t.Error("FDB entry of the lease added after the snapshot was removed")
+	}
+	if vb.rts.find(added.Subnet) == nil {
+		t.Errorf("route to the subnet %v added after the snapshot was removed", added.Subnet)
+	}
+}
+
+// lossyFDB accepts the entries of lost but never holds them
+type lossyFDB struct {
+	mockFDB
+	lost string
+}
+
+func (m *lossyFDB) AddL2(n neigh) error {
+	if n.IP.String() == m.lost {
+		return nil
+	}
+	return m.mockFDB.AddL2(n)
+}
+
+func TestVerifyFDB(t *testing.T) {
+	kept := vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01")
+	lost := vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02")
+
+	f := &lossyFDB{mockFDB: mockFDB{entries: make(map[string]neigh)}, lost: "192.168.0.2"}
+	vb := New(nil, "", &subnet.Config{}).(*VXLANBackend)
+	vb.fdb = f
+	vb.SetVerifyRoutes()
+
+	if err := vb.handleInitialSubnetEvents(snapshotEvents([]subnet.Lease{kept, lost})); err != nil {
+		t.Fatal(err)
+	}
+	if s := vb.RouteStates()[kept.Subnet]; s != backend.RouteInstalled {
+		t.Errorf("kept entry: expected state %v, got %v", backend.RouteInstalled, s)
+	}
+	if s := vb.RouteStates()[lost.Subnet]; s != backend.RouteUnverified {
+		t.Errorf("lost entry: expected state %v, got %v", backend.RouteUnverified, s)
+	}
+
+	// events that add it again keep failing to verify
+	for i := 1; i < backend.FailureThreshold; i++ {
+		vb.handleSubnetEvents(snapshotEvents([]subnet.Lease{lost}))
+	}
+	if err := vb.Health(); err == nil {
+		t.Error("still healthy after repeated verify failures")
+	}
+}
+
+func TestFDBFlood(t *testing.T) {
+	own := vxlanLease(t, "10.1.0.0/24", "192.168.0.10", "aa:bb:cc:00:00:10")
+	a := vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01")
+	b := vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02")
+	c := vxlanLease(t, "10.1.3.0/24", "192.168.0.3", "aa:bb:cc:00:00:03")
+
+	floods := func(f *mockFDB) map[string]bool {
+		found := make(map[string]bool)
+		for _, n := range f.entries {
+			if isFloodEntry(n.MAC) {
+				found[n.IP.String()] = true
+			}
+		}
+		return found
+	}
+
+	for _, enabled := range []bool{false, true} {
+		f := &mockFDB{entries: make(map[string]neigh)}
+		vb := New(nil, "", &subnet.Config{}).(*VXLANBackend)
+		vb.fdb = f
+		vb.cfg.Flood = enabled
+		vb.lease = &own
+
+		if err := vb.handleInitialSubnetEvents(snapshotEvents([]subnet.Lease{own, a, b})); err != nil {
+			t.Fatal(err)
+		}
+		vb.handleSubnetEvents([]subnet.Event{
+			{Type: subnet.SubnetAdded, Lease: c},
+			{Type: subnet.SubnetRemoved, Lease: a},
+		})
+
+		found := floods(f)
+		if !enabled {
+			if len(found) > 0 {
+				t.Errorf("flood entries added while disabled: %v", found)
+			}
+			continue
+		}
+
+		if len(found) != 2 || !found["192.168.0.2"] || !found["192.168.0.3"] {
+			t.Errorf("expected flood entries for 192.168.0.2 and 192.168.0.3, got %v", found)
+		}
+
+		// a restart keeps them and drops the one left behind
+		f.entries["flood/192.168.0.1"] = neigh{IP: a.Attrs.PublicIP, MAC: floodMAC}
+		if err := vb.handleInitialSubnetEvents(snapshotEvents([]subnet.Lease{own, b, c})); err != nil {
+			t.Fatal(err)
+		}
+		if found := floods(f); len(found) != 2 || found["192.168.0.1"] {
+			t.Errorf("expected flood entries for 192.168.0.2 and 192.168.0.3 after resync, got %v", found)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"net"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// the kernel sends broadcast, multicast and unknown unicast frames to
+// every VTEP that has an FDB entry for the all-zeros MAC
+var floodMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+
+func isFloodEntry(mac net.HardwareAddr) bool {
+	return bytes.Equal(mac, floodMAC)
+}
+
+func (vb *VXLANBackend) isOwnVTEP(vtepIP ip.IP4) bool {
+	return vb.lease != nil && vb.lease.Attrs != nil && vb.lease.Attrs.PublicIP == vtepIP
+}
+
+// floodPeers returns the VTEPs of the current routes that frames get
+// flooded to, none unless Flood is set
+func (vb *VXLANBackend) floodPeers() map[ip.IP4]bool {
+	peers := make(map[ip.IP4]bool)
+	if !vb.cfg.Flood {
+		return peers
+	}
+	for _, rt := range vb.rts {
+		if !vb.isOwnVTEP(rt.vtepIP) {
+			peers[rt.vtepIP] = true
+		}
+	}
+	return peers
+}
+
+// addFlood adds the flood entry of vtepIP unless another route already
+// goes to it
+func (vb *VXLANBackend) addFlood(vtepIP ip.IP4) {
+	if !vb.cfg.Flood || vb.isOwnVTEP(vtepIP) || vb.rts.hasVTEP(vtepIP) {
+		return
+	}
+	if err := vb.fdb.AddL2(neigh{IP: vtepIP, MAC: floodMAC}); err != nil {
+		log.Errorf("Failed to add flood entry for %v: %v", vtepIP, err)
+	}
+}
+
+// delFlood removes the flood entry of vtepIP once no route goes to it
+func (vb *VXLANBackend) delFlood(vtepIP ip.IP4) {
+	if !vb.cfg.Flood || vb.isOwnVTEP(vtepIP) || vb.rts.hasVTEP(vtepIP) {
+		return
+	}
+	if err := vb.fdb.DelL2(neigh{IP: vtepIP, MAC: floodMAC}); err != nil {
+		log.Warningf("Failed to remove flood entry for %v: %v", vtepIP, err)
+	}
+}
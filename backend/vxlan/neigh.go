@@ -0,0 +1,99 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"net"
+	"syscall"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// peerTable is what NeighborMode "static" programs for each peer: a route
+// to its subnet via its gateway and a permanent neighbor resolving the
+// gateway to the VTEP MAC of the peer, so the kernel never has to ask
+// flannel; faked in tests
+type peerTable interface {
+	AddPeer(sn ip.IP4Net, gw neigh) error
+	DelPeer(sn ip.IP4Net, gw neigh) error
+}
+
+// addPeer programs the peer holding sn if the neighbors are static
+func (vb *VXLANBackend) addPeer(sn ip.IP4Net, vtepMAC net.HardwareAddr) error {
+	if vb.peers == nil || vb.isOwnSubnet(sn) {
+		return nil
+	}
+	return vb.peers.AddPeer(sn, neigh{IP: vb.config.Gateway(sn), MAC: vtepMAC})
+}
+
+func (vb *VXLANBackend) delPeer(sn ip.IP4Net, vtepMAC net.HardwareAddr) {
+	if vb.peers == nil || vb.isOwnSubnet(sn) {
+		return
+	}
+	if err := vb.peers.DelPeer(sn, neigh{IP: vb.config.Gateway(sn), MAC: vtepMAC}); err != nil {
+		log.Warningf("Failed to remove the neighbor of subnet %v: %v", sn, err)
+	}
+}
+
+// the gateway of our own subnet is the address of the device
+func (vb *VXLANBackend) isOwnSubnet(sn ip.IP4Net) bool {
+	return vb.lease != nil && vb.lease.Subnet == sn
+}
+
+func peerRoute(index int, sn ip.IP4Net, gw ip.IP4) *netlink.Route {
+	// the gateway is within the network the device is addressed in
+	return &netlink.Route{
+		LinkIndex: index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn.ToIPNet(),
+		Gw:        gw.ToIP(),
+	}
+}
+
+func (dev *vxlanDevice) AddPeer(sn ip.IP4Net, gw neigh) error {
+	log.Infof("calling NeighSet: %v, %v", gw.IP, gw.MAC)
+	err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           gw.IP.ToIP(),
+		HardwareAddr: gw.MAC,
+	})
+	if err != nil {
+		return err
+	}
+	return ip.ReplaceRoute(peerRoute(dev.link.Index, sn, gw.IP))
+}
+
+func (dev *vxlanDevice) DelPeer(sn ip.IP4Net, gw neigh) error {
+	log.Infof("calling RouteDel: %v via %v", sn, gw.IP)
+	rerr := netlink.RouteDel(peerRoute(dev.link.Index, sn, gw.IP))
+
+	log.Infof("calling NeighDel: %v, %v", gw.IP, gw.MAC)
+	err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           gw.IP.ToIP(),
+		HardwareAddr: gw.MAC,
+	})
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
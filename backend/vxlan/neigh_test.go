@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+type mockPeers struct {
+	neighs map[string]neigh
+	routes map[ip.IP4Net]ip.IP4
+}
+
+func (m *mockPeers) AddPeer(sn ip.IP4Net, gw neigh) error {
+	m.neighs[gw.IP.String()] = gw
+	m.routes[sn] = gw.IP
+	return nil
+}
+
+func (m *mockPeers) DelPeer(sn ip.IP4Net, gw neigh) error {
+	delete(m.neighs, gw.IP.String())
+	delete(m.routes, sn)
+	return nil
+}
+
+func TestStaticNeighbors(t *testing.T) {
+	own := vxlanLease(t, "10.1.0.0/24", "192.168.0.10", "aa:bb:cc:00:00:10")
+	peer1 := vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01")
+	peer2 := vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02")
+
+	config, err := subnet.ParseConfig(`{ "Network": "10.1.0.0/16", "Backend": { "Type": "vxlan", "NeighborMode": "static" } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vb := New(nil, "", config).(*VXLANBackend)
+	if _, err := vb.parseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if vb.cfg.NeighborMode != neighStatic {
+		t.Fatalf("NeighborMode not decoded: %q", vb.cfg.NeighborMode)
+	}
+
+	p := &mockPeers{neighs: make(map[string]neigh), routes: make(map[ip.IP4Net]ip.IP4)}
+	vb.fdb = &mockFDB{entries: make(map[string]neigh)}
+	vb.peers = p
+	vb.lease = &own
+
+	if err := vb.handleInitialSubnetEvents(snapshotEvents([]subnet.Lease{own, peer1})); err != nil {
+		t.Fatal(err)
+	}
+	vb.handleSubnetEvents(snapshotEvents([]subnet.Lease{peer2}))
+
+	for _, l := range []subnet.Lease{peer1, peer2} {
+		gw := config.Gateway(l.Subnet)
+		vtep, _ := leaseVTEP(&l)
+
+		n, ok := p.neighs[gw.String()]
+		if !ok {
+			t.Errorf("no neighbor for the gateway %v of %v", gw, l.Subnet)
+		} else if n.MAC.String() != vtep.MAC.String() {
+			t.Errorf("neighbor of %v resolves to %v, expected %v", gw, n.MAC, vtep.MAC)
+		}
+		if p.routes[l.Subnet] != gw {
+			t.Errorf("route to %v is via %v, expected %v", l.Subnet, p.routes[l.Subnet], gw)
+		}
+	}
+	if len(p.neighs) != 2 {
+		t.Errorf("expected neighbors of the two peers only, got %v", p.neighs)
+	}
+
+	vb.handleSubnetEvents([]subnet.Event{{Type: subnet.SubnetRemoved, Lease: peer1}})
+	if _, ok := p.neighs[config.Gateway(peer1.Subnet).String()]; ok {
+		t.Error("neighbor of the removed peer was kept")
+	}
+	if _, ok := p.routes[peer1.Subnet]; ok {
+		t.Error("route to the removed peer was kept")
+	}
+}
+
+func TestInvalidNeighborMode(t *testing.T) {
+	config := &subnet.Config{Backend: []byte(`{"NeighborMode": "learning"}`)}
+	vb := New(nil, "", config).(*VXLANBackend)
+
+	_, err := vb.Init(&net.Interface{}, net.ParseIP("10.0.0.1"))
+	if err == nil || !strings.Contains(err.Error(), "NeighborMode") {
+		t.Errorf("expected a NeighborMode config error, got %v", err)
+	}
+}
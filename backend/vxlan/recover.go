@@ -0,0 +1,138 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// replaced in tests
+var (
+	deviceCheckInterval = 5 * time.Second
+
+	deviceExists = func(index int) bool {
+		_, err := netlink.LinkByIndex(index)
+		return err == nil
+	}
+
+	setupDevice = func(devAttrs *vxlanDeviceAttrs, vxlanNet ip.IP4Net, bringUp func(netlink.Link) error) (*vxlanDevice, error) {
+		dev, err := newVXLANDevice(devAttrs)
+		if err != nil {
+			return nil, err
+		}
+		if err := dev.Configure(vxlanNet, bringUp); err != nil {
+			return nil, err
+		}
+		return dev, nil
+	}
+)
+
+// watchDevice returns a channel that is closed once the VXLAN device is
+// gone, e.g. deleted by an operator or another tool
+func (vb *VXLANBackend) watchDevice() <-chan struct{} {
+	gone := make(chan struct{})
+	index := vb.dev.link.Index
+
+	vb.wg.Add(1)
+	go func() {
+		defer vb.wg.Done()
+		for {
+			select {
+			case <-time.After(deviceCheckInterval):
+			case <-vb.ctx.Done():
+				return
+			}
+
+			if !deviceExists(index) {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	return gone
+}
+
+// recoverDevice recreates the VXLAN device, with the MAC already
+// advertised in the lease, and reprograms it from the current lease
+// snapshot. It retries until it succeeds or the backend is stopped.
+func (vb *VXLANBackend) recoverDevice() bool {
+	log.Errorf("VXLAN device %v (index %v) is gone, recreating it", vb.devAttrs.name, vb.dev.link.Index)
+	vb.SetDegraded("device", fmt.Errorf("VXLAN device %v is gone", vb.devAttrs.name))
+
+	devAttrs := vb.devAttrs
+	devAttrs.hwAddr = vb.dev.MACAddr()
+
+	for {
+		if err := vb.tryRecoverDevice(&devAttrs); err == nil {
+			break
+		} else {
+			log.Errorf("Failed to recover VXLAN device %v (retrying in 1 second): %v", devAttrs.name, err)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-vb.ctx.Done():
+			return false
+		}
+	}
+
+	vb.SetHealthy("device")
+	log.Warningf("VXLAN device %v recovered (index %v), routes to %v subnets reinstalled", devAttrs.name, vb.dev.link.Index, len(vb.rts))
+	return true
+}
+
+func (vb *VXLANBackend) tryRecoverDevice(devAttrs *vxlanDeviceAttrs) error {
+	if deviceExists(vb.dev.link.Index) {
+		// an earlier attempt got this far
+		return vb.resync()
+	}
+
+	dev, err := setupDevice(devAttrs, vb.vxlanNet, vb.bringUp)
+	if err != nil {
+		return err
+	}
+	if err := vb.cfg.EgressLimit.Apply(devAttrs.name); err != nil {
+		return err
+	}
+	if err := vb.cfg.NeighProxy.Apply(devAttrs.name); err != nil {
+		return err
+	}
+
+	if vb.fdb == fdb(vb.dev) {
+		vb.fdb = dev
+	}
+	if vb.peers == peerTable(vb.dev) {
+		vb.peers = dev
+	}
+	vb.dev = dev
+
+	return vb.resync()
+}
+
+// resync reprograms the FDB from the current lease snapshot
+func (vb *VXLANBackend) resync() error {
+	wr, err := vb.sm.WatchLeases(vb.ctx, vb.network, nil)
+	if err != nil {
+		return err
+	}
+	return vb.handleInitialSubnetEvents(snapshotEvents(wr.Snapshot))
+}
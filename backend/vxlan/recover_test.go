@@ -0,0 +1,123 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// fakeLinks stands in for the links of the host
+type fakeLinks struct {
+	sync.Mutex
+	indexes map[int]bool
+}
+
+func (fl *fakeLinks) exists(index int) bool {
+	fl.Lock()
+	defer fl.Unlock()
+	return fl.indexes[index]
+}
+
+func (fl *fakeLinks) set(index int, exists bool) {
+	fl.Lock()
+	defer fl.Unlock()
+	fl.indexes[index] = exists
+}
+
+func fakeDevice(index int, mac net.HardwareAddr) *vxlanDevice {
+	return &vxlanDevice{
+		link: &netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "flannel.1", Index: index, HardwareAddr: mac},
+		},
+	}
+}
+
+func TestRecoverDeletedDevice(t *testing.T) {
+	links := &fakeLinks{indexes: map[int]bool{5: true}}
+	mac, _ := net.ParseMAC("aa:bb:cc:00:00:10")
+
+	var created *vxlanDeviceAttrs
+	origInterval, origExists, origSetup := deviceCheckInterval, deviceExists, setupDevice
+	deviceCheckInterval = 10 * time.Millisecond
+	deviceExists = links.exists
+	setupDevice = func(devAttrs *vxlanDeviceAttrs, vxlanNet ip.IP4Net, bringUp func(netlink.Link) error) (*vxlanDevice, error) {
+		created = devAttrs
+		links.set(6, true)
+		return fakeDevice(6, devAttrs.hwAddr), nil
+	}
+	defer func() {
+		deviceCheckInterval, deviceExists, setupDevice = origInterval, origExists, origSetup
+	}()
+
+	sm := &snapshotManager{leases: []subnet.Lease{
+		vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01"),
+		vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02"),
+	}}
+	f := &mockFDB{entries: make(map[string]neigh)}
+
+	vb := New(sm, "", &subnet.Config{}).(*VXLANBackend)
+	defer vb.wg.Wait()
+	defer vb.Stop()
+	vb.fdb = f
+	vb.dev = fakeDevice(5, mac)
+	vb.devAttrs.name = "flannel.1"
+
+	if err := vb.handleInitialSubnetEvents(snapshotEvents(sm.leases)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the FDB goes with the device
+	gone := vb.watchDevice()
+	links.set(5, false)
+	f.entries = make(map[string]neigh)
+
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deletion of the device went unnoticed")
+	}
+
+	if !vb.recoverDevice() {
+		t.Fatal("device was not recovered")
+	}
+
+	if created == nil {
+		t.Fatal("device was not recreated")
+	}
+	if !bytes.Equal(created.hwAddr, mac) {
+		t.Errorf("device recreated with address %v, expected %v", created.hwAddr, mac)
+	}
+	if vb.dev.link.Index != 6 {
+		t.Errorf("backend still uses the deleted device %v", vb.dev.link.Index)
+	}
+
+	for _, pip := range []string{"192.168.0.1", "192.168.0.2"} {
+		if _, ok := f.entries[pip]; !ok {
+			t.Errorf("FDB entry of %v not reinstalled", pip)
+		}
+	}
+	if len(vb.rts) != 2 {
+		t.Errorf("expected routes to 2 subnets, got %v", vb.rts)
+	}
+}
@@ -22,19 +22,30 @@ import (
 
 type route struct {
 	network ip.IP4Net
+	vtepIP  ip.IP4
 	vtepMAC net.HardwareAddr
 }
 
 type routes []route
 
-func (rts *routes) set(nw ip.IP4Net, vtepMAC net.HardwareAddr) {
+func (rts *routes) set(nw ip.IP4Net, vtepIP ip.IP4, vtepMAC net.HardwareAddr) {
 	for i, rt := range *rts {
 		if rt.network.Equal(nw) {
+			(*rts)[i].vtepIP = vtepIP
 			(*rts)[i].vtepMAC = vtepMAC
 			return
 		}
 	}
-	*rts = append(*rts, route{nw, vtepMAC})
+	*rts = append(*rts, route{nw, vtepIP, vtepMAC})
+}
+
+func (rts routes) find(nw ip.IP4Net) *route {
+	for i, rt := range rts {
+		if rt.network.Equal(nw) {
+			return &rts[i]
+		}
+	}
+	return nil
 }
 
 func (rts *routes) remove(nw ip.IP4Net) {
@@ -55,3 +66,12 @@ func (rts routes) findByNetwork(ipAddr ip.IP4) *route {
 	}
 	return nil
 }
+
+func (rts routes) hasVTEP(vtepIP ip.IP4) bool {
+	for _, rt := range rts {
+		if rt.vtepIP == vtepIP {
+			return true
+		}
+	}
+	return false
+}
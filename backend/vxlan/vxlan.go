@@ -17,9 +17,12 @@ package vxlan
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
@@ -27,28 +30,61 @@ import (
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/errlog"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
 
 const (
 	defaultVNI = 1
+
+	// NeighborMode: resolve the addresses of peers on L3 misses or
+	// program a permanent neighbor for the gateway of each peer
+	neighDynamic = "dynamic"
+	neighStatic  = "static"
 )
 
 type VXLANBackend struct {
+	// lease event batches handled so far, accessed atomically
+	// (first in the struct to be 64-bit aligned)
+	evtGen uint64
+
 	sm      subnet.Manager
 	network string
 	config  *subnet.Config
 	cfg     struct {
-		VNI  int
-		Port int
-	}
-	lease  *subnet.Lease
-	dev    *vxlanDevice
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
-	rts    routes
+		VNI         int
+		Port        int
+		DeviceName  string
+		FastPathMap string
+		// neighDynamic or neighStatic
+		NeighborMode string
+		// in seconds
+		FDBAgeing            int
+		FDBReconcileInterval int
+		// flood broadcast, multicast and unknown unicast to all peers
+		Flood bool
+		checksumConfig
+		backend.EgressLimit
+		backend.NeighProxy
+	}
+	lease    *subnet.Lease
+	devAttrs vxlanDeviceAttrs
+	vxlanNet ip.IP4Net
+	dev      *vxlanDevice
+	fdb      fdb
+	peers    peerTable
+	fastPath *fastPath
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	rts      routes
+	errs     *errlog.Limiter
+	backend.ReadyFlag
+	backend.HealthState
+	backend.RouteTracker
+	backend.LinkState
+	backend.VerifyState
 }
 
 func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backend {
@@ -60,12 +96,46 @@ func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backe
 		config:  config,
 		ctx:     ctx,
 		cancel:  cancel,
+		errs:    errlog.NewLimiter(errlog.DefaultInterval),
 	}
 	vb.cfg.VNI = defaultVNI
 
 	return vb
 }
 
+// Capabilities lists what the host needs to run the VXLAN backend
+func Capabilities() []backend.Capability {
+	return []backend.Capability{
+		backend.KernelModule("vxlan"),
+		{Name: "VXLAN devices with learning off", Check: probeVXLANLink},
+	}
+}
+
+const probeDevice = "flannel.probe"
+
+// probeVXLANLink creates (and deletes) a VXLAN device with the netlink
+// attributes flannel sets, which loads the module if it isn't yet
+func probeVXLANLink() error {
+	link := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: probeDevice},
+		VxlanId:   defaultVNI,
+		Learning:  false,
+	}
+	switch err := linkAdd(link, checksumConfig{}); err {
+	case nil:
+		if err := linkDel(link); err != nil {
+			log.Warningf("Failed to delete probe device %v: %v", probeDevice, err)
+		}
+		return nil
+	case syscall.EPERM:
+		return &backend.UndeterminedError{Err: fmt.Errorf("not permitted to create a device")}
+	case syscall.EEXIST:
+		return &backend.UndeterminedError{Err: fmt.Errorf("%v exists already", probeDevice)}
+	default:
+		return fmt.Errorf("failed to create one: %v", err)
+	}
+}
+
 func newSubnetAttrs(pubIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
 	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(mac)})
 	if err != nil {
@@ -79,25 +149,52 @@ func newSubnetAttrs(pubIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs, err
 	}, nil
 }
 
-func (vb *VXLANBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
-	// Parse our configuration
+// parseConfig decodes the backend config and returns the name of the
+// VXLAN device
+func (vb *VXLANBackend) parseConfig() (string, error) {
 	if len(vb.config.Backend) > 0 {
 		if err := json.Unmarshal(vb.config.Backend, &vb.cfg); err != nil {
-			return nil, fmt.Errorf("error decoding VXLAN backend config: %v", err)
+			return "", fmt.Errorf("error decoding VXLAN backend config: %v", err)
 		}
 	}
 
-	devAttrs := vxlanDeviceAttrs{
+	devName := vb.cfg.DeviceName
+	if devName == "" {
+		devName = fmt.Sprintf("flannel.%v", vb.cfg.VNI)
+	}
+	if err := backend.ValidateDeviceName(devName); err != nil {
+		return "", fmt.Errorf("invalid VXLAN backend config: %v", err)
+	}
+	if err := vb.cfg.EgressLimit.Validate(); err != nil {
+		return "", fmt.Errorf("invalid VXLAN backend config: %v", err)
+	}
+	switch vb.cfg.NeighborMode {
+	case "", neighDynamic, neighStatic:
+	default:
+		return "", fmt.Errorf("invalid VXLAN backend config: NeighborMode must be %q or %q, got %q", neighDynamic, neighStatic, vb.cfg.NeighborMode)
+	}
+	return devName, nil
+}
+
+func (vb *VXLANBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
+	devName, err := vb.parseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	vb.devAttrs = vxlanDeviceAttrs{
 		vni:       uint32(vb.cfg.VNI),
-		name:      fmt.Sprintf("flannel.%v", vb.cfg.VNI),
+		name:      devName,
 		vtepIndex: extIface.Index,
 		vtepAddr:  extIP,
 		vtepPort:  vb.cfg.Port,
+		ageing:    vb.cfg.FDBAgeing,
+		csum:      vb.cfg.checksumConfig,
+		static:    vb.cfg.NeighborMode == neighStatic,
 	}
 
-	var err error
 	for {
-		vb.dev, err = newVXLANDevice(&devAttrs)
+		vb.dev, err = newVXLANDevice(&vb.devAttrs)
 		if err == nil {
 			break
 		} else {
@@ -108,6 +205,19 @@ func (vb *VXLANBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Su
 			time.Sleep(1 * time.Second)
 		}
 	}
+	vb.fdb = vb.dev
+	if vb.devAttrs.static {
+		vb.peers = vb.dev
+	}
+
+	if vb.cfg.FastPathMap != "" {
+		vb.fastPath, err = newFastPath(vb.cfg.FastPathMap)
+		if err != nil {
+			log.Warningf("XDP fast path not available, falling back to kernel routing: %v", err)
+		} else {
+			log.Infof("Using XDP fast path map %v", vb.cfg.FastPathMap)
+		}
+	}
 
 	sa, err := newSubnetAttrs(extIP, vb.dev.MACAddr())
 	if err != nil {
@@ -126,22 +236,28 @@ func (vb *VXLANBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.Su
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
-	// vxlan's subnet is that of the whole overlay network (e.g. /16)
-	// and not that of the individual host (e.g. /24)
-	vxlanNet := ip.IP4Net{
-		IP:        l.Subnet.IP,
-		PrefixLen: vb.config.Network.PrefixLen,
+	vb.vxlanNet = backend.DeviceNet(vb.config, l.Subnet)
+	if err = vb.dev.Configure(vb.vxlanNet, vb.bringUp); err != nil {
+		return nil, err
 	}
-	if err = vb.dev.Configure(vxlanNet); err != nil {
+	if err = vb.cfg.EgressLimit.Apply(vb.devAttrs.name); err != nil {
+		return nil, err
+	}
+	if err = vb.cfg.NeighProxy.Apply(vb.devAttrs.name); err != nil {
 		return nil, err
 	}
 
 	return &backend.SubnetDef{
-		Net: l.Subnet,
-		MTU: vb.dev.MTU(),
+		Net:       l.Subnet,
+		MTU:       vb.dev.MTU(),
+		LinkIndex: vb.dev.link.Attrs().Index,
 	}, nil
 }
 
+func (vb *VXLANBackend) bringUp(link netlink.Link) error {
+	return vb.BringUp(vb.ctx, link)
+}
+
 func (vb *VXLANBackend) Run() {
 	vb.wg.Add(1)
 	go func() {
@@ -150,23 +266,43 @@ func (vb *VXLANBackend) Run() {
 		vb.wg.Done()
 	}()
 
-	log.Info("Watching for L3 misses")
 	misses := make(chan *netlink.Neigh, 100)
-	// Unfrtunately MonitorMisses does not take a cancel channel
-	// as there's no wait to interrupt netlink socket recv
-	go vb.dev.MonitorMisses(misses)
+	if !vb.devAttrs.static {
+		log.Info("Watching for L3 misses")
+		// Unfrtunately MonitorMisses does not take a cancel channel
+		// as there's no wait to interrupt netlink socket recv
+		go vb.dev.MonitorMisses(misses)
+	}
 
 	log.Info("Watching for new subnet leases")
 	evts := make(chan []subnet.Event)
 	vb.wg.Add(1)
 	go func() {
-		subnet.WatchLeases(vb.ctx, vb.sm, vb.network, evts)
+		subnet.WatchLeasesMarked(vb.ctx, vb.sm, vb.network, evts)
 		log.Info("WatchLeases exited")
 		vb.wg.Done()
 	}()
 
+	// the device outlives flanneld, its limit and proxying don't
+	defer vb.cfg.EgressLimit.Remove(vb.devAttrs.name)
+	defer vb.cfg.NeighProxy.Remove(vb.devAttrs.name)
 	defer vb.wg.Wait()
-	initialEvtsBatch := <-evts
+
+	// the existing leases, to sweep the FDB entries of gone ones against
+	var initialEvtsBatch []subnet.Event
+	for done := false; !done; {
+		var batch []subnet.Event
+		select {
+		case batch = <-evts:
+		case <-vb.ctx.Done():
+			if vb.fastPath != nil {
+				vb.fastPath.close()
+			}
+			return
+		}
+		batch, done = subnet.SplitSnapshotDone(batch)
+		initialEvtsBatch = append(initialEvtsBatch, batch...)
+	}
 	for {
 		err := vb.handleInitialSubnetEvents(initialEvtsBatch)
 		if err == nil {
@@ -175,16 +311,47 @@ func (vb *VXLANBackend) Run() {
 		log.Error(err, " About to retry")
 		time.Sleep(time.Second)
 	}
+	vb.SetReady()
+
+	resyncs := make(chan resync)
+	if vb.cfg.FDBReconcileInterval > 0 {
+		vb.wg.Add(1)
+		go func() {
+			vb.fdbReconciler(vb.ctx, time.Duration(vb.cfg.FDBReconcileInterval)*time.Second, resyncs)
+			vb.wg.Done()
+		}()
+	}
+
+	devGone := vb.watchDevice()
 
 	for {
 		select {
 		case miss := <-misses:
 			vb.handleMiss(miss)
 
+		case <-devGone:
+			devGone = nil
+			if vb.recoverDevice() {
+				// the monitor of the old device stays blocked in
+				// its netlink socket, ignoring the new device
+				if !vb.devAttrs.static {
+					go vb.dev.MonitorMisses(misses)
+				}
+				devGone = vb.watchDevice()
+			}
+
 		case evtBatch := <-evts:
 			vb.handleSubnetEvents(evtBatch)
 
+		case r := <-resyncs:
+			if err := vb.handleResync(r); err != nil {
+				log.Error("FDB reconcile failed: ", err)
+			}
+
 		case <-vb.ctx.Done():
+			if vb.fastPath != nil {
+				vb.fastPath.close()
+			}
 			return
 		}
 	}
@@ -225,43 +392,114 @@ type vxlanLeaseAttrs struct {
 	VtepMAC hardwareAddr
 }
 
+var errNotVXLAN = errors.New("not a vxlan lease")
+
+// leaseVTEP returns the FDB entry for the VTEP of the node holding l,
+// errNotVXLAN if it runs another backend and backend.ErrNoBackendData if
+// the lease lacks the VTEP MAC
+func leaseVTEP(l *subnet.Lease) (neigh, error) {
+	if l.Attrs.BackendType != "vxlan" {
+		return neigh{}, errNotVXLAN
+	}
+
+	var attrs vxlanLeaseAttrs
+	if err := backend.DecodeBackendData(l.Attrs, &attrs); err != nil {
+		return neigh{}, err
+	}
+	return neigh{IP: l.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)}, nil
+}
+
 func (vb *VXLANBackend) handleSubnetEvents(batch []subnet.Event) {
+	atomic.AddUint64(&vb.evtGen, 1)
+
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.SubnetAdded:
 			log.Info("Subnet added: ", evt.Lease.Subnet)
 
-			if evt.Lease.Attrs.BackendType != "vxlan" {
-				log.Warningf("Ignoring non-vxlan subnet: type=%v", evt.Lease.Attrs.BackendType)
+			vtep, err := leaseVTEP(&evt.Lease)
+			if err == errNotVXLAN {
+				vb.errs.Warningf(evt.Lease.Subnet.String(), "Ignoring non-vxlan subnet %v: type=%v", evt.Lease.Subnet, evt.Lease.Attrs.BackendType)
+				vb.SetRouteState(evt.Lease.Subnet, backend.RouteSkippedMismatch)
+				continue
+			} else if err == backend.ErrNoBackendData {
+				vb.errs.Warningf(evt.Lease.Subnet.String(), "Ignoring subnet %v without a VTEP MAC in its lease", evt.Lease.Subnet)
+				vb.SetRouteState(evt.Lease.Subnet, backend.RouteSkippedNoData)
+				// an update may have taken it away
+				if old := vb.rts.find(evt.Lease.Subnet); old != nil {
+					oldIP := old.vtepIP
+					vb.fdb.DelL2(neigh{IP: old.vtepIP, MAC: old.vtepMAC})
+					vb.delPeer(evt.Lease.Subnet, old.vtepMAC)
+					vb.rts.remove(evt.Lease.Subnet)
+					vb.delFlood(oldIP)
+					if vb.fastPath != nil {
+						vb.fastPath.remove(evt.Lease.Subnet)
+					}
+				}
+				continue
+			} else if err != nil {
+				vb.errs.Errorf(evt.Lease.Subnet.String(), "Error decoding lease JSON of subnet %v: %v", evt.Lease.Subnet, err)
+				vb.SetRouteState(evt.Lease.Subnet, backend.RouteFailed)
 				continue
 			}
 
-			var attrs vxlanLeaseAttrs
-			if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &attrs); err != nil {
-				log.Error("Error decoding subnet lease JSON: ", err)
-				continue
+			// the lease may have been updated to point to a new VTEP,
+			// drop the FDB entry of the old one first
+			oldIP := vtep.IP
+			if old := vb.rts.find(evt.Lease.Subnet); old != nil {
+				if old.vtepIP != vtep.IP || !bytes.Equal(old.vtepMAC, vtep.MAC) {
+					log.Infof("Subnet %v moved from %v to %v", evt.Lease.Subnet, old.vtepIP, vtep.IP)
+					vb.fdb.DelL2(neigh{IP: old.vtepIP, MAC: old.vtepMAC})
+				}
+				oldIP = old.vtepIP
+			}
+
+			vb.addFlood(vtep.IP)
+			vb.rts.set(evt.Lease.Subnet, vtep.IP, vtep.MAC)
+			vb.delFlood(oldIP)
+			if err := vb.addL2(vtep); err != nil {
+				vb.CountFailure("fdb", err)
+				vb.SetRouteState(evt.Lease.Subnet, backend.FailedRouteState(err))
+			} else if err := vb.addPeer(evt.Lease.Subnet, vtep.MAC); err != nil {
+				vb.CountFailure("neigh", err)
+				vb.SetRouteState(evt.Lease.Subnet, backend.RouteFailed)
+			} else {
+				vb.errs.Clear(evt.Lease.Subnet.String())
+				vb.SetHealthy("fdb")
+				vb.SetRouteState(evt.Lease.Subnet, backend.RouteInstalled)
+				vb.notify(&evt.Lease, backend.RouteAdded)
+			}
+			if vb.fastPath != nil {
+				vb.fastPath.add(evt.Lease.Subnet, vtep.IP, vtep.MAC)
 			}
-			vb.rts.set(evt.Lease.Subnet, net.HardwareAddr(attrs.VtepMAC))
-			vb.dev.AddL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
 
 		case subnet.SubnetRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			vb.ForgetRoute(evt.Lease.Subnet)
+			vb.errs.Clear(evt.Lease.Subnet.String())
 
-			if evt.Lease.Attrs.BackendType != "vxlan" {
+			vtep, err := leaseVTEP(&evt.Lease)
+			if err == errNotVXLAN {
 				log.Warningf("Ignoring non-vxlan subnet: type=%v", evt.Lease.Attrs.BackendType)
 				continue
-			}
-
-			var attrs vxlanLeaseAttrs
-			if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &attrs); err != nil {
+			} else if err == backend.ErrNoBackendData {
+				// never programmed
+				continue
+			} else if err != nil {
 				log.Error("Error decoding subnet lease JSON: ", err)
 				continue
 			}
 
-			if len(attrs.VtepMAC) > 0 {
-				vb.dev.DelL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
+			if len(vtep.MAC) > 0 {
+				vb.fdb.DelL2(vtep)
+				vb.delPeer(evt.Lease.Subnet, vtep.MAC)
 			}
 			vb.rts.remove(evt.Lease.Subnet)
+			vb.delFlood(vtep.IP)
+			if vb.fastPath != nil {
+				vb.fastPath.remove(evt.Lease.Subnet)
+			}
+			vb.notify(&evt.Lease, backend.RouteRemoved)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -269,9 +507,13 @@ func (vb *VXLANBackend) handleSubnetEvents(batch []subnet.Event) {
 	}
 }
 
+func (vb *VXLANBackend) notify(l *subnet.Lease, action string) {
+	backend.NotifyRouteChange(vb.sm, backend.RouteChange{Network: vb.network, Subnet: l.Subnet, PeerIP: l.Attrs.PublicIP, Action: action})
+}
+
 func (vb *VXLANBackend) handleInitialSubnetEvents(batch []subnet.Event) error {
 	log.Infof("Handling initial subnet events")
-	fdbTable, err := vb.dev.GetL2List()
+	fdbTable, err := vb.fdb.GetL2List()
 	if err != nil {
 		return fmt.Errorf("Error fetching L2 table: %v", err)
 	}
@@ -281,35 +523,94 @@ func (vb *VXLANBackend) handleInitialSubnetEvents(batch []subnet.Event) error {
 	}
 
 	evtMarker := make([]bool, len(batch))
-	leaseAttrsList := make([]vxlanLeaseAttrs, len(batch))
+	vteps := make([]neigh, len(batch))
 	fdbEntryMarker := make([]bool, len(fdbTable))
 
 	for i, evt := range batch {
-		if evt.Lease.Attrs.BackendType != "vxlan" {
-			log.Warningf("Ignoring non-vxlan subnet: type=%v", evt.Lease.Attrs.BackendType)
+		var err error
+		vteps[i], err = leaseVTEP(&evt.Lease)
+		if err == errNotVXLAN {
+			vb.errs.Warningf(evt.Lease.Subnet.String(), "Ignoring non-vxlan subnet %v: type=%v", evt.Lease.Subnet, evt.Lease.Attrs.BackendType)
+			vb.SetRouteState(evt.Lease.Subnet, backend.RouteSkippedMismatch)
 			evtMarker[i] = true
 			continue
-		}
-
-		if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &leaseAttrsList[i]); err != nil {
-			log.Error("Error decoding subnet lease JSON: ", err)
+		} else if err == backend.ErrNoBackendData {
+			vb.errs.Warningf(evt.Lease.Subnet.String(), "Ignoring subnet %v without a VTEP MAC in its lease", evt.Lease.Subnet)
+			vb.SetRouteState(evt.Lease.Subnet, backend.RouteSkippedNoData)
+			evtMarker[i] = true
+			continue
+		} else if err != nil {
+			vb.errs.Errorf(evt.Lease.Subnet.String(), "Error decoding lease JSON of subnet %v: %v", evt.Lease.Subnet, err)
+			vb.SetRouteState(evt.Lease.Subnet, backend.RouteFailed)
 			evtMarker[i] = true
 			continue
 		}
 
+		// until adding the FDB entry below fails
+		vb.SetRouteState(evt.Lease.Subnet, backend.RouteInstalled)
+
 		for j, fdbEntry := range fdbTable {
-			if evt.Lease.Attrs.PublicIP.ToIP().Equal(fdbEntry.IP) && bytes.Equal([]byte(leaseAttrsList[i].VtepMAC), []byte(fdbEntry.HardwareAddr)) {
+			if vteps[i].IP.ToIP().Equal(fdbEntry.IP) && bytes.Equal([]byte(vteps[i].MAC), []byte(fdbEntry.HardwareAddr)) {
 				evtMarker[i] = true
 				fdbEntryMarker[j] = true
 				break
 			}
 		}
-		vb.rts.set(evt.Lease.Subnet, net.HardwareAddr(leaseAttrsList[i].VtepMAC))
+		vb.rts.set(evt.Lease.Subnet, vteps[i].IP, vteps[i].MAC)
+		if vb.fastPath != nil {
+			vb.fastPath.add(evt.Lease.Subnet, vteps[i].IP, vteps[i].MAC)
+		}
+		if err := vb.addPeer(evt.Lease.Subnet, vteps[i].MAC); err != nil {
+			log.Error("Add neighbor failed: ", err)
+			vb.CountFailure("neigh", err)
+			vb.SetRouteState(evt.Lease.Subnet, backend.RouteFailed)
+		}
+	}
+
+	// leases gone without us having been told
+	live := make(map[ip.IP4Net]bool)
+	inBatch := make(map[ip.IP4Net]bool)
+	for i, evt := range batch {
+		if len(vteps[i].MAC) > 0 {
+			live[evt.Lease.Subnet] = true
+		}
+		inBatch[evt.Lease.Subnet] = true
+	}
+	for sn := range vb.RouteStates() {
+		if !inBatch[sn] {
+			vb.ForgetRoute(sn)
+		}
+	}
+	for _, rt := range append(routes(nil), vb.rts...) {
+		if !live[rt.network] {
+			log.Infof("Subnet %v is gone, removing it", rt.network)
+			vb.delPeer(rt.network, rt.vtepMAC)
+			vb.rts.remove(rt.network)
+			vb.ForgetRoute(rt.network)
+			if vb.fastPath != nil {
+				vb.fastPath.remove(rt.network)
+			}
+		}
+	}
+	if vb.fastPath != nil {
+		// also left behind by an earlier run
+		vb.fastPath.prune(live)
+	}
+
+	// keep the flood entries of the VTEPs left, add those missing and let
+	// the rest go with the stale entries
+	flood := vb.floodPeers()
+	for j, fdbEntry := range fdbTable {
+		if vtepIP := ip.FromIP(fdbEntry.IP); isFloodEntry(fdbEntry.HardwareAddr) && flood[vtepIP] {
+			fdbEntryMarker[j] = true
+			delete(flood, vtepIP)
+		}
 	}
 
 	for j, marker := range fdbEntryMarker {
 		if !marker {
-			err := vb.dev.DelL2(neigh{IP: ip.FromIP(fdbTable[j].IP), MAC: fdbTable[j].HardwareAddr})
+			log.Infof("Removing stale FDB entry: %s %s", fdbTable[j].IP, fdbTable[j].HardwareAddr)
+			err := vb.fdb.DelL2(neigh{IP: ip.FromIP(fdbTable[j].IP), MAC: fdbTable[j].HardwareAddr})
 			if err != nil {
 				log.Error("Delete L2 failed: ", err)
 			}
@@ -318,13 +619,21 @@ func (vb *VXLANBackend) handleInitialSubnetEvents(batch []subnet.Event) error {
 
 	for i, marker := range evtMarker {
 		if !marker {
-			err := vb.dev.AddL2(neigh{IP: batch[i].Lease.Attrs.PublicIP, MAC: net.HardwareAddr(leaseAttrsList[i].VtepMAC)})
+			err := vb.addL2(vteps[i])
 			if err != nil {
 				log.Error("Add L2 failed: ", err)
+				vb.CountFailure("fdb", err)
+				vb.SetRouteState(batch[i].Lease.Subnet, backend.FailedRouteState(err))
 			}
 
 		}
 	}
+
+	for vtepIP := range flood {
+		if err := vb.fdb.AddL2(neigh{IP: vtepIP, MAC: floodMAC}); err != nil {
+			log.Errorf("Failed to add flood entry for %v: %v", vtepIP, err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,74 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestEmptyBackendData(t *testing.T) {
+	good := vxlanLease(t, "10.1.1.0/24", "192.168.0.1", "aa:bb:cc:00:00:01")
+	empty := vxlanLease(t, "10.1.2.0/24", "192.168.0.2", "aa:bb:cc:00:00:02")
+	withData := empty
+	withData.Attrs = &subnet.LeaseAttrs{}
+	*withData.Attrs = *empty.Attrs
+	empty.Attrs.BackendData = nil
+
+	f := &mockFDB{entries: make(map[string]neigh)}
+	vb := New(nil, "", &subnet.Config{}).(*VXLANBackend)
+	vb.fdb = f
+
+	if err := vb.handleInitialSubnetEvents(snapshotEvents([]subnet.Lease{good, empty})); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.entries) != 1 {
+		t.Errorf("expected the FDB entry of %v only, got %v", good.Subnet, f.entries)
+	}
+	if s := vb.RouteStates()[empty.Subnet]; s != backend.RouteSkippedNoData {
+		t.Errorf("lease without backend data is %q", s)
+	}
+
+	// routed once the data shows up
+	vb.handleSubnetEvents(snapshotEvents([]subnet.Lease{withData}))
+	if _, ok := f.entries["192.168.0.2"]; !ok {
+		t.Error("no FDB entry once the lease has its backend data")
+	}
+	if s := vb.RouteStates()[empty.Subnet]; s != backend.RouteInstalled {
+		t.Errorf("lease with backend data is %q", s)
+	}
+
+	// and no longer when it is gone again
+	empty.Attrs.BackendData = json.RawMessage("null")
+	vb.handleSubnetEvents(snapshotEvents([]subnet.Lease{empty}))
+	if _, ok := f.entries["192.168.0.2"]; ok {
+		t.Error("FDB entry kept after the backend data was taken away")
+	}
+	if vb.rts.find(empty.Subnet) != nil {
+		t.Error("route kept after the backend data was taken away")
+	}
+	if s := vb.RouteStates()[empty.Subnet]; s != backend.RouteSkippedNoData {
+		t.Errorf("lease without backend data is %q", s)
+	}
+
+	// removing it is a no-op
+	vb.handleSubnetEvents([]subnet.Event{{Type: subnet.SubnetRemoved, Lease: empty}})
+	if len(f.entries) != 1 {
+		t.Errorf("expected the FDB entry of %v only, got %v", good.Subnet, f.entries)
+	}
+}
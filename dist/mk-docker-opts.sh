@@ -58,7 +58,10 @@ if [ -f "$flannel_env" ]; then
 	source $flannel_env
 fi
 
-if [ -n "$FLANNEL_SUBNET" ]; then
+if [ -n "$FLANNEL_BRIDGE" ]; then
+	# flannel configured the bridge, --bip would conflict with it
+	DOCKER_OPT_BRIDGE="--bridge=$FLANNEL_BRIDGE"
+elif [ -n "$FLANNEL_SUBNET" ]; then
 	DOCKER_OPT_BIP="--bip=$FLANNEL_SUBNET"
 fi
 
@@ -0,0 +1,386 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gossip
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// largest UDP payload, the state of the whole cluster has to fit
+const maxMessageSize = 65507
+
+// claim is what a node advertises: the subnet it holds (none if its
+// PrefixLen is zero) with the attributes of the lease. The node raises
+// Version every round, so that newer claims replace older ones and a
+// node that went silent can be told from a live one.
+type claim struct {
+	NodeID  string
+	Version uint64
+	Subnet  ip.IP4Net
+	Attrs   *subnet.LeaseAttrs `json:",omitempty"`
+	// Addr is where the sender heard from the node, empty
+	// in the sender's own claim
+	Addr string `json:",omitempty"`
+}
+
+func (c *claim) holds() bool {
+	return c.Subnet.PrefixLen > 0
+}
+
+// message is a gossip datagram: the sender's claim and those it knows of
+type message struct {
+	Claims []claim
+}
+
+type member struct {
+	claim
+	// where the node is reached
+	addr string
+	// when its Version last rose
+	seen time.Time
+}
+
+// heldLease is a lease in the view of the cluster and the node holding it
+type heldLease struct {
+	subnet.Lease
+	holder string
+}
+
+// nextVersion returns a version above v. Versions start from the clock so
+// that a restarted node's claims are newer than those from before.
+func nextVersion(v uint64) uint64 {
+	if now := uint64(time.Now().UnixNano()); now > v {
+		return now
+	}
+	return v + 1
+}
+
+func (m *Manager) receive() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, src, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if m.ctx.Err() != nil {
+				return
+			}
+			m.errs.Errorf("receive", "Failed to receive gossip: %v", err)
+			continue
+		}
+		m.errs.Clear("receive")
+
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			m.errs.Warningf(src.String(), "Ignoring malformed gossip from %v: %v", src, err)
+			continue
+		}
+		m.merge(msg.Claims, src.String())
+	}
+}
+
+// merge takes in the claims received from src
+func (m *Manager) merge(claims []claim, src string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := time.Now()
+	for _, c := range claims {
+		if c.NodeID == "" {
+			continue
+		}
+		if c.NodeID == m.self.NodeID {
+			// ours from before a restart, stay ahead of it
+			if c.Version >= m.self.Version {
+				m.self.Version = nextVersion(c.Version)
+			}
+			continue
+		}
+		if c.Version <= m.dead[c.NodeID] {
+			continue
+		}
+
+		mb, ok := m.members[c.NodeID]
+		if !ok {
+			mb = &member{}
+			m.members[c.NodeID] = mb
+			log.Infof("Node %v joined the gossip cluster", c.NodeID)
+		}
+		// an address heard from directly beats one passed on
+		if c.Addr == "" {
+			mb.addr = src
+		} else if mb.addr == "" {
+			mb.addr = c.Addr
+		}
+		if c.Version <= mb.Version {
+			continue
+		}
+
+		delete(m.dead, c.NodeID)
+		mb.claim = c
+		mb.Addr = ""
+		mb.seen = now
+	}
+
+	m.resolve()
+	m.publish()
+}
+
+// beatenBy returns the node with a lower NodeID claiming a subnet
+// overlapping ours, empty if there is none
+func (m *Manager) beatenBy() string {
+	if !m.self.holds() {
+		return ""
+	}
+
+	winner := ""
+	for id, mb := range m.members {
+		if mb.holds() && mb.Subnet.Overlaps(m.self.Subnet) && id < m.self.NodeID && (winner == "" || id < winner) {
+			winner = id
+		}
+	}
+	return winner
+}
+
+// resolve gives up our acquired subnet if a node with a lower NodeID
+// claims it too, e.g. once a partition heals, and claims another one.
+// Claims still settling are resolved by AcquireLease.
+func (m *Manager) resolve() {
+	if !m.acquired {
+		return
+	}
+	if winner := m.beatenBy(); winner != "" {
+		m.repick(winner)
+	}
+}
+
+// repick claims a free subnet in place of the one winner took from us
+// and has settle hand it over once it stood unchallenged
+func (m *Manager) repick(winner string) {
+	lost, attrs := m.self.Subnet, m.self.Attrs
+	m.withdraw()
+
+	sn, err := subnet.AllocateSubnet(m.config, m.attrs, m.claimedByOthers())
+	if err != nil {
+		log.Errorf("Node %v also claims subnet %v and wins, giving it up; no other one to claim: %v", winner, lost, err)
+		return
+	}
+	log.Warningf("Node %v also claims subnet %v and wins, claiming %v instead", winner, lost, sn)
+	m.self.Subnet = sn
+	m.self.Attrs = attrs
+
+	m.wg.Add(1)
+	go func() {
+		m.settle(sn)
+		m.wg.Done()
+	}()
+}
+
+// settle passes on the lease of sn, claimed by repick, once the claim
+// stood unchallenged for Settle
+func (m *Manager) settle(sn ip.IP4Net) {
+	if err := sleep(m.ctx, m.opts.Settle); err != nil {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.acquired || m.self.Subnet != sn {
+		// taken over by AcquireLease or given up
+		return
+	}
+	if winner := m.beatenBy(); winner != "" {
+		m.repick(winner)
+		m.publish()
+		return
+	}
+
+	m.acquired = true
+	log.Infof("Acquired subnet %v in place of the lost one", sn)
+	select {
+	case <-m.replaced:
+		// superseded
+	default:
+	}
+	m.replaced <- m.ownLease()
+}
+
+func (m *Manager) withdraw() {
+	m.self.Subnet = ip.IP4Net{}
+	m.self.Attrs = nil
+	m.self.Version = nextVersion(m.self.Version)
+	m.acquired = false
+}
+
+// expire drops the claims of the nodes not heard of for DeadAfter
+func (m *Manager) expire(now time.Time) {
+	for id, mb := range m.members {
+		if now.Sub(mb.seen) > m.opts.DeadAfter {
+			log.Warningf("Node %v not heard of for %v, dropping its claims", id, m.opts.DeadAfter)
+			m.dead[id] = mb.Version
+			delete(m.members, id)
+		}
+	}
+}
+
+// publish works out the leases from the claims, the one of the lowest
+// NodeID winning among overlapping ones, and records the changes as events
+func (m *Manager) publish() {
+	claims := []claim{}
+	if m.self.holds() {
+		claims = append(claims, m.self)
+	}
+	for _, mb := range m.members {
+		if mb.holds() {
+			claims = append(claims, mb.claim)
+		}
+	}
+	sort.Sort(byNodeID(claims))
+
+	leases := make(map[ip.IP4Net]heldLease)
+	won := []ip.IP4Net{}
+ClaimLoop:
+	for _, c := range claims {
+		for _, sn := range won {
+			if sn.Overlaps(c.Subnet) {
+				continue ClaimLoop
+			}
+		}
+		won = append(won, c.Subnet)
+
+		old, ok := m.leases[c.Subnet]
+		if ok && old.holder == c.NodeID && reflect.DeepEqual(old.Attrs, c.Attrs) {
+			leases[c.Subnet] = old
+			continue
+		}
+		hl := heldLease{subnet.Lease{Subnet: c.Subnet, Attrs: c.Attrs, Expiration: time.Now().Add(leaseTTL)}, c.NodeID}
+		leases[c.Subnet] = hl
+		m.record(subnet.Event{Type: subnet.SubnetAdded, Lease: hl.Lease})
+	}
+
+	for sn, old := range m.leases {
+		if _, ok := leases[sn]; ok {
+			continue
+		}
+		reason := subnet.LeaseRevoked
+		if _, gone := m.dead[old.holder]; gone {
+			reason = subnet.LeaseExpired
+		}
+		m.record(subnet.Event{Type: subnet.SubnetRemoved, Lease: old.Lease, Reason: reason})
+	}
+	m.leases = leases
+}
+
+func (m *Manager) record(e subnet.Event) {
+	m.history = append(m.history, e)
+	if len(m.history) > historySize {
+		m.first += uint64(len(m.history) - historySize)
+		m.history = append([]subnet.Event(nil), m.history[len(m.history)-historySize:]...)
+	}
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *Manager) gossip(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(m.opts.Interval):
+			m.round()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// round sends our claim and those we know of to Fanout random nodes and
+// to the configured peers
+func (m *Manager) round() {
+	m.mux.Lock()
+	m.self.Version = nextVersion(m.self.Version)
+	m.expire(time.Now())
+	m.publish()
+
+	msg := message{Claims: []claim{m.self}}
+	addrs := []string{}
+	for _, mb := range m.members {
+		c := mb.claim
+		c.Addr = mb.addr
+		msg.Claims = append(msg.Claims, c)
+		if mb.addr != "" {
+			addrs = append(addrs, mb.addr)
+		}
+	}
+	peers := m.opts.Peers
+	m.mux.Unlock()
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		log.Errorf("Failed to encode gossip: %v", err)
+		return
+	}
+	if len(data) > maxMessageSize {
+		m.errs.Errorf("size", "Claims of %v nodes don't fit into a gossip datagram (%v bytes)", len(msg.Claims), len(data))
+		return
+	}
+	m.errs.Clear("size")
+
+	for _, addr := range m.targets(addrs, peers) {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err == nil {
+			_, err = m.conn.WriteToUDP(data, udpAddr)
+		}
+		if err != nil {
+			m.errs.Warningf(addr, "Failed to gossip to %v: %v", addr, err)
+			continue
+		}
+		m.errs.Clear(addr)
+	}
+}
+
+// targets picks Fanout of addrs and adds peers
+func (m *Manager) targets(addrs, peers []string) []string {
+	picked := []string{}
+	chosen := make(map[string]bool)
+	for _, i := range rand.Perm(len(addrs)) {
+		if len(picked) == m.opts.Fanout {
+			break
+		}
+		picked = append(picked, addrs[i])
+		chosen[addrs[i]] = true
+	}
+	for _, p := range peers {
+		if !chosen[p] {
+			picked = append(picked, p)
+		}
+	}
+	return picked
+}
+
+type byNodeID []claim
+
+func (s byNodeID) Len() int           { return len(s) }
+func (s byNodeID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNodeID) Less(i, j int) bool { return s[i].NodeID < s[j].NodeID }
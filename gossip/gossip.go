@@ -0,0 +1,448 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gossip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/errlog"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	defaultInterval = time.Second
+	defaultFanout   = 3
+
+	// nominal, leases live as long as their node keeps gossiping
+	leaseTTL = 24 * time.Hour
+
+	// lease events kept for watches to catch up on
+	historySize = 1000
+)
+
+var errNotHolder = errors.New("only the node holding a lease can change it")
+
+// Options configure the gossip Manager
+type Options struct {
+	// NodeID names the node in the cluster. Of two nodes claiming
+	// overlapping subnets the one with the lower NodeID keeps its.
+	NodeID string
+	// Listen is the UDP address gossip is exchanged on
+	Listen string
+	// Peers are the addresses of nodes to join the cluster through,
+	// they are gossiped to every round
+	Peers []string
+	// Config is the config of the network, the same on all nodes
+	Config string
+
+	// Interval is the time between gossip rounds, a second if zero
+	Interval time.Duration
+	// Fanout is the number of random nodes gossiped to every
+	// round, 3 if zero
+	Fanout int
+	// DeadAfter is how long a node goes unheard of before its lease
+	// is dropped, 15 rounds if zero
+	DeadAfter time.Duration
+	// Settle is how long a claim has to stand unchallenged before
+	// AcquireLease returns it, 3 rounds if zero
+	Settle time.Duration
+}
+
+// Manager is a subnet.Manager coordinating the leases of the default
+// network between nodes without etcd. Every node advertises the subnet
+// it picked to the others over UDP gossip and conflicting claims are
+// resolved in favor of the lowest NodeID.
+type Manager struct {
+	opts   Options
+	config *subnet.Config
+	conn   *net.UDPConn
+	errs   *errlog.Limiter
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mux  sync.Mutex
+	self claim
+	// self.Subnet was returned by AcquireLease
+	acquired bool
+	// what AcquireLease was last asked for, for picking another
+	// subnet when ours is lost
+	attrs *subnet.LeaseAttrs
+	// receives the lease that replaced a lost one
+	replaced chan *subnet.Lease
+	members  map[string]*member
+	// the last versions of the nodes given up on
+	dead   map[string]uint64
+	leases map[ip.IP4Net]heldLease
+	// history[i] is the event of index first+i
+	history []subnet.Event
+	first   uint64
+	// closed on the next event
+	changed chan struct{}
+}
+
+// NewManager starts gossiping on opts.Listen
+func NewManager(opts Options) (*Manager, error) {
+	if opts.NodeID == "" {
+		return nil, errors.New("gossip needs a node ID")
+	}
+
+	config, err := subnet.ParseConfig(opts.Config)
+	if err != nil {
+		return nil, fmt.Errorf("bad network config: %v", err)
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.Fanout <= 0 {
+		opts.Fanout = defaultFanout
+	}
+	if opts.DeadAfter <= 0 {
+		opts.DeadAfter = 15 * opts.Interval
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = 3 * opts.Interval
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", opts.Listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		opts:     opts,
+		config:   config,
+		conn:     conn,
+		errs:     errlog.NewLimiter(errlog.DefaultInterval),
+		ctx:      ctx,
+		cancel:   cancel,
+		self:     claim{NodeID: opts.NodeID, Version: nextVersion(0)},
+		members:  make(map[string]*member),
+		dead:     make(map[string]uint64),
+		leases:   make(map[ip.IP4Net]heldLease),
+		changed:  make(chan struct{}),
+		replaced: make(chan *subnet.Lease, 1),
+	}
+
+	m.wg.Add(2)
+	go func() {
+		m.receive()
+		m.wg.Done()
+	}()
+	go func() {
+		m.gossip(ctx)
+		m.wg.Done()
+	}()
+
+	log.Infof("Gossiping as %v on %v", opts.NodeID, conn.LocalAddr())
+	return m, nil
+}
+
+// Addr returns the address gossip is received on
+func (m *Manager) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Replaced returns a channel that receives the new lease of the node
+// whenever it lost its subnet to a node with a lower NodeID and
+// acquired another one. The lost lease can no longer be renewed.
+func (m *Manager) Replaced() <-chan *subnet.Lease {
+	return m.replaced
+}
+
+// Close stops gossiping. The lease of the node is dropped by the others
+// once DeadAfter passes.
+func (m *Manager) Close() {
+	m.cancel()
+	m.conn.Close()
+	m.wg.Wait()
+}
+
+func checkNetwork(network string) error {
+	if network != "" {
+		return fmt.Errorf("gossip only coordinates the default network, not %q", network)
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	config := *m.config
+	return &config, nil
+}
+
+func (m *Manager) GetNetworkStats(ctx context.Context, network string) (*subnet.NetworkStats, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return subnet.LeaseStats(m.config, m.snapshot()), nil
+}
+
+// ownLease returns the lease of this node, if it holds one
+func (m *Manager) ownLease() *subnet.Lease {
+	return &subnet.Lease{Subnet: m.self.Subnet, Attrs: m.self.Attrs, Expiration: time.Now().Add(leaseTTL)}
+}
+
+// claimedByOthers returns the subnets claimed by other nodes, winning or not
+func (m *Manager) claimedByOthers() []subnet.Lease {
+	leases := []subnet.Lease{}
+	for _, mb := range m.members {
+		if mb.holds() {
+			leases = append(leases, subnet.Lease{Subnet: mb.Subnet})
+		}
+	}
+	return leases
+}
+
+// AcquireLease claims a subnet not claimed by any node known of and
+// returns it once it stood unchallenged for Settle. A claim challenged by
+// a node with a lower NodeID is given up for another one.
+func (m *Manager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
+	prefixLen, err := subnet.LeasePrefixLen(m.config, attrs)
+	if err != nil {
+		return nil, err
+	}
+	stored := *attrs
+	stored.AvoidSubnets = nil
+
+	keep := func() bool {
+		if !m.self.holds() || m.self.Subnet.PrefixLen != prefixLen || m.beatenBy() != "" {
+			return false
+		}
+		for _, asn := range attrs.AvoidSubnets {
+			if asn.Overlaps(m.self.Subnet) {
+				return false
+			}
+		}
+		return true
+	}
+
+	m.mux.Lock()
+	if m.acquired && keep() {
+		m.attrs = attrs
+		m.self.Attrs = &stored
+		m.self.Version = nextVersion(m.self.Version)
+		m.publish()
+		l := m.ownLease()
+		m.mux.Unlock()
+		return l, nil
+	}
+	m.mux.Unlock()
+
+	// hear from the cluster before picking out of what is left
+	if err := sleep(ctx, m.opts.Settle); err != nil {
+		return nil, err
+	}
+
+	for {
+		m.mux.Lock()
+		if !keep() {
+			sn, err := subnet.AllocateSubnet(m.config, attrs, m.claimedByOthers())
+			if err != nil {
+				m.mux.Unlock()
+				return nil, err
+			}
+			m.self.Subnet = sn
+		}
+		m.self.Attrs = &stored
+		m.self.Version = nextVersion(m.self.Version)
+		m.publish()
+		sn := m.self.Subnet
+		m.mux.Unlock()
+
+		log.Infof("Claimed subnet %v, waiting %v for conflicting claims", sn, m.opts.Settle)
+		if err := sleep(ctx, m.opts.Settle); err != nil {
+			m.mux.Lock()
+			m.withdraw()
+			m.publish()
+			m.mux.Unlock()
+			return nil, err
+		}
+
+		m.mux.Lock()
+		winner := m.beatenBy()
+		if winner == "" && m.self.Subnet == sn {
+			m.acquired = true
+			m.attrs = attrs
+			l := m.ownLease()
+			m.mux.Unlock()
+			return l, nil
+		}
+		log.Infof("Node %v also claims subnet %v and wins, picking another one", winner, sn)
+		m.self.Subnet = ip.IP4Net{}
+		m.mux.Unlock()
+	}
+}
+
+func (m *Manager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	if err := checkNetwork(network); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	// given up to another node
+	if !m.acquired || m.self.Subnet != lease.Subnet {
+		return subnet.ErrLeaseExpired
+	}
+	lease.Expiration = time.Now().Add(leaseTTL)
+	return nil
+}
+
+func (m *Manager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if !m.acquired || m.self.Subnet != sn {
+		return nil, errNotHolder
+	}
+	stored := *attrs
+	stored.AvoidSubnets = nil
+	m.self.Attrs = &stored
+	m.self.Version = nextVersion(m.self.Version)
+	m.publish()
+	return m.ownLease(), nil
+}
+
+func (m *Manager) GetLease(ctx context.Context, network string, sn ip.IP4Net) (*subnet.Lease, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	hl, ok := m.leases[sn]
+	if !ok {
+		return nil, subnet.ErrLeaseNotFound
+	}
+	l := hl.Lease
+	return &l, nil
+}
+
+func (m *Manager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	if err := checkNetwork(network); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if !m.acquired || m.self.Subnet != sn {
+		return errNotHolder
+	}
+	m.withdraw()
+	m.publish()
+	return nil
+}
+
+func (m *Manager) DrainLease(ctx context.Context, network string, sn ip.IP4Net, r *subnet.Reservation) error {
+	return errors.New("draining leases is not supported with gossip")
+}
+
+func (m *Manager) snapshot() []subnet.Lease {
+	leases := make([]subnet.Lease, 0, len(m.leases))
+	for _, hl := range m.leases {
+		leases = append(leases, hl.Lease)
+	}
+	return leases
+}
+
+// WatchLeases returns the leases known of without a cursor and the changes
+// since the cursor (the index of the next event) otherwise
+func (m *Manager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if err := checkNetwork(network); err != nil {
+		return subnet.WatchResult{}, err
+	}
+
+	m.mux.Lock()
+	next := m.first + uint64(len(m.history))
+	if cursor == nil {
+		defer m.mux.Unlock()
+		return subnet.WatchResult{Snapshot: m.snapshot(), Cursor: strconv.FormatUint(next, 10)}, nil
+	}
+	m.mux.Unlock()
+
+	s, ok := cursor.(string)
+	if !ok {
+		return subnet.WatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+	index, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return subnet.WatchResult{}, fmt.Errorf("failed to parse cursor: %v", err)
+	}
+
+	for {
+		m.mux.Lock()
+		next := m.first + uint64(len(m.history))
+		switch {
+		case index < m.first, index > next:
+			// the latter from before a restart
+			m.mux.Unlock()
+			return subnet.WatchResult{}, subnet.ErrCursorExpired
+
+		case index < next:
+			events := append([]subnet.Event(nil), m.history[index-m.first:]...)
+			m.mux.Unlock()
+			return subnet.WatchResult{Events: events, Cursor: strconv.FormatUint(next, 10)}, nil
+		}
+		changed := m.changed
+		m.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return subnet.WatchResult{}, ctx.Err()
+		}
+	}
+}
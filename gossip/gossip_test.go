@@ -0,0 +1,244 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// room for 6 nodes, so that random picks collide
+const testConfig = `{ "Network": "10.5.0.0/16", "SubnetLen": 24, "SubnetMin": "10.5.0.0", "SubnetMax": "10.5.5.0" }`
+
+func newTestManager(t *testing.T, id, config string, peers ...string) *Manager {
+	m, err := NewManager(Options{
+		NodeID:    id,
+		Listen:    "127.0.0.1:0",
+		Peers:     peers,
+		Config:    config,
+		Interval:  10 * time.Millisecond,
+		DeadAfter: 300 * time.Millisecond,
+		Settle:    100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start gossip: %v", err)
+	}
+	return m
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func attrs(i int) *subnet.LeaseAttrs {
+	return &subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP(fmt.Sprintf("192.168.0.%d", i+1)))}
+}
+
+// sameLeases reports whether m knows of exactly leases
+func sameLeases(m *Manager, leases []*subnet.Lease) bool {
+	wr, err := m.WatchLeases(context.Background(), "", nil)
+	if err != nil || len(wr.Snapshot) != len(leases) {
+		return false
+	}
+	for _, l := range leases {
+		found := false
+		for _, sl := range wr.Snapshot {
+			found = found || (sl.Subnet == l.Subnet && sl.Attrs.PublicIP == l.Attrs.PublicIP)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestClusterConverges(t *testing.T) {
+	const nodes = 5
+
+	ms := []*Manager{newTestManager(t, "node-0", testConfig)}
+	for i := 1; i < nodes; i++ {
+		ms = append(ms, newTestManager(t, fmt.Sprintf("node-%d", i), testConfig, ms[0].Addr().String()))
+	}
+	defer func() {
+		for _, m := range ms {
+			m.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	leases := make([]*subnet.Lease, nodes)
+	wg := sync.WaitGroup{}
+	for i := range ms {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := ms[i].AcquireLease(ctx, "", attrs(i))
+			if err != nil {
+				t.Errorf("node-%d: AcquireLease failed: %v", i, err)
+				return
+			}
+			leases[i] = l
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for i := range leases {
+		for j := 0; j < i; j++ {
+			if leases[i].Subnet.Overlaps(leases[j].Subnet) {
+				t.Fatalf("node-%d and node-%d both got %v", j, i, leases[i].Subnet)
+			}
+		}
+	}
+
+	for i, m := range ms {
+		waitFor(t, fmt.Sprintf("node-%d to know of all leases", i), func() bool { return sameLeases(m, leases) })
+		if err := m.RenewLease(ctx, "", leases[i]); err != nil {
+			t.Errorf("node-%d: RenewLease failed: %v", i, err)
+		}
+	}
+
+	// the lease of a node gone silent expires
+	wr, err := ms[1].WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms[nodes-1].Close()
+	ms = ms[:nodes-1]
+
+	waitFor(t, "the lease of the closed node to expire", func() bool { return sameLeases(ms[1], leases[:nodes-1]) })
+	wr, err = ms[1].WatchLeases(ctx, "", wr.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != subnet.SubnetRemoved || wr.Events[0].Reason != subnet.LeaseExpired {
+		t.Errorf("expected the expiry of %v, got %+v", leases[nodes-1].Subnet, wr.Events)
+	}
+}
+
+func TestLowestNodeIDWins(t *testing.T) {
+	// a single subnet
+	config := `{ "Network": "10.5.0.0/16", "SubnetLen": 24, "SubnetMin": "10.5.7.0", "SubnetMax": "10.5.7.0" }`
+
+	// partitioned until b learns of a
+	a := newTestManager(t, "node-a", config)
+	defer a.Close()
+	b := newTestManager(t, "node-b", config)
+	defer b.Close()
+
+	ctx := context.Background()
+	la, err := a.AcquireLease(ctx, "", attrs(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := b.AcquireLease(ctx, "", attrs(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if la.Subnet != lb.Subnet {
+		t.Fatalf("expected both to get the only subnet, got %v and %v", la.Subnet, lb.Subnet)
+	}
+
+	b.mux.Lock()
+	b.opts.Peers = []string{a.Addr().String()}
+	b.mux.Unlock()
+
+	waitFor(t, "node-b to give up its lease", func() bool { return b.RenewLease(ctx, "", lb) == subnet.ErrLeaseExpired })
+	if err := a.RenewLease(ctx, "", la); err != nil {
+		t.Errorf("node-a lost its lease: %v", err)
+	}
+	for _, m := range []*Manager{a, b} {
+		waitFor(t, "everyone to agree the subnet is node-a's", func() bool { return sameLeases(m, []*subnet.Lease{la}) })
+	}
+
+	// nothing left for the loser
+	if _, err := b.AcquireLease(ctx, "", attrs(1)); err == nil {
+		t.Error("node-b acquired a lease with no subnet free")
+	}
+}
+
+func TestLoserRepicks(t *testing.T) {
+	// the same hostname hashes both to the same subnet
+	config := `{ "Network": "10.5.0.0/16", "SubnetLen": 24, "SubnetMin": "10.5.7.0", "SubnetMax": "10.5.8.0", "Allocation": "hashed" }`
+	sameHost := func(i int) *subnet.LeaseAttrs {
+		a := attrs(i)
+		a.Hostname = "edge"
+		return a
+	}
+
+	// partitioned until b learns of a
+	a := newTestManager(t, "node-a", config)
+	defer a.Close()
+	b := newTestManager(t, "node-b", config)
+	defer b.Close()
+
+	ctx := context.Background()
+	la, err := a.AcquireLease(ctx, "", sameHost(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := b.AcquireLease(ctx, "", sameHost(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if la.Subnet != lb.Subnet {
+		t.Fatalf("expected both to get the subnet their hostname hashes to, got %v and %v", la.Subnet, lb.Subnet)
+	}
+
+	b.mux.Lock()
+	b.opts.Peers = []string{a.Addr().String()}
+	b.mux.Unlock()
+
+	var nl *subnet.Lease
+	select {
+	case nl = <-b.Replaced():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for node-b to acquire another lease")
+	}
+	if nl.Subnet.Overlaps(la.Subnet) {
+		t.Fatalf("node-b replaced its lease with %v, which overlaps node-a's %v", nl.Subnet, la.Subnet)
+	}
+	if nl.Attrs.PublicIP != lb.Attrs.PublicIP {
+		t.Errorf("the new lease of node-b has public IP %v, expected %v", nl.Attrs.PublicIP, lb.Attrs.PublicIP)
+	}
+
+	if err := b.RenewLease(ctx, "", lb); err != subnet.ErrLeaseExpired {
+		t.Errorf("expected the lost lease to be expired, got %v", err)
+	}
+	if err := b.RenewLease(ctx, "", nl); err != nil {
+		t.Errorf("node-b failed to renew its new lease: %v", err)
+	}
+	for _, m := range []*Manager{a, b} {
+		waitFor(t, "everyone to know of both leases", func() bool { return sameLeases(m, []*subnet.Lease{la, nl}) })
+	}
+}
@@ -15,22 +15,32 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-systemd/daemon"
 	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/gossip"
 	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/health"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/nats"
+	"github.com/coreos/flannel/pkg/selftest"
 	"github.com/coreos/flannel/remote"
 	"github.com/coreos/flannel/subnet"
 )
@@ -41,15 +51,101 @@ type CmdLineOpts struct {
 	etcdKeyfile   string
 	etcdCertfile  string
 	etcdCAFile    string
+	leaseGrace    time.Duration
+	leaseHold     time.Duration
+	duplicateIP   string
+	reuseHostname bool
 	help          bool
 	version       bool
 	ipMasq        bool
+	iptablesTag   bool
 	subnetFile    string
 	subnetDir     string
+	fileDebounce  time.Duration
+	mgmtNetwork   string
+	observe       bool
+	bridge        string
 	iface         string
+	bindAddr      string
+	publicIP      string
+	publicIPv6    string
 	listen        string
 	remote        string
+	replicaOf     string
+	maxWatchLife  time.Duration
+	bookmarkIval  time.Duration
+	watchHistory  time.Duration
+	maxAcquires   int
+	acquireQueue  int
+	acquireWait   time.Duration
+	maxWatches    int
+	maxWatchesIP  int
+	writeTimeout  time.Duration
+	maintenance   bool
 	networks      string
+	leaseKey      string
+	subnetBlocks  uint
+	publicIPs     string
+	zone          string
+	tenant        string
+	advertiseVer  bool
+	hostname      string
+	perPeerMTU    bool
+	manageLink    bool
+	verifyRoutes  bool
+
+	publicHostname  string
+	resolveInterval time.Duration
+
+	drainFor        string
+	drainGrace      time.Duration
+	routeFilterFile string
+	coalesceWindow  time.Duration
+	maxRoutes       int
+	watchBuffer     int
+	watchOverflow   string
+
+	configRetryTimeout time.Duration
+	configWaitTimeout  time.Duration
+	configCacheDir     string
+	subnetConflict     string
+	healthListen       string
+	writeSubnetFile    bool
+
+	selftestListen   string
+	selftestDuration time.Duration
+	selftestStreams  int
+
+	reconcileNodesFile string
+	reconcileInterval  time.Duration
+	reconcileRemove    bool
+	configCheckIntvl   time.Duration
+
+	routeHookCmd     string
+	routeHookURL     string
+	routeHookTimeout time.Duration
+
+	leaseEventsNATS    string
+	leaseEventsSubject string
+	leaseEventsQueue   int
+
+	remoteKeepAlive time.Duration
+	remoteCompress  int
+	remoteTokenFile string
+
+	serverTenant string
+	tenantTokens string
+
+	etcdSRVDomain  string
+	etcdSRVRefresh time.Duration
+
+	gossipListen string
+	gossipPeers  string
+	gossipConfig string
+	gossipNodeID string
+
+	sqlDriver string
+	sqlDSN    string
 }
 
 var opts CmdLineOpts
@@ -60,13 +156,87 @@ func init() {
 	flag.StringVar(&opts.etcdKeyfile, "etcd-keyfile", "", "SSL key file used to secure etcd communication")
 	flag.StringVar(&opts.etcdCertfile, "etcd-certfile", "", "SSL certification file used to secure etcd communication")
 	flag.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
+	flag.StringVar(&opts.etcdSRVDomain, "etcd-srv-domain", "", "domain whose _etcd-client._tcp (or, with TLS, _etcd-client-ssl._tcp) SRV records list the etcd endpoints; --etcd-endpoints is used if discovery fails")
+	flag.DurationVar(&opts.etcdSRVRefresh, "etcd-srv-refresh", 5*time.Minute, "how often to resolve the --etcd-srv-domain SRV records again, 0 only resolves them at startup")
+	flag.StringVar(&opts.sqlDriver, "sql-driver", "", "database/sql driver of --sql-dsn: 'postgres' or 'mysql', linked in with the build tag of the same name (defaults to the one linked in)")
+	flag.StringVar(&opts.sqlDSN, "sql-dsn", "", "keep network configs and leases in the SQL database of this data source name instead of etcd")
+	flag.DurationVar(&opts.leaseGrace, "lease-grace", 0, "keep leases in etcd for this long past their expiry and accept renewals of them within it, to tolerate clock skew")
+	flag.DurationVar(&opts.leaseHold, "lease-hold", subnet.DefaultLeaseHold, "keep the subnet of a new lease for its node for this long even if the lease expires before its first renewal, 0 disables")
+	flag.StringVar(&opts.duplicateIP, "duplicate-public-ip", subnet.DuplicatePublicIPReject, "what to do about a node acquiring a lease with the public IP of another node's: 'reject' it or 'warn' and grant it (for nodes behind a shared NAT)")
 	flag.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where env variables (subnet, MTU, ... ) will be written to")
+	flag.DurationVar(&opts.fileDebounce, "subnet-file-debounce", 0, "write each subnet file at most once per this window, merging the changes within it into one write of the last content (0 writes right away)")
 	flag.StringVar(&opts.subnetDir, "subnet-dir", "/run/flannel/networks", "directory where files with env variables (subnet, MTU, ...) will be written to")
 	flag.StringVar(&opts.iface, "iface", "", "interface to use (IP or name) for inter-host communication")
-	flag.StringVar(&opts.listen, "listen", "", "run as server and listen on specified address (e.g. ':8080')")
-	flag.StringVar(&opts.remote, "remote", "", "run as client and connect to server on specified address (e.g. '10.1.2.3:8080')")
+	flag.StringVar(&opts.bindAddr, "bind-address", "", "local IP for backends to bind to and send encapsulated packets from (defaults to the IP of --iface)")
+	flag.StringVar(&opts.publicIP, "public-ip", "", "IP (or DNS name, resolved again every --resolve-interval) to advertise to peers as the tunnel endpoint of this host in place of --bind-address, for hosts behind NAT")
+	flag.StringVar(&opts.publicIPv6, "public-ipv6", "", "IPv6 address to advertise to peers as the IPv6 tunnel endpoint of this dual-stack host")
+	flag.StringVar(&opts.listen, "listen", "", "run as server and listen on specified comma-delimited addresses (e.g. ':8080' or 'unix:///run/flannel/flannel.sock')")
+	flag.StringVar(&opts.remote, "remote", "", "run as client and connect to server on specified address (e.g. '10.1.2.3:8080' or 'unix:///run/flannel/flannel.sock'), or spread the requests by weight over a comma-delimited list of ADDR[;weight=N][;zone=Z]")
+	flag.DurationVar(&opts.remoteKeepAlive, "remote-keepalive", remote.DefaultKeepAlive, "interval of TCP keep-alive probes on the connections to --remote, detecting ones silently dropped (e.g. by a firewall) while watching, 0 disables them")
+	flag.IntVar(&opts.remoteCompress, "remote-compress-threshold", remote.DefaultCompressThreshold, "gzip request bodies to --remote larger than this many bytes if the server accepts them, 0 disables")
+	flag.StringVar(&opts.gossipListen, "gossip-listen", "", "coordinate leases with the other nodes over UDP gossip on this address (e.g. ':8474') instead of etcd, for small clusters without one")
+	flag.StringVar(&opts.gossipPeers, "gossip-peers", "", "comma-delimited list of addresses of nodes to join the gossip through (e.g. '10.1.2.3:8474')")
+	flag.StringVar(&opts.gossipConfig, "gossip-config", "/etc/flannel/network.json", "file holding the network config when coordinating over gossip, the same on all nodes")
+	flag.StringVar(&opts.gossipNodeID, "gossip-node-id", "", "name of this node in the gossip, unique in the cluster (defaults to --hostname); of two nodes claiming the same subnet the lower name keeps it")
+	flag.StringVar(&opts.remoteTokenFile, "remote-token-file", "", "file holding the token presented to --remote, for servers scoping requests to the tenant of their token")
+	flag.StringVar(&opts.serverTenant, "server-tenant", "", "(server) scope the networks of all requests to this tenant")
+	flag.StringVar(&opts.tenantTokens, "tenant-tokens-file", "", "(server) file of 'TOKEN TENANT' lines; requests must present one of the tokens and are scoped to its tenant")
+	flag.StringVar(&opts.replicaOf, "replica-of", "", "(server) run as a read-only replica, redirecting lease writes to the server on this address (e.g. '10.1.2.3:8080') or URL (e.g. 'https://10.1.2.3:8443')")
+	flag.IntVar(&opts.maxAcquires, "max-concurrent-acquires", 0, "(server) limit the number of lease allocations in progress at once, 0 disables")
+	flag.IntVar(&opts.acquireQueue, "acquire-queue", 100, "(server) number of lease allocations waiting for their turn beyond --max-concurrent-acquires before turning them away with a 429")
+	flag.DurationVar(&opts.acquireWait, "acquire-queue-timeout", 30*time.Second, "(server) how long a lease allocation waits for its turn before it is turned away with a 429, 0 waits as long as the client does")
+	flag.IntVar(&opts.maxWatches, "max-watches", 0, "(server) limit the number of lease watches in progress at once, turning more away with a 503, 0 disables")
+	flag.IntVar(&opts.maxWatchesIP, "max-watches-per-ip", 0, "(server) limit the number of lease watches in progress from the same address, 0 disables")
+	flag.DurationVar(&opts.writeTimeout, "write-timeout", time.Minute, "(server) drop connections whose client hasn't taken a response write for this long (e.g. a watch it stopped reading), 0 disables")
+	flag.BoolVar(&opts.maintenance, "maintenance-mode", false, "(server) while etcd is unreachable, serve the last known configs and leases read-only and fail lease writes with a 503")
+	flag.DurationVar(&opts.maxWatchLife, "max-watch-lifetime", 0, "(server) end watches without events after this long so that clients reconnect (e.g. '10m'), 0 disables")
+	flag.DurationVar(&opts.bookmarkIval, "watch-bookmark-interval", remote.DefaultBookmarkInterval, "(server) how often idle Kubernetes-style watch streams get a BOOKMARK event")
+	flag.DurationVar(&opts.watchHistory, "watch-history", time.Hour, "(server) how long lease events are kept for watches since a time, 0 disables them")
 	flag.StringVar(&opts.networks, "networks", "", "run in multi-network mode and service the specified networks")
+	flag.StringVar(&opts.mgmtNetwork, "management-network", "", "also join this network (e.g. 'mgmt'), for node-to-node traffic, and add its subnet to --subnet-file as FLANNEL_MGMT_*")
+	flag.BoolVar(&opts.observe, "observe", false, "only watch the leases of the networks and report them on --health-listen, never acquiring one or touching the host")
+	flag.StringVar(&opts.leaseKey, "lease-key", "subnet", "what leases are keyed by in etcd and in the requests to --listen servers: 'subnet' or 'node' (--hostname or the public IP), the same on all nodes and servers")
+	flag.UintVar(&opts.subnetBlocks, "subnet-blocks", 1, "number of contiguous subnets (power of two) to lease for this host")
+	flag.DurationVar(&opts.configRetryTimeout, "config-retry-timeout", 5*time.Minute, "how long to retry retrieving the network config before giving up (0 retries forever)")
+	flag.DurationVar(&opts.configWaitTimeout, "config-wait-timeout", 0, "how long to wait for the network config to be written if there is none yet (0 gives up right away)")
+	flag.StringVar(&opts.configCacheDir, "config-cache-dir", "", "directory to cache network configs in for use when etcd is unreachable at startup (e.g. /var/lib/flannel/config), empty disables")
+	flag.StringVar(&opts.subnetConflict, "subnet-conflict", network.ConflictWarn, "what to do with a lease that overlaps a network of this host: 'warn' and use it, 'fail' or 'reacquire' another one")
+	flag.StringVar(&opts.healthListen, "health-listen", "", "address to serve the /readyz endpoint on (e.g. '127.0.0.1:8472'), empty disables")
+	flag.StringVar(&opts.selftestListen, "selftest-listen", "", "address to serve the throughput self-test sink on (e.g. ':8473'), empty disables; its port is also where 'selftest' connects to")
+	flag.DurationVar(&opts.selftestDuration, "selftest-duration", 10*time.Second, "how long 'selftest' sends data for")
+	flag.IntVar(&opts.selftestStreams, "selftest-streams", 1, "number of parallel TCP streams 'selftest' uses")
+	flag.StringVar(&opts.publicIPs, "public-ips", "", "comma-delimited list of IP[:WEIGHT] of all the uplinks of this host, for backends that support ECMP (host-gw)")
+	flag.StringVar(&opts.hostname, "hostname", defaultHostname(), "name of this host, advertised in its leases so it gets the same subnet back if its IP changes (empty disables)")
+	flag.BoolVar(&opts.reuseHostname, "reuse-hostname-lease", false, "let a node take over the live lease carrying its hostname (e.g. right after its IP changed), not only an expired one; only for clusters whose hostnames are unique")
+	flag.StringVar(&opts.publicHostname, "public-hostname", "", "DNS name of this host, advertised in its leases for peers to resolve instead of using its public IP (for hosts with dynamic IPs)")
+	flag.DurationVar(&opts.resolveInterval, "resolve-interval", time.Minute, "how often to resolve the public hostnames of peers, and a --public-ip given by name, again")
+	flag.StringVar(&opts.drainFor, "drain-for", "", "on shutdown, revoke the leases of this host and reserve their subnets for the host of this name (requires --hostname)")
+	flag.DurationVar(&opts.drainGrace, "drain-grace", 10*time.Minute, "how long subnets stay reserved for the --drain-for host")
+	flag.StringVar(&opts.zone, "zone", "", "zone (failure domain) of this host, advertised in its leases")
+	flag.StringVar(&opts.tenant, "tenant", "", "tenant of this host, advertised in its leases for peers to route its subnet through the tenant's routing table (host-gw TenantRoutingTables)")
+	flag.BoolVar(&opts.advertiseVer, "advertise-version", true, "advertise the version and the features of this flanneld in its leases")
+	flag.StringVar(&opts.routeFilterFile, "route-filter-file", "", "file listing the networks (CIDR) and zones ('zone NAME') of the peers to program routes for, re-read on SIGHUP")
+	flag.StringVar(&opts.routeHookCmd, "route-hook-cmd", "", "command to run for each route to a peer added or removed, its arguments are templates over .Network, .Subnet, .PeerIP and .Action ('add' or 'remove'), e.g. 'fw-update {{.Action}} {{.Subnet}} {{.PeerIP}}'")
+	flag.StringVar(&opts.routeHookURL, "route-hook-url", "", "URL to POST each route to a peer added or removed to, as JSON")
+	flag.StringVar(&opts.leaseEventsNATS, "lease-events-nats", "", "NATS server (e.g. 'nats://broker:4222') to publish the lease events of the networks to as JSON, empty disables")
+	flag.StringVar(&opts.leaseEventsSubject, "lease-events-subject", "flannel.leases", "subject the lease events are published to")
+	flag.IntVar(&opts.leaseEventsQueue, "lease-events-queue", 1000, "lease events waiting to be published, beyond that they are dropped")
+	flag.DurationVar(&opts.routeHookTimeout, "route-hook-timeout", 10*time.Second, "how long --route-hook-cmd and --route-hook-url may take per route change")
+	flag.BoolVar(&opts.manageLink, "manage-link", true, "set the devices of the backends (udp, vxlan) up; with false, another component does and routes to them are installed once they are up")
+	flag.BoolVar(&opts.verifyRoutes, "verify-routes", false, "read each route (host-gw) or FDB entry (vxlan) back after installing it, installing it again once and degrading the backend if it is still missing")
+	flag.BoolVar(&opts.perPeerMTU, "per-peer-mtu", false, "while migrating between backends, write the larger of their MTUs to the subnet file and give the routes to peers over the other backend its MTU")
+	flag.DurationVar(&opts.coalesceWindow, "coalesce-window", 0, "buffer lease events for this long and apply their net effect at once (e.g. '200ms'), 0 disables")
+	flag.IntVar(&opts.watchBuffer, "watch-buffer", 0, "queue up to this many lease events for a backend that is slow to apply them, 0 disables")
+	flag.StringVar(&opts.watchOverflow, "watch-overflow", subnet.OverflowBlock, "what to do once --watch-buffer is full: 'block' the watch until the backend catches up or 'resync' the backend from a snapshot of the leases")
+	flag.IntVar(&opts.maxRoutes, "max-routes", 0, "route to at most this many peers per network, holding back further leases and failing /readyz while any are; 0 is unlimited")
+	flag.BoolVar(&opts.writeSubnetFile, "write-subnet-file", true, "write the env variables (subnet, MTU, ...) to --subnet-file (or --subnet-dir), otherwise they are only served on /subnets of --health-listen")
+	flag.StringVar(&opts.bridge, "bridge", "", "bridge the containers are on (e.g. docker0): give it the first address of the subnet, route to peers from it and add FLANNEL_BRIDGE to --subnet-file")
 	flag.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
+	flag.BoolVar(&opts.iptablesTag, "iptables-tag", false, "tag the iptables rules flannel adds with a 'flannel:NETWORK' comment so that 'cleanup' can remove them")
+	flag.StringVar(&opts.reconcileNodesFile, "reconcile-nodes-file", "", "(server) file listing public IPs of live nodes; leases held by other IPs are reported")
+	flag.DurationVar(&opts.reconcileInterval, "reconcile-interval", 10*time.Minute, "(server) how often to reconcile leases against --reconcile-nodes-file")
+	flag.BoolVar(&opts.reconcileRemove, "reconcile-remove", false, "(server) revoke leases not held by a live node instead of only reporting them")
+	flag.DurationVar(&opts.configCheckIntvl, "config-check-interval", time.Minute, "(server) how often to retrieve and validate the config of each served network, failing /readyz while it is invalid (0 disables)")
 	flag.BoolVar(&opts.help, "help", false, "print this message")
 	flag.BoolVar(&opts.version, "version", false, "print version and exit")
 }
@@ -93,25 +263,40 @@ func flagsFromEnv(prefix string, fs *flag.FlagSet) {
 	})
 }
 
-func writeSubnetFile(path string, sn *backend.SubnetDef) error {
-	dir, name := filepath.Split(path)
-	os.MkdirAll(dir, 0755)
-
-	tempFile := filepath.Join(dir, "."+name)
-	f, err := os.Create(tempFile)
+// defaultHostname returns the name of the host, "" if it is unknown
+func defaultHostname() string {
+	name, err := os.Hostname()
 	if err != nil {
-		return err
+		return ""
 	}
+	return name
+}
 
-	// Write out the first usable IP by incrementing
-	// sn.IP by one
-	sn.Net.IP += 1
+// subnetFileContent returns the subnet file holding info, followed by
+// that of the management network if mgmt is not nil
+func subnetFileContent(info subnetInfo, mgmt *subnetInfo) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "FLANNEL_SUBNET=%s\n", info.Subnet)
+	fmt.Fprintf(&b, "FLANNEL_GATEWAY=%s\n", info.Gateway)
+	fmt.Fprintf(&b, "FLANNEL_MTU=%d\n", info.MTU)
+	fmt.Fprintf(&b, "FLANNEL_IPMASQ=%v\n", info.IPMasq)
+	if info.Bridge != "" {
+		fmt.Fprintf(&b, "FLANNEL_BRIDGE=%s\n", info.Bridge)
+	}
+	if mgmt != nil {
+		fmt.Fprintf(&b, "FLANNEL_MGMT_SUBNET=%s\n", mgmt.Subnet)
+		fmt.Fprintf(&b, "FLANNEL_MGMT_GATEWAY=%s\n", mgmt.Gateway)
+		fmt.Fprintf(&b, "FLANNEL_MGMT_MTU=%d\n", mgmt.MTU)
+	}
+	return b.Bytes()
+}
 
-	fmt.Fprintf(f, "FLANNEL_SUBNET=%s\n", sn.Net)
-	fmt.Fprintf(f, "FLANNEL_MTU=%d\n", sn.MTU)
-	_, err = fmt.Fprintf(f, "FLANNEL_IPMASQ=%v\n", opts.ipMasq)
-	f.Close()
-	if err != nil {
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	os.MkdirAll(dir, 0755)
+
+	tempFile := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
 		return err
 	}
 
@@ -125,6 +310,13 @@ func lookupIface() (*net.Interface, net.IP, error) {
 	var ipaddr net.IP
 	var err error
 
+	var bindAddr net.IP
+	if opts.bindAddr != "" {
+		if bindAddr = net.ParseIP(opts.bindAddr); bindAddr == nil || bindAddr.To4() == nil {
+			return nil, nil, fmt.Errorf("--bind-address %q is not an IPv4 address", opts.bindAddr)
+		}
+	}
+
 	if len(opts.iface) > 0 {
 		if ipaddr = net.ParseIP(opts.iface); ipaddr != nil {
 			iface, err = ip.GetInterfaceByIP(ipaddr)
@@ -137,6 +329,10 @@ func lookupIface() (*net.Interface, net.IP, error) {
 				return nil, nil, fmt.Errorf("Error looking up interface %s: %s", opts.iface, err)
 			}
 		}
+	} else if bindAddr != nil {
+		if iface, err = ip.GetInterfaceByIP(bindAddr); err != nil {
+			return nil, nil, fmt.Errorf("--bind-address %v is not an address of this host", bindAddr)
+		}
 	} else {
 		log.Info("Determining IP address of default interface")
 		if iface, err = ip.GetDefaultGatewayIface(); err != nil {
@@ -144,6 +340,16 @@ func lookupIface() (*net.Interface, net.IP, error) {
 		}
 	}
 
+	if bindAddr != nil {
+		if ipaddr != nil && !ipaddr.Equal(bindAddr) {
+			return nil, nil, fmt.Errorf("--bind-address %v differs from --iface %v", bindAddr, ipaddr)
+		}
+		if err := ip.GetIfaceIP4AddrMatch(iface, bindAddr); err != nil {
+			return nil, nil, fmt.Errorf("--bind-address %v is not an address of %v", bindAddr, iface.Name)
+		}
+		ipaddr = bindAddr
+	}
+
 	if ipaddr == nil {
 		ipaddr, err = ip.GetIfaceIP4Addr(iface)
 		if err != nil {
@@ -158,23 +364,146 @@ func isMultiNetwork() bool {
 	return len(opts.networks) > 0
 }
 
+// sqlDriver returns the driver of --sql-dsn: --sql-driver, which has to
+// be linked in, or else the only driver that is
+func sqlDriver() (string, error) {
+	linked := sql.Drivers()
+	if opts.sqlDriver == "" {
+		if len(linked) != 1 {
+			return "", fmt.Errorf("--sql-driver is needed with %v SQL drivers linked in %v, build with -tags postgres or -tags mysql", len(linked), linked)
+		}
+		return linked[0], nil
+	}
+
+	for _, d := range linked {
+		if d == opts.sqlDriver {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("--sql-driver %q is not linked into this build (linked in: %v), build with -tags %v", opts.sqlDriver, linked, opts.sqlDriver)
+}
+
 func newSubnetManager() (subnet.Manager, error) {
+	keyFunc, err := subnet.ParseKeyFunc(opts.leaseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.gossipListen != "" {
+		return newGossipManager()
+	}
+
 	if opts.remote != "" {
-		return remote.NewRemoteManager(opts.remote), nil
+		endpoints, err := remote.ParseEndpoints(opts.remote)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --remote: %v", err)
+		}
+		copts := remote.ClientOptions{KeyFunc: keyFunc, KeepAlive: opts.remoteKeepAlive, CompressThreshold: opts.remoteCompress, Zone: opts.zone}
+		if opts.remoteTokenFile != "" {
+			token, err := ioutil.ReadFile(opts.remoteTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read --remote-token-file: %v", err)
+			}
+			copts.Token = strings.TrimSpace(string(token))
+		}
+		return remote.NewRemoteManagerWithEndpoints(endpoints, copts), nil
+	}
+
+	if err := subnet.ValidateDuplicatePublicIP(opts.duplicateIP); err != nil {
+		return nil, fmt.Errorf("invalid --duplicate-public-ip: %v", err)
 	}
 
 	cfg := &subnet.EtcdConfig{
-		Endpoints: strings.Split(opts.etcdEndpoints, ","),
-		Keyfile:   opts.etcdKeyfile,
-		Certfile:  opts.etcdCertfile,
-		CAFile:    opts.etcdCAFile,
-		Prefix:    opts.etcdPrefix,
+		Endpoints:  strings.Split(opts.etcdEndpoints, ","),
+		Keyfile:    opts.etcdKeyfile,
+		Certfile:   opts.etcdCertfile,
+		CAFile:     opts.etcdCAFile,
+		Prefix:     opts.etcdPrefix,
+		KeyFunc:    keyFunc,
+		LeaseGrace: opts.leaseGrace,
+		LeaseHold:  opts.leaseHold,
+		SRVDomain:  opts.etcdSRVDomain,
+		SRVRefresh: opts.etcdSRVRefresh,
+
+		DuplicatePublicIP:  opts.duplicateIP,
+		ReuseHostnameLease: opts.reuseHostname,
+	}
+
+	if opts.sqlDSN != "" {
+		driver, err := sqlDriver()
+		if err != nil {
+			return nil, err
+		}
+		return subnet.NewSQLManager(&subnet.SQLConfig{
+			Driver:     driver,
+			DSN:        opts.sqlDSN,
+			KeyFunc:    keyFunc,
+			LeaseGrace: opts.leaseGrace,
+			LeaseHold:  opts.leaseHold,
+
+			DuplicatePublicIP:  opts.duplicateIP,
+			ReuseHostnameLease: opts.reuseHostname,
+		})
 	}
 
 	return subnet.NewEtcdManager(cfg)
 }
 
-func initAndRun(ctx context.Context, sm subnet.Manager, netnames []string) {
+func newGossipManager() (subnet.Manager, error) {
+	if opts.remote != "" || opts.listen != "" {
+		return nil, fmt.Errorf("--gossip-listen can't be combined with --remote or --listen")
+	}
+	if isMultiNetwork() {
+		return nil, fmt.Errorf("--gossip-listen only coordinates the default network, not --networks")
+	}
+
+	config, err := ioutil.ReadFile(opts.gossipConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeID := opts.gossipNodeID
+	if nodeID == "" {
+		nodeID = opts.hostname
+	}
+
+	peers := []string{}
+	for _, p := range strings.Split(opts.gossipPeers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+		}
+	}
+
+	gm, err := gossip.NewManager(gossip.Options{
+		NodeID: nodeID,
+		Listen: opts.gossipListen,
+		Peers:  peers,
+		Config: string(config),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gm, nil
+}
+
+// leaseReplacer is implemented by managers that acquire another lease
+// for the node by themselves when it loses its own (i.e. gossip)
+type leaseReplacer interface {
+	Replaced() <-chan *subnet.Lease
+}
+
+// replacedLeases returns the channel of the leases sm acquired in place
+// of lost ones, nil if it doesn't
+func replacedLeases(sm subnet.Manager) <-chan *subnet.Lease {
+	if lr, ok := sm.(leaseReplacer); ok {
+		return lr.Replaced()
+	}
+	return nil
+}
+
+// initAndRun runs the networks netnames. A network whose lease is
+// replaced by one of replaced is restarted on the new one.
+func initAndRun(ctx context.Context, sm subnet.Manager, replaced <-chan *subnet.Lease, netnames []string, readyz *health.Checks, metrics *health.Metrics, subnets *subnetInfos) {
 	iface, ipaddr, err := lookupIface()
 	if err != nil {
 		log.Error(err)
@@ -188,34 +517,202 @@ func initAndRun(ctx context.Context, sm subnet.Manager, netnames []string) {
 
 	log.Infof("Using %s as external interface", ipaddr)
 
+	var publicIP ip.IP4
+	var publicIPHost string
+	if opts.publicIP != "" {
+		if net.ParseIP(opts.publicIP) == nil {
+			// a name that follows the host around, e.g. in autoscaling groups
+			publicIPHost = opts.publicIP
+			if publicIP, err = network.ResolvePublicIP(publicIPHost); err != nil {
+				log.Errorf("Failed to resolve --public-ip %v: %v", publicIPHost, err)
+				return
+			}
+		} else if publicIP, err = subnet.ParsePublicIP(opts.publicIP); err != nil {
+			log.Error("Invalid --public-ip: ", err)
+			return
+		}
+		log.Infof("Advertising %v as the public IP of this host", publicIP)
+	}
+
+	var publicIPv6 net.IP
+	if opts.publicIPv6 != "" {
+		if publicIPv6, err = subnet.ParsePublicIPv6(opts.publicIPv6); err != nil {
+			log.Error("Invalid --public-ipv6: ", err)
+			return
+		}
+		log.Infof("Advertising %v as the public IPv6 address of this host", publicIPv6)
+	}
+
+	publicIPs, err := subnet.ParsePublicIPs(opts.publicIPs)
+	if err != nil {
+		log.Error("Invalid --public-ips: ", err)
+		return
+	}
+
+	if opts.drainFor != "" && opts.hostname == "" {
+		log.Error("--drain-for requires --hostname")
+		return
+	}
+
+	subnetConflict, err := network.ParseConflictPolicy(opts.subnetConflict)
+	if err != nil {
+		log.Error("Invalid --subnet-conflict: ", err)
+		return
+	}
+
+	if err := subnet.ValidateOverflowPolicy(opts.watchOverflow); err != nil {
+		log.Error("Invalid --watch-overflow: ", err)
+		return
+	}
+
+	if opts.bridge != "" && isMultiNetwork() {
+		log.Error("--bridge can't be used with --networks")
+		return
+	}
+
+	var routeFilter *network.RouteFilter
+	if opts.routeFilterFile != "" {
+		routeFilter = network.NewRouteFilter()
+		if err := routeFilter.Load(opts.routeFilterFile); err != nil {
+			log.Error("Failed to load route filter: ", err)
+			return
+		}
+		go reloadOnSIGHUP(ctx, routeFilter, opts.routeFilterFile)
+	}
+
+	if opts.resolveInterval <= 0 {
+		log.Error("--resolve-interval must be positive")
+		return
+	}
+	resolver := network.NewResolver()
+	go resolver.Run(ctx, opts.resolveInterval)
+
+	var routeHook *network.RouteHook
+	if opts.routeHookCmd != "" || opts.routeHookURL != "" {
+		if opts.routeHookTimeout <= 0 {
+			log.Error("--route-hook-timeout must be positive")
+			return
+		}
+		if routeHook, err = network.NewRouteHook(opts.routeHookCmd, opts.routeHookURL, opts.routeHookTimeout); err != nil {
+			log.Error("Invalid --route-hook-cmd: ", err)
+			return
+		}
+		go routeHook.Run(ctx)
+	}
+
+	netOpts := network.Options{
+		IPMasq:             opts.ipMasq,
+		IPTablesTag:        opts.iptablesTag,
+		SubnetBlocks:       opts.subnetBlocks,
+		PublicIP:           publicIP,
+		PublicIPHost:       publicIPHost,
+		ResolveInterval:    opts.resolveInterval,
+		PublicIPs:          publicIPs,
+		PublicIPv6:         publicIPv6,
+		Zone:               opts.zone,
+		Tenant:             opts.tenant,
+		Hostname:           opts.hostname,
+		PublicHostname:     opts.publicHostname,
+		DrainFor:           opts.drainFor,
+		DrainGrace:         opts.drainGrace,
+		RouteFilter:        routeFilter,
+		Resolver:           resolver,
+		RouteHook:          routeHook,
+		PerPeerMTU:         opts.perPeerMTU,
+		CoalesceWindow:     opts.coalesceWindow,
+		ConfigRetryTimeout: opts.configRetryTimeout,
+		ConfigWaitTimeout:  opts.configWaitTimeout,
+		ConfigCacheDir:     opts.configCacheDir,
+		SubnetConflict:     subnetConflict,
+		MaxRoutes:          opts.maxRoutes,
+		WatchBuffer:        opts.watchBuffer,
+		WatchOverflow:      opts.watchOverflow,
+		ExternalLink:       !opts.manageLink,
+		VerifyRoutes:       opts.verifyRoutes,
+	}
+	if opts.advertiseVer {
+		netOpts.Version = Version
+		netOpts.Features = Features
+	}
+
 	nets := []*network.Network{}
 	for _, n := range netnames {
-		nets = append(nets, network.New(sm, n, opts.ipMasq))
+		nopts := netOpts
+		if n == "" {
+			// the containers are on the default network,
+			// not the management one
+			nopts.Bridge = opts.bridge
+		}
+		nn := network.New(sm, n, nopts)
+
+		check := "network"
+		if n != "" {
+			check = fmt.Sprintf("network %q", n)
+		}
+		readyz.Add(check, func() error {
+			if !nn.IsReady() {
+				return fmt.Errorf("routes not programmed yet")
+			}
+			for name, err := range nn.BackendHealth() {
+				if err != nil {
+					return fmt.Errorf("%v backend degraded: %v", name, err)
+				}
+			}
+			return nn.Health()
+		})
+		nets = append(nets, nn)
+
+		go registerHealthGauges(ctx, metrics, n, nn)
 	}
 
+	go func() {
+		// tell systemd we're up once the routes of every network are in place
+		for _, n := range nets {
+			select {
+			case <-n.Ready():
+			case <-ctx.Done():
+				return
+			}
+		}
+		daemon.SdNotify("READY=1")
+	}()
+
+	// a failed network (but one of --networks) stops the others
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	wg := sync.WaitGroup{}
 
 	for _, n := range nets {
+		wg.Add(1)
 		go func(n *network.Network) {
-			wg.Add(1)
 			defer wg.Done()
 
-			sn := n.Init(ctx, iface, ipaddr)
-			if sn != nil {
-				if isMultiNetwork() {
-					path := filepath.Join(opts.subnetDir, n.Name) + ".env"
-					if err := writeSubnetFile(path, sn); err != nil {
-						return
+			for {
+				nctx, ncancel := context.WithCancel(ctx)
+				sn := n.Init(nctx, iface, ipaddr)
+				if sn == nil {
+					ncancel()
+					if ctx.Err() == nil && !isMultiNetwork() {
+						// nothing left to do, let the supervisor restart us
+						log.Error("Failed to initialize the network, exiting")
+						cancel()
 					}
-				} else {
-					if err := writeSubnetFile(opts.subnetFile, sn); err != nil {
-						return
-					}
-					daemon.SdNotify("READY=1")
+					return
+				}
+				if err := publishSubnet(subnets, n.Name, sn); err != nil {
+					ncancel()
+					return
 				}
 
-				n.Run(ctx)
-				log.Infof("%v exited", n.Name)
+				go restartOnReplacedLease(nctx, ncancel, n.Name, sn, replaced)
+				n.Run(nctx)
+				ncancel()
+				if ctx.Err() != nil {
+					log.Infof("%v exited", n.Name)
+					return
+				}
+				log.Infof("Restarting network %q on its new lease", n.Name)
 			}
 		}(n)
 	}
@@ -223,6 +720,476 @@ func initAndRun(ctx context.Context, sm subnet.Manager, netnames []string) {
 	wg.Wait()
 }
 
+// restartOnReplacedLease calls restart once a lease other than that of
+// sn is received from replaced
+func restartOnReplacedLease(ctx context.Context, restart func(), network string, sn *backend.SubnetDef, replaced <-chan *subnet.Lease) {
+	for {
+		select {
+		case l := <-replaced:
+			if l.Subnet.Equal(sn.Net) {
+				// the one Init got
+				continue
+			}
+			log.Warningf("Lease %v of network %q was lost to another node, moving to %v", sn.Net, network, l.Subnet)
+			restart()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// registerHealthGauges exports the health of the backends of n and the
+// state of its routes to peers once they are known, i.e. once the
+// network is ready
+func registerHealthGauges(ctx context.Context, metrics *health.Metrics, name string, n *network.Network) {
+	select {
+	case <-n.Ready():
+	case <-ctx.Done():
+		return
+	}
+
+	for be := range n.BackendHealth() {
+		be := be
+		labels := map[string]string{"network": name, "backend": be}
+		metrics.AddGauge("flannel_backend_healthy", "Whether the backend is healthy (1) or degraded (0).", labels, func() float64 {
+			if n.BackendHealth()[be] != nil {
+				return 0
+			}
+			return 1
+		})
+	}
+
+	metrics.AddGaugeFamily("flannel_peer_route", "Routes to peer subnets by state: installed, failed, unverified or skipped_<reason>.", func() []health.Sample {
+		states := n.RouteStates()
+		samples := make([]health.Sample, 0, len(states))
+		for sn, state := range states {
+			labels := map[string]string{"network": name, "subnet": sn.String(), "state": state}
+			samples = append(samples, health.Sample{Labels: labels, Value: 1})
+		}
+		return samples
+	})
+}
+
+// publishLeaseEvents publishes the lease events of networks to the NATS
+// server of --lease-events-nats until ctx is canceled
+func publishLeaseEvents(ctx context.Context, sm subnet.Manager, networks []string, metrics *health.Metrics) error {
+	if opts.leaseEventsQueue <= 0 {
+		return fmt.Errorf("--lease-events-queue must be positive")
+	}
+	pub, err := nats.NewPublisher(opts.leaseEventsNATS, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	p := subnet.NewLeasePublisher(pub, opts.leaseEventsSubject, opts.leaseEventsQueue)
+	for _, n := range networks {
+		go p.Watch(ctx, sm, n)
+	}
+	go func() {
+		p.Run(ctx)
+		pub.Close()
+	}()
+
+	metrics.AddGauge("flannel_lease_events_dropped", "Lease events dropped for a full --lease-events-queue.", nil, func() float64 {
+		return float64(p.Dropped())
+	})
+	return nil
+}
+
+func reloadOnSIGHUP(ctx context.Context, f *network.RouteFilter, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			log.Info("Reloading route filter from ", path)
+			if err := f.Load(path); err != nil {
+				// keep the filter we have rather than
+				// guessing what was meant
+				log.Error("Failed to reload route filter: ", err)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe reports whether the host has what the given backends (all of
+// them if none are given) need and returns the exit status
+func probe(types []string) int {
+	if len(types) == 0 {
+		types = network.BackendTypes
+	}
+
+	type feature struct {
+		name string
+		caps []backend.Capability
+	}
+
+	features := []feature{}
+	for _, t := range types {
+		caps, err := network.BackendCapabilities(t)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		features = append(features, feature{t, caps})
+	}
+	if opts.ipMasq {
+		features = append(features, feature{"ip-masq", network.IPMasqCapabilities()})
+	}
+
+	status := 0
+	for _, f := range features {
+		fmt.Printf("%v:\n", f.name)
+		if len(f.caps) == 0 {
+			fmt.Println("  no requirements")
+		}
+		for _, r := range backend.Probe(f.caps) {
+			if ue, ok := r.Err.(*backend.UndeterminedError); ok {
+				fmt.Printf("  %v: unknown: %v\n", r.Capability, ue.Err)
+			} else if r.Err != nil {
+				fmt.Printf("  %v: missing: %v\n", r.Capability, r.Err)
+				status = 1
+			} else {
+				fmt.Printf("  %v: ok\n", r.Capability)
+			}
+		}
+	}
+	return status
+}
+
+// cleanup deletes the iptables rules tagged (see --iptables-tag) for the
+// given networks (the default one if none are given) and returns the
+// exit status
+func cleanup(networks []string) int {
+	if len(networks) == 0 {
+		networks = []string{""}
+	}
+
+	for _, n := range networks {
+		deleted, err := network.CleanupIPTables(n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clean up after %v: %v\n", network.IPTablesTag(n), err)
+			return 1
+		}
+		fmt.Printf("%v: deleted %v iptables rules\n", network.IPTablesTag(n), deleted)
+	}
+	return 0
+}
+
+// diffState prints where the kernel state diverges from the lease set of
+// the given networks (the default one if none are given) and returns the
+// exit status: 1 if it does, 2 if it could not be told
+func diffState(networks []string) int {
+	if len(networks) == 0 {
+		networks = []string{""}
+	}
+
+	sm, err := newSubnetManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create SubnetManager: %v\n", err)
+		return 2
+	}
+
+	iface, _, err := lookupIface()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	status := 0
+	for _, n := range networks {
+		name := n
+		if name == "" {
+			name = "default network"
+		}
+
+		config, err := sm.GetNetworkConfig(ctx, n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: failed to retrieve the network config: %v\n", name, err)
+			return 2
+		}
+		wr, err := sm.WatchLeases(ctx, n, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: failed to retrieve the leases: %v\n", name, err)
+			return 2
+		}
+
+		d, err := network.DiffBackendState(sm, n, config, iface, wr.Snapshot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+			return 2
+		}
+
+		if d.Empty() {
+			fmt.Printf("%v: in sync with %v leases\n", name, len(wr.Snapshot))
+			continue
+		}
+		fmt.Printf("%v:\n", name)
+		d.Write(os.Stdout)
+		status = 1
+	}
+	return status
+}
+
+func networkDisplayName(n string) string {
+	if n == "" {
+		return "default network"
+	}
+	return n
+}
+
+// exportState writes the config and leases of a network (the default one
+// if not given) to a file, "-" for stdout, and returns the exit status
+func exportState(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "export takes a FILE and optionally a NETWORK")
+		return 2
+	}
+	file, n := args[0], ""
+	if len(args) == 2 {
+		n = args[1]
+	}
+
+	sm, err := newSubnetManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create SubnetManager: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	b, err := subnet.Export(ctx, sm, n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", networkDisplayName(n), err)
+		return 1
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data = append(data, '\n')
+
+	if file == "-" {
+		os.Stdout.Write(data)
+	} else if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%v: exported the config and %v leases\n", networkDisplayName(n), len(b.Leases))
+	return 0
+}
+
+// importState restores the config and leases exported to a file into the
+// network they were exported from (or the one given) and returns the
+// exit status: 1 if it failed or some leases conflict with the ones in
+// the store
+func importState(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "import takes a FILE and optionally a NETWORK")
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b := &subnet.Backup{}
+	if err := json.Unmarshal(data, b); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", args[0], err)
+		return 1
+	}
+	if b.Config == nil {
+		fmt.Fprintf(os.Stderr, "%v: no network config\n", args[0])
+		return 1
+	}
+
+	n := b.Network
+	if len(args) == 2 {
+		n = args[1]
+	}
+
+	sm, err := newSubnetManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create SubnetManager: %v\n", err)
+		return 1
+	}
+	r, ok := sm.(subnet.Restorer)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "import needs direct access to etcd, it can't go through --remote or --gossip-listen")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := subnet.Restore(ctx, r, n, b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", networkDisplayName(n), err)
+		return 1
+	}
+
+	fmt.Printf("%v: restored %v leases, %v already present\n", networkDisplayName(n), res.Restored, res.Present)
+	for _, c := range res.Conflicts {
+		fmt.Printf("conflict: %v\n", c)
+	}
+	if len(res.Conflicts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// relabelLease sets the zone, pool or hostname of the lease of a subnet in
+// place and returns the exit status
+func relabelLease(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "relabel takes a SUBNET, optionally a NETWORK and one or more of zone=, pool= and hostname=")
+		return 2
+	}
+
+	_, ipn, err := net.ParseCIDR(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	sn := ip.FromIPNet(ipn)
+	args, n := args[1:], ""
+	if !strings.Contains(args[0], "=") {
+		args, n = args[1:], args[0]
+	}
+	labels, err := subnet.ParseLabels(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if labels.Hostname != nil && opts.leaseKey == "node" {
+		fmt.Fprintln(os.Stderr, "the hostname can't be changed while leases are keyed by node")
+		return 2
+	}
+
+	sm, err := newSubnetManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create SubnetManager: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	l, err := subnet.Relabel(ctx, sm, n, sn, labels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v: %v\n", networkDisplayName(n), sn, err)
+		return 1
+	}
+	fmt.Printf("%v: %v: zone %q, pool %q, hostname %q\n", networkDisplayName(n), l.Subnet, l.Attrs.Zone, l.Attrs.Pool, l.Attrs.Hostname)
+	return 0
+}
+
+// selftestPeer measures the throughput over the overlay to the sink of the
+// node holding the lease of the given subnet (or address within it) and
+// returns the exit status. The sink is reached at the first address of
+// the subnet unless another one is given.
+func selftestPeer(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "selftest takes a SUBNET and optionally an ADDRESS to connect to")
+		return 2
+	}
+	if opts.selftestListen == "" {
+		fmt.Fprintln(os.Stderr, "selftest needs --selftest-listen to know the port the peers serve on")
+		return 2
+	}
+	_, port, err := net.SplitHostPort(opts.selftestListen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad --selftest-listen: %v\n", err)
+		return 2
+	}
+	if opts.selftestStreams < 1 {
+		fmt.Fprintln(os.Stderr, "--selftest-streams must be positive")
+		return 2
+	}
+
+	target := net.ParseIP(args[0])
+	if target == nil {
+		if target, _, err = net.ParseCIDR(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "bad subnet %q\n", args[0])
+			return 2
+		}
+	}
+
+	sm, err := newSubnetManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create SubnetManager: %v\n", err)
+		return 1
+	}
+
+	netname := strings.Split(opts.networks, ",")[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// not every Manager gives up when ctx is done
+	type watchResult struct {
+		wr  subnet.WatchResult
+		err error
+	}
+	c := make(chan watchResult, 1)
+	go func() {
+		wr, err := sm.WatchLeases(ctx, netname, nil)
+		c <- watchResult{wr, err}
+	}()
+
+	var wr subnet.WatchResult
+	select {
+	case res := <-c:
+		if res.err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to retrieve leases: %v\n", res.err)
+			return 1
+		}
+		wr = res.wr
+	case <-ctx.Done():
+		fmt.Fprintf(os.Stderr, "Failed to retrieve leases: %v\n", ctx.Err())
+		return 1
+	}
+
+	var lease *subnet.Lease
+	for i := range wr.Snapshot {
+		if wr.Snapshot[i].Subnet.Contains(ip.FromIP(target)) {
+			lease = &wr.Snapshot[i]
+			break
+		}
+	}
+	if lease == nil {
+		fmt.Fprintf(os.Stderr, "no lease holds %v\n", args[0])
+		return 1
+	}
+
+	host := lease.Subnet.IP.String()
+	if len(args) == 2 {
+		host = args[1]
+	}
+	addr := net.JoinHostPort(host, port)
+
+	fmt.Printf("Sending to %v (lease %v of %v) for %v over %v streams\n", addr, lease.Subnet, lease.Attrs.PublicIP, opts.selftestDuration, opts.selftestStreams)
+	res, err := selftest.Run(addr, opts.selftestDuration, opts.selftestStreams)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Self-test failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%.1f Mbit/s, %v retransmitted segments\n", res.Mbps(), res.Retransmits)
+	return 0
+}
+
 func main() {
 	// glog will log to tmp files by default. override so all entries
 	// can flow into journald (if running under systemd)
@@ -231,8 +1198,15 @@ func main() {
 	// now parse command line args
 	flag.Parse()
 
-	if flag.NArg() > 0 || opts.help {
+	if (flag.NArg() > 0 && flag.Arg(0) != "probe" && flag.Arg(0) != "selftest" && flag.Arg(0) != "cleanup" && flag.Arg(0) != "diff" && flag.Arg(0) != "export" && flag.Arg(0) != "import" && flag.Arg(0) != "relabel") || opts.help {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... probe [BACKEND]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... selftest SUBNET [ADDRESS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... cleanup [NETWORK]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... diff [NETWORK]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... export FILE [NETWORK]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... import FILE [NETWORK]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... relabel SUBNET [NETWORK] LABEL=VALUE...\n", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -244,30 +1218,165 @@ func main() {
 
 	flagsFromEnv("FLANNELD", flag.CommandLine)
 
+	if flag.Arg(0) == "probe" {
+		os.Exit(probe(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "selftest" {
+		os.Exit(selftestPeer(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "cleanup" {
+		os.Exit(cleanup(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "diff" {
+		os.Exit(diffState(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "export" {
+		os.Exit(exportState(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "import" {
+		os.Exit(importState(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "relabel" {
+		os.Exit(relabelLease(flag.Args()[1:]))
+	}
+
 	sm, err := newSubnetManager()
 	if err != nil {
 		log.Error("Failed to create SubnetManager: ", err)
 		os.Exit(1)
 	}
 
+	readyz := health.NewChecks()
+	metrics := health.NewMetrics()
+	subnets := newSubnetInfos()
+
 	var runFunc func(ctx context.Context)
+	var obs observers
 
 	if opts.listen != "" {
 		if opts.remote != "" {
 			log.Error("--listen and --remote are mutually exclusive")
 			os.Exit(1)
 		}
+		if opts.observe {
+			log.Error("--listen and --observe are mutually exclusive")
+			os.Exit(1)
+		}
 		log.Info("running as server")
-		runFunc = func(ctx context.Context) {
-			remote.RunServer(ctx, sm, opts.listen)
+		if opts.maxAcquires < 0 || opts.acquireQueue < 0 || opts.acquireWait < 0 {
+			log.Error("--max-concurrent-acquires, --acquire-queue and --acquire-queue-timeout must not be negative")
+			os.Exit(1)
+		}
+		if opts.maxWatches < 0 || opts.maxWatchesIP < 0 || opts.writeTimeout < 0 {
+			log.Error("--max-watches, --max-watches-per-ip and --write-timeout must not be negative")
+			os.Exit(1)
+		}
+		if opts.bookmarkIval <= 0 {
+			log.Error("--watch-bookmark-interval must be positive")
+			os.Exit(1)
+		}
+		serverOpts := remote.ServerOptions{
+			Primary:               opts.replicaOf,
+			MaxWatchLifetime:      opts.maxWatchLife,
+			WatchBookmarkInterval: opts.bookmarkIval,
+			MaxConcurrentAcquires: opts.maxAcquires,
+			AcquireQueue:          opts.acquireQueue,
+			AcquireQueueTimeout:   opts.acquireWait,
+			MaxWatches:            opts.maxWatches,
+			MaxWatchesPerIP:       opts.maxWatchesIP,
+			WriteTimeout:          opts.writeTimeout,
+			Maintenance:           opts.maintenance,
+			EventHistory:          opts.watchHistory,
+		}
+		// validated by newSubnetManager
+		serverOpts.KeyFunc, _ = subnet.ParseKeyFunc(opts.leaseKey)
+
+		switch {
+		case opts.serverTenant != "" && opts.tenantTokens != "":
+			log.Error("--server-tenant and --tenant-tokens-file are mutually exclusive")
+			os.Exit(1)
+		case opts.serverTenant != "":
+			if err := subnet.ValidateTenant(opts.serverTenant); err != nil {
+				log.Error("Invalid --server-tenant: ", err)
+				os.Exit(1)
+			}
+			serverOpts.Tenant = opts.serverTenant
+		case opts.tenantTokens != "":
+			if serverOpts.TenantTokens, err = remote.LoadTenantTokens(opts.tenantTokens); err != nil {
+				log.Error("Invalid --tenant-tokens-file: ", err)
+				os.Exit(1)
+			}
+		}
+
+		// the networks of --networks are those of the tenant
+		tenantSM := sm
+		if serverOpts.Tenant != "" {
+			tenantSM = subnet.NewTenantManager(sm, serverOpts.Tenant)
+		}
+
+		// catch a broken config now rather than when a node asks for it
+		var configChecks []*network.ConfigCheck
+		if opts.configCheckIntvl > 0 {
+			for _, n := range strings.Split(opts.networks, ",") {
+				cc := network.NewConfigCheck(tenantSM, n)
+				check := "config"
+				if n != "" {
+					check = fmt.Sprintf("config of network %q", n)
+				}
+				readyz.Add(check, cc.Check)
+				configChecks = append(configChecks, cc)
+			}
+		}
+		checkConfigs := func(ctx context.Context) {
+			for _, cc := range configChecks {
+				go cc.Run(ctx, opts.configCheckIntvl)
+			}
+		}
+
+		if opts.replicaOf != "" {
+			log.Info("running as read-only replica of ", opts.replicaOf)
+			if opts.reconcileNodesFile != "" {
+				log.Warning("--reconcile-nodes-file is ignored on a replica, reconciling is left to the primary")
+			}
+			runFunc = func(ctx context.Context) {
+				checkConfigs(ctx)
+				remote.RunServer(ctx, sm, opts.listen, serverOpts)
+			}
+		} else {
+			runFunc = func(ctx context.Context) {
+				checkConfigs(ctx)
+				if opts.reconcileNodesFile != "" {
+					liveNodes := subnet.FileLiveNodes(opts.reconcileNodesFile)
+					for _, n := range strings.Split(opts.networks, ",") {
+						go subnet.LeaseReconciler(ctx, tenantSM, n, liveNodes, opts.reconcileRemove, opts.reconcileInterval)
+					}
+				}
+				remote.RunServer(ctx, sm, opts.listen, serverOpts)
+			}
 		}
 	} else {
 		networks := strings.Split(opts.networks, ",")
 		if len(networks) == 0 {
 			networks = append(networks, "")
 		}
-		runFunc = func(ctx context.Context) {
-			initAndRun(ctx, sm, networks)
+		if opts.mgmtNetwork != "" {
+			if isMultiNetwork() {
+				log.Error("--management-network and --networks are mutually exclusive")
+				os.Exit(1)
+			}
+			networks = append(networks, opts.mgmtNetwork)
+		}
+		if opts.observe {
+			log.Info("running as observer")
+			obs = newObservers(sm, networks)
+			runFunc = func(ctx context.Context) {
+				obs.run(ctx, readyz, metrics)
+			}
+		} else {
+			runFunc = func(ctx context.Context) {
+				// the lease watches and snapshots of a network share one upstream watch
+				initAndRun(ctx, subnet.NewWatchMux(ctx, sm), replacedLeases(sm), networks, readyz, metrics, subnets)
+			}
 		}
 	}
 
@@ -278,19 +1387,58 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
+	if opts.healthListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/readyz", readyz)
+		mux.Handle("/metrics", metrics)
+		mux.Handle("/subnets", subnets)
+		if obs != nil {
+			mux.Handle("/leases", obs)
+		}
+		if rm, ok := sm.(*remote.RemoteManager); ok {
+			mux.Handle("/remote", remote.EndpointsHandler(rm))
+		}
+		go health.Serve(ctx, opts.healthListen, mux)
+	}
+
+	if opts.selftestListen != "" {
+		l, err := net.Listen("tcp", opts.selftestListen)
+		if err != nil {
+			log.Error("Failed to serve self-test sink: ", err)
+			os.Exit(1)
+		}
+		go selftest.Serve(ctx, l)
+	}
+
+	if opts.leaseEventsNATS != "" {
+		if err := publishLeaseEvents(ctx, sm, strings.Split(opts.networks, ","), metrics); err != nil {
+			log.Error("Invalid --lease-events-nats: ", err)
+			os.Exit(1)
+		}
+	}
+
+	done := make(chan struct{})
 	go func() {
 		runFunc(ctx)
-		wg.Done()
+		close(done)
 	}()
 
-	<-sigs
+	// runFunc only returns before being told to if it gave up
+	gaveUp := false
+	select {
+	case <-sigs:
+		log.Info("Exiting...")
+	case <-done:
+		gaveUp = true
+	}
 	// unregister to get default OS nuke behaviour in case we don't exit cleanly
 	signal.Stop(sigs)
 
-	log.Info("Exiting...")
 	cancel()
+	<-done
 
-	wg.Wait()
+	if gaveUp {
+		// let the supervisor restart us
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,323 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/health"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func testSubnetDef(t *testing.T) *backend.SubnetDef {
+	_, n, err := net.ParseCIDR("10.1.5.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := ip.FromIPNet(n)
+	return &backend.SubnetDef{Net: sn, MTU: 1450, Gateway: sn.IP + 1}
+}
+
+func TestPublishSubnet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := opts
+	defer func() { opts = saved }()
+	opts.networks = ""
+
+	for _, write := range []bool{true, false} {
+		opts.writeSubnetFile = write
+		opts.subnetFile = filepath.Join(dir, "subnet.env")
+		os.Remove(opts.subnetFile)
+
+		infos := newSubnetInfos()
+		if err := publishSubnet(infos, "", testSubnetDef(t)); err != nil {
+			t.Fatalf("publishSubnet failed: %v", err)
+		}
+
+		_, err := os.Stat(opts.subnetFile)
+		switch {
+		case write && err != nil:
+			t.Errorf("subnet file not written: %v", err)
+		case !write && !os.IsNotExist(err):
+			t.Errorf("subnet file written with --write-subnet-file=false: %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		infos.ServeHTTP(rec, httptest.NewRequest("GET", "/subnets", nil))
+		// decoding an IP4Net drops the host bits
+		var served map[string]struct {
+			Subnet string
+			MTU    int
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+			t.Fatalf("failed to decode /subnets: %v", err)
+		}
+		if info := served[""]; info.Subnet != "10.1.5.1/24" || info.MTU != 1450 {
+			t.Errorf("unexpected subnet served: %+v", info)
+		}
+	}
+}
+
+func TestPublishSubnetManagement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := opts
+	defer func() { opts = saved }()
+	opts.networks = ""
+	opts.mgmtNetwork = "mgmt"
+	opts.writeSubnetFile = true
+	opts.subnetFile = filepath.Join(dir, "subnet.env")
+
+	infos := newSubnetInfos()
+	mgmt := testSubnetDef(t)
+	mgmt.Net.IP += 256
+	mgmt.Gateway += 256
+	mgmt.MTU = 1500
+	if err := publishSubnet(infos, "mgmt", mgmt); err != nil {
+		t.Fatalf("publishSubnet failed: %v", err)
+	}
+	if _, err := os.Stat(opts.subnetFile); !os.IsNotExist(err) {
+		t.Errorf("subnet file written before the pod subnet is known: %v", err)
+	}
+
+	if err := publishSubnet(infos, "", testSubnetDef(t)); err != nil {
+		t.Fatalf("publishSubnet failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(opts.subnetFile)
+	if err != nil {
+		t.Fatalf("subnet file not written: %v", err)
+	}
+
+	expected := "FLANNEL_SUBNET=10.1.5.1/24\nFLANNEL_GATEWAY=10.1.5.1\nFLANNEL_MTU=1450\nFLANNEL_IPMASQ=false\nFLANNEL_MGMT_SUBNET=10.1.6.1/24\nFLANNEL_MGMT_GATEWAY=10.1.6.1\nFLANNEL_MGMT_MTU=1500\n"
+	if string(data) != expected {
+		t.Errorf("unexpected subnet file:\n%s\nexpected:\n%s", data, expected)
+	}
+}
+
+func TestSubnetFileDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mux sync.Mutex
+	writes := 0
+	defer func(f func(string, []byte) error) { writeFile = f }(writeFile)
+	writeFile = func(path string, data []byte) error {
+		mux.Lock()
+		writes++
+		mux.Unlock()
+		return writeFileAtomic(path, data)
+	}
+	written := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return writes
+	}
+
+	path := filepath.Join(dir, "subnet.env")
+	files := newSubnetFiles(100 * time.Millisecond)
+
+	info := subnetInfo{MTU: 1450}
+	for ; info.MTU < 1460; info.MTU++ {
+		if err := files.write(path, subnetFileContent(info, nil)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	last := subnetFileContent(subnetInfo{MTU: 1459}, nil)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if data, _ := ioutil.ReadFile(path); string(data) == string(last) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the last content to be written")
+		}
+	}
+	if n := written(); n > 2 {
+		t.Errorf("expected at most 2 writes for 10 changes, got %v", n)
+	}
+
+	// the same content again, within the window and after it
+	n := written()
+	if err := files.write(path, last); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := files.write(path, last); err != nil {
+		t.Fatal(err)
+	}
+	if written() != n {
+		t.Errorf("unchanged content was rewritten: %v writes, expected %v", written(), n)
+	}
+}
+
+// watchOnlyManager serves a snapshot and then the events sent on events,
+// counting the leases asked for
+type watchOnlyManager struct {
+	subnet.Manager
+	snapshot []subnet.Lease
+	events   chan subnet.Event
+	mux      sync.Mutex
+	acquired int
+}
+
+func (m *watchOnlyManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.acquired++
+	return nil, context.Canceled
+}
+
+func (m *watchOnlyManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if cursor == nil {
+		return subnet.WatchResult{Snapshot: m.snapshot, Cursor: "1"}, nil
+	}
+
+	select {
+	case e := <-m.events:
+		return subnet.WatchResult{Events: []subnet.Event{e}, Cursor: "2"}, nil
+	case <-ctx.Done():
+		return subnet.WatchResult{}, ctx.Err()
+	}
+}
+
+func observedLease(sn string, ready bool) subnet.Lease {
+	_, n, _ := net.ParseCIDR(sn)
+	return subnet.Lease{Subnet: ip.FromIPNet(n), Attrs: &subnet.LeaseAttrs{PublicIP: ip.IP4(1), Ready: &ready}}
+}
+
+func TestObserve(t *testing.T) {
+	sm := &watchOnlyManager{
+		snapshot: []subnet.Lease{observedLease("10.1.1.0/24", true), observedLease("10.1.2.0/24", false)},
+		events:   make(chan subnet.Event),
+	}
+	readyz := health.NewChecks()
+	metrics := health.NewMetrics()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	obs := newObservers(sm, []string{""})
+	go obs.run(ctx, readyz, metrics)
+
+	select {
+	case sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: observedLease("10.1.3.0/24", true)}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("observer did not watch for events")
+	}
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	expected := []string{
+		`flannel_observed_leases{network=""} 3`,
+		`flannel_observed_leases_ready{network=""} 2`,
+		`flannel_observed_lease_events{network="",type="added"} 3`,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out := scrape()
+		missing := ""
+		for _, line := range expected {
+			if !strings.Contains(out, line) {
+				missing = line
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics lack %q:\n%v", missing, out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if errs := readyz.Run(); len(errs) != 0 {
+		t.Errorf("expected the leases check to pass, got %v", errs)
+	}
+
+	rec := httptest.NewRecorder()
+	obs.ServeHTTP(rec, httptest.NewRequest("GET", "/leases", nil))
+	var leases map[string][]subnet.Lease
+	if err := json.Unmarshal(rec.Body.Bytes(), &leases); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases[""]) != 3 {
+		t.Errorf("expected 3 leases on /leases, got %v", leases)
+	}
+
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	if sm.acquired != 0 {
+		t.Errorf("observer asked for %v leases", sm.acquired)
+	}
+}
+
+type nopSQLDriver struct{}
+
+func (nopSQLDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not a real driver")
+}
+
+func TestSQLDriver(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+
+	// none linked into the test binary yet
+	for _, d := range []string{"", "postgres"} {
+		opts.sqlDriver = d
+		if _, err := sqlDriver(); err == nil {
+			t.Errorf("--sql-driver=%q accepted without a driver linked in", d)
+		}
+	}
+
+	sql.Register("flanneltest", nopSQLDriver{})
+	opts.sqlDriver = ""
+	if d, err := sqlDriver(); err != nil || d != "flanneltest" {
+		t.Errorf("expected the only driver linked in, got %q: %v", d, err)
+	}
+	opts.sqlDriver = "postgres"
+	if _, err := sqlDriver(); err == nil || !strings.Contains(err.Error(), "-tags postgres") {
+		t.Errorf("expected an unlinked --sql-driver to be rejected, got %v", err)
+	}
+}
@@ -3,8 +3,10 @@ package network
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"strings"
 
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/backend/alloc"
 	"github.com/coreos/flannel/backend/awsvpc"
@@ -15,26 +17,100 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func newBackend(sm subnet.Manager, network string, config *subnet.Config) (backend.Backend, error) {
-	var bt struct {
-		Type string
-	}
+// BackendTypes lists the supported backend types
+var BackendTypes = []string{"udp", "alloc", "host-gw", "vxlan", "aws-vpc", "gce"}
+
+type backendType struct {
+	Type string
+	// Fallback is used in place of Type if the host
+	// lacks the capabilities needed by Type
+	Fallback string
+	// MigrateFrom is the config of the backend the network is
+	// migrating from, run alongside Type until all nodes run Type
+	MigrateFrom json.RawMessage
+}
+
+func parseBackendType(config *subnet.Config) (*backendType, error) {
+	bt := &backendType{}
 
 	if len(config.Backend) == 0 {
 		bt.Type = "udp"
 	} else {
-		if err := json.Unmarshal(config.Backend, &bt); err != nil {
+		if err := json.Unmarshal(config.Backend, bt); err != nil {
 			return nil, fmt.Errorf("Error decoding Backend property of config: %v", err)
 		}
 	}
 
-	switch strings.ToLower(bt.Type) {
+	bt.Type = strings.ToLower(bt.Type)
+	bt.Fallback = strings.ToLower(bt.Fallback)
+	return bt, nil
+}
+
+// BackendCapabilities returns what the host needs to run backends of type bt
+func BackendCapabilities(bt string) ([]backend.Capability, error) {
+	switch strings.ToLower(bt) {
+	case "udp":
+		return udp.Capabilities(), nil
+	case "vxlan":
+		return vxlan.Capabilities(), nil
+	case "alloc", "host-gw", "aws-vpc", "gce":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("'%v': unknown backend type", bt)
+	}
+}
+
+// replaced in tests
+var backendCapabilities = BackendCapabilities
+
+func probeBackend(bt string) error {
+	caps, err := backendCapabilities(bt)
+	if err != nil {
+		return err
+	}
+	return backend.Require(bt+" backend", caps)
+}
+
+// newProbedBackend creates the backend configured for the network after
+// checking that the host supports it. If it doesn't, the fallback backend
+// (with its default settings) is created instead if one is configured,
+// otherwise a *backend.CapabilityError is returned.
+func newProbedBackend(sm subnet.Manager, network string, config *subnet.Config) (backend.Backend, error) {
+	bt, err := parseBackendType(config)
+	if err != nil {
+		return nil, err
+	}
+
+	perr := probeBackend(bt.Type)
+	if perr == nil {
+		return newBackend(sm, network, bt.Type, config)
+	}
+	if bt.Fallback == "" {
+		return nil, perr
+	}
+
+	if err := probeBackend(bt.Fallback); err != nil {
+		return nil, fmt.Errorf("%v; fallback: %v", perr, err)
+	}
+
+	log.Warningf("%v; falling back to %v backend", perr, bt.Fallback)
+
+	fallback := *config
+	fallback.Backend = json.RawMessage(fmt.Sprintf(`{"Type": %q}`, bt.Fallback))
+	return newBackend(sm, network, bt.Fallback, &fallback)
+}
+
+// replaced in tests
+var newBackend = createBackend
+
+func createBackend(sm subnet.Manager, network string, bt string, config *subnet.Config) (backend.Backend, error) {
+	switch bt {
 	case "udp":
 		return udp.New(sm, network, config), nil
 	case "alloc":
 		return alloc.New(sm, network), nil
 	case "host-gw":
-		return hostgw.New(sm, network), nil
+		return hostgw.New(sm, network, config), nil
 	case "vxlan":
 		return vxlan.New(sm, network, config), nil
 	case "aws-vpc":
@@ -42,6 +118,27 @@ func newBackend(sm subnet.Manager, network string, config *subnet.Config) (backe
 	case "gce":
 		return gce.New(sm, network, config), nil
 	default:
-		return nil, fmt.Errorf("%v: '%v': unknown backend type", network, bt.Type)
+		return nil, fmt.Errorf("%v: '%v': unknown backend type", network, bt)
+	}
+}
+
+// DiffBackendState compares the kernel state kept by the backend
+// configured for the network against the one implied by leases, without
+// changing anything
+func DiffBackendState(sm subnet.Manager, network string, config *subnet.Config, extIface *net.Interface, leases []subnet.Lease) (*backend.StateDiff, error) {
+	bt, err := parseBackendType(config)
+	if err != nil {
+		return nil, err
+	}
+
+	be, err := createBackend(sm, network, bt.Type, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sd, ok := be.(backend.StateDiffer)
+	if !ok {
+		return nil, fmt.Errorf("%v backend can't diff its state", bt.Type)
 	}
+	return sd.DiffState(extIface, leases)
 }
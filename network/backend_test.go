@@ -0,0 +1,97 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+)
+
+func withMissingCapabilities(missing ...string) func() {
+	orig := backendCapabilities
+	backendCapabilities = func(bt string) ([]backend.Capability, error) {
+		for _, m := range missing {
+			if m == bt {
+				return []backend.Capability{{
+					Name:  bt + " kernel module",
+					Check: func() error { return errors.New("not loaded") },
+				}}, nil
+			}
+		}
+		return nil, nil
+	}
+	return func() { backendCapabilities = orig }
+}
+
+func backendConfig(t *testing.T, be string) *subnet.Config {
+	cfg, err := subnet.ParseConfig(`{ "Network": "10.3.0.0/16", "Backend": ` + be + ` }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestProbedBackendMissing(t *testing.T) {
+	defer withMissingCapabilities("vxlan")()
+
+	_, err := newProbedBackend(nil, "", backendConfig(t, `{ "Type": "vxlan" }`))
+	if _, ok := err.(*backend.CapabilityError); !ok {
+		t.Fatalf("newProbedBackend returned %v, expected a *backend.CapabilityError", err)
+	}
+}
+
+func TestProbedBackendFallback(t *testing.T) {
+	defer withMissingCapabilities("vxlan")()
+
+	cfg := backendConfig(t, `{ "Type": "VXLAN", "VNI": 7, "Fallback": "host-gw" }`)
+	be, err := newProbedBackend(nil, "", cfg)
+	if err != nil {
+		t.Fatalf("newProbedBackend failed: %v", err)
+	}
+	if be.Name() != "host-gw" {
+		t.Errorf("expected fallback to host-gw, got %v", be.Name())
+	}
+
+	// the VXLAN settings must not leak into the fallback
+	var bc map[string]interface{}
+	if err := json.Unmarshal(cfg.Backend, &bc); err != nil || bc["VNI"] != 7.0 {
+		t.Errorf("config of the network was modified: %s", cfg.Backend)
+	}
+}
+
+func TestProbedBackendFallbackMissing(t *testing.T) {
+	defer withMissingCapabilities("vxlan", "udp")()
+
+	_, err := newProbedBackend(nil, "", backendConfig(t, `{ "Type": "vxlan", "Fallback": "udp" }`))
+	if err == nil {
+		t.Fatal("newProbedBackend succeeded without the capabilities of either backend")
+	}
+}
+
+func TestProbedBackendPresent(t *testing.T) {
+	defer withMissingCapabilities("udp")()
+
+	be, err := newProbedBackend(nil, "", backendConfig(t, `{ "Type": "vxlan", "Fallback": "udp" }`))
+	if err != nil {
+		t.Fatalf("newProbedBackend failed: %v", err)
+	}
+	if be.Name() != "VXLAN" {
+		t.Errorf("expected vxlan, got %v", be.Name())
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"syscall"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// replaced in tests
+var (
+	linkAdd    = netlink.LinkAdd
+	linkByName = netlink.LinkByName
+	linkSetMTU = netlink.LinkSetMTU
+	linkSetUp  = netlink.LinkSetUp
+	addrList   = netlink.AddrList
+	addrAdd    = netlink.AddrAdd
+	addrDel    = netlink.AddrDel
+)
+
+// configureBridge sets up the bridge name that containers of the host are
+// attached to, as with Docker's own networking: it is created if missing,
+// given gw (the gateway of the lease with its prefix) in place of any
+// other IPv4 address it has and brought up with mtu.
+func configureBridge(name string, gw ip.IP4Net, mtu int) (ip.IP4, error) {
+	err := linkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	if err != nil && err != syscall.EEXIST {
+		return 0, fmt.Errorf("failed to create bridge %v: %v", name, err)
+	}
+
+	br, err := linkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up bridge %v: %v", name, err)
+	}
+	if br.Type() != "bridge" {
+		return 0, fmt.Errorf("%v exists but is a %v device, not a bridge", name, br.Type())
+	}
+
+	addrs, err := addrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the addresses of %v: %v", name, err)
+	}
+
+	found := false
+	for _, addr := range addrs {
+		if ip.FromIPNet(addr.IPNet).Equal(gw) {
+			found = true
+			continue
+		}
+
+		// e.g. left behind by Docker (or by a lease held before)
+		log.Warningf("Removing address %v from bridge %v, it should have %v", addr.IPNet, name, gw)
+		if err := addrDel(br, &addr); err != nil {
+			return 0, fmt.Errorf("failed to remove address %v from %v: %v", addr.IPNet, name, err)
+		}
+	}
+
+	if !found {
+		if err := addrAdd(br, &netlink.Addr{IPNet: gw.ToIPNet()}); err != nil {
+			return 0, fmt.Errorf("failed to add address %v to %v: %v", gw, name, err)
+		}
+	}
+
+	if mtu > 0 && br.Attrs().MTU != mtu {
+		if err := linkSetMTU(br, mtu); err != nil {
+			return 0, fmt.Errorf("failed to set the MTU of %v: %v", name, err)
+		}
+	}
+
+	if err := linkSetUp(br); err != nil {
+		return 0, fmt.Errorf("failed to bring %v up: %v", name, err)
+	}
+
+	log.Infof("Bridge %v configured with %v", name, gw)
+	return gw.IP, nil
+}
+
+// setupBridge configures the Bridge of the network for its lease sn and
+// makes the backends route to peers from the address of the bridge
+func (n *Network) setupBridge(sn *backend.SubnetDef) error {
+	gw, err := configureBridge(n.opts.Bridge, ip.IP4Net{IP: sn.Gateway, PrefixLen: sn.Net.PrefixLen}, sn.MTU)
+	if err != nil {
+		return err
+	}
+
+	backends := []backend.Backend{n.be}
+	if n.mig != nil {
+		backends = append(backends, n.mig.fromBe)
+	}
+	for _, be := range backends {
+		if rs, ok := be.(backend.RouteSourcer); ok {
+			rs.SetRouteSource(gw)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// fakeLinks stands in for netlink with a single link, nil until added
+type fakeLinks struct {
+	link  netlink.Link
+	addrs []string
+	up    bool
+}
+
+func (f *fakeLinks) install() func() {
+	linkAdd = func(l netlink.Link) error {
+		if f.link != nil {
+			return syscall.EEXIST
+		}
+		f.link = l
+		return nil
+	}
+	linkByName = func(name string) (netlink.Link, error) {
+		if f.link == nil || f.link.Attrs().Name != name {
+			return nil, syscall.ENODEV
+		}
+		return f.link, nil
+	}
+	linkSetMTU = func(l netlink.Link, mtu int) error {
+		l.Attrs().MTU = mtu
+		return nil
+	}
+	linkSetUp = func(l netlink.Link) error {
+		f.up = true
+		return nil
+	}
+	addrList = func(l netlink.Link, family int) ([]netlink.Addr, error) {
+		addrs := []netlink.Addr{}
+		for _, a := range f.addrs {
+			addr, err := netlink.ParseAddr(a)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, *addr)
+		}
+		return addrs, nil
+	}
+	addrAdd = func(l netlink.Link, addr *netlink.Addr) error {
+		f.addrs = append(f.addrs, addr.IPNet.String())
+		return nil
+	}
+	addrDel = func(l netlink.Link, addr *netlink.Addr) error {
+		addrs := []string{}
+		for _, a := range f.addrs {
+			if a != addr.IPNet.String() {
+				addrs = append(addrs, a)
+			}
+		}
+		f.addrs = addrs
+		return nil
+	}
+
+	return func() {
+		linkAdd, linkByName, linkSetMTU, linkSetUp = netlink.LinkAdd, netlink.LinkByName, netlink.LinkSetMTU, netlink.LinkSetUp
+		addrList, addrAdd, addrDel = netlink.AddrList, netlink.AddrAdd, netlink.AddrDel
+	}
+}
+
+// sourceBackend records the route source it is given
+type sourceBackend struct {
+	backend.Backend
+	src ip.IP4
+}
+
+func (b *sourceBackend) SetRouteSource(src ip.IP4) {
+	b.src = src
+}
+
+func TestSetupBridge(t *testing.T) {
+	f := &fakeLinks{}
+	defer f.install()()
+
+	be := &sourceBackend{}
+	n := New(nil, "", Options{Bridge: "docker0"})
+	n.be = be
+
+	sn := mustParseIP4Net("10.1.5.0/24")
+	if err := n.setupBridge(&backend.SubnetDef{Net: sn, MTU: 1450, Gateway: sn.IP + 1}); err != nil {
+		t.Fatalf("setupBridge failed: %v", err)
+	}
+
+	if _, ok := f.link.(*netlink.Bridge); !ok {
+		t.Fatalf("docker0 created as %v", f.link.Type())
+	}
+	if !reflect.DeepEqual(f.addrs, []string{"10.1.5.1/24"}) {
+		t.Errorf("bridge has addresses %v, expected the lease gateway", f.addrs)
+	}
+	if f.link.Attrs().MTU != 1450 || !f.up {
+		t.Errorf("bridge has MTU %v and up=%v", f.link.Attrs().MTU, f.up)
+	}
+	if be.src.String() != "10.1.5.1" {
+		t.Errorf("peer routes sourced from %v, expected the bridge address", be.src)
+	}
+}
+
+func TestConfigureBridgeWrongAddress(t *testing.T) {
+	// Docker's default and the subnet of an earlier lease
+	f := &fakeLinks{
+		link:  &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker0", MTU: 1450}},
+		addrs: []string{"172.17.42.1/16", "10.1.5.1/24", "10.1.9.1/24"},
+	}
+	defer f.install()()
+
+	gw := mustParseIP4Net("10.1.5.0/24")
+	gw.IP++
+	if _, err := configureBridge("docker0", gw, 1450); err != nil {
+		t.Fatalf("configureBridge failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(f.addrs, []string{"10.1.5.1/24"}) {
+		t.Errorf("bridge has addresses %v, expected only the lease gateway", f.addrs)
+	}
+}
+
+func TestConfigureBridgeNotABridge(t *testing.T) {
+	f := &fakeLinks{link: &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "docker0"}}}
+	defer f.install()()
+
+	gw := mustParseIP4Net("10.1.5.0/24")
+	gw.IP++
+	if _, err := configureBridge("docker0", gw, 1450); err == nil {
+		t.Error("configureBridge took over a device that is not a bridge")
+	}
+}
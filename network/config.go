@@ -0,0 +1,192 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/subnet"
+)
+
+// default backoff between attempts to retrieve the network config
+const (
+	defaultConfigRetryInitial = time.Second
+	defaultConfigRetryMax     = 30 * time.Second
+)
+
+func configCachePath(dir, network string) string {
+	if network == "" {
+		network = "_"
+	}
+	return filepath.Join(dir, network+".json")
+}
+
+func readCachedConfig(path string) (*subnet.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return subnet.ParseConfig(string(data))
+}
+
+func writeCachedConfig(path string, cfg *subnet.Config) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tempFile := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		return err
+	}
+
+	// rename(2) so that a crash never leaves a truncated cache behind
+	return os.Rename(tempFile, path)
+}
+
+// retryGetConfig calls GetNetworkConfig with exponential backoff until it
+// succeeds, ctx is done or timeout (if non-zero) passes. A missing config
+// is not an error to retry but is waited for until waitTimeout passes.
+func (n *Network) retryGetConfig(ctx context.Context, timeout, waitTimeout time.Duration) (*subnet.Config, error) {
+	start := time.Now()
+
+	delay, maxDelay := n.opts.ConfigRetryInitial, n.opts.ConfigRetryMax
+	if delay <= 0 {
+		delay = defaultConfigRetryInitial
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultConfigRetryMax
+	}
+	for {
+		cfg, err := n.sm.GetNetworkConfig(ctx, n.Name)
+		if err == nil {
+			return cfg, nil
+		}
+
+		limit := timeout
+		if err == subnet.ErrConfigNotFound {
+			if waitTimeout == 0 {
+				return nil, err
+			}
+			limit = waitTimeout
+		}
+		if limit > 0 && time.Since(start)+delay > limit {
+			return nil, fmt.Errorf("giving up after %v: %v", limit, err)
+		}
+
+		if err == subnet.ErrConfigNotFound {
+			log.Warningf("No network config yet, waiting for it (checking again in %v)", delay)
+		} else {
+			log.Errorf("Failed to retrieve network config (retrying in %v): %v", delay, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// getConfig retrieves the config of the network, retrying failures for up
+// to ConfigRetryTimeout and waiting for a missing one for up to
+// ConfigWaitTimeout. If the first attempt fails and a config cached by
+// an earlier run is on disk, that is used instead and the retrieval goes
+// on in the background. Successfully retrieved configs are cached.
+func (n *Network) getConfig(ctx context.Context) (*subnet.Config, error) {
+	if n.opts.ConfigCacheDir == "" {
+		return n.retryGetConfig(ctx, n.opts.ConfigRetryTimeout, n.opts.ConfigWaitTimeout)
+	}
+
+	path := configCachePath(n.opts.ConfigCacheDir, n.Name)
+
+	cfg, err := n.sm.GetNetworkConfig(ctx, n.Name)
+	if err == nil {
+		n.cacheConfig(path, cfg)
+		return cfg, nil
+	}
+
+	cached, cerr := readCachedConfig(path)
+	if cerr != nil {
+		if !os.IsNotExist(cerr) {
+			log.Warningf("Ignoring cached network config %v: %v", path, cerr)
+		}
+
+		log.Errorf("Failed to retrieve network config: %v", err)
+		cfg, err = n.retryGetConfig(ctx, n.opts.ConfigRetryTimeout, n.opts.ConfigWaitTimeout)
+		if err == nil {
+			n.cacheConfig(path, cfg)
+		}
+		return cfg, err
+	}
+
+	log.Warningf("Failed to retrieve network config, using cached copy from %v: %v", path, err)
+
+	go func() {
+		// keep trying so the cache gets refreshed and a
+		// changed config is at least brought to attention
+		cfg, err := n.retryGetConfig(ctx, 0, 0)
+		if err == subnet.ErrConfigNotFound {
+			log.Warningf("Network config of %q is gone, still using the cached copy", n.Name)
+		}
+		if err != nil {
+			return
+		}
+
+		if !configEqual(cfg, cached) {
+			log.Warningf("Network config of %q changed since it was cached, restart to apply it", n.Name)
+		}
+		n.cacheConfig(path, cfg)
+	}()
+
+	return cached, nil
+}
+
+func (n *Network) cacheConfig(path string, cfg *subnet.Config) {
+	if err := writeCachedConfig(path, cfg); err != nil {
+		log.Warningf("Failed to cache network config to %v: %v", path, err)
+	}
+}
+
+func configEqual(x, y *subnet.Config) bool {
+	// compare the encoded forms so that formatting
+	// differences in Backend don't count
+	xb, err := json.Marshal(x)
+	if err != nil {
+		return false
+	}
+	yb, err := json.Marshal(y)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(xb, yb)
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/subnet"
+)
+
+const testConfig = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "host-gw" } }`
+
+// flakyManager fails GetNetworkConfig the first failures times
+type flakyManager struct {
+	subnet.Manager
+	failures int
+	calls    int
+}
+
+func (m *flakyManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	m.calls++
+	if m.failures < 0 || m.calls <= m.failures {
+		return nil, errors.New("etcd is unreachable")
+	}
+	return subnet.ParseConfig(testConfig)
+}
+
+func fastRetries(opts Options) Options {
+	opts.ConfigRetryInitial, opts.ConfigRetryMax = 10*time.Millisecond, 20*time.Millisecond
+	return opts
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flannel-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestGetConfigTransientFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	sm := &flakyManager{failures: 2}
+	n := New(sm, "", fastRetries(Options{ConfigRetryTimeout: 10 * time.Second, ConfigCacheDir: dir}))
+
+	cfg, err := n.getConfig(context.Background())
+	if err != nil {
+		t.Fatalf("getConfig failed: %v", err)
+	}
+
+	if cfg.Network.String() != "10.3.0.0/16" {
+		t.Errorf("getConfig returned wrong network: %v", cfg.Network)
+	}
+
+	if sm.calls != 3 {
+		t.Errorf("expected 3 calls to GetNetworkConfig, got %v", sm.calls)
+	}
+
+	cached, err := readCachedConfig(configCachePath(dir, ""))
+	if err != nil {
+		t.Fatalf("Failed to read cached config: %v", err)
+	}
+	if !configEqual(cfg, cached) {
+		t.Errorf("cached config differs: %#v vs %#v", cached, cfg)
+	}
+}
+
+func TestGetConfigGiveUp(t *testing.T) {
+	sm := &flakyManager{failures: -1}
+	n := New(sm, "", fastRetries(Options{ConfigRetryTimeout: 50 * time.Millisecond}))
+
+	if _, err := n.getConfig(context.Background()); err == nil {
+		t.Error("getConfig succeeded against a failing manager")
+	}
+}
+
+// pendingManager has no config until ready, then fails with err if set
+type pendingManager struct {
+	subnet.Manager
+	ready time.Time
+	err   error
+}
+
+func (m *pendingManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	if time.Now().Before(m.ready) {
+		return nil, subnet.ErrConfigNotFound
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	return subnet.ParseConfig(testConfig)
+}
+
+func TestGetConfigWait(t *testing.T) {
+	sm := &pendingManager{ready: time.Now().Add(100 * time.Millisecond)}
+	n := New(sm, "", fastRetries(Options{ConfigRetryTimeout: 10 * time.Millisecond, ConfigWaitTimeout: 10 * time.Second}))
+
+	cfg, err := n.getConfig(context.Background())
+	if err != nil {
+		t.Fatalf("getConfig did not wait for the config: %v", err)
+	}
+	if cfg.Network.String() != "10.3.0.0/16" {
+		t.Errorf("getConfig returned wrong network: %v", cfg.Network)
+	}
+
+	// not waiting by default
+	sm = &pendingManager{ready: time.Now().Add(time.Hour)}
+	n = New(sm, "", fastRetries(Options{ConfigRetryTimeout: time.Hour}))
+	if _, err := n.getConfig(context.Background()); err != subnet.ErrConfigNotFound {
+		t.Errorf("expected %v without waiting, got %v", subnet.ErrConfigNotFound, err)
+	}
+
+	// other errors are not waited out
+	sm = &pendingManager{err: errors.New("etcd is unreachable")}
+	n = New(sm, "", fastRetries(Options{ConfigRetryTimeout: 50 * time.Millisecond, ConfigWaitTimeout: time.Hour}))
+	done := make(chan error, 1)
+	go func() {
+		_, err := n.getConfig(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "unreachable") {
+			t.Errorf("expected the store error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("getConfig kept waiting on a store error")
+	}
+}
+
+func TestGetConfigCached(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	expected, err := subnet.ParseConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCachedConfig(configCachePath(dir, "blue"), expected); err != nil {
+		t.Fatalf("Failed to write cached config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// would not give up for a long time without the cache
+	sm := &flakyManager{failures: -1}
+	n := New(sm, "blue", fastRetries(Options{ConfigRetryTimeout: time.Hour, ConfigCacheDir: dir}))
+
+	cfg, err := n.getConfig(ctx)
+	if err != nil {
+		t.Fatalf("getConfig failed: %v", err)
+	}
+
+	if !configEqual(cfg, expected) {
+		t.Errorf("getConfig did not return the cached config: %#v", cfg)
+	}
+}
+
+// switchingManager serves whatever config is set last
+type switchingManager struct {
+	subnet.Manager
+	mux    sync.Mutex
+	config string
+}
+
+func (m *switchingManager) set(config string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.config = config
+}
+
+func (m *switchingManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return subnet.ParseConfig(m.config)
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		valid  bool
+	}{
+		{testConfig, true},
+		{`{ "Network": "10.3.0.0/16" }`, true},
+		{`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "Fallback": "udp" } }`, true},
+		{`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "MigrateFrom": { "Type": "udp" } } }`, true},
+		{`{ "Backend": { "Type": "host-gw" } }`, false},
+		{`{ "Network": "10.3.0.0/16", "Backend": { "Type": "bogus" } }`, false},
+		{`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "Fallback": "bogus" } }`, false},
+		{`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "MigrateFrom": { "Type": "bogus" } } }`, false},
+	} {
+		cfg, err := subnet.ParseConfig(tc.config)
+		if err != nil {
+			t.Fatalf("ParseConfig(%v) failed: %v", tc.config, err)
+		}
+		if err := ValidateConfig(cfg); (err == nil) != tc.valid {
+			t.Errorf("ValidateConfig(%v): expected valid=%v, got %v", tc.config, tc.valid, err)
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	sm := &switchingManager{config: `{ "Network": "10.3.0.0/16", "Backend": { "Type": "bogus" } }`}
+	cc := NewConfigCheck(sm, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cc.Run(ctx, 10*time.Millisecond)
+
+	// stays failing, not just until the first check
+	time.Sleep(50 * time.Millisecond)
+	if err := cc.Check(); err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Fatalf("invalid config passed the check: %v", err)
+	}
+
+	sm.set(testConfig)
+	waitFor(t, "the fixed config to pass the check", func() bool { return cc.Check() == nil })
+}
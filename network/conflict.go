@@ -0,0 +1,170 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// Policies for a lease that overlaps a network of the host
+const (
+	// ConflictWarn logs the conflict and uses the lease anyway
+	ConflictWarn = "warn"
+	// ConflictFail gives up on the network
+	ConflictFail = "fail"
+	// ConflictReacquire acquires a lease elsewhere
+	ConflictReacquire = "reacquire"
+)
+
+// ParseConflictPolicy checks that s names a policy
+func ParseConflictPolicy(s string) (string, error) {
+	switch s {
+	case ConflictWarn, ConflictFail, ConflictReacquire:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown subnet conflict policy %q (expected %v, %v or %v)", s, ConflictWarn, ConflictFail, ConflictReacquire)
+	}
+}
+
+type hostNetwork struct {
+	Iface string
+	Net   ip.IP4Net
+}
+
+// returns the IPv4 networks of the host's interfaces; replaced in tests
+var hostNetworks = interfaceNetworks
+
+func interfaceNetworks() ([]hostNetwork, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	nets := []hostNetwork{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %v: %v", iface.Name, err)
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				nets = append(nets, hostNetwork{iface.Name, ip.FromIPNet(ipn).Network()})
+			}
+		}
+	}
+	return nets, nil
+}
+
+// SubnetConflictError tells that a lease overlaps a network of the host,
+// where routes to the lease would blackhole the host's own traffic
+type SubnetConflictError struct {
+	Subnet  ip.IP4Net
+	Iface   string
+	HostNet ip.IP4Net
+}
+
+func (e *SubnetConflictError) Error() string {
+	return fmt.Sprintf("subnet %v overlaps network %v of %v", e.Subnet, e.HostNet, e.Iface)
+}
+
+// subnetConflicts returns the networks of the host that sn overlaps.
+// Those that are the flannel network itself (the flannel devices) or
+// within sn (e.g. docker0) don't count.
+func subnetConflicts(sn, flannelNet ip.IP4Net) ([]hostNetwork, error) {
+	nets, err := hostNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []hostNetwork{}
+	for _, hn := range nets {
+		switch {
+		case !hn.Net.Overlaps(sn):
+		case hn.Net.Equal(flannelNet):
+		case sn.Contains(hn.Net.IP) && hn.Net.PrefixLen >= sn.PrefixLen:
+		default:
+			conflicts = append(conflicts, hn)
+		}
+	}
+	return conflicts, nil
+}
+
+func containsNet(nets []ip.IP4Net, n ip.IP4Net) bool {
+	for _, x := range nets {
+		if x.Equal(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConflict applies the conflict policy to lease l of network,
+// returning the lease to use
+func (m *nodeManager) checkConflict(ctx context.Context, network string, attrs *subnet.LeaseAttrs, l *subnet.Lease) (*subnet.Lease, error) {
+	config, err := m.Manager.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	avoid := *attrs
+	for {
+		conflicts, err := subnetConflicts(l.Subnet, config.Network)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("failed to check lease %v against the networks of the host: %v", l.Subnet, err)
+		case len(conflicts) == 0:
+			return l, nil
+		}
+
+		conflict := &SubnetConflictError{l.Subnet, conflicts[0].Iface, conflicts[0].Net}
+		switch m.opts.SubnetConflict {
+		case ConflictFail:
+			return nil, m.fatal(conflict)
+
+		case ConflictReacquire:
+			added := false
+			for _, hn := range conflicts {
+				if !containsNet(avoid.AvoidSubnets, hn.Net) {
+					avoid.AvoidSubnets = append(avoid.AvoidSubnets, hn.Net)
+					added = true
+				}
+			}
+			if !added {
+				// the manager does not keep clear of them (e.g. an older server)
+				return nil, m.fatal(conflict)
+			}
+
+			log.Warningf("Lease %v is not usable (%v), acquiring another one", l.Subnet, conflict)
+			if l, err = m.Manager.AcquireLease(ctx, network, &avoid); err != nil {
+				return nil, err
+			}
+			log.Infof("Acquired lease %v instead", l.Subnet)
+
+		default:
+			log.Warningf("Using lease %v although %v, routes to it can cut the host off from that network", l.Subnet, conflict)
+			return l, nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// two subnets: 10.1.5.0/24 and 10.1.6.0/24
+const conflictConfig = `{ "Network": "10.1.0.0/16", "SubnetMin": "10.1.5.0", "SubnetMax": "10.1.6.0" }`
+
+func withHostNetworks(nets ...hostNetwork) func() {
+	orig := hostNetworks
+	hostNetworks = func() ([]hostNetwork, error) {
+		return nets, nil
+	}
+	return func() { hostNetworks = orig }
+}
+
+func mustParseIP4Net(s string) ip.IP4Net {
+	_, n, _ := net.ParseCIDR(s)
+	return ip.FromIPNet(n)
+}
+
+func TestSubnetConflictReacquire(t *testing.T) {
+	ctx := context.Background()
+	sm := subnet.NewMockManager(0, conflictConfig)
+	attrs := subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("1.2.3.4"))}
+
+	// held since an earlier run
+	old, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host is on a /23 covering the lease, the flannel device
+	// and docker0 (within the lease) don't count
+	hostNet := ip.IP4Net{IP: old.Subnet.IP, PrefixLen: 23}.Network()
+	defer withHostNetworks(
+		hostNetwork{"eth0", hostNet},
+		hostNetwork{"flannel0", mustParseIP4Net("10.1.0.0/16")},
+		hostNetwork{"docker0", old.Subnet},
+	)()
+
+	nm := newNodeManager(sm, Options{SubnetConflict: ConflictReacquire})
+	l, err := nm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: attrs.PublicIP})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	if l.Subnet.Equal(old.Subnet) || l.Subnet.Overlaps(hostNet) {
+		t.Errorf("got lease %v overlapping host network %v", l.Subnet, hostNet)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Errorf("expected only lease %v to be held, got %v", l.Subnet, wr.Snapshot)
+	}
+}
+
+func TestSubnetConflictPolicies(t *testing.T) {
+	ctx := context.Background()
+	defer withHostNetworks(hostNetwork{"eth0", mustParseIP4Net("10.0.0.0/8")})()
+
+	for _, policy := range []string{ConflictWarn, ConflictFail} {
+		sm := subnet.NewMockManager(0, conflictConfig)
+		nm := newNodeManager(sm, Options{SubnetConflict: policy})
+
+		l, err := nm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("1.2.3.4"))})
+		switch policy {
+		case ConflictWarn:
+			if err != nil || l == nil {
+				t.Errorf("%v: AcquireLease failed: %v", policy, err)
+			}
+
+		case ConflictFail:
+			if _, ok := err.(*SubnetConflictError); !ok {
+				t.Errorf("%v: expected a *SubnetConflictError, got %v", policy, err)
+			}
+			if nm.failed() == nil {
+				t.Errorf("%v: the conflict was not recorded as fatal", policy)
+			}
+		}
+	}
+}
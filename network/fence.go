@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// fence returns the claim to l.Subnet to go with: l itself or, if stale
+// is true, a claim seen before that outranks it (e.g. l is the renewal
+// of a node that lost its lease while partitioned away). Claims are
+// remembered until the subnet is released. m.mux must be held.
+func (m *nodeManager) fence(network string, l subnet.Lease) (subnet.Lease, bool) {
+	if l.Attrs == nil || l.Attrs.Epoch == 0 {
+		return l, false
+	}
+
+	claims := m.claims[network]
+	if claims == nil {
+		claims = make(map[ip.IP4Net]subnet.Lease)
+		m.claims[network] = claims
+	}
+
+	if c, ok := claims[l.Subnet]; ok && outranks(c, l) {
+		log.Warningf("Ignoring claim to %v by %v (epoch %v), it is held by %v (epoch %v)",
+			l.Subnet, l.Attrs.PublicIP, l.Attrs.Epoch, c.Attrs.PublicIP, c.Attrs.Epoch)
+		return c, true
+	}
+
+	claims[l.Subnet] = l
+	return l, false
+}
+
+// outranks returns whether claim c wins over l: it has a higher epoch
+// or, as concurrent acquires can get the same one, it is that of another
+// node that comes first by hostname (PublicIP without hostnames). The
+// order does not depend on which claim is seen first, so peers agree.
+func outranks(c, l subnet.Lease) bool {
+	switch {
+	case c.Attrs.Epoch != l.Attrs.Epoch:
+		return c.Attrs.Epoch > l.Attrs.Epoch
+	case c.Attrs.Hostname != "" && l.Attrs.Hostname != "":
+		return c.Attrs.Hostname < l.Attrs.Hostname
+	default:
+		return c.Attrs.PublicIP < l.Attrs.PublicIP
+	}
+}
+
+// release forgets the claims to sn, m.mux must be held
+func (m *nodeManager) release(network string, sn ip.IP4Net) {
+	delete(m.claims[network], sn)
+}
+
+// releaseMissing forgets the claims to the subnets not in snapshot,
+// m.mux must be held
+func (m *nodeManager) releaseMissing(network string, snapshot []subnet.Lease) {
+	leased := make(map[ip.IP4Net]bool)
+	for _, l := range snapshot {
+		leased[l.Subnet] = true
+	}
+	for sn := range m.claims[network] {
+		if !leased[sn] {
+			delete(m.claims[network], sn)
+		}
+	}
+}
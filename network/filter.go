@@ -0,0 +1,144 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// RouteFilter restricts the remote leases that backends program routes
+// for. A lease matches if its Zone is one of the filter's zones or its
+// subnet lies within one of the filter's networks. An empty filter
+// matches everything.
+type RouteFilter struct {
+	mux     sync.Mutex
+	zones   map[string]bool
+	subnets []ip.IP4Net
+	changed chan struct{}
+}
+
+func NewRouteFilter() *RouteFilter {
+	return &RouteFilter{
+		zones:   make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+}
+
+// Set replaces the rules of the filter
+func (f *RouteFilter) Set(zones []string, subnets []ip.IP4Net) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.zones = make(map[string]bool)
+	for _, z := range zones {
+		f.zones[z] = true
+	}
+	f.subnets = subnets
+
+	// wake up everyone waiting for a change
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Load sets the filter from a file with one rule per line: either a
+// network in CIDR notation or "zone NAME". Blank lines and lines
+// starting with # are ignored. A missing file clears the filter.
+func (f *RouteFilter) Load(path string) error {
+	file, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		f.Set(nil, nil)
+		return nil
+	case err != nil:
+		return err
+	}
+	defer file.Close()
+
+	zones, subnets, err := parseRouteFilter(file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	f.Set(zones, subnets)
+	return nil
+}
+
+func parseRouteFilter(r io.Reader) ([]string, []ip.IP4Net, error) {
+	zones := []string{}
+	subnets := []ip.IP4Net{}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fields := strings.Fields(line); fields[0] == "zone" {
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("bad zone rule %q", line)
+			}
+			zones = append(zones, fields[1])
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(line)
+		if err != nil || n.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("bad network %q", line)
+		}
+		subnets = append(subnets, ip.FromIPNet(n))
+	}
+
+	return zones, subnets, s.Err()
+}
+
+// Matches reports whether routes should be programmed for l
+func (f *RouteFilter) Matches(l *subnet.Lease) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if len(f.zones) == 0 && len(f.subnets) == 0 {
+		return true
+	}
+
+	if l.Attrs != nil && f.zones[l.Attrs.Zone] {
+		return true
+	}
+
+	last := l.Subnet.Next().IP - 1
+	for _, n := range f.subnets {
+		if n.Contains(l.Subnet.IP) && n.Contains(last) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Changed returns a channel that is closed the next time the filter is set
+func (f *RouteFilter) Changed() <-chan struct{} {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.changed
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+)
+
+// route changes waiting for the hook, beyond that they are dropped
+const routeHookQueue = 1000
+
+// RouteHook runs a command and/or posts to a URL for each route to a peer
+// that a backend adds or removes. They run one at a time, in order, off
+// the backends' goroutines.
+type RouteHook struct {
+	args    []*template.Template
+	url     string
+	timeout time.Duration
+	queue   chan backend.RouteChange
+}
+
+// NewRouteHook returns a hook running command, if not empty, and posting
+// the change as JSON to url, if not empty, allowing each timeout. command
+// is split on spaces, each argument being a text/template expanded with
+// the backend.RouteChange (e.g. "fw-update {{.Action}} {{.Subnet}}").
+func NewRouteHook(command, url string, timeout time.Duration) (*RouteHook, error) {
+	h := &RouteHook{
+		url:     url,
+		timeout: timeout,
+		queue:   make(chan backend.RouteChange, routeHookQueue),
+	}
+
+	for i, arg := range strings.Fields(command) {
+		t, err := template.New(fmt.Sprintf("arg%v", i)).Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad argument %q: %v", arg, err)
+		}
+		h.args = append(h.args, t)
+	}
+	// catch references to fields that don't exist now
+	if _, err := h.expand(backend.RouteChange{}); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *RouteHook) expand(c backend.RouteChange) ([]string, error) {
+	args := make([]string, len(h.args))
+	for i, t := range h.args {
+		var b bytes.Buffer
+		if err := t.Execute(&b, c); err != nil {
+			return nil, err
+		}
+		args[i] = b.String()
+	}
+	return args, nil
+}
+
+// notify queues c without blocking
+func (h *RouteHook) notify(c backend.RouteChange) {
+	select {
+	case h.queue <- c:
+	default:
+		log.Warningf("Route hook is falling behind, dropping %v of route to %v", c.Action, c.Subnet)
+	}
+}
+
+// Run runs the hook for the queued changes until ctx is canceled
+func (h *RouteHook) Run(ctx context.Context) {
+	for {
+		select {
+		case c := <-h.queue:
+			if len(h.args) > 0 {
+				if err := h.runCommand(c); err != nil {
+					log.Errorf("Route hook command failed for %v of route to %v: %v", c.Action, c.Subnet, err)
+				}
+			}
+			if h.url != "" {
+				if err := h.post(c); err != nil {
+					log.Errorf("Route hook post failed for %v of route to %v: %v", c.Action, c.Subnet, err)
+				}
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *RouteHook) runCommand(c backend.RouteChange) error {
+	args, err := h.expand(c)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"FLANNEL_NETWORK="+c.Network,
+		"FLANNEL_SUBNET="+c.Subnet.String(),
+		"FLANNEL_PEER_IP="+c.PeerIP.String(),
+		"FLANNEL_ROUTE_ACTION="+c.Action,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out.Bytes()))
+		}
+		return nil
+
+	case <-time.After(h.timeout):
+		// not waiting for it, a child could keep its output open
+		cmd.Process.Kill()
+		return fmt.Errorf("timed out after %v", h.timeout)
+	}
+}
+
+func (h *RouteHook) post(c backend.RouteChange) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: h.timeout}
+	resp, err := client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responded with %v", h.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func routeChange(t *testing.T, action, sn, peer string) backend.RouteChange {
+	_, n, err := net.ParseCIDR(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend.RouteChange{
+		Network: "blue",
+		Subnet:  ip.FromIPNet(n),
+		PeerIP:  ip.FromIP(net.ParseIP(peer)),
+		Action:  action,
+	}
+}
+
+// writeScript writes an executable shell script to dir
+func writeScript(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write %v: %v", path, err)
+	}
+	return path
+}
+
+func readLines(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestRouteHookCommand(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	script := writeScript(t, dir, "hook", `echo "$@" $FLANNEL_ROUTE_ACTION $FLANNEL_SUBNET >> `+out)
+
+	h, err := NewRouteHook(script+" {{.Action}} {{.Network}} {{.Subnet}} {{.PeerIP}}", "", 10*time.Second)
+	if err != nil {
+		t.Fatalf("NewRouteHook failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	nm := newNodeManager(nil, Options{RouteHook: h})
+	nm.RouteChanged(routeChange(t, backend.RouteAdded, "10.3.1.0/24", "1.1.1.1"))
+	nm.RouteChanged(routeChange(t, backend.RouteRemoved, "10.3.1.0/24", "1.1.1.1"))
+
+	waitFor(t, "the hook to run twice", func() bool { return len(readLines(out)) == 2 })
+
+	expected := []string{
+		"add blue 10.3.1.0/24 1.1.1.1 add 10.3.1.0/24",
+		"remove blue 10.3.1.0/24 1.1.1.1 remove 10.3.1.0/24",
+	}
+	for i, line := range readLines(out) {
+		if line != expected[i] {
+			t.Errorf("run %v: expected %q, got %q", i, expected[i], line)
+		}
+	}
+}
+
+func TestRouteHookTimeout(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	script := writeScript(t, dir, "hook", `[ "$1" = remove ] && exec sleep 60; echo "$@" >> `+out)
+
+	h, err := NewRouteHook(script+" {{.Action}} {{.Subnet}}", "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewRouteHook failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	// the hanging run must not hold up the one after it
+	h.notify(routeChange(t, backend.RouteRemoved, "10.3.1.0/24", "1.1.1.1"))
+	h.notify(routeChange(t, backend.RouteAdded, "10.3.2.0/24", "1.1.1.2"))
+
+	waitFor(t, "the hook to run after a timeout", func() bool { return len(readLines(out)) == 1 })
+	if line := readLines(out)[0]; line != "add 10.3.2.0/24" {
+		t.Errorf("unexpected hook run: %q", line)
+	}
+}
+
+func TestRouteHookURL(t *testing.T) {
+	var mux sync.Mutex
+	var received []backend.RouteChange
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c backend.RouteChange
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			t.Errorf("Failed to decode route change: %v", err)
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		received = append(received, c)
+	}))
+	defer srv.Close()
+
+	h, err := NewRouteHook("", srv.URL, 10*time.Second)
+	if err != nil {
+		t.Fatalf("NewRouteHook failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	c := routeChange(t, backend.RouteAdded, "10.3.1.0/24", "1.1.1.1")
+	h.notify(c)
+
+	waitFor(t, "the route change to be posted", func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(received) == 1
+	})
+
+	mux.Lock()
+	defer mux.Unlock()
+	if received[0] != c {
+		t.Errorf("expected %+v to be posted, got %+v", c, received[0])
+	}
+}
+
+func TestRouteHookBadCommand(t *testing.T) {
+	for _, cmd := range []string{"hook {{.Action", "hook {{.Bogus}}"} {
+		if _, err := NewRouteHook(cmd, "", time.Second); err == nil {
+			t.Errorf("NewRouteHook(%q) succeeded", cmd)
+		}
+	}
+}
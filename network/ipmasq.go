@@ -20,11 +20,62 @@ import (
 
 	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 
+	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
 )
 
-func setupIPMasq(ipn ip.IP4Net) error {
-	ipt, err := ip.NewIPTables()
+// IPMasqCapabilities returns what the host needs for --ip-masq
+func IPMasqCapabilities() []backend.Capability {
+	return []backend.Capability{
+		backend.Executable("iptables"),
+	}
+}
+
+// iptables is the subset of ip.IPTables used to manage the rules of flannel
+type iptables interface {
+	ClearChain(table, chain string) error
+	AppendUnique(table string, args ...string) error
+	Delete(table string, args ...string) error
+	List(table string) ([][]string, error)
+}
+
+// replaced in tests
+var newIPTables = func() (iptables, error) {
+	return ip.NewIPTables()
+}
+
+// the tables CleanupIPTables looks for tagged rules in
+var iptablesTables = []string{"filter", "nat", "mangle"}
+
+// IPTablesTag is the comment flannel tags the iptables rules it adds for
+// network with (if Options.IPTablesTag is set)
+func IPTablesTag(network string) string {
+	if network == "" {
+		network = "_"
+	}
+	return "flannel:" + network
+}
+
+func tagRule(args []string, tag string) []string {
+	if tag == "" {
+		return args
+	}
+	return append(args, "-m", "comment", "--comment", tag)
+}
+
+func hasTag(rule []string, tag string) bool {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] == "--comment" && rule[i+1] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// setupIPMasq adds the masquerading rules for ipn, tagged with tag unless
+// it is empty
+func setupIPMasq(ipn ip.IP4Net, tag string) error {
+	ipt, err := newIPTables()
 	if err != nil {
 		return fmt.Errorf("failed to setup IP Masquerade. iptables was not found")
 	}
@@ -44,6 +95,7 @@ func setupIPMasq(ipn ip.IP4Net) error {
 	}
 
 	for _, args := range rules {
+		args = tagRule(args, tag)
 		log.Info("Adding iptables rule: ", strings.Join(args, " "))
 
 		err = ipt.AppendUnique("nat", args...)
@@ -54,3 +106,36 @@ func setupIPMasq(ipn ip.IP4Net) error {
 
 	return nil
 }
+
+// CleanupIPTables deletes the rules tagged with the IPTablesTag of network,
+// leaving all others (including the FLANNEL chain itself) alone, and
+// returns how many were deleted
+func CleanupIPTables(network string) (int, error) {
+	ipt, err := newIPTables()
+	if err != nil {
+		return 0, fmt.Errorf("iptables was not found")
+	}
+
+	tag := IPTablesTag(network)
+	deleted := 0
+	for _, table := range iptablesTables {
+		rules, err := ipt.List(table)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list rules of %v table: %v", table, err)
+		}
+
+		for _, rule := range rules {
+			if len(rule) < 2 || rule[0] != "-A" || !hasTag(rule, tag) {
+				continue
+			}
+
+			log.Infof("Deleting iptables rule: -t %v %v", table, strings.Join(rule, " "))
+			if err := ipt.Delete(table, rule[1:]...); err != nil {
+				return deleted, fmt.Errorf("failed to delete rule from %v table: %v", table, err)
+			}
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fakeIPTables keeps rules in the form printed by "iptables -S"
+type fakeIPTables struct {
+	tables map[string][][]string
+}
+
+func (f *fakeIPTables) find(table string, rule []string) int {
+	for i, r := range f.tables[table] {
+		if reflect.DeepEqual(r, rule) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeIPTables) ClearChain(table, chain string) error {
+	rules := [][]string{}
+	for _, r := range f.tables[table] {
+		if r[1] != chain {
+			rules = append(rules, r)
+		}
+	}
+	f.tables[table] = append(rules, []string{"-N", chain})
+	return nil
+}
+
+func (f *fakeIPTables) AppendUnique(table string, args ...string) error {
+	rule := append([]string{"-A"}, args...)
+	if f.find(table, rule) < 0 {
+		f.tables[table] = append(f.tables[table], rule)
+	}
+	return nil
+}
+
+func (f *fakeIPTables) Delete(table string, args ...string) error {
+	i := f.find(table, append([]string{"-A"}, args...))
+	if i < 0 {
+		return fmt.Errorf("no such rule in %v: %v", table, args)
+	}
+	f.tables[table] = append(f.tables[table][:i], f.tables[table][i+1:]...)
+	return nil
+}
+
+func (f *fakeIPTables) List(table string) ([][]string, error) {
+	return append([][]string{}, f.tables[table]...), nil
+}
+
+func withFakeIPTables(f *fakeIPTables) func() {
+	orig := newIPTables
+	newIPTables = func() (iptables, error) {
+		return f, nil
+	}
+	return func() {
+		newIPTables = orig
+	}
+}
+
+func TestCleanupIPTables(t *testing.T) {
+	others := map[string][][]string{
+		"filter": {
+			{"-P", "FORWARD", "ACCEPT"},
+			{"-A", "FORWARD", "-s", "10.6.0.0/16", "-m", "comment", "--comment", "flannel:blue", "-j", "ACCEPT"},
+		},
+		"nat": {
+			{"-N", "DOCKER"},
+			{"-A", "POSTROUTING", "-s", "172.17.0.0/16", "!", "-o", "docker0", "-j", "MASQUERADE"},
+			{"-A", "POSTROUTING", "-s", "10.5.0.0/16", "-m", "comment", "--comment", "flannel:_ (not ours)", "-j", "ACCEPT"},
+		},
+	}
+
+	f := &fakeIPTables{map[string][][]string{}}
+	for table, rules := range others {
+		f.tables[table] = append([][]string{}, rules...)
+	}
+	defer withFakeIPTables(f)()
+
+	if err := setupIPMasq(mustParseIP4Net("10.5.0.0/16"), IPTablesTag("")); err != nil {
+		t.Fatalf("setupIPMasq failed: %v", err)
+	}
+
+	tagged := 0
+	for _, rule := range f.tables["nat"] {
+		if hasTag(rule, "flannel:_") {
+			tagged++
+		}
+	}
+	if tagged != 3 {
+		t.Fatalf("setupIPMasq added %v tagged rules, expected 3: %v", tagged, f.tables["nat"])
+	}
+
+	deleted, err := CleanupIPTables("")
+	if err != nil {
+		t.Fatalf("CleanupIPTables failed: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("CleanupIPTables deleted %v rules, expected 3", deleted)
+	}
+
+	// only the (now empty) FLANNEL chain is left behind
+	others["nat"] = append(others["nat"], []string{"-N", "FLANNEL"})
+	for table, rules := range others {
+		if !reflect.DeepEqual(f.tables[table], rules) {
+			t.Errorf("CleanupIPTables left %v table as %v, expected %v", table, f.tables[table], rules)
+		}
+	}
+}
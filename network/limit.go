@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// routed returns how many peer leases of visible are passed on to the
+// backends, m.mux must be held
+func (m *nodeManager) routed(visible map[ip.IP4Net]bool) int {
+	n := 0
+	for sn := range visible {
+		if m.own[sn] == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// overLimit reports whether routing another peer lease would exceed
+// MaxRoutes
+func (m *nodeManager) overLimit(routed int) bool {
+	return m.opts.MaxRoutes > 0 && routed >= m.opts.MaxRoutes
+}
+
+// hold keeps l back from the backends until there is room for it,
+// m.mux must be held
+func (m *nodeManager) hold(network string, l subnet.Lease) {
+	held := m.held[network]
+	if held == nil {
+		held = make(map[ip.IP4Net]subnet.Lease)
+		m.held[network] = held
+	}
+	held[l.Subnet] = l
+	m.skipped[network][l.Subnet] = backend.RouteSkippedLimit
+}
+
+// promote passes on as many held leases as fit under the limit again,
+// m.mux must be held
+func (m *nodeManager) promote(network string) []subnet.Event {
+	visible := m.visible[network]
+	routed := m.routed(visible)
+
+	events := []subnet.Event{}
+	for sn, l := range m.held[network] {
+		if m.overLimit(routed) {
+			break
+		}
+		log.Infof("Routing lease %v held back by the route limit", sn)
+		delete(m.held[network], sn)
+		delete(m.skipped[network], sn)
+		visible[sn] = true
+		routed++
+		events = append(events, subnet.Event{Type: subnet.SubnetAdded, Lease: l})
+	}
+	return events
+}
+
+func (m *nodeManager) logHeld(network string, newly int) {
+	if newly > 0 {
+		log.Errorf("Route limit of %v reached for network %q, not routing %v more leases (%v held back in total)",
+			m.opts.MaxRoutes, network, newly, len(m.held[network]))
+	}
+}
+
+// routeLimitErr returns an error while leases of network are held back
+// by the route limit
+func (m *nodeManager) routeLimitErr(network string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if n := len(m.held[network]); n > 0 {
+		return fmt.Errorf("route limit of %v reached, %v leases not routed", m.opts.MaxRoutes, n)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// networksManager hands each network to its own clusterManager
+type networksManager struct {
+	subnet.Manager
+	nets map[string]*clusterManager
+}
+
+func (m *networksManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	return m.nets[network].GetNetworkConfig(ctx, network)
+}
+
+func (m *networksManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	return m.nets[network].AcquireLease(ctx, network, attrs)
+}
+
+func (m *networksManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	return m.nets[network].RenewLease(ctx, network, lease)
+}
+
+func (m *networksManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	return m.nets[network].UpdateLeaseAttrs(ctx, network, sn, attrs)
+}
+
+func (m *networksManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	return m.nets[network].WatchLeases(ctx, network, cursor)
+}
+
+func addPeer(t *testing.T, cm *clusterManager, bt, pip string) ip.IP4Net {
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(net.ParseIP(pip)),
+		BackendType: bt,
+		BackendData: json.RawMessage(`{}`),
+	}
+	l, err := cm.AcquireLease(context.Background(), "", attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Subnet
+}
+
+// the pod network and a management network (as with
+// --management-network) are joined and routed independently
+func TestManagementNetwork(t *testing.T) {
+	defer withMissingCapabilities()()
+
+	tn := &testNode{
+		name:     "node",
+		ip:       net.IPv4(192, 168, 0, 1),
+		backends: make(map[string]*fakeBackend),
+	}
+	defer withFakeBackends(&tn)()
+
+	pod := newClusterManager(t, `{ "Type": "vxlan" }`)
+	mgmt := newClusterManager(t, `{ "Type": "host-gw" }`)
+	mgmt.config.Network = mustParseIP4Net("10.4.0.0/16")
+	sm := &networksManager{nets: map[string]*clusterManager{"": pod, "mgmt": mgmt}}
+
+	podPeers := map[ip.IP4Net]bool{
+		addPeer(t, pod, "vxlan", "192.168.0.2"): true,
+		addPeer(t, pod, "vxlan", "192.168.0.3"): true,
+	}
+	mgmtPeers := map[ip.IP4Net]bool{
+		addPeer(t, mgmt, "host-gw", "192.168.0.2"): true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leases := make(map[string]ip.IP4Net)
+	for _, name := range []string{"", "mgmt"} {
+		n := New(sm, name, Options{})
+		sn := n.Init(ctx, &net.Interface{MTU: 1500}, tn.ip)
+		if sn == nil {
+			t.Fatalf("Failed to initialize network %q", name)
+		}
+		leases[name] = sn.Net
+		go n.Run(ctx)
+	}
+
+	if !pod.lease(leases[""]).Subnet.Equal(leases[""]) || !mustParseIP4Net("10.3.0.0/16").Contains(leases[""].IP) {
+		t.Errorf("no pod lease acquired: %v", leases[""])
+	}
+	if !mgmt.lease(leases["mgmt"]).Subnet.Equal(leases["mgmt"]) || !mustParseIP4Net("10.4.0.0/16").Contains(leases["mgmt"].IP) {
+		t.Errorf("no management lease acquired: %v", leases["mgmt"])
+	}
+
+	waitFor(t, "routes of both networks", func() bool {
+		return reflect.DeepEqual(tn.routes("vxlan"), podPeers) && reflect.DeepEqual(tn.routes("host-gw"), mgmtPeers)
+	})
+
+	// a peer joining one network leaves the routes of the other alone
+	mgmtPeers[addPeer(t, mgmt, "host-gw", "192.168.0.3")] = true
+	waitFor(t, "route to the new management peer", func() bool {
+		return reflect.DeepEqual(tn.routes("host-gw"), mgmtPeers)
+	})
+	if routes := tn.routes("vxlan"); !reflect.DeepEqual(routes, podPeers) {
+		t.Errorf("pod routes changed to %v with a new management peer", routes)
+	}
+
+	tn.mux.Lock()
+	defer tn.mux.Unlock()
+	for _, err := range tn.errs {
+		t.Error(err)
+	}
+}
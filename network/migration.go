@@ -0,0 +1,342 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// how often the leases are checked for the end of a migration; replaced in tests
+var migrationCheckInterval = 10 * time.Second
+
+// migration runs the backend the network is migrating from alongside the
+// one it is configured with, until all nodes run the latter. The two share
+// the node's lease, which advertises the data of both (LeaseAttrs.Backends)
+// and keeps the old BackendType for the nodes that run the old backend
+// only. Each backend sees the leases of the nodes running one of its type,
+// so traffic to a node that has not migrated yet keeps taking the old path.
+type migration struct {
+	subnet.Manager
+	from, to string
+
+	// the backend migrated from, with its own node manager
+	// (the visibility of leases is tracked per watch)
+	fromBe backend.Backend
+	fromSM *nodeManager
+
+	mux sync.Mutex
+	// the backend data advertised for each type
+	data map[string]json.RawMessage
+	// the attributes last sent for the lease, nil until acquired
+	attrs *subnet.LeaseAttrs
+	sn    ip.IP4Net
+	// set once the old backend is no longer advertised
+	done bool
+	// the backend whose routes to peers get an explicit MTU, "" if none
+	mtuBt   string
+	mtuLink int
+	mtuMax  int
+}
+
+func newMigration(sm subnet.Manager, from, to string) *migration {
+	return &migration{
+		Manager: sm,
+		from:    from,
+		to:      to,
+		data:    make(map[string]json.RawMessage),
+	}
+}
+
+func migrationStatus(ctx context.Context, sm subnet.Manager, network, bt string) (*subnet.MigrationStatus, error) {
+	wr, err := sm.WatchLeases(ctx, network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return subnet.Migration(wr.Snapshot, bt), nil
+}
+
+// merge returns attrs with the backend data of all the node's backends,
+// m.mux must be held
+func (m *migration) merge(attrs *subnet.LeaseAttrs) *subnet.LeaseAttrs {
+	merged := *attrs
+	if m.done {
+		merged.BackendType, merged.BackendData, merged.Backends = m.to, m.data[m.to], nil
+		return &merged
+	}
+
+	merged.BackendType, merged.BackendData = m.from, m.data[m.from]
+	merged.Backends = make(map[string]json.RawMessage)
+	for bt, data := range m.data {
+		merged.Backends[bt] = data
+	}
+	return &merged
+}
+
+// mtu returns the MTU to advertise while both backends run, given what
+// they were initialized with. Unless perPeer, it is the smaller of the
+// two. Otherwise it is the larger one and the routes to the peers reached
+// over the backend with the higher overhead get that backend's MTU.
+func (m *migration) mtu(to, from *backend.SubnetDef, perPeer bool) int {
+	lo, loBt, hi := from, m.from, to
+	if to.MTU < from.MTU {
+		lo, loBt, hi = to, m.to, from
+	}
+
+	if !perPeer || lo.MTU == hi.MTU {
+		return lo.MTU
+	}
+	if lo.LinkIndex == 0 {
+		log.Warningf("The %v backend routes to peers itself, advertising its MTU of %v", loBt, lo.MTU)
+		return lo.MTU
+	}
+
+	m.mux.Lock()
+	m.mtuBt, m.mtuLink, m.mtuMax = loBt, lo.LinkIndex, lo.MTU
+	m.mux.Unlock()
+
+	log.Infof("Advertising an MTU of %v, routes to peers over the %v backend get %v", hi.MTU, loBt, lo.MTU)
+	return hi.MTU
+}
+
+// routeChanged adds or removes the route with an explicit MTU for a route
+// that the backend of type bt changed, if its routes get one
+func (m *migration) routeChanged(bt string, c backend.RouteChange) {
+	m.mux.Lock()
+	if bt != m.mtuBt {
+		m.mux.Unlock()
+		return
+	}
+	r := mtuRoute{dst: c.Subnet, linkIndex: m.mtuLink, mtu: m.mtuMax}
+	m.mux.Unlock()
+
+	switch c.Action {
+	case backend.RouteAdded:
+		if err := mtuRouteAdd(r); err != nil {
+			log.Errorf("Failed to add route to %v with MTU %v: %v", r.dst, r.mtu, err)
+		}
+	case backend.RouteRemoved:
+		if err := mtuRouteDel(r); err != nil {
+			log.Warningf("Failed to delete route to %v with MTU %v: %v", r.dst, r.mtu, err)
+		}
+	}
+}
+
+// view returns the manager for the backend of type bt
+func (m *migration) view(bt string) *migrationView {
+	return &migrationView{
+		Manager: m.Manager,
+		m:       m,
+		bt:      bt,
+		visible: make(map[ip.IP4Net]subnet.Lease),
+	}
+}
+
+// run runs the old backend until all the leases advertise the new one
+// (or ctx is done)
+func (m *migration) run(ctx context.Context, network string) {
+	stopped := make(chan struct{})
+	go func() {
+		m.fromBe.Run()
+		close(stopped)
+	}()
+
+	defer func() {
+		m.fromBe.Stop()
+		<-stopped
+	}()
+
+	pending := -1
+	seen := false
+	for {
+		select {
+		case <-time.After(migrationCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		status, err := migrationStatus(ctx, m.Manager, network, m.to)
+		switch {
+		case err != nil:
+			log.Errorf("Failed to check the migration of network %v: %v", network, err)
+			continue
+		case !status.Complete:
+			if len(status.Pending) != pending {
+				pending = len(status.Pending)
+				log.Infof("Waiting for %v node(s) to run the %v backend", pending, m.to)
+			}
+			seen = false
+			continue
+		case !seen:
+			// the new backend gets another interval to pick up the
+			// leases that completed the migration
+			seen = true
+			continue
+		}
+
+		log.Infof("All nodes run the %v backend, stopping the %v backend", m.to, m.from)
+		m.complete(ctx, network)
+		return
+	}
+}
+
+// complete switches the lease over to the new backend, retrying
+// until it succeeds or ctx is done
+func (m *migration) complete(ctx context.Context, network string) {
+	m.mux.Lock()
+	m.done = true
+	attrs := m.merge(m.attrs)
+	m.mux.Unlock()
+
+	for {
+		_, err := m.Manager.UpdateLeaseAttrs(ctx, network, m.sn, attrs)
+		if err == nil {
+			log.Infof("Lease %v is advertised with the %v backend only", m.sn, m.to)
+			return
+		}
+		log.Errorf("Failed to advertise lease %v with the %v backend only (retrying): %v", m.sn, m.to, err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// migrationView is the subnet.Manager of one of the backends of a
+// migration. It is watched by that backend only.
+type migrationView struct {
+	subnet.Manager
+	m  *migration
+	bt string
+
+	// the leases passed on, as they were
+	visible map[ip.IP4Net]subnet.Lease
+}
+
+// backendLease returns l as seen by the backend, ok is false if its
+// node does not run a backend of the same type
+func (v *migrationView) backendLease(l subnet.Lease) (subnet.Lease, bool) {
+	attrs, ok := l.Attrs.ForBackend(v.bt)
+	if !ok && v.bt == v.m.from && attrs != nil && attrs.BackendType == "" {
+		// untyped leases (e.g. of udp) are those of nodes not migrating yet
+		ok = true
+	}
+	l.Attrs = attrs
+	return l, ok
+}
+
+func (v *migrationView) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	v.m.mux.Lock()
+	defer v.m.mux.Unlock()
+
+	v.m.data[v.bt] = attrs.BackendData
+	merged := v.m.merge(attrs)
+
+	// the node's existing lease is picked up again, by its PublicIP
+	l, err := v.Manager.AcquireLease(ctx, network, merged)
+	if err != nil {
+		return nil, err
+	}
+	if v.m.attrs != nil && !l.Subnet.Equal(v.m.sn) {
+		return nil, fmt.Errorf("acquired %v while the node holds %v", l.Subnet, v.m.sn)
+	}
+	v.m.attrs, v.m.sn = l.Attrs, l.Subnet
+
+	bl, _ := v.backendLease(*l)
+	return &bl, nil
+}
+
+func (v *migrationView) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	v.m.mux.Lock()
+	l := *lease
+	l.Attrs = v.m.merge(lease.Attrs)
+	v.m.attrs = l.Attrs
+	v.m.mux.Unlock()
+
+	err := v.Manager.RenewLease(ctx, network, &l)
+	lease.Expiration = l.Expiration
+	return err
+}
+
+func (v *migrationView) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	v.m.mux.Lock()
+	merged := v.m.merge(attrs)
+	v.m.attrs = merged
+	v.m.mux.Unlock()
+
+	l, err := v.Manager.UpdateLeaseAttrs(ctx, network, sn, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	bl, _ := v.backendLease(*l)
+	return &bl, nil
+}
+
+// RouteChanged passes c on, the routes are those of the node either way
+func (v *migrationView) RouteChanged(c backend.RouteChange) {
+	v.m.routeChanged(v.bt, c)
+	backend.NotifyRouteChange(v.Manager, c)
+}
+
+func (v *migrationView) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	wr, err := v.Manager.WatchLeases(ctx, network, cursor)
+	if err != nil {
+		return wr, err
+	}
+
+	if wr.Snapshot != nil {
+		v.visible = make(map[ip.IP4Net]subnet.Lease)
+		snapshot := []subnet.Lease{}
+		for _, l := range wr.Snapshot {
+			if bl, ok := v.backendLease(l); ok {
+				v.visible[l.Subnet] = bl
+				snapshot = append(snapshot, bl)
+			}
+		}
+		wr.Snapshot = snapshot
+		return wr, nil
+	}
+
+	events := []subnet.Event{}
+	for _, e := range wr.Events {
+		prev, visible := v.visible[e.Lease.Subnet]
+		if e.Type == subnet.SubnetAdded {
+			if bl, ok := v.backendLease(e.Lease); ok {
+				v.visible[e.Lease.Subnet] = bl
+				events = append(events, subnet.Event{Type: subnet.SubnetAdded, Lease: bl})
+				continue
+			}
+		}
+
+		if visible {
+			// removed or no longer running a backend of the type
+			delete(v.visible, e.Lease.Subnet)
+			events = append(events, subnet.Event{Type: subnet.SubnetRemoved, Lease: prev, Reason: e.Reason})
+		}
+	}
+	wr.Events = events
+	return wr, nil
+}
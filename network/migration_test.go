@@ -0,0 +1,499 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// clusterManager keeps the leases of the nodes of a test cluster, every
+// watch gets a fresh snapshot after each change
+type clusterManager struct {
+	subnet.Manager
+
+	mux     sync.Mutex
+	config  *subnet.Config
+	leases  []subnet.Lease
+	version int
+	changed chan struct{}
+}
+
+func newClusterManager(t *testing.T, be string) *clusterManager {
+	return &clusterManager{
+		config:  backendConfig(t, be),
+		changed: make(chan struct{}),
+	}
+}
+
+func (m *clusterManager) setConfig(t *testing.T, be string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.config = backendConfig(t, be)
+}
+
+func (m *clusterManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.config, nil
+}
+
+// store must be called with m.mux held
+func (m *clusterManager) store(sn ip.IP4Net, attrs *subnet.LeaseAttrs) *subnet.Lease {
+	a := *attrs
+	l := subnet.Lease{Subnet: sn, Attrs: &a, Expiration: time.Now().Add(time.Hour)}
+
+	found := false
+	for i := range m.leases {
+		if m.leases[i].Subnet.Equal(sn) {
+			m.leases[i] = l
+			found = true
+		}
+	}
+	if !found {
+		m.leases = append(m.leases, l)
+	}
+
+	m.version++
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return &l
+}
+
+func (m *clusterManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	sn := ip.IP4Net{IP: m.config.Network.IP + ip.IP4((len(m.leases)+1)<<8), PrefixLen: 24}
+	for _, l := range m.leases {
+		if l.Attrs.PublicIP == attrs.PublicIP {
+			sn = l.Subnet
+		}
+	}
+	return m.store(sn, attrs), nil
+}
+
+func (m *clusterManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	lease.Expiration = m.store(lease.Subnet, lease.Attrs).Expiration
+	return nil
+}
+
+func (m *clusterManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.store(sn, attrs), nil
+}
+
+func (m *clusterManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	m.mux.Lock()
+	if cursor != nil && cursor.(int) == m.version {
+		changed := m.changed
+		m.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return subnet.WatchResult{}, ctx.Err()
+		}
+		m.mux.Lock()
+	}
+	defer m.mux.Unlock()
+
+	snapshot := make([]subnet.Lease, len(m.leases))
+	copy(snapshot, m.leases)
+	return subnet.WatchResult{Snapshot: snapshot, Cursor: m.version}, nil
+}
+
+func (m *clusterManager) lease(sn ip.IP4Net) subnet.Lease {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, l := range m.leases {
+		if l.Subnet.Equal(sn) {
+			return l
+		}
+	}
+	return subnet.Lease{}
+}
+
+// testNode runs a Network with fake backends that keep track of the
+// subnets they route to
+type testNode struct {
+	name string
+	ip   net.IP
+	sn   ip.IP4Net
+
+	cancel func()
+	done   chan struct{}
+
+	mux      sync.Mutex
+	backends map[string]*fakeBackend
+	stopping bool
+	// complaints about routes lost or leases of the wrong type
+	errs []string
+}
+
+func (tn *testNode) complain(format string, args ...interface{}) {
+	tn.errs = append(tn.errs, tn.name+": "+fmt.Sprintf(format, args...))
+}
+
+// reaches reports whether a running backend routes to sn, tn.mux must be held
+func (tn *testNode) reaches(sn ip.IP4Net) bool {
+	for _, b := range tn.backends {
+		if b.running && b.routes[sn] {
+			return true
+		}
+	}
+	return false
+}
+
+func (tn *testNode) routes(bt string) map[ip.IP4Net]bool {
+	tn.mux.Lock()
+	defer tn.mux.Unlock()
+
+	routes := make(map[ip.IP4Net]bool)
+	if b := tn.backends[bt]; b != nil && b.running {
+		for sn := range b.routes {
+			routes[sn] = true
+		}
+	}
+	return routes
+}
+
+func (tn *testNode) stop() {
+	tn.mux.Lock()
+	tn.stopping = true
+	tn.mux.Unlock()
+
+	tn.cancel()
+	<-tn.done
+}
+
+type fakeBackend struct {
+	node    *testNode
+	sm      subnet.Manager
+	network string
+	bt      string
+
+	ctx    context.Context
+	cancel func()
+	extIP  net.IP
+	lease  *subnet.Lease
+
+	running bool
+	routes  map[ip.IP4Net]bool
+}
+
+func (b *fakeBackend) Init(extIface *net.Interface, extIP net.IP) (*backend.SubnetDef, error) {
+	b.extIP = extIP
+	attrs := subnet.LeaseAttrs{PublicIP: ip.FromIP(extIP)}
+	// like those of the real udp backend, udp leases are untyped
+	if b.bt != "udp" {
+		attrs.BackendType = b.bt
+		attrs.BackendData = json.RawMessage(fmt.Sprintf(`{"Node":%q}`, b.node.name))
+	}
+
+	l, err := b.sm.AcquireLease(b.ctx, b.network, &attrs)
+	if err != nil {
+		return nil, err
+	}
+	b.lease = l
+	return &backend.SubnetDef{Net: l.Subnet, MTU: 1450}, nil
+}
+
+func (b *fakeBackend) Run() {
+	b.node.mux.Lock()
+	b.running = true
+	b.node.mux.Unlock()
+
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(b.ctx, b.sm, b.network, evts)
+
+	for {
+		select {
+		case batch := <-evts:
+			b.handle(batch)
+
+		case <-b.ctx.Done():
+			b.node.mux.Lock()
+			defer b.node.mux.Unlock()
+
+			b.running = false
+			for sn := range b.routes {
+				if !b.node.stopping && !b.node.reaches(sn) {
+					b.node.complain("lost the route to %v with the %v backend", sn, b.bt)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (b *fakeBackend) handle(batch []subnet.Event) {
+	b.node.mux.Lock()
+	defer b.node.mux.Unlock()
+
+	for _, e := range batch {
+		sn := e.Lease.Subnet
+		if sn.Equal(b.lease.Subnet) {
+			continue
+		}
+		if b.bt != "udp" && (e.Lease.Attrs.BackendType != b.bt || len(e.Lease.Attrs.BackendData) == 0) {
+			b.node.complain("the %v backend got a lease of type %q", b.bt, e.Lease.Attrs.BackendType)
+			continue
+		}
+
+		switch e.Type {
+		case subnet.SubnetAdded:
+			b.routes[sn] = true
+		case subnet.SubnetRemoved:
+			delete(b.routes, sn)
+			if !b.node.reaches(sn) {
+				b.node.complain("lost the route to %v with the %v backend", sn, b.bt)
+			}
+		}
+	}
+}
+
+func (b *fakeBackend) Stop() {
+	b.cancel()
+}
+
+func (b *fakeBackend) Name() string {
+	return b.bt
+}
+
+func withFakeBackends(starting **testNode) func() {
+	orig := newBackend
+	newBackend = func(sm subnet.Manager, network string, bt string, config *subnet.Config) (backend.Backend, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		b := &fakeBackend{
+			node:    *starting,
+			sm:      sm,
+			network: network,
+			bt:      bt,
+			ctx:     ctx,
+			cancel:  cancel,
+			routes:  make(map[ip.IP4Net]bool),
+		}
+		(*starting).backends[bt] = b
+		return b, nil
+	}
+	return func() { newBackend = orig }
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
+
+const (
+	udpBackend       = `{ "Type": "udp" }`
+	migratingBackend = `{ "Type": "vxlan", "MigrateFrom": { "Type": "udp" } }`
+)
+
+func TestStagedMigration(t *testing.T) {
+	defer withMissingCapabilities()()
+
+	interval := migrationCheckInterval
+	migrationCheckInterval = 20 * time.Millisecond
+	defer func() { migrationCheckInterval = interval }()
+
+	var starting *testNode
+	defer withFakeBackends(&starting)()
+
+	cm := newClusterManager(t, udpBackend)
+	nodes := make([]*testNode, 3)
+
+	start := func(i int) {
+		tn := &testNode{
+			name:     fmt.Sprintf("node%v", i),
+			ip:       net.IPv4(192, 168, 0, byte(i+1)),
+			done:     make(chan struct{}),
+			backends: make(map[string]*fakeBackend),
+		}
+		if old := nodes[i]; old != nil {
+			tn.errs = old.errs
+		}
+		nodes[i] = tn
+		starting = tn
+
+		ctx, cancel := context.WithCancel(context.Background())
+		tn.cancel = cancel
+
+		n := New(cm, "", Options{})
+		sn := n.Init(ctx, &net.Interface{MTU: 1500}, tn.ip)
+		if sn == nil {
+			t.Fatalf("Failed to initialize %v", tn.name)
+		}
+		tn.sn = sn.Net
+
+		go func() {
+			n.Run(ctx)
+			close(tn.done)
+		}()
+	}
+
+	// whether node i routes to all the others with backend bt
+	meshed := func(i int, bt string) bool {
+		routes := nodes[i].routes(bt)
+		for j, other := range nodes {
+			if j != i && !routes[other.sn] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := range nodes {
+		start(i)
+	}
+	for i := range nodes {
+		waitFor(t, fmt.Sprintf("udp routes of node%v", i), func() bool { return meshed(i, "udp") })
+	}
+
+	cm.setConfig(t, migratingBackend)
+
+	// first node: runs vxlan next to udp, without peers to use it with
+	nodes[0].stop()
+	start(0)
+	waitFor(t, "node0 to advertise both backends", func() bool {
+		attrs := cm.lease(nodes[0].sn).Attrs
+		_, udp := attrs.Backends["udp"]
+		_, vxlan := attrs.Backends["vxlan"]
+		return attrs.BackendType == "udp" && udp && vxlan
+	})
+	waitFor(t, "udp routes of node0", func() bool { return meshed(0, "udp") })
+	if routes := nodes[0].routes("vxlan"); len(routes) > 0 {
+		t.Errorf("node0 routes to %v with vxlan before any peer runs it", routes)
+	}
+
+	// second node: the two migrated nodes switch to vxlan between them
+	nodes[1].stop()
+	start(1)
+	waitFor(t, "vxlan routes between node0 and node1", func() bool {
+		return nodes[0].routes("vxlan")[nodes[1].sn] && nodes[1].routes("vxlan")[nodes[0].sn]
+	})
+	for i := range nodes {
+		if !meshed(i, "udp") {
+			t.Errorf("node%v lost udp routes during the migration", i)
+		}
+	}
+
+	// last node: all of them stop their udp backends
+	time.Sleep(5 * migrationCheckInterval)
+	if !nodes[0].routes("udp")[nodes[2].sn] {
+		t.Fatalf("udp backend of node0 stopped before all nodes migrated")
+	}
+	nodes[2].stop()
+	start(2)
+	for i, tn := range nodes {
+		waitFor(t, fmt.Sprintf("node%v to complete the migration", i), func() bool {
+			attrs := cm.lease(tn.sn).Attrs
+			return attrs.BackendType == "vxlan" && attrs.Backends == nil && meshed(i, "vxlan") && len(tn.routes("udp")) == 0
+		})
+	}
+
+	for _, tn := range nodes {
+		tn.stop()
+		for _, err := range tn.errs {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPerPeerMTU(t *testing.T) {
+	routes := make(map[ip.IP4Net]mtuRoute)
+	mtuRouteAdd = func(r mtuRoute) error {
+		routes[r.dst] = r
+		return nil
+	}
+	mtuRouteDel = func(r mtuRoute) error {
+		delete(routes, r.dst)
+		return nil
+	}
+	defer func() {
+		mtuRouteAdd = doMTURouteAdd
+		mtuRouteDel = doMTURouteDel
+	}()
+
+	udp := &backend.SubnetDef{MTU: 1472, LinkIndex: 4}
+	vxlan := &backend.SubnetDef{MTU: 1450, LinkIndex: 5}
+
+	if mtu := newMigration(nil, "udp", "vxlan").mtu(vxlan, udp, false); mtu != 1450 {
+		t.Errorf("expected the smaller MTU of 1450 to be advertised, got %v", mtu)
+	}
+
+	m := newMigration(nil, "udp", "vxlan")
+	if mtu := m.mtu(vxlan, udp, true); mtu != 1472 {
+		t.Errorf("expected the larger MTU of 1472 to be advertised, got %v", mtu)
+	}
+
+	sn := func(s string) ip.IP4Net {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip.FromIPNet(n)
+	}
+	change := func(bt, action, s string) {
+		m.view(bt).RouteChanged(backend.RouteChange{Subnet: sn(s), Action: action})
+	}
+
+	// two peers run udp only, two run vxlan too
+	change("udp", backend.RouteAdded, "10.3.1.0/24")
+	change("udp", backend.RouteAdded, "10.3.2.0/24")
+	change("vxlan", backend.RouteAdded, "10.3.3.0/24")
+	change("vxlan", backend.RouteAdded, "10.3.4.0/24")
+
+	expected := map[ip.IP4Net]mtuRoute{
+		sn("10.3.3.0/24"): {dst: sn("10.3.3.0/24"), linkIndex: 5, mtu: 1450},
+		sn("10.3.4.0/24"): {dst: sn("10.3.4.0/24"), linkIndex: 5, mtu: 1450},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected routes with an MTU to the vxlan peers only: %v, got %v", expected, routes)
+	}
+
+	change("vxlan", backend.RouteRemoved, "10.3.4.0/24")
+	change("udp", backend.RouteRemoved, "10.3.1.0/24")
+	if _, ok := routes[sn("10.3.4.0/24")]; ok || len(routes) != 1 {
+		t.Errorf("expected the route to the removed vxlan peer to be gone, got %v", routes)
+	}
+
+	// without a device of its own to route over, the smaller MTU is advertised
+	m = newMigration(nil, "host-gw", "fake")
+	hostgw := &backend.SubnetDef{MTU: 1500}
+	if mtu := m.mtu(&backend.SubnetDef{MTU: 1400}, hostgw, true); mtu != 1400 {
+		t.Errorf("expected the smaller MTU of 1400 for a backend without a device, got %v", mtu)
+	}
+	change("fake", backend.RouteAdded, "10.3.5.0/24")
+	if _, ok := routes[sn("10.3.5.0/24")]; ok {
+		t.Errorf("added a route with an MTU for a backend without a device")
+	}
+}
@@ -15,6 +15,7 @@
 package network
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -22,41 +23,206 @@ import (
 	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
 
+// Options holds the node wide settings applied to every network
+type Options struct {
+	IPMasq bool
+
+	// IPTablesTag makes the iptables rules added for the network
+	// carry an IPTablesTag comment, see CleanupIPTables
+	IPTablesTag bool
+
+	// SubnetBlocks is the number of contiguous SubnetLen sized
+	// blocks to lease for this node (0 or 1 for a single block)
+	SubnetBlocks uint
+
+	// PublicIP, if set, is advertised in the leases of this node in
+	// place of the address the backends bind to, for nodes behind NAT
+	PublicIP ip.IP4
+
+	// PublicIPHost, if set, is the DNS name PublicIP was resolved from.
+	// It is resolved again every ResolveInterval and the leases of this
+	// node are updated when it resolves to another IP.
+	PublicIPHost    string
+	ResolveInterval time.Duration
+
+	// PublicIPs are advertised in the leases for backends
+	// that can balance traffic over several uplinks
+	PublicIPs []subnet.WeightedIP
+
+	// PublicIPv6, if set, is advertised in the leases of this node
+	// as its IPv6 tunnel endpoint
+	PublicIPv6 net.IP
+
+	// Zone is advertised in the leases of this node
+	Zone string
+
+	// Tenant is advertised in the leases of this node
+	Tenant string
+
+	// Version and Features, if set, are advertised in the leases
+	// of this node
+	Version  string
+	Features []string
+
+	// Hostname is advertised in the leases of this node so that
+	// it gets its lease back even if its PublicIP changes
+	Hostname string
+
+	// PublicHostname is advertised in the leases of this node for
+	// peers to resolve instead of using PublicIP, which it should
+	// resolve to when the lease is acquired
+	PublicHostname string
+
+	// RouteFilter, if set, limits the remote leases
+	// that backends program routes for
+	RouteFilter *RouteFilter
+
+	// Resolver, if set, resolves the PublicHostname of remote leases
+	// to the IP routes are programmed to
+	Resolver *Resolver
+
+	// RouteHook, if set, is told about the routes to peers that
+	// backends add and remove
+	RouteHook *RouteHook
+
+	// PerPeerMTU, while migrating between backends, advertises the
+	// larger of their MTUs and gives the routes to the peers reached
+	// over the other one its MTU, instead of advertising the smaller
+	PerPeerMTU bool
+
+	// CoalesceWindow is how long lease events are buffered and
+	// merged before backends apply them (0 applies them right away)
+	CoalesceWindow time.Duration
+
+	// DrainFor, if set, hands the leases of the node over to the node
+	// of this name on shutdown: they are revoked with their subnets
+	// reserved for DrainFor for DrainGrace
+	DrainFor   string
+	DrainGrace time.Duration
+
+	// ConfigRetryTimeout bounds how long retrieving the network
+	// config is retried before giving up (0 retries forever)
+	ConfigRetryTimeout time.Duration
+
+	// ConfigRetryInitial and ConfigRetryMax bound the backoff between
+	// attempts to retrieve the network config (1s and 30s if 0)
+	ConfigRetryInitial time.Duration
+	ConfigRetryMax     time.Duration
+
+	// ConfigWaitTimeout is how long to wait for the network config to
+	// be written if there is none yet, 0 gives up right away
+	ConfigWaitTimeout time.Duration
+
+	// SubnetConflict is the policy (ConflictWarn, ConflictFail or
+	// ConflictReacquire) for leases overlapping a network of the
+	// host, "" skips the check
+	SubnetConflict string
+
+	// ConfigCacheDir is where the last retrieved network configs are
+	// kept to start from when the config can't be retrieved ("" disables)
+	ConfigCacheDir string
+
+	// MaxRoutes caps the peer leases passed on to the backends, and so
+	// the routes installed, as a guard against runaway lease counts.
+	// Leases past it are held back until there is room (0 for no cap).
+	MaxRoutes int
+
+	// WatchBuffer is how many lease events are queued for a backend
+	// that is slow to apply them (0 for none). Once the queue is full,
+	// the watch waits for the backend or, with WatchOverflow set to
+	// subnet.OverflowResync, the queue is dropped and the backend is
+	// brought up to date from a snapshot of the leases.
+	WatchBuffer   int
+	WatchOverflow string
+
+	// ExternalLink leaves setting the devices of the backends up to
+	// another component, backends wait for it before routing to them
+	ExternalLink bool
+
+	// VerifyRoutes has the backends read each route (or FDB entry)
+	// back after installing it
+	VerifyRoutes bool
+
+	// Bridge, if set, is the bridge the containers of the host are on.
+	// It is given the first address of the lease in place of any other
+	// and routes to peers are sent from that address where the backend
+	// supports it.
+	Bridge string
+}
+
+const drainTimeout = 10 * time.Second
+
 type Network struct {
 	Name string
 
-	sm     subnet.Manager
+	sm     *nodeManager
 	ipMasq bool
+	opts   Options
 	be     backend.Backend
+	ready  backend.ReadyFlag
+	// set while migrating from another backend type
+	mig *migration
 }
 
-func New(sm subnet.Manager, name string, ipMasq bool) *Network {
+func New(sm subnet.Manager, name string, opts Options) *Network {
 	return &Network{
 		Name:   name,
-		sm:     sm,
-		ipMasq: ipMasq,
+		sm:     newNodeManager(sm, opts),
+		ipMasq: opts.IPMasq,
+		opts:   opts,
 	}
 }
 
+// prepareBackend passes the options that backends implement optionally
+// on to be, before its Init
+func (n *Network) prepareBackend(be backend.Backend) {
+	if el, ok := be.(backend.ExternalLinker); ok && n.opts.ExternalLink {
+		el.SetExternalLink()
+	}
+	if rv, ok := be.(backend.RouteVerifier); ok && n.opts.VerifyRoutes {
+		rv.SetVerifyRoutes()
+	}
+}
+
+// Init sets up the backend of the network. It can be called again once
+// Run returned, to start over with a new lease.
 func (n *Network) Init(ctx context.Context, iface *net.Interface, ipaddr net.IP) *backend.SubnetDef {
-	var cfg *subnet.Config
 	var be backend.Backend
-	var sn *backend.SubnetDef
+	var sn, fromSn *backend.SubnetDef
+
+	// those of an earlier run
+	n.sm.forgetOwn(n.Name)
+
+	cfg, err := n.getConfig(ctx)
+	if err != nil {
+		if err != context.Canceled {
+			log.Errorf("Failed to retrieve config of network %q: %v", n.Name, err)
+		}
+		return nil
+	}
+
+	if n.ipMasq {
+		if err := backend.Require("IP masquerading", IPMasqCapabilities()); err != nil {
+			log.Errorf("Failed to initialize network %v: %v", n.Name, err)
+			return nil
+		}
+	}
 
 	steps := []func() error{
 		func() (err error) {
-			cfg, err = n.sm.GetNetworkConfig(ctx, n.Name)
+			n.mig, err = n.setupMigration(ctx, cfg)
 			if err != nil {
-				log.Error("Failed to retrieve network config: ", err)
+				log.Errorf("Failed to set up the migration of network %v: %v", n.Name, err)
 			}
 			return
 		},
 
 		func() (err error) {
-			be, err = newBackend(n.sm, n.Name, cfg)
+			be, err = newProbedBackend(n.sm, n.Name, cfg)
 			if err != nil {
 				log.Error("Failed to create backend: ", err)
 			} else {
@@ -66,9 +232,38 @@ func (n *Network) Init(ctx context.Context, iface *net.Interface, ipaddr net.IP)
 		},
 
 		func() (err error) {
+			// the old backend holds the lease until the new one joins it
+			if n.mig != nil {
+				n.prepareBackend(n.mig.fromBe)
+				fromSn, err = n.mig.fromBe.Init(iface, ipaddr)
+				if err != nil {
+					log.Errorf("Failed to initialize network %v (type %v): %v", n.Name, n.mig.fromBe.Name(), err)
+				}
+			}
+			return
+		},
+
+		func() (err error) {
+			n.prepareBackend(be)
 			sn, err = be.Init(iface, ipaddr)
 			if err != nil {
 				log.Errorf("Failed to initialize network %v (type %v): %v", n.Name, be.Name(), err)
+				return
+			}
+			sn.Gateway = cfg.Gateway(sn.Net)
+			if fromSn != nil {
+				// traffic takes either backend until the migration is complete
+				sn.MTU = n.mig.mtu(sn, fromSn, n.opts.PerPeerMTU)
+			}
+			return
+		},
+
+		func() (err error) {
+			if n.opts.Bridge == "" {
+				return nil
+			}
+			if err = n.setupBridge(sn); err != nil {
+				log.Errorf("Failed to set up bridge %v for network %v: %v", n.opts.Bridge, n.Name, err)
 			}
 			return
 		},
@@ -76,7 +271,11 @@ func (n *Network) Init(ctx context.Context, iface *net.Interface, ipaddr net.IP)
 		func() (err error) {
 			if n.ipMasq {
 				flannelNet := cfg.Network
-				if err = setupIPMasq(flannelNet); err != nil {
+				tag := ""
+				if n.opts.IPTablesTag {
+					tag = IPTablesTag(n.Name)
+				}
+				if err = setupIPMasq(flannelNet, tag); err != nil {
 					log.Errorf("Failed to set up IP Masquerade for network %v: %v", n.Name, err)
 				}
 			}
@@ -96,12 +295,63 @@ func (n *Network) Init(ctx context.Context, iface *net.Interface, ipaddr net.IP)
 			if err == nil {
 				break
 			}
+			if _, ok := err.(*backend.CapabilityError); ok {
+				// retrying won't make the host grow the missing bits
+				return nil
+			}
+			if n.sm.failed() != nil {
+				return nil
+			}
 		}
 	}
 
 	return sn
 }
 
+// setupMigration creates the backend the network is migrating from, if
+// the config says so and not all nodes run the new backend already
+func (n *Network) setupMigration(ctx context.Context, config *subnet.Config) (*migration, error) {
+	bt, err := parseBackendType(config)
+	if err != nil || len(bt.MigrateFrom) == 0 {
+		return nil, err
+	}
+
+	fromConfig := *config
+	fromConfig.Backend = bt.MigrateFrom
+	from, err := parseBackendType(&fromConfig)
+	if err != nil {
+		return nil, err
+	}
+	if from.Type == bt.Type {
+		return nil, fmt.Errorf("MigrateFrom is of the same backend type (%v)", bt.Type)
+	}
+
+	if err := probeBackend(bt.Type); err != nil {
+		// not migrating, the new backend (or its fallback) is dealt with as usual
+		log.Warningf("Not migrating network %v: %v", n.Name, err)
+		return nil, nil
+	}
+
+	status, err := migrationStatus(ctx, n.sm.Manager, n.Name, bt.Type)
+	if err != nil {
+		return nil, err
+	}
+	if status.Complete {
+		log.Infof("All nodes of network %v run the %v backend, not running the %v backend", n.Name, bt.Type, from.Type)
+		return nil, nil
+	}
+
+	m := newMigration(n.sm.Manager, from.Type, bt.Type)
+	m.fromSM = newNodeManager(m.view(from.Type), n.opts)
+	if m.fromBe, err = newBackend(m.fromSM, n.Name, from.Type, &fromConfig); err != nil {
+		return nil, err
+	}
+	n.sm.Manager = m.view(bt.Type)
+
+	log.Infof("Migrating network %v from the %v to the %v backend (%v node(s) to go)", n.Name, from.Type, bt.Type, len(status.Pending))
+	return m, nil
+}
+
 func (n *Network) Run(ctx context.Context) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -110,8 +360,140 @@ func (n *Network) Run(ctx context.Context) {
 		wg.Done()
 	}()
 
+	backends := []backend.Backend{n.be}
+	if n.mig != nil {
+		backends = append(backends, n.mig.fromBe)
+
+		wg.Add(1)
+		go func() {
+			n.mig.run(ctx, n.Name)
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		for _, be := range backends {
+			if r, ok := be.(backend.Readier); ok {
+				select {
+				case <-r.Ready():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		log.Infof("Network %q is ready", n.Name)
+		n.ready.SetReady()
+		n.sm.markReady(ctx, n.Name)
+		if n.mig != nil {
+			n.mig.fromSM.markReady(ctx, n.Name)
+		}
+	}()
+
+	if n.opts.PublicIPHost != "" {
+		go n.sm.followPublicIP(ctx, n.Name)
+		if n.mig != nil {
+			go n.mig.fromSM.followPublicIP(ctx, n.Name)
+		}
+	}
+
 	<-ctx.Done()
 	n.be.Stop()
 
 	wg.Wait()
+
+	if n.opts.DrainFor != "" {
+		n.drain()
+	}
+}
+
+// drain revokes the leases held by the node, reserving them for the
+// replacement node. Peers drop their routes as the leases disappear.
+func (n *Network) drain() {
+	// ctx of Run is done by now
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	// a lease that expired meanwhile may belong to another node by now
+	wr, err := n.sm.Manager.WatchLeases(ctx, n.Name, nil)
+	if err != nil {
+		log.Errorf("Failed to retrieve leases of network %q, not handing them over: %v", n.Name, err)
+		return
+	}
+	held := make(map[ip.IP4Net]bool)
+	for _, l := range wr.Snapshot {
+		held[l.Subnet] = l.Attrs.Hostname == n.opts.Hostname
+	}
+
+	r := &subnet.Reservation{Hostname: n.opts.DrainFor, TTL: n.opts.DrainGrace}
+	for _, sn := range n.sm.ownLeases() {
+		if !held[sn] {
+			log.Warningf("Lease %v is no longer held by this node, not handing it over", sn)
+			continue
+		}
+		if err := n.sm.DrainLease(ctx, n.Name, sn, r); err != nil {
+			log.Errorf("Failed to hand over lease %v to %v: %v", sn, r.Hostname, err)
+			continue
+		}
+		log.Infof("Lease %v handed over to %v", sn, r.Hostname)
+	}
+}
+
+// Ready returns a channel that is closed once the backend
+// has installed the routes to the existing leases
+func (n *Network) Ready() <-chan struct{} {
+	return n.ready.Ready()
+}
+
+// IsReady reports whether the network is ready
+func (n *Network) IsReady() bool {
+	return n.ready.IsReady()
+}
+
+// BackendHealth returns the health of the backends of the network that
+// report it, keyed by backend name. Only to be called once it is ready.
+func (n *Network) BackendHealth() map[string]error {
+	backends := []backend.Backend{n.be}
+	if n.mig != nil {
+		backends = append(backends, n.mig.fromBe)
+	}
+
+	health := make(map[string]error)
+	for _, be := range backends {
+		if r, ok := be.(backend.HealthReporter); ok {
+			health[be.Name()] = r.Health()
+		}
+	}
+	return health
+}
+
+// Health returns why the network is degraded apart from its backends
+// (e.g. leases are held back by MaxRoutes), nil if it is not
+func (n *Network) Health() error {
+	return n.sm.routeLimitErr(n.Name)
+}
+
+// RouteStates returns the state of the route to each peer subnet of the
+// network, one of the backend.Route* constants. Leases held back from the
+// backends have the reason they are; of a subnet routed by more than one
+// backend while migrating, installed wins. Only to be called once it is
+// ready.
+func (n *Network) RouteStates() map[ip.IP4Net]string {
+	backends := []backend.Backend{n.be}
+	if n.mig != nil {
+		backends = append(backends, n.mig.fromBe)
+	}
+
+	states := n.sm.skippedLeases(n.Name)
+	for _, be := range backends {
+		r, ok := be.(backend.RouteStateReporter)
+		if !ok {
+			continue
+		}
+		for sn, s := range r.RouteStates() {
+			if states[sn] != backend.RouteInstalled {
+				states[sn] = s
+			}
+		}
+	}
+	return states
 }
@@ -0,0 +1,580 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// nodeManager fills in the lease attributes that describe the node
+// rather than the backend, so that backends don't each have to.
+// It also hides the remote leases that don't pass the route filter, as
+// well as those of nodes that are not ready yet, from the backends' watches.
+type nodeManager struct {
+	subnet.Manager
+	opts Options
+
+	mux sync.Mutex
+	// own leases always pass the filter
+	own map[ip.IP4Net]*ownLease
+	// per network, the leases that were passed on
+	visible map[string]map[ip.IP4Net]bool
+	// per network, why the leases that were not are held back
+	skipped map[string]map[ip.IP4Net]string
+	// per network, the leases held back by the route limit
+	held map[string]map[ip.IP4Net]subnet.Lease
+	// per network, the claim with the highest epoch to each subnet
+	claims map[string]map[ip.IP4Net]subnet.Lease
+	// per network, the route filter and IPs the last watch result was
+	// made with, so that changes between watches are not missed
+	seen map[string]watchInputs
+	// set by an error that retrying can't fix
+	fatalErr error
+	// what Options.PublicIPHost last resolved to
+	publicIP ip.IP4
+}
+
+// watchInputs are closed when what a watch result was made with changes
+type watchInputs struct {
+	filter <-chan struct{}
+	ips    <-chan struct{}
+}
+
+type ownLease struct {
+	network string
+	attrs   subnet.LeaseAttrs
+	ready   bool
+}
+
+func newNodeManager(sm subnet.Manager, opts Options) *nodeManager {
+	return &nodeManager{
+		Manager:  sm,
+		opts:     opts,
+		own:      make(map[ip.IP4Net]*ownLease),
+		visible:  make(map[string]map[ip.IP4Net]bool),
+		skipped:  make(map[string]map[ip.IP4Net]string),
+		held:     make(map[string]map[ip.IP4Net]subnet.Lease),
+		claims:   make(map[string]map[ip.IP4Net]subnet.Lease),
+		seen:     make(map[string]watchInputs),
+		publicIP: opts.PublicIP,
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func (m *nodeManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if m.opts.SubnetBlocks > 1 {
+		attrs.SubnetBlocks = m.opts.SubnetBlocks
+	}
+	m.mux.Lock()
+	publicIP := m.publicIP
+	m.mux.Unlock()
+	if publicIP != 0 {
+		attrs.PublicIP = publicIP
+	}
+	if len(m.opts.PublicIPs) > 0 {
+		attrs.PublicIPs = m.opts.PublicIPs
+	}
+	if m.opts.PublicIPv6 != nil {
+		attrs.PublicIPv6 = m.opts.PublicIPv6
+	}
+	if m.opts.Zone != "" {
+		attrs.Zone = m.opts.Zone
+	}
+	if m.opts.Tenant != "" {
+		attrs.Tenant = m.opts.Tenant
+	}
+	if m.opts.Version != "" {
+		attrs.Version = m.opts.Version
+		attrs.Features = m.opts.Features
+	}
+	if m.opts.Hostname != "" {
+		attrs.Hostname = m.opts.Hostname
+	}
+	if m.opts.PublicHostname != "" {
+		attrs.PublicHostname = m.opts.PublicHostname
+	}
+	// until markReady is called
+	attrs.Ready = boolPtr(false)
+
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+	switch err {
+	case subnet.ErrDuplicatePublicIP:
+		// two nodes claiming the same address is a misconfiguration
+		return nil, m.fatal(fmt.Errorf("%v: %v", attrs.PublicIP, err))
+	case subnet.ErrBackendMismatch:
+		return nil, m.fatal(fmt.Errorf("%q: %v", attrs.BackendType, err))
+	}
+	if err == nil && m.opts.SubnetConflict != "" {
+		l, err = m.checkConflict(ctx, network, attrs, l)
+	}
+	if err == nil {
+		m.mux.Lock()
+		m.own[l.Subnet] = &ownLease{network: network, attrs: *l.Attrs}
+		m.mux.Unlock()
+	}
+	return l, err
+}
+
+// fatal records err as one that retrying can't fix and returns it
+func (m *nodeManager) fatal(err error) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.fatalErr = err
+	return err
+}
+
+func (m *nodeManager) failed() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.fatalErr
+}
+
+// RenewLease keeps the leases that were marked ready so, and the labels
+// and public IP they were given since they were acquired
+func (m *nodeManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	m.mux.Lock()
+	o := m.own[lease.Subnet]
+	var own ownLease
+	if o != nil {
+		own = *o
+	}
+	m.mux.Unlock()
+
+	if o == nil || (!own.ready || lease.Attrs.IsReady()) && sameLabels(&own.attrs, lease.Attrs) && own.attrs.PublicIP == lease.Attrs.PublicIP {
+		return m.Manager.RenewLease(ctx, network, lease)
+	}
+
+	// the backend's copy of the lease may still be the not
+	// ready one or predate a relabeling or a new public IP
+	attrs := *lease.Attrs
+	subnet.LabelsOf(&own.attrs).Apply(&attrs)
+	attrs.PublicIP = own.attrs.PublicIP
+	if own.ready {
+		attrs.Ready = boolPtr(true)
+	}
+	l := *lease
+	l.Attrs = &attrs
+
+	err := m.Manager.RenewLease(ctx, network, &l)
+	lease.Expiration = l.Expiration
+	return err
+}
+
+// markReady advertises the own leases in network as ready, retrying
+// until it succeeds or ctx is done
+func (m *nodeManager) markReady(ctx context.Context, network string) {
+	m.mux.Lock()
+	pending := make(map[ip.IP4Net]subnet.LeaseAttrs)
+	for sn, o := range m.own {
+		if o.network == network {
+			o.ready = true
+			attrs := o.attrs
+			attrs.Ready = boolPtr(true)
+			pending[sn] = attrs
+		}
+	}
+	m.mux.Unlock()
+
+	for sn, attrs := range pending {
+		for {
+			_, err := m.Manager.UpdateLeaseAttrs(ctx, network, sn, &attrs)
+			if err == nil {
+				log.Infof("Lease %v is advertised as ready", sn)
+				break
+			}
+			log.Errorf("Failed to advertise lease %v as ready (retrying): %v", sn, err)
+
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// followPublicIP resolves Options.PublicIPHost every ResolveInterval
+// and, when it resolves to another IP, advertises that in the own leases
+// in network. A failed lookup keeps the last IP.
+func (m *nodeManager) followPublicIP(ctx context.Context, network string) {
+	host := m.opts.PublicIPHost
+	for {
+		select {
+		case <-time.After(m.opts.ResolveInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		a, err := ResolvePublicIP(host)
+		if err != nil {
+			log.Warningf("Failed to resolve --public-ip %v, keeping the last IP: %v", host, err)
+			continue
+		}
+		m.setPublicIP(ctx, network, a)
+	}
+}
+
+// setPublicIP advertises a as the public IP of the own leases in network.
+// What fails to be updated now is by the next renewal.
+func (m *nodeManager) setPublicIP(ctx context.Context, network string, a ip.IP4) {
+	m.mux.Lock()
+	if a == m.publicIP {
+		m.mux.Unlock()
+		return
+	}
+	log.Infof("%v now resolves to %v (was %v), updating the leases", m.opts.PublicIPHost, a, m.publicIP)
+	m.publicIP = a
+
+	pending := make(map[ip.IP4Net]subnet.LeaseAttrs)
+	for sn, o := range m.own {
+		if o.network == network {
+			o.attrs.PublicIP = a
+			attrs := o.attrs
+			if o.ready {
+				attrs.Ready = boolPtr(true)
+			}
+			pending[sn] = attrs
+		}
+	}
+	m.mux.Unlock()
+
+	for sn, attrs := range pending {
+		if _, err := m.Manager.UpdateLeaseAttrs(ctx, network, sn, &attrs); err != nil {
+			log.Errorf("Failed to advertise %v as the public IP of lease %v: %v", a, sn, err)
+		}
+	}
+}
+
+func (m *nodeManager) ownLeases() []ip.IP4Net {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	leases := []ip.IP4Net{}
+	for sn := range m.own {
+		leases = append(leases, sn)
+	}
+	return leases
+}
+
+// forgetOwn drops the own leases in network, those of a backend that
+// was stopped
+func (m *nodeManager) forgetOwn(network string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for sn, o := range m.own {
+		if o.network == network {
+			delete(m.own, sn)
+		}
+	}
+}
+
+func (m *nodeManager) CoalesceWindow() time.Duration {
+	return m.opts.CoalesceWindow
+}
+
+func (m *nodeManager) WatchBuffer() (int, string) {
+	return m.opts.WatchBuffer, m.opts.WatchOverflow
+}
+
+func (m *nodeManager) RouteChanged(c backend.RouteChange) {
+	if m.opts.RouteHook != nil {
+		m.opts.RouteHook.notify(c)
+	}
+}
+
+type watchResult struct {
+	wr  subnet.WatchResult
+	err error
+}
+
+// inputs returns what a watch result is made with now
+func (m *nodeManager) inputs() watchInputs {
+	var in watchInputs
+	if f := m.opts.RouteFilter; f != nil {
+		in.filter = f.Changed()
+	}
+	if r := m.opts.Resolver; r != nil {
+		in.ips = r.Changed()
+	}
+	return in
+}
+
+func (m *nodeManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	m.mux.Lock()
+	in, ok := m.seen[network]
+	m.mux.Unlock()
+	if !ok || cursor == nil {
+		in = m.inputs()
+	}
+
+	if in.filter == nil && in.ips == nil {
+		wr, err := m.Manager.WatchLeases(ctx, network, cursor)
+		if err != nil {
+			return wr, err
+		}
+		return m.filter(network, wr), nil
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan watchResult, 1)
+	go func() {
+		wr, err := m.Manager.WatchLeases(wctx, network, cursor)
+		c <- watchResult{wr, err}
+	}()
+
+	// start over from a snapshot, the watcher diffs it
+	// against what it has seen and the backend follows
+	resync := func(why string) watchResult {
+		cancel()
+		<-c
+		log.Infof("%v, resyncing leases of network %v", why, network)
+		wr, err := m.Manager.WatchLeases(ctx, network, nil)
+		return watchResult{wr, err}
+	}
+
+	var res watchResult
+	select {
+	case res = <-c:
+	case <-in.filter:
+		res = resync("Route filter changed")
+	case <-in.ips:
+		res = resync("Public hostnames resolve to new IPs")
+	}
+
+	if res.err != nil {
+		return res.wr, res.err
+	}
+
+	next := m.inputs()
+	m.mux.Lock()
+	m.seen[network] = next
+	m.mux.Unlock()
+	return m.filter(network, m.resolve(network, res.wr)), nil
+}
+
+// resolve fills in the current IPs of the leases of network that
+// advertise a PublicHostname
+func (m *nodeManager) resolve(network string, wr subnet.WatchResult) subnet.WatchResult {
+	r := m.opts.Resolver
+	if r == nil {
+		return wr
+	}
+
+	if wr.Snapshot != nil {
+		snapshot := make([]subnet.Lease, len(wr.Snapshot))
+		for i, l := range wr.Snapshot {
+			snapshot[i] = r.resolveLease(network, l)
+		}
+		wr.Snapshot = snapshot
+		r.retain(network, snapshot)
+	}
+
+	events := make([]subnet.Event, len(wr.Events))
+	for i, e := range wr.Events {
+		switch e.Type {
+		case subnet.SubnetAdded:
+			e.Lease = r.resolveLease(network, e.Lease)
+		case subnet.SubnetRemoved:
+			r.releaseLease(network, e.Lease.Subnet)
+		}
+		events[i] = e
+	}
+	wr.Events = events
+	return wr
+}
+
+// adoptLabels takes over the labels an own lease was given (e.g. with
+// relabel) so that renewing it keeps them; m.mux is held
+func (m *nodeManager) adoptLabels(network string, l *subnet.Lease) {
+	o := m.own[l.Subnet]
+	if o == nil || o.network != network || l.Attrs == nil {
+		return
+	}
+	if !sameLabels(&o.attrs, l.Attrs) {
+		log.Infof("Lease %v relabeled: zone %q, pool %q, hostname %q", l.Subnet, l.Attrs.Zone, l.Attrs.Pool, l.Attrs.Hostname)
+		subnet.LabelsOf(l.Attrs).Apply(&o.attrs)
+	}
+}
+
+func sameLabels(a, b *subnet.LeaseAttrs) bool {
+	return a.Zone == b.Zone && a.Pool == b.Pool && a.Hostname == b.Hostname
+}
+
+// skipReason returns why l, already visible or not, is not passed on to
+// the backends, "" if it is. Readiness only defers routing to a new lease:
+// one that was visible stays so when its node restarts and is not ready
+// for a while.
+func (m *nodeManager) skipReason(l *subnet.Lease, visible bool) string {
+	if m.own[l.Subnet] != nil {
+		return ""
+	}
+
+	if f := m.opts.RouteFilter; f != nil && !f.Matches(l) {
+		switch {
+		case visible:
+		case l.Attrs == nil:
+			log.Infof("Skipping lease %v: does not match the route filter", l.Subnet)
+		default:
+			log.Infof("Skipping lease %v (zone %q): does not match the route filter", l.Subnet, l.Attrs.Zone)
+		}
+		return backend.RouteSkippedFiltered
+	}
+
+	if !visible && !l.Attrs.IsReady() {
+		log.Infof("Skipping lease %v: its node is not ready yet", l.Subnet)
+		return backend.RouteSkippedNotReady
+	}
+	return ""
+}
+
+// skippedLeases returns why the leases of network that are held back
+// from the backends are
+func (m *nodeManager) skippedLeases(network string) map[ip.IP4Net]string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	skipped := make(map[ip.IP4Net]string)
+	for sn, reason := range m.skipped[network] {
+		skipped[sn] = reason
+	}
+	return skipped
+}
+
+func (m *nodeManager) filter(network string, wr subnet.WatchResult) subnet.WatchResult {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	visible := m.visible[network]
+	if visible == nil {
+		visible = make(map[ip.IP4Net]bool)
+		m.visible[network] = visible
+	}
+
+	skipped := m.skipped[network]
+	if skipped == nil {
+		skipped = make(map[ip.IP4Net]string)
+		m.skipped[network] = skipped
+	}
+
+	if wr.Snapshot != nil {
+		m.releaseMissing(network, wr.Snapshot)
+
+		leases := make([]subnet.Lease, len(wr.Snapshot))
+		reasons := make([]string, len(wr.Snapshot))
+		routed := 0
+		for i, l := range wr.Snapshot {
+			leases[i], _ = m.fence(network, l)
+			m.adoptLabels(network, &leases[i])
+			reasons[i] = m.skipReason(&leases[i], visible[l.Subnet])
+			if reasons[i] == "" && visible[l.Subnet] && m.own[l.Subnet] == nil {
+				routed++
+			}
+		}
+
+		nowVisible := make(map[ip.IP4Net]bool)
+		m.skipped[network] = make(map[ip.IP4Net]string)
+		m.held[network] = nil
+		// the routes in place stay, new leases get what room is left
+		newlyHeld := 0
+		snapshot := []subnet.Lease{}
+		for i, l := range leases {
+			if reasons[i] == "" && !visible[l.Subnet] && m.own[l.Subnet] == nil {
+				if m.overLimit(routed) {
+					m.hold(network, l)
+					newlyHeld++
+					continue
+				}
+				routed++
+			}
+
+			if reasons[i] != "" {
+				m.skipped[network][l.Subnet] = reasons[i]
+				continue
+			}
+			nowVisible[l.Subnet] = true
+			snapshot = append(snapshot, l)
+		}
+		m.visible[network] = nowVisible
+		m.logHeld(network, newlyHeld)
+		wr.Snapshot = snapshot
+		return wr
+	}
+
+	events := []subnet.Event{}
+	newlyHeld := 0
+	for _, e := range wr.Events {
+		if e.Type == subnet.SubnetRemoved {
+			m.release(network, e.Lease.Subnet)
+		} else if _, stale := m.fence(network, e.Lease); stale {
+			continue
+		} else {
+			m.adoptLabels(network, &e.Lease)
+		}
+
+		reason := ""
+		if e.Type != subnet.SubnetRemoved {
+			reason = m.skipReason(&e.Lease, visible[e.Lease.Subnet])
+		}
+
+		_, wasHeld := m.held[network][e.Lease.Subnet]
+		delete(m.held[network], e.Lease.Subnet)
+
+		switch {
+		case reason == "" && e.Type != subnet.SubnetRemoved && !visible[e.Lease.Subnet] &&
+			m.own[e.Lease.Subnet] == nil && m.overLimit(m.routed(visible)):
+			m.hold(network, e.Lease)
+			if !wasHeld {
+				newlyHeld++
+			}
+
+		case e.Type == subnet.SubnetRemoved:
+			delete(skipped, e.Lease.Subnet)
+			if visible[e.Lease.Subnet] {
+				delete(visible, e.Lease.Subnet)
+				events = append(events, e)
+			}
+
+		case reason == "":
+			delete(skipped, e.Lease.Subnet)
+			visible[e.Lease.Subnet] = true
+			events = append(events, e)
+
+		default:
+			skipped[e.Lease.Subnet] = reason
+			if visible[e.Lease.Subnet] {
+				// the lease changed and no longer passes
+				delete(visible, e.Lease.Subnet)
+				events = append(events, subnet.Event{Type: subnet.SubnetRemoved, Lease: e.Lease})
+			}
+		}
+	}
+	m.logHeld(network, newlyHeld)
+	wr.Events = append(events, m.promote(network)...)
+	return wr
+}
@@ -0,0 +1,497 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// leasesManager serves a fixed snapshot and then the events sent on events
+type leasesManager struct {
+	subnet.Manager
+	snapshot []subnet.Lease
+	events   chan subnet.Event
+}
+
+func (m *leasesManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if cursor == nil {
+		return subnet.WatchResult{Snapshot: m.snapshot, Cursor: "1"}, nil
+	}
+
+	select {
+	case e := <-m.events:
+		return subnet.WatchResult{Events: []subnet.Event{e}, Cursor: "2"}, nil
+	case <-ctx.Done():
+		return subnet.WatchResult{}, ctx.Err()
+	}
+}
+
+func zoneLease(sn, zone string) subnet.Lease {
+	_, n, _ := net.ParseCIDR(sn)
+	return subnet.Lease{
+		Subnet: ip.FromIPNet(n),
+		Attrs:  &subnet.LeaseAttrs{Zone: zone, BackendType: "host-gw"},
+	}
+}
+
+func nextBatch(t *testing.T, events chan []subnet.Event) []subnet.Event {
+	select {
+	case batch := <-events:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for lease events")
+		return nil
+	}
+}
+
+func batchKeys(batch []subnet.Event) map[string]subnet.EventType {
+	keys := make(map[string]subnet.EventType)
+	for _, e := range batch {
+		keys[e.Lease.Key()] = e.Type
+	}
+	return keys
+}
+
+func TestRouteFilterZone(t *testing.T) {
+	sm := &leasesManager{
+		snapshot: []subnet.Lease{
+			zoneLease("10.1.1.0/24", "a"),
+			zoneLease("10.1.2.0/24", "b"),
+			zoneLease("10.1.3.0/24", "a"),
+		},
+		events: make(chan subnet.Event),
+	}
+
+	f := NewRouteFilter()
+	zones, subnets, err := parseRouteFilter(strings.NewReader("# same zone only\nzone a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Set(zones, subnets)
+
+	nm := newNodeManager(sm, Options{RouteFilter: f})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, nm, "", events)
+
+	keys := batchKeys(nextBatch(t, events))
+	if len(keys) != 2 || keys["10.1.1.0-24"] != subnet.SubnetAdded || keys["10.1.3.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected only the zone a leases, got %v", keys)
+	}
+
+	// leases outside the zone that show up later are skipped too
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: zoneLease("10.1.4.0/24", "b")}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the zone b lease to be skipped, got %v", batchKeys(batch))
+	}
+
+	// as is one without attributes
+	noAttrs := zoneLease("10.1.6.0/24", "")
+	noAttrs.Attrs = nil
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: noAttrs}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the lease without attributes to be skipped, got %v", batchKeys(batch))
+	}
+
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: zoneLease("10.1.5.0/24", "a")}
+	if keys := batchKeys(nextBatch(t, events)); keys["10.1.5.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected the zone a lease to be added, got %v", keys)
+	}
+
+	// clearing the filter brings in all the peers
+	f.Set(nil, nil)
+
+	keys = batchKeys(nextBatch(t, events))
+	if keys["10.1.2.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected the zone b lease to be added once the filter is cleared, got %v", keys)
+	}
+}
+
+func readyLease(sn string, ready *bool) subnet.Lease {
+	l := zoneLease(sn, "")
+	l.Attrs.Ready = ready
+	return l
+}
+
+func TestNotReadyLeaseDeferred(t *testing.T) {
+	sm := &leasesManager{
+		snapshot: []subnet.Lease{
+			readyLease("10.1.1.0/24", boolPtr(true)),
+			readyLease("10.1.2.0/24", boolPtr(false)),
+			// a node that does not advertise readiness
+			readyLease("10.1.3.0/24", nil),
+		},
+		events: make(chan subnet.Event),
+	}
+
+	nm := newNodeManager(sm, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, nm, "", events)
+
+	keys := batchKeys(nextBatch(t, events))
+	if len(keys) != 2 || keys["10.1.1.0-24"] != subnet.SubnetAdded || keys["10.1.3.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected only the ready leases, got %v", keys)
+	}
+
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: readyLease("10.1.2.0/24", boolPtr(false))}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the not ready lease to be skipped, got %v", batchKeys(batch))
+	}
+
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: readyLease("10.1.2.0/24", boolPtr(true))}
+	if keys := batchKeys(nextBatch(t, events)); keys["10.1.2.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected the lease to be added once ready, got %v", keys)
+	}
+
+	// a restarting node keeps its routes while it gets ready again
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: readyLease("10.1.1.0/24", boolPtr(false))}
+	if keys := batchKeys(nextBatch(t, events)); keys["10.1.1.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected the restarting lease to stay, got %v", keys)
+	}
+}
+
+// trackingBackend only reports the states of routes
+type trackingBackend struct {
+	backend.Backend
+	backend.RouteTracker
+}
+
+func TestRouteStates(t *testing.T) {
+	f := NewRouteFilter()
+	zones, subnets, err := parseRouteFilter(strings.NewReader("zone a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Set(zones, subnets)
+
+	nm := newNodeManager(&leasesManager{}, Options{RouteFilter: f})
+	be := &trackingBackend{}
+	n := &Network{sm: nm, be: be}
+
+	notReady := zoneLease("10.1.2.0/24", "a")
+	notReady.Attrs.Ready = boolPtr(false)
+	wr := nm.filter("", subnet.WatchResult{Snapshot: []subnet.Lease{
+		zoneLease("10.1.1.0/24", "a"),
+		notReady,
+		zoneLease("10.1.3.0/24", "b"),
+	}})
+	for _, l := range wr.Snapshot {
+		be.SetRouteState(l.Subnet, backend.RouteInstalled)
+	}
+
+	expected := map[string]string{
+		"10.1.1.0/24": backend.RouteInstalled,
+		"10.1.2.0/24": backend.RouteSkippedNotReady,
+		"10.1.3.0/24": backend.RouteSkippedFiltered,
+	}
+	checkStates := func(when string) {
+		states := n.RouteStates()
+		if len(states) != len(expected) {
+			t.Errorf("%v: expected %v states, got %v", when, len(expected), states)
+		}
+		for sn, state := range states {
+			if expected[sn.String()] != state {
+				t.Errorf("%v: expected the route to %v to be %q, got %q", when, sn, expected[sn.String()], state)
+			}
+		}
+	}
+	checkStates("after the snapshot")
+
+	// the backend takes over once the lease is passed on
+	notReady.Attrs.Ready = boolPtr(true)
+	wr = nm.filter("", subnet.WatchResult{Events: []subnet.Event{
+		{Type: subnet.SubnetAdded, Lease: notReady},
+		{Type: subnet.SubnetRemoved, Lease: zoneLease("10.1.3.0/24", "b")},
+	}})
+	if len(wr.Events) != 1 {
+		t.Fatalf("expected only the ready lease to be passed on, got %v", wr.Events)
+	}
+	be.SetRouteState(notReady.Subnet, backend.RouteSkippedUnreachable)
+
+	expected["10.1.2.0/24"] = backend.RouteSkippedUnreachable
+	delete(expected, "10.1.3.0/24")
+	checkStates("after the events")
+}
+
+func TestMaxRoutes(t *testing.T) {
+	sm := &leasesManager{
+		snapshot: []subnet.Lease{
+			zoneLease("10.1.1.0/24", ""),
+			zoneLease("10.1.2.0/24", ""),
+		},
+		events: make(chan subnet.Event),
+	}
+
+	nm := newNodeManager(sm, Options{MaxRoutes: 2})
+	n := &Network{sm: nm, be: &trackingBackend{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, nm, "", events)
+
+	if keys := batchKeys(nextBatch(t, events)); len(keys) != 2 {
+		t.Errorf("expected both leases within the limit, got %v", keys)
+	}
+	if err := n.Health(); err != nil {
+		t.Errorf("unhealthy within the limit: %v", err)
+	}
+
+	// one too many
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: zoneLease("10.1.3.0/24", "")}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the lease past the limit to be held back, got %v", batchKeys(batch))
+	}
+	if err := n.Health(); err == nil {
+		t.Error("still healthy with a lease held back")
+	}
+	if s := n.RouteStates()[zoneLease("10.1.3.0/24", "").Subnet]; s != backend.RouteSkippedLimit {
+		t.Errorf("expected the held lease to be %q, got %q", backend.RouteSkippedLimit, s)
+	}
+
+	// the routes in place stay: renewals still pass
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: zoneLease("10.1.1.0/24", "")}
+	if keys := batchKeys(nextBatch(t, events)); keys["10.1.1.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected the renewal of a routed lease to pass, got %v", keys)
+	}
+
+	// a lease going away makes room for the held one
+	sm.events <- subnet.Event{Type: subnet.SubnetRemoved, Lease: zoneLease("10.1.2.0/24", "")}
+	keys := batchKeys(nextBatch(t, events))
+	if len(keys) != 2 || keys["10.1.2.0-24"] != subnet.SubnetRemoved || keys["10.1.3.0-24"] != subnet.SubnetAdded {
+		t.Errorf("expected the held lease to take the room, got %v", keys)
+	}
+	if err := n.Health(); err != nil {
+		t.Errorf("unhealthy with no lease held back: %v", err)
+	}
+}
+
+// attrsManager records the attributes of lease writes
+type attrsManager struct {
+	subnet.Manager
+	mux     sync.Mutex
+	updated []*subnet.LeaseAttrs
+	renewed []*subnet.LeaseAttrs
+}
+
+func (m *attrsManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	l := zoneLease("10.1.1.0/24", "")
+	l.Attrs = attrs
+	return &l, nil
+}
+
+func (m *attrsManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.renewed = append(m.renewed, lease.Attrs)
+	return nil
+}
+
+func (m *attrsManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.updated = append(m.updated, attrs)
+	return &subnet.Lease{Subnet: sn, Attrs: attrs}, nil
+}
+
+func TestMarkReady(t *testing.T) {
+	sm := &attrsManager{}
+	nm := newNodeManager(sm, Options{})
+	ctx := context.Background()
+
+	l, err := nm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: ip.IP4(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs.IsReady() {
+		t.Fatal("lease was acquired as ready")
+	}
+
+	if err := nm.RenewLease(ctx, "", l); err != nil {
+		t.Fatal(err)
+	}
+
+	nm.markReady(ctx, "")
+
+	if err := nm.RenewLease(ctx, "", l); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sm.updated) != 1 || !sm.updated[0].IsReady() || sm.updated[0].PublicIP != ip.IP4(1) {
+		t.Errorf("expected the lease attrs to be updated to ready, got %v", sm.updated)
+	}
+	if len(sm.renewed) != 2 || sm.renewed[0].IsReady() || !sm.renewed[1].IsReady() {
+		t.Errorf("expected only the renewal after markReady to be ready, got %v", sm.renewed)
+	}
+}
+
+func TestRenewKeepsLabels(t *testing.T) {
+	sm := &attrsManager{}
+	nm := newNodeManager(sm, Options{Zone: "zone-a"})
+	ctx := context.Background()
+
+	l, err := nm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: ip.IP4(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// relabeled from elsewhere
+	relabeled := *l
+	attrs := *l.Attrs
+	attrs.Zone = "zone-b"
+	relabeled.Attrs = &attrs
+	nm.filter("", subnet.WatchResult{Events: []subnet.Event{{Type: subnet.SubnetAdded, Lease: relabeled}}})
+
+	if err := nm.RenewLease(ctx, "", l); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.renewed) != 1 || sm.renewed[0].Zone != "zone-b" {
+		t.Errorf("expected the renewal to keep the new zone, got %v", sm.renewed)
+	}
+}
+
+func TestAdvertisedPublicIP(t *testing.T) {
+	defer withMissingCapabilities()()
+
+	tn := &testNode{name: "node0", backends: make(map[string]*fakeBackend)}
+	defer withFakeBackends(&tn)()
+
+	cm := newClusterManager(t, udpBackend)
+	bindIP := net.IPv4(192, 168, 0, 1)
+	publicIP := ip.FromIP(net.IPv4(203, 0, 113, 7))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := New(cm, "", Options{PublicIP: publicIP})
+	sn := n.Init(ctx, &net.Interface{MTU: 1500}, bindIP)
+	if sn == nil {
+		t.Fatal("Failed to initialize the network")
+	}
+
+	if b := tn.backends["udp"]; b == nil || !b.extIP.Equal(bindIP) {
+		t.Errorf("backend was not given the bind address %v", bindIP)
+	}
+	if l := cm.lease(sn.Net); l.Attrs == nil || l.Attrs.PublicIP != publicIP {
+		t.Errorf("lease does not advertise %v: %+v", publicIP, l.Attrs)
+	}
+}
+
+func epochLease(sn, publicIP string, epoch uint64) subnet.Lease {
+	l := zoneLease(sn, "")
+	l.Attrs.PublicIP = ip.FromIP(net.ParseIP(publicIP))
+	l.Attrs.Epoch = epoch
+	return l
+}
+
+func TestEpochFencing(t *testing.T) {
+	sm := &leasesManager{
+		snapshot: []subnet.Lease{epochLease("10.1.1.0/24", "1.1.1.2", 20)},
+		events:   make(chan subnet.Event),
+	}
+	nm := newNodeManager(sm, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, nm, "", events)
+
+	if keys := batchKeys(nextBatch(t, events)); keys["10.1.1.0-24"] != subnet.SubnetAdded {
+		t.Fatalf("expected the lease in the snapshot, got %v", keys)
+	}
+
+	// the node that held the subnet before comes back and renews
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: epochLease("10.1.1.0/24", "1.1.1.1", 10)}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the lower epoch claim to be ignored, got %v", batch)
+	}
+
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: epochLease("10.1.1.0/24", "1.1.1.3", 30)}
+	batch := nextBatch(t, events)
+	if len(batch) != 1 || batch[0].Lease.Attrs.PublicIP != ip.FromIP(net.ParseIP("1.1.1.3")) {
+		t.Errorf("expected the higher epoch claim to be passed on, got %v", batch)
+	}
+
+	// once released, any claim goes
+	sm.events <- subnet.Event{Type: subnet.SubnetRemoved, Lease: epochLease("10.1.1.0/24", "1.1.1.3", 30)}
+	nextBatch(t, events)
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: epochLease("10.1.1.0/24", "1.1.1.1", 10)}
+	if batch := nextBatch(t, events); len(batch) != 1 {
+		t.Errorf("expected a claim to the released subnet to be passed on, got %v", batch)
+	}
+}
+
+func TestEpochFencingTakeover(t *testing.T) {
+	a := epochLease("10.1.1.0/24", "1.1.1.1", 10)
+	b := epochLease("10.1.1.0/24", "1.1.1.2", 20)
+	c := epochLease("10.1.1.0/24", "1.1.1.3", 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := func(snapshot ...subnet.Lease) (*leasesManager, chan []subnet.Event) {
+		sm := &leasesManager{snapshot: snapshot, events: make(chan subnet.Event)}
+		nm := newNodeManager(sm, Options{})
+
+		events := make(chan []subnet.Event)
+		go subnet.WatchLeases(ctx, nm, "", events)
+		nextBatch(t, events)
+		return sm, events
+	}
+
+	// b takes the subnet over from a, which then renews
+	sm, events := watch(a)
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: b}
+	if batch := nextBatch(t, events); len(batch) != 1 || batch[0].Lease.Attrs.PublicIP != b.Attrs.PublicIP {
+		t.Fatalf("expected the takeover to be passed on, got %v", batch)
+	}
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: a}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the renewal after the takeover to be ignored, got %v", batch)
+	}
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: b}
+	if batch := nextBatch(t, events); len(batch) != 1 {
+		t.Errorf("expected the renewal of the holder to be passed on, got %v", batch)
+	}
+
+	// claims with the same epoch go the same way whichever comes first
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: c}
+	if batch := nextBatch(t, events); len(batch) != 0 {
+		t.Errorf("expected the claim of %v to lose the tie, got %v", c.Attrs.PublicIP, batch)
+	}
+	sm, events = watch(c)
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: b}
+	if batch := nextBatch(t, events); len(batch) != 1 || batch[0].Lease.Attrs.PublicIP != b.Attrs.PublicIP {
+		t.Errorf("expected the claim of %v to win the tie, got %v", b.Attrs.PublicIP, batch)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// Observer follows the leases of a network without acquiring one or
+// touching the host, to report on the overlay
+type Observer struct {
+	Name string
+
+	sm     subnet.Manager
+	mux    sync.Mutex
+	synced bool
+	leases map[ip.IP4Net]subnet.Lease
+	stats  ObserverStats
+}
+
+// ObserverStats counts what an Observer has seen
+type ObserverStats struct {
+	// Leases is the number of current leases, Ready those of
+	// them whose node is ready
+	Leases int
+	Ready  int
+	// Added and Removed count the lease events since the start,
+	// leases of the initial snapshot included
+	Added   int
+	Removed int
+}
+
+func NewObserver(sm subnet.Manager, name string) *Observer {
+	return &Observer{
+		Name:   name,
+		sm:     sm,
+		leases: make(map[ip.IP4Net]subnet.Lease),
+	}
+}
+
+// Run follows the leases until ctx is done
+func (o *Observer) Run(ctx context.Context) {
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeasesMarked(ctx, o.sm, o.Name, events)
+
+	for {
+		select {
+		case batch := <-events:
+			o.apply(batch)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (o *Observer) apply(batch []subnet.Event) {
+	batch, done := subnet.SplitSnapshotDone(batch)
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	for _, e := range batch {
+		switch e.Type {
+		case subnet.SubnetAdded:
+			o.leases[e.Lease.Subnet] = e.Lease
+			o.stats.Added++
+		case subnet.SubnetRemoved:
+			delete(o.leases, e.Lease.Subnet)
+			o.stats.Removed++
+		}
+	}
+
+	if done && !o.synced {
+		log.Infof("Observing %v leases of network %q", len(o.leases), o.Name)
+		o.synced = true
+	}
+}
+
+// Synced returns an error until the leases that existed when the watch
+// started have been seen
+func (o *Observer) Synced() error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if !o.synced {
+		return fmt.Errorf("leases of network %q not retrieved yet", o.Name)
+	}
+	return nil
+}
+
+// Leases returns the current leases ordered by subnet
+func (o *Observer) Leases() []subnet.Lease {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	leases := make([]subnet.Lease, 0, len(o.leases))
+	for _, l := range o.leases {
+		leases = append(leases, l)
+	}
+	sort.Sort(leasesBySubnet(leases))
+	return leases
+}
+
+func (o *Observer) Stats() ObserverStats {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	stats := o.stats
+	stats.Leases = len(o.leases)
+	for _, l := range o.leases {
+		if l.Attrs != nil && l.Attrs.IsReady() {
+			stats.Ready++
+		}
+	}
+	return stats
+}
+
+type leasesBySubnet []subnet.Lease
+
+func (l leasesBySubnet) Len() int           { return len(l) }
+func (l leasesBySubnet) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l leasesBySubnet) Less(i, j int) bool { return l[i].Subnet.IP < l[j].Subnet.IP }
@@ -0,0 +1,279 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// how long a lookup may take
+const lookupTimeout = 5 * time.Second
+
+// replaced in tests
+var (
+	lookupIP = net.LookupIP
+	// more peer hostnames than this are not resolved, their leases use
+	// their public IP
+	maxResolvedHosts = 1024
+)
+
+// Resolver resolves the PublicHostname of leases to the IP that
+// backends program routes to. The IPs are cached and kept up to date
+// by Run; when a lookup fails the last good IP is kept. A hostname is
+// looked up in the background when a lease first advertises it, and
+// dropped from the cache once no lease does.
+type Resolver struct {
+	mux    sync.Mutex
+	lookup func(string) ([]net.IP, error)
+	hosts  map[string]*resolvedHost
+	// per network, the hostname each lease advertises
+	leases  map[string]map[ip.IP4Net]string
+	changed chan struct{}
+}
+
+type resolvedHost struct {
+	// 0 until a lookup succeeds
+	ip      ip.IP4
+	pending bool
+	// the leases that advertise the hostname
+	refs int
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{
+		lookup:  lookupIP,
+		hosts:   make(map[string]*resolvedHost),
+		leases:  make(map[string]map[ip.IP4Net]string),
+		changed: make(chan struct{}),
+	}
+}
+
+// lookupIP4 returns the first IPv4 address host resolves to, giving up
+// after timeout
+func lookupIP4(lookup func(string) ([]net.IP, error), timeout time.Duration, host string) (ip.IP4, error) {
+	type lookupResult struct {
+		addrs []net.IP
+		err   error
+	}
+
+	c := make(chan lookupResult, 1)
+	go func() {
+		addrs, err := lookup(host)
+		c <- lookupResult{addrs, err}
+	}()
+
+	var res lookupResult
+	select {
+	case res = <-c:
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("lookup of %v timed out after %v", host, timeout)
+	}
+	if res.err != nil {
+		return 0, res.err
+	}
+	for _, a := range res.addrs {
+		if a.To4() != nil {
+			return ip.FromIP(a), nil
+		}
+	}
+	return 0, fmt.Errorf("%v has no IPv4 address", host)
+}
+
+// ResolvePublicIP returns the IPv4 address host resolves to, which must
+// be one to advertise as a public IP
+func ResolvePublicIP(host string) (ip.IP4, error) {
+	a, err := lookupIP4(lookupIP, lookupTimeout, host)
+	if err != nil {
+		return 0, err
+	}
+	return subnet.ParsePublicIP(a.String())
+}
+
+// notify wakes the watches so that they pick up new IPs; r.mux is held
+func (r *Resolver) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// resolveLease returns l, a lease of network, with its PublicIP set to
+// the IP its PublicHostname resolves to, if it has one and it resolved
+// already. l itself is not modified.
+func (r *Resolver) resolveLease(network string, l subnet.Lease) subnet.Lease {
+	host := ""
+	if l.Attrs != nil {
+		host = l.Attrs.PublicHostname
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.leases[network][l.Subnet] != host {
+		r.release(network, l.Subnet)
+	}
+	if host == "" {
+		return l
+	}
+
+	h := r.hosts[host]
+	if h == nil {
+		if len(r.hosts) >= maxResolvedHosts {
+			log.Warningf("Not resolving %v, already resolving %v hostnames; using %v", host, len(r.hosts), l.Attrs.PublicIP)
+			return l
+		}
+		h = &resolvedHost{pending: true}
+		r.hosts[host] = h
+		go r.lookupNew(host)
+	}
+	if r.leases[network] == nil {
+		r.leases[network] = make(map[ip.IP4Net]string)
+	}
+	if _, ok := r.leases[network][l.Subnet]; !ok {
+		r.leases[network][l.Subnet] = host
+		h.refs++
+	}
+
+	if h.ip == 0 {
+		return l
+	}
+	attrs := *l.Attrs
+	attrs.PublicIP = h.ip
+	l.Attrs = &attrs
+	return l
+}
+
+// lookupNew looks up a hostname no lease advertised before
+func (r *Resolver) lookupNew(host string) {
+	a, err := lookupIP4(r.lookup, lookupTimeout, host)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	h := r.hosts[host]
+	if h == nil {
+		return
+	}
+	h.pending = false
+	if err != nil {
+		log.Warningf("Failed to resolve %v, using the public IP of its leases until it does: %v", host, err)
+		return
+	}
+	h.ip = a
+	r.notify()
+}
+
+// release forgets the hostname sn, a lease of network, advertised, and
+// drops it from the cache if no other lease does; r.mux is held
+func (r *Resolver) release(network string, sn ip.IP4Net) {
+	host, ok := r.leases[network][sn]
+	if !ok {
+		return
+	}
+	delete(r.leases[network], sn)
+
+	if h := r.hosts[host]; h != nil {
+		if h.refs--; h.refs == 0 {
+			delete(r.hosts, host)
+		}
+	}
+}
+
+// releaseLease forgets the hostname of sn, a lease of network that is gone
+func (r *Resolver) releaseLease(network string, sn ip.IP4Net) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.release(network, sn)
+}
+
+// retain forgets the hostnames of the leases of network
+// not in snapshot
+func (r *Resolver) retain(network string, snapshot []subnet.Lease) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	current := make(map[ip.IP4Net]bool)
+	for _, l := range snapshot {
+		current[l.Subnet] = true
+	}
+	for sn := range r.leases[network] {
+		if !current[sn] {
+			r.release(network, sn)
+		}
+	}
+}
+
+// refresh looks up the cached hostnames again and reports whether any
+// of them resolved to a new IP
+func (r *Resolver) refresh() bool {
+	r.mux.Lock()
+	hosts := make([]string, 0, len(r.hosts))
+	for host, h := range r.hosts {
+		if !h.pending {
+			hosts = append(hosts, host)
+		}
+	}
+	r.mux.Unlock()
+
+	changed := false
+	for _, host := range hosts {
+		a, err := lookupIP4(r.lookup, lookupTimeout, host)
+		if err != nil {
+			log.Warningf("Failed to resolve %v, keeping its last IP: %v", host, err)
+			continue
+		}
+
+		r.mux.Lock()
+		if h := r.hosts[host]; h != nil && h.ip != a {
+			log.Infof("%v now resolves to %v (was %v)", host, a, h.ip)
+			h.ip = a
+			changed = true
+		}
+		r.mux.Unlock()
+	}
+
+	if changed {
+		r.mux.Lock()
+		r.notify()
+		r.mux.Unlock()
+	}
+	return changed
+}
+
+// Changed returns a channel that is closed the next time
+// a hostname resolves to a different IP
+func (r *Resolver) Changed() <-chan struct{} {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.changed
+}
+
+// Run refreshes the resolved IPs every interval until ctx is done
+func (r *Resolver) Run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+			r.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// stubResolver answers lookups from a map, missing names fail
+type stubResolver struct {
+	mux sync.Mutex
+	ips map[string]string
+}
+
+func (r *stubResolver) set(host, addr string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if addr == "" {
+		delete(r.ips, host)
+	} else {
+		r.ips[host] = addr
+	}
+}
+
+func (r *stubResolver) LookupIP(host string) ([]net.IP, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if addr, ok := r.ips[host]; ok {
+		return []net.IP{net.ParseIP(addr)}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func hostnameLease(sn, publicIP, host string) subnet.Lease {
+	l := zoneLease(sn, "")
+	l.Attrs.PublicIP, _ = ip.ParseIP4(publicIP)
+	l.Attrs.PublicHostname = host
+	return l
+}
+
+func batchIPs(batch []subnet.Event) map[string]string {
+	ips := make(map[string]string)
+	for _, e := range batch {
+		if e.Type == subnet.SubnetAdded {
+			ips[e.Lease.Key()] = e.Lease.Attrs.PublicIP.String()
+		}
+	}
+	return ips
+}
+
+func TestResolvePublicHostname(t *testing.T) {
+	stub := &stubResolver{ips: map[string]string{"peer.example.com": "10.0.0.1"}}
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = stub.LookupIP
+
+	sm := &leasesManager{
+		snapshot: []subnet.Lease{
+			hostnameLease("10.1.1.0/24", "1.1.1.1", "peer.example.com"),
+			hostnameLease("10.1.2.0/24", "1.1.1.2", ""),
+		},
+		events: make(chan subnet.Event),
+	}
+
+	r := NewResolver()
+	nm := newNodeManager(sm, Options{Resolver: r})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, nm, "", events)
+
+	// the hostname is looked up in the background, PublicIP is used
+	// until it resolves
+	ips := batchIPs(nextBatch(t, events))
+	if len(ips) != 2 || ips["10.1.2.0-24"] != "1.1.1.2" {
+		t.Errorf("expected both leases, with PublicIP where there is no hostname, got %v", ips)
+	}
+	if ips["10.1.1.0-24"] != "10.0.0.1" {
+		ips = batchIPs(nextBatch(t, events))
+		if len(ips) != 1 || ips["10.1.1.0-24"] != "10.0.0.1" {
+			t.Errorf("expected the lease to be updated once the hostname resolved, got %v", ips)
+		}
+	}
+
+	// the routes follow the new IP once it is picked up
+	stub.set("peer.example.com", "10.0.0.2")
+	if !r.refresh() {
+		t.Fatal("refresh did not notice the new IP")
+	}
+	ips = batchIPs(nextBatch(t, events))
+	if len(ips) != 1 || ips["10.1.1.0-24"] != "10.0.0.2" {
+		t.Errorf("expected only the lease to be updated with the new IP, got %v", ips)
+	}
+
+	// failed lookups keep the last good IP
+	stub.set("peer.example.com", "")
+	if r.refresh() {
+		t.Error("refresh reported a change after a failed lookup")
+	}
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: hostnameLease("10.1.1.0/24", "1.1.1.1", "peer.example.com")}
+	if ips := batchIPs(nextBatch(t, events)); ips["10.1.1.0-24"] != "10.0.0.2" {
+		t.Errorf("expected the last good IP to be kept, got %v", ips)
+	}
+
+	// names that never resolved fall back to PublicIP
+	sm.events <- subnet.Event{Type: subnet.SubnetAdded, Lease: hostnameLease("10.1.3.0/24", "1.1.1.3", "gone.example.com")}
+	if ips := batchIPs(nextBatch(t, events)); ips["10.1.3.0-24"] != "1.1.1.3" {
+		t.Errorf("expected PublicIP to be used for an unresolvable name, got %v", ips)
+	}
+}
+
+func TestResolverForgetsUnusedHostnames(t *testing.T) {
+	stub := &stubResolver{ips: map[string]string{"a.example.com": "10.0.0.1", "b.example.com": "10.0.0.2"}}
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = stub.LookupIP
+
+	cached := func(r *Resolver) int {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		return len(r.hosts)
+	}
+
+	r := NewResolver()
+	a := hostnameLease("10.1.1.0/24", "1.1.1.1", "a.example.com")
+	b := hostnameLease("10.1.2.0/24", "1.1.1.2", "b.example.com")
+	r.resolveLease("", a)
+	r.resolveLease("", b)
+	r.resolveLease("other", hostnameLease("10.1.1.0/24", "1.1.1.1", "a.example.com"))
+	if n := cached(r); n != 2 {
+		t.Fatalf("%v hostnames cached, expected 2", n)
+	}
+
+	// another network still has a lease for a
+	r.releaseLease("", a.Subnet)
+	if n := cached(r); n != 2 {
+		t.Errorf("%v hostnames cached after a lease was released, expected 2", n)
+	}
+
+	r.retain("other", nil)
+	r.retain("", []subnet.Lease{b})
+	if n := cached(r); n != 1 {
+		t.Errorf("%v hostnames cached, expected just b", n)
+	}
+
+	// a lease that stops advertising a hostname releases it
+	b.Attrs.PublicHostname = ""
+	r.resolveLease("", b)
+	if n := cached(r); n != 0 {
+		t.Errorf("%v hostnames cached, expected none", n)
+	}
+
+	defer func(n int) { maxResolvedHosts = n }(maxResolvedHosts)
+	maxResolvedHosts = 1
+	r.resolveLease("", a)
+	r.resolveLease("", hostnameLease("10.1.2.0/24", "1.1.1.2", "b.example.com"))
+	if n := cached(r); n != 1 {
+		t.Errorf("%v hostnames cached, expected at most 1", n)
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	hang := func(host string) ([]net.IP, error) {
+		<-block
+		return nil, errors.New("no such host")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := lookupIP4(hang, 10*time.Millisecond, "slow.example.com")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected a lookup that hangs to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup was not given up")
+	}
+}
+
+func TestFollowPublicIP(t *testing.T) {
+	stub := &stubResolver{ips: map[string]string{"node.example.com": "203.0.113.7"}}
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = stub.LookupIP
+
+	publicIP, err := ResolvePublicIP("node.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := &attrsManager{}
+	nm := newNodeManager(sm, Options{PublicIP: publicIP, PublicIPHost: "node.example.com", ResolveInterval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := nm.AcquireLease(ctx, "", &subnet.LeaseAttrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm.markReady(ctx, "")
+
+	// stopped before lookupIP is restored
+	done := make(chan struct{})
+	go func() {
+		nm.followPublicIP(ctx, "")
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	updates := func() []*subnet.LeaseAttrs {
+		sm.mux.Lock()
+		defer sm.mux.Unlock()
+		return append([]*subnet.LeaseAttrs{}, sm.updated...)
+	}
+
+	stub.set("node.example.com", "203.0.113.8")
+	waitFor(t, "the new public IP to be advertised", func() bool { return len(updates()) == 2 })
+	if u := updates()[1]; u.PublicIP.String() != "203.0.113.8" || !u.IsReady() {
+		t.Errorf("expected the lease to be updated to 203.0.113.8 and stay ready, got %+v", u)
+	}
+
+	// failed lookups keep the last IP
+	stub.set("node.example.com", "")
+	time.Sleep(50 * time.Millisecond)
+	if u := updates(); len(u) != 2 {
+		t.Errorf("lease was updated when the lookup failed: %v", u)
+	}
+
+	// the backend's copy of the lease still has the old IP
+	if err := nm.RenewLease(ctx, "", l); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.renewed) != 1 || sm.renewed[0].PublicIP.String() != "203.0.113.8" || !sm.renewed[0].IsReady() {
+		t.Errorf("expected the renewal to keep the new public IP, got %v", sm.renewed)
+	}
+
+	l, err = nm.AcquireLease(ctx, "", &subnet.LeaseAttrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs.PublicIP.String() != "203.0.113.8" {
+		t.Errorf("new lease does not advertise the new public IP: %v", l.Attrs.PublicIP)
+	}
+}
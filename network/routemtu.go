@@ -0,0 +1,67 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"syscall"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink/nl"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// mtuRoute is a route to a peer subnet over a backend's device with an
+// explicit MTU
+type mtuRoute struct {
+	dst       ip.IP4Net
+	linkIndex int
+	mtu       int
+}
+
+// the vendored netlink can't set route metrics, such routes are added
+// (and deleted) with raw requests; replaced in tests
+var (
+	mtuRouteAdd = doMTURouteAdd
+	mtuRouteDel = doMTURouteDel
+)
+
+func doMTURoute(proto, flags int, r mtuRoute) error {
+	req := nl.NewNetlinkRequest(proto, flags)
+
+	msg := nl.NewRtMsg()
+	msg.Family = syscall.AF_INET
+	msg.Dst_len = uint8(r.dst.PrefixLen)
+	req.AddData(msg)
+
+	oif := make([]byte, 4)
+	nl.NativeEndian().PutUint32(oif, uint32(r.linkIndex))
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, r.dst.IP.ToIP().To4()))
+	req.AddData(nl.NewRtAttr(syscall.RTA_OIF, oif))
+
+	metrics := nl.NewRtAttr(syscall.RTA_METRICS, nil)
+	nl.NewRtAttrChild(metrics, syscall.RTAX_MTU, nl.Uint32Attr(uint32(r.mtu)))
+	req.AddData(metrics)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func doMTURouteAdd(r mtuRoute) error {
+	// replace, a route left behind by an earlier run is fine
+	return doMTURoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK, r)
+}
+
+func doMTURouteDel(r mtuRoute) error {
+	return doMTURoute(syscall.RTM_DELROUTE, syscall.NLM_F_ACK, r)
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ValidateConfig checks what subnet.ParseConfig leaves to the nodes to
+// find out: that there is a Network and that the backend types are known
+func ValidateConfig(cfg *subnet.Config) error {
+	// unset, or 0.0.0.0/0 which would take over all routes
+	if cfg.Network.PrefixLen == 0 {
+		return errors.New("Network is missing")
+	}
+
+	bt, err := parseBackendType(cfg)
+	if err != nil {
+		return err
+	}
+	types := []string{bt.Type}
+	if bt.Fallback != "" {
+		types = append(types, bt.Fallback)
+	}
+	if len(bt.MigrateFrom) > 0 {
+		from, err := parseBackendType(&subnet.Config{Backend: bt.MigrateFrom})
+		if err != nil {
+			return fmt.Errorf("MigrateFrom: %v", err)
+		}
+		types = append(types, from.Type)
+	}
+
+	for _, t := range types {
+		if _, err := BackendCapabilities(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigCheck periodically retrieves and validates the config of a
+// network, for servers to report a broken config before a node asks
+// for it
+type ConfigCheck struct {
+	sm      subnet.Manager
+	network string
+
+	mux sync.Mutex
+	err error
+}
+
+func NewConfigCheck(sm subnet.Manager, network string) *ConfigCheck {
+	return &ConfigCheck{
+		sm:      sm,
+		network: network,
+		err:     errors.New("config not checked yet"),
+	}
+}
+
+// Check is a health.Check failing while the config is not valid
+func (c *ConfigCheck) Check() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.err
+}
+
+func (c *ConfigCheck) check(ctx context.Context) error {
+	cfg, err := c.sm.GetNetworkConfig(ctx, c.network)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve config: %v", err)
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	return nil
+}
+
+// Run checks the config right away and then every interval until ctx
+// is canceled
+func (c *ConfigCheck) Run(ctx context.Context, interval time.Duration) {
+	for {
+		err := c.check(ctx)
+
+		c.mux.Lock()
+		changed := (err == nil) != (c.err == nil)
+		c.err = err
+		c.mux.Unlock()
+
+		switch {
+		case err != nil:
+			log.Errorf("Network %q: %v", c.network, err)
+		case changed:
+			log.Infof("Network %q: config is valid", c.network)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
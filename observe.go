@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/health"
+	"github.com/coreos/flannel/subnet"
+)
+
+// observers serves the leases seen by the observer of every network as
+// JSON, keyed by network name
+type observers []*network.Observer
+
+func newObservers(sm subnet.Manager, networks []string) observers {
+	obs := make(observers, len(networks))
+	for i, n := range networks {
+		obs[i] = network.NewObserver(sm, n)
+	}
+	return obs
+}
+
+// run follows the leases of all the networks, reporting them through
+// readyz and metrics, until ctx is done
+func (obs observers) run(ctx context.Context, readyz *health.Checks, metrics *health.Metrics) {
+	done := make(chan struct{})
+	for _, o := range obs {
+		check := "leases"
+		if o.Name != "" {
+			check = fmt.Sprintf("leases of network %q", o.Name)
+		}
+		readyz.Add(check, o.Synced)
+		registerObserverGauges(metrics, o)
+
+		go func(o *network.Observer) {
+			o.Run(ctx)
+			done <- struct{}{}
+		}(o)
+	}
+	for range obs {
+		<-done
+	}
+}
+
+func registerObserverGauges(metrics *health.Metrics, o *network.Observer) {
+	labels := map[string]string{"network": o.Name}
+	metrics.AddGauge("flannel_observed_leases", "Leases of the network.", labels, func() float64 {
+		return float64(o.Stats().Leases)
+	})
+	metrics.AddGauge("flannel_observed_leases_ready", "Leases of the network whose node is ready.", labels, func() float64 {
+		return float64(o.Stats().Ready)
+	})
+	metrics.AddGaugeFamily("flannel_observed_lease_events", "Lease events seen since the start by type: added or removed.", func() []health.Sample {
+		stats := o.Stats()
+		return []health.Sample{
+			{Labels: map[string]string{"network": o.Name, "type": "added"}, Value: float64(stats.Added)},
+			{Labels: map[string]string{"network": o.Name, "type": "removed"}, Value: float64(stats.Removed)},
+		}
+	})
+}
+
+func (obs observers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	leases := make(map[string][]subnet.Lease, len(obs))
+	for _, o := range obs {
+		leases[o.Name] = o.Leases()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leases)
+}
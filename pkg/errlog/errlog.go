@@ -0,0 +1,125 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package errlog keeps errors that repeat on every event (e.g. a
+// malformed lease seen with each watch batch) from flooding the log.
+package errlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// DefaultInterval is how often a repeated message is logged again
+const DefaultInterval = 5 * time.Minute
+
+// severities of the messages
+const (
+	Info = iota
+	Warning
+	Error
+)
+
+// writes a message; replaced in tests
+var output = func(severity int, msg string) {
+	switch severity {
+	case Info:
+		log.Info(msg)
+	case Warning:
+		log.Warning(msg)
+	default:
+		log.Error(msg)
+	}
+}
+
+// replaced in tests
+var now = time.Now
+
+// Limiter logs a message the first time it comes up for a key (e.g. the
+// subnet of a lease) and then, while it keeps repeating, at most every
+// interval along with how often it was suppressed. A different message
+// for the key is logged right away.
+type Limiter struct {
+	interval time.Duration
+
+	mux  sync.Mutex
+	last map[string]*entry
+}
+
+type entry struct {
+	msg        string
+	logged     time.Time
+	suppressed int
+}
+
+func NewLimiter(interval time.Duration) *Limiter {
+	return &Limiter{
+		interval: interval,
+		last:     make(map[string]*entry),
+	}
+}
+
+func (l *Limiter) Infof(key, format string, args ...interface{}) {
+	l.logf(Info, key, format, args...)
+}
+
+func (l *Limiter) Warningf(key, format string, args ...interface{}) {
+	l.logf(Warning, key, format, args...)
+}
+
+func (l *Limiter) Errorf(key, format string, args ...interface{}) {
+	l.logf(Error, key, format, args...)
+}
+
+func (l *Limiter) logf(severity int, key, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	t := now()
+
+	l.mux.Lock()
+	e := l.last[key]
+	switch {
+	case e == nil || e.msg != msg:
+		l.last[key] = &entry{msg: msg, logged: t}
+
+	case t.Sub(e.logged) < l.interval:
+		e.suppressed++
+		l.mux.Unlock()
+		return
+
+	default:
+		if e.suppressed > 0 {
+			msg = fmt.Sprintf("%v (repeated %v times since %v)", msg, e.suppressed, e.logged.Format(time.RFC3339))
+		}
+		e.logged, e.suppressed = t, 0
+	}
+	l.mux.Unlock()
+
+	output(severity, msg)
+}
+
+// Clear forgets the message of key once what it was about is resolved,
+// so that it is logged right away should it come up again
+func (l *Limiter) Clear(key string) {
+	l.mux.Lock()
+	e := l.last[key]
+	delete(l.last, key)
+	l.mux.Unlock()
+
+	if e != nil && e.suppressed > 0 {
+		output(Info, fmt.Sprintf("Resolved after %v more times: %v", e.suppressed, e.msg))
+	}
+}
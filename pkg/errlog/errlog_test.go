@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errlog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type capture struct {
+	lines []string
+	clock time.Time
+}
+
+func withCapture() (*capture, func()) {
+	c := &capture{clock: time.Unix(1000, 0)}
+	origOutput, origNow := output, now
+	output = func(severity int, msg string) { c.lines = append(c.lines, msg) }
+	now = func() time.Time { return c.clock }
+	return c, func() {
+		output, now = origOutput, origNow
+	}
+}
+
+func TestRepeatedErrors(t *testing.T) {
+	c, restore := withCapture()
+	defer restore()
+
+	l := NewLimiter(time.Minute)
+	for i := 0; i < 100; i++ {
+		l.Errorf("10.1.5.0/24", "Error adding route to %v: %v", "10.1.5.0/24", "network is unreachable")
+		c.clock = c.clock.Add(time.Second)
+	}
+
+	// the first one and then one per minute
+	if len(c.lines) != 2 {
+		t.Fatalf("expected 2 log lines for 100 errors, got %v: %v", len(c.lines), c.lines)
+	}
+	if !strings.Contains(c.lines[1], "repeated 59 times") {
+		t.Errorf("repeated line lacks the count: %v", c.lines[1])
+	}
+
+	// a different error for the key is not held back
+	l.Errorf("10.1.5.0/24", "Error adding route to %v: %v", "10.1.5.0/24", "file exists")
+	if len(c.lines) != 3 {
+		t.Fatalf("changed error was not logged: %v", c.lines)
+	}
+
+	// nor are errors for other keys
+	l.Errorf("10.1.6.0/24", "Error adding route to %v: %v", "10.1.6.0/24", "network is unreachable")
+	if len(c.lines) != 4 {
+		t.Fatalf("error of another key was not logged: %v", c.lines)
+	}
+}
+
+func TestClear(t *testing.T) {
+	c, restore := withCapture()
+	defer restore()
+
+	l := NewLimiter(time.Minute)
+	for i := 0; i < 10; i++ {
+		l.Warningf("k", "Ignoring subnet")
+	}
+	l.Clear("k")
+
+	if len(c.lines) != 2 || !strings.Contains(c.lines[1], "Resolved after 9 more times") {
+		t.Fatalf("expected the resolution to be logged, got %v", c.lines)
+	}
+
+	// logged right away once it comes back
+	l.Warningf("k", "Ignoring subnet")
+	if len(c.lines) != 3 {
+		t.Fatalf("error was not logged again after Clear: %v", c.lines)
+	}
+
+	// nothing to report if it never repeated
+	l.Clear("k")
+	if len(c.lines) != 3 {
+		t.Errorf("Clear logged without suppressed errors: %v", c.lines)
+	}
+}
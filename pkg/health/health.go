@@ -0,0 +1,109 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Check returns nil if the component it covers is fine, or why it isn't
+type Check func() error
+
+// Checks is an http.Handler that responds with 200 if all of the
+// registered checks pass and with 503 listing the failures otherwise.
+type Checks struct {
+	mux    sync.Mutex
+	checks map[string]Check
+}
+
+func NewChecks() *Checks {
+	return &Checks{
+		checks: make(map[string]Check),
+	}
+}
+
+// Add registers check under name, replacing any check of the same name
+func (c *Checks) Add(name string, check Check) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.checks[name] = check
+}
+
+// Run runs all the checks and returns the failed ones
+func (c *Checks) Run() map[string]error {
+	c.mux.Lock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mux.Unlock()
+
+	failed := make(map[string]error)
+	for name, check := range checks {
+		if err := check(); err != nil {
+			failed[name] = err
+		}
+	}
+	return failed
+}
+
+func (c *Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failed := c.Run()
+	if len(failed) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, name := range names {
+		fmt.Fprintf(w, "%v: %v\n", name, failed[name])
+	}
+}
+
+// Serve serves h on addr until ctx is canceled
+func Serve(ctx context.Context, addr string, h http.Handler) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Errorf("Error listening on %v: %v", addr, err)
+		return
+	}
+
+	c := make(chan error, 1)
+	go func() {
+		c <- http.Serve(l, h)
+	}()
+
+	select {
+	case <-ctx.Done():
+		l.Close()
+		<-c
+
+	case err := <-c:
+		log.Errorf("Error serving on %v: %v", addr, err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChecks(t *testing.T) {
+	c := NewChecks()
+
+	ready := false
+	c.Add("network", func() error {
+		if !ready {
+			return errors.New("routes not programmed yet")
+		}
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %v while not ready, got %v", http.StatusServiceUnavailable, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "network: routes not programmed yet") {
+		t.Errorf("failed check missing from response: %q", rec.Body.String())
+	}
+
+	ready = true
+
+	rec = httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected %v once ready, got %v", http.StatusOK, rec.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.AddGauge("flannel_backend_healthy", "Whether the backend is healthy.", map[string]string{"network": "blue", "backend": "vxlan"}, func() float64 { return 0 })
+	m.AddGauge("flannel_backend_healthy", "Whether the backend is healthy.", map[string]string{"network": `a"b`, "backend": "udp"}, func() float64 { return 1 })
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP flannel_backend_healthy Whether the backend is healthy.
+# TYPE flannel_backend_healthy gauge
+flannel_backend_healthy{backend="udp",network="a\"b"} 1
+flannel_backend_healthy{backend="vxlan",network="blue"} 0
+`
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected metrics:\n%v\nexpected:\n%v", rec.Body.String(), expected)
+	}
+}
+
+func TestGaugeFamily(t *testing.T) {
+	m := NewMetrics()
+	m.AddGauge("flannel_peer_route", "Routes by state.", map[string]string{"subnet": "10.1.1.0/24"}, func() float64 { return 1 })
+
+	subnets := []string{"10.1.2.0/24"}
+	m.AddGaugeFamily("flannel_peer_route", "Routes by state.", func() []Sample {
+		samples := []Sample{}
+		for _, sn := range subnets {
+			samples = append(samples, Sample{Labels: map[string]string{"subnet": sn}, Value: 0})
+		}
+		return samples
+	})
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	expected := `# HELP flannel_peer_route Routes by state.
+# TYPE flannel_peer_route gauge
+flannel_peer_route{subnet="10.1.1.0/24"} 1
+flannel_peer_route{subnet="10.1.2.0/24"} 0
+`
+	if body := scrape(); body != expected {
+		t.Errorf("unexpected metrics:\n%v\nexpected:\n%v", body, expected)
+	}
+
+	// series come and go with what collect returns
+	subnets = []string{"10.1.3.0/24"}
+	if body := scrape(); strings.Contains(body, "10.1.2.0/24") || !strings.Contains(body, `flannel_peer_route{subnet="10.1.3.0/24"} 0`) {
+		t.Errorf("family not collected on scrape:\n%v", body)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is an http.Handler that serves the registered gauges in the
+// Prometheus text format
+type Metrics struct {
+	mux    sync.Mutex
+	gauges map[string]*gauge
+}
+
+type gauge struct {
+	help string
+	// values by their rendered labels
+	series map[string]func() float64
+	// series whose labels are only known at scrape time
+	collect []func() []Sample
+}
+
+// Sample is the value of one series of a gauge
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		gauges: make(map[string]*gauge),
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", k, labelEscaper.Replace(v)))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// AddGauge registers the series of gauge name with the given labels,
+// replacing any with the same labels. value is called on every scrape.
+func (m *Metrics) AddGauge(name, help string, labels map[string]string, value func() float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.gauge(name, help).series[renderLabels(labels)] = value
+}
+
+// AddGaugeFamily registers collect to return series of gauge name on
+// every scrape, for gauges with a series per changing thing (e.g. a
+// subnet). The samples are rendered along with those added by AddGauge.
+func (m *Metrics) AddGaugeFamily(name, help string, collect func() []Sample) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	g := m.gauge(name, help)
+	g.collect = append(g.collect, collect)
+}
+
+func (m *Metrics) gauge(name, help string) *gauge {
+	g := m.gauges[name]
+	if g == nil {
+		g = &gauge{help: help, series: make(map[string]func() float64)}
+		m.gauges[name] = g
+	}
+	return g
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	names := make([]string, 0, len(m.gauges))
+	for name := range m.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		g := m.gauges[name]
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", name, g.help, name)
+
+		values := make(map[string]float64, len(g.series))
+		for l, value := range g.series {
+			values[l] = value()
+		}
+		for _, collect := range g.collect {
+			for _, s := range collect() {
+				values[renderLabels(s.Labels)] = s.Value
+			}
+		}
+
+		labels := make([]string, 0, len(values))
+		for l := range values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+
+		for _, l := range labels {
+			fmt.Fprintf(w, "%v%v %v\n", name, l, values[l])
+		}
+	}
+}
@@ -16,9 +16,12 @@ package ip
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 )
 
 type IP4 uint32
@@ -43,7 +46,7 @@ func FromIP(ip net.IP) IP4 {
 
 func ParseIP4(s string) (IP4, error) {
 	ip := net.ParseIP(s)
-	if ip == nil {
+	if ip == nil || ip.To4() == nil {
 		return IP4(0), errors.New("Invalid IP address format")
 	}
 	return FromIP(ip), nil
@@ -85,17 +88,42 @@ func (ip IP4) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf(`"%s"`, ip)), nil
 }
 
-// json.Unmarshaler impl
+// json.Unmarshaler impl. Besides the dotted-quad string it accepts the
+// address as a JSON number (e.g. 167838208 for "10.1.2.0"), a form that
+// may still be found in old etcd data.
 func (ip *IP4) UnmarshalJSON(j []byte) error {
-	j = bytes.Trim(j, "\"")
-	if val, err := ParseIP4(string(j)); err != nil {
-		return err
-	} else {
+	switch {
+	case isJSONNull(j):
+		return nil
+
+	case len(j) > 0 && j[0] == '"':
+		var s string
+		if err := json.Unmarshal(j, &s); err != nil {
+			return err
+		}
+		val, err := ParseIP4(s)
+		if err != nil {
+			return err
+		}
 		*ip = val
 		return nil
+
+	default:
+		n, err := strconv.ParseUint(string(j), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid IPv4 address: %s", j)
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		*ip = FromBytes(b)
+		return nil
 	}
 }
 
+func isJSONNull(j []byte) bool {
+	return string(bytes.TrimSpace(j)) == "null"
+}
+
 // similar to net.IPNet but has uint based representation
 type IP4Net struct {
 	IP        IP4
@@ -167,13 +195,42 @@ func (n IP4Net) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf(`"%s"`, n)), nil
 }
 
-// json.Unmarshaler impl
+// json.Unmarshaler impl. Besides the CIDR string it accepts the struct
+// form ({"IP": 167838208, "PrefixLen": 24}) for compatibility with
+// old etcd data.
 func (n *IP4Net) UnmarshalJSON(j []byte) error {
-	j = bytes.Trim(j, "\"")
-	if _, val, err := net.ParseCIDR(string(j)); err != nil {
-		return err
-	} else {
+	switch {
+	case isJSONNull(j):
+		return nil
+
+	case len(j) > 0 && j[0] == '"':
+		var s string
+		if err := json.Unmarshal(j, &s); err != nil {
+			return err
+		}
+		_, val, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		if val.IP.To4() == nil {
+			return fmt.Errorf("not an IPv4 network: %v", s)
+		}
 		*n = FromIPNet(val)
 		return nil
+
+	default:
+		// its own type so that this method is not called recursively
+		var legacy struct {
+			IP        IP4
+			PrefixLen uint
+		}
+		if err := json.Unmarshal(j, &legacy); err != nil {
+			return fmt.Errorf("invalid IPv4 network: %s", j)
+		}
+		if legacy.PrefixLen > 32 {
+			return fmt.Errorf("invalid IPv4 network: prefix length %v", legacy.PrefixLen)
+		}
+		*n = IP4Net{legacy.IP, legacy.PrefixLen}
+		return nil
 	}
 }
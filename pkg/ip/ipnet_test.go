@@ -119,3 +119,61 @@ func TestIP4Net(t *testing.T) {
 		t.Error("Marshal of IP4Net failed with unexpected value: ", j)
 	}
 }
+
+func TestJSONRoundTrip(t *testing.T) {
+	type lease struct {
+		Subnet   IP4Net
+		PublicIP IP4
+	}
+
+	in := lease{mkIP4Net("10.1.2.0", 24), mkIP4("192.168.0.7")}
+	j, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal("Marshal failed: ", err)
+	}
+	if string(j) != `{"Subnet":"10.1.2.0/24","PublicIP":"192.168.0.7"}` {
+		t.Errorf("Marshal produced unexpected value: %s", j)
+	}
+
+	var out lease
+	if err := json.Unmarshal(j, &out); err != nil {
+		t.Fatal("Unmarshal failed: ", err)
+	}
+	if out != in {
+		t.Errorf("round trip changed the value: %+v vs %+v", out, in)
+	}
+}
+
+func TestJSONLegacyNumeric(t *testing.T) {
+	var ip IP4
+	if err := json.Unmarshal([]byte(`167838208`), &ip); err != nil {
+		t.Fatal("Unmarshal of numeric IP4 failed: ", err)
+	}
+	if ip != mkIP4("10.1.2.0") {
+		t.Errorf("numeric IP4 decoded to %v", ip)
+	}
+
+	var n IP4Net
+	if err := json.Unmarshal([]byte(`{"IP": 167838208, "PrefixLen": 24}`), &n); err != nil {
+		t.Fatal("Unmarshal of struct IP4Net failed: ", err)
+	}
+	if !n.Equal(mkIP4Net("10.1.2.0", 24)) {
+		t.Errorf("struct IP4Net decoded to %v", n)
+	}
+}
+
+func TestJSONInvalid(t *testing.T) {
+	for _, j := range []string{`"1.2.3"`, `"::1"`, `4294967296`, `-1`, `true`} {
+		var ip IP4
+		if err := json.Unmarshal([]byte(j), &ip); err == nil {
+			t.Errorf("Unmarshal of IP4 %s succeeded", j)
+		}
+	}
+
+	for _, j := range []string{`"1.2.3.0"`, `"::/64"`, `{"IP": 1, "PrefixLen": 33}`, `[1]`} {
+		var n IP4Net
+		if err := json.Unmarshal([]byte(j), &n); err == nil {
+			t.Errorf("Unmarshal of IP4Net %s succeeded", j)
+		}
+	}
+}
@@ -81,6 +81,64 @@ func (ipt *IPTables) AppendUnique(table string, args ...string) error {
 	return nil
 }
 
+func (ipt *IPTables) Delete(table string, args ...string) error {
+	cmd := append([]string{"-t", table, "-D"}, args...)
+	return exec.Command(ipt.path, cmd...).Run()
+}
+
+// List returns the chains and rules of table as printed by "iptables -S",
+// each split into its arguments (e.g. ["-A", "POSTROUTING", "-j", "FLANNEL"])
+func (ipt *IPTables) List(table string) ([][]string, error) {
+	cmd := exec.Command(ipt.path, "-t", table, "-S")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	rules := [][]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if args := splitRuleSpec(line); len(args) > 0 {
+			rules = append(rules, args)
+		}
+	}
+	return rules, nil
+}
+
+// splitRuleSpec splits a line of "iptables -S" output into arguments.
+// iptables double quotes arguments with spaces (such as comments) and
+// backslash escapes quotes within them.
+func splitRuleSpec(line string) []string {
+	args := []string{}
+	arg := []byte{}
+	inArg, quoted := false, false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && quoted && i+1 < len(line):
+			i++
+			arg = append(arg, line[i])
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = arg[:0], false
+			}
+		default:
+			arg = append(arg, c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+
+	return args
+}
+
 func (ipt *IPTables) ClearChain(table, chain string) error {
 	cmd := append([]string{"-t", table, "-N", chain})
 	err := exec.Command(ipt.path, cmd...).Run()
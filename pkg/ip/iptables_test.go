@@ -0,0 +1,39 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRuleSpec(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		args []string
+	}{
+		{"-N FLANNEL", []string{"-N", "FLANNEL"}},
+		{"-A POSTROUTING -s 10.5.0.0/16 -m comment --comment flannel:_ -j FLANNEL",
+			[]string{"-A", "POSTROUTING", "-s", "10.5.0.0/16", "-m", "comment", "--comment", "flannel:_", "-j", "FLANNEL"}},
+		{`-A FORWARD -m comment --comment "say \"hi\" there" -j ACCEPT`,
+			[]string{"-A", "FORWARD", "-m", "comment", "--comment", `say "hi" there`, "-j", "ACCEPT"}},
+		{`-A FORWARD -m comment --comment ""`, []string{"-A", "FORWARD", "-m", "comment", "--comment", ""}},
+		{"  ", []string{}},
+	} {
+		if args := splitRuleSpec(tc.line); !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("splitRuleSpec(%q) = %q, expected %q", tc.line, args, tc.args)
+		}
+	}
+}
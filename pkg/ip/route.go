@@ -0,0 +1,92 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink/nl"
+)
+
+// ReplaceRoute installs the IPv4 route r, replacing a route to the same
+// destination (and metric) in the main table if there is one.
+// Equivalent to `ip route replace`, which the vendored netlink lacks.
+func ReplaceRoute(r *netlink.Route) error {
+	if r.Dst == nil || r.Dst.IP.To4() == nil {
+		return fmt.Errorf("route destination must be an IPv4 network")
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK)
+
+	msg := nl.NewRtMsg()
+	msg.Family = syscall.AF_INET
+	msg.Scope = uint8(r.Scope)
+	dstLen, _ := r.Dst.Mask.Size()
+	msg.Dst_len = uint8(dstLen)
+	req.AddData(msg)
+
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, r.Dst.IP.To4()))
+	if r.Src != nil {
+		req.AddData(nl.NewRtAttr(syscall.RTA_PREFSRC, r.Src.To4()))
+	}
+	if r.Gw != nil {
+		req.AddData(nl.NewRtAttr(syscall.RTA_GATEWAY, r.Gw.To4()))
+	}
+
+	oif := make([]byte, 4)
+	nl.NativeEndian().PutUint32(oif, uint32(r.LinkIndex))
+	req.AddData(nl.NewRtAttr(syscall.RTA_OIF, oif))
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// RoutesTo returns the IPv4 routes of the main table to exactly dst
+func RoutesTo(dst *net.IPNet) ([]netlink.Route, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []netlink.Route{}
+	for _, r := range routes {
+		if r.Dst != nil && r.Dst.IP.Equal(dst.IP) && bytes.Equal(r.Dst.Mask, dst.Mask) {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+// ReplaceLinkRoute installs the route r via a device like ReplaceRoute,
+// logging the routes to its destination via other devices (e.g. one
+// installed by Docker) that it takes over
+func ReplaceLinkRoute(r *netlink.Route) error {
+	existing, err := RoutesTo(r.Dst)
+	if err != nil {
+		log.Warningf("Failed to list routes to %v: %v", r.Dst, err)
+	}
+	for _, er := range existing {
+		if er.LinkIndex != r.LinkIndex || er.Gw != nil {
+			log.Warningf("Replacing route to %v (%v) that was not installed by flannel", r.Dst, er)
+		}
+	}
+
+	return ReplaceRoute(r)
+}
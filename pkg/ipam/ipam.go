@@ -0,0 +1,182 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipam hands out individual addresses from the subnet leased by
+// a node, e.g. to pods started by a CNI plugin.
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+var ErrExhausted = errors.New("no addresses left in subnet")
+
+// name of the file remembering the last allocated address so that
+// allocation goes round robin and a just released address is not
+// handed out again right away
+const lastFile = "last_reserved"
+
+// Allocator allocates the addresses of a subnet. Each allocation is kept
+// as a file named after the address (holding the ID of its owner) in the
+// store directory, so allocations survive restarts and O_EXCL creation
+// makes sure no address is handed out twice, even by several processes.
+//
+// The network and broadcast addresses are never allocated, neither is the
+// gateway of the subnet, which is left to the node (e.g. its bridge).
+type Allocator struct {
+	sn  ip.IP4Net
+	gw  ip.IP4
+	dir string
+
+	mux  sync.Mutex
+	last ip.IP4
+}
+
+// NewAllocator returns an Allocator for the addresses of sn that keeps
+// its allocations in dir, creating it if needed. Allocations of another
+// subnet that are found in dir are ignored. The gateway is the first
+// usable address of sn.
+func NewAllocator(sn ip.IP4Net, dir string) (*Allocator, error) {
+	return NewAllocatorWithGateway(sn, sn.Network().IP+1, dir)
+}
+
+// NewAllocatorWithGateway is NewAllocator with gw as the gateway of sn,
+// as given by the GatewayOffset of the network config (FLANNEL_GATEWAY
+// in the subnet file)
+func NewAllocatorWithGateway(sn ip.IP4Net, gw ip.IP4, dir string) (*Allocator, error) {
+	sn = sn.Network()
+	if sn.PrefixLen > 30 {
+		return nil, fmt.Errorf("subnet %v is too small to allocate addresses from", sn)
+	}
+
+	a := &Allocator{sn: sn, gw: gw, dir: dir}
+	if !a.usable(gw) {
+		return nil, fmt.Errorf("gateway %v is not a usable address of %v", gw, sn)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	a.last = sn.IP
+	if data, err := ioutil.ReadFile(filepath.Join(dir, lastFile)); err == nil {
+		if last, err := ip.ParseIP4(strings.TrimSpace(string(data))); err == nil && a.allocatable(last) {
+			a.last = last
+		}
+	}
+	return a, nil
+}
+
+// Gateway returns the address reserved for the gateway
+func (a *Allocator) Gateway() ip.IP4 {
+	return a.gw
+}
+
+func (a *Allocator) broadcast() ip.IP4 {
+	return a.sn.IP | ip.IP4(^a.sn.Mask())
+}
+
+// usable reports whether addr is neither the network nor the broadcast
+// address of the subnet
+func (a *Allocator) usable(addr ip.IP4) bool {
+	return a.sn.Contains(addr) && addr > a.sn.IP && addr < a.broadcast()
+}
+
+func (a *Allocator) allocatable(addr ip.IP4) bool {
+	return a.usable(addr) && addr != a.gw
+}
+
+func (a *Allocator) path(addr ip.IP4) string {
+	return filepath.Join(a.dir, addr.String())
+}
+
+// Allocate allocates a free address to id. It returns ErrExhausted if
+// all the addresses are taken.
+func (a *Allocator) Allocate(id string) (ip.IP4, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	first, last := a.sn.IP+1, a.broadcast()-1
+
+	addr := a.last
+	for i := first; i <= last; i++ {
+		if addr++; addr > last {
+			addr = first
+		}
+		if addr == a.gw {
+			continue
+		}
+
+		f, err := os.OpenFile(a.path(addr), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		switch {
+		case os.IsExist(err):
+			continue
+		case err != nil:
+			return 0, err
+		}
+
+		_, err = f.WriteString(id)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return 0, err
+		}
+
+		a.last = addr
+		// only a hint, losing it just changes where the next search starts
+		ioutil.WriteFile(filepath.Join(a.dir, lastFile), []byte(addr.String()), 0644)
+
+		return addr, nil
+	}
+
+	return 0, ErrExhausted
+}
+
+// Release frees addr. Releasing an address that is not allocated is not
+// an error.
+func (a *Allocator) Release(addr ip.IP4) error {
+	if !a.allocatable(addr) {
+		return fmt.Errorf("%v is not an allocatable address of %v", addr, a.sn)
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if err := os.Remove(a.path(addr)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Owner returns the ID addr was allocated to, or "" if it is free
+func (a *Allocator) Owner(addr ip.IP4) (string, error) {
+	data, err := ioutil.ReadFile(a.path(addr))
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	return string(data), nil
+}
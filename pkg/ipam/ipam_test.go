@@ -0,0 +1,175 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func mustParseIP4Net(s string) ip.IP4Net {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip.FromIPNet(n)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flannel-ipam")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestAllocateExhausted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	sn := mustParseIP4Net("10.1.5.0/29")
+	a, err := NewAllocator(sn, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// .0 is the network, .1 the gateway and .7 the broadcast address
+	seen := make(map[ip.IP4]bool)
+	for i := 0; i < 5; i++ {
+		addr, err := a.Allocate(fmt.Sprint("pod", i))
+		if err != nil {
+			t.Fatalf("Allocate %v failed: %v", i, err)
+		}
+		if seen[addr] {
+			t.Errorf("%v was allocated twice", addr)
+		}
+		seen[addr] = true
+
+		if addr == sn.IP || addr == a.Gateway() || addr == a.broadcast() || !sn.Contains(addr) {
+			t.Errorf("Allocate returned reserved or foreign address %v", addr)
+		}
+	}
+
+	if _, err := a.Allocate("pod5"); err != ErrExhausted {
+		t.Fatalf("Allocate on a full subnet returned %v, expected ErrExhausted", err)
+	}
+
+	released := mustParseIP4Net("10.1.5.4/32").IP
+	if err := a.Release(released); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	addr, err := a.Allocate("pod6")
+	if err != nil {
+		t.Fatalf("Allocate after Release failed: %v", err)
+	}
+	if addr != released {
+		t.Errorf("Allocate returned %v, expected the released %v", addr, released)
+	}
+
+	if err := a.Release(a.Gateway()); err == nil {
+		t.Error("Release of the gateway address succeeded")
+	}
+}
+
+func TestAllocateSkipsGateway(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	sn := mustParseIP4Net("10.1.5.0/29")
+	gw := mustParseIP4Net("10.1.5.4/32").IP
+	a, err := NewAllocatorWithGateway(sn, gw, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// .1 to .6 less the gateway
+	for i := 0; i < 5; i++ {
+		addr, err := a.Allocate(fmt.Sprint("pod", i))
+		if err != nil {
+			t.Fatalf("Allocate %v failed: %v", i, err)
+		}
+		if addr == gw {
+			t.Fatalf("Allocate handed out the gateway %v", gw)
+		}
+	}
+	if _, err := a.Allocate("pod5"); err != ErrExhausted {
+		t.Fatalf("Allocate on a full subnet returned %v, expected ErrExhausted", err)
+	}
+	if err := a.Release(gw); err == nil {
+		t.Error("Release of the gateway succeeded")
+	}
+
+	for _, bad := range []string{"10.1.5.0/32", "10.1.5.7/32", "10.1.6.1/32"} {
+		if _, err := NewAllocatorWithGateway(sn, mustParseIP4Net(bad).IP, dir); err == nil {
+			t.Errorf("NewAllocatorWithGateway accepted gateway %v", bad)
+		}
+	}
+}
+
+func TestAllocateRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	sn := mustParseIP4Net("10.1.5.0/29")
+	a, err := NewAllocator(sn, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners := make(map[ip.IP4]string)
+	for _, id := range []string{"pod0", "pod1"} {
+		addr, err := a.Allocate(id)
+		if err != nil {
+			t.Fatalf("Allocate failed: %v", err)
+		}
+		owners[addr] = id
+	}
+
+	// a new allocator (e.g. after a restart) picks up where the old one left
+	a, err = NewAllocator(sn, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, id := range owners {
+		owner, err := a.Owner(addr)
+		if err != nil {
+			t.Fatalf("Owner failed: %v", err)
+		}
+		if owner != id {
+			t.Errorf("%v is owned by %q after restart, expected %q", addr, owner, id)
+		}
+	}
+
+	for i := 2; i < 5; i++ {
+		addr, err := a.Allocate(fmt.Sprint("pod", i))
+		if err != nil {
+			t.Fatalf("Allocate %v failed: %v", i, err)
+		}
+		if id, ok := owners[addr]; ok {
+			t.Errorf("%v was allocated again after restart, it belongs to %v", addr, id)
+		}
+		owners[addr] = fmt.Sprint("pod", i)
+	}
+
+	if _, err := a.Allocate("pod5"); err != ErrExhausted {
+		t.Errorf("Allocate on a full subnet returned %v, expected ErrExhausted", err)
+	}
+}
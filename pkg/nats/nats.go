@@ -0,0 +1,165 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nats publishes messages to a NATS server. It speaks just enough
+// of the client protocol (CONNECT, PUB and answering PINGs) to publish,
+// without subscriptions, TLS or authentication.
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+const defaultPort = "4222"
+
+// Publisher publishes to the server at one address, connecting on the
+// first Publish and again after the connection fails
+type Publisher struct {
+	addr    string
+	timeout time.Duration
+
+	mux  sync.Mutex
+	conn net.Conn
+}
+
+// NewPublisher returns a publisher to the server at rawurl
+// (nats://host[:port]), allowing timeout for connecting and each publish
+func NewPublisher(rawurl string, timeout time.Duration) (*Publisher, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a nats://host[:port] URL", rawurl)
+	}
+
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	return &Publisher{addr: addr, timeout: timeout}, nil
+}
+
+// Publish sends data to subject. It returns once the message is written,
+// the server doesn't acknowledge it.
+func (p *Publisher) Publish(subject string, data []byte) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("invalid subject %q", subject)
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data)
+	if err := p.write(p.conn, msg); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection, if any
+func (p *Publisher) Close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *Publisher) write(conn net.Conn, msg string) error {
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err := conn.Write([]byte(msg))
+	return err
+}
+
+// connect dials the server and sends CONNECT once it has sent its INFO;
+// called with mux held
+func (p *Publisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("no INFO from %v: %v", p.addr, err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("expected INFO from %v, got %q", p.addr, strings.TrimSpace(line))
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if err := p.write(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"flanneld\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	go p.serve(conn, r)
+	return nil
+}
+
+// serve answers the PINGs the server sends to check on idle clients and
+// drops the connection on errors it reports
+func (p *Publisher) serve(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			p.mux.Lock()
+			err = p.write(conn, "PONG\r\n")
+			p.mux.Unlock()
+
+		case strings.HasPrefix(line, "-ERR"):
+			log.Errorf("NATS server %v: %v", p.addr, line)
+			err = fmt.Errorf("%v", line)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	conn.Close()
+	if p.conn == conn {
+		p.conn = nil
+	}
+}
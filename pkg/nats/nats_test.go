@@ -0,0 +1,106 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveOne plays a NATS server for one connection, sending the lines it
+// gets (and the payloads after PUB) to lines
+func serveOne(t *testing.T, l net.Listener, lines chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+	// an idle client gets PINGs
+	conn.Write([]byte("PING\r\n"))
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			close(lines)
+			return
+		}
+		lines <- strings.TrimSpace(line)
+	}
+}
+
+func nextLine(t *testing.T, lines <-chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the client")
+		return ""
+	}
+}
+
+func TestPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go serveOne(t, l, lines)
+
+	p, err := NewPublisher("nats://"+l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewPublisher failed: %v", err)
+	}
+	defer p.Close()
+
+	if err := p.Publish("flannel.leases", []byte(`{"type":"added"}`)); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	got := []string{}
+	for len(got) < 4 {
+		got = append(got, nextLine(t, lines))
+	}
+	// the PONG may come before or after the message
+	if !strings.HasPrefix(got[0], "CONNECT {") {
+		t.Errorf("expected CONNECT first, got %q", got[0])
+	}
+	msg := strings.Join(got[1:], "|")
+	if !strings.Contains(msg, `PUB flannel.leases 16|{"type":"added"}`) || !strings.Contains(msg, "PONG") {
+		t.Errorf("unexpected messages %q", got[1:])
+	}
+}
+
+func TestNewPublisher(t *testing.T) {
+	p, err := NewPublisher("nats://broker", time.Second)
+	if err != nil || p.addr != "broker:4222" {
+		t.Errorf("expected the default port, got %v (%v)", p, err)
+	}
+	for _, u := range []string{"kafka://broker:9092", "broker:4222"} {
+		if _, err := NewPublisher(u, time.Second); err == nil {
+			t.Errorf("%q accepted", u)
+		}
+	}
+	if err := (&Publisher{}).Publish("two words", nil); err == nil {
+		t.Error("subject with a space accepted")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selftest measures the TCP throughput to a peer over the overlay,
+// iperf style: a sink served by the peer's flanneld discards whatever it is
+// sent while the client pushes data to it for a while.
+package selftest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const bufSize = 128 * 1024
+
+// Serve accepts connections on l and discards all they send until ctx is done
+func Serve(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				log.Error("Self-test sink stopped: ", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}()
+	}
+}
+
+type Result struct {
+	Streams  int
+	Bytes    int64
+	Duration time.Duration
+	// segments retransmitted, over all streams
+	Retransmits uint32
+}
+
+// Mbps returns the throughput in megabits per second
+func (r *Result) Mbps() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * 8 / r.Duration.Seconds() / 1e6
+}
+
+type streamResult struct {
+	bytes       int64
+	retransmits uint32
+	err         error
+}
+
+// Run sends data to the sink at addr over the given number of parallel
+// streams for duration
+func Run(addr string, duration time.Duration, streams int) (*Result, error) {
+	conns := make([]*net.TCPConn, 0, streams)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < streams; i++ {
+		c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, c.(*net.TCPConn))
+	}
+
+	start := time.Now()
+	deadline := start.Add(duration)
+
+	results := make([]streamResult, streams)
+	wg := sync.WaitGroup{}
+	for i, c := range conns {
+		wg.Add(1)
+		go func(c *net.TCPConn, r *streamResult) {
+			defer wg.Done()
+			r.bytes, r.err = send(c, deadline)
+			if r.err == nil {
+				r.retransmits, r.err = retransmits(c)
+			}
+		}(c, &results[i])
+	}
+	wg.Wait()
+
+	res := &Result{Streams: streams, Duration: time.Since(start)}
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		res.Bytes += r.bytes
+		res.Retransmits += r.retransmits
+	}
+	return res, nil
+}
+
+// send writes to c until deadline and returns the number of bytes written
+func send(c *net.TCPConn, deadline time.Time) (int64, error) {
+	if err := c.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, bufSize)
+	var total int64
+	for {
+		n, err := c.Write(buf)
+		total += int64(n)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selftest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Serve(ctx, l)
+
+	res, err := Run(l.Addr().String(), 200*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if res.Streams != 2 {
+		t.Errorf("Run used %v streams, expected 2", res.Streams)
+	}
+	if res.Duration < 200*time.Millisecond {
+		t.Errorf("Run stopped early, after %v", res.Duration)
+	}
+	if res.Bytes == 0 || res.Mbps() <= 0 {
+		t.Errorf("Run did not send anything: %+v", res)
+	}
+}
+
+func TestRunRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	if _, err := Run(addr, 100*time.Millisecond, 1); err == nil {
+		t.Error("Run succeeded without a sink")
+	}
+}
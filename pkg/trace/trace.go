@@ -0,0 +1,161 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trace carries the W3C trace context (the traceparent header)
+// of requests in contexts, so that the spans of a tracer are linked from
+// the agent through the server to its store calls. Without a Tracer set
+// nothing is traced and a trace context already in a context is only
+// passed on.
+package trace
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Header is the HTTP header the trace context is sent in
+const Header = "traceparent"
+
+// SpanContext identifies a span and the trace it is part of
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+var errMalformed = errors.New("malformed traceparent")
+
+// Parse parses a traceparent header value. Fields that later versions
+// of the format append are ignored.
+func Parse(s string) (SpanContext, error) {
+	sc := SpanContext{}
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errMalformed
+	}
+	if !isHex(parts[0], 1) || !isHex(parts[1], 16) || !isHex(parts[2], 8) || !isHex(parts[3], 1) {
+		return sc, errMalformed
+	}
+
+	var flags [1]byte
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	hex.Decode(flags[:], []byte(parts[3]))
+	sc.Flags = flags[0]
+
+	if !sc.Valid() {
+		return sc, errMalformed
+	}
+	return sc, nil
+}
+
+// isHex reports whether s is n bytes in lowercase hex
+func isHex(s string, n int) bool {
+	if len(s) != 2*n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Valid reports whether neither of the IDs is all zeros
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the trace ID in hex, as used in logs
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// String returns sc as traceparent header value
+func (sc SpanContext) String() string {
+	return "00-" + sc.TraceIDString() + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+type contextKey int
+
+const spanContextKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying sc
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey, sc)
+}
+
+// FromContext returns the SpanContext carried by ctx, if any
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey).(SpanContext)
+	return sc, ok
+}
+
+// Inject sets the traceparent header of h to the trace context of ctx,
+// if it has one
+func Inject(ctx context.Context, h http.Header) {
+	if sc, ok := FromContext(ctx); ok {
+		h.Set(Header, sc.String())
+	}
+}
+
+// Extract returns ctx carrying the trace context of the traceparent
+// header in h. A missing or malformed header leaves ctx as is.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := Parse(h.Get(Header))
+	if err != nil {
+		return ctx
+	}
+	return NewContext(ctx, sc)
+}
+
+// Tracer is implemented by the adapter to a tracing library
+type Tracer interface {
+	// StartSpan starts a span named name, a child of the span of ctx
+	// if it carries one, and returns ctx carrying the context of the
+	// new span along with the function ending it
+	StartSpan(ctx context.Context, name string) (context.Context, func())
+}
+
+var (
+	mux    sync.Mutex
+	tracer Tracer
+)
+
+// SetTracer makes t trace the requests from now on, nil stops tracing
+func SetTracer(t Tracer) {
+	mux.Lock()
+	defer mux.Unlock()
+	tracer = t
+}
+
+// StartSpan starts a span with the Tracer set. Without one it returns ctx
+// unchanged and a function that does nothing.
+func StartSpan(ctx context.Context, name string) (context.Context, func()) {
+	mux.Lock()
+	t := tracer
+	mux.Unlock()
+
+	if t == nil {
+		return ctx, func() {}
+	}
+	return t.StartSpan(ctx, name)
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"strings"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// backendChecker refuses leases to nodes that run another backend than
+// the one their network is configured for, which would otherwise join
+// and silently break the routes to them. Networks migrating between
+// backends are not checked.
+type backendChecker struct {
+	subnet.Manager
+}
+
+func (m *backendChecker) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	cfg, err := m.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	if types := backendLeaseTypes(cfg); types != nil && !types[strings.ToLower(attrs.BackendType)] {
+		log.Warningf("Refusing a lease in network %q to %v: backend type %q does not match the config", network, attrs.PublicIP, attrs.BackendType)
+		return nil, subnet.ErrBackendMismatch
+	}
+	return m.Manager.AcquireLease(ctx, network, attrs)
+}
+
+// backendLeaseTypes returns the BackendTypes the leases of the nodes of
+// a network with cfg may have, nil if any goes
+func backendLeaseTypes(cfg *subnet.Config) map[string]bool {
+	bt := struct {
+		Type        string
+		Fallback    string
+		MigrateFrom json.RawMessage
+	}{Type: "udp"}
+	if len(cfg.Backend) > 0 {
+		// a broken config is for the nodes to report
+		if err := json.Unmarshal(cfg.Backend, &bt); err != nil || bt.Type == "" {
+			return nil
+		}
+	}
+	if len(bt.MigrateFrom) > 0 {
+		return nil
+	}
+
+	types := make(map[string]bool)
+	for _, t := range []string{bt.Type, bt.Fallback} {
+		if t = strings.ToLower(t); t == "" {
+			continue
+		}
+		types[t] = true
+		// only these backends advertise their type in the leases
+		if t != "vxlan" && t != "host-gw" {
+			types[""] = true
+		}
+	}
+	return types
+}
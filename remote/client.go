@@ -17,23 +17,111 @@ package remote
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"path"
+	"strconv"
+	"sync"
+	"time"
 
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/trace"
 	"github.com/coreos/flannel/subnet"
 )
 
+// host part of the URLs of requests sent over a unix socket
+const unixSocketHost = "unix.socket"
+
 // implements subnet.Manager by sending requests to the server
 type RemoteManager struct {
-	base string // includes scheme, host, and port, and version
+	keyFunc subnet.KeyFunc
+	token   string
+	zone    string
+
+	mux       sync.Mutex
+	endpoints []*endpoint
+	// the endpoint picked last
+	current *endpoint
+
+	compressThreshold int
+	enc               requestEncoding
 }
 
+// NewRemoteManager returns a manager talking to the server at listenAddr,
+// either an IP and port or unix:// followed by the path of a unix socket
 func NewRemoteManager(listenAddr string) subnet.Manager {
-	return &RemoteManager{base: "http://" + listenAddr + "/v1"}
+	return NewRemoteManagerWithKeys(listenAddr, subnet.SubnetKey)
+}
+
+// NewRemoteManagerWithKeys is like NewRemoteManager but addresses leases
+// by the keys of keyFunc, which has to match the KeyFunc of the server
+func NewRemoteManagerWithKeys(listenAddr string, keyFunc subnet.KeyFunc) subnet.Manager {
+	return NewRemoteManagerWithOptions(listenAddr, ClientOptions{KeyFunc: keyFunc, KeepAlive: DefaultKeepAlive, CompressThreshold: DefaultCompressThreshold})
+}
+
+// DefaultKeepAlive is well below the few minutes after which stateful
+// firewalls commonly drop idle flows
+const DefaultKeepAlive = 30 * time.Second
+
+type ClientOptions struct {
+	// KeyFunc derives the keys leases are addressed by, which have
+	// to match those of the server, SubnetKey if nil
+	KeyFunc subnet.KeyFunc
+
+	// KeepAlive is the interval of the TCP keep-alive probes on the
+	// connections to the server, so that one dropped silently while a
+	// watch waits on it is detected and the watch reconnects. 0
+	// disables them.
+	KeepAlive time.Duration
+
+	// CompressThreshold is the size in bytes above which request bodies
+	// are sent gzipped, once the server has shown that it accepts them.
+	// 0 disables compression.
+	CompressThreshold int
+
+	// Token, if set, is presented to the server as a bearer token,
+	// for a server scoping requests to the tenant of their token
+	Token string
+
+	// Zone, if set, is the zone of this host. Requests go to the
+	// endpoints in it while any of them is reachable.
+	Zone string
+}
+
+// NewRemoteManagerWithOptions is like NewRemoteManager with opts
+func NewRemoteManagerWithOptions(listenAddr string, opts ClientOptions) subnet.Manager {
+	return NewRemoteManagerWithEndpoints([]Endpoint{{Addr: listenAddr, Weight: 1}}, opts)
+}
+
+// NewRemoteManagerWithEndpoints is like NewRemoteManagerWithOptions but
+// spreads the requests over several servers (e.g. a primary and its
+// replicas) at random by weight, trying another one when a request
+// fails to reach a server
+func NewRemoteManagerWithEndpoints(endpoints []Endpoint, opts ClientOptions) subnet.Manager {
+	keyFunc := opts.KeyFunc
+	if keyFunc == nil {
+		keyFunc = subnet.SubnetKey
+	}
+
+	d := &net.Dialer{KeepAlive: opts.KeepAlive}
+	if opts.KeepAlive <= 0 {
+		// newer Go defaults to sending them when it is 0
+		d.KeepAlive = -1
+	}
+
+	m := &RemoteManager{keyFunc: keyFunc, token: opts.Token, zone: opts.Zone, compressThreshold: opts.CompressThreshold}
+	for _, ep := range endpoints {
+		m.endpoints = append(m.endpoints, newEndpoint(ep, d))
+	}
+	return m
 }
 
 func (m *RemoteManager) mkurl(network string, parts ...string) string {
@@ -43,19 +131,31 @@ func (m *RemoteManager) mkurl(network string, parts ...string) string {
 	if network[0] != '/' {
 		network = "/" + network
 	}
-	return m.base + path.Join(append([]string{network}, parts...)...)
+	// escape the segments, keeping '/' (which the server's routes
+	// allow in network names) as is so that the URL reads the same
+	// whether or not a proxy decodes it on the way
+	// relative to the base of the endpoint the request is sent to
+	p := path.Join(append([]string{network}, parts...)...)
+	return (&neturl.URL{Path: p}).EscapedPath()
 }
 
 func (m *RemoteManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.GetNetworkConfig")
+	defer end()
+
 	url := m.mkurl(network, "config")
 
-	resp, err := httpGet(ctx, url)
+	resp, err := m.httpGet(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, subnet.ErrConfigNotFound
+	default:
 		return nil, httpError(resp)
 	}
 
@@ -67,7 +167,34 @@ func (m *RemoteManager) GetNetworkConfig(ctx context.Context, network string) (*
 	return config, nil
 }
 
+func (m *RemoteManager) GetNetworkStats(ctx context.Context, network string) (*subnet.NetworkStats, error) {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.GetNetworkStats")
+	defer end()
+
+	url := m.mkurl(network, "stats")
+
+	resp, err := m.httpGet(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpError(resp)
+	}
+
+	stats := &subnet.NetworkStats{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
 func (m *RemoteManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.AcquireLease")
+	defer end()
+
 	url := m.mkurl(network, "leases/")
 
 	body, err := json.Marshal(attrs)
@@ -75,13 +202,33 @@ func (m *RemoteManager) AcquireLease(ctx context.Context, network string, attrs
 		return nil, err
 	}
 
-	resp, err := httpPutPost(ctx, "POST", url, "application/json", body)
-	if err != nil {
-		return nil, err
+	var resp *http.Response
+	for {
+		resp, err = m.httpPutPost(ctx, "POST", url, "application/json", body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+
+		// the server is busy allocating for others
+		resp.Body.Close()
+		select {
+		case <-time.After(retryDelay(resp)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return nil, subnet.ErrDuplicatePublicIP
+	case http.StatusUnprocessableEntity:
+		return nil, subnet.ErrBackendMismatch
+	default:
 		return nil, httpError(resp)
 	}
 
@@ -94,14 +241,17 @@ func (m *RemoteManager) AcquireLease(ctx context.Context, network string, attrs
 }
 
 func (m *RemoteManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
-	url := m.mkurl(network, "leases", lease.Key())
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.RenewLease")
+	defer end()
+
+	url := m.mkurl(network, "leases", m.keyFunc(lease))
 
 	body, err := json.Marshal(lease)
 	if err != nil {
 		return err
 	}
 
-	resp, err := httpPutPost(ctx, "PUT", url, "application/json", body)
+	resp, err := m.httpPutPost(ctx, "PUT", url, "application/json", body)
 	if err != nil {
 		return err
 	}
@@ -120,7 +270,102 @@ func (m *RemoteManager) RenewLease(ctx context.Context, network string, lease *s
 	return nil
 }
 
+func (m *RemoteManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.UpdateLeaseAttrs")
+	defer end()
+
+	url := m.mkurl(network, "leases", m.keyFunc(&subnet.Lease{Subnet: sn, Attrs: attrs}), "attrs")
+
+	body, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.httpPutPost(ctx, "PUT", url, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return nil, subnet.ErrDuplicatePublicIP
+	default:
+		return nil, httpError(resp)
+	}
+
+	newLease := &subnet.Lease{}
+	if err := json.NewDecoder(resp.Body).Decode(newLease); err != nil {
+		return nil, err
+	}
+
+	return newLease, nil
+}
+
+// GetLease returns the current lease of sn or subnet.ErrLeaseNotFound
+func (m *RemoteManager) GetLease(ctx context.Context, network string, sn ip.IP4Net) (*subnet.Lease, error) {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.GetLease")
+	defer end()
+
+	url := m.mkurl(network, "leases", sn.StringSep(".", "-"))
+
+	resp, err := m.httpGet(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, subnet.ErrLeaseNotFound
+	default:
+		return nil, httpError(resp)
+	}
+
+	lease := &subnet.Lease{}
+	if err := json.NewDecoder(resp.Body).Decode(lease); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+func (m *RemoteManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	return m.DrainLease(ctx, network, sn, nil)
+}
+
+func (m *RemoteManager) DrainLease(ctx context.Context, network string, sn ip.IP4Net, r *subnet.Reservation) error {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.DrainLease")
+	defer end()
+
+	// only the subnet is known here, which servers take in place of any key
+	url := m.mkurl(network, "leases", sn.StringSep(".", "-"))
+	if r != nil {
+		q := neturl.Values{}
+		q.Set("reserve-for", r.Hostname)
+		q.Set("reserve-ttl", r.TTL.String())
+		url += "?" + q.Encode()
+	}
+
+	resp, err := m.httpDo(ctx, "DELETE", url, http.Header{}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return httpError(resp)
+	}
+
+	return nil
+}
+
 func (m *RemoteManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	ctx, end := trace.StartSpan(ctx, "RemoteManager.WatchLeases")
+	defer end()
+
 	url := m.mkurl(network, "leases")
 
 	if cursor != nil {
@@ -132,7 +377,7 @@ func (m *RemoteManager) WatchLeases(ctx context.Context, network string, cursor
 		url = fmt.Sprintf("%v?next=%v", url, c)
 	}
 
-	resp, err := httpGet(ctx, url)
+	resp, err := m.httpGet(ctx, url)
 	if err != nil {
 		return subnet.WatchResult{}, err
 	}
@@ -152,12 +397,49 @@ func (m *RemoteManager) WatchLeases(ctx context.Context, network string, cursor
 	return wr, nil
 }
 
+// HTTPError is returned when the server responds with a non-200 status.
+// RequestID can be used to find the matching entry in the server logs.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RequestID  string
+}
+
+func (e *HTTPError) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("%v: %v", e.Status, e.Body)
+	}
+	return fmt.Sprintf("%v: %v (request %v)", e.Status, e.Body, e.RequestID)
+}
+
 func httpError(resp *http.Response) error {
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
-	return fmt.Errorf("%v: %v", resp.Status, string(b))
+
+	// prefer the ID echoed by the server but fall back to the one we sent
+	reqID := resp.Header.Get(requestIDHeader)
+	if reqID == "" && resp.Request != nil {
+		reqID = resp.Request.Header.Get(requestIDHeader)
+	}
+
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(b),
+		RequestID:  reqID,
+	}
+}
+
+// retryDelay returns how long resp (a 429) says to wait
+func retryDelay(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		secs = retryAfter
+	}
+	return time.Duration(secs) * time.Second
 }
 
 type httpRespErr struct {
@@ -165,11 +447,68 @@ type httpRespErr struct {
 	err  error
 }
 
-func httpDo(ctx context.Context, req *http.Request) (*http.Response, error) {
+// httpDo sends a request for url (as returned by mkurl) to one of the
+// endpoints, trying the others in turn while it fails to reach them
+func (m *RemoteManager) httpDo(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	if header.Get(requestIDHeader) == "" {
+		header.Set(requestIDHeader, newRequestID())
+	}
+	trace.Inject(ctx, header)
+	if m.token != "" {
+		header.Set("Authorization", "Bearer "+m.token)
+	}
+
+	tried := make(map[*endpoint]bool)
+	for {
+		ep := m.pick(tried)
+
+		var rbody io.Reader
+		if body != nil {
+			rbody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, ep.base+url, rbody)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := m.send(ctx, ep, req)
+		if err == nil || ctx.Err() != nil {
+			if err == nil {
+				m.reached(ep, true)
+			}
+			return resp, err
+		}
+
+		m.reached(ep, false)
+		tried[ep] = true
+		if len(tried) == len(m.endpoints) {
+			return nil, err
+		}
+		log.Warningf("Failed to reach %v, trying another server: %v", ep.Addr, err)
+	}
+}
+
+func (m *RemoteManager) send(ctx context.Context, ep *endpoint, req *http.Request) (*http.Response, error) {
+	// writes sent to a read-only replica get a 307 to the primary
+	// which the client follows, resending the method and body
+	tr := &http.Transport{Dial: ep.dial}
+	client := &http.Client{Transport: tr}
+	if m.token != "" {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			// dropped when the primary is another host
+			req.Header.Set("Authorization", "Bearer "+m.token)
+			return nil
+		}
+	}
+
 	// Run the HTTP request in a goroutine (so it can be canceled) and pass
 	// the result via the channel c
-	tr := &http.Transport{}
-	client := &http.Client{Transport: tr}
 	c := make(chan httpRespErr, 1)
 	go func() {
 		resp, err := client.Do(req)
@@ -182,24 +521,41 @@ func httpDo(ctx context.Context, req *http.Request) (*http.Response, error) {
 		<-c // Wait for f to return.
 		return nil, ctx.Err()
 	case r := <-c:
+		if r.resp != nil {
+			m.enc.learn(r.resp)
+		}
 		return r.resp, r.err
 	}
 }
 
-func httpGet(ctx context.Context, url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+func (m *RemoteManager) httpGet(ctx context.Context, url string) (*http.Response, error) {
+	return m.httpDo(ctx, "GET", url, http.Header{}, nil)
+}
+
+func (m *RemoteManager) httpPutPost(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, error) {
+	if m.compressThreshold > 0 && len(body) > m.compressThreshold && m.enc.acceptsGzip() {
+		zbody, err := gzipBody(body)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := m.httpSend(ctx, method, url, contentType, "gzip", zbody)
+		if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+			return resp, err
+		}
+		// the server no longer takes gzip, which httpDo has
+		// taken note of; send it again uncompressed
+		resp.Body.Close()
 	}
 
-	return httpDo(ctx, req)
+	return m.httpSend(ctx, method, url, contentType, "", body)
 }
 
-func httpPutPost(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
+func (m *RemoteManager) httpSend(ctx context.Context, method, url, contentType, encoding string, body []byte) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
 	}
-	req.Header.Set("Content-Type", contentType)
-	return httpDo(ctx, req)
+	return m.httpDo(ctx, method, url, header, body)
 }
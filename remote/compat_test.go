@@ -0,0 +1,185 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// the lease of a flannel version predating most LeaseAttrs fields
+type oldLease struct {
+	Subnet ip.IP4Net
+	Attrs  *struct {
+		PublicIP    ip.IP4
+		BackendType string          `json:",omitempty"`
+		BackendData json.RawMessage `json:",omitempty"`
+	}
+	Expiration time.Time
+}
+
+// versionedServer answers acquires and renews like a server of another
+// version: it decodes requests into (a copy of) lease and echoes them,
+// along with extra attrs (JSON fields) unknown to this version
+type versionedServer struct {
+	lease interface{}
+	extra string
+
+	mux     sync.Mutex
+	renewed []byte
+}
+
+func (s *versionedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := fmt.Sprintf(`{"Subnet": "10.1.5.0/24", "Attrs": %s, "Expiration": %q}`, body, time.Now().Add(time.Hour).Format(time.RFC3339))
+	if r.Method == "PUT" {
+		s.mux.Lock()
+		s.renewed = body
+		s.mux.Unlock()
+		reply = string(body)
+	}
+
+	// tolerant, like every version of the server
+	if err := json.Unmarshal([]byte(reply), s.lease); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	data, _ := json.Marshal(s.lease)
+	if s.extra != "" {
+		data = bytes.Replace(data, []byte(`"Attrs":{`), []byte(`"Attrs":{`+s.extra+`,`), 1)
+	}
+	w.Write(data)
+}
+
+func TestCompatNewClientOldServer(t *testing.T) {
+	for _, srv := range []*versionedServer{
+		{lease: &oldLease{}},
+		{lease: &subnet.Lease{}, extra: `"Future":{"x":1}`},
+	} {
+		server := httptest.NewServer(srv)
+		sm := NewRemoteManager(strings.TrimPrefix(server.URL, "http://"))
+		ctx := context.Background()
+
+		notReady := false
+		attrs := &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Zone: "a", Version: "0.5.0", Ready: &notReady}
+		l, err := sm.AcquireLease(ctx, "", attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease from %T server failed: %v", srv.lease, err)
+		}
+		if l.Attrs.PublicIP != attrs.PublicIP {
+			t.Errorf("unexpected attrs from %T server: %+v", srv.lease, l.Attrs)
+		}
+
+		if err := sm.RenewLease(ctx, "", l); err != nil {
+			t.Fatalf("RenewLease with %T server failed: %v", srv.lease, err)
+		}
+
+		if srv.extra == "" {
+			// fields the old server dropped read as their default
+			if l.Attrs.Zone != "" || !l.Attrs.IsReady() {
+				t.Errorf("old server returned new fields: %+v", l.Attrs)
+			}
+		} else if !bytes.Contains(srv.renewed, []byte(`"Future":{"x":1}`)) {
+			t.Errorf("renewal dropped the fields unknown to the client: %s", srv.renewed)
+		}
+
+		server.Close()
+	}
+}
+
+func TestCompatOldClientNewServer(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := subnet.NewMockManager(1, config)
+	server := httptest.NewServer(newRouter(ctx, sm, ServerOptions{}))
+	defer server.Close()
+
+	for _, attrs := range []string{
+		// older and newer clients than the server
+		`{"PublicIP": "1.1.1.1"}`,
+		`{"PublicIP": "1.1.1.2", "Future": {"x": 1}}`,
+	} {
+		resp, err := http.Post(server.URL+"/v1/_/leases", "application/json", strings.NewReader(attrs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lease, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("acquiring with %s failed: %v %s", attrs, resp.StatusCode, lease)
+		}
+
+		var l subnet.Lease
+		if err := json.Unmarshal(lease, &l); err != nil {
+			t.Fatal(err)
+		}
+
+		// renew with the lease exactly as the client got it
+		req, err := http.NewRequest("PUT", server.URL+"/v1/_/leases/"+l.Key(), bytes.NewReader(lease))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("renewing with %s failed: %v", attrs, resp.StatusCode)
+		}
+	}
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wr.Snapshot) != 2 {
+		t.Fatalf("expected 2 leases, got %v", wr.Snapshot)
+	}
+	for _, l := range wr.Snapshot {
+		future := l.Attrs.Unknown["Future"]
+		switch l.Attrs.PublicIP.String() {
+		case "1.1.1.1":
+			if future != nil {
+				t.Errorf("lease of the old client gained a field: %s", future)
+			}
+		case "1.1.1.2":
+			if string(future) != `{"x":1}` {
+				t.Errorf("field unknown to the server not stored: %+v", l.Attrs)
+			}
+		}
+	}
+}
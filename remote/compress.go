@@ -0,0 +1,114 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressThreshold is the size above which request bodies are
+// compressed once the server accepts that
+const DefaultCompressThreshold = 1024
+
+// Servers list the encodings they accept for request bodies in the
+// Accept-Encoding header of their responses (RFC 7694), which is how
+// clients learn that they may send them compressed. Servers predating
+// this don't send it and get uncompressed bodies only.
+const acceptEncodingHeader = "Accept-Encoding"
+
+// requestEncoding tracks whether the server accepts gzip request bodies
+type requestEncoding struct {
+	mux  sync.Mutex
+	gzip bool
+}
+
+func acceptsGzip(h http.Header) bool {
+	for _, enc := range strings.Split(h.Get(acceptEncodingHeader), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// learn takes note of what the server said in the response to a request
+func (e *requestEncoding) learn(resp *http.Response) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if resp.StatusCode == http.StatusUnsupportedMediaType {
+		// a server rolled back to an older version
+		e.gzip = false
+	} else if acceptsGzip(resp.Header) {
+		e.gzip = true
+	}
+}
+
+func (e *requestEncoding) acceptsGzip() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.gzip
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type gzipBodyReader struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (r gzipBodyReader) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
+// decodeRequestBody has the handlers read the body of req decompressed.
+// It writes a 415 and returns false if req is in an unsupported encoding.
+func decodeRequestBody(w http.ResponseWriter, req *http.Request) bool {
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return true
+
+	case "gzip":
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "malformed gzip request body: "+err.Error())
+			return false
+		}
+		req.Body = gzipBodyReader{zr, req.Body}
+		req.Header.Del("Content-Encoding")
+		req.ContentLength = -1
+		return true
+	}
+
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	io.WriteString(w, "unsupported Content-Encoding: "+req.Header.Get("Content-Encoding"))
+	return false
+}
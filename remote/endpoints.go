@@ -0,0 +1,196 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long an endpoint that could not be reached is passed over; replaced in tests
+var endpointRetry = 30 * time.Second
+
+// Endpoint is a server (or replica) a RemoteManager sends requests to
+type Endpoint struct {
+	// Addr is an IP and port or unix:// followed by the path of a
+	// unix socket, as taken by NewRemoteManager
+	Addr string
+	// Weight is the share of the requests the endpoint gets
+	// relative to the others it is picked among
+	Weight int
+	// Zone, if set, is the zone of the server, see ClientOptions.Zone
+	Zone string
+}
+
+// ParseEndpoints parses a comma-delimited list of ADDR[;weight=N][;zone=Z],
+// weights defaulting to 1
+func ParseEndpoints(s string) ([]Endpoint, error) {
+	var eps []Endpoint
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(spec), ";")
+		ep := Endpoint{Addr: parts[0], Weight: 1}
+		if ep.Addr == "" {
+			return nil, fmt.Errorf("%q: missing address", spec)
+		}
+
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%q: expected key=value, got %q", spec, p)
+			}
+			switch kv[0] {
+			case "weight":
+				w, err := strconv.Atoi(kv[1])
+				if err != nil || w <= 0 {
+					return nil, fmt.Errorf("%q: weight must be a positive integer", spec)
+				}
+				ep.Weight = w
+			case "zone":
+				ep.Zone = kv[1]
+			default:
+				return nil, fmt.Errorf("%q: unknown key %q", spec, kv[0])
+			}
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+type endpoint struct {
+	Endpoint
+	base string // includes scheme, host, and port, and version
+	dial func(network, addr string) (net.Conn, error)
+
+	// when a request last failed to reach it, zero once one succeeds;
+	// guarded by RemoteManager.mux
+	failedAt time.Time
+}
+
+func newEndpoint(ep Endpoint, d *net.Dialer) *endpoint {
+	if ep.Weight <= 0 {
+		ep.Weight = 1
+	}
+
+	if strings.HasPrefix(ep.Addr, "unix://") {
+		path := strings.TrimPrefix(ep.Addr, "unix://")
+		return &endpoint{
+			Endpoint: ep,
+			base:     "http://" + unixSocketHost + "/v1",
+			dial: func(network, addr string) (net.Conn, error) {
+				// a redirect (from a replica) may lead elsewhere
+				if addr != unixSocketHost+":80" {
+					return d.Dial(network, addr)
+				}
+				return net.Dial("unix", path)
+			},
+		}
+	}
+
+	return &endpoint{Endpoint: ep, base: "http://" + ep.Addr + "/v1", dial: d.Dial}
+}
+
+func (ep *endpoint) healthy(now time.Time) bool {
+	return now.Sub(ep.failedAt) >= endpointRetry
+}
+
+// pick returns one of the endpoints not in tried at random by weight.
+// Healthy ones in the zone of the client come first, then the other
+// healthy ones, then those that failed lately.
+func (m *RemoteManager) pick(tried map[*endpoint]bool) *endpoint {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := time.Now()
+	var local, healthy, rest []*endpoint
+	for _, ep := range m.endpoints {
+		switch {
+		case tried[ep]:
+		case !ep.healthy(now):
+			rest = append(rest, ep)
+		case m.zone != "" && ep.Zone == m.zone:
+			local = append(local, ep)
+			healthy = append(healthy, ep)
+		default:
+			healthy = append(healthy, ep)
+		}
+	}
+
+	candidates := rest
+	if len(local) > 0 {
+		candidates = local
+	} else if len(healthy) > 0 {
+		candidates = healthy
+	}
+
+	total := 0
+	for _, ep := range candidates {
+		total += ep.Weight
+	}
+	n := rand.Intn(total)
+	for _, ep := range candidates {
+		if n -= ep.Weight; n < 0 {
+			m.current = ep
+			return ep
+		}
+	}
+	panic("unreachable")
+}
+
+// reached records whether a request reached ep
+func (m *RemoteManager) reached(ep *endpoint, ok bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if ok {
+		ep.failedAt = time.Time{}
+	} else {
+		ep.failedAt = time.Now()
+	}
+}
+
+// EndpointStatus is an endpoint of a RemoteManager and whether it is
+// picked from (Healthy) or passed over since a request failed to reach it
+type EndpointStatus struct {
+	Endpoint
+	Healthy bool
+	// Current is set on the endpoint the last request went to
+	Current bool
+}
+
+// Endpoints returns the state of the endpoints of m
+func (m *RemoteManager) Endpoints() []EndpointStatus {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := time.Now()
+	eps := make([]EndpointStatus, 0, len(m.endpoints))
+	for _, ep := range m.endpoints {
+		eps = append(eps, EndpointStatus{Endpoint: ep.Endpoint, Healthy: ep.healthy(now), Current: ep == m.current})
+	}
+	return eps
+}
+
+// EndpointsHandler serves the Endpoints of m as JSON
+func EndpointsHandler(m *RemoteManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Endpoints())
+	})
+}
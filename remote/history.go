@@ -0,0 +1,285 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// replaced in tests
+var (
+	historyNow   = time.Now
+	historyRetry = time.Second
+)
+
+// sinceCursor asks eventHistory.WatchLeases for the events recorded
+// after a point in time
+type sinceCursor time.Time
+
+// sinceError is returned for watches since a time the history of the
+// network doesn't reach back to
+type sinceError struct {
+	since, start time.Time
+}
+
+func (e *sinceError) Error() string {
+	return fmt.Sprintf("lease events since %v are not retained, the history of the network starts at %v",
+		e.since.Format(time.RFC3339), e.start.Format(time.RFC3339))
+}
+
+type timedBatch struct {
+	at     time.Time
+	events []subnet.Event
+	// where a watch goes on from after the batch
+	cursor string
+}
+
+// networkHistory is the log of the lease events of a network. It is
+// complete from start on: before it the events were not seen, or were
+// dropped for being older than the retention.
+type networkHistory struct {
+	ready chan struct{}
+	// set once the network turned out not to exist
+	err     error
+	start   time.Time
+	batches []timedBatch
+	cursor  string
+}
+
+// eventHistory is a Manager that follows the leases of each network it
+// is asked about and keeps the events it sees, with the time they were
+// recorded, for retention. A watch with a sinceCursor gets the events
+// recorded after its time right away, along with the cursor to go on
+// from; other calls pass through.
+type eventHistory struct {
+	subnet.Manager
+
+	ctx       context.Context
+	retention time.Duration
+
+	mux      sync.Mutex
+	networks map[string]*networkHistory
+}
+
+func newEventHistory(ctx context.Context, sm subnet.Manager, retention time.Duration) *eventHistory {
+	return &eventHistory{
+		Manager:   sm,
+		ctx:       ctx,
+		retention: retention,
+		networks:  make(map[string]*networkHistory),
+	}
+}
+
+// track returns the history of network, starting to follow it if need
+// be. Only networks whose config was found are to be tracked.
+func (h *eventHistory) track(network string) *networkHistory {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	nh, ok := h.networks[network]
+	if !ok {
+		nh = &networkHistory{ready: make(chan struct{})}
+		h.networks[network] = nh
+		go h.follow(network, nh)
+	}
+	return nh
+}
+
+// tracked returns the history of network, tracking it if its config
+// is found
+func (h *eventHistory) tracked(ctx context.Context, network string) (*networkHistory, error) {
+	h.mux.Lock()
+	nh, ok := h.networks[network]
+	h.mux.Unlock()
+	if ok {
+		return nh, nil
+	}
+
+	if _, err := h.Manager.GetNetworkConfig(ctx, network); err != nil {
+		return nil, err
+	}
+	return h.track(network), nil
+}
+
+// evict stops tracking network, which no longer exists
+func (h *eventHistory) evict(network string, nh *networkHistory) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	log.Infof("Network %q is gone, no longer recording its lease events", network)
+	if h.networks[network] == nh {
+		delete(h.networks, network)
+	}
+	nh.err = subnet.ErrConfigNotFound
+	if nh.ready != nil {
+		close(nh.ready)
+		nh.ready = nil
+	}
+}
+
+// follow records the events of network into nh until the server is done
+// or the network is deleted
+func (h *eventHistory) follow(network string, nh *networkHistory) {
+	var cursor interface{}
+	for {
+		if cursor == nil {
+			// starting over, e.g. after the network was deleted
+			if _, err := h.Manager.GetNetworkConfig(h.ctx, network); err == subnet.ErrConfigNotFound {
+				h.evict(network, nh)
+				return
+			}
+		}
+
+		wr, err := h.Manager.WatchLeases(h.ctx, network, cursor)
+		if err != nil {
+			if h.ctx.Err() != nil {
+				return
+			}
+			switch err {
+			case subnet.ErrCursorExpired:
+				cursor = nil
+				continue
+			case subnet.ErrConfigNotFound:
+				h.evict(network, nh)
+				return
+			}
+
+			log.Warningf("Failed to watch the leases of %q for the event history: %v", network, err)
+			select {
+			case <-time.After(historyRetry):
+			case <-h.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		c, err := cursorString(wr.Cursor)
+		if err != nil {
+			log.Errorf("Stopped recording the lease events of %q: %v", network, err)
+			return
+		}
+
+		h.mux.Lock()
+		now := historyNow()
+		switch {
+		case cursor == nil:
+			// whatever happened before the snapshot is unknown
+			if nh.cursor != "" {
+				log.Warningf("Lease event history of %q lost track, it starts over", network)
+			}
+			nh.start = now
+			nh.batches = nil
+		case len(wr.Events) > 0:
+			nh.batches = append(nh.batches, timedBatch{now, wr.Events, c})
+		}
+		nh.cursor = c
+		nh.prune(now.Add(-h.retention))
+
+		if cursor == nil && nh.ready != nil {
+			close(nh.ready)
+			nh.ready = nil
+		}
+		h.mux.Unlock()
+
+		cursor = wr.Cursor
+	}
+}
+
+// prune drops the batches recorded before horizon
+func (nh *networkHistory) prune(horizon time.Time) {
+	for len(nh.batches) > 0 && nh.batches[0].at.Before(horizon) {
+		nh.start = nh.batches[0].at
+		nh.batches = nh.batches[1:]
+	}
+}
+
+// since returns the events of nh recorded after t and where to go on
+// from; it has to be called with eventHistory.mux held
+func (nh *networkHistory) since(t time.Time) (subnet.WatchResult, error) {
+	if t.Before(nh.start) {
+		return subnet.WatchResult{}, &sinceError{t, nh.start}
+	}
+
+	events := []subnet.Event{}
+	for _, b := range nh.batches {
+		if b.at.After(t) {
+			events = append(events, b.events...)
+		}
+	}
+	return subnet.WatchResult{Events: events, Cursor: nh.cursor}, nil
+}
+
+func (h *eventHistory) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	// clients fetch the config first, the history of their network
+	// is best started before they change it
+	config, err := h.Manager.GetNetworkConfig(ctx, network)
+	if err == nil {
+		h.track(network)
+	}
+	return config, err
+}
+
+func (h *eventHistory) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	t, ok := cursor.(sinceCursor)
+	if !ok {
+		return h.Manager.WatchLeases(ctx, network, cursor)
+	}
+
+	nh, err := h.tracked(ctx, network)
+	if err != nil {
+		return subnet.WatchResult{}, err
+	}
+
+	h.mux.Lock()
+	ready := nh.ready
+	h.mux.Unlock()
+	if ready != nil {
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return subnet.WatchResult{}, ctx.Err()
+		}
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if nh.err != nil {
+		return subnet.WatchResult{}, nh.err
+	}
+	nh.prune(historyNow().Add(-h.retention))
+	return nh.since(time.Time(t))
+}
+
+// parseSince returns the cursor of the since parameter of a watch, nil if
+// there is none
+func parseSince(r *http.Request) (interface{}, error) {
+	s := r.URL.Query().Get("since")
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, fmt.Errorf("since must be an RFC 3339 time: %v", err)
+	}
+	return sinceCursor(t), nil
+}
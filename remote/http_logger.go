@@ -15,8 +15,10 @@
 package remote
 
 import (
-	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"net/http"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/pkg/trace"
 )
 
 type httpResp struct {
@@ -42,9 +44,20 @@ type httpLoggerHandler struct {
 }
 
 func (lh httpLoggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqID := r.Header.Get(requestIDHeader)
+	if reqID == "" {
+		reqID = newRequestID()
+		r.Header.Set(requestIDHeader, reqID)
+	}
+	w.Header().Set(requestIDHeader, reqID)
+
 	resp := &httpResp{w, 0}
 	lh.h.ServeHTTP(resp, r)
-	log.Infof("%v %v - %v", r.Method, r.RequestURI, resp.status)
+	if sc, err := trace.Parse(r.Header.Get(trace.Header)); err == nil {
+		log.Infof("%v %v - %v (request %v, trace %v)", r.Method, r.RequestURI, resp.status, reqID, sc.TraceIDString())
+		return
+	}
+	log.Infof("%v %v - %v (request %v)", r.Method, r.RequestURI, resp.status, reqID)
 }
 
 func httpLogger(h http.Handler) http.Handler {
@@ -0,0 +1,182 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// seconds clients are told to wait before retrying a turned away request
+const retryAfter = 1
+
+// acquireLimiter bounds the number of lease allocations in progress so
+// that a burst of them does not turn into a storm of conflicting etcd
+// writes. Up to queue more wait for their turn, for at most wait (if
+// non-zero), the rest are turned away.
+type acquireLimiter struct {
+	running  chan struct{}
+	admitted chan struct{}
+	wait     time.Duration
+}
+
+func newAcquireLimiter(max, queue int, wait time.Duration) *acquireLimiter {
+	return &acquireLimiter{
+		running:  make(chan struct{}, max),
+		admitted: make(chan struct{}, max+queue),
+		wait:     wait,
+	}
+}
+
+func (l *acquireLimiter) limit(h handler) handler {
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.admitted <- struct{}{}:
+			defer func() { <-l.admitted }()
+		default:
+			r.Body.Close()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, "too many lease requests in progress")
+			return
+		}
+
+		var timeout <-chan time.Time
+		if l.wait > 0 {
+			t := time.NewTimer(l.wait)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case l.running <- struct{}{}:
+			defer func() { <-l.running }()
+		case <-r.Context().Done():
+			// the client gave up
+			r.Body.Close()
+			return
+		case <-timeout:
+			r.Body.Close()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, "timed out waiting for the lease requests in progress")
+			return
+		case <-ctx.Done():
+			r.Body.Close()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		h(ctx, sm, w, r)
+	}
+}
+
+// watchLimiter bounds the number of watches in progress, in total and
+// per client address, so that a client opening watches by the thousand
+// can't exhaust the fds and goroutines of the server. Watches beyond
+// either limit (if non-zero) are turned away with a 503.
+type watchLimiter struct {
+	max   int
+	perIP int
+
+	mux     sync.Mutex
+	running int
+	byIP    map[string]int
+}
+
+func newWatchLimiter(max, perIP int) *watchLimiter {
+	return &watchLimiter{max: max, perIP: perIP, byIP: make(map[string]int)}
+}
+
+// clientIP is the address of the client of r, empty for unix sockets
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *watchLimiter) admit(ip string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.max > 0 && l.running >= l.max || l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return false
+	}
+	l.running++
+	l.byIP[ip]++
+	return true
+}
+
+func (l *watchLimiter) release(ip string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.running--
+	if l.byIP[ip]--; l.byIP[ip] == 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+func (l *watchLimiter) limit(h handler) handler {
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !l.admit(ip) {
+			r.Body.Close()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "too many lease watches in progress")
+			return
+		}
+		defer l.release(ip)
+
+		h(ctx, sm, w, r)
+	}
+}
+
+// deadlineConn fails writes its peer doesn't take within timeout. The
+// handler writing then ends and the connection is closed, rather than
+// a client that stopped reading (e.g. a watch stream) holding on to it.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+type deadlineListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l deadlineListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &deadlineConn{c, l.timeout}, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ErrMaintenance is returned for writes while etcd is unreachable
+var ErrMaintenance = errors.New("etcd is unreachable, the server is in maintenance mode and read-only")
+
+// how long a watch waits before it is answered as stalled; replaced in tests
+var stalledWatchDelay = 10 * time.Second
+
+// knownLeases is the last known state of the leases of a network: a
+// snapshot and the events that followed it, up to cursor
+type knownLeases struct {
+	leases map[ip.IP4Net]subnet.Lease
+	cursor string
+}
+
+// maintenanceManager keeps the last network configs and lease snapshots
+// it passed on. While etcd is unreachable it serves them, with watches
+// marked as stalled, and turns writes away with ErrMaintenance. It goes
+// back to normal as soon as a request makes it to etcd again.
+type maintenanceManager struct {
+	subnet.Manager
+
+	mux     sync.Mutex
+	down    bool
+	since   time.Time
+	reason  string
+	configs map[string]*subnet.Config
+	known   map[string]*knownLeases
+}
+
+func newMaintenanceManager(sm subnet.Manager) *maintenanceManager {
+	return &maintenanceManager{
+		Manager: sm,
+		configs: make(map[string]*subnet.Config),
+		known:   make(map[string]*knownLeases),
+	}
+}
+
+// unreachable reports whether err means that etcd (or the database in
+// its place) could not be reached, rather than that it turned the
+// request down. Other errors (ErrConfigNotFound, running out of
+// subnets, ...) are answers of a working store.
+func unreachable(err error) bool {
+	switch e := err.(type) {
+	case *etcd.EtcdError:
+		return e.ErrorCode == etcd.ErrCodeEtcdNotReachable
+	case net.Error:
+		return true
+	}
+	return err == driver.ErrBadConn
+}
+
+// check notes the outcome of a request to etcd and returns whether
+// the server is (now) in maintenance
+func (m *maintenanceManager) check(err error) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	switch {
+	case err == nil:
+		if m.down {
+			log.Infof("etcd is back after %v, leaving maintenance mode", time.Since(m.since))
+			m.down = false
+		}
+
+	case unreachable(err):
+		if !m.down {
+			log.Warningf("etcd is unreachable, serving the last known configs and leases read-only: %v", err)
+			m.down, m.since = true, time.Now()
+		}
+		m.reason = err.Error()
+	}
+	return m.down
+}
+
+func (m *maintenanceManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	cfg, err := m.Manager.GetNetworkConfig(ctx, network)
+	m.check(err)
+	if err != nil {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		if cached, ok := m.configs[network]; ok && m.down {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	m.mux.Lock()
+	m.configs[network] = cfg
+	m.mux.Unlock()
+	return cfg, nil
+}
+
+func (m *maintenanceManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	wr, err := m.Manager.WatchLeases(ctx, network, cursor)
+	if !m.check(err) {
+		if err == nil {
+			m.remember(network, cursor, wr)
+		}
+		return wr, err
+	}
+
+	m.mux.Lock()
+	known := m.known[network]
+	m.mux.Unlock()
+	if known == nil {
+		return wr, err
+	}
+
+	if cursor == nil {
+		stalled := subnet.WatchResult{Snapshot: []subnet.Lease{}, Cursor: known.cursor, Stalled: true}
+		for _, l := range known.leases {
+			stalled.Snapshot = append(stalled.Snapshot, l)
+		}
+		return stalled, nil
+	}
+
+	// nothing changes while etcd is away; hold the watch a while
+	// so that clients don't spin and tell them it is stalled
+	select {
+	case <-watchAfter(stalledWatchDelay):
+	case <-ctx.Done():
+		return subnet.WatchResult{}, ctx.Err()
+	}
+	return subnet.WatchResult{Cursor: cursor, Stalled: true}, nil
+}
+
+// remember updates the known leases of network with wr, a snapshot or
+// the events following the known ones
+func (m *maintenanceManager) remember(network string, cursor interface{}, wr subnet.WatchResult) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	known := m.known[network]
+	switch {
+	case wr.Snapshot != nil:
+		known = &knownLeases{leases: make(map[ip.IP4Net]subnet.Lease)}
+		for _, l := range wr.Snapshot {
+			known.leases[l.Subnet] = l
+		}
+		m.known[network] = known
+
+	case known != nil && cursor != nil && fmt.Sprint(cursor) == known.cursor:
+		for _, e := range wr.Events {
+			switch e.Type {
+			case subnet.SubnetAdded:
+				known.leases[e.Lease.Subnet] = e.Lease
+			case subnet.SubnetRemoved:
+				delete(known.leases, e.Lease.Subnet)
+			}
+		}
+
+	default:
+		// events of a watch that is behind or ahead of the known
+		// leases (or there are none yet), they don't apply
+		return
+	}
+	known.cursor = fmt.Sprint(wr.Cursor)
+}
+
+func (m *maintenanceManager) GetLease(ctx context.Context, network string, sn ip.IP4Net) (*subnet.Lease, error) {
+	l, err := m.Manager.GetLease(ctx, network, sn)
+	if !m.check(err) {
+		return l, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if known := m.known[network]; known != nil {
+		if l, ok := known.leases[sn]; ok {
+			return &l, nil
+		}
+		return nil, subnet.ErrLeaseNotFound
+	}
+	return nil, err
+}
+
+// write turns the error of a write into ErrMaintenance while in maintenance
+func (m *maintenanceManager) write(err error) error {
+	if m.check(err) && err != nil {
+		return ErrMaintenance
+	}
+	return err
+}
+
+func (m *maintenanceManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+	return l, m.write(err)
+}
+
+func (m *maintenanceManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	return m.write(m.Manager.RenewLease(ctx, network, lease))
+}
+
+func (m *maintenanceManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	l, err := m.Manager.UpdateLeaseAttrs(ctx, network, sn, attrs)
+	return l, m.write(err)
+}
+
+func (m *maintenanceManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	return m.write(m.Manager.RevokeLease(ctx, network, sn))
+}
+
+func (m *maintenanceManager) DrainLease(ctx context.Context, network string, sn ip.IP4Net, r *subnet.Reservation) error {
+	return m.write(m.Manager.DrainLease(ctx, network, sn, r))
+}
+
+type maintenanceStatus struct {
+	Enabled     bool       `json:"enabled"`
+	Maintenance bool       `json:"maintenance"`
+	Since       *time.Time `json:"since,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// GET /healthz
+func handleHealthz(m *maintenanceManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := maintenanceStatus{}
+		if m != nil {
+			m.mux.Lock()
+			status = maintenanceStatus{Enabled: true, Maintenance: m.down}
+			if m.down {
+				since := m.since
+				status.Since, status.Reason = &since, m.reason
+			}
+			m.mux.Unlock()
+		}
+		jsonResponse(w, http.StatusOK, status)
+	}
+}
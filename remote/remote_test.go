@@ -15,17 +15,29 @@
 package remote
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/trace"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -41,7 +53,7 @@ func TestRemote(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		RunServer(ctx, sm, addr)
+		RunServer(ctx, sm, addr, ServerOptions{})
 		wg.Done()
 	}()
 
@@ -51,6 +63,45 @@ func TestRemote(t *testing.T) {
 	wg.Wait()
 }
 
+func TestRemoteUnixSocket(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	sm := subnet.NewMockManager(1, config)
+
+	dir, err := ioutil.TempDir("", "flannel-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flannel.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		RunServer(ctx, sm, "unix://"+path, ServerOptions{})
+		wg.Done()
+	}()
+
+	for i := 0; ; i++ {
+		fi, err := os.Stat(path)
+		if err == nil {
+			if fi.Mode().Perm() != unixSocketMode {
+				t.Errorf("socket has mode %v, expected %v", fi.Mode().Perm(), os.FileMode(unixSocketMode))
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not create %v", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	doTestRemote(ctx, t, "unix://"+path)
+
+	cancel()
+	wg.Wait()
+}
+
 func mustParseIP4(s string) ip.IP4 {
 	a, err := ip.ParseIP4(s)
 	if err != nil {
@@ -70,6 +121,9 @@ func mustParseIP4Net(s string) ip.IP4Net {
 func isConnRefused(err error) bool {
 	if uerr, ok := err.(*url.Error); ok {
 		if operr, ok := uerr.Err.(*net.OpError); ok {
+			if serr, ok := operr.Err.(*os.SyscallError); ok {
+				return serr.Err == syscall.ECONNREFUSED
+			}
 			return operr.Err == syscall.ECONNREFUSED
 		}
 	}
@@ -113,10 +167,44 @@ func doTestRemote(ctx context.Context, t *testing.T, remoteAddr string) {
 		t.Errorf("AcquireLease returned subnet not in network: %v (in %v)", l.Subnet, expectedNetwork)
 	}
 
+	stats, err := sm.GetNetworkStats(ctx, "_")
+	switch {
+	case err != nil:
+		t.Errorf("GetNetworkStats failed: %v", err)
+	case stats.Leased != 1 || stats.Leased+stats.Reserved+stats.Free != stats.Total:
+		t.Errorf("GetNetworkStats returned bad counts: %+v", stats)
+	}
+
 	if err = sm.RenewLease(ctx, "_", l); err != nil {
 		t.Errorf("RenewLease failed: %v", err)
 	}
 
+	newAttrs := &subnet.LeaseAttrs{
+		PublicIP: mustParseIP4("1.1.1.3"),
+	}
+	ul, err := sm.UpdateLeaseAttrs(ctx, "_", l.Subnet, newAttrs)
+	switch {
+	case err != nil:
+		t.Errorf("UpdateLeaseAttrs failed: %v", err)
+	case !ul.Subnet.Equal(l.Subnet):
+		t.Errorf("UpdateLeaseAttrs changed the subnet: %v vs %v", ul.Subnet, l.Subnet)
+	case ul.Attrs.PublicIP != newAttrs.PublicIP:
+		t.Errorf("UpdateLeaseAttrs returned bad PublicIP: %v vs %v", ul.Attrs.PublicIP, newAttrs.PublicIP)
+	}
+
+	if err = sm.RevokeLease(ctx, "_", l.Subnet); err != nil {
+		t.Errorf("RevokeLease failed: %v", err)
+	}
+
+	l, err = sm.AcquireLease(ctx, "_", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	r := &subnet.Reservation{Hostname: "replacement", TTL: time.Minute}
+	if err = sm.DrainLease(ctx, "_", l.Subnet, r); err != nil {
+		t.Errorf("DrainLease failed: %v", err)
+	}
+
 	doTestWatch(t, sm)
 }
 
@@ -157,3 +245,1915 @@ func doTestWatch(t *testing.T, sm subnet.Manager) {
 		t.Errorf("WatchSubnet produced wrong subnet: expected %s, got %s", l.Key(), evt.Lease.Key())
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(requestIDHeader)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "boom")
+	})
+
+	ts := httptest.NewServer(httpLogger(h))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+	_, err := sm.GetNetworkConfig(context.Background(), "_")
+	if err == nil {
+		t.Fatal("GetNetworkConfig succeeded against failing server")
+	}
+
+	if seen == "" {
+		t.Fatalf("Server did not receive %v header", requestIDHeader)
+	}
+
+	herr, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("GetNetworkConfig returned %T, expected *HTTPError", err)
+	}
+	if herr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("HTTPError has wrong status: %v", herr.StatusCode)
+	}
+	if herr.RequestID != seen {
+		t.Errorf("HTTPError has wrong request ID: expected %v, got %v", seen, herr.RequestID)
+	}
+	if !strings.Contains(err.Error(), seen) {
+		t.Errorf("Error message does not contain request ID: %v", err)
+	}
+}
+
+func TestReplicaRedirectScheme(t *testing.T) {
+	for _, tc := range []struct {
+		primary string
+		tls     bool
+		expect  string
+	}{
+		{"10.1.2.3:8080", false, "http://10.1.2.3:8080/v1/_/leases"},
+		// reached the way the replica was
+		{"10.1.2.3:8080", true, "https://10.1.2.3:8080/v1/_/leases"},
+		{"https://10.1.2.3:8443", false, "https://10.1.2.3:8443/v1/_/leases"},
+		{"http://primary:8080", true, "http://primary:8080/v1/_/leases"},
+	} {
+		r := httptest.NewRequest("POST", "/v1/_/leases", nil)
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		redirectToPrimary(tc.primary)(w, r)
+
+		if loc := w.Header().Get("Location"); loc != tc.expect {
+			t.Errorf("primary %q (TLS %v): redirected to %q, expected %q", tc.primary, tc.tls, loc, tc.expect)
+		}
+	}
+}
+
+func TestReplicaRedirect(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primarySM := subnet.NewMockManager(1, config)
+	primary := httptest.NewServer(httpLogger(newRouter(ctx, primarySM, ServerOptions{})))
+	defer primary.Close()
+
+	replicaSM := subnet.NewMockManager(1, config)
+	replica := httptest.NewServer(httpLogger(newRouter(ctx, replicaSM, ServerOptions{Primary: strings.TrimPrefix(primary.URL, "http://")})))
+	defer replica.Close()
+
+	// the replica answers writes with a redirect...
+	noFollow := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := noFollow.Post(replica.URL+"/v1/_/leases", "application/json", strings.NewReader(`{"PublicIP": "1.1.1.1"}`))
+	if err != nil {
+		t.Fatalf("POST to replica failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("replica answered write with %v, expected %v", resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, primary.URL) {
+		t.Errorf("replica redirected to %q, expected %v", loc, primary.URL)
+	}
+
+	// ...which RemoteManager follows to the primary
+	sm := NewRemoteManager(strings.TrimPrefix(replica.URL, "http://"))
+
+	l, err := sm.AcquireLease(ctx, "_", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease via replica failed: %v", err)
+	}
+
+	if err := sm.RenewLease(ctx, "_", l); err != nil {
+		t.Errorf("RenewLease via replica failed: %v", err)
+	}
+
+	wr, err := primarySM.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases on primary failed: %v", err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Errorf("lease %v was not acquired on the primary: %v", l.Subnet, wr.Snapshot)
+	}
+
+	// reads are served by the replica itself
+	if _, err := sm.GetNetworkConfig(ctx, "_"); err != nil {
+		t.Errorf("GetNetworkConfig via replica failed: %v", err)
+	}
+	wr, err = replicaSM.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases on replica failed: %v", err)
+	}
+	if len(wr.Snapshot) != 0 {
+		t.Errorf("replica store was written to: %v", wr.Snapshot)
+	}
+}
+
+// fakeClock hands out timers that fire once Advance moves past them
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (clk *fakeClock) After(d time.Duration) <-chan time.Time {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	c := make(chan time.Time, 1)
+	clk.timers = append(clk.timers, fakeTimer{clk.now.Add(d), c})
+	return c
+}
+
+func (clk *fakeClock) Advance(d time.Duration) {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	clk.now = clk.now.Add(d)
+	pending := clk.timers[:0]
+	for _, t := range clk.timers {
+		if t.deadline.After(clk.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- clk.now
+		}
+	}
+	clk.timers = pending
+}
+
+func (clk *fakeClock) Now() time.Time {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	return clk.now
+}
+
+func (clk *fakeClock) pending() int {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	return len(clk.timers)
+}
+
+func TestWatchMaxLifetime(t *testing.T) {
+	clk := &fakeClock{now: time.Now()}
+	defer func(f func(time.Duration) <-chan time.Time) { watchAfter = f }(watchAfter)
+	watchAfter = clk.After
+
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(httpLogger(newRouter(ctx, subnet.NewMockManager(1, config), ServerOptions{MaxWatchLifetime: time.Minute})))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+	wr, err := sm.WatchLeases(ctx, "_", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	cursor := wr.Cursor
+
+	type result struct {
+		wr  subnet.WatchResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		wr, err := sm.WatchLeases(ctx, "_", cursor)
+		done <- result{wr, err}
+	}()
+
+	for i := 0; clk.pending() == 0; i++ {
+		if i == 100 {
+			t.Fatal("watch did not start its lifetime timer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	clk.Advance(59 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("watch returned before its lifetime was over")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case res := <-done:
+		switch {
+		case res.err != nil:
+			t.Errorf("watch ended with an error: %v", res.err)
+		case res.wr.Snapshot != nil || len(res.wr.Events) != 0:
+			t.Errorf("watch returned leases: %#v", res.wr)
+		case res.wr.Cursor != cursor:
+			t.Errorf("watch returned cursor %v, expected %v", res.wr.Cursor, cursor)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not return after its lifetime")
+	}
+}
+
+// networkRecorder records the networks the server asks about
+type networkRecorder struct {
+	subnet.Manager
+	mu       sync.Mutex
+	networks map[string]bool
+}
+
+func (m *networkRecorder) record(network string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.networks[network] = true
+}
+
+func (m *networkRecorder) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	m.record(network)
+	return m.Manager.GetNetworkConfig(ctx, network)
+}
+
+func (m *networkRecorder) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.record(network)
+	return m.Manager.AcquireLease(ctx, network, attrs)
+}
+
+func (m *networkRecorder) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	m.record(network)
+	return m.Manager.RenewLease(ctx, network, lease)
+}
+
+func (m *networkRecorder) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.record(network)
+	return m.Manager.UpdateLeaseAttrs(ctx, network, sn, attrs)
+}
+
+func (m *networkRecorder) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	m.record(network)
+	return m.Manager.RevokeLease(ctx, network, sn)
+}
+
+func (m *networkRecorder) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	m.record(network)
+	return m.Manager.WatchLeases(ctx, network, cursor)
+}
+
+// prefixProxy strips /flannel off the paths of the requests it passes on
+// to target, leaving the raw path either as is or (decoded) unset
+func prefixProxy(t *testing.T, target string, keepRaw bool) *httptest.Server {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	direct := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		direct(r)
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/flannel")
+		if keepRaw {
+			r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, "/flannel")
+		} else {
+			r.URL.RawPath = ""
+		}
+	}
+	return httptest.NewServer(proxy)
+}
+
+func TestRemoteBehindProxy(t *testing.T) {
+	const network = "tenant/blue 100%"
+
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec := &networkRecorder{Manager: subnet.NewMockManager(1, config), networks: make(map[string]bool)}
+	server := httptest.NewServer(httpLogger(newRouter(ctx, rec, ServerOptions{})))
+	defer server.Close()
+
+	for _, keepRaw := range []bool{true, false} {
+		proxy := prefixProxy(t, server.URL, keepRaw)
+		sm := NewRemoteManager(strings.TrimPrefix(proxy.URL, "http://") + "/flannel")
+
+		if _, err := sm.GetNetworkConfig(ctx, network); err != nil {
+			t.Errorf("GetNetworkConfig via proxy failed: %v", err)
+		}
+
+		l, err := sm.AcquireLease(ctx, network, &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")})
+		if err != nil {
+			t.Fatalf("AcquireLease via proxy failed: %v", err)
+		}
+		if err := sm.RenewLease(ctx, network, l); err != nil {
+			t.Errorf("RenewLease via proxy failed: %v", err)
+		}
+		if _, err := sm.UpdateLeaseAttrs(ctx, network, l.Subnet, &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.2")}); err != nil {
+			t.Errorf("UpdateLeaseAttrs via proxy failed: %v", err)
+		}
+
+		wr, err := sm.WatchLeases(ctx, network, nil)
+		switch {
+		case err != nil:
+			t.Errorf("WatchLeases via proxy failed: %v", err)
+		case len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet):
+			t.Errorf("WatchLeases via proxy returned %v, expected lease %v", wr.Snapshot, l.Subnet)
+		}
+
+		if err := sm.RevokeLease(ctx, network, l.Subnet); err != nil {
+			t.Errorf("RevokeLease via proxy failed: %v", err)
+		}
+
+		proxy.Close()
+	}
+
+	if len(rec.networks) != 1 || !rec.networks[network] {
+		t.Errorf("server saw networks %v, expected only %q", rec.networks, network)
+	}
+}
+
+// contendedManager tracks how many AcquireLease calls are in progress,
+// each taking until release is closed or a short while passes
+type contendedManager struct {
+	subnet.Manager
+	mu          sync.Mutex
+	inflight    int
+	maxInflight int
+	release     chan struct{}
+}
+
+func (m *contendedManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	m.mu.Lock()
+	m.inflight++
+	if m.inflight > m.maxInflight {
+		m.maxInflight = m.inflight
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-m.release:
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight--
+
+	// the mock registry is not safe for concurrent use
+	return m.Manager.AcquireLease(ctx, network, attrs)
+}
+
+func TestAcquireLimit(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := &contendedManager{Manager: subnet.NewMockManager(1, config)}
+	server := httptest.NewServer(newRouter(ctx, cm, ServerOptions{MaxConcurrentAcquires: 2, AcquireQueue: 10}))
+	defer server.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(server.URL, "http://"))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			attrs := &subnet.LeaseAttrs{PublicIP: ip.IP4(i + 1)}
+			if _, err := sm.AcquireLease(ctx, "_", attrs); err != nil {
+				t.Errorf("AcquireLease failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if cm.maxInflight != 2 {
+		t.Errorf("expected at most 2 allocations at once, saw %v", cm.maxInflight)
+	}
+}
+
+func TestAcquireLimitQueueFull(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := &contendedManager{Manager: subnet.NewMockManager(1, config), release: make(chan struct{})}
+	l := newAcquireLimiter(1, 0, 0)
+
+	// holds the only slot until release is closed
+	done := make(chan struct{})
+	go func() {
+		w := httptest.NewRecorder()
+		l.limit(handleAcquireLease)(ctx, cm, w, httptest.NewRequest("POST", "/v1/_/leases", strings.NewReader(`{"PublicIP": "1.1.1.1"}`)))
+		close(done)
+	}()
+	for {
+		cm.mu.Lock()
+		n := cm.inflight
+		cm.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	l.limit(handleAcquireLease)(ctx, cm, w, httptest.NewRequest("POST", "/v1/_/leases", strings.NewReader(`{"PublicIP": "1.1.1.2"}`)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("allocation beyond the queue got %v, expected %v", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	close(cm.release)
+	<-done
+}
+
+func TestAcquireLimitQueueTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	l := newAcquireLimiter(1, 1, 50*time.Millisecond)
+	h := l.limit(func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	acquire := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(ctx, nil, w, r)
+		return w
+	}
+	newRequest := func() *http.Request {
+		return httptest.NewRequest("POST", "/v1/_/leases", strings.NewReader(`{"PublicIP": "1.1.1.1"}`))
+	}
+
+	// holds the only slot until release is closed
+	done := make(chan struct{})
+	go func() {
+		acquire(newRequest())
+		close(done)
+	}()
+	<-started
+
+	w := acquire(newRequest())
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("allocation queued past the timeout got %v, expected %v", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	// a client that gives up leaves the queue before the timeout
+	rctx, rcancel := context.WithCancel(ctx)
+	rcancel()
+	begin := time.Now()
+	acquire(newRequest().WithContext(rctx))
+	if waited := time.Since(begin); waited >= 50*time.Millisecond {
+		t.Errorf("allocation of a client that gave up waited %v", waited)
+	}
+
+	close(release)
+	<-done
+	select {
+	case <-started:
+		t.Error("allocation turned away was run")
+	default:
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := subnet.NewMockManager(1, config)
+	h := newRouter(ctx, sm, ServerOptions{})
+
+	migrated := &subnet.LeaseAttrs{
+		PublicIP:    mustParseIP4("1.1.1.1"),
+		BackendType: "udp",
+		Backends:    map[string]json.RawMessage{"udp": nil, "vxlan": json.RawMessage(`{}`)},
+	}
+	if _, err := sm.AcquireLease(ctx, "", migrated); err != nil {
+		t.Fatal(err)
+	}
+	l, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(code int, pending []ip.IP4Net) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/_/migration/vxlan", nil))
+		if w.Code != code {
+			t.Errorf("expected status %v, got %v", code, w.Code)
+		}
+
+		var status subnet.MigrationStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode migration status: %v", err)
+		}
+		if status.Migrated != 2-len(pending) || !reflect.DeepEqual(status.Pending, pending) {
+			t.Errorf("expected %v pending, got %+v", pending, status)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, []ip.IP4Net{l.Subnet})
+
+	if _, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.2"), BackendType: "vxlan"}); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusOK, []ip.IP4Net{})
+}
+
+func TestLeaseKeys(t *testing.T) {
+	for _, tc := range []struct {
+		keyFunc subnet.KeyFunc
+		key     func(l *subnet.Lease) string
+	}{
+		{subnet.SubnetKey, func(l *subnet.Lease) string { return l.Subnet.StringSep(".", "-") }},
+		{subnet.NodeKey, func(l *subnet.Lease) string { return "node-a" }},
+	} {
+		config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		paths := []string{}
+		router := newRouter(ctx, subnet.NewMockManagerWithKeys(0, config, tc.keyFunc), ServerOptions{KeyFunc: tc.keyFunc})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.Method+" "+r.URL.Path)
+			router.ServeHTTP(w, r)
+		}))
+
+		sm := NewRemoteManagerWithKeys(strings.TrimPrefix(ts.URL, "http://"), tc.keyFunc)
+
+		attrs := &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Hostname: "node-a"}
+		l, err := sm.AcquireLease(ctx, "", attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		key := tc.key(l)
+
+		if err := sm.RenewLease(ctx, "", l); err != nil {
+			t.Errorf("RenewLease of %q failed: %v", key, err)
+		}
+		if _, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &subnet.LeaseAttrs{PublicIP: attrs.PublicIP, Hostname: "node-a", Zone: "z1"}); err != nil {
+			t.Errorf("UpdateLeaseAttrs of %q failed: %v", key, err)
+		}
+
+		wr, err := sm.WatchLeases(ctx, "", nil)
+		if err != nil {
+			t.Fatalf("WatchLeases failed: %v", err)
+		}
+		if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) || wr.Snapshot[0].Attrs.Zone != "z1" {
+			t.Errorf("Snapshot does not have the updated lease of %v: %v", l.Subnet, wr.Snapshot)
+		}
+
+		if err := sm.RevokeLease(ctx, "", l.Subnet); err != nil {
+			t.Errorf("RevokeLease of %q failed: %v", key, err)
+		}
+		if wr, err := sm.WatchLeases(ctx, "", nil); err != nil || len(wr.Snapshot) != 0 {
+			t.Errorf("Lease still there after revoking it: %v, %v", wr.Snapshot, err)
+		}
+
+		for _, p := range []string{
+			"PUT /v1/_/leases/" + key,
+			"PUT /v1/_/leases/" + key + "/attrs",
+		} {
+			found := false
+			for _, seen := range paths {
+				found = found || seen == p
+			}
+			if !found {
+				t.Errorf("Client did not send %v: %v", p, paths)
+			}
+		}
+
+		ts.Close()
+		cancel()
+	}
+}
+
+func TestGetLease(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(newRouter(ctx, subnet.NewMockManager(0, config), ServerOptions{}))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+	attrs := &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Hostname: "node-a"}
+	l, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	got, err := sm.GetLease(ctx, "", l.Subnet)
+	if err != nil {
+		t.Fatalf("GetLease failed: %v", err)
+	}
+	if !got.Subnet.Equal(l.Subnet) || got.Attrs.PublicIP != attrs.PublicIP || got.Attrs.Hostname != "node-a" {
+		t.Errorf("GetLease returned the wrong lease: %v %+v", got.Subnet, got.Attrs)
+	}
+
+	if _, err := sm.GetLease(ctx, "", mustParseIP4Net("10.1.254.0/24")); err != subnet.ErrLeaseNotFound {
+		t.Errorf("GetLease of a non-existent lease: expected ErrLeaseNotFound, got %v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/_/leases/not-a-subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Malformed subnet: expected 400, got %v", resp.Status)
+	}
+}
+
+func TestDuplicatePublicIP(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(newRouter(ctx, subnet.NewMockManager(0, config), ServerOptions{}))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+	if _, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Hostname: "node-a"}); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	_, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Hostname: "node-b"})
+	if err != subnet.ErrDuplicatePublicIP {
+		t.Errorf("AcquireLease of a duplicate PublicIP: expected ErrDuplicatePublicIP, got %v", err)
+	}
+}
+
+func TestBackendMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, tc := range []struct {
+		backend string
+		types   map[string]bool
+	}{
+		{``, map[string]bool{"": true, "udp": true, "vxlan": false}},
+		{`, "Backend": {"Type": "vxlan"}`, map[string]bool{"vxlan": true, "VXLAN": true, "host-gw": false, "": false}},
+		{`, "Backend": {"Type": "vxlan", "Fallback": "udp"}`, map[string]bool{"vxlan": true, "": true, "host-gw": false}},
+		{`, "Backend": {"Type": "vxlan", "MigrateFrom": {"Type": "host-gw"}}`, map[string]bool{"vxlan": true, "host-gw": true, "": true}},
+	} {
+		config := fmt.Sprintf(`{"Network": %q%v}`, expectedNetwork, tc.backend)
+		ts := httptest.NewServer(newRouter(ctx, subnet.NewMockManager(0, config), ServerOptions{}))
+		sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+		i := 0
+		for bt, ok := range tc.types {
+			i++
+			attrs := &subnet.LeaseAttrs{PublicIP: mustParseIP4(fmt.Sprintf("1.1.1.%v", i)), BackendType: bt}
+			_, err := sm.AcquireLease(ctx, "", attrs)
+			switch {
+			case ok && err != nil:
+				t.Errorf("%v: AcquireLease of a %q lease failed: %v", config, bt, err)
+			case !ok && err != subnet.ErrBackendMismatch:
+				t.Errorf("%v: AcquireLease of a %q lease: expected ErrBackendMismatch, got %v", config, bt, err)
+			}
+		}
+		ts.Close()
+	}
+}
+
+// traceManager records the trace context of the AcquireLease calls
+type traceManager struct {
+	subnet.Manager
+	mux  sync.Mutex
+	seen []trace.SpanContext
+}
+
+func (m *traceManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if sc, ok := trace.FromContext(ctx); ok {
+		m.mux.Lock()
+		m.seen = append(m.seen, sc)
+		m.mux.Unlock()
+	}
+	return m.Manager.AcquireLease(ctx, network, attrs)
+}
+
+// childTracer starts spans with the next span ID of the trace of ctx
+type childTracer struct {
+	mux   sync.Mutex
+	names []string
+}
+
+func (t *childTracer) StartSpan(ctx context.Context, name string) (context.Context, func()) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.names = append(t.names, name)
+
+	sc, _ := trace.FromContext(ctx)
+	sc.SpanID[7]++
+	return trace.NewContext(ctx, sc), func() {}
+}
+
+func TestTraceContext(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tm := &traceManager{Manager: subnet.NewMockManager(0, config)}
+	ts := httptest.NewServer(newRouter(ctx, tm, ServerOptions{}))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+	sc, err := trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")}
+
+	// without a tracer the trace context is passed on as is
+	if _, err := sm.AcquireLease(trace.NewContext(ctx, sc), "", attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	// and nothing is sent without one
+	if _, err := sm.AcquireLease(ctx, "", attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	if len(tm.seen) != 1 || tm.seen[0] != sc {
+		t.Fatalf("server saw trace contexts %v, expected %v", tm.seen, sc)
+	}
+
+	tracer := &childTracer{}
+	trace.SetTracer(tracer)
+	defer trace.SetTracer(nil)
+
+	tm.seen = nil
+	if _, err := sm.AcquireLease(trace.NewContext(ctx, sc), "", attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	// a span of the client and one of the server
+	if len(tm.seen) != 1 || tm.seen[0].TraceID != sc.TraceID || tm.seen[0].SpanID[7] != sc.SpanID[7]+2 {
+		t.Errorf("server saw trace contexts %v, expected a grandchild of %v", tm.seen, sc)
+	}
+	if len(tracer.names) != 2 || tracer.names[0] != "RemoteManager.AcquireLease" {
+		t.Errorf("unexpected spans %v", tracer.names)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	for _, tc := range []struct {
+		keepAlive time.Duration
+		enabled   int
+	}{
+		{7 * time.Second, 1},
+		{0, 0},
+	} {
+		sm := NewRemoteManagerWithOptions(addr, ClientOptions{KeepAlive: tc.keepAlive}).(*RemoteManager)
+		conn, err := sm.endpoints[0].dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial %v: %v", addr, err)
+		}
+		f, err := conn.(*net.TCPConn).File()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fd := int(f.Fd())
+		if on, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); err != nil || on != tc.enabled {
+			t.Errorf("KeepAlive %v: expected SO_KEEPALIVE to be %v, got %v (%v)", tc.keepAlive, tc.enabled, on, err)
+		}
+		if tc.enabled == 1 {
+			if idle, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); err != nil || idle != 7 {
+				t.Errorf("expected keep-alive probes after 7s, got %v (%v)", idle, err)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestWatchReconnectsOnDroppedConnection(t *testing.T) {
+	var mux sync.Mutex
+	watches := 0
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("next") == "" {
+			jsonResponse(w, http.StatusOK, subnet.WatchResult{Snapshot: []subnet.Lease{}, Cursor: "1"})
+			return
+		}
+
+		mux.Lock()
+		watches++
+		first := watches == 1
+		mux.Unlock()
+
+		if first {
+			// the connection dies while the watch waits on it
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack the watch: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		l := subnet.Lease{Subnet: mustParseIP4Net("10.1.5.0/24"), Attrs: &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")}}
+		jsonResponse(w, http.StatusOK, subnet.WatchResult{Events: []subnet.Event{{Type: subnet.SubnetAdded, Lease: l}}, Cursor: "2"})
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, sm, "_", events)
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case batch := <-events:
+			if len(batch) == 0 {
+				continue
+			}
+			if batch[0].Lease.Subnet.String() != "10.1.5.0/24" {
+				t.Errorf("Unexpected events after reconnecting: %v", batch)
+			}
+			mux.Lock()
+			defer mux.Unlock()
+			if watches != 2 {
+				t.Errorf("Expected the watch to be retried once, it was sent %v times", watches)
+			}
+			return
+
+		case <-deadline:
+			t.Fatal("Timed out waiting for the watch to reconnect")
+		}
+	}
+}
+
+// outageManager fails as if etcd was unreachable while down is set
+type outageManager struct {
+	subnet.Manager
+
+	mux  sync.Mutex
+	down bool
+}
+
+func (m *outageManager) setDown(down bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.down = down
+}
+
+func (m *outageManager) err() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.down {
+		return &etcd.EtcdError{ErrorCode: etcd.ErrCodeEtcdNotReachable, Message: "All the given peers are not reachable"}
+	}
+	return nil
+}
+
+func (m *outageManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	if err := m.err(); err != nil {
+		return nil, err
+	}
+	return m.Manager.GetNetworkConfig(ctx, network)
+}
+
+func (m *outageManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if err := m.err(); err != nil {
+		return nil, err
+	}
+	return m.Manager.AcquireLease(ctx, network, attrs)
+}
+
+func (m *outageManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	if err := m.err(); err != nil {
+		return err
+	}
+	return m.Manager.RenewLease(ctx, network, lease)
+}
+
+func (m *outageManager) GetLease(ctx context.Context, network string, sn ip.IP4Net) (*subnet.Lease, error) {
+	if err := m.err(); err != nil {
+		return nil, err
+	}
+	return m.Manager.GetLease(ctx, network, sn)
+}
+
+func (m *outageManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if err := m.err(); err != nil {
+		return subnet.WatchResult{}, err
+	}
+	return m.Manager.WatchLeases(ctx, network, cursor)
+}
+
+func maintenanceStatusOf(t *testing.T, url string) maintenanceStatus {
+	resp, err := http.Get(url + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	status := maintenanceStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	clk := &fakeClock{now: time.Now()}
+	defer func(f func(time.Duration) <-chan time.Time) { watchAfter = f }(watchAfter)
+	watchAfter = clk.After
+
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	om := &outageManager{Manager: subnet.NewMockManager(0, config)}
+	ts := httptest.NewServer(newRouter(ctx, om, ServerOptions{Maintenance: true}))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+	// what agents read before etcd goes away
+	l, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if _, err := sm.GetNetworkConfig(ctx, ""); err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if _, err := sm.WatchLeases(ctx, "", nil); err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	om.setDown(true)
+
+	cfg, err := sm.GetNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed while etcd is down: %v", err)
+	}
+	if cfg.Network.String() != expectedNetwork {
+		t.Errorf("cached config has network %v", cfg.Network)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed while etcd is down: %v", err)
+	}
+	if !wr.Stalled || len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Errorf("expected a stalled snapshot of %v, got %+v", l.Subnet, wr)
+	}
+
+	if got, err := sm.GetLease(ctx, "", l.Subnet); err != nil || !got.Subnet.Equal(l.Subnet) {
+		t.Errorf("GetLease from the cache: %v, %v", got, err)
+	}
+
+	// watches are held for a while, then end stalled
+	done := make(chan subnet.WatchResult, 1)
+	go func() {
+		wr, err := sm.WatchLeases(ctx, "", wr.Cursor)
+		if err != nil {
+			t.Errorf("watch failed while etcd is down: %v", err)
+		}
+		done <- wr
+	}()
+	for i := 0; clk.pending() == 0; i++ {
+		if i == 100 {
+			t.Fatal("stalled watch was not held")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	clk.Advance(stalledWatchDelay)
+	if res := <-done; !res.Stalled || len(res.Events) != 0 {
+		t.Errorf("expected a stalled watch without events, got %+v", res)
+	}
+
+	err = sm.RenewLease(ctx, "", l)
+	if herr, ok := err.(*HTTPError); !ok || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("RenewLease while etcd is down: expected a 503, got %v", err)
+	}
+	_, err = sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.2")})
+	if herr, ok := err.(*HTTPError); !ok || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("AcquireLease while etcd is down: expected a 503, got %v", err)
+	}
+
+	if status := maintenanceStatusOf(t, ts.URL); !status.Maintenance || status.Since == nil {
+		t.Errorf("/healthz does not report the maintenance: %+v", status)
+	}
+
+	// and back to normal with etcd
+	om.setDown(false)
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Errorf("RenewLease failed after etcd came back: %v", err)
+	}
+	if status := maintenanceStatusOf(t, ts.URL); status.Maintenance {
+		t.Errorf("still in maintenance after etcd came back: %+v", status)
+	}
+}
+
+// oneNetworkManager only knows the default network
+type oneNetworkManager struct {
+	subnet.Manager
+}
+
+func (m *oneNetworkManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	if network != "" {
+		return nil, subnet.ErrConfigNotFound
+	}
+	return m.Manager.GetNetworkConfig(ctx, network)
+}
+
+func TestMaintenanceNotForRefusals(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	om := &oneNetworkManager{subnet.NewMockManager(0, config)}
+	ts := httptest.NewServer(newRouter(ctx, om, ServerOptions{Maintenance: true}))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+
+	// a mistyped network is an answer of etcd, not an outage
+	if _, err := sm.GetNetworkConfig(ctx, "typo"); err == nil {
+		t.Fatal("GetNetworkConfig of an unknown network succeeded")
+	}
+	if status := maintenanceStatusOf(t, ts.URL); status.Maintenance {
+		t.Errorf("in maintenance after a config was not found: %+v", status)
+	}
+	if _, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")}); err != nil {
+		t.Errorf("AcquireLease failed after a config was not found: %v", err)
+	}
+}
+
+// idleManager has no lease events but its store revision advances with
+// every snapshot, as it would with writes elsewhere in etcd. Cursor
+// "0.1" is outside its history.
+type idleManager struct {
+	subnet.Manager
+	mux sync.Mutex
+	rev int
+}
+
+func (m *idleManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if cursor == nil {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		m.rev++
+		return subnet.WatchResult{
+			Snapshot: []subnet.Lease{{Subnet: mustParseIP4Net("10.1.5.0/24"), Attrs: &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")}}},
+			Cursor:   fmt.Sprint(m.rev),
+		}, nil
+	}
+	if cursor == "0.1" {
+		return subnet.WatchResult{}, subnet.ErrCursorExpired
+	}
+	<-ctx.Done()
+	return subnet.WatchResult{}, ctx.Err()
+}
+
+func openWatchStream(t *testing.T, url string) (*json.Decoder, func()) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", WatchStreamType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("watch stream request failed: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != WatchStreamType {
+		resp.Body.Close()
+		t.Fatalf("watch stream served as %q", ct)
+	}
+	return json.NewDecoder(resp.Body), func() { resp.Body.Close() }
+}
+
+type testWatchEvent struct {
+	Type   string `json:"type"`
+	Object struct {
+		leaseObject
+		Code int `json:"code"`
+	} `json:"object"`
+}
+
+func TestWatchStreamBookmarks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(newRouter(ctx, &idleManager{}, ServerOptions{WatchBookmarkInterval: 20 * time.Millisecond}))
+	defer ts.Close()
+
+	dec, done := openWatchStream(t, ts.URL+"/v1/_/leases")
+	defer done()
+
+	var evt testWatchEvent
+	if err := dec.Decode(&evt); err != nil {
+		t.Fatalf("failed to decode the first event: %v", err)
+	}
+	if evt.Type != watchAdded || evt.Object.Metadata.Name != "10.1.5.0-24" || evt.Object.Lease == nil || evt.Object.Metadata.ResourceVersion != "1" {
+		t.Fatalf("expected the lease ADDED at resourceVersion 1, got %+v", evt)
+	}
+
+	last := 0
+	for i := 0; i < 3; i++ {
+		evt = testWatchEvent{}
+		if err := dec.Decode(&evt); err != nil {
+			t.Fatalf("failed to decode event: %v", err)
+		}
+		if evt.Type != watchBookmark {
+			t.Fatalf("expected a BOOKMARK while idle, got %+v", evt)
+		}
+
+		var rv int
+		fmt.Sscan(evt.Object.Metadata.ResourceVersion, &rv)
+		if rv <= last {
+			t.Errorf("bookmark did not advance the resourceVersion: %v after %v", rv, last)
+		}
+		last = rv
+	}
+}
+
+func TestWatchStreamExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(newRouter(ctx, &idleManager{}, ServerOptions{}))
+	defer ts.Close()
+
+	dec, done := openWatchStream(t, ts.URL+"/v1/_/leases?resourceVersion=0.1")
+	defer done()
+
+	var evt testWatchEvent
+	if err := dec.Decode(&evt); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if evt.Type != watchError || evt.Object.Code != http.StatusGone {
+		t.Errorf("expected an ERROR with code 410, got %+v", evt)
+	}
+}
+
+func TestWatchStreamEvents(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msm := subnet.NewMockManager(1, config)
+	ts := httptest.NewServer(newRouter(ctx, msm, ServerOptions{}))
+	defer ts.Close()
+
+	dec, done := openWatchStream(t, ts.URL+"/v1/_/leases")
+	defer done()
+
+	l, err := msm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	var evt testWatchEvent
+	if err := dec.Decode(&evt); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if evt.Type != watchAdded || evt.Object.Lease == nil || !evt.Object.Lease.Subnet.Equal(l.Subnet) || evt.Object.Metadata.ResourceVersion == "" {
+		t.Errorf("expected the acquired lease ADDED, got %+v", evt)
+	}
+}
+
+// encodingRecorder records the Content-Encoding of the requests to h and,
+// if old, hides that the server accepts compressed requests
+type encodingRecorder struct {
+	h   http.Handler
+	old bool
+
+	mux       sync.Mutex
+	encodings map[string]string
+}
+
+type hidingWriter struct {
+	http.ResponseWriter
+}
+
+func (w hidingWriter) WriteHeader(code int) {
+	w.Header().Del(acceptEncodingHeader)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w hidingWriter) Write(b []byte) (int, error) {
+	w.Header().Del(acceptEncodingHeader)
+	return w.ResponseWriter.Write(b)
+}
+
+func (er *encodingRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	er.mux.Lock()
+	if er.encodings == nil {
+		er.encodings = make(map[string]string)
+	}
+	er.encodings[r.Method] = r.Header.Get("Content-Encoding")
+	er.mux.Unlock()
+
+	if er.old {
+		w = hidingWriter{w}
+	}
+	er.h.ServeHTTP(w, r)
+}
+
+func (er *encodingRecorder) encoding(method string) string {
+	er.mux.Lock()
+	defer er.mux.Unlock()
+	return er.encodings[method]
+}
+
+func TestGzipRequests(t *testing.T) {
+	for _, old := range []bool{false, true} {
+		config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		er := &encodingRecorder{h: newRouter(ctx, subnet.NewMockManager(0, config), ServerOptions{}), old: old}
+		ts := httptest.NewServer(er)
+		defer ts.Close()
+
+		sm := NewRemoteManagerWithOptions(strings.TrimPrefix(ts.URL, "http://"), ClientOptions{CompressThreshold: 10})
+
+		// learns whether the server takes compressed requests
+		if _, err := sm.GetNetworkConfig(ctx, "_"); err != nil {
+			t.Fatalf("GetNetworkConfig failed: %v", err)
+		}
+
+		attrs := &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Hostname: strings.Repeat("node", 100)}
+		l, err := sm.AcquireLease(ctx, "_", attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		if l.Attrs.Hostname != attrs.Hostname {
+			t.Errorf("lease acquired with hostname %q", l.Attrs.Hostname)
+		}
+		if err := sm.RenewLease(ctx, "_", l); err != nil {
+			t.Fatalf("RenewLease failed: %v", err)
+		}
+
+		expected := "gzip"
+		if old {
+			expected = ""
+		}
+		for _, method := range []string{"POST", "PUT"} {
+			if enc := er.encoding(method); enc != expected {
+				t.Errorf("old server=%v: %v request sent with Content-Encoding %q, expected %q", old, method, enc, expected)
+			}
+		}
+	}
+}
+
+func TestGzipPutDecodes(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msm := subnet.NewMockManager(0, config)
+	ts := httptest.NewServer(newRouter(ctx, msm, ServerOptions{}))
+	defer ts.Close()
+
+	l, err := msm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	body, err := json.Marshal(&subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1"), Zone: "zone-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zbody, err := gzipBody(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("PUT", ts.URL+"/v1/_/leases/"+l.Key()+"/attrs", strings.NewReader(string(zbody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("gzipped PUT got status %v", resp.StatusCode)
+	}
+
+	updated, err := msm.GetLease(ctx, "", l.Subnet)
+	if err != nil {
+		t.Fatalf("GetLease failed: %v", err)
+	}
+	if updated.Attrs.Zone != "zone-b" {
+		t.Errorf("gzipped attrs not applied: %+v", updated.Attrs)
+	}
+
+	// other encodings are turned away
+	req, _ = http.NewRequest("PUT", ts.URL+"/v1/_/leases/"+l.Key()+"/attrs", strings.NewReader(string(body)))
+	req.Header.Set("Content-Encoding", "br")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT in an unsupported encoding got status %v, expected 415", resp.StatusCode)
+	}
+}
+
+// networksManager serves each network from its own manager
+type networksManager struct {
+	subnet.Manager
+	networks map[string]subnet.Manager
+}
+
+func (m *networksManager) get(network string) (subnet.Manager, error) {
+	if sm, ok := m.networks[network]; ok {
+		return sm, nil
+	}
+	return nil, fmt.Errorf("no network %q", network)
+}
+
+func (m *networksManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	sm, err := m.get(network)
+	if err != nil {
+		return nil, err
+	}
+	return sm.GetNetworkConfig(ctx, network)
+}
+
+func (m *networksManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	sm, err := m.get(network)
+	if err != nil {
+		return nil, err
+	}
+	return sm.AcquireLease(ctx, network, attrs)
+}
+
+func (m *networksManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	sm, err := m.get(network)
+	if err != nil {
+		return subnet.WatchResult{}, err
+	}
+	return sm.WatchLeases(ctx, network, cursor)
+}
+
+func TestTenantTokens(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nm := &networksManager{networks: map[string]subnet.Manager{
+		"_tenants/blue/default":  subnet.NewMockManager(0, `{"Network": "10.1.0.0/16"}`),
+		"_tenants/green/default": subnet.NewMockManager(0, `{"Network": "10.2.0.0/16"}`),
+	}}
+	ts := httptest.NewServer(newRouter(ctx, nm, ServerOptions{TenantTokens: map[string]string{"b-token": "blue", "g-token": "green"}}))
+	defer ts.Close()
+
+	client := func(token string) subnet.Manager {
+		return NewRemoteManagerWithOptions(strings.TrimPrefix(ts.URL, "http://"), ClientOptions{Token: token})
+	}
+
+	for token, network := range map[string]string{"b-token": "10.1.0.0/16", "g-token": "10.2.0.0/16"} {
+		sm := client(token)
+
+		cfg, err := sm.GetNetworkConfig(ctx, "default")
+		if err != nil {
+			t.Fatalf("GetNetworkConfig with %v failed: %v", token, err)
+		}
+		if cfg.Network.String() != network {
+			t.Errorf("GetNetworkConfig with %v: expected %v, got %v", token, network, cfg.Network)
+		}
+
+		l, err := sm.AcquireLease(ctx, "default", &subnet.LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")})
+		if err != nil {
+			t.Fatalf("AcquireLease with %v failed: %v", token, err)
+		}
+
+		wr, err := sm.WatchLeases(ctx, "default", nil)
+		if err != nil {
+			t.Fatalf("WatchLeases with %v failed: %v", token, err)
+		}
+		if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+			t.Errorf("WatchLeases with %v: expected only %v, got %v", token, l.Subnet, wr.Snapshot)
+		}
+	}
+
+	// the other tenant's network is out of reach under any name
+	if _, err := client("b-token").GetNetworkConfig(ctx, "_tenants/green/default"); err == nil {
+		t.Error("GetNetworkConfig reached the network of another tenant")
+	}
+
+	for _, token := range []string{"", "bogus"} {
+		if _, err := client(token).GetNetworkConfig(ctx, "default"); err == nil {
+			t.Errorf("GetNetworkConfig with token %q succeeded", token)
+		}
+
+		req, _ := http.NewRequest("GET", ts.URL+"/v1/default/config", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Token %q: expected 401, got %v", token, resp.Status)
+		}
+	}
+}
+
+func TestLoadTenantTokens(t *testing.T) {
+	f, err := ioutil.TempFile("", "flannel-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	fmt.Fprint(f, "# token tenant\nb-token blue\n\n  g-token   green\n")
+	f.Close()
+
+	tokens, err := LoadTenantTokens(f.Name())
+	if err != nil {
+		t.Fatalf("LoadTenantTokens failed: %v", err)
+	}
+	if expected := map[string]string{"b-token": "blue", "g-token": "green"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("LoadTenantTokens: expected %v, got %v", expected, tokens)
+	}
+
+	for _, bad := range []string{"b-token\n", "b-token blue\nb-token green\n", "b-token blue/x\n"} {
+		ioutil.WriteFile(f.Name(), []byte(bad), 0600)
+		if _, err := LoadTenantTokens(f.Name()); err == nil {
+			t.Errorf("LoadTenantTokens accepted %q", bad)
+		}
+	}
+}
+
+func TestSnakeCaseFields(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(newRouter(ctx, subnet.NewMockManager(0, fmt.Sprintf(`{"Network": %q}`, expectedNetwork)), ServerOptions{}))
+	defer ts.Close()
+
+	do := func(method, path, body, accept string) map[string]interface{} {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v %v: %v", method, path, resp.Status)
+		}
+		var v map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// acquired with the snake_case names and returned with them on request
+	l := do("POST", "/v1/_/leases", `{"public_ip": "1.1.1.1", "public_hostname": "node-a"}`, SnakeCaseType)
+	attrs, _ := l["attrs"].(map[string]interface{})
+	if attrs["public_ip"] != "1.1.1.1" || attrs["public_hostname"] != "node-a" {
+		t.Errorf("Expected the acquired lease in snake_case, got %v", l)
+	}
+
+	// older clients get the Go names
+	if c := do("GET", "/v1/_/config", "", ""); c["Network"] != expectedNetwork {
+		t.Errorf("Expected the config with Go names, got %v", c)
+	}
+	if c := do("GET", "/v1/_/config", "", "application/json, "+SnakeCaseType); c["network"] != expectedNetwork || c["subnet_len"] == nil {
+		t.Errorf("Expected the config in snake_case, got %v", c)
+	}
+
+	wr := do("GET", "/v1/_/leases", "", SnakeCaseType)
+	snapshot, _ := wr["snapshot"].([]interface{})
+	if len(snapshot) != 1 {
+		t.Fatalf("Expected one lease in the snapshot, got %v", wr)
+	}
+	if a := snapshot[0].(map[string]interface{})["attrs"].(map[string]interface{}); a["public_ip"] != "1.1.1.1" {
+		t.Errorf("Expected the snapshot in snake_case, got %v", wr)
+	}
+}
+
+func watchSince(t *testing.T, url string, since time.Time) (subnet.WatchResult, int) {
+	resp, err := http.Get(url + "/v1/_/leases?since=" + since.Format(time.RFC3339Nano))
+	if err != nil {
+		t.Fatalf("GET since %v failed: %v", since, err)
+	}
+	defer resp.Body.Close()
+
+	wr := subnet.WatchResult{}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&wr); err != nil {
+			t.Fatalf("Failed to decode the watch result: %v", err)
+		}
+	}
+	return wr, resp.StatusCode
+}
+
+func TestWatchSince(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)}
+	defer func(f func() time.Time) { historyNow = f }(historyNow)
+	historyNow = clk.Now
+
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(newRouter(ctx, subnet.NewMockManager(0, config), ServerOptions{EventHistory: time.Hour}))
+	defer ts.Close()
+
+	sm := NewRemoteManager(strings.TrimPrefix(ts.URL, "http://"))
+	if _, err := sm.GetNetworkConfig(ctx, "_"); err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	start := clk.Now()
+	clk.Advance(time.Second)
+
+	acquire := func(publicIP string) ip.IP4Net {
+		l, err := sm.AcquireLease(ctx, "_", &subnet.LeaseAttrs{PublicIP: mustParseIP4(publicIP)})
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		return l.Subnet
+	}
+	// waits until n events were recorded since t
+	recorded := func(since time.Time, n int) subnet.WatchResult {
+		for i := 0; ; i++ {
+			wr, code := watchSince(t, ts.URL, since)
+			if code != http.StatusOK {
+				t.Fatalf("watch since %v returned %v", since, code)
+			}
+			if len(wr.Events) >= n {
+				return wr
+			}
+			if i == 100 {
+				t.Fatalf("expected %v events since %v, got %v", n, since, wr.Events)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	acquire("1.1.1.1")
+	recorded(start, 1)
+
+	clk.Advance(time.Minute)
+	since := clk.Now()
+	clk.Advance(time.Second)
+
+	expected := map[ip.IP4Net]bool{acquire("1.1.1.2"): true, acquire("1.1.1.3"): true}
+	wr := recorded(since, 2)
+	if len(wr.Events) != 2 {
+		t.Fatalf("expected the 2 events since %v, got %v", since, wr.Events)
+	}
+	for _, e := range wr.Events {
+		if e.Type != subnet.SubnetAdded || !expected[e.Lease.Subnet] {
+			t.Errorf("unexpected event since %v: %+v", since, e)
+		}
+	}
+
+	// the cursor moves on with the events (the mock Manager only has
+	// room for one watch, the history's, to go on from it)
+	acquire("1.1.1.4")
+	if next := recorded(since, 3); next.Cursor == wr.Cursor || len(next.Events) != 3 {
+		t.Errorf("expected 3 events and another cursor than %v, got %v", wr.Cursor, next)
+	}
+
+	if _, code := watchSince(t, ts.URL, start.Add(-time.Minute)); code != http.StatusGone {
+		t.Errorf("expected a 410 for a time before the history, got %v", code)
+	}
+}
+
+// vanishingManager has its default network deleted once deleted is closed
+type vanishingManager struct {
+	subnet.Manager
+	deleted chan struct{}
+}
+
+func (m *vanishingManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	select {
+	case <-m.deleted:
+		return nil, subnet.ErrConfigNotFound
+	default:
+	}
+	return (&oneNetworkManager{m.Manager}).GetNetworkConfig(ctx, network)
+}
+
+func (m *vanishingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.WatchResult, error) {
+	if cursor == nil {
+		return m.Manager.WatchLeases(ctx, network, nil)
+	}
+	select {
+	case <-m.deleted:
+		return subnet.WatchResult{}, subnet.ErrConfigNotFound
+	case <-ctx.Done():
+		return subnet.WatchResult{}, ctx.Err()
+	}
+}
+
+func TestHistoryOnlyOfKnownNetworks(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vm := &vanishingManager{subnet.NewMockManager(0, config), make(chan struct{})}
+	h := newEventHistory(ctx, vm, time.Hour)
+	tracking := func() int {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		return len(h.networks)
+	}
+
+	if _, err := h.GetNetworkConfig(ctx, "typo"); err != subnet.ErrConfigNotFound {
+		t.Fatalf("expected ErrConfigNotFound for an unknown network, got %v", err)
+	}
+	if _, err := h.WatchLeases(ctx, "typo", sinceCursor(time.Now())); err != subnet.ErrConfigNotFound {
+		t.Errorf("expected ErrConfigNotFound watching an unknown network since a time, got %v", err)
+	}
+	if n := tracking(); n != 0 {
+		t.Fatalf("tracking %v networks that don't exist", n)
+	}
+
+	if _, err := h.GetNetworkConfig(ctx, ""); err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	// a time the history reaches back to, there being no events yet
+	if _, err := h.WatchLeases(ctx, "", sinceCursor(time.Now().Add(time.Minute))); err != nil {
+		t.Fatalf("watch since failed: %v", err)
+	}
+	if n := tracking(); n != 1 {
+		t.Fatalf("expected the default network to be tracked, tracking %v", n)
+	}
+
+	// deleting the network stops the follower
+	close(vm.deleted)
+	for i := 0; tracking() != 0; i++ {
+		if i == 100 {
+			t.Fatal("the history of the deleted network is still tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := h.WatchLeases(ctx, "", sinceCursor(time.Now())); err != subnet.ErrConfigNotFound {
+		t.Errorf("expected ErrConfigNotFound watching the deleted network since a time, got %v", err)
+	}
+}
+
+func TestWatchLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	h := newWatchLimiter(3, 2).limit(func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	watch := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/v1/_/leases?next=1", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h(ctx, nil, w, r)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	admit := func(addr string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watch(addr)
+		}()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch from %v was not admitted", addr)
+		}
+	}
+	reject := func(addr string) {
+		if w := watch(addr); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("expected a 503 with Retry-After for the watch from %v, got %v", addr, w.Code)
+		}
+	}
+
+	admit("10.0.0.1:1000")
+	admit("10.0.0.1:1001")
+	// beyond the limit of the address
+	reject("10.0.0.1:1002")
+	admit("10.0.0.2:1000")
+	// beyond the total limit
+	reject("10.0.0.3:1000")
+
+	close(release)
+	wg.Wait()
+	admit("10.0.0.1:1003")
+}
+
+// pipeListener hands out the server ends of the pipes it is given
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "unix"}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := &pipeListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	defer l.Close()
+	go http.Serve(deadlineListener{l, 50 * time.Millisecond}, newRouter(ctx, &idleManager{}, ServerOptions{}))
+
+	// pipes buffer nothing, the server blocks on its first write to
+	// a client that doesn't read
+	client, server := net.Pipe()
+	defer client.Close()
+	l.conns <- server
+
+	if _, err := fmt.Fprintf(client, "GET /v1/_/leases HTTP/1.1\r\nHost: flannel\r\nAccept: %v\r\n\r\n", WatchStreamType); err != nil {
+		t.Fatalf("Failed to send the watch request: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(make([]byte, 1024))
+	switch {
+	case err == nil:
+		t.Errorf("the watch stream went on to a client that didn't read (%v bytes)", n)
+	case isTimeout(err):
+		t.Errorf("the connection of a client that didn't read was not dropped")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestParseEndpoints(t *testing.T) {
+	eps, err := ParseEndpoints("10.0.0.3:8888;weight=3;zone=a, 10.0.0.4:8888,unix:///run/flannel.sock;zone=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Endpoint{{"10.0.0.3:8888", 3, "a"}, {"10.0.0.4:8888", 1, ""}, {"unix:///run/flannel.sock", 1, "b"}}
+	if !reflect.DeepEqual(eps, expected) {
+		t.Errorf("expected %v, got %v", expected, eps)
+	}
+
+	for _, s := range []string{"", "10.0.0.3:8888;weight=0", "10.0.0.3:8888;weight", "10.0.0.3:8888;rack=1"} {
+		if _, err := ParseEndpoints(s); err == nil {
+			t.Errorf("ParseEndpoints(%q) succeeded", s)
+		}
+	}
+}
+
+func TestEndpointSelection(t *testing.T) {
+	var mux sync.Mutex
+	hits := make(map[string]int)
+	server := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			hits[name]++
+			mux.Unlock()
+			fmt.Fprint(w, `{ "Network": "10.1.0.0/16" }`)
+		}))
+	}
+	// returns and resets the hits
+	takeHits := func() map[string]int {
+		mux.Lock()
+		defer mux.Unlock()
+		h := hits
+		hits = make(map[string]int)
+		return h
+	}
+
+	a, b := server("a"), server("b")
+	defer a.Close()
+	defer b.Close()
+	down := server("down")
+	downAddr := strings.TrimPrefix(down.URL, "http://")
+	down.Close()
+
+	eps := []Endpoint{
+		{Addr: strings.TrimPrefix(a.URL, "http://"), Weight: 1, Zone: "z1"},
+		{Addr: strings.TrimPrefix(b.URL, "http://"), Weight: 3},
+		{Addr: downAddr, Weight: 4},
+	}
+	sm := NewRemoteManagerWithEndpoints(eps, ClientOptions{}).(*RemoteManager)
+
+	const calls = 2000
+	for i := 0; i < calls; i++ {
+		if _, err := sm.GetNetworkConfig(context.Background(), ""); err != nil {
+			t.Fatalf("GetNetworkConfig failed despite reachable endpoints: %v", err)
+		}
+	}
+
+	// a quarter to a, the rest to b, none to the one that is down
+	h := takeHits()
+	if h["a"]+h["b"] != calls || h["a"] < calls/4-150 || h["a"] > calls/4+150 {
+		t.Errorf("requests not spread 1:3 by weight: %v", h)
+	}
+	for _, s := range sm.Endpoints() {
+		if healthy := s.Addr != downAddr; s.Healthy != healthy {
+			t.Errorf("%v: expected healthy=%v", s.Addr, healthy)
+		}
+	}
+
+	// same-zone endpoints are preferred
+	sm = NewRemoteManagerWithEndpoints(eps, ClientOptions{Zone: "z1"}).(*RemoteManager)
+	for i := 0; i < 100; i++ {
+		if _, err := sm.GetNetworkConfig(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := takeHits(); h["a"] != 100 {
+		t.Errorf("expected all requests to go to the endpoint in the zone, got %v", h)
+	}
+
+	rec := httptest.NewRecorder()
+	EndpointsHandler(sm).ServeHTTP(rec, httptest.NewRequest("GET", "/remote", nil))
+	var served []EndpointStatus
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 3 || !served[0].Current || served[1].Current {
+		t.Errorf("expected the endpoint in the zone to be the current one: %+v", served)
+	}
+
+	// failing over once the zone is unreachable
+	a.Close()
+	if _, err := sm.GetNetworkConfig(context.Background(), ""); err != nil {
+		t.Errorf("GetNetworkConfig did not fail over: %v", err)
+	}
+	if h := takeHits(); h["b"] != 1 || h["a"] != 0 {
+		t.Errorf("expected the request to fail over to b, got %v", h)
+	}
+}
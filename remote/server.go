@@ -20,14 +20,19 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-systemd/activation"
 	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/gorilla/mux"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/trace"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -37,10 +42,63 @@ func jsonResponse(w http.ResponseWriter, code int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
-		log.Error("Error JSON encoding response: %v", err)
+		log.Errorf("Error JSON encoding response: %v", err)
 	}
 }
 
+// SnakeCaseType is the media type clients accept to get configs, leases
+// and watch results with the snake_case field names of
+// subnet.MarshalSnakeCase rather than the Go ones
+const SnakeCaseType = "application/json;fields=snake_case"
+
+func wantsSnakeCase(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt := strings.Replace(strings.TrimSpace(accept), " ", "", -1)
+		if strings.HasPrefix(mt, SnakeCaseType) {
+			return true
+		}
+	}
+	return false
+}
+
+// wireResponse is jsonResponse with the field names the client asked for
+func wireResponse(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if !wantsSnakeCase(r) {
+		jsonResponse(w, code, v)
+		return
+	}
+
+	data, err := subnet.MarshalSnakeCase(v)
+	if err != nil {
+		log.Errorf("Error JSON encoding response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
+
+// errorStatus is the status code of a response for the error of a Manager
+func errorStatus(err error) int {
+	switch err {
+	case ErrMaintenance:
+		return http.StatusServiceUnavailable
+	case subnet.ErrDuplicatePublicIP:
+		return http.StatusConflict
+	case subnet.ErrNoEndpoint:
+		return http.StatusBadRequest
+	case subnet.ErrConfigNotFound:
+		return http.StatusNotFound
+	case subnet.ErrBackendMismatch:
+		return http.StatusUnprocessableEntity
+	}
+	if _, ok := err.(*sinceError); ok {
+		return http.StatusGone
+	}
+	return http.StatusInternalServerError
+}
+
 // GET /{network}/config
 func handleGetNetworkConfig(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -52,12 +110,56 @@ func handleGetNetworkConfig(ctx context.Context, sm subnet.Manager, w http.Respo
 
 	c, err := sm.GetNetworkConfig(ctx, network)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprint(w, err)
+		return
+	}
+
+	wireResponse(w, r, http.StatusOK, c)
+}
+
+// GET /{network}/stats
+func handleGetNetworkStats(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	network := mux.Vars(r)["network"]
+	if network == "_" {
+		network = ""
+	}
+
+	stats, err := sm.GetNetworkStats(ctx, network)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
 		fmt.Fprint(w, err)
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, c)
+	jsonResponse(w, http.StatusOK, stats)
+}
+
+// GET /{network}/migration/{backend}
+// The status code is 200 once all nodes run the backend, 503 until then.
+func handleGetMigrationStatus(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	network := mux.Vars(r)["network"]
+	if network == "_" {
+		network = ""
+	}
+
+	wr, err := sm.WatchLeases(ctx, network, nil)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprint(w, err)
+		return
+	}
+
+	status := subnet.Migration(wr.Snapshot, strings.ToLower(mux.Vars(r)["backend"]))
+	code := http.StatusOK
+	if !status.Complete {
+		code = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, code, status)
 }
 
 // POST /{network}/leases
@@ -78,16 +180,35 @@ func handleAcquireLease(ctx context.Context, sm subnet.Manager, w http.ResponseW
 
 	lease, err := sm.AcquireLease(ctx, network, &attrs)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
 		fmt.Fprint(w, err)
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, lease)
+	wireResponse(w, r, http.StatusOK, lease)
+}
+
+// resolveLeaseKey returns the subnet of the lease addressed by key, which
+// is either the subnet key or the key derived by keyFunc
+func resolveLeaseKey(ctx context.Context, sm subnet.Manager, network, key string, keyFunc subnet.KeyFunc) (ip.IP4Net, error) {
+	if sn, err := subnet.ParseSubnetKey(key); err == nil {
+		return sn, nil
+	}
+
+	wr, err := sm.WatchLeases(ctx, network, nil)
+	if err != nil {
+		return ip.IP4Net{}, err
+	}
+	for _, l := range wr.Snapshot {
+		if keyFunc(&l) == key {
+			return l.Subnet, nil
+		}
+	}
+	return ip.IP4Net{}, fmt.Errorf("no lease with key %q", key)
 }
 
-// PUT /{network}/{lease.network}
-func handleRenewLease(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+// GET /{network}/leases/{subnet}
+func handleGetLease(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	network := mux.Vars(r)["network"]
@@ -95,20 +216,133 @@ func handleRenewLease(ctx context.Context, sm subnet.Manager, w http.ResponseWri
 		network = ""
 	}
 
-	lease := subnet.Lease{}
-	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+	sn, err := subnet.ParseSubnetKey(mux.Vars(r)["subnet"])
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "JSON decoding error: ", err)
+		fmt.Fprint(w, "Bad subnet: ", err)
 		return
 	}
 
-	if err := sm.RenewLease(ctx, network, &lease); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	lease, err := sm.GetLease(ctx, network, sn)
+	switch {
+	case err == subnet.ErrLeaseNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	case err != nil:
+		w.WriteHeader(errorStatus(err))
 		fmt.Fprint(w, err)
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, lease)
+	wireResponse(w, r, http.StatusOK, lease)
+}
+
+// PUT /{network}/leases/{key}
+func handleRenewLease(keyFunc subnet.KeyFunc) handler {
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		network := mux.Vars(r)["network"]
+		if network == "_" {
+			network = ""
+		}
+
+		lease := subnet.Lease{}
+		if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "JSON decoding error: ", err)
+			return
+		}
+
+		// a mismatch means the client keys leases differently
+		if key := mux.Vars(r)["key"]; key != keyFunc(&lease) && key != lease.Key() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Lease %v is not keyed %q", lease.Subnet, key)
+			return
+		}
+
+		if err := sm.RenewLease(ctx, network, &lease); err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprint(w, err)
+			return
+		}
+
+		wireResponse(w, r, http.StatusOK, lease)
+	}
+}
+
+// PUT /{network}/leases/{key}/attrs
+func handleUpdateLeaseAttrs(keyFunc subnet.KeyFunc) handler {
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		network := mux.Vars(r)["network"]
+		if network == "_" {
+			network = ""
+		}
+
+		sn, err := resolveLeaseKey(ctx, sm, network, mux.Vars(r)["key"], keyFunc)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Bad lease: ", err)
+			return
+		}
+
+		attrs := subnet.LeaseAttrs{}
+		if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "JSON decoding error: ", err)
+			return
+		}
+
+		lease, err := sm.UpdateLeaseAttrs(ctx, network, sn, &attrs)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprint(w, err)
+			return
+		}
+
+		wireResponse(w, r, http.StatusOK, lease)
+	}
+}
+
+// DELETE /{network}/leases/{key}[?reserve-for=HOSTNAME&reserve-ttl=DURATION]
+func handleRevokeLease(keyFunc subnet.KeyFunc) handler {
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		network := mux.Vars(r)["network"]
+		if network == "_" {
+			network = ""
+		}
+
+		sn, err := resolveLeaseKey(ctx, sm, network, mux.Vars(r)["key"], keyFunc)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Bad lease: ", err)
+			return
+		}
+
+		var res *subnet.Reservation
+		if hostname := r.URL.Query().Get("reserve-for"); hostname != "" {
+			ttl, err := time.ParseDuration(r.URL.Query().Get("reserve-ttl"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "Bad reserve-ttl: ", err)
+				return
+			}
+			res = &subnet.Reservation{Hostname: hostname, TTL: ttl}
+		}
+
+		if err := sm.DrainLease(ctx, network, sn, res); err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprint(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
 func getCursor(u *url.URL) interface{} {
@@ -119,39 +353,124 @@ func getCursor(u *url.URL) interface{} {
 	return vals[0]
 }
 
+// replaced in tests
+var watchAfter = time.After
+
 // GET /{network}/leases?next=cursor
-func handleWatchLeases(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// GET /{network}/leases?since=time
+//
+// If maxLifetime is non-zero, a watch that has not seen any events for
+// that long returns an empty result with the cursor it was given and the
+// connection is closed so that the client reconnects (and possibly lands
+// on another server) without resyncing.
+//
+// Clients accepting WatchStreamType get a watch stream instead, see
+// streamLeases.
+//
+// With history, since (an RFC 3339 time) asks for the events recorded
+// after it, see eventHistory; the result is returned right away.
+func handleWatchLeases(maxLifetime, bookmarkInterval time.Duration, history bool) handler {
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		network := mux.Vars(r)["network"]
+		if network == "_" {
+			network = ""
+		}
 
-	network := mux.Vars(r)["network"]
-	if network == "_" {
-		network = ""
-	}
+		since, err := parseSince(r)
+		switch {
+		case err != nil:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		case since != nil && !history:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "the server keeps no event history to watch since a time")
+			return
+		case since != nil && getCursor(r.URL) != nil:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "since and next can't be combined")
+			return
+		case since != nil:
+			wr, err := sm.WatchLeases(ctx, network, since)
+			if err == nil {
+				wr.Cursor, err = cursorString(wr.Cursor)
+			}
+			if err != nil {
+				w.WriteHeader(errorStatus(err))
+				fmt.Fprint(w, err)
+				return
+			}
+			wireResponse(w, r, http.StatusOK, wr)
+			return
+		}
 
-	cursor := getCursor(r.URL)
+		if wantsWatchStream(r) {
+			streamLeases(ctx, sm, network, w, r, bookmarkInterval, maxLifetime)
+			return
+		}
 
-	wr, err := sm.WatchLeases(ctx, network, cursor)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
-		return
-	}
+		cursor := getCursor(r.URL)
+
+		// only watches block, snapshots (no cursor) return right away
+		expired := make(chan struct{})
+		if cursor != nil && maxLifetime > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(ctx)
+			defer cancel()
+
+			timeout := watchAfter(maxLifetime)
+			go func() {
+				select {
+				case <-timeout:
+					close(expired)
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
 
-	switch wr.Cursor.(type) {
-	case string:
-	case fmt.Stringer:
-		wr.Cursor = wr.Cursor.(fmt.Stringer).String()
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, fmt.Errorf("internal error: watch cursor is of unknown type"))
-		return
-	}
+		wr, err := sm.WatchLeases(ctx, network, cursor)
+		if err == subnet.ErrCursorExpired {
+			// clients predate ErrCursorExpired, hand them
+			// the snapshot they expect instead
+			wr, err = sm.WatchLeases(ctx, network, nil)
+		}
+		if err != nil {
+			select {
+			case <-expired:
+				// also drop the connection so the next watch
+				// is free to go elsewhere
+				w.Header().Set("Connection", "close")
+				wr = subnet.WatchResult{Cursor: cursor}
+			default:
+				w.WriteHeader(errorStatus(err))
+				fmt.Fprint(w, err)
+				return
+			}
+		}
+
+		if wr.Cursor, err = cursorString(wr.Cursor); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
 
-	jsonResponse(w, http.StatusOK, wr)
+		wireResponse(w, r, http.StatusOK, wr)
+	}
 }
 
 func bindHandler(h handler, ctx context.Context, sm subnet.Manager) http.HandlerFunc {
 	return func(resp http.ResponseWriter, req *http.Request) {
+		// the store calls made for the request join the trace of the client
+		ctx, end := trace.StartSpan(trace.Extract(ctx, req.Header), req.Method+" "+req.URL.Path)
+		defer end()
+
+		resp.Header().Set(acceptEncodingHeader, "gzip")
+		if !decodeRequestBody(resp, req) {
+			return
+		}
 		h(ctx, sm, resp, req)
 	}
 }
@@ -182,6 +501,29 @@ func fdListener(addr string) (net.Listener, error) {
 	return listeners[fdOffset], nil
 }
 
+// access is controlled by the permissions of the socket
+const unixSocketMode = 0660
+
+func unixListener(path string) (net.Listener, error) {
+	// a socket left behind by an unclean exit makes bind fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
 func listener(addr string) (net.Listener, error) {
 	rex := regexp.MustCompile("(?:([a-z]+)://)?(.*)")
 	groups := rex.FindStringSubmatch(addr)
@@ -196,39 +538,205 @@ func listener(addr string) (net.Listener, error) {
 	case groups[1] == "fd":
 		return fdListener(groups[2])
 
+	case groups[1] == "unix":
+		return unixListener(groups[2])
+
 	default:
 		return nil, fmt.Errorf("bad listener scheme")
 	}
 }
 
-func RunServer(ctx context.Context, sm subnet.Manager, listenAddr string) {
+// redirects lease writes to the primary server, primary being its URL
+// or its address (reached the way the replica was)
+func redirectToPrimary(primary string) http.HandlerFunc {
+	scheme, host := "", primary
+	if u, err := url.Parse(primary); err == nil && u.Scheme != "" && u.Host != "" {
+		scheme, host = u.Scheme, u.Host
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := scheme
+		if s == "" {
+			s = "http"
+			if r.TLS != nil {
+				s = "https"
+			}
+		}
+
+		// 307 makes clients repeat the same method and body
+		u := url.URL{Scheme: s, Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+	}
+}
+
+type ServerOptions struct {
+	// if set, the server is a read-only replica: config and watches are
+	// served from its own Manager while lease writes are redirected to
+	// the server at this address or URL (e.g. https://10.1.2.3:8443)
+	Primary string
+
+	// if non-zero, watches return after this long without events so
+	// that clients reconnect
+	MaxWatchLifetime time.Duration
+
+	// how often idle watch streams (WatchStreamType) get a BOOKMARK,
+	// DefaultBookmarkInterval if zero
+	WatchBookmarkInterval time.Duration
+
+	// if non-zero, at most MaxConcurrentAcquires lease allocations are
+	// in progress at once; AcquireQueue more wait for their turn and
+	// the rest get a 429 telling them to retry, as do those that wait
+	// longer than AcquireQueueTimeout (if non-zero)
+	MaxConcurrentAcquires int
+	AcquireQueue          int
+	AcquireQueueTimeout   time.Duration
+
+	// if non-zero, at most MaxWatches watches are in progress at once,
+	// and at most MaxWatchesPerIP of them from the same address; more
+	// get a 503
+	MaxWatches      int
+	MaxWatchesPerIP int
+
+	// if non-zero, connections are dropped once a write to them has not
+	// been taken for this long, e.g. by a watch client not reading
+	WriteTimeout time.Duration
+
+	// KeyFunc derives the keys clients address leases by (besides
+	// their subnet keys, which are always accepted), SubnetKey if nil
+	KeyFunc subnet.KeyFunc
+
+	// if set, the last known configs and leases are served while etcd
+	// is unreachable and lease writes fail with 503 until it is back
+	Maintenance bool
+
+	// if non-zero, the lease events of the networks served are kept
+	// for this long for watches since a time
+	EventHistory time.Duration
+
+	// Tenant, if set, scopes the networks of every request to it (see
+	// subnet.TenantNetwork). With TenantTokens instead, each request
+	// presents a bearer token and is scoped to its tenant; requests
+	// without a known token get a 401.
+	Tenant       string
+	TenantTokens map[string]string
+}
+
+const networkPath = "/v1/{network:.+}"
+
+func newRouter(ctx context.Context, sm subnet.Manager, opts ServerOptions) *mux.Router {
 	// {network} is always required a the API level but to
 	// keep backward compat, special "_" network is allowed
 	// that means "no network"
+	//
+	// Routes match the decoded path, so that it makes no difference
+	// whether a proxy in front passes it on decoded or not, and
+	// network names may contain '/' (escaped by clients or not).
 
-	r := mux.NewRouter()
-	r.HandleFunc("/v1/{network}/config", bindHandler(handleGetNetworkConfig, ctx, sm)).Methods("GET")
-	r.HandleFunc("/v1/{network}/leases", bindHandler(handleAcquireLease, ctx, sm)).Methods("POST")
-	r.HandleFunc("/v1/{network}/leases/{subnet}", bindHandler(handleRenewLease, ctx, sm)).Methods("PUT")
-	r.HandleFunc("/v1/{network}/leases", bindHandler(handleWatchLeases, ctx, sm)).Methods("GET")
+	sm = &backendChecker{sm}
 
-	l, err := listener(listenAddr)
-	if err != nil {
-		log.Errorf("Error listening on %v: %v", listenAddr, err)
-		return
+	var mm *maintenanceManager
+	if opts.Maintenance {
+		mm = newMaintenanceManager(sm)
+		sm = mm
+	}
+	if opts.EventHistory > 0 {
+		sm = newEventHistory(ctx, sm, opts.EventHistory)
+	}
+
+	t := tenancy{tenant: opts.Tenant, tokens: opts.TenantTokens}
+	bind := func(h handler) http.HandlerFunc {
+		return bindHandler(t.scope(h), ctx, sm)
+	}
+	write := func(h handler) http.HandlerFunc {
+		if opts.Primary != "" {
+			return redirectToPrimary(opts.Primary)
+		}
+		return bind(h)
 	}
 
-	c := make(chan error, 1)
-	go func() {
-		c <- http.Serve(l, httpLogger(r))
+	keyFunc := opts.KeyFunc
+	if keyFunc == nil {
+		keyFunc = subnet.SubnetKey
+	}
+
+	bookmarkInterval := opts.WatchBookmarkInterval
+	if bookmarkInterval == 0 {
+		bookmarkInterval = DefaultBookmarkInterval
+	}
+
+	acquire := handleAcquireLease
+	if opts.MaxConcurrentAcquires > 0 {
+		acquire = newAcquireLimiter(opts.MaxConcurrentAcquires, opts.AcquireQueue, opts.AcquireQueueTimeout).limit(acquire)
+	}
+
+	watch := handleWatchLeases(opts.MaxWatchLifetime, bookmarkInterval, opts.EventHistory > 0)
+	if opts.MaxWatches > 0 || opts.MaxWatchesPerIP > 0 {
+		watch = newWatchLimiter(opts.MaxWatches, opts.MaxWatchesPerIP).limit(watch)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", handleHealthz(mm)).Methods("GET")
+	r.HandleFunc(networkPath+"/config", bind(handleGetNetworkConfig)).Methods("GET")
+	r.HandleFunc(networkPath+"/stats", bind(handleGetNetworkStats)).Methods("GET")
+	r.HandleFunc(networkPath+"/migration/{backend}", bind(handleGetMigrationStatus)).Methods("GET")
+	r.HandleFunc(networkPath+"/leases", write(acquire)).Methods("POST")
+	r.HandleFunc(networkPath+"/leases/{key}/attrs", write(handleUpdateLeaseAttrs(keyFunc))).Methods("PUT")
+	r.HandleFunc(networkPath+"/leases/{key}", write(handleRenewLease(keyFunc))).Methods("PUT")
+	r.HandleFunc(networkPath+"/leases/{key}", write(handleRevokeLease(keyFunc))).Methods("DELETE")
+	r.HandleFunc(networkPath+"/leases", bind(watch)).Methods("GET")
+	r.HandleFunc(networkPath+"/leases/{subnet}", bind(handleGetLease)).Methods("GET")
+	return r
+}
+
+func RunServer(ctx context.Context, sm subnet.Manager, listenAddr string, opts ServerOptions) {
+	serve(ctx, newRouter(ctx, sm, opts), listenAddr, opts.WriteTimeout)
+}
+
+// serve serves h on each of the comma separated listenAddr until ctx is
+// done or serving on any of them fails. Connections are dropped after
+// writeTimeout (if non-zero) without a write being taken.
+func serve(ctx context.Context, h http.Handler, listenAddr string, writeTimeout time.Duration) {
+	var ls []net.Listener
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
 	}()
 
+	for _, addr := range strings.Split(listenAddr, ",") {
+		l, err := listener(addr)
+		if err != nil {
+			log.Errorf("Error listening on %v: %v", addr, err)
+			return
+		}
+		if writeTimeout > 0 {
+			l = deadlineListener{l, writeTimeout}
+		}
+		ls = append(ls, l)
+	}
+
+	c := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) {
+			err := http.Serve(l, httpLogger(h))
+			if err != nil {
+				err = fmt.Errorf("%v: %v", l.Addr(), err)
+			}
+			c <- err
+		}(l)
+	}
+
 	select {
 	case <-ctx.Done():
-		l.Close()
-		<-c
+		for _, l := range ls {
+			l.Close()
+		}
+		for range ls {
+			<-c
+		}
+		ls = nil
 
 	case err := <-c:
-		log.Errorf("Error serving on %v: %v", listenAddr, err)
+		log.Errorf("Error serving on %v", err)
 	}
 }
@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// tenancy scopes the networks of requests to the tenant of the server or
+// of the token a request presents, see ServerOptions
+type tenancy struct {
+	tenant string
+	tokens map[string]string
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func (t tenancy) scope(h handler) handler {
+	if t.tenant == "" && t.tokens == nil {
+		return h
+	}
+
+	return func(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+		tenant := t.tenant
+		if t.tokens != nil {
+			var ok bool
+			if tenant, ok = t.tokens[bearerToken(r)]; !ok {
+				r.Body.Close()
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "missing or unknown tenant token")
+				return
+			}
+		}
+		h(ctx, subnet.NewTenantManager(sm, tenant), w, r)
+	}
+}
+
+// LoadTenantTokens reads the tokens of tenants from path, a "TOKEN TENANT"
+// pair per line. Empty lines and those starting with '#' are skipped.
+func LoadTenantTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected a token and a tenant", path, n)
+		}
+		if err := subnet.ValidateTenant(fields[1]); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, n, err)
+		}
+		if _, ok := tokens[fields[0]]; ok {
+			return nil, fmt.Errorf("%v:%v: duplicate token", path, n)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
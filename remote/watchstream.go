@@ -0,0 +1,280 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// WatchStreamType is the media type of a Kubernetes-style watch stream:
+// one JSON encoded watch event per line
+const WatchStreamType = "application/json;stream=watch"
+
+// DefaultBookmarkInterval is how often an idle watch stream gets a BOOKMARK
+const DefaultBookmarkInterval = time.Minute
+
+// types of the watch events
+const (
+	watchAdded    = "ADDED"
+	watchDeleted  = "DELETED"
+	watchBookmark = "BOOKMARK"
+	watchError    = "ERROR"
+)
+
+type objectMeta struct {
+	Name            string `json:"name,omitempty"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// leaseObject is the object of lease events; that of a BOOKMARK only has
+// the resourceVersion set
+type leaseObject struct {
+	Metadata objectMeta    `json:"metadata"`
+	Lease    *subnet.Lease `json:"lease,omitempty"`
+}
+
+// statusObject is the object of ERROR events
+type statusObject struct {
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+type watchEvent struct {
+	Type   string      `json:"type"`
+	Object interface{} `json:"object"`
+}
+
+func wantsWatchStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt := strings.Replace(strings.TrimSpace(accept), " ", "", -1)
+		if strings.HasPrefix(mt, WatchStreamType) {
+			return true
+		}
+	}
+	return false
+}
+
+func cursorString(cursor interface{}) (string, error) {
+	switch c := cursor.(type) {
+	case string:
+		return c, nil
+	case fmt.Stringer:
+		return c.String(), nil
+	default:
+		return "", fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+}
+
+type watchStream struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+}
+
+func (s *watchStream) send(typ string, obj interface{}) error {
+	if err := s.enc.Encode(watchEvent{typ, obj}); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s *watchStream) sendLease(typ, rv string, l subnet.Lease) error {
+	return s.send(typ, leaseObject{
+		Metadata: objectMeta{Name: l.Key(), ResourceVersion: rv},
+		Lease:    &l,
+	})
+}
+
+// sendBatch sends the events of a watch result. As a client resuming
+// from the resourceVersion of the last event it processed must not miss
+// the rest of the batch, only the last event carries the cursor after
+// the batch; the others carry the one before (lease events are
+// idempotent, so replaying them does no harm).
+func (s *watchStream) sendBatch(prev, next string, batch []subnet.Event) error {
+	for i, evt := range batch {
+		rv := prev
+		if i == len(batch)-1 {
+			rv = next
+		}
+
+		typ := watchAdded
+		if evt.Type == subnet.SubnetRemoved {
+			typ = watchDeleted
+		}
+		if err := s.sendLease(typ, rv, evt.Lease); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendStatus ends the stream with an ERROR event
+func (s *watchStream) sendStatus(code int, reason string, err error) {
+	s.send(watchError, statusObject{
+		Kind:    "Status",
+		Status:  "Failure",
+		Message: err.Error(),
+		Reason:  reason,
+		Code:    code,
+	})
+}
+
+// streamLeases serves GET /{network}/leases?resourceVersion=rv to clients
+// accepting WatchStreamType, as a Kubernetes-style watch. Without a
+// resourceVersion the current leases come first as ADDED events.
+//
+// After interval without events the stream gets a BOOKMARK whose
+// resourceVersion all changes up to have been sent, so that the client
+// can resume from it rather than from a cursor that may have fallen out
+// of the history since. A resourceVersion outside the history ends the
+// stream with a 410 Expired ERROR, upon which the client starts over
+// without one.
+func streamLeases(ctx context.Context, sm subnet.Manager, network string, w http.ResponseWriter, r *http.Request, interval, maxLifetime time.Duration) {
+	if cn, ok := w.(http.CloseNotifier); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	if maxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxLifetime)
+		defer cancel()
+	}
+
+	var cursor interface{}
+	if rv := r.URL.Query().Get("resourceVersion"); rv != "" && rv != "0" {
+		cursor = rv
+	}
+
+	var snapshot *subnet.WatchResult
+	if cursor == nil {
+		wr, err := sm.WatchLeases(ctx, network, nil)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprint(w, err)
+			return
+		}
+		snapshot = &wr
+	}
+
+	w.Header().Set("Content-Type", WatchStreamType)
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		// let the client know the watch is on before any events
+		f.Flush()
+	}
+	s := &watchStream{w: w, enc: json.NewEncoder(w)}
+
+	// bookmark is a cursor taken before the current watch started,
+	// which becomes safe to announce once the watch sees no events
+	var bookmark interface{}
+
+	if snapshot != nil {
+		rv, err := cursorString(snapshot.Cursor)
+		if err != nil {
+			s.sendStatus(http.StatusInternalServerError, "InternalError", err)
+			return
+		}
+		for _, l := range snapshot.Snapshot {
+			if err := s.sendLease(watchAdded, rv, l); err != nil {
+				return
+			}
+		}
+		cursor, bookmark = snapshot.Cursor, snapshot.Cursor
+	}
+
+	for {
+		wctx, cancel := context.WithTimeout(ctx, interval)
+		wr, err := sm.WatchLeases(wctx, network, cursor)
+		idle := wctx.Err() != nil
+		cancel()
+
+		switch {
+		case ctx.Err() != nil:
+			return
+
+		case err == nil && len(wr.Snapshot) > 0, err == subnet.ErrCursorExpired:
+			s.sendStatus(http.StatusGone, "Expired", subnet.ErrCursorExpired)
+			return
+
+		case err != nil && !idle:
+			log.Errorf("Lease watch stream of %q failed: %v", network, err)
+			s.sendStatus(errorStatus(err), "InternalError", err)
+			return
+
+		case err != nil:
+			if bookmark != nil {
+				rv, err := cursorString(bookmark)
+				if err != nil {
+					s.sendStatus(http.StatusInternalServerError, "InternalError", err)
+					return
+				}
+				if err := s.send(watchBookmark, leaseObject{Metadata: objectMeta{ResourceVersion: rv}}); err != nil {
+					return
+				}
+				cursor = bookmark
+			}
+
+			// where the store is now, to be announced
+			// if the next watch is idle as well
+			snap, err := sm.WatchLeases(ctx, network, nil)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.sendStatus(errorStatus(err), "InternalError", err)
+				}
+				return
+			}
+			bookmark = snap.Cursor
+
+		default:
+			prev, err := cursorString(cursor)
+			if err == nil {
+				var next string
+				if next, err = cursorString(wr.Cursor); err == nil {
+					err = s.sendBatch(prev, next, wr.Events)
+				}
+			}
+			if err != nil {
+				s.sendStatus(http.StatusInternalServerError, "InternalError", err)
+				return
+			}
+			cursor, bookmark = wr.Cursor, nil
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Allocation strategies of the network config
+const (
+	// AllocateRandom picks a random free subnet (of the first 100)
+	AllocateRandom = "random"
+	// AllocateHashed prefers the subnet the node's identity hashes to
+	AllocateHashed = "hashed"
+)
+
+func validateAllocation(s string) error {
+	switch s {
+	case "", AllocateRandom, AllocateHashed:
+		return nil
+	}
+	return fmt.Errorf("unknown Allocation %q, expected %q or %q", s, AllocateRandom, AllocateHashed)
+}
+
+// nodeIdentity is what the hashed allocation maps to a subnet: the
+// hostname if the node has one, its PublicIP otherwise
+func nodeIdentity(attrs *LeaseAttrs) string {
+	if attrs.Hostname != "" {
+		return attrs.Hostname
+	}
+	return attrs.PublicIP.String()
+}
+
+// hashedSubnet returns the subnet of prefixLen in the range of config
+// that identity hashes to. The same identity always maps to the same
+// subnet as long as the range stays the same.
+func hashedSubnet(config *Config, prefixLen uint, identity string) (ip.IP4Net, bool) {
+	first := firstSubnet(config, prefixLen)
+	if lastBlock(config, first) > config.SubnetMax {
+		return ip.IP4Net{}, false
+	}
+
+	size := uint32(1) << (32 - prefixLen)
+	count := uint32(config.SubnetMax-lastBlock(config, first))/size + 1
+
+	h := fnv.New32a()
+	h.Write([]byte(identity))
+	return ip.IP4Net{IP: first.IP + ip.IP4((h.Sum32()%count)*size), PrefixLen: prefixLen}, true
+}
+
+// firstSubnet returns the first subnet of prefixLen in the range of
+// config. Multi-block leases are aligned on their own size so releasing
+// one does not leave the range fragmented.
+func firstSubnet(config *Config, prefixLen uint) ip.IP4Net {
+	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: prefixLen}
+	if prefixLen < config.SubnetLen && !sn.Network().Equal(sn) {
+		sn = sn.Network().Next()
+	}
+	return sn
+}
+
+func isTaken(sn ip.IP4Net, leases []Lease) bool {
+	for _, l := range leases {
+		if sn.Overlaps(l.Subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateHashed takes the subnet identity hashes to, unless it is taken
+// in which case it falls back to the first free one
+func allocateHashed(config *Config, prefixLen uint, leases []Lease, identity string) (ip.IP4Net, bool) {
+	if sn, ok := hashedSubnet(config, prefixLen, identity); ok && !isTaken(sn, leases) {
+		return sn, true
+	}
+
+	for sn := firstSubnet(config, prefixLen); sn.IP >= config.SubnetMin && lastBlock(config, sn) <= config.SubnetMax; sn = sn.Next() {
+		if !isTaken(sn, leases) {
+			return sn, true
+		}
+	}
+	return ip.IP4Net{}, false
+}
+
+// AllocateSubnet picks the subnet of a new lease with attrs, as the
+// Allocation of config says, that overlaps neither taken nor
+// attrs.AvoidSubnets. It is for Managers that keep leases elsewhere
+// than in etcd.
+func AllocateSubnet(config *Config, attrs *LeaseAttrs, taken []Lease) (ip.IP4Net, error) {
+	prefixLen, err := LeasePrefixLen(config, attrs)
+	if err != nil {
+		return ip.IP4Net{}, err
+	}
+
+	taken = append([]Lease(nil), taken...)
+	for _, asn := range attrs.AvoidSubnets {
+		taken = append(taken, Lease{Subnet: asn})
+	}
+	return allocateSubnet(config, prefixLen, taken, nodeIdentity(attrs))
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Agents, servers and etcd may run different flannel versions, each with
+// its own set of LeaseAttrs fields. To keep them working together:
+//
+//  - fields are only ever added, never renamed or repurposed, and are
+//    optional: an absent field means what versions without it did
+//  - LeaseAttrs are decoded tolerantly, ignoring fields this version
+//    doesn't know, by clients and servers alike
+//  - the unknown fields are kept in Unknown and encoded again, so that
+//    the attrs of a newer node stored or renewed through an older server
+//    (or agent) reach the other nodes intact
+//
+// A field that older versions must not ignore needs to be negotiated
+// (e.g. through Features) rather than just added.
+
+// lower cased names of the LeaseAttrs fields, as encoding/json matches
+// keys to fields case-insensitively
+var leaseAttrsFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(LeaseAttrs{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = true
+	}
+	return fields
+}()
+
+// without the methods below
+type plainLeaseAttrs LeaseAttrs
+
+func (attrs *LeaseAttrs) UnmarshalJSON(b []byte) error {
+	b, err := leaseAttrsNames.fromSnakeCase(b)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, (*plainLeaseAttrs)(attrs)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	attrs.Unknown = nil
+	for k, v := range fields {
+		if leaseAttrsFields[strings.ToLower(k)] {
+			continue
+		}
+		if attrs.Unknown == nil {
+			attrs.Unknown = make(map[string]json.RawMessage)
+		}
+		attrs.Unknown[k] = v
+	}
+	return nil
+}
+
+func (attrs LeaseAttrs) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(plainLeaseAttrs(attrs))
+	if err != nil || len(attrs.Unknown) == 0 {
+		return b, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range attrs.Unknown {
+		// known fields take precedence
+		if !leaseAttrsFields[strings.ToLower(k)] {
+			fields[k] = v
+		}
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Backup is the state of a network as exported by Export: its config
+// and the leases live at the time, with what was left of their TTLs
+type Backup struct {
+	Network  string
+	Exported time.Time
+	Config   *Config
+	Leases   []BackupLease
+}
+
+type BackupLease struct {
+	Subnet ip.IP4Net
+	Attrs  *LeaseAttrs
+	// TTL is the number of seconds the lease had left,
+	// 0 if it does not expire
+	TTL uint64 `json:",omitempty"`
+}
+
+// ErrExists is returned by the methods of Restorer when what they are
+// to create is already there
+var ErrExists = errors.New("already exists")
+
+// Restorer is implemented by Managers that can write back the state of
+// a network exported by Export (i.e. those storing it themselves)
+type Restorer interface {
+	Manager
+	// CreateNetworkConfig stores config as the config of network
+	CreateNetworkConfig(ctx context.Context, network string, config *Config) error
+	// CreateLease stores l expiring after ttl
+	CreateLease(ctx context.Context, network string, l *Lease, ttl time.Duration) error
+}
+
+// Export retrieves the config and leases of network from sm
+func Export(ctx context.Context, sm Manager, network string) (*Backup, error) {
+	config, err := sm.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the network config: %v", err)
+	}
+
+	wr, err := sm.WatchLeases(ctx, network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the leases: %v", err)
+	}
+
+	now := time.Now()
+	b := &Backup{
+		Network:  network,
+		Exported: now,
+		Config:   config,
+		Leases:   []BackupLease{},
+	}
+	for _, l := range wr.Snapshot {
+		bl := BackupLease{Subnet: l.Subnet, Attrs: l.Attrs}
+		if !l.Expiration.IsZero() {
+			left := l.Expiration.Sub(now)
+			if left <= 0 {
+				continue
+			}
+			// round up so as not to end up with 0, i.e. no TTL
+			bl.TTL = uint64((left + time.Second - 1) / time.Second)
+		}
+		b.Leases = append(b.Leases, bl)
+	}
+	return b, nil
+}
+
+// RestoreConflict is a lease of a backup whose subnet is taken in the
+// store restored to
+type RestoreConflict struct {
+	Subnet ip.IP4Net
+	// Holder is the lease holding (part of) the subnet, nil if it
+	// could not be told
+	Holder *Lease
+}
+
+func (c RestoreConflict) String() string {
+	if c.Holder == nil {
+		return fmt.Sprintf("%v is taken", c.Subnet)
+	}
+	return fmt.Sprintf("%v is taken by %v (%v)", c.Subnet, c.Holder.Subnet, c.Holder.Attrs.PublicIP)
+}
+
+type RestoreResult struct {
+	// Restored leases were created, Present ones were there already
+	// (same subnet and PublicIP)
+	Restored  int
+	Present   int
+	Conflicts []RestoreConflict
+}
+
+func sameLease(x, y *Lease) bool {
+	return x.Subnet.Equal(y.Subnet) && x.Attrs != nil && y.Attrs != nil && x.Attrs.PublicIP == y.Attrs.PublicIP
+}
+
+// Restore writes b back to r as the state of network: the config, if
+// the network has none yet, and the leases with their TTLs. A network
+// with a different config is left alone. Leases of subnets that are
+// taken by other leases are not restored but reported as conflicts, so
+// that restoring into a store in use never hands a subnet out twice.
+func Restore(ctx context.Context, r Restorer, network string, b *Backup) (*RestoreResult, error) {
+	err := r.CreateNetworkConfig(ctx, network, b.Config)
+	switch {
+	case err == ErrExists:
+		current, err := r.GetNetworkConfig(ctx, network)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve the network config: %v", err)
+		}
+		cb, _ := json.Marshal(current)
+		bb, _ := json.Marshal(b.Config)
+		if string(cb) != string(bb) {
+			return nil, fmt.Errorf("the network already has a different config: %s", cb)
+		}
+
+	case err != nil:
+		return nil, fmt.Errorf("failed to store the network config: %v", err)
+	}
+
+	wr, err := r.WatchLeases(ctx, network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the leases: %v", err)
+	}
+
+	res := &RestoreResult{}
+	for _, bl := range b.Leases {
+		l := &Lease{Subnet: bl.Subnet, Attrs: bl.Attrs}
+
+		if holder := overlappingLease(wr.Snapshot, l.Subnet); holder != nil {
+			if sameLease(holder, l) {
+				res.Present++
+			} else {
+				res.Conflicts = append(res.Conflicts, RestoreConflict{Subnet: l.Subnet, Holder: holder})
+			}
+			continue
+		}
+
+		switch err := r.CreateLease(ctx, network, l, time.Duration(bl.TTL)*time.Second); err {
+		case nil:
+			res.Restored++
+		case ErrExists:
+			// taken since the leases were retrieved
+			res.Conflicts = append(res.Conflicts, RestoreConflict{Subnet: l.Subnet})
+		default:
+			return res, fmt.Errorf("failed to restore the lease of %v: %v", l.Subnet, err)
+		}
+	}
+	return res, nil
+}
+
+func overlappingLease(leases []Lease, sn ip.IP4Net) *Lease {
+	for i := range leases {
+		if leases[i].Subnet.Overlaps(sn) {
+			return &leases[i]
+		}
+	}
+	return nil
+}
+
+func (m *EtcdManager) CreateNetworkConfig(ctx context.Context, network string, config *Config) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.registry.createConfig(ctx, network, string(data))
+	if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdKeyAlreadyExists {
+		return ErrExists
+	}
+	return err
+}
+
+func (m *EtcdManager) CreateLease(ctx context.Context, network string, l *Lease, ttl time.Duration) error {
+	key, data, err := m.encodeLease(l)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.registry.createSubnet(ctx, network, key, data, uint64(ttl/time.Second))
+	if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdKeyAlreadyExists {
+		return ErrExists
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func leaseSet(t *testing.T, sm Manager) map[string]Lease {
+	wr, err := sm.WatchLeases(context.Background(), "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	leases := make(map[string]Lease)
+	for _, l := range wr.Snapshot {
+		leases[l.Subnet.String()] = l
+	}
+	return leases
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newEtcdManager(newDummyRegistry(0))
+
+	// next to the leases without a TTL
+	if _, err := src.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4")}); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	b, err := Export(ctx, src, "")
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &Backup{}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("failed to decode backup: %v", err)
+	}
+
+	// a wiped store
+	dst := newEtcdManager(newMockRegistry(0, "", nil)).(*EtcdManager)
+
+	res, err := Restore(ctx, dst, "", restored)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if res.Restored != len(b.Leases) || res.Present != 0 || len(res.Conflicts) != 0 {
+		t.Errorf("unexpected restore result: %+v (%v leases)", res, len(b.Leases))
+	}
+
+	cfg, err := dst.GetNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed after the restore: %v", err)
+	}
+	if cfg.Network != b.Config.Network || cfg.SubnetLen != b.Config.SubnetLen {
+		t.Errorf("restored config %+v differs from %+v", cfg, b.Config)
+	}
+
+	expected, got := leaseSet(t, src), leaseSet(t, dst)
+	if len(got) != len(expected) {
+		t.Fatalf("restored %v leases, expected %v", len(got), len(expected))
+	}
+	for sn, el := range expected {
+		l, ok := got[sn]
+		if !ok {
+			t.Errorf("lease of %v not restored", sn)
+			continue
+		}
+		if l.Attrs.PublicIP != el.Attrs.PublicIP {
+			t.Errorf("lease of %v restored with PublicIP %v, expected %v", sn, l.Attrs.PublicIP, el.Attrs.PublicIP)
+		}
+		if d := l.Expiration.Sub(el.Expiration); d < -2*time.Second || d > 2*time.Second {
+			t.Errorf("lease of %v restored expiring at %v, expected %v", sn, l.Expiration, el.Expiration)
+		}
+	}
+
+	// restoring again finds everything in place
+	res, err = Restore(ctx, dst, "", restored)
+	if err != nil {
+		t.Fatalf("second Restore failed: %v", err)
+	}
+	if res.Restored != 0 || res.Present != len(b.Leases) || len(res.Conflicts) != 0 {
+		t.Errorf("unexpected result of restoring again: %+v", res)
+	}
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	ctx := context.Background()
+	b, err := Export(ctx, newEtcdManager(newDummyRegistry(0)), "")
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	dst := newEtcdManager(newMockRegistry(0, "", nil)).(*EtcdManager)
+	if err := dst.CreateNetworkConfig(ctx, "", b.Config); err != nil {
+		t.Fatalf("CreateNetworkConfig failed: %v", err)
+	}
+	taken := &Lease{Subnet: b.Leases[0].Subnet, Attrs: &LeaseAttrs{PublicIP: mustParseIP4("9.9.9.9")}}
+	if err := dst.CreateLease(ctx, "", taken, time.Hour); err != nil {
+		t.Fatalf("CreateLease failed: %v", err)
+	}
+
+	res, err := Restore(ctx, dst, "", b)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(res.Conflicts) != 1 || !res.Conflicts[0].Subnet.Equal(taken.Subnet) || res.Conflicts[0].Holder.Attrs.PublicIP != taken.Attrs.PublicIP {
+		t.Errorf("expected a conflict on %v, got %v", taken.Subnet, res.Conflicts)
+	}
+	if res.Restored != len(b.Leases)-1 {
+		t.Errorf("restored %v leases, expected %v", res.Restored, len(b.Leases)-1)
+	}
+
+	// the taken subnet stays with its holder
+	if l := leaseSet(t, dst)[taken.Subnet.String()]; l.Attrs.PublicIP != taken.Attrs.PublicIP {
+		t.Errorf("restore took over %v from its holder", taken.Subnet)
+	}
+}
+
+func TestRestoreConfigMismatch(t *testing.T) {
+	ctx := context.Background()
+	b, err := Export(ctx, newEtcdManager(newDummyRegistry(0)), "")
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	dst := newEtcdManager(newMockRegistry(0, `{ "Network": "10.9.0.0/16" }`, nil)).(*EtcdManager)
+	if _, err := Restore(ctx, dst, "", b); err == nil {
+		t.Error("Restore into a network with a different config succeeded")
+	}
+	if n := len(leaseSet(t, dst)); n != 0 {
+		t.Errorf("restored %v leases into a network with a different config", n)
+	}
+}
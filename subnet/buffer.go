@@ -0,0 +1,187 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Overflow policies of the watch buffer
+const (
+	// OverflowBlock stops the watch until the receiver catches up
+	OverflowBlock = "block"
+	// OverflowResync drops the buffered events and brings the
+	// receiver up to date from a snapshot of the leases instead
+	OverflowResync = "resync"
+)
+
+// Bufferer is implemented by Managers whose watchers should queue up to
+// size events for a receiver that is slow to take them, and deal with a
+// full queue according to policy (OverflowBlock or OverflowResync)
+type Bufferer interface {
+	WatchBuffer() (size int, policy string)
+}
+
+func ValidateOverflowPolicy(policy string) error {
+	switch policy {
+	case "", OverflowBlock, OverflowResync:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q, expected %q or %q", policy, OverflowBlock, OverflowResync)
+}
+
+// eventBuffer queues batches for the receiver and keeps track of the
+// leases it was sent, to resync it from a snapshot on overflow
+type eventBuffer struct {
+	size   int
+	resync bool
+	queue  [][]Event
+	queued int
+	sent   map[ip.IP4Net]Lease
+}
+
+func newEventBuffer(size int, policy string) *eventBuffer {
+	return &eventBuffer{
+		size:   size,
+		resync: policy == OverflowResync,
+		sent:   make(map[ip.IP4Net]Lease),
+	}
+}
+
+// full reports whether batch does not fit. A batch always fits an
+// empty buffer, the snapshot may well be larger than it.
+func (b *eventBuffer) full(batch []Event) bool {
+	return b.queued > 0 && b.queued+len(batch) > b.size
+}
+
+func (b *eventBuffer) push(batch []Event) {
+	b.queue = append(b.queue, batch)
+	b.queued += len(batch)
+}
+
+func (b *eventBuffer) pop() {
+	batch := b.queue[0]
+	b.queue = b.queue[1:]
+	b.queued -= len(batch)
+
+	for _, e := range batch {
+		switch e.Type {
+		case SubnetAdded:
+			b.sent[e.Lease.Subnet] = e.Lease
+		case SubnetRemoved:
+			delete(b.sent, e.Lease.Subnet)
+		}
+	}
+}
+
+// reset replaces what is queued (and batch, which did not fit) by the
+// events that take the receiver from the leases it was sent to leases
+func (b *eventBuffer) reset(batch []Event, leases []Lease) {
+	snapshotDone := false
+	for _, queued := range append([][]Event{batch}, b.queue...) {
+		if _, ok := SplitSnapshotDone(queued); ok {
+			snapshotDone = true
+		}
+	}
+
+	diff := []Event{}
+	current := make(map[ip.IP4Net]bool)
+	for _, l := range leases {
+		current[l.Subnet] = true
+		if old, ok := b.sent[l.Subnet]; !ok || attrsChanged(old.Attrs, l.Attrs) {
+			diff = append(diff, Event{Type: SubnetAdded, Lease: l})
+		}
+	}
+	for sn, l := range b.sent {
+		if !current[sn] {
+			diff = append(diff, Event{Type: SubnetRemoved, Lease: l})
+		}
+	}
+	if snapshotDone {
+		diff = append(diff, Event{Type: SnapshotDone})
+	}
+
+	b.queue, b.queued = nil, 0
+	b.push(diff)
+}
+
+// bufferEvents forwards batches from in to out, queueing up to size
+// events while out is not ready. With OverflowBlock it stops reading in
+// once the queue is full. With OverflowResync it drops the queue and
+// replaces it by the difference between what was sent and the leases
+// returned by snapshot.
+func bufferEvents(ctx context.Context, in <-chan []Event, out chan<- []Event, size int, policy string, snapshot func(context.Context) ([]Lease, error)) {
+	b := newEventBuffer(size, policy)
+
+	for {
+		var sendc chan<- []Event
+		var head []Event
+		if len(b.queue) > 0 {
+			sendc, head = out, b.queue[0]
+		}
+
+		recvc := in
+		if !b.resync && b.queued >= b.size {
+			recvc = nil
+		}
+
+		select {
+		case batch := <-recvc:
+			if !b.full(batch) || !b.resync {
+				b.push(batch)
+				continue
+			}
+
+			log.Warningf("Watch buffer of %v events overflowed, resyncing from a snapshot", size)
+			leases, err := retrySnapshot(ctx, snapshot)
+			if err != nil {
+				return
+			}
+			b.reset(batch, leases)
+
+		case sendc <- head:
+			b.pop()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retrySnapshot calls snapshot with backoff until it succeeds or ctx is done
+func retrySnapshot(ctx context.Context, snapshot func(context.Context) ([]Lease, error)) ([]Lease, error) {
+	delay := watchRetryInitial
+	for {
+		leases, err := snapshot(ctx)
+		if err == nil {
+			return leases, nil
+		}
+		log.Errorf("Failed to get a snapshot of the leases (retrying in %v): %v", delay, err)
+
+		select {
+		case <-watchRetryAfter(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if delay *= 2; delay > watchRetryMax {
+			delay = watchRetryMax
+		}
+	}
+}
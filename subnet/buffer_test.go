@@ -0,0 +1,135 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func bufferLease(i int) Lease {
+	return Lease{
+		Subnet: newIP4Net(fmt.Sprintf("10.3.%d.0", i), 24),
+		Attrs:  &LeaseAttrs{PublicIP: mustParseIP4(fmt.Sprintf("1.1.1.%d", i))},
+	}
+}
+
+func TestBufferOverflowResync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 10.3.1.0 was sent, then 10.3.2.0 ... 10.3.50.0 came while the
+	// receiver was busy, of which 10.3.2.0 and 10.3.3.0 are still there
+	snapshots := 0
+	snapshot := func(ctx context.Context) ([]Lease, error) {
+		snapshots++
+		return []Lease{bufferLease(2), bufferLease(3)}, nil
+	}
+
+	in := make(chan []Event)
+	out := make(chan []Event)
+	go bufferEvents(ctx, in, out, 10, OverflowResync, snapshot)
+
+	in <- []Event{{Type: SubnetAdded, Lease: bufferLease(1)}, {Type: SnapshotDone}}
+	<-out
+
+	for i := 2; i <= 50; i++ {
+		select {
+		case in <- []Event{{Type: SubnetAdded, Lease: bufferLease(i)}}:
+		case <-time.After(time.Second):
+			t.Fatalf("watch blocked at event %v with the resync policy", i)
+		}
+	}
+
+	batch := <-out
+	if snapshots == 0 {
+		t.Fatal("overflow did not trigger a resync")
+	}
+
+	// what takes the receiver from 10.3.1.0 to the snapshot,
+	// followed by whatever came after the last resync
+	leases := map[string]bool{"10.3.1.0/24": true}
+	events := 0
+	for {
+		for _, e := range batch {
+			events++
+			switch e.Type {
+			case SubnetAdded:
+				leases[e.Lease.Subnet.String()] = true
+			case SubnetRemoved:
+				delete(leases, e.Lease.Subnet.String())
+			}
+		}
+
+		select {
+		case batch = <-out:
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+		break
+	}
+
+	if events > 10+2 {
+		t.Errorf("receiver got %v events for a buffer of 10", events)
+	}
+	if leases["10.3.1.0/24"] {
+		t.Error("lease missing from the snapshot was not removed")
+	}
+	if !leases["10.3.2.0/24"] || !leases["10.3.3.0/24"] {
+		t.Errorf("leases of the snapshot were not added: %v", leases)
+	}
+}
+
+func TestBufferOverflowBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snapshot := func(ctx context.Context) ([]Lease, error) {
+		t.Error("blocking buffer resynced")
+		return nil, nil
+	}
+
+	in := make(chan []Event)
+	out := make(chan []Event)
+	go bufferEvents(ctx, in, out, 2, OverflowBlock, snapshot)
+
+	in <- []Event{{Type: SubnetAdded, Lease: bufferLease(1)}}
+	in <- []Event{{Type: SubnetAdded, Lease: bufferLease(2)}}
+
+	select {
+	case in <- []Event{{Type: SubnetAdded, Lease: bufferLease(3)}}:
+		t.Fatal("full buffer took another event")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// room for one more once the receiver takes one
+	if batch := <-out; !batch[0].Lease.Subnet.Equal(bufferLease(1).Subnet) {
+		t.Fatalf("expected the first event first, got %v", batch)
+	}
+	select {
+	case in <- []Event{{Type: SubnetAdded, Lease: bufferLease(3)}}:
+	case <-time.After(time.Second):
+		t.Fatal("buffer did not take an event after the receiver caught up")
+	}
+
+	for i := 2; i <= 3; i++ {
+		if batch := <-out; !batch[0].Lease.Subnet.Equal(bufferLease(i).Subnet) {
+			t.Errorf("expected %v, got %v", bufferLease(i).Subnet, batch)
+		}
+	}
+}
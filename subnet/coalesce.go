@@ -0,0 +1,134 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Coalescer is implemented by Managers whose watchers should buffer lease
+// events for a while and deliver their net effect in one batch
+type Coalescer interface {
+	CoalesceWindow() time.Duration
+}
+
+// coalescer tracks the leases the receiver knows about so that it can
+// reduce a window of events to the ones that change its state
+type coalescer struct {
+	known   map[ip.IP4Net]bool
+	pending map[ip.IP4Net]Event
+	order   []ip.IP4Net
+	// a SnapshotDone event is pending, it goes last
+	snapshotDone bool
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		known:   make(map[ip.IP4Net]bool),
+		pending: make(map[ip.IP4Net]Event),
+	}
+}
+
+func (c *coalescer) add(batch []Event) {
+	for _, e := range batch {
+		if e.Type == SnapshotDone {
+			c.snapshotDone = true
+			continue
+		}
+		if _, ok := c.pending[e.Lease.Subnet]; !ok {
+			c.order = append(c.order, e.Lease.Subnet)
+		}
+		// the last event of a lease determines its final state
+		c.pending[e.Lease.Subnet] = e
+	}
+}
+
+// flush returns the net effect of the pending events
+func (c *coalescer) flush() []Event {
+	batch := []Event{}
+
+	for _, sn := range c.order {
+		e := c.pending[sn]
+
+		switch e.Type {
+		case SubnetAdded:
+			c.known[sn] = true
+			batch = append(batch, e)
+
+		case SubnetRemoved:
+			// added and removed within the window: nothing to undo
+			if c.known[sn] {
+				delete(c.known, sn)
+				batch = append(batch, e)
+			}
+		}
+	}
+
+	if c.snapshotDone {
+		batch = append(batch, Event{Type: SnapshotDone})
+		c.snapshotDone = false
+	}
+
+	c.pending = make(map[ip.IP4Net]Event)
+	c.order = nil
+
+	return batch
+}
+
+// coalesceEvents forwards batches from in to out. The first batch (the
+// snapshot) is passed as is, later ones are held for window and merged.
+func coalesceEvents(ctx context.Context, in <-chan []Event, out chan<- []Event, window time.Duration) {
+	c := newCoalescer()
+	first := true
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case batch := <-in:
+			c.add(batch)
+			if first {
+				first = false
+				if !send(ctx, out, c.flush()) {
+					return
+				}
+			} else if timer == nil {
+				timer = time.After(window)
+			}
+
+		case <-timer:
+			timer = nil
+			if batch := c.flush(); len(batch) > 0 {
+				if !send(ctx, out, batch) {
+					return
+				}
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func send(ctx context.Context, out chan<- []Event, batch []Event) bool {
+	select {
+	case out <- batch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
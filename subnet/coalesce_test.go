@@ -0,0 +1,84 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer()
+
+	a := Lease{Subnet: newIP4Net("10.3.1.0", 24), Attrs: &LeaseAttrs{PublicIP: mustParseIP4("1.1.1.1")}}
+	b := Lease{Subnet: newIP4Net("10.3.2.0", 24), Attrs: &LeaseAttrs{PublicIP: mustParseIP4("1.1.1.2")}}
+	d := Lease{Subnet: newIP4Net("10.3.3.0", 24), Attrs: &LeaseAttrs{PublicIP: mustParseIP4("1.1.1.3")}}
+
+	c.add([]Event{{Type: SubnetAdded, Lease: a}})
+	if batch := c.flush(); len(batch) != 1 {
+		t.Fatalf("expected the snapshot to pass through, got %v", batch)
+	}
+
+	a2 := a
+	a2.Attrs = &LeaseAttrs{PublicIP: mustParseIP4("1.1.1.9")}
+
+	c.add([]Event{{Type: SubnetAdded, Lease: b}, {Type: SubnetRemoved, Lease: a}})
+	c.add([]Event{{Type: SubnetRemoved, Lease: b}, {Type: SubnetAdded, Lease: d}, {Type: SubnetAdded, Lease: a2}})
+
+	batch := c.flush()
+	if len(batch) != 2 {
+		t.Fatalf("expected 2 coalesced events, got %v", batch)
+	}
+
+	// a was re-added with new attrs, b came and went, d is new
+	if batch[0].Type != SubnetAdded || !batch[0].Lease.Subnet.Equal(a.Subnet) || batch[0].Lease.Attrs.PublicIP != a2.Attrs.PublicIP {
+		t.Errorf("expected %v to be re-added via %v, got %v", a.Subnet, a2.Attrs.PublicIP, batch[0])
+	}
+	if batch[1].Type != SubnetAdded || !batch[1].Lease.Subnet.Equal(d.Subnet) {
+		t.Errorf("expected %v to be added, got %v", d.Subnet, batch[1])
+	}
+
+	// removing a known lease goes through
+	c.add([]Event{{Type: SubnetRemoved, Lease: d}})
+	if batch := c.flush(); len(batch) != 1 || batch[0].Type != SubnetRemoved {
+		t.Errorf("expected %v to be removed, got %v", d.Subnet, batch)
+	}
+}
+
+func TestCoalesceEventsWindow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan []Event)
+	out := make(chan []Event, 10)
+	go coalesceEvents(ctx, in, out, 50*time.Millisecond)
+
+	in <- []Event{}
+	if batch := <-out; len(batch) != 0 {
+		t.Fatalf("expected an empty snapshot, got %v", batch)
+	}
+
+	l := Lease{Subnet: newIP4Net("10.3.1.0", 24), Attrs: &LeaseAttrs{}}
+	in <- []Event{{Type: SubnetAdded, Lease: l}}
+	in <- []Event{{Type: SubnetRemoved, Lease: l}}
+
+	select {
+	case batch := <-out:
+		t.Errorf("add and remove within the window produced %v", batch)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
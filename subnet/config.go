@@ -17,16 +17,74 @@ package subnet
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
 
 type Config struct {
-	Network   ip.IP4Net
-	SubnetMin ip.IP4
-	SubnetMax ip.IP4
-	SubnetLen uint
-	Backend   json.RawMessage `json:",omitempty"`
+	Network   ip.IP4Net       `json:"Network"`
+	SubnetMin ip.IP4          `json:"SubnetMin"`
+	SubnetMax ip.IP4          `json:"SubnetMax"`
+	SubnetLen uint            `json:"SubnetLen"`
+	Backend   json.RawMessage `json:"Backend,omitempty"`
+
+	// Allocation is how subnets are picked for new leases,
+	// AllocateRandom (the default) or AllocateHashed
+	Allocation string `json:"Allocation,omitempty"`
+
+	// GatewayOffset is where in each lease the address reserved for
+	// the node is, see Gateway. Zero means 1, the first usable address.
+	GatewayOffset uint `json:"GatewayOffset,omitempty"`
+
+	// Pools, if set, are the disjoint blocks of Network subnets are
+	// allocated from in place of SubnetMin to SubnetMax, each carved
+	// into SubnetLen sized subnets and drawn from in order. SubnetMin
+	// and SubnetMax are then the first and last subnets of the pools.
+	Pools []ip.IP4Net `json:"Pools,omitempty"`
+}
+
+// subnetRanges returns the contiguous ranges of subnets leases are taken
+// from, in order: one per pool, or the one from SubnetMin to SubnetMax.
+// Each is a copy of c with the SubnetMin and SubnetMax of the range.
+func (c *Config) subnetRanges() []*Config {
+	if len(c.Pools) == 0 {
+		return []*Config{c}
+	}
+
+	subnetSize := ip.IP4(1 << (32 - c.SubnetLen))
+	ranges := make([]*Config, len(c.Pools))
+	for i, p := range c.Pools {
+		r := *c
+		r.Pools = nil
+		r.SubnetMin = p.IP
+		r.SubnetMax = p.Next().IP - subnetSize
+		ranges[i] = &r
+	}
+	return ranges
+}
+
+// Gateway returns the address reserved for the node in its lease sn:
+// backends address their devices with it, the bridge of the containers
+// gets it and IPAM never hands it out
+func (c *Config) Gateway(sn ip.IP4Net) ip.IP4 {
+	offset := c.GatewayOffset
+	if offset == 0 {
+		offset = 1
+	}
+	return sn.Network().IP + ip.IP4(offset)
+}
+
+// without the method below
+type plainConfig Config
+
+// UnmarshalJSON accepts the snake_case field names along with the Go ones
+func (c *Config) UnmarshalJSON(b []byte) error {
+	b, err := configNames.fromSnakeCase(b)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, (*plainConfig)(c))
 }
 
 func ParseConfig(s string) (*Config, error) {
@@ -36,6 +94,10 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := validateAllocation(cfg.Allocation); err != nil {
+		return nil, err
+	}
+
 	if cfg.SubnetLen > 0 {
 		if cfg.SubnetLen < cfg.Network.PrefixLen {
 			return nil, errors.New("HostSubnet is larger network than Network")
@@ -52,6 +114,15 @@ func ParseConfig(s string) (*Config, error) {
 
 	subnetSize := ip.IP4(1 << (32 - cfg.SubnetLen))
 
+	// neither the network nor the broadcast address of a lease
+	if cfg.GatewayOffset >= uint(subnetSize)-1 {
+		return nil, errors.New("GatewayOffset is outside the subnets of the hosts")
+	}
+
+	if len(cfg.Pools) > 0 {
+		return cfg, validatePools(cfg)
+	}
+
 	if cfg.SubnetMin == ip.IP4(0) {
 		// skip over the first subnet otherwise it causes problems. e.g.
 		// if Network is 10.100.0.0/16, having an interface with 10.0.0.0
@@ -69,3 +140,42 @@ func ParseConfig(s string) (*Config, error) {
 
 	return cfg, nil
 }
+
+// validatePools checks that the pools of cfg are disjoint blocks of the
+// network holding at least a subnet each, and sets SubnetMin and SubnetMax
+func validatePools(cfg *Config) error {
+	min, max := cfg.SubnetMin, cfg.SubnetMax
+
+	for i, p := range cfg.Pools {
+		switch {
+		case !p.Network().Equal(p):
+			return fmt.Errorf("Pool %v is not a network address, %v is", p, p.Network())
+		case p.PrefixLen > cfg.SubnetLen:
+			return fmt.Errorf("Pool %v is smaller than the subnets of the hosts", p)
+		case !cfg.Network.Contains(p.IP) || p.PrefixLen < cfg.Network.PrefixLen:
+			return fmt.Errorf("Pool %v is not in the range of the Network", p)
+		}
+		for _, q := range cfg.Pools[:i] {
+			if p.Overlaps(q) {
+				return fmt.Errorf("Pools %v and %v overlap", q, p)
+			}
+		}
+	}
+
+	ranges := cfg.subnetRanges()
+	cfg.SubnetMin, cfg.SubnetMax = ranges[0].SubnetMin, ranges[0].SubnetMax
+	for _, r := range ranges[1:] {
+		if r.SubnetMin < cfg.SubnetMin {
+			cfg.SubnetMin = r.SubnetMin
+		}
+		if r.SubnetMax > cfg.SubnetMax {
+			cfg.SubnetMax = r.SubnetMax
+		}
+	}
+
+	// as set above when the config was parsed before
+	if min != ip.IP4(0) && min != cfg.SubnetMin || max != ip.IP4(0) && max != cfg.SubnetMax {
+		return errors.New("SubnetMin and SubnetMax can't be set along with Pools")
+	}
+	return nil
+}
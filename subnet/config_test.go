@@ -15,7 +15,12 @@
 package subnet
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -69,3 +74,172 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestConfigPools(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.0.0.0/8", "SubnetLen": 24, "Pools": [ "10.5.0.0/16", "10.1.0.0/16" ] }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.SubnetMin.String() != "10.1.0.0" || cfg.SubnetMax.String() != "10.5.255.0" {
+		t.Errorf("expected SubnetMin and SubnetMax to span the pools, got %v and %v", cfg.SubnetMin, cfg.SubnetMax)
+	}
+
+	// a config cached in its parsed form parses the same
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfig(string(data)); err != nil {
+		t.Errorf("ParseConfig failed on %s: %v", data, err)
+	}
+
+	for _, s := range []string{
+		// overlapping
+		`{ "Network": "10.0.0.0/8", "Pools": [ "10.1.0.0/16", "10.1.128.0/17" ] }`,
+		// outside the network
+		`{ "Network": "10.0.0.0/8", "Pools": [ "10.1.0.0/16", "11.1.0.0/16" ] }`,
+		`{ "Network": "10.1.0.0/16", "Pools": [ "10.0.0.0/8" ] }`,
+		// smaller than a subnet
+		`{ "Network": "10.0.0.0/8", "SubnetLen": 24, "Pools": [ "10.1.0.0/25" ] }`,
+		// not a network address (10.1.2.0/16)
+		`{ "Network": "10.0.0.0/8", "Pools": [ { "IP": 167838208, "PrefixLen": 16 } ] }`,
+		`{ "Network": "10.0.0.0/8", "SubnetMin": "10.1.5.0", "Pools": [ "10.1.0.0/16" ] }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("ParseConfig accepted %v", s)
+		}
+	}
+}
+
+func TestConfigGateway(t *testing.T) {
+	sn := newIP4Net("10.3.5.0", 24)
+
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if gw := cfg.Gateway(sn); gw.String() != "10.3.5.1" {
+		t.Errorf("default gateway of %v is %v, expected the first usable address", sn, gw)
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16", "GatewayOffset": 254 }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if gw := cfg.Gateway(sn); gw.String() != "10.3.5.254" {
+		t.Errorf("gateway of %v is %v, expected 10.3.5.254", sn, gw)
+	}
+
+	// the broadcast address of a lease
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "GatewayOffset": 255 }`); err == nil {
+		t.Error("ParseConfig accepted a GatewayOffset past the subnets")
+	}
+}
+
+// networksRegistry serves a config per network
+type networksRegistry struct {
+	*mockSubnetRegistry
+	configs map[string]string
+}
+
+func (r *networksRegistry) getConfig(ctx context.Context, network string) (*etcd.Response, error) {
+	cfg, ok := r.configs[network]
+	if !ok {
+		return nil, &etcd.EtcdError{ErrorCode: etcdKeyNotFound}
+	}
+	return &etcd.Response{Node: &etcd.Node{Value: cfg}}, nil
+}
+
+func newNetworksManager(configs map[string]string) Manager {
+	return newEtcdManager(&networksRegistry{newMockRegistry(0, "", nil), configs})
+}
+
+func TestConfigInherits(t *testing.T) {
+	sm := newNetworksManager(map[string]string{
+		"base": `{ "Network": "10.3.0.0/16", "SubnetLen": 26, "Backend": { "Type": "vxlan", "VNI": 3, "MTU": 1450 } }`,
+		"blue": `{ "Inherits": "base", "Backend": { "MTU": 1400 } }`,
+	})
+
+	cfg, err := sm.GetNetworkConfig(context.Background(), "blue")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+
+	if cfg.Network.String() != "10.3.0.0/16" || cfg.SubnetLen != 26 {
+		t.Errorf("Network not inherited: %v with SubnetLen %v", cfg.Network, cfg.SubnetLen)
+	}
+
+	var backend struct {
+		Type string
+		VNI  int
+		MTU  int
+	}
+	if err := json.Unmarshal(cfg.Backend, &backend); err != nil {
+		t.Fatalf("Failed to parse merged backend %s: %v", cfg.Backend, err)
+	}
+	if backend.Type != "vxlan" || backend.VNI != 3 {
+		t.Errorf("Backend not inherited: %s", cfg.Backend)
+	}
+	if backend.MTU != 1400 {
+		t.Errorf("Backend MTU not overridden: %s", cfg.Backend)
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	base := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.5.0", "Backend": { "Type": "vxlan", "VNI": 3, "MigrateFrom": { "Type": "udp", "Port": 7890 } } }`
+
+	for _, tc := range []struct {
+		child    string
+		expected string
+	}{
+		// lower case keys override like encoding/json matches them
+		{`{ "network": "10.4.0.0/16", "subnetmin": null }`, `{"Backend":{"Type":"vxlan","VNI":3,"MigrateFrom":{"Type":"udp","Port":7890}},"network":"10.4.0.0/16"}`},
+		{`{ "Backend": { "VNI": null, "MigrateFrom": { "Type": "host-gw" } } }`, `{"Backend":{"MigrateFrom":{"Type":"host-gw"},"Type":"vxlan"},"Network":"10.3.0.0/16","SubnetMin":"10.3.5.0"}`},
+		{`{ "Backend": null }`, `{"Network":"10.3.0.0/16","SubnetMin":"10.3.5.0"}`},
+	} {
+		var b, c configObject
+		if err := json.Unmarshal([]byte(base), &b); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tc.child), &c); err != nil {
+			t.Fatal(err)
+		}
+
+		merged, err := mergeConfig(b, c)
+		if err != nil {
+			t.Fatalf("mergeConfig(%v) failed: %v", tc.child, err)
+		}
+
+		// compare as decoded values, key order is not kept
+		var got, expected interface{}
+		data, _ := json.Marshal(merged)
+		json.Unmarshal(data, &got)
+		json.Unmarshal([]byte(tc.expected), &expected)
+		gotData, _ := json.Marshal(got)
+		expectedData, _ := json.Marshal(expected)
+		if string(gotData) != string(expectedData) {
+			t.Errorf("mergeConfig(%v): expected %s, got %s", tc.child, expectedData, gotData)
+		}
+	}
+}
+
+func TestConfigInheritsErrors(t *testing.T) {
+	sm := newNetworksManager(map[string]string{
+		"loop1":   `{ "Inherits": "loop2" }`,
+		"loop2":   `{ "Inherits": "loop1", "Network": "10.3.0.0/16" }`,
+		"orphan":  `{ "Inherits": "missing" }`,
+		"base":    `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.5.0" }`,
+		"outside": `{ "Inherits": "base", "Network": "10.4.0.0/16" }`,
+	})
+
+	for network, msg := range map[string]string{
+		"loop1":   "inherits from itself",
+		"orphan":  "missing",
+		"outside": "SubnetMin",
+	} {
+		_, err := sm.GetNetworkConfig(context.Background(), network)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("GetNetworkConfig(%v): expected an error mentioning %q, got %v", network, msg, err)
+		}
+	}
+}
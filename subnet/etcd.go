@@ -15,7 +15,6 @@
 package subnet
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -34,15 +33,32 @@ const (
 	subnetTTL       = 24 * 3600
 )
 
+// DefaultLeaseHold is long enough for a node to get its first renewal in
+// while a short hold of a subnet that ends up without a node is soon over
+const DefaultLeaseHold = 5 * time.Minute
+
 // etcd error codes
 const (
 	etcdKeyNotFound       = 100
+	etcdTestFailed        = 101
 	etcdKeyAlreadyExists  = 105
 	etcdEventIndexCleared = 401
 )
 
 type EtcdManager struct {
 	registry Registry
+	keyFunc  KeyFunc
+	// how long past their expiry leases are kept and can be renewed
+	grace time.Duration
+	// how long the subnet of a new lease is held for its node, see
+	// holdSubnet
+	hold time.Duration
+	// only log leases duplicating the PublicIP of another node
+	// instead of rejecting them, for nodes behind a shared NAT
+	warnDuplicates bool
+	// take over the live lease of another PublicIP with the
+	// hostname of the acquiring node, see findOwnLease
+	reuseByHostname bool
 }
 
 var (
@@ -62,20 +78,147 @@ func NewEtcdManager(config *EtcdConfig) (Manager, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &EtcdManager{r}, nil
+	keyFunc := config.KeyFunc
+	if keyFunc == nil {
+		keyFunc = SubnetKey
+	}
+	return &EtcdManager{
+		registry:       r,
+		keyFunc:        keyFunc,
+		grace:          config.LeaseGrace,
+		hold:           config.LeaseHold,
+		warnDuplicates: config.DuplicatePublicIP == DuplicatePublicIPWarn,
+
+		reuseByHostname: config.ReuseHostnameLease,
+	}, nil
 }
 
 func newEtcdManager(r Registry) Manager {
-	return &EtcdManager{r}
+	return &EtcdManager{registry: r, keyFunc: SubnetKey}
+}
+
+// leaseTTL is the TTL leases are stored with, their nominal lifetime
+// extended by the grace window
+func (m *EtcdManager) leaseTTL() uint64 {
+	return subnetTTL + uint64(m.grace/time.Second)
 }
 
+// expiration returns the nominal expiry of the lease stored in node
+func (m *EtcdManager) expiration(node *etcd.Node) time.Time {
+	return node.Expiration.Add(-m.grace)
+}
+
+// checkRenewal fails the renewal of a lease that expired longer than the
+// grace window ago. Renewals within it are let through but logged, they
+// hint at the clocks of the node and the store being skewed. Without a
+// grace window late renewals recreate the lease, as they always did.
+func (m *EtcdManager) checkRenewal(lease *Lease) error {
+	if lease.Expiration.IsZero() || m.grace == 0 {
+		return nil
+	}
+
+	late := time.Now().Sub(lease.Expiration)
+	switch {
+	case late <= 0:
+		return nil
+	case late > m.grace:
+		log.Warningf("Lease %v expired %v ago, past the grace of %v, not renewing it", lease.Subnet, late, m.grace)
+		return ErrLeaseExpired
+	}
+
+	log.Warningf("Lease %v renewed %v after its expiry, within the grace of %v; is the clock of its node skewed?", lease.Subnet, late, m.grace)
+	return nil
+}
+
+// GetNetworkConfig returns the config of network, merged with the
+// config it inherits from if it names one
 func (m *EtcdManager) GetNetworkConfig(ctx context.Context, network string) (*Config, error) {
+	s, err := resolveConfig(ctx, m.getRawConfig, network)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(s)
+}
+
+func (m *EtcdManager) getRawConfig(ctx context.Context, network string) (string, error) {
 	cfgResp, err := m.registry.getConfig(ctx, network)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return "", ErrConfigNotFound
+		}
+		return "", err
+	}
+	return cfgResp.Node.Value, nil
+}
+
+func (m *EtcdManager) GetNetworkStats(ctx context.Context, network string) (*NetworkStats, error) {
+	config, err := m.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, _, err := m.getLeases(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	reserved, err := m.getReservations(ctx, network)
 	if err != nil {
 		return nil, err
 	}
 
-	return ParseConfig(cfgResp.Node.Value)
+	return networkStats(config, leases, reserved), nil
+}
+
+// LeaseStats returns the NetworkStats of a network with the given leases
+// and no reservations
+func LeaseStats(config *Config, leases []Lease) *NetworkStats {
+	return networkStats(config, leases, nil)
+}
+
+func networkStats(config *Config, leases []Lease, reserved map[ip.IP4Net]string) *NetworkStats {
+	ranges := config.subnetRanges()
+
+	// number of SubnetLen sized blocks of sn within the ranges
+	blocks := func(sn ip.IP4Net) uint {
+		if sn.PrefixLen > config.SubnetLen {
+			return 0
+		}
+		for _, r := range ranges {
+			if sn.IP >= r.SubnetMin && lastBlock(r, sn) <= r.SubnetMax {
+				return 1 << (config.SubnetLen - sn.PrefixLen)
+			}
+		}
+		return 0
+	}
+
+	stats := &NetworkStats{}
+	for _, r := range ranges {
+		stats.Total += uint((r.SubnetMax-r.SubnetMin)>>(32-r.SubnetLen)) + 1
+	}
+
+	for _, l := range leases {
+		stats.Leased += blocks(l.Subnet)
+	}
+
+ReservedLoop:
+	for sn := range reserved {
+		// a drained lease is reserved before it is deleted
+		for _, l := range leases {
+			if sn.Overlaps(l.Subnet) {
+				continue ReservedLoop
+			}
+		}
+		stats.Reserved += blocks(sn)
+	}
+
+	if used := stats.Leased + stats.Reserved; used < stats.Total {
+		stats.Free = stats.Total - used
+	}
+
+	stats.MinVersion, stats.Features = clusterVersion(leases)
+	return stats
 }
 
 func (m *EtcdManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
@@ -84,6 +227,14 @@ func (m *EtcdManager) AcquireLease(ctx context.Context, network string, attrs *L
 		return nil, err
 	}
 
+	// no point in retrying a request that can never be satisfied
+	if _, err := LeasePrefixLen(config, attrs); err != nil {
+		return nil, err
+	}
+	if err := ValidateEndpoints(attrs); err != nil {
+		return nil, err
+	}
+
 	for {
 		l, err := m.acquireLeaseOnce(ctx, network, config, attrs)
 		switch {
@@ -91,7 +242,7 @@ func (m *EtcdManager) AcquireLease(ctx context.Context, network string, attrs *L
 			log.Info("Subnet lease acquired: ", l.Subnet)
 			return l, nil
 
-		case err == context.Canceled, err == context.DeadlineExceeded:
+		case err == context.Canceled, err == context.DeadlineExceeded, err == ErrDuplicatePublicIP:
 			return nil, err
 
 		default:
@@ -107,66 +258,179 @@ func (m *EtcdManager) AcquireLease(ctx context.Context, network string, attrs *L
 	}
 }
 
-func findLeaseByIP(leases []Lease, pubIP ip.IP4) *Lease {
+// findOwnLease looks for a lease held by the node described by attrs.
+// A lease with the same PublicIP is preferred, failing that the node is
+// recognized by its hostname (e.g. after its IP changed). Hostnames need
+// not be unique (cloned images, "localhost"), so a live lease of another
+// PublicIP is only taken over if m.reuseByHostname, expired ones (kept
+// for the grace) always are.
+func (m *EtcdManager) findOwnLease(leases []Lease, attrs *LeaseAttrs) *Lease {
 	for _, l := range leases {
-		if pubIP == l.Attrs.PublicIP {
+		if attrs.PublicIP == l.Attrs.PublicIP && !otherNode(l.Attrs, attrs) {
 			return &l
 		}
 	}
 
+	if attrs.Hostname != "" {
+		now := time.Now()
+		for _, l := range leases {
+			// stored expirations include the grace
+			expired := !l.Expiration.IsZero() && l.Expiration.Add(-m.grace).Before(now)
+			if attrs.Hostname == l.Attrs.Hostname && (m.reuseByHostname || expired) {
+				return &l
+			}
+		}
+	}
+
+	return nil
+}
+
+// otherNode returns whether x and y are attributes of different nodes.
+// Nodes are told apart by hostname, without one they can't be.
+func otherNode(x, y *LeaseAttrs) bool {
+	return x.Hostname != "" && y.Hostname != "" && x.Hostname != y.Hostname
+}
+
+// checkDuplicate fails with ErrDuplicatePublicIP if a live lease of
+// another node has the PublicIP of attrs, unless duplicates are only
+// to be warned about
+func (m *EtcdManager) checkDuplicate(leases []Lease, attrs *LeaseAttrs) error {
+	now := time.Now()
+	for _, l := range leases {
+		if l.Attrs.PublicIP != attrs.PublicIP || !otherNode(l.Attrs, attrs) {
+			continue
+		}
+		if !l.Expiration.IsZero() && l.Expiration.Before(now) {
+			continue
+		}
+
+		if m.warnDuplicates {
+			log.Warningf("PublicIP %v of %v is also used by %v (lease %v)", attrs.PublicIP, attrs.Hostname, l.Attrs.Hostname, l.Subnet)
+			return nil
+		}
+		log.Errorf("Rejecting lease for %v: PublicIP %v is already used by %v (lease %v)", attrs.Hostname, attrs.PublicIP, l.Attrs.Hostname, l.Subnet)
+		return ErrDuplicatePublicIP
+	}
 	return nil
 }
 
 func (m *EtcdManager) tryAcquireLease(ctx context.Context, network string, config *Config, extIP ip.IP4, attrs *LeaseAttrs) (*Lease, error) {
 	var err error
-	leases, _, err := m.getLeases(ctx, network)
+	leases, index, err := m.getLeases(ctx, network)
 	if err != nil {
 		return nil, err
 	}
 
-	attrBytes, err := json.Marshal(attrs)
+	avoid := attrs.AvoidSubnets
+	stored := *attrs
+	stored.AvoidSubnets = nil
+	// the etcd index only grows, every lease written so far has an
+	// epoch of at most index (concurrent acquires may get the same
+	// one, peers break the tie)
+	stored.Epoch = index + 1
+	attrs = &stored
+
+	prefixLen, err := LeasePrefixLen(config, attrs)
 	if err != nil {
 		return nil, err
 	}
 
-	// try to reuse a subnet if there's one that matches our IP
-	if l := findLeaseByIP(leases, extIP); l != nil {
-		// make sure the existing subnet is still within the configured network
-		if isSubnetConfigCompat(config, l.Subnet) {
-			log.Infof("Found lease (%v) for current IP (%v), reusing", l.Subnet, extIP)
-			resp, err := m.registry.updateSubnet(ctx, network, l.Key(), string(attrBytes), subnetTTL)
+	if err := m.checkDuplicate(leases, attrs); err != nil {
+		return nil, err
+	}
+
+	// try to reuse a subnet if we already hold one
+	if l := m.findOwnLease(leases, attrs); l != nil {
+		// make sure the existing subnet is not to be avoided
+		// and still within the configured network
+		if avoided := overlapping(l.Subnet, avoid); avoided != nil {
+			log.Infof("Found lease (%v) for current IP (%v) but it overlaps %v, deleting", l.Subnet, extIP, *avoided)
+			if _, err := m.registry.deleteSubnet(ctx, network, m.leaseKey(l)); err != nil {
+				return nil, err
+			}
+		} else if isSubnetConfigCompat(config, l.Subnet, prefixLen) {
+			if l.Attrs.PublicIP != extIP {
+				log.Infof("Found lease (%v) for current hostname (%v) held by %v, reusing", l.Subnet, attrs.Hostname, l.Attrs.PublicIP)
+			} else {
+				log.Infof("Found lease (%v) for current IP (%v), reusing", l.Subnet, extIP)
+			}
+			oldKey := m.leaseKey(l)
+			l.Attrs = attrs
+			key, value, err := m.encodeLease(l)
 			if err != nil {
 				return nil, err
 			}
+			resp, err := m.registry.updateSubnet(ctx, network, key, value, m.leaseTTL())
+			if err != nil {
+				return nil, err
+			}
+			if key != oldKey {
+				// the node's identity changed along with its IP
+				if _, err := m.registry.deleteSubnet(ctx, network, oldKey); err != nil && !isKeyNotFound(err) {
+					return nil, err
+				}
+			}
 
-			l.Attrs = attrs
-			l.Expiration = *resp.Node.Expiration
+			l.Expiration = m.expiration(resp.Node)
 			return l, nil
 		} else {
 			log.Infof("Found lease (%v) for current IP (%v) but not compatible with current config, deleting", l.Subnet, extIP)
-			if _, err := m.registry.deleteSubnet(ctx, network, l.Key()); err != nil {
+			if _, err := m.registry.deleteSubnet(ctx, network, m.leaseKey(l)); err != nil {
 				return nil, err
 			}
 		}
 	}
 
-	// no existing match, grab a new one
-	sn, err := m.allocateSubnet(config, leases)
+	reserved, err := m.getReservations(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	// no existing match, take the subnet reserved for us or grab a new one
+	sn, ok := reservedSubnet(reserved, nodeIdentity(attrs))
+	if ok && isSubnetConfigCompat(config, sn, prefixLen) && overlapping(sn, avoid) == nil {
+		log.Infof("Found subnet (%v) reserved for current node (%v), taking it", sn, nodeIdentity(attrs))
+	} else {
+		// reserved subnets are as good as taken
+		taken := leases
+		for rsn := range reserved {
+			taken = append(taken, Lease{Subnet: rsn})
+		}
+		for _, asn := range avoid {
+			taken = append(taken, Lease{Subnet: asn})
+		}
+
+		sn, err = allocateSubnet(config, prefixLen, taken, nodeIdentity(attrs))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, value, err := m.encodeLease(&Lease{Subnet: sn, Attrs: attrs})
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := m.registry.createSubnet(ctx, network, sn.StringSep(".", "-"), string(attrBytes), subnetTTL)
+	resp, err := m.registry.createSubnet(ctx, network, key, value, m.leaseTTL())
 	switch {
 	case err == nil:
+		if m.hold > 0 {
+			// replaces the reservation taken, if any
+			m.holdSubnet(ctx, network, sn, attrs)
+		} else if _, ok := reserved[sn]; ok {
+			if _, err := m.registry.deleteReservation(ctx, network, sn.StringSep(".", "-")); err != nil && !isKeyNotFound(err) {
+				// it expires on its own
+				log.Warningf("Failed to remove reservation of %v: %v", sn, err)
+			}
+		}
 		return &Lease{
 			Subnet:     sn,
 			Attrs:      attrs,
-			Expiration: *resp.Node.Expiration,
+			Expiration: m.expiration(resp.Node),
 		}, nil
 
 	// if etcd returned Key Already Exists, try again.
-	case err.(*etcd.EtcdError).ErrorCode == etcdKeyAlreadyExists:
+	case isKeyAlreadyExists(err):
 		return nil, nil
 
 	default:
@@ -174,6 +438,59 @@ func (m *EtcdManager) tryAcquireLease(ctx context.Context, network string, confi
 	}
 }
 
+// overlapping returns the first of nets that overlaps sn, nil if none does
+func overlapping(sn ip.IP4Net, nets []ip.IP4Net) *ip.IP4Net {
+	for i := range nets {
+		if sn.Overlaps(nets[i]) {
+			return &nets[i]
+		}
+	}
+	return nil
+}
+
+// getReservations returns the reserved subnets of the network and the
+// hostname each is reserved for
+func (m *EtcdManager) getReservations(ctx context.Context, network string) (map[ip.IP4Net]string, error) {
+	resp, err := m.registry.getReservations(ctx, network)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve reservations: %v", err)
+	}
+
+	reserved := make(map[ip.IP4Net]string)
+	for _, node := range resp.Node.Nodes {
+		if sn, err := ParseSubnetKey(node.Key); err == nil {
+			reserved[sn] = node.Value
+		}
+	}
+	return reserved, nil
+}
+
+// reservedSubnet returns the subnet reserved for the node of identity (see
+// nodeIdentity): by DrainLease for its hostname or by holdSubnet
+func reservedSubnet(reserved map[ip.IP4Net]string, identity string) (ip.IP4Net, bool) {
+	for sn, h := range reserved {
+		if h == identity {
+			return sn, true
+		}
+	}
+	return ip.IP4Net{}, false
+}
+
+// holdSubnet reserves sn, the subnet of a new lease, for its node for the
+// hold window. Were the lease to expire before the node first renews it
+// (e.g. with a short TTL or a delayed renewal), the subnet is not
+// allocated to another node meanwhile; the node itself gets it back.
+func (m *EtcdManager) holdSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs) {
+	ttl := uint64((m.hold + time.Second - 1) / time.Second)
+	if _, err := m.registry.createReservation(ctx, network, sn.StringSep(".", "-"), nodeIdentity(attrs), ttl); err != nil {
+		// the lease is there all the same
+		log.Warningf("Failed to hold %v for %v: %v", sn, nodeIdentity(attrs), err)
+	}
+}
+
 func (m *EtcdManager) acquireLeaseOnce(ctx context.Context, network string, config *Config, attrs *LeaseAttrs) (*Lease, error) {
 	for i := 0; i < registerRetries; i++ {
 		l, err := m.tryAcquireLease(ctx, network, config, attrs.PublicIP, attrs)
@@ -196,7 +513,8 @@ func (m *EtcdManager) acquireLeaseOnce(ctx context.Context, network string, conf
 	return nil, errors.New("Max retries reached trying to acquire a subnet")
 }
 
-func parseSubnetKey(s string) (ip.IP4Net, error) {
+// ParseSubnetKey parses a lease key as produced by Lease.Key()
+func ParseSubnetKey(s string) (ip.IP4Net, error) {
 	if parts := subnetRegex.FindStringSubmatch(s); len(parts) == 3 {
 		snIp := net.ParseIP(parts[1]).To4()
 		prefixLen, err := strconv.ParseUint(parts[2], 10, 5)
@@ -208,28 +526,37 @@ func parseSubnetKey(s string) (ip.IP4Net, error) {
 	return ip.IP4Net{}, errors.New("Error parsing IP Subnet")
 }
 
-func (m *EtcdManager) allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
+func allocateSubnet(config *Config, prefixLen uint, leases []Lease, identity string) (ip.IP4Net, error) {
+	// the next pool is only drawn from once the ones before are full
+	for _, r := range config.subnetRanges() {
+		if sn, ok := allocateInRange(r, prefixLen, leases, identity); ok {
+			return sn, nil
+		}
+	}
+	return ip.IP4Net{}, errors.New("out of subnets")
+}
+
+// allocateInRange picks a free subnet between the SubnetMin and SubnetMax
+// of config, if there is one
+func allocateInRange(config *Config, prefixLen uint, leases []Lease, identity string) (ip.IP4Net, bool) {
 	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
 
-	var bag []ip.IP4
-	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
+	if config.Allocation == AllocateHashed {
+		return allocateHashed(config, prefixLen, leases, identity)
+	}
 
-OuterLoop:
-	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
-		for _, l := range leases {
-			if sn.Overlaps(l.Subnet) {
-				continue OuterLoop
-			}
+	var bag []ip.IP4
+	for sn := firstSubnet(config, prefixLen); sn.IP >= config.SubnetMin && lastBlock(config, sn) <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
+		if !isTaken(sn, leases) {
+			bag = append(bag, sn.IP)
 		}
-		bag = append(bag, sn.IP)
 	}
 
 	if len(bag) == 0 {
-		return ip.IP4Net{}, errors.New("out of subnets")
-	} else {
-		i := randInt(0, len(bag))
-		return ip.IP4Net{IP: bag[i], PrefixLen: config.SubnetLen}, nil
+		return ip.IP4Net{}, false
 	}
+	i := randInt(0, len(bag))
+	return ip.IP4Net{IP: bag[i], PrefixLen: prefixLen}, true
 }
 
 // getLeases queries etcd to get a list of currently allocated leases for a given network.
@@ -244,27 +571,13 @@ func (m *EtcdManager) getLeases(ctx context.Context, network string) ([]Lease, u
 	switch {
 	case err == nil:
 		for _, node := range resp.Node.Nodes {
-			sn, err := parseSubnetKey(node.Key)
-			if err == nil {
-				attrs := &LeaseAttrs{}
-				if err = json.Unmarshal([]byte(node.Value), attrs); err == nil {
-					exp := time.Time{}
-					if node.Expiration != nil {
-						exp = *node.Expiration
-					}
-
-					lease := Lease{
-						Subnet:     sn,
-						Attrs:      attrs,
-						Expiration: exp,
-					}
-					leases = append(leases, lease)
-				}
+			if lease, err := decodeLease(node); err == nil {
+				leases = append(leases, lease)
 			}
 		}
 		index = resp.EtcdIndex
 
-	case err.(*etcd.EtcdError).ErrorCode == etcdKeyNotFound:
+	case isKeyNotFound(err):
 		// key not found: treat it as empty set
 		index = err.(*etcd.EtcdError).Index
 
@@ -276,18 +589,203 @@ func (m *EtcdManager) getLeases(ctx context.Context, network string) ([]Lease, u
 }
 
 func (m *EtcdManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
-	attrBytes, err := json.Marshal(lease.Attrs)
+	if err := m.checkRenewal(lease); err != nil {
+		return err
+	}
+
+	key, value, err := m.encodeLease(lease)
 	if err != nil {
 		return err
 	}
 
 	// TODO(eyakubovich): propogate ctx into registry
-	resp, err := m.registry.updateSubnet(ctx, network, lease.Key(), string(attrBytes), subnetTTL)
+	resp, err := m.registry.updateSubnet(ctx, network, key, value, m.leaseTTL())
 	if err != nil {
 		return err
 	}
 
-	lease.Expiration = *resp.Node.Expiration
+	lease.Expiration = m.expiration(resp.Node)
+	return nil
+}
+
+// UpdateLeaseAttrs replaces the attributes of an existing lease while
+// keeping its subnet and expiration. The write is conditional on the lease
+// not having changed since it was read and is retried on conflicts.
+func (m *EtcdManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs) (*Lease, error) {
+	key, value, err := m.encodeLease(&Lease{Subnet: sn, Attrs: attrs})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < registerRetries; i++ {
+		resp, err := m.registry.getSubnet(ctx, network, key)
+		if err != nil {
+			return nil, err
+		}
+
+		// only a changing PublicIP can come to duplicate another one
+		if old, err := decodeLease(resp.Node); err == nil && old.Attrs.PublicIP != attrs.PublicIP {
+			leases, _, err := m.getLeases(ctx, network)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.checkDuplicate(leases, attrs); err != nil {
+				return nil, err
+			}
+		}
+
+		ttl := m.leaseTTL()
+		if resp.Node.TTL > 0 {
+			ttl = uint64(resp.Node.TTL)
+		}
+
+		resp, err = m.registry.compareAndSwapSubnet(ctx, network, key, value, ttl, resp.Node.ModifiedIndex)
+		switch {
+		case err == nil:
+			return &Lease{
+				Subnet:     sn,
+				Attrs:      attrs,
+				Expiration: m.expiration(resp.Node),
+			}, nil
+
+		case isTestFailed(err):
+			// lease was modified (e.g. renewed) under us, try again
+			continue
+
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("failed to update lease %v: too many conflicting writes", sn)
+}
+
+// RelabelLease changes the labels of the lease of sn in place. Like
+// UpdateLeaseAttrs, the write is conditional on the lease not having
+// changed since it was read and is retried on conflicts, so that changes
+// to its other attributes made meanwhile are kept.
+func (m *EtcdManager) RelabelLease(ctx context.Context, network string, sn ip.IP4Net, labels Labels) (*Lease, error) {
+	key, err := m.keyOf(ctx, network, sn)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, ErrLeaseNotFound
+		}
+		return nil, err
+	}
+
+	for i := 0; i < registerRetries; i++ {
+		resp, err := m.registry.getSubnet(ctx, network, key)
+		if err != nil {
+			if isKeyNotFound(err) {
+				return nil, ErrLeaseNotFound
+			}
+			return nil, err
+		}
+
+		l, err := decodeLease(resp.Node)
+		if err != nil {
+			return nil, err
+		}
+		labels.Apply(l.Attrs)
+
+		newKey, value, err := m.encodeLease(&l)
+		if err != nil {
+			return nil, err
+		}
+		if newKey != key {
+			return nil, fmt.Errorf("relabeling lease %v would change its key", sn)
+		}
+
+		ttl := m.leaseTTL()
+		if resp.Node.TTL > 0 {
+			ttl = uint64(resp.Node.TTL)
+		}
+
+		resp, err = m.registry.compareAndSwapSubnet(ctx, network, key, value, ttl, resp.Node.ModifiedIndex)
+		switch {
+		case err == nil:
+			l.Expiration = m.expiration(resp.Node)
+			return &l, nil
+
+		case isTestFailed(err):
+			// lease was modified (e.g. renewed) under us, try again
+			continue
+
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("failed to relabel lease %v: too many conflicting writes", sn)
+}
+
+// GetLease returns the current lease of sn or ErrLeaseNotFound
+func (m *EtcdManager) GetLease(ctx context.Context, network string, sn ip.IP4Net) (*Lease, error) {
+	key, err := m.keyOf(ctx, network, sn)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, ErrLeaseNotFound
+		}
+		return nil, err
+	}
+
+	resp, err := m.registry.getSubnet(ctx, network, key)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, ErrLeaseNotFound
+		}
+		return nil, err
+	}
+
+	l, err := decodeLease(resp.Node)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (m *EtcdManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	key, err := m.keyOf(ctx, network, sn)
+	if err != nil {
+		return err
+	}
+	_, err = m.registry.deleteSubnet(ctx, network, key)
+	return err
+}
+
+// DrainLease revokes the lease of sn like RevokeLease but first reserves
+// the subnet for r.Hostname. Until the reservation expires the subnet is
+// only granted to the node of that name; its peers meanwhile see the lease
+// removed. A nil r makes it the same as RevokeLease.
+func (m *EtcdManager) DrainLease(ctx context.Context, network string, sn ip.IP4Net, r *Reservation) error {
+	if r == nil {
+		return m.RevokeLease(ctx, network, sn)
+	}
+
+	if r.Hostname == "" {
+		return errors.New("reservation without a hostname")
+	}
+
+	ttl := uint64(r.TTL / time.Second)
+	if ttl == 0 {
+		return fmt.Errorf("reservation TTL must be at least a second, got %v", r.TTL)
+	}
+
+	key, err := m.keyOf(ctx, network, sn)
+	if err != nil {
+		return err
+	}
+
+	// reserve first so that the subnet is never up for grabs
+	if _, err := m.registry.createReservation(ctx, network, sn.StringSep(".", "-"), r.Hostname, ttl); err != nil {
+		return fmt.Errorf("failed to reserve %v: %v", sn, err)
+	}
+
+	if _, err := m.registry.deleteSubnet(ctx, network, key); err != nil {
+		return err
+	}
+
+	log.Infof("Subnet %v reserved for %v for %v", sn, r.Hostname, r.TTL)
 	return nil
 }
 
@@ -317,8 +815,7 @@ func (m *EtcdManager) WatchLeases(ctx context.Context, network string, cursor in
 		return parseSubnetWatchResponse(resp)
 
 	case isIndexTooSmall(err):
-		log.Warning("Watch of subnet leases failed because etcd index outside history window")
-		return m.watchReset(ctx, network)
+		return WatchResult{}, ErrCursorExpired
 
 	default:
 		return WatchResult{}, err
@@ -330,8 +827,28 @@ func isIndexTooSmall(err error) bool {
 	return ok && etcdErr.ErrorCode == etcdEventIndexCleared
 }
 
+func isKeyNotFound(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcdKeyNotFound
+}
+
+func isKeyAlreadyExists(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcdKeyAlreadyExists
+}
+
+func isTestFailed(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcdTestFailed
+}
+
 func parseSubnetWatchResponse(resp *etcd.Response) (WatchResult, error) {
-	sn, err := parseSubnetKey(resp.Node.Key)
+	// removals carry the value in the previous node, if at all
+	value := resp.Node.Value
+	if resp.PrevNode != nil {
+		value = resp.PrevNode.Value
+	}
+	sn, err := leaseSubnet(resp.Node.Key, value)
 	if err != nil {
 		return WatchResult{}, fmt.Errorf("error parsing subnet IP: %s", resp.Node.Key)
 	}
@@ -339,31 +856,29 @@ func parseSubnetWatchResponse(resp *etcd.Response) (WatchResult, error) {
 	evt := Event{}
 
 	switch resp.Action {
-	case "delete", "expire":
+	case "delete":
 		evt = Event{
-			SubnetRemoved,
-			Lease{Subnet: sn},
+			Type:   SubnetRemoved,
+			Lease:  Lease{Subnet: sn},
+			Reason: LeaseRevoked,
+		}
+
+	case "expire":
+		evt = Event{
+			Type:   SubnetRemoved,
+			Lease:  Lease{Subnet: sn},
+			Reason: LeaseExpired,
 		}
 
 	default:
-		attrs := &LeaseAttrs{}
-		err := json.Unmarshal([]byte(resp.Node.Value), attrs)
+		lease, err := decodeLease(resp.Node)
 		if err != nil {
 			return WatchResult{}, err
 		}
 
-		exp := time.Time{}
-		if resp.Node.Expiration != nil {
-			exp = *resp.Node.Expiration
-		}
-
 		evt = Event{
-			SubnetAdded,
-			Lease{
-				Subnet:     sn,
-				Attrs:      attrs,
-				Expiration: exp,
-			},
+			Type:  SubnetAdded,
+			Lease: lease,
 		}
 	}
 
@@ -381,6 +896,10 @@ func (m *EtcdManager) watchReset(ctx context.Context, network string) (WatchResu
 
 	leases, index, err := m.getLeases(ctx, network)
 	if err != nil {
+		if _, ok := err.(*etcd.EtcdError); ok {
+			// as is, for callers to tell an unreachable etcd apart
+			return wr, err
+		}
 		return wr, fmt.Errorf("failed to retrieve subnet leases: %v", err)
 	}
 
@@ -390,10 +909,20 @@ func (m *EtcdManager) watchReset(ctx context.Context, network string) (WatchResu
 	return wr, nil
 }
 
-func isSubnetConfigCompat(config *Config, sn ip.IP4Net) bool {
-	if sn.IP < config.SubnetMin || sn.IP > config.SubnetMax {
+func isSubnetConfigCompat(config *Config, sn ip.IP4Net, prefixLen uint) bool {
+	if sn.PrefixLen != prefixLen {
 		return false
 	}
 
-	return sn.PrefixLen == config.SubnetLen
+	for _, r := range config.subnetRanges() {
+		if sn.IP >= r.SubnetMin && lastBlock(r, sn) <= r.SubnetMax {
+			return true
+		}
+	}
+	return false
+}
+
+// lastBlock returns the address of the last SubnetLen sized block in sn
+func lastBlock(config *Config, sn ip.IP4Net) ip.IP4 {
+	return sn.Next().IP - ip.IP4(1<<(32-config.SubnetLen))
 }
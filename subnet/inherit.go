@@ -0,0 +1,165 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// how long a chain of configs inheriting from each other can get
+const maxInheritDepth = 8
+
+// inheritKey names the network whose config a config is based on
+const inheritKey = "Inherits"
+
+type configObject map[string]json.RawMessage
+
+// lookup returns the key of o matching name the way Config decodes it:
+// case-insensitively, or by its snake_case name
+func (o configObject) lookup(name string) (string, bool) {
+	if _, ok := o[name]; ok {
+		return name, true
+	}
+	name = configNames.canonical(name)
+	for k := range o {
+		if strings.EqualFold(configNames.canonical(k), name) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// override sets the keys of o to those of other. A null value in other
+// removes the key from o, putting back the default.
+func (o configObject) override(other configObject) {
+	for k, v := range other {
+		if ok, found := o.lookup(k); found {
+			delete(o, ok)
+		}
+		if !isNull(v) {
+			o[k] = v
+		}
+	}
+}
+
+func isNull(v json.RawMessage) bool {
+	return strings.TrimSpace(string(v)) == "null"
+}
+
+// mergeConfig overrides the base config with the keys set in child. Top
+// level keys of child replace those of base. Backend is merged one level
+// deeper: keys set in the child's Backend replace those of the base's,
+// the rest (Type included) are inherited. Values nested further, such as
+// MigrateFrom, are replaced as a whole.
+func mergeConfig(base, child configObject) (configObject, error) {
+	merged := configObject{}
+	merged.override(base)
+
+	var backend configObject
+	if k, ok := merged.lookup("Backend"); ok {
+		if err := json.Unmarshal(merged[k], &backend); err != nil {
+			return nil, fmt.Errorf("Backend of base config is not a dictionary: %v", err)
+		}
+	}
+	if k, ok := child.lookup("Backend"); ok && backend != nil && !isNull(child[k]) {
+		var override configObject
+		if err := json.Unmarshal(child[k], &override); err != nil {
+			return nil, fmt.Errorf("Backend is not a dictionary: %v", err)
+		}
+		backend.override(override)
+
+		data, err := json.Marshal(backend)
+		if err != nil {
+			return nil, err
+		}
+		// the child's key is replaced below, with the merged value
+		child = copyObject(child)
+		child[k] = data
+	}
+
+	merged.override(child)
+	return merged, nil
+}
+
+func copyObject(o configObject) configObject {
+	c := make(configObject, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
+// resolveConfig returns the config of network with whatever it inherits
+// merged in. get returns the raw config of a network.
+func resolveConfig(ctx context.Context, get func(ctx context.Context, network string) (string, error), network string) (string, error) {
+	s, err := get(ctx, network)
+	if err != nil {
+		return "", err
+	}
+
+	var cfg configObject
+	if err := json.Unmarshal([]byte(s), &cfg); err != nil {
+		return "", err
+	}
+
+	seen := map[string]bool{network: true}
+	for depth := 0; ; depth++ {
+		k, ok := cfg.lookup(inheritKey)
+		if !ok {
+			if depth == 0 {
+				return s, nil
+			}
+			break
+		}
+
+		var name string
+		if err := json.Unmarshal(cfg[k], &name); err != nil {
+			return "", fmt.Errorf("%v must name a network: %v", inheritKey, err)
+		}
+		delete(cfg, k)
+
+		if seen[name] {
+			return "", fmt.Errorf("config of %q inherits from itself via %q", network, name)
+		}
+		if depth == maxInheritDepth {
+			return "", fmt.Errorf("config of %q inherits through more than %v configs", network, maxInheritDepth)
+		}
+		seen[name] = true
+
+		bs, err := get(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve base config %q: %v", name, err)
+		}
+		var base configObject
+		if err := json.Unmarshal([]byte(bs), &base); err != nil {
+			return "", fmt.Errorf("failed to parse base config %q: %v", name, err)
+		}
+
+		// the base's own Inherits is left in for the next round
+		if cfg, err = mergeConfig(base, cfg); err != nil {
+			return "", fmt.Errorf("failed to merge base config %q: %v", name, err)
+		}
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// KeyFunc derives the key a lease is stored under in etcd and addressed
+// by in the URLs of the client/server API. All the nodes (and servers) of
+// a network have to agree on it.
+type KeyFunc func(l *Lease) string
+
+// SubnetKey, the default, keys a lease by its subnet (e.g. "10.1.5.0-24")
+func SubnetKey(l *Lease) string {
+	return l.Subnet.StringSep(".", "-")
+}
+
+// NodeKey keys a lease by the identity of the node holding it: its
+// Hostname or, if it has none, its PublicIP. A node then holds at most
+// one lease per network.
+func NodeKey(l *Lease) string {
+	if l.Attrs == nil {
+		return ""
+	}
+	if l.Attrs.Hostname != "" {
+		return l.Attrs.Hostname
+	}
+	return l.Attrs.PublicIP.String()
+}
+
+// ParseKeyFunc returns the KeyFunc of the given name, "subnet" or "node"
+func ParseKeyFunc(name string) (KeyFunc, error) {
+	switch name {
+	case "subnet":
+		return SubnetKey, nil
+	case "node":
+		return NodeKey, nil
+	default:
+		return nil, fmt.Errorf("unknown lease key %q, expected 'subnet' or 'node'", name)
+	}
+}
+
+// a lease under a key that doesn't tell its subnet carries it in the
+// value, next to the attributes
+const subnetField = "Subnet"
+
+func (m *EtcdManager) leaseKey(l *Lease) string {
+	return m.keyFunc(l)
+}
+
+// encodeLease returns the key and the value to store l under
+func (m *EtcdManager) encodeLease(l *Lease) (string, string, error) {
+	key := m.leaseKey(l)
+	if key == "" {
+		return "", "", fmt.Errorf("no key for lease %v", l.Subnet)
+	}
+
+	attrs := *l.Attrs
+	if sn, err := ParseSubnetKey(key); err != nil || !sn.Equal(l.Subnet) {
+		sb, err := json.Marshal(l.Subnet)
+		if err != nil {
+			return "", "", err
+		}
+		attrs.Unknown = map[string]json.RawMessage{subnetField: sb}
+		for k, v := range l.Attrs.Unknown {
+			attrs.Unknown[k] = v
+		}
+	}
+
+	b, err := json.Marshal(&attrs)
+	if err != nil {
+		return "", "", err
+	}
+	return key, string(b), nil
+}
+
+// leaseSubnet returns the subnet of the lease stored under key with the
+// given value (which removals need not have)
+func leaseSubnet(key, value string) (ip.IP4Net, error) {
+	if sn, err := ParseSubnetKey(key); err == nil {
+		return sn, nil
+	}
+
+	v := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return ip.IP4Net{}, fmt.Errorf("lease %v: %v", key, err)
+	}
+
+	sb, ok := v[subnetField]
+	if !ok {
+		return ip.IP4Net{}, fmt.Errorf("lease %v has no subnet", key)
+	}
+	sn := ip.IP4Net{}
+	if err := json.Unmarshal(sb, &sn); err != nil {
+		return ip.IP4Net{}, fmt.Errorf("lease %v: bad subnet: %v", key, err)
+	}
+	return sn, nil
+}
+
+// decodeLease parses a lease as stored by encodeLease
+func decodeLease(node *etcd.Node) (Lease, error) {
+	sn, err := leaseSubnet(node.Key, node.Value)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	attrs := &LeaseAttrs{}
+	if err := json.Unmarshal([]byte(node.Value), attrs); err != nil {
+		return Lease{}, err
+	}
+	delete(attrs.Unknown, subnetField)
+	if len(attrs.Unknown) == 0 {
+		attrs.Unknown = nil
+	}
+
+	exp := time.Time{}
+	if node.Expiration != nil {
+		exp = *node.Expiration
+	}
+
+	return Lease{
+		Subnet:     sn,
+		Attrs:      attrs,
+		Expiration: exp,
+	}, nil
+}
+
+// keyOf returns the key of the lease of sn, looking it up unless leases
+// are keyed by subnet
+func (m *EtcdManager) keyOf(ctx context.Context, network string, sn ip.IP4Net) (string, error) {
+	key := sn.StringSep(".", "-")
+	if m.leaseKey(&Lease{Subnet: sn, Attrs: &LeaseAttrs{}}) == key {
+		return key, nil
+	}
+
+	leases, _, err := m.getLeases(ctx, network)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range leases {
+		if l.Subnet.Equal(sn) {
+			return m.leaseKey(&l), nil
+		}
+	}
+	return "", &etcd.EtcdError{ErrorCode: etcdKeyNotFound, Message: "lease not found"}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// MigrationStatus tells how far the nodes of a network are in
+// migrating to a backend type
+type MigrationStatus struct {
+	Backend  string `json:"backend"`
+	Migrated int    `json:"migrated"`
+	Complete bool   `json:"complete"`
+
+	// Pending are the leases of the nodes that don't run the backend yet
+	Pending []ip.IP4Net `json:"pending"`
+}
+
+// Migration returns the status of the migration of leases to backend type bt
+func Migration(leases []Lease, bt string) *MigrationStatus {
+	status := &MigrationStatus{
+		Backend: bt,
+		Pending: []ip.IP4Net{},
+	}
+
+	for _, l := range leases {
+		if _, ok := l.Attrs.ForBackend(bt); ok {
+			status.Migrated++
+		} else {
+			status.Pending = append(status.Pending, l.Subnet)
+		}
+	}
+
+	status.Complete = len(status.Pending) == 0
+	return status
+}
@@ -16,18 +16,23 @@ package subnet
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
+// mockSubnetRegistry hands out copies of its nodes, as etcd does, so
+// that watch events and responses are not changed by later writes
 type mockSubnetRegistry struct {
-	config  *etcd.Node
-	subnets *etcd.Node
-	events  chan *etcd.Response
-	index   uint64
-	ttl     uint64
+	mux          sync.Mutex
+	config       *etcd.Node
+	subnets      *etcd.Node
+	reservations map[string]*etcd.Node
+	events       chan *etcd.Response
+	index        uint64
+	ttl          uint64
 }
 
 func newMockRegistry(ttlOverride uint64, config string, initialSubnets []*etcd.Node) *mockSubnetRegistry {
@@ -45,13 +50,22 @@ func newMockRegistry(ttlOverride uint64, config string, initialSubnets []*etcd.N
 		subnets: &etcd.Node{
 			Nodes: initialSubnets,
 		},
-		events: make(chan *etcd.Response, 1000),
-		index:  index + 1,
-		ttl:    ttlOverride,
+		reservations: make(map[string]*etcd.Node),
+		events:       make(chan *etcd.Response, 1000),
+		index:        index + 1,
+		ttl:          ttlOverride,
 	}
 }
 
+func copyNode(n *etcd.Node) *etcd.Node {
+	c := *n
+	return &c
+}
+
 func (msr *mockSubnetRegistry) getConfig(ctx context.Context, network string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
 	return &etcd.Response{
 		EtcdIndex: msr.index,
 		Node:      msr.config,
@@ -59,84 +73,186 @@ func (msr *mockSubnetRegistry) getConfig(ctx context.Context, network string) (*
 }
 
 func (msr *mockSubnetRegistry) setConfig(config string) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+	msr.setConfigLocked(config)
+}
+
+func (msr *mockSubnetRegistry) setConfigLocked(config string) {
 	msr.config = &etcd.Node{
 		Key:   "config",
 		Value: config,
 	}
 }
 
+func (msr *mockSubnetRegistry) createConfig(ctx context.Context, network, data string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	if msr.config.Value != "" {
+		return nil, &etcd.EtcdError{ErrorCode: etcdKeyAlreadyExists, Index: msr.index}
+	}
+
+	msr.index += 1
+	msr.setConfigLocked(data)
+	return &etcd.Response{
+		Node:      msr.config,
+		EtcdIndex: msr.index,
+	}, nil
+}
+
 func (msr *mockSubnetRegistry) getSubnets(ctx context.Context, network string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	dir := copyNode(msr.subnets)
+	dir.Nodes = make(etcd.Nodes, 0, len(msr.subnets.Nodes))
+	for _, n := range msr.subnets.Nodes {
+		dir.Nodes = append(dir.Nodes, copyNode(n))
+	}
 	return &etcd.Response{
-		Node:      msr.subnets,
+		Node:      dir,
 		EtcdIndex: msr.index,
 	}, nil
 }
 
+func (msr *mockSubnetRegistry) getSubnet(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	for _, n := range msr.subnets.Nodes {
+		if n.Key == sn {
+			return &etcd.Response{
+				Node:      copyNode(n),
+				EtcdIndex: msr.index,
+			}, nil
+		}
+	}
+
+	return nil, &etcd.EtcdError{ErrorCode: etcdKeyNotFound, Index: msr.index}
+}
+
 func (msr *mockSubnetRegistry) createSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	for _, n := range msr.subnets.Nodes {
+		if n.Key == sn {
+			return nil, &etcd.EtcdError{ErrorCode: etcdKeyAlreadyExists, Index: msr.index}
+		}
+	}
+
 	msr.index += 1
 
 	if msr.ttl > 0 {
 		ttl = msr.ttl
 	}
 
-	// add squared durations :)
-	exp := time.Now().Add(time.Duration(ttl) * time.Second)
-
 	node := &etcd.Node{
 		Key:           sn,
 		Value:         data,
 		ModifiedIndex: msr.index,
-		Expiration:    &exp,
+	}
+	// as with etcd, no TTL means no expiry
+	if ttl > 0 {
+		// add squared durations :)
+		exp := time.Now().Add(time.Duration(ttl) * time.Second)
+		node.Expiration = &exp
 	}
 
 	msr.subnets.Nodes = append(msr.subnets.Nodes, node)
 	msr.events <- &etcd.Response{
 		Action: "add",
-		Node:   node,
+		Node:   copyNode(node),
 	}
 
 	return &etcd.Response{
-		Node:      node,
+		Node:      copyNode(node),
 		EtcdIndex: msr.index,
 	}, nil
 }
 
 func (msr *mockSubnetRegistry) updateSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+	return msr.updateSubnetLocked(sn, data, ttl)
+}
+
+func (msr *mockSubnetRegistry) updateSubnetLocked(sn, data string, ttl uint64) (*etcd.Response, error) {
 	msr.index += 1
 
 	// add squared durations :)
 	exp := time.Now().Add(time.Duration(ttl) * time.Second)
 
-	for _, n := range msr.subnets.Nodes {
+	for i, n := range msr.subnets.Nodes {
 		if n.Key == sn {
+			n = copyNode(n)
 			n.Value = data
 			n.ModifiedIndex = msr.index
 			n.Expiration = &exp
+			msr.subnets.Nodes[i] = n
 			msr.events <- &etcd.Response{
 				Action: "add",
-				Node:   n,
+				Node:   copyNode(n),
 			}
 
 			return &etcd.Response{
-				Node:      n,
+				Node:      copyNode(n),
 				EtcdIndex: msr.index,
 			}, nil
 		}
 	}
 
-	return nil, fmt.Errorf("Subnet not found")
+	// as with etcd, setting a missing key creates it
+	n := &etcd.Node{
+		Key:           sn,
+		Value:         data,
+		ModifiedIndex: msr.index,
+		Expiration:    &exp,
+	}
+	msr.subnets.Nodes = append(msr.subnets.Nodes, n)
+	msr.events <- &etcd.Response{
+		Action: "add",
+		Node:   copyNode(n),
+	}
+
+	return &etcd.Response{
+		Node:      copyNode(n),
+		EtcdIndex: msr.index,
+	}, nil
+}
+
+func (msr *mockSubnetRegistry) compareAndSwapSubnet(ctx context.Context, network, sn, data string, ttl uint64, prevIndex uint64) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	for _, n := range msr.subnets.Nodes {
+		if n.Key == sn {
+			if n.ModifiedIndex != prevIndex {
+				return nil, &etcd.EtcdError{ErrorCode: etcdTestFailed, Index: msr.index}
+			}
+			return msr.updateSubnetLocked(sn, data, ttl)
+		}
+	}
+
+	return nil, &etcd.EtcdError{ErrorCode: etcdKeyNotFound, Index: msr.index}
 }
 
 func (msr *mockSubnetRegistry) deleteSubnet(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
 	msr.index += 1
 
 	for i, n := range msr.subnets.Nodes {
 		if n.Key == sn {
 			msr.subnets.Nodes[i] = msr.subnets.Nodes[len(msr.subnets.Nodes)-1]
 			msr.subnets.Nodes = msr.subnets.Nodes[:len(msr.subnets.Nodes)-1]
+			n = copyNode(n)
+			n.ModifiedIndex = msr.index
 			msr.events <- &etcd.Response{
 				Action: "delete",
-				Node:   n,
+				Node:   copyNode(n),
 			}
 
 			return &etcd.Response{
@@ -165,7 +281,88 @@ func (msr *mockSubnetRegistry) watchSubnets(ctx context.Context, network string,
 	}
 }
 
+func (msr *mockSubnetRegistry) getReservations(ctx context.Context, network string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	dir := &etcd.Node{Dir: true}
+	for sn, n := range msr.reservations {
+		if n.Expiration.Before(time.Now()) {
+			delete(msr.reservations, sn)
+			continue
+		}
+		dir.Nodes = append(dir.Nodes, copyNode(n))
+	}
+
+	return &etcd.Response{
+		Node:      dir,
+		EtcdIndex: msr.index,
+	}, nil
+}
+
+func (msr *mockSubnetRegistry) createReservation(ctx context.Context, network, sn, hostname string, ttl uint64) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	msr.index += 1
+
+	exp := time.Now().Add(time.Duration(ttl) * time.Second)
+	n := &etcd.Node{
+		Key:           sn,
+		Value:         hostname,
+		ModifiedIndex: msr.index,
+		Expiration:    &exp,
+	}
+	msr.reservations[sn] = n
+
+	return &etcd.Response{
+		Node:      copyNode(n),
+		EtcdIndex: msr.index,
+	}, nil
+}
+
+func (msr *mockSubnetRegistry) deleteReservation(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	n, ok := msr.reservations[sn]
+	if !ok {
+		return nil, &etcd.EtcdError{ErrorCode: etcdKeyNotFound, Index: msr.index}
+	}
+
+	msr.index += 1
+	delete(msr.reservations, sn)
+
+	return &etcd.Response{
+		Node:      n,
+		EtcdIndex: msr.index,
+	}, nil
+}
+
+func (msr *mockSubnetRegistry) hasReservation(sn string) bool {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	_, ok := msr.reservations[sn]
+	return ok
+}
+
+func (msr *mockSubnetRegistry) expireReservation(sn string) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	if n, ok := msr.reservations[sn]; ok {
+		n = copyNode(n)
+		exp := time.Now().Add(-time.Second)
+		n.Expiration = &exp
+		msr.reservations[sn] = n
+	}
+}
+
 func (msr *mockSubnetRegistry) hasSubnet(sn string) bool {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
 	for _, n := range msr.subnets.Nodes {
 		if n.Key == sn {
 			return true
@@ -175,11 +372,15 @@ func (msr *mockSubnetRegistry) hasSubnet(sn string) bool {
 }
 
 func (msr *mockSubnetRegistry) expireSubnet(sn string) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
 	for i, n := range msr.subnets.Nodes {
 		if n.Key == sn {
 			msr.index += 1
 			msr.subnets.Nodes[i] = msr.subnets.Nodes[len(msr.subnets.Nodes)-1]
-			msr.subnets.Nodes = msr.subnets.Nodes[:len(msr.subnets.Nodes)-2]
+			msr.subnets.Nodes = msr.subnets.Nodes[:len(msr.subnets.Nodes)-1]
+			n = copyNode(n)
 			n.ModifiedIndex = msr.index
 			msr.events <- &etcd.Response{
 				Action: "expire",
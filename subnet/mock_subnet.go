@@ -18,3 +18,8 @@ func NewMockManager(ttlOverride uint64, config string) Manager {
 	r := newMockRegistry(ttlOverride, config, nil)
 	return newEtcdManager(r)
 }
+
+func NewMockManagerWithKeys(ttlOverride uint64, config string, keyFunc KeyFunc) Manager {
+	r := newMockRegistry(ttlOverride, config, nil)
+	return &EtcdManager{registry: r, keyFunc: keyFunc}
+}
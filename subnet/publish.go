@@ -0,0 +1,160 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/errlog"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// types of LeaseEvent
+const (
+	LeaseAdded   = "added"
+	LeaseUpdated = "updated"
+	LeaseRemoved = "removed"
+)
+
+// Publisher sends messages to a broker (e.g. a nats.Publisher)
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// LeaseEvent is what a LeasePublisher publishes, as JSON, for each lease
+// that is added, updated in place (e.g. a new PublicIP) or removed
+type LeaseEvent struct {
+	Type       string      `json:"type"`
+	Network    string      `json:"network"`
+	Subnet     ip.IP4Net   `json:"subnet"`
+	Attrs      *LeaseAttrs `json:"attrs,omitempty"`
+	Expiration time.Time   `json:"expiration"`
+	Reason     EventReason `json:"reason,omitempty"`
+	Time       time.Time   `json:"time"`
+}
+
+// LeasePublisher publishes the lease events of the networks it watches to
+// a subject of a broker. Events are queued rather than waited for, once
+// the queue is full they are dropped and counted.
+type LeasePublisher struct {
+	pub     Publisher
+	subject string
+	queue   chan LeaseEvent
+	dropped uint64
+}
+
+func NewLeasePublisher(pub Publisher, subject string, queueSize int) *LeasePublisher {
+	return &LeasePublisher{
+		pub:     pub,
+		subject: subject,
+		queue:   make(chan LeaseEvent, queueSize),
+	}
+}
+
+// Dropped is the number of events dropped so far for a full queue
+func (p *LeasePublisher) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+func (p *LeasePublisher) enqueue(evt LeaseEvent) {
+	select {
+	case p.queue <- evt:
+	default:
+		if atomic.AddUint64(&p.dropped, 1) == 1 {
+			log.Warningf("Lease event publisher is falling behind, dropping events")
+		}
+	}
+}
+
+// Watch queues the events of the leases of network until ctx is done. The
+// leases there already are taken as known, what happens to them after is
+// published. Renewals, which leave the attributes as they are, are not.
+func (p *LeasePublisher) Watch(ctx context.Context, sm Manager, network string) {
+	evts := make(chan []Event)
+	go WatchLeasesMarked(ctx, sm, network, evts)
+
+	known := make(map[ip.IP4Net]*LeaseAttrs)
+	inSnapshot := true
+	for {
+		var batch []Event
+		select {
+		case batch = <-evts:
+		case <-ctx.Done():
+			return
+		}
+
+		batch, done := SplitSnapshotDone(batch)
+		for _, evt := range batch {
+			le := LeaseEvent{
+				Network:    network,
+				Subnet:     evt.Lease.Subnet,
+				Attrs:      evt.Lease.Attrs,
+				Expiration: evt.Lease.Expiration,
+				Reason:     evt.Reason,
+				Time:       time.Now(),
+			}
+			attrs, ok := known[evt.Lease.Subnet]
+			switch {
+			case evt.Type == SubnetRemoved:
+				le.Type = LeaseRemoved
+				delete(known, evt.Lease.Subnet)
+			case !ok:
+				le.Type = LeaseAdded
+				known[evt.Lease.Subnet] = evt.Lease.Attrs
+			case attrsChanged(attrs, evt.Lease.Attrs):
+				le.Type = LeaseUpdated
+				known[evt.Lease.Subnet] = evt.Lease.Attrs
+			default:
+				continue
+			}
+
+			if !inSnapshot {
+				p.enqueue(le)
+			}
+		}
+		if done {
+			inSnapshot = false
+		}
+	}
+}
+
+// Run publishes the queued events, one at a time, until ctx is canceled.
+// An event that fails to publish is logged and dropped.
+func (p *LeasePublisher) Run(ctx context.Context) {
+	errs := errlog.NewLimiter(errlog.DefaultInterval)
+	for {
+		select {
+		case evt := <-p.queue:
+			data, err := json.Marshal(evt)
+			if err != nil {
+				log.Errorf("Failed to encode %v event of lease %v: %v", evt.Type, evt.Subnet, err)
+				continue
+			}
+			if err := p.pub.Publish(p.subject, data); err != nil {
+				errs.Errorf("publish", "Failed to publish %v event of lease %v: %v", evt.Type, evt.Subnet, err)
+				continue
+			}
+			errs.Clear("publish")
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// memBroker keeps what is published to it
+type memBroker struct {
+	mu   sync.Mutex
+	msgs []LeaseEvent
+}
+
+func (b *memBroker) Publish(subject string, data []byte) error {
+	if subject != "flannel.leases" {
+		return nil
+	}
+	var evt LeaseEvent
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs = append(b.msgs, evt)
+	return nil
+}
+
+func (b *memBroker) published() []LeaseEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]LeaseEvent(nil), b.msgs...)
+}
+
+func (b *memBroker) waitFor(t *testing.T, n int) []LeaseEvent {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := b.published(); len(msgs) >= n {
+			return msgs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %v events to be published, got %v", n, b.published())
+	return nil
+}
+
+func TestLeasePublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := newEtcdManager(newDummyRegistry(0))
+	broker := &memBroker{}
+	p := NewLeasePublisher(broker, "flannel.leases", 10)
+	go p.Watch(ctx, sm, "")
+	go p.Run(ctx)
+
+	// let the watch take in the existing leases
+	time.Sleep(100 * time.Millisecond)
+
+	l, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	broker.waitFor(t, 1)
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if _, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.5")}); err != nil {
+		t.Fatalf("UpdateLeaseAttrs failed: %v", err)
+	}
+	broker.waitFor(t, 2)
+	if err := sm.RevokeLease(ctx, "", l.Subnet); err != nil {
+		t.Fatalf("RevokeLease failed: %v", err)
+	}
+	broker.waitFor(t, 3)
+
+	// nothing more trickles in
+	time.Sleep(100 * time.Millisecond)
+	msgs := broker.published()
+	expected := []string{LeaseAdded, LeaseUpdated, LeaseRemoved}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %v events, got %+v", expected, msgs)
+	}
+	for i, evt := range msgs {
+		if evt.Type != expected[i] || evt.Subnet != l.Subnet {
+			t.Errorf("event %v: expected %v of %v, got %v of %v", i, expected[i], l.Subnet, evt.Type, evt.Subnet)
+		}
+	}
+	if ip := msgs[1].Attrs.PublicIP.String(); ip != "1.2.3.5" {
+		t.Errorf("update carries PublicIP %v, expected 1.2.3.5", ip)
+	}
+}
+
+func TestLeasePublisherOverflow(t *testing.T) {
+	p := NewLeasePublisher(&memBroker{}, "flannel.leases", 2)
+	for i := 0; i < 5; i++ {
+		p.enqueue(LeaseEvent{Type: LeaseAdded})
+	}
+	if p.Dropped() != 3 {
+		t.Errorf("expected 3 events dropped, got %v", p.Dropped())
+	}
+}
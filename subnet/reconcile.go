@@ -0,0 +1,127 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// LiveNodes returns the public IPs of the nodes that are known to be
+// alive. It is the source of truth that leases get reconciled against.
+type LiveNodes func() (map[ip.IP4]bool, error)
+
+// StaticLiveNodes returns LiveNodes for a fixed list of IPs
+func StaticLiveNodes(ips []ip.IP4) LiveNodes {
+	return func() (map[ip.IP4]bool, error) {
+		live := make(map[ip.IP4]bool)
+		for _, a := range ips {
+			live[a] = true
+		}
+		return live, nil
+	}
+}
+
+// FileLiveNodes returns LiveNodes that reads one IP per line from path.
+// The file is re-read on every call so it can be updated externally.
+func FileLiveNodes(path string) LiveNodes {
+	return func() (map[ip.IP4]bool, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		live := make(map[ip.IP4]bool)
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			a, err := ip.ParseIP4(line)
+			if err != nil {
+				return nil, fmt.Errorf("%v: bad IP %q", path, line)
+			}
+			live[a] = true
+		}
+
+		return live, s.Err()
+	}
+}
+
+// ReconcileLeases finds the leases of network whose PublicIP does not
+// belong to a live node. The leases are only reported unless remove is set,
+// in which case they are also revoked.
+func ReconcileLeases(ctx context.Context, sm Manager, network string, liveNodes LiveNodes, remove bool) ([]Lease, error) {
+	live, err := liveNodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live nodes: %v", err)
+	}
+
+	// an empty set is much more likely to be a broken source
+	// than a cluster without nodes; don't wipe out everything
+	if len(live) == 0 {
+		return nil, fmt.Errorf("list of live nodes is empty")
+	}
+
+	wr, err := sm.WatchLeases(ctx, network, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []Lease{}
+	for _, l := range wr.Snapshot {
+		if l.Attrs == nil || live[l.Attrs.PublicIP] {
+			continue
+		}
+
+		stale = append(stale, l)
+
+		if !remove {
+			log.Warningf("Lease %v is held by %v which is not a live node (dry run, not removing)", l.Subnet, l.Attrs.PublicIP)
+			continue
+		}
+
+		log.Warningf("Lease %v is held by %v which is not a live node, revoking", l.Subnet, l.Attrs.PublicIP)
+		if err := sm.RevokeLease(ctx, network, l.Subnet); err != nil {
+			log.Errorf("Failed to revoke lease %v: %v", l.Subnet, err)
+		}
+	}
+
+	return stale, nil
+}
+
+// LeaseReconciler periodically runs ReconcileLeases until ctx is canceled
+func LeaseReconciler(ctx context.Context, sm Manager, network string, liveNodes LiveNodes, remove bool, interval time.Duration) {
+	for {
+		if _, err := ReconcileLeases(ctx, sm, network, liveNodes, remove); err != nil {
+			log.Errorf("Error reconciling leases of network %q: %v", network, err)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func newReconcileRegistry() *mockSubnetRegistry {
+	subnets := []*etcd.Node{
+		&etcd.Node{Key: "10.3.1.0-24", Value: `{ "PublicIP": "1.1.1.1" }`, ModifiedIndex: 10},
+		&etcd.Node{Key: "10.3.2.0-24", Value: `{ "PublicIP": "1.1.1.2" }`, ModifiedIndex: 11},
+		&etcd.Node{Key: "10.3.3.0-24", Value: `{ "PublicIP": "1.1.1.3" }`, ModifiedIndex: 12},
+	}
+
+	config := `{ "Network": "10.3.0.0/16" }`
+	return newMockRegistry(0, config, subnets)
+}
+
+func TestReconcileLeasesDryRun(t *testing.T) {
+	msr := newReconcileRegistry()
+	sm := newEtcdManager(msr)
+
+	live := StaticLiveNodes([]ip.IP4{mustParseIP4("1.1.1.1"), mustParseIP4("1.1.1.3")})
+
+	stale, err := ReconcileLeases(context.Background(), sm, "", live, false)
+	if err != nil {
+		t.Fatal("ReconcileLeases failed: ", err)
+	}
+
+	if len(stale) != 1 || stale[0].Key() != "10.3.2.0-24" {
+		t.Fatalf("ReconcileLeases reported wrong leases: %v", stale)
+	}
+
+	if !msr.hasSubnet("10.3.2.0-24") {
+		t.Error("ReconcileLeases removed a lease in dry run mode")
+	}
+}
+
+func TestReconcileLeasesRemove(t *testing.T) {
+	msr := newReconcileRegistry()
+	sm := newEtcdManager(msr)
+
+	live := StaticLiveNodes([]ip.IP4{mustParseIP4("1.1.1.1"), mustParseIP4("1.1.1.3")})
+
+	stale, err := ReconcileLeases(context.Background(), sm, "", live, true)
+	if err != nil {
+		t.Fatal("ReconcileLeases failed: ", err)
+	}
+
+	if len(stale) != 1 || stale[0].Key() != "10.3.2.0-24" {
+		t.Fatalf("ReconcileLeases reported wrong leases: %v", stale)
+	}
+
+	if msr.hasSubnet("10.3.2.0-24") {
+		t.Error("ReconcileLeases did not remove lease of unknown node")
+	}
+	for _, sn := range []string{"10.3.1.0-24", "10.3.3.0-24"} {
+		if !msr.hasSubnet(sn) {
+			t.Errorf("ReconcileLeases removed lease %v of a live node", sn)
+		}
+	}
+}
+
+func TestReconcileLeasesNoLiveNodes(t *testing.T) {
+	msr := newReconcileRegistry()
+	sm := newEtcdManager(msr)
+
+	if _, err := ReconcileLeases(context.Background(), sm, "", StaticLiveNodes(nil), true); err == nil {
+		t.Fatal("ReconcileLeases succeeded with empty live node list")
+	}
+
+	if len(msr.subnets.Nodes) != 3 {
+		t.Error("ReconcileLeases removed leases with empty live node list")
+	}
+}
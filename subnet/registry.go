@@ -29,11 +29,17 @@ import (
 
 type Registry interface {
 	getConfig(ctx context.Context, network string) (*etcd.Response, error)
+	createConfig(ctx context.Context, network, data string) (*etcd.Response, error)
 	getSubnets(ctx context.Context, network string) (*etcd.Response, error)
+	getSubnet(ctx context.Context, network, sn string) (*etcd.Response, error)
 	createSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error)
 	updateSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error)
+	compareAndSwapSubnet(ctx context.Context, network, sn, data string, ttl uint64, prevIndex uint64) (*etcd.Response, error)
 	deleteSubnet(ctx context.Context, network, sn string) (*etcd.Response, error)
 	watchSubnets(ctx context.Context, network string, since uint64) (*etcd.Response, error)
+	getReservations(ctx context.Context, network string) (*etcd.Response, error)
+	createReservation(ctx context.Context, network, sn, hostname string, ttl uint64) (*etcd.Response, error)
+	deleteReservation(ctx context.Context, network, sn string) (*etcd.Response, error)
 }
 
 type EtcdConfig struct {
@@ -42,37 +48,92 @@ type EtcdConfig struct {
 	Certfile  string
 	CAFile    string
 	Prefix    string
+
+	// KeyFunc derives the keys of the leases, SubnetKey if nil
+	KeyFunc KeyFunc
+
+	// LeaseGrace is how long past their expiry leases are kept,
+	// with renewals of them accepted, to tolerate clock skew
+	LeaseGrace time.Duration
+
+	// LeaseHold is how long the subnet of a new lease stays reserved
+	// for its node, whatever becomes of the lease, to cover the time
+	// until its first renewal; 0 disables it
+	LeaseHold time.Duration
+
+	// SRVDomain, if set, is the domain whose SRV records list the
+	// etcd endpoints, Endpoints are only used when discovery fails
+	SRVDomain string
+	// SRVRefresh is how often the SRV records are resolved again
+	// (0 only resolves them at startup)
+	SRVRefresh time.Duration
+
+	// DuplicatePublicIP is what to do about a node taking a PublicIP
+	// another node's lease has, DuplicatePublicIPReject if empty
+	DuplicatePublicIP string
+
+	// ReuseHostnameLease lets a node take over the live lease of
+	// another PublicIP carrying its hostname, see findOwnLease
+	ReuseHostnameLease bool
+}
+
+// policies for leases duplicating the PublicIP of another node
+const (
+	DuplicatePublicIPReject = "reject"
+	DuplicatePublicIPWarn   = "warn"
+)
+
+func ValidateDuplicatePublicIP(policy string) error {
+	switch policy {
+	case "", DuplicatePublicIPReject, DuplicatePublicIPWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown duplicate PublicIP policy %q, expected %q or %q", policy, DuplicatePublicIPReject, DuplicatePublicIPWarn)
 }
 
 type etcdSubnetRegistry struct {
 	mux     sync.Mutex
 	cli     *etcd.Client
 	etcdCfg *EtcdConfig
+	// what cli talks to, Endpoints or the discovered ones
+	endpoints []string
 }
 
 func init() {
 	etcd.SetLogger(golog.New(os.Stderr, "go-etcd", golog.LstdFlags))
 }
 
-func newEtcdClient(c *EtcdConfig) (*etcd.Client, error) {
-	if c.Keyfile != "" || c.Certfile != "" || c.CAFile != "" {
-		return etcd.NewTLSClient(c.Endpoints, c.Certfile, c.Keyfile, c.CAFile)
+func newEtcdClient(c *EtcdConfig, endpoints []string) (*etcd.Client, error) {
+	if c.usesTLS() {
+		return etcd.NewTLSClient(endpoints, c.Certfile, c.Keyfile, c.CAFile)
 	} else {
-		return etcd.NewClient(c.Endpoints), nil
+		return etcd.NewClient(endpoints), nil
 	}
 }
 
 func newEtcdSubnetRegistry(config *EtcdConfig) (Registry, error) {
 	r := &etcdSubnetRegistry{
-		etcdCfg: config,
+		etcdCfg:   config,
+		endpoints: config.Endpoints,
+	}
+
+	if config.SRVDomain != "" {
+		var err error
+		if r.endpoints, err = initialEndpoints(config); err != nil {
+			return nil, err
+		}
 	}
 
 	var err error
-	r.cli, err = newEtcdClient(config)
+	r.cli, err = newEtcdClient(config, r.endpoints)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.SRVDomain != "" && config.SRVRefresh > 0 {
+		go r.watchSRV(config.SRVRefresh)
+	}
+
 	return r, nil
 }
 
@@ -85,11 +146,21 @@ func (esr *etcdSubnetRegistry) getConfig(ctx context.Context, network string) (*
 	return resp, nil
 }
 
+func (esr *etcdSubnetRegistry) createConfig(ctx context.Context, network, data string) (*etcd.Response, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "config")
+	return esr.client().Create(key, data, 0)
+}
+
 func (esr *etcdSubnetRegistry) getSubnets(ctx context.Context, network string) (*etcd.Response, error) {
 	key := path.Join(esr.etcdCfg.Prefix, network, "subnets")
 	return esr.client().Get(key, false, true)
 }
 
+func (esr *etcdSubnetRegistry) getSubnet(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "subnets", sn)
+	return esr.client().Get(key, false, false)
+}
+
 func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error) {
 	key := path.Join(esr.etcdCfg.Prefix, network, "subnets", sn)
 	resp, err := esr.client().Create(key, data, ttl)
@@ -112,11 +183,39 @@ func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, network, sn, da
 	return resp, nil
 }
 
+func (esr *etcdSubnetRegistry) compareAndSwapSubnet(ctx context.Context, network, sn, data string, ttl uint64, prevIndex uint64) (*etcd.Response, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "subnets", sn)
+	resp, err := esr.client().CompareAndSwap(key, data, ttl, "", prevIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	ensureExpiration(resp, ttl)
+	return resp, nil
+}
+
 func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, network, sn string) (*etcd.Response, error) {
 	key := path.Join(esr.etcdCfg.Prefix, network, "subnets", sn)
 	return esr.client().Delete(key, false)
 }
 
+// reservations live outside of the subnets directory so
+// that watchers of the leases never see them
+func (esr *etcdSubnetRegistry) getReservations(ctx context.Context, network string) (*etcd.Response, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "reservations")
+	return esr.client().Get(key, false, true)
+}
+
+func (esr *etcdSubnetRegistry) createReservation(ctx context.Context, network, sn, hostname string, ttl uint64) (*etcd.Response, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "reservations", sn)
+	return esr.client().Set(key, hostname, ttl)
+}
+
+func (esr *etcdSubnetRegistry) deleteReservation(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "reservations", sn)
+	return esr.client().Delete(key, false)
+}
+
 type watchResp struct {
 	resp *etcd.Response
 	err  error
@@ -170,7 +269,7 @@ func (esr *etcdSubnetRegistry) resetClient() {
 
 	var err error
 	esr.cli.Close()
-	esr.cli, err = newEtcdClient(esr.etcdCfg)
+	esr.cli, err = newEtcdClient(esr.etcdCfg, esr.endpoints)
 	if err != nil {
 		panic(fmt.Errorf("resetClient: error recreating etcd client: %v", err))
 	}
@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Labels are the attributes of a lease that describe its node rather than
+// how to reach it. A nil field is left as it is, an empty one is cleared.
+type Labels struct {
+	Zone     *string
+	Pool     *string
+	Hostname *string
+}
+
+// ParseLabels parses NAME=VALUE pairs, NAME being zone, pool or hostname
+func ParseLabels(args []string) (Labels, error) {
+	var labels Labels
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return Labels{}, fmt.Errorf("%q is not NAME=VALUE", arg)
+		}
+		value := arg[i+1:]
+		switch strings.ToLower(arg[:i]) {
+		case "zone":
+			labels.Zone = &value
+		case "pool":
+			labels.Pool = &value
+		case "hostname":
+			labels.Hostname = &value
+		default:
+			return Labels{}, fmt.Errorf("unknown label %q, expected zone, pool or hostname", arg[:i])
+		}
+	}
+	return labels, nil
+}
+
+// Apply sets the labels that are not nil in attrs
+func (labels Labels) Apply(attrs *LeaseAttrs) {
+	if labels.Zone != nil {
+		attrs.Zone = *labels.Zone
+	}
+	if labels.Pool != nil {
+		attrs.Pool = *labels.Pool
+	}
+	if labels.Hostname != nil {
+		attrs.Hostname = *labels.Hostname
+	}
+}
+
+// LabelsOf returns all the labels of attrs
+func LabelsOf(attrs *LeaseAttrs) Labels {
+	zone, pool, hostname := attrs.Zone, attrs.Pool, attrs.Hostname
+	return Labels{Zone: &zone, Pool: &pool, Hostname: &hostname}
+}
+
+// Relabeler is implemented by Managers that can change the labels of a
+// lease without overwriting concurrent changes to its other attributes
+type Relabeler interface {
+	RelabelLease(ctx context.Context, network string, sn ip.IP4Net, labels Labels) (*Lease, error)
+}
+
+// Relabel changes the labels of the lease of sn in place, keeping its
+// subnet and expiration. Peers see the lease updated in a SubnetAdded
+// event. Unless sm is a Relabeler, a change to the lease between reading
+// and updating it is lost.
+func Relabel(ctx context.Context, sm Manager, network string, sn ip.IP4Net, labels Labels) (*Lease, error) {
+	if r, ok := sm.(Relabeler); ok {
+		return r.RelabelLease(ctx, network, sn, labels)
+	}
+
+	l, err := sm.GetLease(ctx, network, sn)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := *l.Attrs
+	labels.Apply(&attrs)
+	return sm.UpdateLeaseAttrs(ctx, network, sn, &attrs)
+}
@@ -22,11 +22,24 @@ import (
 )
 
 const (
-	renewMargin = time.Hour
+	// leases are renewed once this fraction of their remaining
+	// lifetime has passed, and at least renewMargin before they
+	// expire, leaving room for clock skew and failed attempts
+	renewFraction = 0.5
+	renewMargin   = time.Hour
 )
 
+// renewDelay returns how long to wait before renewing a lease expiring at exp
+func renewDelay(exp time.Time) time.Duration {
+	left := exp.Sub(time.Now())
+	if dur := time.Duration(float64(left) * renewFraction); dur < left-renewMargin {
+		return dur
+	}
+	return left - renewMargin
+}
+
 func LeaseRenewer(ctx context.Context, m Manager, network string, lease *Lease) {
-	dur := lease.Expiration.Sub(time.Now()) - renewMargin
+	dur := renewDelay(lease.Expiration)
 
 	for {
 		select {
@@ -39,7 +52,7 @@ func LeaseRenewer(ctx context.Context, m Manager, network string, lease *Lease)
 			}
 
 			log.Info("Lease renewed, new expiration: ", lease.Expiration)
-			dur = lease.Expiration.Sub(time.Now()) - renewMargin
+			dur = renewDelay(lease.Expiration)
 
 		case <-ctx.Done():
 			return
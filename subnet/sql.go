@@ -0,0 +1,631 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// SQLConfig is the config of a Manager keeping the network configs and
+// leases in a SQL database (Postgres or MySQL) in place of etcd
+type SQLConfig struct {
+	// Driver and DSN are passed to sql.Open. The driver has to be
+	// linked in, see the postgres and mysql build tags of flanneld.
+	Driver string
+	DSN    string
+
+	// PollInterval is how often watches look for new lease events,
+	// DefaultSQLPollInterval if zero
+	PollInterval time.Duration
+
+	// as in EtcdConfig
+	KeyFunc            KeyFunc
+	LeaseGrace         time.Duration
+	LeaseHold          time.Duration
+	DuplicatePublicIP  string
+	ReuseHostnameLease bool
+}
+
+const DefaultSQLPollInterval = time.Second
+
+// lease events kept for watches to catch up with, as many as etcd keeps
+const sqlHistory = 1000
+
+// how often expired leases and reservations are removed; replaced in tests
+var (
+	sqlSweepInterval = 5 * time.Second
+	sqlNow           = time.Now
+)
+
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS flannel_index (id INTEGER PRIMARY KEY, value BIGINT NOT NULL, compacted BIGINT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS flannel_configs (network VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL, modified BIGINT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS flannel_leases (network VARCHAR(255) NOT NULL, lease_key VARCHAR(255) NOT NULL, data TEXT NOT NULL, expires BIGINT, modified BIGINT NOT NULL, PRIMARY KEY (network, lease_key))`,
+	`CREATE TABLE IF NOT EXISTS flannel_reservations (network VARCHAR(255) NOT NULL, subnet VARCHAR(255) NOT NULL, hostname VARCHAR(255) NOT NULL, expires BIGINT NOT NULL, PRIMARY KEY (network, subnet))`,
+	`CREATE TABLE IF NOT EXISTS flannel_events (idx BIGINT PRIMARY KEY, network VARCHAR(255) NOT NULL, lease_key VARCHAR(255) NOT NULL, action VARCHAR(16) NOT NULL, data TEXT NOT NULL, expires BIGINT)`,
+}
+
+// the queries, with '?' placeholders
+const (
+	qIndexGet  = `SELECT value, compacted FROM flannel_index WHERE id = 1`
+	qIndexInit = `INSERT INTO flannel_index (id, value, compacted) VALUES (1, 0, 0)`
+	qIndexBump = `UPDATE flannel_index SET value = value + 1 WHERE id = 1`
+	qCompact   = `UPDATE flannel_index SET compacted = ? WHERE id = 1`
+
+	qConfigGet    = `SELECT data FROM flannel_configs WHERE network = ?`
+	qConfigInsert = `INSERT INTO flannel_configs (network, data, modified) VALUES (?, ?, ?)`
+
+	qLeasesGet     = `SELECT lease_key, data, expires, modified FROM flannel_leases WHERE network = ? AND (expires IS NULL OR expires > ?)`
+	qLeaseGet      = `SELECT data, expires, modified FROM flannel_leases WHERE network = ? AND lease_key = ?`
+	qLeaseInsert   = `INSERT INTO flannel_leases (network, lease_key, data, expires, modified) VALUES (?, ?, ?, ?, ?)`
+	qLeaseDelete   = `DELETE FROM flannel_leases WHERE network = ? AND lease_key = ?`
+	qLeasesExpired = `SELECT network, lease_key FROM flannel_leases WHERE expires IS NOT NULL AND expires <= ?`
+
+	qEventInsert = `INSERT INTO flannel_events (idx, network, lease_key, action, data, expires) VALUES (?, ?, ?, ?, ?, ?)`
+	qEventNext   = `SELECT idx, lease_key, action, data, expires FROM flannel_events WHERE network = ? AND idx >= ? ORDER BY idx LIMIT 1`
+	qEventsPrune = `DELETE FROM flannel_events WHERE idx <= ?`
+
+	qReservationsGet   = `SELECT subnet, hostname, expires FROM flannel_reservations WHERE network = ? AND expires > ?`
+	qReservationGet    = `SELECT expires FROM flannel_reservations WHERE network = ? AND subnet = ?`
+	qReservationInsert = `INSERT INTO flannel_reservations (network, subnet, hostname, expires) VALUES (?, ?, ?, ?)`
+	qReservationDelete = `DELETE FROM flannel_reservations WHERE network = ? AND subnet = ?`
+	qReservationsSweep = `DELETE FROM flannel_reservations WHERE expires <= ?`
+)
+
+// sqlRegistry is a Registry on a SQL database. A single row holds the
+// index, which every write bumps within its transaction: the row lock
+// serializes the writes, so that reading a lease and then writing it is
+// atomic, and the index numbers the lease events watches follow, as in
+// etcd. Leases expire by their expires column (in milliseconds since
+// the epoch): expired ones are hidden from reads right away and removed,
+// with an "expire" event, by a periodic sweep.
+type sqlRegistry struct {
+	db *sql.DB
+	// Postgres numbers its placeholders ($1, $2, ...)
+	dollar bool
+	poll   time.Duration
+}
+
+// NewSQLManager returns a Manager keeping its state in the database of
+// config, creating the tables if they don't exist
+func NewSQLManager(config *SQLConfig) (Manager, error) {
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newSQLRegistry(db, config)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go r.sweep(sqlSweepInterval)
+
+	keyFunc := config.KeyFunc
+	if keyFunc == nil {
+		keyFunc = SubnetKey
+	}
+	return &EtcdManager{
+		registry:       r,
+		keyFunc:        keyFunc,
+		grace:          config.LeaseGrace,
+		hold:           config.LeaseHold,
+		warnDuplicates: config.DuplicatePublicIP == DuplicatePublicIPWarn,
+
+		reuseByHostname: config.ReuseHostnameLease,
+	}, nil
+}
+
+func newSQLRegistry(db *sql.DB, config *SQLConfig) (*sqlRegistry, error) {
+	r := &sqlRegistry{
+		db:     db,
+		dollar: config.Driver == "postgres" || config.Driver == "pgx",
+		poll:   config.PollInterval,
+	}
+	if r.poll <= 0 {
+		r.poll = DefaultSQLPollInterval
+	}
+
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to create tables: %v", err)
+		}
+	}
+
+	if _, _, err := r.index(); err == sql.ErrNoRows {
+		// another server may be just as quick
+		if _, err := db.Exec(qIndexInit); err != nil {
+			if _, _, err := r.index(); err != nil {
+				return nil, fmt.Errorf("failed to initialize the index: %v", err)
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// q rewrites the placeholders of query for the database
+func (r *sqlRegistry) q(query string) string {
+	if !r.dollar {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) *time.Time {
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return &t
+}
+
+// expiry returns the expires column of a key stored now with ttl
+func expiry(ttl uint64) sql.NullInt64 {
+	if ttl == 0 {
+		// as with etcd, no TTL means no expiry
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: toMillis(sqlNow().Add(time.Duration(ttl) * time.Second)), Valid: true}
+}
+
+func expired(expires sql.NullInt64) bool {
+	return expires.Valid && expires.Int64 <= toMillis(sqlNow())
+}
+
+func etcdError(code int, cause string, index uint64) error {
+	msg := map[int]string{
+		etcdKeyNotFound:       "Key not found",
+		etcdTestFailed:        "Compare failed",
+		etcdKeyAlreadyExists:  "Key already exists",
+		etcdEventIndexCleared: "The event in requested index is outdated and cleared",
+	}[code]
+	return &etcd.EtcdError{ErrorCode: code, Message: msg, Cause: cause, Index: index}
+}
+
+// index returns the current index and the one up to which the history
+// of lease events was dropped
+func (r *sqlRegistry) index() (index, compacted uint64, err error) {
+	err = r.db.QueryRow(r.q(qIndexGet)).Scan(&index, &compacted)
+	return
+}
+
+// sqlTx is a write transaction at index
+type sqlTx struct {
+	*sql.Tx
+	r     *sqlRegistry
+	index uint64
+}
+
+// write runs f in a transaction, committing it unless f fails
+func (r *sqlRegistry) write(f func(tx *sqlTx) (*etcd.Response, error)) (*etcd.Response, error) {
+	t, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	tx := &sqlTx{Tx: t, r: r}
+
+	if _, err := tx.Exec(r.q(qIndexBump)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var compacted uint64
+	if err := tx.QueryRow(r.q(qIndexGet)).Scan(&tx.index, &compacted); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	resp, err := f(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	resp.EtcdIndex = tx.index
+	return resp, nil
+}
+
+// lease returns the node of the lease of key, nil if there is none (or
+// it expired)
+func (tx *sqlTx) lease(network, key string) (*etcd.Node, error) {
+	var data string
+	var expires sql.NullInt64
+	var modified uint64
+	err := tx.QueryRow(tx.r.q(qLeaseGet), network, key).Scan(&data, &expires, &modified)
+	switch {
+	case err == sql.ErrNoRows || err == nil && expired(expires):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	n := &etcd.Node{Key: key, Value: data, ModifiedIndex: modified}
+	if expires.Valid {
+		n.Expiration = fromMillis(expires.Int64)
+	}
+	return n, nil
+}
+
+// put stores the lease of key, replacing whatever is stored, and records
+// the event of doing so
+func (tx *sqlTx) put(action, network, key, data string, ttl uint64) (*etcd.Response, error) {
+	expires := expiry(ttl)
+	if _, err := tx.Exec(tx.r.q(qLeaseDelete), network, key); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(tx.r.q(qLeaseInsert), network, key, data, expires, tx.index); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(tx.r.q(qEventInsert), tx.index, network, key, action, data, expires); err != nil {
+		return nil, err
+	}
+
+	n := &etcd.Node{Key: key, Value: data, ModifiedIndex: tx.index}
+	if expires.Valid {
+		n.Expiration = fromMillis(expires.Int64)
+	}
+	return &etcd.Response{Action: action, Node: n}, nil
+}
+
+// remove deletes the lease of key, recording the event of doing so
+func (tx *sqlTx) remove(action, network string, prev *etcd.Node) (*etcd.Response, error) {
+	if _, err := tx.Exec(tx.r.q(qLeaseDelete), network, prev.Key); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(tx.r.q(qEventInsert), tx.index, network, prev.Key, action, prev.Value, nil); err != nil {
+		return nil, err
+	}
+	return &etcd.Response{
+		Action:   action,
+		Node:     &etcd.Node{Key: prev.Key, ModifiedIndex: tx.index},
+		PrevNode: prev,
+	}, nil
+}
+
+func (r *sqlRegistry) getConfig(ctx context.Context, network string) (*etcd.Response, error) {
+	var data string
+	err := r.db.QueryRow(r.q(qConfigGet), network).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, etcdError(etcdKeyNotFound, network+"/config", 0)
+	case err != nil:
+		return nil, err
+	}
+	return &etcd.Response{Node: &etcd.Node{Key: "config", Value: data}}, nil
+}
+
+func (r *sqlRegistry) createConfig(ctx context.Context, network, data string) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		var existing string
+		err := tx.QueryRow(r.q(qConfigGet), network).Scan(&existing)
+		switch {
+		case err == nil:
+			return nil, etcdError(etcdKeyAlreadyExists, network+"/config", tx.index-1)
+		case err != sql.ErrNoRows:
+			return nil, err
+		}
+
+		if _, err := tx.Exec(r.q(qConfigInsert), network, data, tx.index); err != nil {
+			return nil, err
+		}
+		return &etcd.Response{Action: "create", Node: &etcd.Node{Key: "config", Value: data, ModifiedIndex: tx.index}}, nil
+	})
+}
+
+func (r *sqlRegistry) getSubnets(ctx context.Context, network string) (*etcd.Response, error) {
+	// the index first: a watch from it may see a lease again, but
+	// never misses one written in between
+	index, _, err := r.index()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(r.q(qLeasesGet), network, toMillis(sqlNow()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dir := &etcd.Node{Dir: true}
+	for rows.Next() {
+		var key, data string
+		var expires sql.NullInt64
+		var modified uint64
+		if err := rows.Scan(&key, &data, &expires, &modified); err != nil {
+			return nil, err
+		}
+		n := &etcd.Node{Key: key, Value: data, ModifiedIndex: modified}
+		if expires.Valid {
+			n.Expiration = fromMillis(expires.Int64)
+		}
+		dir.Nodes = append(dir.Nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &etcd.Response{Node: dir, EtcdIndex: index}, nil
+}
+
+func (r *sqlRegistry) getSubnet(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	var data string
+	var expires sql.NullInt64
+	var modified uint64
+	err := r.db.QueryRow(r.q(qLeaseGet), network, sn).Scan(&data, &expires, &modified)
+	switch {
+	case err == sql.ErrNoRows || err == nil && expired(expires):
+		return nil, etcdError(etcdKeyNotFound, network+"/subnets/"+sn, 0)
+	case err != nil:
+		return nil, err
+	}
+
+	n := &etcd.Node{Key: sn, Value: data, ModifiedIndex: modified}
+	if expires.Valid {
+		n.Expiration = fromMillis(expires.Int64)
+	}
+	return &etcd.Response{Node: n}, nil
+}
+
+func (r *sqlRegistry) createSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		existing, err := tx.lease(network, sn)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, etcdError(etcdKeyAlreadyExists, network+"/subnets/"+sn, tx.index-1)
+		}
+		return tx.put("create", network, sn, data, ttl)
+	})
+}
+
+func (r *sqlRegistry) updateSubnet(ctx context.Context, network, sn, data string, ttl uint64) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		return tx.put("set", network, sn, data, ttl)
+	})
+}
+
+func (r *sqlRegistry) compareAndSwapSubnet(ctx context.Context, network, sn, data string, ttl uint64, prevIndex uint64) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		existing, err := tx.lease(network, sn)
+		switch {
+		case err != nil:
+			return nil, err
+		case existing == nil:
+			return nil, etcdError(etcdKeyNotFound, network+"/subnets/"+sn, tx.index-1)
+		case existing.ModifiedIndex != prevIndex:
+			return nil, etcdError(etcdTestFailed, network+"/subnets/"+sn, tx.index-1)
+		}
+		return tx.put("compareAndSwap", network, sn, data, ttl)
+	})
+}
+
+func (r *sqlRegistry) deleteSubnet(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		existing, err := tx.lease(network, sn)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, etcdError(etcdKeyNotFound, network+"/subnets/"+sn, tx.index-1)
+		}
+		return tx.remove("delete", network, existing)
+	})
+}
+
+func (r *sqlRegistry) watchSubnets(ctx context.Context, network string, since uint64) (*etcd.Response, error) {
+	for {
+		resp, err := r.nextEvent(network, since)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+
+		select {
+		case <-time.After(r.poll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// nextEvent returns the first lease event of network at or after since,
+// nil if there is none yet
+func (r *sqlRegistry) nextEvent(network string, since uint64) (*etcd.Response, error) {
+	var idx uint64
+	var key, action, data string
+	var expires sql.NullInt64
+	err := r.db.QueryRow(r.q(qEventNext), network, since).Scan(&idx, &key, &action, &data, &expires)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	found := err == nil
+
+	// checked after looking for the event since the history may have
+	// been dropped in between
+	index, compacted, err := r.index()
+	if err != nil {
+		return nil, err
+	}
+	if since <= compacted {
+		return nil, etcdError(etcdEventIndexCleared, network+"/subnets", index)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	resp := &etcd.Response{Action: action, EtcdIndex: index}
+	switch action {
+	case "delete", "expire":
+		resp.Node = &etcd.Node{Key: key, ModifiedIndex: idx}
+		resp.PrevNode = &etcd.Node{Key: key, Value: data}
+	default:
+		resp.Node = &etcd.Node{Key: key, Value: data, ModifiedIndex: idx}
+		if expires.Valid {
+			resp.Node.Expiration = fromMillis(expires.Int64)
+		}
+	}
+	return resp, nil
+}
+
+func (r *sqlRegistry) getReservations(ctx context.Context, network string) (*etcd.Response, error) {
+	rows, err := r.db.Query(r.q(qReservationsGet), network, toMillis(sqlNow()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dir := &etcd.Node{Dir: true}
+	for rows.Next() {
+		var sn, hostname string
+		var expires int64
+		if err := rows.Scan(&sn, &hostname, &expires); err != nil {
+			return nil, err
+		}
+		dir.Nodes = append(dir.Nodes, &etcd.Node{Key: sn, Value: hostname, Expiration: fromMillis(expires)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &etcd.Response{Node: dir}, nil
+}
+
+func (r *sqlRegistry) createReservation(ctx context.Context, network, sn, hostname string, ttl uint64) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		expires := expiry(ttl)
+		if _, err := tx.Exec(r.q(qReservationDelete), network, sn); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(r.q(qReservationInsert), network, sn, hostname, expires.Int64); err != nil {
+			return nil, err
+		}
+		return &etcd.Response{Action: "set", Node: &etcd.Node{Key: sn, Value: hostname, ModifiedIndex: tx.index, Expiration: fromMillis(expires.Int64)}}, nil
+	})
+}
+
+func (r *sqlRegistry) deleteReservation(ctx context.Context, network, sn string) (*etcd.Response, error) {
+	return r.write(func(tx *sqlTx) (*etcd.Response, error) {
+		var expires int64
+		err := tx.QueryRow(r.q(qReservationGet), network, sn).Scan(&expires)
+		switch {
+		case err == sql.ErrNoRows || err == nil && expires <= toMillis(sqlNow()):
+			return nil, etcdError(etcdKeyNotFound, network+"/reservations/"+sn, tx.index-1)
+		case err != nil:
+			return nil, err
+		}
+
+		if _, err := tx.Exec(r.q(qReservationDelete), network, sn); err != nil {
+			return nil, err
+		}
+		return &etcd.Response{Action: "delete", Node: &etcd.Node{Key: sn, ModifiedIndex: tx.index}}, nil
+	})
+}
+
+// sweep removes expired leases and reservations and drops the lease
+// events beyond the history every interval. Any number of servers can
+// sweep the same database.
+func (r *sqlRegistry) sweep(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := r.sweepOnce(); err != nil {
+			log.Warningf("Failed to sweep expired leases: %v", err)
+		}
+	}
+}
+
+var errNotExpired = errors.New("lease not expired")
+
+func (r *sqlRegistry) sweepOnce() error {
+	now := toMillis(sqlNow())
+
+	rows, err := r.db.Query(r.q(qLeasesExpired), now)
+	if err != nil {
+		return err
+	}
+	type lease struct{ network, key string }
+	var leases []lease
+	for rows.Next() {
+		var l lease
+		if err := rows.Scan(&l.network, &l.key); err != nil {
+			rows.Close()
+			return err
+		}
+		leases = append(leases, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range leases {
+		_, err := r.write(func(tx *sqlTx) (*etcd.Response, error) {
+			var data string
+			var expires sql.NullInt64
+			var modified uint64
+			err := tx.QueryRow(r.q(qLeaseGet), l.network, l.key).Scan(&data, &expires, &modified)
+			switch {
+			case err == sql.ErrNoRows || err == nil && !expired(expires):
+				// renewed or removed meanwhile; failing the
+				// transaction leaves the index alone
+				return nil, errNotExpired
+			case err != nil:
+				return nil, err
+			}
+			return tx.remove("expire", l.network, &etcd.Node{Key: l.key, Value: data})
+		})
+		if err != nil && err != errNotExpired {
+			return err
+		}
+	}
+
+	if _, err := r.db.Exec(r.q(qReservationsSweep), now); err != nil {
+		return err
+	}
+
+	index, compacted, err := r.index()
+	if err != nil {
+		return err
+	}
+	if index > sqlHistory && index-sqlHistory > compacted {
+		if _, err := r.db.Exec(r.q(qCompact), index-sqlHistory); err != nil {
+			return err
+		}
+		if _, err := r.db.Exec(r.q(qEventsPrune), index-sqlHistory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/coreos/flannel/Godeps/_workspace/src/github.com/go-sql-driver/mysql"
+	_ "github.com/coreos/flannel/Godeps/_workspace/src/github.com/lib/pq"
+)
+
+// TestSQLEngine runs the tests of the SQL manager against the database
+// of FLANNEL_TEST_SQL_DSN, with FLANNEL_TEST_SQL_DRIVER ("postgres" or
+// "mysql"). The flannel tables in it are dropped before each test.
+func TestSQLEngine(t *testing.T) {
+	driver, dsn := os.Getenv("FLANNEL_TEST_SQL_DRIVER"), os.Getenv("FLANNEL_TEST_SQL_DSN")
+	if driver == "" || dsn == "" {
+		t.Skip("FLANNEL_TEST_SQL_DRIVER and FLANNEL_TEST_SQL_DSN are not set")
+	}
+
+	db := func(t *testing.T) *EtcdManager {
+		return newSQLTestManager(t, driver, dsn)
+	}
+
+	for _, tc := range []struct {
+		name string
+		run  func(*testing.T, sqlTestDB)
+	}{
+		{"AllocationAtomic", testSQLAllocationAtomic},
+		{"LeaseExpiry", testSQLLeaseExpiry},
+		{"WatchCompacted", testSQLWatchCompacted},
+	} {
+		dropSQLTables(t, driver, dsn)
+		t.Run(tc.name, func(t *testing.T) { tc.run(t, db) })
+	}
+}
+
+func dropSQLTables(t *testing.T, driver, dsn string) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("failed to open the database: %v", err)
+	}
+	defer db.Close()
+
+	for _, table := range []string{"flannel_index", "flannel_configs", "flannel_leases", "flannel_reservations", "flannel_events"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatalf("failed to drop %v: %v", table, err)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// fakeSQL is a database/sql driver keeping the flannel tables in memory.
+// It only understands the queries of sqlRegistry; transactions run one
+// at a time, as the index row lock makes them in a real database.
+type fakeSQL struct {
+	mux sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+var fakeSQLDriver = &fakeSQL{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("flannel-fake", fakeSQLDriver)
+}
+
+type fakeRow struct {
+	data     string
+	expires  driver.Value
+	modified int64
+}
+
+type fakeEvent struct {
+	idx                        int64
+	network, key, action, data string
+	expires                    driver.Value
+}
+
+type fakeTables struct {
+	initialized      bool
+	index, compacted int64
+	configs          map[string]string
+	leases           map[[2]string]fakeRow
+	reservations     map[[2]string]fakeRow
+	events           []fakeEvent
+}
+
+func (t *fakeTables) copy() *fakeTables {
+	c := *t
+	c.configs = make(map[string]string)
+	for k, v := range t.configs {
+		c.configs[k] = v
+	}
+	c.leases = make(map[[2]string]fakeRow)
+	for k, v := range t.leases {
+		c.leases[k] = v
+	}
+	c.reservations = make(map[[2]string]fakeRow)
+	for k, v := range t.reservations {
+		c.reservations[k] = v
+	}
+	c.events = append([]fakeEvent(nil), t.events...)
+	return &c
+}
+
+type fakeDB struct {
+	// held by a transaction from begin to end, and by a statement
+	// outside of any
+	txMux sync.Mutex
+	mux   sync.Mutex
+	t     *fakeTables
+}
+
+func (d *fakeSQL) Open(name string) (driver.Conn, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &fakeDB{t: &fakeTables{
+			configs:      make(map[string]string),
+			leases:       make(map[[2]string]fakeRow),
+			reservations: make(map[[2]string]fakeRow),
+		}}
+		d.dbs[name] = db
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+	// the tables as of the start of the transaction, if in one
+	saved *fakeTables
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.txMux.Lock()
+	c.db.mux.Lock()
+	c.saved = c.db.t.copy()
+	c.db.mux.Unlock()
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.saved = nil
+	c.db.txMux.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.mux.Lock()
+	c.db.t = c.saved
+	c.db.mux.Unlock()
+	c.saved = nil
+	c.db.txMux.Unlock()
+	return nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.c.saved == nil {
+		s.c.db.txMux.Lock()
+		defer s.c.db.txMux.Unlock()
+	}
+	_, err := s.run(args)
+	return driver.RowsAffected(0), err
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.run(args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+func str(v driver.Value) string {
+	return v.(string)
+}
+
+func num(v driver.Value) int64 {
+	return v.(int64)
+}
+
+// expiredAt tells whether the expires column v is at or before ms
+func expiredAt(v driver.Value, ms int64) bool {
+	return v != nil && num(v) <= ms
+}
+
+func (s *fakeStmt) run(a []driver.Value) ([][]driver.Value, error) {
+	db := s.c.db
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	t := db.t
+
+	var rows [][]driver.Value
+	switch s.query {
+	case qIndexGet:
+		if t.initialized {
+			rows = append(rows, []driver.Value{t.index, t.compacted})
+		}
+	case qIndexInit:
+		if t.initialized {
+			return nil, fmt.Errorf("duplicate key")
+		}
+		t.initialized = true
+	case qIndexBump:
+		t.index++
+	case qCompact:
+		t.compacted = num(a[0])
+
+	case qConfigGet:
+		if data, ok := t.configs[str(a[0])]; ok {
+			rows = append(rows, []driver.Value{data})
+		}
+	case qConfigInsert:
+		t.configs[str(a[0])] = str(a[1])
+
+	case qLeasesGet:
+		for k, l := range t.leases {
+			if k[0] == str(a[0]) && !expiredAt(l.expires, num(a[1])) {
+				rows = append(rows, []driver.Value{k[1], l.data, l.expires, l.modified})
+			}
+		}
+	case qLeaseGet:
+		if l, ok := t.leases[[2]string{str(a[0]), str(a[1])}]; ok {
+			rows = append(rows, []driver.Value{l.data, l.expires, l.modified})
+		}
+	case qLeaseInsert:
+		t.leases[[2]string{str(a[0]), str(a[1])}] = fakeRow{str(a[2]), a[3], num(a[4])}
+	case qLeaseDelete:
+		delete(t.leases, [2]string{str(a[0]), str(a[1])})
+	case qLeasesExpired:
+		for k, l := range t.leases {
+			if expiredAt(l.expires, num(a[0])) {
+				rows = append(rows, []driver.Value{k[0], k[1]})
+			}
+		}
+
+	case qEventInsert:
+		t.events = append(t.events, fakeEvent{num(a[0]), str(a[1]), str(a[2]), str(a[3]), str(a[4]), a[5]})
+	case qEventNext:
+		for _, e := range t.events {
+			if e.network == str(a[0]) && e.idx >= num(a[1]) {
+				rows = append(rows, []driver.Value{e.idx, e.key, e.action, e.data, e.expires})
+				break
+			}
+		}
+	case qEventsPrune:
+		var kept []fakeEvent
+		for _, e := range t.events {
+			if e.idx > num(a[0]) {
+				kept = append(kept, e)
+			}
+		}
+		t.events = kept
+
+	case qReservationsGet:
+		for k, r := range t.reservations {
+			if k[0] == str(a[0]) && !expiredAt(r.expires, num(a[1])) {
+				rows = append(rows, []driver.Value{k[1], r.data, r.expires})
+			}
+		}
+	case qReservationGet:
+		if r, ok := t.reservations[[2]string{str(a[0]), str(a[1])}]; ok {
+			rows = append(rows, []driver.Value{r.expires})
+		}
+	case qReservationInsert:
+		t.reservations[[2]string{str(a[0]), str(a[1])}] = fakeRow{data: str(a[2]), expires: a[3]}
+	case qReservationDelete:
+		delete(t.reservations, [2]string{str(a[0]), str(a[1])})
+	case qReservationsSweep:
+		for k, r := range t.reservations {
+			if expiredAt(r.expires, num(a[0])) {
+				delete(t.reservations, k)
+			}
+		}
+
+	default:
+		for _, stmt := range sqlSchema {
+			if s.query == stmt {
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected query: %v", s.query)
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newSQLTestManager(t *testing.T, driver, dsn string) *EtcdManager {
+	sm, err := NewSQLManager(&SQLConfig{Driver: driver, DSN: dsn, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewSQLManager failed: %v", err)
+	}
+	return sm.(*EtcdManager)
+}
+
+// sqlTestDB opens managers on one database, that of the fake driver or
+// a real one (see TestSQLEngine)
+type sqlTestDB func(t *testing.T) *EtcdManager
+
+func fakeSQLDB(name string) sqlTestDB {
+	return func(t *testing.T) *EtcdManager {
+		return newSQLTestManager(t, "flannel-fake", name)
+	}
+}
+
+func TestSQLAllocationAtomic(t *testing.T) {
+	testSQLAllocationAtomic(t, fakeSQLDB(t.Name()))
+}
+
+func testSQLAllocationAtomic(t *testing.T, db sqlTestDB) {
+	ctx := context.Background()
+
+	// two servers on the same database
+	m1 := db(t)
+	m2 := db(t)
+
+	config, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.20.0" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.CreateNetworkConfig(ctx, "", config); err != nil {
+		t.Fatalf("CreateNetworkConfig failed: %v", err)
+	}
+	if err := m2.CreateNetworkConfig(ctx, "", config); err != ErrExists {
+		t.Errorf("expected the second CreateNetworkConfig to find the config, got %v", err)
+	}
+
+	const nodes = 10
+	subnets := make(chan string, nodes)
+	errs := make(chan error, nodes)
+	var wg sync.WaitGroup
+	for i := 0; i < nodes; i++ {
+		sm := m1
+		if i%2 == 1 {
+			sm = m2
+		}
+		attrs := &LeaseAttrs{PublicIP: ip.IP4(0x01010100 + i + 1)}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := sm.AcquireLease(ctx, "", attrs)
+			if err != nil {
+				errs <- err
+				return
+			}
+			subnets <- l.Subnet.String()
+		}()
+	}
+	wg.Wait()
+	close(subnets)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("AcquireLease failed: %v", err)
+	}
+	var got []string
+	seen := make(map[string]bool)
+	for sn := range subnets {
+		if seen[sn] {
+			t.Errorf("%v was leased twice", sn)
+		}
+		seen[sn] = true
+		got = append(got, sn)
+	}
+	sort.Strings(got)
+	if len(got) != nodes {
+		t.Errorf("expected %v leases, got %v", nodes, got)
+	}
+
+	leases, _, err := m2.getLeases(ctx, "")
+	if err != nil {
+		t.Fatalf("getLeases failed: %v", err)
+	}
+	if len(leases) != nodes {
+		t.Errorf("expected %v stored leases, got %v", nodes, len(leases))
+	}
+}
+
+func TestSQLLeaseExpiry(t *testing.T) {
+	testSQLLeaseExpiry(t, fakeSQLDB(t.Name()))
+}
+
+func testSQLLeaseExpiry(t *testing.T, db sqlTestDB) {
+	now := time.Now()
+	defer func() { sqlNow = time.Now }()
+	sqlNow = func() time.Time { return now }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sm := db(t)
+	r := sm.registry.(*sqlRegistry)
+	if _, err := r.createConfig(ctx, "", `{ "Network": "10.3.0.0/16" }`); err != nil {
+		t.Fatalf("createConfig failed: %v", err)
+	}
+
+	l, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: ip.IP4(0x01010101)})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Fatalf("expected a snapshot of %v, got %v", l.Subnet, wr.Snapshot)
+	}
+
+	// not yet expired
+	if err := r.sweepOnce(); err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if _, err := sm.GetLease(ctx, "", l.Subnet); err != nil {
+		t.Fatalf("GetLease failed before the expiry: %v", err)
+	}
+
+	now = now.Add(time.Duration(sm.leaseTTL()+1) * time.Second)
+
+	// hidden right away, before any sweep
+	if _, err := sm.GetLease(ctx, "", l.Subnet); err == nil {
+		t.Errorf("GetLease found the expired lease")
+	}
+
+	if err := r.sweepOnce(); err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	wr, err = sm.WatchLeases(ctx, "", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Events) != 1 {
+		t.Fatalf("expected one event, got %v", wr.Events)
+	}
+	evt := wr.Events[0]
+	if evt.Type != SubnetRemoved || evt.Reason != LeaseExpired || !evt.Lease.Subnet.Equal(l.Subnet) {
+		t.Errorf("expected the expiry of %v, got %+v", l.Subnet, evt)
+	}
+}
+
+func TestSQLWatchCompacted(t *testing.T) {
+	testSQLWatchCompacted(t, fakeSQLDB(t.Name()))
+}
+
+func testSQLWatchCompacted(t *testing.T, db sqlTestDB) {
+	ctx := context.Background()
+
+	sm := db(t)
+	r := sm.registry.(*sqlRegistry)
+	for i := 0; i < sqlHistory+10; i++ {
+		if _, err := r.updateSubnet(ctx, "", "10.3.1.0-24", `{ "PublicIP": "1.1.1.1" }`, 0); err != nil {
+			t.Fatalf("updateSubnet failed: %v", err)
+		}
+	}
+	if err := r.sweepOnce(); err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	if _, err := sm.WatchLeases(ctx, "", "1"); err != ErrCursorExpired {
+		t.Errorf("expected ErrCursorExpired for a dropped index, got %v", err)
+	}
+	if _, err := sm.WatchLeases(ctx, "", fmt.Sprint(sqlHistory+5)); err != nil {
+		t.Errorf("WatchLeases failed within the history: %v", err)
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	r := &sqlRegistry{dollar: true}
+	if q := r.q(qLeaseInsert); q != `INSERT INTO flannel_leases (network, lease_key, data, expires, modified) VALUES ($1, $2, $3, $4, $5)` {
+		t.Errorf("unexpected Postgres query: %v", q)
+	}
+}
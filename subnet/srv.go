@@ -0,0 +1,147 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// looks up SRV records; replaced in tests
+var lookupSRV = net.LookupSRV
+
+// how often resolving the SRV records is tried at startup before
+// falling back to the static endpoints, and the delay in between
+var (
+	srvAttempts   = 3
+	srvRetryDelay = time.Second
+)
+
+// discoverEndpoints returns the client URLs of the etcd members that
+// domain publishes as _etcd-client-ssl._tcp (for TLS) or _etcd-client._tcp
+// SRV records, the way etcd's own DNS discovery does
+func discoverEndpoints(domain string, tls bool) ([]string, error) {
+	services := []struct{ service, scheme string }{{"etcd-client", "http"}}
+	if tls {
+		services = append([]struct{ service, scheme string }{{"etcd-client-ssl", "https"}}, services...)
+	}
+
+	var errs []string
+	for _, s := range services {
+		_, addrs, err := lookupSRV(s.service, "tcp", domain)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		endpoints := []string{}
+		for _, a := range addrs {
+			host := strings.TrimSuffix(a.Target, ".")
+			endpoints = append(endpoints, fmt.Sprintf("%v://%v", s.scheme, net.JoinHostPort(host, fmt.Sprint(a.Port))))
+		}
+		if len(endpoints) > 0 {
+			return endpoints, nil
+		}
+		errs = append(errs, fmt.Sprintf("no _%v._tcp records", s.service))
+	}
+	return nil, fmt.Errorf("failed to discover etcd endpoints of %v: %v", domain, strings.Join(errs, "; "))
+}
+
+func (c *EtcdConfig) usesTLS() bool {
+	return c.Keyfile != "" || c.Certfile != "" || c.CAFile != ""
+}
+
+// initialEndpoints returns the endpoints to start with: those published
+// under SRVDomain, retried a few times, or the static Endpoints if
+// discovery fails
+func initialEndpoints(c *EtcdConfig) ([]string, error) {
+	var err error
+	for i := 0; i < srvAttempts; i++ {
+		if i > 0 {
+			time.Sleep(srvRetryDelay)
+		}
+
+		var endpoints []string
+		if endpoints, err = discoverEndpoints(c.SRVDomain, c.usesTLS()); err == nil {
+			log.Infof("Discovered etcd endpoints %v via %v", endpoints, c.SRVDomain)
+			return endpoints, nil
+		}
+		log.Warning(err)
+	}
+
+	if len(c.Endpoints) == 0 {
+		return nil, err
+	}
+	log.Warningf("Falling back to etcd endpoints %v until discovery succeeds", c.Endpoints)
+	return c.Endpoints, nil
+}
+
+// refreshEndpoints resolves the SRV records again and points the client
+// to the new endpoints if the set changed. Failures keep the endpoints
+// in use, to try again with the next refresh.
+func (esr *etcdSubnetRegistry) refreshEndpoints() {
+	endpoints, err := discoverEndpoints(esr.etcdCfg.SRVDomain, esr.etcdCfg.usesTLS())
+	if err != nil {
+		log.Warningf("Keeping the etcd endpoints in use: %v", err)
+		return
+	}
+
+	esr.mux.Lock()
+	defer esr.mux.Unlock()
+
+	if sameEndpoints(esr.endpoints, endpoints) {
+		return
+	}
+
+	cli, err := newEtcdClient(esr.etcdCfg, endpoints)
+	if err != nil {
+		log.Errorf("Failed to create etcd client for %v: %v", endpoints, err)
+		return
+	}
+	log.Infof("etcd endpoints changed from %v to %v", esr.endpoints, endpoints)
+	esr.cli.Close()
+	esr.cli = cli
+	esr.endpoints = endpoints
+}
+
+func (esr *etcdSubnetRegistry) watchSRV(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		esr.refreshEndpoints()
+	}
+}
+
+func sameEndpoints(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	// the order of SRV records with equal priority is randomized
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
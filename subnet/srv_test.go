@@ -0,0 +1,140 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// srvStub serves the SRV records set for each service
+type srvStub struct {
+	mux     sync.Mutex
+	records map[string][]*net.SRV
+	lookups int
+}
+
+func (s *srvStub) set(service string, records ...*net.SRV) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.records[service] = records
+}
+
+func (s *srvStub) lookup(service, proto, name string) (string, []*net.SRV, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lookups++
+
+	if name != "example.com" || proto != "tcp" {
+		return "", nil, errors.New("unexpected lookup of " + name)
+	}
+	records, ok := s.records[service]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+	return "_" + service + "._tcp." + name, records, nil
+}
+
+func withSRVStub() (*srvStub, func()) {
+	s := &srvStub{records: make(map[string][]*net.SRV)}
+	lookup, delay := lookupSRV, srvRetryDelay
+	lookupSRV, srvRetryDelay = s.lookup, time.Millisecond
+	return s, func() {
+		lookupSRV, srvRetryDelay = lookup, delay
+	}
+}
+
+func TestSRVEndpoints(t *testing.T) {
+	s, restore := withSRVStub()
+	defer restore()
+
+	s.set("etcd-client",
+		&net.SRV{Target: "etcd1.example.com.", Port: 2379},
+		&net.SRV{Target: "etcd2.example.com.", Port: 4001},
+	)
+
+	r, err := newEtcdSubnetRegistry(&EtcdConfig{Endpoints: []string{"http://127.0.0.1:2379"}, SRVDomain: "example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	esr := r.(*etcdSubnetRegistry)
+
+	expected := []string{"http://etcd1.example.com:2379", "http://etcd2.example.com:4001"}
+	if got := esr.client().GetCluster(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the client to use %v, got %v", expected, got)
+	}
+
+	// membership changes are picked up by a refresh
+	s.set("etcd-client", &net.SRV{Target: "etcd3.example.com.", Port: 2379})
+	esr.refreshEndpoints()
+	expected = []string{"http://etcd3.example.com:2379"}
+	if got := esr.client().GetCluster(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the client to move to %v, got %v", expected, got)
+	}
+
+	// a failing lookup keeps what is in use
+	s.set("etcd-client")
+	cli := esr.client()
+	esr.refreshEndpoints()
+	if esr.client() != cli {
+		t.Errorf("client replaced after a failed lookup: %v", esr.client().GetCluster())
+	}
+}
+
+func TestSRVEndpointsTLS(t *testing.T) {
+	s, restore := withSRVStub()
+	defer restore()
+
+	s.set("etcd-client-ssl", &net.SRV{Target: "etcd1.example.com.", Port: 2379})
+	s.set("etcd-client", &net.SRV{Target: "etcd2.example.com.", Port: 2379})
+
+	endpoints, err := discoverEndpoints("example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"https://etcd1.example.com:2379"}; !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("expected %v, got %v", expected, endpoints)
+	}
+
+	if endpoints, err = discoverEndpoints("example.com", false); err != nil || endpoints[0] != "http://etcd2.example.com:2379" {
+		t.Errorf("expected only the plain records without TLS, got %v (%v)", endpoints, err)
+	}
+}
+
+func TestSRVFallback(t *testing.T) {
+	s, restore := withSRVStub()
+	defer restore()
+
+	static := []string{"http://10.0.0.2:2379"}
+	r, err := newEtcdSubnetRegistry(&EtcdConfig{Endpoints: static, SRVDomain: "example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+
+	if got := r.(*etcdSubnetRegistry).client().GetCluster(); !reflect.DeepEqual(got, static) {
+		t.Errorf("expected the static endpoints %v, got %v", static, got)
+	}
+	if s.lookups != srvAttempts {
+		t.Errorf("expected %v lookups before falling back, got %v", srvAttempts, s.lookups)
+	}
+
+	if _, err := newEtcdSubnetRegistry(&EtcdConfig{SRVDomain: "example.com"}); err == nil {
+		t.Error("registry created with neither SRV records nor static endpoints")
+	}
+}
@@ -18,22 +18,249 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/flannel/pkg/ip"
 )
 
+// LeaseAttrs are advertised by a node in its lease. See attrs.go for how
+// versions with different sets of fields get along.
 type LeaseAttrs struct {
-	PublicIP    ip.IP4
-	BackendType string          `json:",omitempty"`
-	BackendData json.RawMessage `json:",omitempty"`
+	PublicIP    ip.IP4          `json:"PublicIP"`
+	BackendType string          `json:"BackendType,omitempty"`
+	BackendData json.RawMessage `json:"BackendData,omitempty"`
+
+	// SubnetBlocks requests a lease spanning this many contiguous
+	// SubnetLen sized blocks. It must be a power of two so that the
+	// aggregate is itself a subnet. Zero means a single block.
+	SubnetBlocks uint `json:"SubnetBlocks,omitempty"`
+
+	// PublicIPs lists all the public IPs of a node with several
+	// uplinks. Backends that support it spread the traffic to the
+	// node's subnet across them (ECMP). PublicIP is still set.
+	PublicIPs []WeightedIP `json:"PublicIPs,omitempty"`
+
+	// PublicIPv6 is the IPv6 tunnel endpoint of a dual-stack node, next
+	// to PublicIP. Backends pick the endpoint of the family of the route
+	// with Endpoint; as subnets are IPv4 for now, that is still PublicIP.
+	PublicIPv6 net.IP `json:"PublicIPv6,omitempty"`
+
+	// AvoidSubnets asks for a lease that doesn't overlap any of them
+	// (e.g. the networks of the host). It is not stored in the lease.
+	AvoidSubnets []ip.IP4Net `json:"AvoidSubnets,omitempty"`
+
+	// Zone is the failure domain (e.g. availability zone) of the node
+	Zone string `json:"Zone,omitempty"`
+
+	// Pool labels the group of nodes (e.g. a node pool of the cluster)
+	// that the node belongs to
+	Pool string `json:"Pool,omitempty"`
+
+	// Tenant labels the node for backends that route
+	// the traffic of each tenant separately
+	Tenant string `json:"Tenant,omitempty"`
+
+	// Hostname identifies the node across changes of its PublicIP
+	Hostname string `json:"Hostname,omitempty"`
+
+	// PublicHostname, if set, is a DNS name that peers resolve to reach
+	// the node, in place of PublicIP (which is still set, as a fallback)
+	PublicHostname string `json:"PublicHostname,omitempty"`
+
+	// Version and Features are the flannel version of the node and
+	// the optional features it supports (absent with older nodes)
+	Version  string   `json:"Version,omitempty"`
+	Features []string `json:"Features,omitempty"`
+
+	// Backends holds the BackendData of each backend type the node runs
+	// while the network migrates between backend types. BackendType and
+	// BackendData are still those of the backend migrated from.
+	Backends map[string]json.RawMessage `json:"Backends,omitempty"`
+
+	// Ready is false while the node is still programming routes to
+	// its peers and peers hold off routing to it until it turns true.
+	// Leases of nodes that don't advertise it (nil) count as ready.
+	Ready *bool `json:"Ready,omitempty"`
+
+	// Epoch is a fencing token set on every acquire of the lease, above
+	// that of any lease acquired before. Of two claims to a subnet peers
+	// go with the higher epoch. Zero (older servers) is unknown.
+	Epoch uint64 `json:"Epoch,omitempty"`
+
+	// Unknown holds the fields, added by newer versions, that this
+	// version doesn't know. They are encoded again as they were so that
+	// they survive a pass through this version.
+	Unknown map[string]json.RawMessage `json:"-"`
+}
+
+// IsReady reports whether the node holding the lease is ready for traffic
+func (attrs *LeaseAttrs) IsReady() bool {
+	return attrs == nil || attrs.Ready == nil || *attrs.Ready
+}
+
+// ForBackend returns the attributes as seen by backends of type bt: those
+// of the node's backend of that type while it migrates. ok is false if
+// the node does not run one.
+func (attrs *LeaseAttrs) ForBackend(bt string) (a *LeaseAttrs, ok bool) {
+	if attrs == nil {
+		return nil, false
+	}
+
+	if data, ok := attrs.Backends[bt]; ok {
+		a := *attrs
+		a.BackendType, a.BackendData, a.Backends = bt, data, nil
+		return &a, true
+	}
+	return attrs, attrs.BackendType == bt
+}
+
+// Endpoint returns the tunnel endpoint of the node for routes of the
+// IPv6 (v6) or the IPv4 family, nil if the node advertises none
+func (attrs *LeaseAttrs) Endpoint(v6 bool) net.IP {
+	switch {
+	case attrs == nil:
+		return nil
+	case v6:
+		return attrs.PublicIPv6
+	case attrs.PublicIP == 0:
+		return nil
+	}
+	return attrs.PublicIP.ToIP()
+}
+
+// ValidateEndpoints checks that the attributes of a lease to acquire
+// carry a tunnel endpoint of at least one family
+func ValidateEndpoints(attrs *LeaseAttrs) error {
+	if attrs.PublicIPv6 != nil && (attrs.PublicIPv6.To4() != nil || attrs.PublicIPv6.To16() == nil) {
+		return fmt.Errorf("PublicIPv6 %v is not an IPv6 address", attrs.PublicIPv6)
+	}
+	if attrs.PublicIP == 0 && attrs.PublicIPv6 == nil {
+		return ErrNoEndpoint
+	}
+	return nil
+}
+
+// WeightedIP is a public IP together with the relative
+// share of traffic it should get
+type WeightedIP struct {
+	IP     ip.IP4 `json:"IP"`
+	Weight uint   `json:"Weight,omitempty"`
+}
+
+// MaxIPWeight is the largest weight of a public IP, that of a nexthop
+// of a multipath route
+const MaxIPWeight = 256
+
+// ParsePublicIPs parses a comma separated list of IP[:WEIGHT].
+// The weight defaults to 1.
+func ParsePublicIPs(s string) ([]WeightedIP, error) {
+	ips := []WeightedIP{}
+	seen := make(map[ip.IP4]bool)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		addr, weight := item, uint64(1)
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			var err error
+			addr = item[:i]
+			weight, err = strconv.ParseUint(item[i+1:], 10, 32)
+			if err != nil || weight == 0 || weight > MaxIPWeight {
+				return nil, fmt.Errorf("%q: weight must be between 1 and %v", item, MaxIPWeight)
+			}
+		}
+
+		// the nexthops have to be of the same family as the subnets
+		pip := net.ParseIP(addr)
+		if pip == nil || pip.To4() == nil {
+			return nil, fmt.Errorf("%q: not an IPv4 address", item)
+		}
+
+		wip := WeightedIP{ip.FromIP(pip), uint(weight)}
+		if seen[wip.IP] {
+			return nil, fmt.Errorf("%v is listed more than once", wip.IP)
+		}
+		seen[wip.IP] = true
+
+		ips = append(ips, wip)
+	}
+
+	return ips, nil
+}
+
+// ParsePublicIP parses an IPv4 address to advertise as the PublicIP of
+// leases, rejecting addresses that peers could never reach it by
+func ParsePublicIP(s string) (ip.IP4, error) {
+	pip := net.ParseIP(s)
+	if pip == nil || pip.To4() == nil {
+		return 0, fmt.Errorf("%q: not an IPv4 address", s)
+	}
+
+	switch {
+	case pip.IsUnspecified(), pip.Equal(net.IPv4bcast):
+		return 0, fmt.Errorf("%v is not a host address", pip)
+	case pip.IsLoopback(), pip.IsLinkLocalUnicast():
+		return 0, fmt.Errorf("%v is not routable", pip)
+	case pip.IsMulticast():
+		return 0, fmt.Errorf("%v is a multicast address", pip)
+	}
+	return ip.FromIP(pip), nil
+}
+
+// ParsePublicIPv6 parses an IPv6 address to advertise as the PublicIPv6
+// of leases, rejecting addresses that peers could never reach it by
+func ParsePublicIPv6(s string) (net.IP, error) {
+	pip := net.ParseIP(s)
+	if pip == nil || pip.To4() != nil {
+		return nil, fmt.Errorf("%q: not an IPv6 address", s)
+	}
+
+	switch {
+	case pip.IsUnspecified():
+		return nil, fmt.Errorf("%v is not a host address", pip)
+	case pip.IsLoopback(), pip.IsLinkLocalUnicast():
+		return nil, fmt.Errorf("%v is not routable", pip)
+	case pip.IsMulticast():
+		return nil, fmt.Errorf("%v is a multicast address", pip)
+	}
+	return pip, nil
+}
+
+// LeasePrefixLen returns the prefix length of a lease with the given
+// attributes under config. It fails if the requested aggregate is not
+// a whole subnet or does not fit into the network.
+func LeasePrefixLen(config *Config, attrs *LeaseAttrs) (uint, error) {
+	blocks := attrs.SubnetBlocks
+	if blocks <= 1 {
+		return config.SubnetLen, nil
+	}
+
+	if blocks&(blocks-1) != 0 {
+		return 0, fmt.Errorf("SubnetBlocks (%v) is not a power of two", blocks)
+	}
+
+	prefixLen := config.SubnetLen
+	for ; blocks > 1; blocks >>= 1 {
+		if prefixLen == config.Network.PrefixLen {
+			return 0, fmt.Errorf("%v subnet blocks do not fit into network %v", attrs.SubnetBlocks, config.Network)
+		}
+		prefixLen--
+	}
+
+	return prefixLen, nil
 }
 
 type Lease struct {
-	Subnet     ip.IP4Net
-	Attrs      *LeaseAttrs
-	Expiration time.Time
+	Subnet     ip.IP4Net   `json:"Subnet"`
+	Attrs      *LeaseAttrs `json:"Attrs"`
+	Expiration time.Time   `json:"Expiration"`
 }
 
 func (l *Lease) Key() string {
@@ -46,12 +273,26 @@ type (
 	Event struct {
 		Type  EventType `json:"type"`
 		Lease Lease     `json:"lease"`
+		// Reason tells why a lease was removed, if known
+		Reason EventReason `json:"reason,omitempty"`
 	}
+
+	EventReason string
 )
 
 const (
 	SubnetAdded EventType = iota
 	SubnetRemoved
+	// SnapshotDone ends the initial snapshot of a WatchLeasesMarked
+	// watch, it carries no lease and is never sent over the wire
+	SnapshotDone
+)
+
+const (
+	// LeaseRevoked means the lease was released (deleted) explicitly
+	LeaseRevoked EventReason = "revoked"
+	// LeaseExpired means the lease was not renewed in time
+	LeaseExpired EventReason = "expired"
 )
 
 type WatchResult struct {
@@ -62,8 +303,40 @@ type WatchResult struct {
 	Events   []Event     `json:"events"`
 	Snapshot []Lease     `json:"snapshot"`
 	Cursor   interface{} `json:"cursor"`
+
+	// Stalled is set by a server that can't reach etcd and serves
+	// the last leases it knows of
+	Stalled bool `json:"stalled,omitempty"`
 }
 
+// ErrCursorExpired is returned by WatchLeases when the cursor points
+// past the history kept by the store. The caller has to start over
+// with a nil cursor to get a snapshot.
+var ErrCursorExpired = errors.New("watch cursor is outside the history window")
+
+// ErrConfigNotFound is returned by GetNetworkConfig when the network has
+// no config (yet)
+var ErrConfigNotFound = errors.New("network config not found")
+
+// ErrLeaseNotFound is returned by GetLease when no lease of the subnet exists
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// ErrLeaseExpired is returned by RenewLease when the lease expired
+// longer ago than the grace window (if one is set) allows
+var ErrLeaseExpired = errors.New("lease expired")
+
+// ErrDuplicatePublicIP is returned by AcquireLease and UpdateLeaseAttrs
+// when the PublicIP is already in use by the lease of another node
+var ErrDuplicatePublicIP = errors.New("PublicIP is already in use by another node")
+
+// ErrBackendMismatch is returned by AcquireLease at servers when the
+// BackendType of the node is not the one its network is configured for
+var ErrBackendMismatch = errors.New("backend type does not match the network config")
+
+// ErrNoEndpoint is returned by AcquireLease when the attributes carry
+// neither a PublicIP nor a PublicIPv6
+var ErrNoEndpoint = errors.New("lease has no tunnel endpoint (PublicIP or PublicIPv6)")
+
 func (et EventType) MarshalJSON() ([]byte, error) {
 	s := ""
 
@@ -92,9 +365,38 @@ func (et *EventType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Reservation holds a revoked lease's subnet out of general allocation
+// for TTL so that it can be granted to the node named Hostname (e.g. the
+// replacement of a drained node)
+type Reservation struct {
+	Hostname string
+	TTL      time.Duration
+}
+
+// NetworkStats tells how much of the subnet range (SubnetMin to
+// SubnetMax, or the Pools) of a network is in use, counted in SubnetLen
+// sized subnets
+type NetworkStats struct {
+	Total    uint `json:"total"`
+	Leased   uint `json:"leased"`
+	Reserved uint `json:"reserved"`
+	Free     uint `json:"free"`
+
+	// MinVersion is the lowest Version of the lease holders, empty if
+	// any of them does not advertise its version
+	MinVersion string `json:"minVersion,omitempty"`
+	// Features are those supported by all the lease holders
+	Features []string `json:"features,omitempty"`
+}
+
 type Manager interface {
 	GetNetworkConfig(ctx context.Context, network string) (*Config, error)
+	GetNetworkStats(ctx context.Context, network string) (*NetworkStats, error)
 	AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error)
 	RenewLease(ctx context.Context, network string, lease *Lease) error
+	UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs) (*Lease, error)
+	GetLease(ctx context.Context, network string, sn ip.IP4Net) (*Lease, error)
+	RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error
+	DrainLease(ctx context.Context, network string, sn ip.IP4Net, r *Reservation) error
 	WatchLeases(ctx context.Context, network string, cursor interface{}) (WatchResult, error)
 }
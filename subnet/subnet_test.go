@@ -17,7 +17,9 @@ package subnet
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -67,6 +69,421 @@ func TestAcquireLease(t *testing.T) {
 	}
 }
 
+func TestAcquireLeaseSameHostname(t *testing.T) {
+	msr := newMockRegistry(1000, `{ "Network": "10.3.0.0/16" }`, nil)
+	sm := &EtcdManager{registry: msr, keyFunc: SubnetKey, reuseByHostname: true}
+
+	attrs := LeaseAttrs{
+		PublicIP: mustParseIP4("1.2.3.4"),
+		Hostname: "node1",
+	}
+
+	l, err := sm.AcquireLease(context.Background(), "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// the node came back with a new IP but the same name
+	attrs2 := LeaseAttrs{
+		PublicIP: mustParseIP4("1.2.3.5"),
+		Hostname: "node1",
+	}
+
+	l2, err := sm.AcquireLease(context.Background(), "", &attrs2)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	if !l2.Subnet.Equal(l.Subnet) {
+		t.Errorf("Subnet mismatch: expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+	if l2.Attrs.PublicIP != attrs2.PublicIP {
+		t.Errorf("Lease not updated to the new PublicIP: %v", l2.Attrs.PublicIP)
+	}
+
+	// a different node gets its own subnet
+	attrs3 := LeaseAttrs{
+		PublicIP: mustParseIP4("1.2.3.6"),
+		Hostname: "node2",
+	}
+
+	l3, err := sm.AcquireLease(context.Background(), "", &attrs3)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	if l3.Subnet.Equal(l.Subnet) {
+		t.Errorf("Different node got the same subnet %v", l3.Subnet)
+	}
+}
+
+func TestAcquireLeaseSameHostnameLive(t *testing.T) {
+	msr := newMockRegistry(1000, `{ "Network": "10.3.0.0/16" }`, nil)
+	sm := newEtcdManager(msr)
+
+	ctx := context.Background()
+	l, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), Hostname: "localhost"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// another node of the same name does not take over the live lease
+	l2, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.5"), Hostname: "localhost"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l2.Subnet.Equal(l.Subnet) {
+		t.Fatalf("Node of the same hostname took over the live lease of %v", l.Subnet)
+	}
+
+	// but an expired one, kept for the grace longer than the mock's TTL
+	sm = &EtcdManager{registry: msr, keyFunc: SubnetKey, grace: time.Hour}
+	l3, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.6"), Hostname: "localhost"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l3.Subnet.Equal(l.Subnet) && !l3.Subnet.Equal(l2.Subnet) {
+		t.Errorf("Node of the same hostname got %v instead of an expired lease", l3.Subnet)
+	}
+}
+
+func TestAcquireLeaseDuplicatePublicIP(t *testing.T) {
+	for _, warn := range []bool{false, true} {
+		msr := newMockRegistry(1000, `{ "Network": "10.3.0.0/16" }`, nil)
+		sm := &EtcdManager{registry: msr, keyFunc: SubnetKey, warnDuplicates: warn}
+
+		attrs := LeaseAttrs{
+			PublicIP: mustParseIP4("1.2.3.4"),
+			Hostname: "node1",
+		}
+		l, err := sm.AcquireLease(context.Background(), "", &attrs)
+		if err != nil {
+			t.Fatal("AcquireLease failed: ", err)
+		}
+
+		// another node configured with the same IP
+		attrs2 := LeaseAttrs{
+			PublicIP: mustParseIP4("1.2.3.4"),
+			Hostname: "node2",
+		}
+		l2, err := sm.AcquireLease(context.Background(), "", &attrs2)
+		if !warn {
+			if err != ErrDuplicatePublicIP {
+				t.Errorf("AcquireLease of a duplicate PublicIP: expected ErrDuplicatePublicIP, got %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal("AcquireLease with warn-only duplicates failed: ", err)
+		}
+		if l2.Subnet.Equal(l.Subnet) {
+			t.Errorf("Node sharing the PublicIP was handed the lease of the other: %v", l2.Subnet)
+		}
+	}
+}
+
+func TestAcquireLeaseAvoidSubnets(t *testing.T) {
+	subnets := []*etcd.Node{
+		&etcd.Node{Key: "10.3.1.0-24", Value: `{ "PublicIP": "1.2.3.4" }`, ModifiedIndex: 10},
+	}
+	msr := newMockRegistry(1000, drainConfig, subnets)
+	sm := newEtcdManager(msr)
+
+	attrs := LeaseAttrs{
+		PublicIP:     mustParseIP4("1.2.3.4"),
+		AvoidSubnets: []ip.IP4Net{{IP: mustParseIP4("10.3.0.0"), PrefixLen: 23}},
+	}
+
+	l, err := sm.AcquireLease(context.Background(), "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	if l.Subnet.String() != "10.3.2.0/24" {
+		t.Errorf("Subnet mismatch: expected 10.3.2.0/24, got %v", l.Subnet)
+	}
+	if msr.hasSubnet("10.3.1.0-24") {
+		t.Error("Lease overlapping the avoided subnets was not deleted")
+	}
+
+	resp, err := msr.getSubnet(context.Background(), "", "10.3.2.0-24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := LeaseAttrs{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.AvoidSubnets != nil || l.Attrs.AvoidSubnets != nil {
+		t.Errorf("AvoidSubnets were stored in the lease: %v", resp.Node.Value)
+	}
+}
+
+// five subnets: 10.3.1.0/24 ... 10.3.5.0/24
+const hashedConfig = `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.5.0", "Allocation": "hashed" }`
+
+func TestAcquireLeaseHashed(t *testing.T) {
+	config, err := ParseConfig(hashedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preferred, ok := hashedSubnet(config, config.SubnetLen, "node1")
+	if !ok {
+		t.Fatal("no subnet for node1 in the range")
+	}
+
+	acquire := func(subnets []*etcd.Node) ip.IP4Net {
+		sm := newEtcdManager(newMockRegistry(1000, hashedConfig, subnets))
+		attrs := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), Hostname: "node1"}
+		l, err := sm.AcquireLease(context.Background(), "", &attrs)
+		if err != nil {
+			t.Fatal("AcquireLease failed: ", err)
+		}
+		return l.Subnet
+	}
+
+	// the same identity gets the same subnet, whatever the cluster
+	for i := 0; i < 3; i++ {
+		if sn := acquire(nil); !sn.Equal(preferred) {
+			t.Fatalf("node1 got %v, expected %v", sn, preferred)
+		}
+	}
+
+	// with that one taken it is the first free one
+	taken := []*etcd.Node{
+		&etcd.Node{Key: preferred.StringSep(".", "-"), Value: `{ "PublicIP": "1.1.1.1" }`, ModifiedIndex: 10},
+	}
+	expected := ip.IP4Net{IP: mustParseIP4("10.3.1.0"), PrefixLen: 24}
+	if preferred.Equal(expected) {
+		expected = ip.IP4Net{IP: mustParseIP4("10.3.2.0"), PrefixLen: 24}
+	}
+	if sn := acquire(taken); !sn.Equal(expected) {
+		t.Errorf("node1 got %v with its subnet taken, expected %v", sn, expected)
+	}
+
+	// identities spread over the range
+	seen := make(map[ip.IP4Net]bool)
+	for i := 0; i < 20; i++ {
+		sn, _ := hashedSubnet(config, config.SubnetLen, fmt.Sprintf("node%d", i))
+		if !isSubnetConfigCompat(config, sn, config.SubnetLen) {
+			t.Fatalf("hashed subnet %v is out of range", sn)
+		}
+		seen[sn] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("20 identities hashed to %v subnets", len(seen))
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "Allocation": "bogus" }`); err == nil {
+		t.Error("config with an unknown Allocation parsed")
+	}
+}
+
+// two subnets: 10.3.1.0/24 and 10.3.2.0/24
+const drainConfig = `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.2.0" }`
+
+func drainedLease(t *testing.T, sm Manager) *Lease {
+	old := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), Hostname: "old"}
+	l, err := sm.AcquireLease(context.Background(), "", &old)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	r := &Reservation{Hostname: "new", TTL: 10 * time.Minute}
+	if err := sm.DrainLease(context.Background(), "", l.Subnet, r); err != nil {
+		t.Fatal("DrainLease failed: ", err)
+	}
+	return l
+}
+
+func TestDrainLeaseReplacement(t *testing.T) {
+	msr := newMockRegistry(1000, drainConfig, nil)
+	sm := newEtcdManager(msr)
+
+	l := drainedLease(t, sm)
+	if msr.hasSubnet(l.Key()) {
+		t.Fatalf("Drained lease %v was not revoked", l.Subnet)
+	}
+
+	// the only subnet up for grabs is the other one
+	other := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.5"), Hostname: "other"}
+	lo, err := sm.AcquireLease(context.Background(), "", &other)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if lo.Subnet.Equal(l.Subnet) {
+		t.Fatalf("Reserved subnet %v was granted to another node", l.Subnet)
+	}
+
+	replacement := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.6"), Hostname: "new"}
+	ln, err := sm.AcquireLease(context.Background(), "", &replacement)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !ln.Subnet.Equal(l.Subnet) {
+		t.Errorf("Replacement got %v instead of the reserved %v", ln.Subnet, l.Subnet)
+	}
+	if msr.hasReservation(l.Key()) {
+		t.Error("Reservation was not removed once taken")
+	}
+}
+
+func TestLeaseHold(t *testing.T) {
+	msr := newMockRegistry(0, drainConfig, nil)
+	sm := &EtcdManager{registry: msr, keyFunc: SubnetKey, hold: time.Minute}
+	ctx := context.Background()
+
+	acquire := func(hostname, publicIP string) (*Lease, error) {
+		attrs := LeaseAttrs{PublicIP: mustParseIP4(publicIP), Hostname: hostname}
+		config, err := sm.GetNetworkConfig(ctx, "")
+		if err != nil {
+			t.Fatal("GetNetworkConfig failed: ", err)
+		}
+		// AcquireLease would wait for a subnet to free up
+		return sm.tryAcquireLease(ctx, "", config, attrs.PublicIP, &attrs)
+	}
+
+	l, err := acquire("first", "1.2.3.4")
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// gone before its first renewal
+	msr.expireSubnet(l.Key())
+
+	lo, err := acquire("other", "1.2.3.5")
+	switch {
+	case err != nil:
+		t.Fatal("AcquireLease failed: ", err)
+	case lo.Subnet.Equal(l.Subnet):
+		t.Fatalf("Held subnet %v was granted to another node", l.Subnet)
+	}
+	if lt, err := acquire("third", "1.2.3.6"); err == nil {
+		t.Fatalf("Held subnet %v was granted to a third node", lt.Subnet)
+	}
+
+	// the node itself gets it back
+	lb, err := acquire("first", "1.2.3.4")
+	switch {
+	case err != nil:
+		t.Fatal("AcquireLease failed: ", err)
+	case !lb.Subnet.Equal(l.Subnet):
+		t.Errorf("Node got %v back instead of its held %v", lb.Subnet, l.Subnet)
+	}
+
+	// and once the window is over anyone does
+	msr.expireSubnet(l.Key())
+	msr.expireReservation(l.Key())
+	lt, err := acquire("third", "1.2.3.6")
+	switch {
+	case err != nil:
+		t.Fatal("AcquireLease failed: ", err)
+	case !lt.Subnet.Equal(l.Subnet):
+		t.Errorf("Third node got %v instead of the no longer held %v", lt.Subnet, l.Subnet)
+	}
+}
+
+func TestDrainLeaseGraceExpired(t *testing.T) {
+	msr := newMockRegistry(1000, drainConfig, nil)
+	sm := newEtcdManager(msr).(*EtcdManager)
+
+	l := drainedLease(t, sm)
+
+	// take the other subnet so that the reserved one is all that's left
+	other := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.5"), Hostname: "other"}
+	if _, err := sm.AcquireLease(context.Background(), "", &other); err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	config, err := sm.GetNetworkConfig(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.7"), Hostname: "third"}
+	if _, err := sm.tryAcquireLease(context.Background(), "", config, third.PublicIP, &third); err == nil {
+		t.Fatal("Reserved subnet was granted to another node within the grace period")
+	}
+
+	msr.expireReservation(l.Key())
+
+	lt, err := sm.AcquireLease(context.Background(), "", &third)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !lt.Subnet.Equal(l.Subnet) {
+		t.Errorf("Expected the formerly reserved %v, got %v", l.Subnet, lt.Subnet)
+	}
+}
+
+func TestAcquireMultiBlockLease(t *testing.T) {
+	// room for exactly one aligned /22 (four /24 blocks)
+	config := `{ "Network": "10.4.0.0/16", "SubnetMin": "10.4.4.0", "SubnetMax": "10.4.7.0" }`
+	msr := newMockRegistry(1000, config, nil)
+	sm := newEtcdManager(msr)
+
+	attrs := LeaseAttrs{
+		PublicIP:     mustParseIP4("1.2.3.4"),
+		SubnetBlocks: 4,
+	}
+
+	l, err := sm.AcquireLease(context.Background(), "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	if l.Subnet.String() != "10.4.4.0/22" {
+		t.Fatal("Subnet mismatch: expected 10.4.4.0/22, got: ", l.Subnet)
+	}
+
+	// all constituent blocks are taken
+	other := LeaseAttrs{
+		PublicIP: mustParseIP4("1.2.3.5"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := sm.AcquireLease(ctx, "", &other); err == nil {
+		t.Fatal("AcquireLease succeeded with all blocks reserved")
+	}
+
+	// release the aggregate, the blocks become available again
+	if _, err := msr.deleteSubnet(context.Background(), "", l.Key()); err != nil {
+		t.Fatal("deleteSubnet failed: ", err)
+	}
+
+	l2, err := sm.AcquireLease(context.Background(), "", &other)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Contains(l2.Subnet.IP) || l2.Subnet.PrefixLen != 24 {
+		t.Fatalf("Subnet mismatch: expected /24 within %v, got: %v", l.Subnet, l2.Subnet)
+	}
+}
+
+func TestAcquireMultiBlockLeaseInvalid(t *testing.T) {
+	msr := newDummyRegistry(1000)
+	sm := newEtcdManager(msr)
+
+	for _, blocks := range []uint{3, 512} {
+		attrs := LeaseAttrs{
+			PublicIP:     mustParseIP4("1.2.3.4"),
+			SubnetBlocks: blocks,
+		}
+		if _, err := sm.AcquireLease(context.Background(), "", &attrs); err == nil {
+			t.Errorf("AcquireLease with %v blocks succeeded", blocks)
+		}
+	}
+}
+
+func mustParseIP4(s string) ip.IP4 {
+	a, err := ip.ParseIP4(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
 func TestConfigChanged(t *testing.T) {
 	msr := newDummyRegistry(1000)
 	sm := newEtcdManager(msr)
@@ -179,58 +596,799 @@ func TestWatchLeaseRemoved(t *testing.T) {
 	}
 }
 
-type leaseData struct {
-	Dummy string
+func TestWatchLeaseRemovedReason(t *testing.T) {
+	msr := newDummyRegistry(0)
+	sm := newEtcdManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm, "", events)
+
+	// skip over the initial snapshot
+	<-events
+
+	if err := sm.RevokeLease(ctx, "", newIP4Net("10.3.1.0", 24)); err != nil {
+		t.Fatal("RevokeLease failed: ", err)
+	}
+	msr.expireSubnet("10.3.4.0-24")
+
+	expected := map[string]EventReason{
+		"10.3.1.0-24": LeaseRevoked,
+		"10.3.4.0-24": LeaseExpired,
+	}
+	for seen := 0; seen < len(expected); {
+		for _, evt := range <-events {
+			if evt.Type != SubnetRemoved {
+				t.Fatalf("WatchSubnets produced wrong event type: %v", evt)
+			}
+			if evt.Reason != expected[evt.Lease.Key()] {
+				t.Errorf("Removal of %v has reason %q, expected %q", evt.Lease.Key(), evt.Reason, expected[evt.Lease.Key()])
+			}
+			seen++
+		}
+	}
 }
 
-func TestRenewLease(t *testing.T) {
-	msr := newDummyRegistry(1)
+func TestGetNetworkStats(t *testing.T) {
+	msr := newDummyRegistry(0)
 	sm := newEtcdManager(msr)
+	ctx := context.Background()
 
-	// Create LeaseAttrs
-	extIP, _ := ip.ParseIP4("1.2.3.4")
-	attrs := LeaseAttrs{
-		PublicIP:    extIP,
-		BackendType: "vxlan",
+	r := &Reservation{Hostname: "replacement", TTL: time.Minute}
+	if err := sm.DrainLease(ctx, "", newIP4Net("10.3.5.0", 24), r); err != nil {
+		t.Fatal("DrainLease failed: ", err)
 	}
 
-	ld, err := json.Marshal(&leaseData{Dummy: "test string"})
+	stats, err := sm.GetNetworkStats(ctx, "")
 	if err != nil {
-		t.Fatalf("Failed to marshal leaseData: %v", err)
+		t.Fatal("GetNetworkStats failed: ", err)
 	}
-	attrs.BackendData = json.RawMessage(ld)
-
-	// Acquire lease
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
-	l, err := sm.AcquireLease(ctx, "", &attrs)
-	if err != nil {
-		t.Fatal("AcquireLease failed: ", err)
+	// 10.3.1.0 to 10.3.5.0 of which 1, 2 and 4 are leased,
+	// 5 is reserved and 3 is free
+	expected := NetworkStats{Total: 5, Leased: 3, Reserved: 1, Free: 1}
+	if !reflect.DeepEqual(*stats, expected) {
+		t.Errorf("GetNetworkStats returned %+v, expected %+v", *stats, expected)
 	}
+}
 
-	go LeaseRenewer(ctx, sm, "", l)
+func TestAcquireLeasePools(t *testing.T) {
+	config := `{ "Network": "10.0.0.0/8", "SubnetLen": 26, "Pools": [ "10.5.0.0/25", "10.1.0.0/25" ] }`
+	sm := newEtcdManager(newMockRegistry(0, config, nil))
+	ctx := context.Background()
 
-	fmt.Println("Waiting for lease to pass original expiration")
-	time.Sleep(2 * time.Second)
+	pools := []ip.IP4Net{newIP4Net("10.5.0.0", 25), newIP4Net("10.1.0.0", 25)}
+	for i := 0; i < 4; i++ {
+		attrs := LeaseAttrs{PublicIP: ip.IP4(0x01010101 + i)}
+		l, err := sm.AcquireLease(ctx, "", &attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease %v failed: %v", i, err)
+		}
 
-	// check that it's still good
-	for _, n := range msr.subnets.Nodes {
-		if n.Key == l.Subnet.StringSep(".", "-") {
-			if n.Expiration.Before(time.Now()) {
-				t.Error("Failed to renew lease: expiration did not advance")
-			}
-			a := LeaseAttrs{}
-			if err := json.Unmarshal([]byte(n.Value), &a); err != nil {
-				t.Errorf("Failed to JSON-decode LeaseAttrs: %v", err)
-				return
-			}
-			if !reflect.DeepEqual(a, attrs) {
-				t.Errorf("LeaseAttrs changed: was %#v, now %#v", attrs, a)
-			}
-			return
+		// the first pool fills up before the second is drawn from
+		if pool := pools[i/2]; !pool.Contains(l.Subnet.IP) || l.Subnet.PrefixLen != 26 {
+			t.Errorf("lease %v is %v, expected a /26 in %v", i, l.Subnet, pool)
 		}
 	}
 
-	t.Fatalf("Failed to find acquired lease")
+	stats, err := sm.GetNetworkStats(ctx, "")
+	if err != nil {
+		t.Fatal("GetNetworkStats failed: ", err)
+	}
+	if expected := (NetworkStats{Total: 4, Leased: 4}); !reflect.DeepEqual(*stats, expected) {
+		t.Errorf("GetNetworkStats returned %+v, expected %+v", *stats, expected)
+	}
+
+	// the gap between the pools is not handed out (AcquireLease
+	// would wait for a subnet to free up)
+	cfg, err := sm.GetNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatal("GetNetworkConfig failed: ", err)
+	}
+	extIP := mustParseIP4("1.1.1.100")
+	if l, err := sm.(*EtcdManager).tryAcquireLease(ctx, "", cfg, extIP, &LeaseAttrs{PublicIP: extIP}); err == nil || err.Error() != "out of subnets" {
+		t.Errorf("expected to be out of subnets with all pools taken, got %v, %v", l, err)
+	}
+}
+
+func TestLeaseVersionRoundTrip(t *testing.T) {
+	attrs := LeaseAttrs{
+		PublicIP: mustParseIP4("1.1.1.1"),
+		Version:  "0.5.0+git",
+		Features: []string{"ready", "tenant"},
+	}
+
+	data, err := json.Marshal(&attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded LeaseAttrs
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, attrs) {
+		t.Errorf("LeaseAttrs did not round-trip: %+v vs %+v", decoded, attrs)
+	}
+
+	// as written by older agents
+	if err := json.Unmarshal([]byte(`{ "PublicIP": "1.1.1.1" }`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseAttrsUnknownFields(t *testing.T) {
+	// as written by a newer agent
+	data := `{"PublicIP": "1.1.1.1", "zone": "a", "Future": {"x": [1, 2]}, "Later": true}`
+
+	var attrs LeaseAttrs
+	if err := json.Unmarshal([]byte(data), &attrs); err != nil {
+		t.Fatalf("failed to decode attrs with unknown fields: %v", err)
+	}
+	if attrs.Zone != "a" {
+		t.Errorf("known field (in another case) not decoded: %+v", attrs)
+	}
+	expected := map[string]json.RawMessage{
+		"Future": json.RawMessage(`{"x": [1, 2]}`),
+		"Later":  json.RawMessage(`true`),
+	}
+	if !reflect.DeepEqual(attrs.Unknown, expected) {
+		t.Errorf("expected unknown fields %s, got %s", expected, attrs.Unknown)
+	}
+
+	// what an older agent does with the lease: change a field, write it back
+	attrs.Zone = "b"
+	encoded, err := json.Marshal(&attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if string(fields["Zone"]) != `"b"` || fields["zone"] != nil {
+		t.Errorf("Zone not encoded once as changed: %s", encoded)
+	}
+	if string(fields["Future"]) != `{"x":[1,2]}` || string(fields["Later"]) != "true" {
+		t.Errorf("unknown fields lost: %s", encoded)
+	}
+
+	var decoded LeaseAttrs
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Zone != "b" || len(decoded.Unknown) != 2 {
+		t.Errorf("attrs did not round-trip: %+v", decoded)
+	}
+}
+
+func TestGetNetworkStatsMinVersion(t *testing.T) {
+	subnets := []*etcd.Node{
+		&etcd.Node{Key: "10.3.1.0-24", Value: `{ "PublicIP": "1.1.1.1", "Version": "0.5.0+git", "Features": ["ready", "tenant"] }`, ModifiedIndex: 10},
+		&etcd.Node{Key: "10.3.2.0-24", Value: `{ "PublicIP": "1.1.1.2", "Version": "0.10.1", "Features": ["tenant", "ready", "public-ips"] }`, ModifiedIndex: 11},
+		&etcd.Node{Key: "10.3.3.0-24", Value: `{ "PublicIP": "1.1.1.3", "Version": "0.5.2", "Features": ["tenant"] }`, ModifiedIndex: 12},
+	}
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.5.0" }`
+	msr := newMockRegistry(0, config, subnets)
+	sm := newEtcdManager(msr)
+
+	stats, err := sm.GetNetworkStats(context.Background(), "")
+	if err != nil {
+		t.Fatal("GetNetworkStats failed: ", err)
+	}
+	if stats.MinVersion != "0.5.0+git" {
+		t.Errorf("expected minimum version 0.5.0+git, got %q", stats.MinVersion)
+	}
+	if !reflect.DeepEqual(stats.Features, []string{"tenant"}) {
+		t.Errorf("expected common features [tenant], got %v", stats.Features)
+	}
+
+	// an older agent joins
+	if _, err := msr.createSubnet(context.Background(), "", "10.3.4.0-24", `{ "PublicIP": "1.1.1.4" }`, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = sm.GetNetworkStats(context.Background(), ""); err != nil {
+		t.Fatal("GetNetworkStats failed: ", err)
+	}
+	if stats.MinVersion != "" || len(stats.Features) != 0 {
+		t.Errorf("version known despite a lease without one: %q %v", stats.MinVersion, stats.Features)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.5.0", "0.5.0+git", 0},
+		{"0.5.0", "0.10.0", -1},
+		{"v1.2", "1.1.9", 1},
+		{"1.0", "1.0.0", 0},
+	} {
+		if r := CompareVersions(c.a, c.b); r != c.expected {
+			t.Errorf("CompareVersions(%q, %q) = %v, expected %v", c.a, c.b, r, c.expected)
+		}
+	}
+}
+
+type leaseData struct {
+	Dummy string
+}
+
+func TestRenewLease(t *testing.T) {
+	msr := newDummyRegistry(1)
+	sm := newEtcdManager(msr)
+
+	// Create LeaseAttrs
+	extIP, _ := ip.ParseIP4("1.2.3.4")
+	attrs := LeaseAttrs{
+		PublicIP:    extIP,
+		BackendType: "vxlan",
+	}
+
+	ld, err := json.Marshal(&leaseData{Dummy: "test string"})
+	if err != nil {
+		t.Fatalf("Failed to marshal leaseData: %v", err)
+	}
+	attrs.BackendData = json.RawMessage(ld)
+
+	// Acquire lease
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	go LeaseRenewer(ctx, sm, "", l)
+
+	fmt.Println("Waiting for lease to pass original expiration")
+	time.Sleep(2 * time.Second)
+
+	// check that it's still good
+	resp, err := msr.getSubnets(ctx, "")
+	if err != nil {
+		t.Fatal("getSubnets failed: ", err)
+	}
+	for _, n := range resp.Node.Nodes {
+		if n.Key == l.Subnet.StringSep(".", "-") {
+			if n.Expiration.Before(time.Now()) {
+				t.Error("Failed to renew lease: expiration did not advance")
+			}
+			a := LeaseAttrs{}
+			if err := json.Unmarshal([]byte(n.Value), &a); err != nil {
+				t.Errorf("Failed to JSON-decode LeaseAttrs: %v", err)
+				return
+			}
+			// as acquired, with the epoch set
+			if !reflect.DeepEqual(a, *l.Attrs) {
+				t.Errorf("LeaseAttrs changed: was %#v, now %#v", *l.Attrs, a)
+			}
+			return
+		}
+	}
+
+	t.Fatalf("Failed to find acquired lease")
+}
+
+func TestRenewLeaseGrace(t *testing.T) {
+	msr := newDummyRegistry(0)
+	sm := &EtcdManager{registry: msr, keyFunc: SubnetKey, grace: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// stored for the grace longer than the lease is advertised for
+	node := msr.subnets.Nodes[len(msr.subnets.Nodes)-1]
+	if d := node.Expiration.Sub(l.Expiration); d != time.Minute {
+		t.Errorf("lease is stored for %v longer than it expires, expected %v", d, time.Minute)
+	}
+
+	l.Expiration = time.Now().Add(-30 * time.Second)
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Errorf("renewal within the grace failed: %v", err)
+	}
+	if !l.Expiration.After(time.Now()) {
+		t.Errorf("renewal within the grace did not advance the expiration: %v", l.Expiration)
+	}
+
+	l.Expiration = time.Now().Add(-2 * time.Minute)
+	if err := sm.RenewLease(ctx, "", l); err != ErrLeaseExpired {
+		t.Errorf("renewal past the grace returned %v, expected ErrLeaseExpired", err)
+	}
+}
+
+func TestRenewLeaseAfterExpiry(t *testing.T) {
+	msr := newDummyRegistry(0)
+	sm := newEtcdManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// without a grace the late renewal stores the lease again
+	key := l.Subnet.StringSep(".", "-")
+	msr.expireSubnet(key)
+	l.Expiration = time.Now().Add(-time.Hour)
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Fatalf("renewal after the expiry failed: %v", err)
+	}
+	if !msr.hasSubnet(key) || !l.Expiration.After(time.Now()) {
+		t.Errorf("renewal after the expiry did not store the lease again: %v", l.Expiration)
+	}
+}
+
+func TestRenewDelay(t *testing.T) {
+	for _, tc := range []struct {
+		left, min, max time.Duration
+	}{
+		// half way through the lifetime of a fresh lease
+		{24 * time.Hour, 11 * time.Hour, 12 * time.Hour},
+		// but at least renewMargin before its expiry
+		{90 * time.Minute, 29 * time.Minute, 30 * time.Minute},
+		{time.Second, -time.Hour, -59 * time.Minute},
+	} {
+		if d := renewDelay(time.Now().Add(tc.left)); d < tc.min || d > tc.max {
+			t.Errorf("lease expiring in %v renewed in %v, expected between %v and %v", tc.left, d, tc.min, tc.max)
+		}
+	}
+}
+
+func TestUpdateLeaseAttrs(t *testing.T) {
+	msr := newDummyRegistry(0)
+	sm := newEtcdManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attrs := LeaseAttrs{
+		PublicIP:    mustParseIP4("1.2.3.4"),
+		BackendType: "vxlan",
+	}
+
+	l, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm, "", events)
+
+	// skip over the initial snapshot
+	<-events
+
+	newAttrs := attrs
+	newAttrs.PublicIP = mustParseIP4("5.6.7.8")
+
+	nl, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &newAttrs)
+	if err != nil {
+		t.Fatal("UpdateLeaseAttrs failed: ", err)
+	}
+
+	if !nl.Subnet.Equal(l.Subnet) {
+		t.Errorf("UpdateLeaseAttrs changed the subnet: was %v, now %v", l.Subnet, nl.Subnet)
+	}
+
+	evtBatch := <-events
+
+	if len(evtBatch) != 1 {
+		t.Fatalf("WatchSubnets produced wrong sized event batch")
+	}
+
+	evt := evtBatch[0]
+
+	if evt.Type != SubnetAdded {
+		t.Fatalf("WatchSubnets produced wrong event type")
+	}
+
+	if !evt.Lease.Subnet.Equal(l.Subnet) {
+		t.Errorf("WatchSubnet produced wrong subnet: expected %v, got %v", l.Subnet, evt.Lease.Subnet)
+	}
+
+	if evt.Lease.Attrs.PublicIP != newAttrs.PublicIP {
+		t.Errorf("WatchSubnet produced wrong PublicIP: expected %v, got %v", newAttrs.PublicIP, evt.Lease.Attrs.PublicIP)
+	}
+}
+
+func TestUpdateLeaseAttrsMissing(t *testing.T) {
+	msr := newDummyRegistry(0)
+	sm := newEtcdManager(msr)
+
+	attrs := LeaseAttrs{
+		PublicIP: mustParseIP4("1.2.3.4"),
+	}
+
+	if _, err := sm.UpdateLeaseAttrs(context.Background(), "", newIP4Net("10.3.99.0", 24), &attrs); err == nil {
+		t.Error("UpdateLeaseAttrs of a non-existent lease succeeded")
+	}
+}
+
+func TestUpdateLeaseAttrsDuplicatePublicIP(t *testing.T) {
+	msr := newMockRegistry(1000, `{ "Network": "10.3.0.0/16" }`, nil)
+	sm := newEtcdManager(msr)
+	ctx := context.Background()
+
+	attrs1 := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), Hostname: "node1"}
+	if _, err := sm.AcquireLease(ctx, "", &attrs1); err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	attrs2 := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.5"), Hostname: "node2"}
+	l, err := sm.AcquireLease(ctx, "", &attrs2)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// updates keeping the PublicIP are fine
+	switched := attrs2
+	switched.BackendType = "vxlan"
+	if _, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &switched); err != nil {
+		t.Fatal("UpdateLeaseAttrs failed: ", err)
+	}
+
+	moved := switched
+	moved.PublicIP = attrs1.PublicIP
+	if _, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &moved); err != ErrDuplicatePublicIP {
+		t.Errorf("UpdateLeaseAttrs to a duplicate PublicIP: expected ErrDuplicatePublicIP, got %v", err)
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	sm := newEtcdManager(newDummyRegistry(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attrs := LeaseAttrs{
+		PublicIP:    mustParseIP4("1.2.3.4"),
+		BackendType: "vxlan",
+		Zone:        "zone-a",
+		Hostname:    "node-a",
+	}
+	l, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm, "", events)
+	<-events
+
+	labels, err := ParseLabels([]string{"zone=zone-b", "pool=batch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Relabel(ctx, sm, "", l.Subnet, labels); err != nil {
+		t.Fatal("Relabel failed: ", err)
+	}
+
+	var evt Event
+	select {
+	case batch := <-events:
+		if len(batch) != 1 {
+			t.Fatalf("expected one event, got %v", batch)
+		}
+		evt = batch[0]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after the relabel")
+	}
+
+	if evt.Type != SubnetAdded || !evt.Lease.Subnet.Equal(l.Subnet) {
+		t.Errorf("expected %v to be added again, got %v of %v", l.Subnet, evt.Type, evt.Lease.Subnet)
+	}
+	a := evt.Lease.Attrs
+	if a.Zone != "zone-b" || a.Pool != "batch" || a.Hostname != "node-a" || a.PublicIP != attrs.PublicIP {
+		t.Errorf("unexpected attrs after the relabel: %+v", a)
+	}
+
+	if _, err := ParseLabels([]string{"color=red"}); err == nil {
+		t.Error("ParseLabels accepted an unknown label")
+	}
+}
+
+// racingRegistry runs race once, before the first compareAndSwapSubnet
+type racingRegistry struct {
+	*mockSubnetRegistry
+	once sync.Once
+	race func()
+}
+
+func (r *racingRegistry) compareAndSwapSubnet(ctx context.Context, network, sn, data string, ttl uint64, prevIndex uint64) (*etcd.Response, error) {
+	r.once.Do(r.race)
+	return r.mockSubnetRegistry.compareAndSwapSubnet(ctx, network, sn, data, ttl, prevIndex)
+}
+
+func TestRelabelKeepsConcurrentChanges(t *testing.T) {
+	r := &racingRegistry{mockSubnetRegistry: newDummyRegistry(0)}
+	sm := newEtcdManager(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attrs := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), BackendType: "vxlan", Zone: "zone-a"}
+	l, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	// the node marks its lease ready while it is being relabeled
+	r.race = func() {
+		isReady := true
+		ready := attrs
+		ready.Ready = &isReady
+		value, err := json.Marshal(&ready)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.updateSubnet(ctx, "", l.Key(), string(value), 0)
+	}
+
+	labels, err := ParseLabels([]string{"zone=zone-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Relabel(ctx, sm, "", l.Subnet, labels); err != nil {
+		t.Fatal("Relabel failed: ", err)
+	}
+
+	got, err := sm.GetLease(ctx, "", l.Subnet)
+	if err != nil {
+		t.Fatal("GetLease failed: ", err)
+	}
+	if got.Attrs.Zone != "zone-b" || !got.Attrs.IsReady() || got.Attrs.Ready == nil {
+		t.Errorf("expected the new zone and the ready mark, got %+v", got.Attrs)
+	}
+}
+
+func TestParsePublicIPs(t *testing.T) {
+	ips, err := ParsePublicIPs("1.1.1.1:3, 2.2.2.2")
+	if err != nil {
+		t.Fatalf("ParsePublicIPs failed: %v", err)
+	}
+
+	expected := []WeightedIP{
+		{mustParseIP4("1.1.1.1"), 3},
+		{mustParseIP4("2.2.2.2"), 1},
+	}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("ParsePublicIPs returned %v, expected %v", ips, expected)
+	}
+
+	for _, s := range []string{"fe80::1", "1.1.1.1:0", "1.1.1.1:257", "1.1.1.1,1.1.1.1", "bogus"} {
+		if _, err := ParsePublicIPs(s); err == nil {
+			t.Errorf("ParsePublicIPs(%q) did not fail", s)
+		}
+	}
+}
+
+func TestNodeKeyedLeases(t *testing.T) {
+	msr := newDummyRegistry(0)
+	sm := &EtcdManager{registry: msr, keyFunc: NodeKey}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attrs := &LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), Hostname: "node-a"}
+	l, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	node := msr.subnets.Nodes[len(msr.subnets.Nodes)-1]
+	if node.Key != "node-a" {
+		t.Fatalf("Lease stored under %q, expected the hostname", node.Key)
+	}
+
+	// the subnet moves into the value but not into the attributes
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	found := false
+	for _, sl := range wr.Snapshot {
+		if sl.Subnet.Equal(l.Subnet) {
+			found = true
+			if sl.Attrs.Hostname != "node-a" || sl.Attrs.Unknown != nil {
+				t.Errorf("Lease has wrong attributes: %#v", sl.Attrs)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Lease of %v not in snapshot: %v", l.Subnet, wr.Snapshot)
+	}
+
+	// acquiring again finds and keeps the same key
+	if again, err := sm.AcquireLease(ctx, "", attrs); err != nil || !again.Subnet.Equal(l.Subnet) {
+		t.Fatalf("AcquireLease did not reuse %v: %v, %v", l.Subnet, again, err)
+	}
+	if n := len(msr.subnets.Nodes); n != 5 {
+		t.Errorf("Expected 5 leases, got %v", n)
+	}
+
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if _, err := sm.UpdateLeaseAttrs(ctx, "", l.Subnet, &LeaseAttrs{PublicIP: attrs.PublicIP, Hostname: "node-a", Zone: "z1"}); err != nil {
+		t.Fatal("UpdateLeaseAttrs failed: ", err)
+	}
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm, "", events)
+	<-events
+
+	if err := sm.RevokeLease(ctx, "", l.Subnet); err != nil {
+		t.Fatal("RevokeLease failed: ", err)
+	}
+
+	evts := <-events
+	if len(evts) != 1 || evts[0].Type != SubnetRemoved || !evts[0].Lease.Subnet.Equal(l.Subnet) {
+		t.Errorf("Revoking produced wrong events: %v", evts)
+	}
+	if _, err := msr.getSubnet(ctx, "", "node-a"); !isKeyNotFound(err) {
+		t.Errorf("Lease still stored after revoking it: %v", err)
+	}
+}
+
+func TestGetLease(t *testing.T) {
+	for _, keyFunc := range []KeyFunc{SubnetKey, NodeKey} {
+		sm := NewMockManagerWithKeys(0, `{"Network": "10.3.0.0/16"}`, keyFunc)
+		ctx := context.Background()
+
+		attrs := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4"), Hostname: "node-a"}
+		l, err := sm.AcquireLease(ctx, "", &attrs)
+		if err != nil {
+			t.Fatal("AcquireLease failed: ", err)
+		}
+
+		got, err := sm.GetLease(ctx, "", l.Subnet)
+		if err != nil {
+			t.Fatal("GetLease failed: ", err)
+		}
+		if !got.Subnet.Equal(l.Subnet) || got.Attrs.PublicIP != attrs.PublicIP || got.Attrs.Hostname != "node-a" {
+			t.Errorf("GetLease returned the wrong lease: %v %+v", got.Subnet, got.Attrs)
+		}
+
+		if _, err := sm.GetLease(ctx, "", newIP4Net("10.3.99.0", 24)); err != ErrLeaseNotFound {
+			t.Errorf("GetLease of a non-existent lease: expected ErrLeaseNotFound, got %v", err)
+		}
+	}
+}
+
+func TestParsePublicIP(t *testing.T) {
+	pip, err := ParsePublicIP("203.0.113.7")
+	if err != nil {
+		t.Fatalf("ParsePublicIP failed: %v", err)
+	}
+	if pip != mustParseIP4("203.0.113.7") {
+		t.Errorf("ParsePublicIP returned %v", pip)
+	}
+
+	for _, s := range []string{"", "nat.example.com", "::1", "0.0.0.0", "127.0.0.1", "169.254.1.1", "224.0.0.1", "255.255.255.255"} {
+		if _, err := ParsePublicIP(s); err == nil {
+			t.Errorf("ParsePublicIP accepted %q", s)
+		}
+	}
+}
+
+func TestLeaseEndpoint(t *testing.T) {
+	v6 := net.ParseIP("2001:db8::7")
+	dual := &LeaseAttrs{PublicIP: mustParseIP4("203.0.113.7"), PublicIPv6: v6}
+
+	if ep := dual.Endpoint(true); !ep.Equal(v6) {
+		t.Errorf("route of the IPv6 family uses %v, expected the IPv6 endpoint", ep)
+	}
+	if ep := dual.Endpoint(false); !ep.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("route of the IPv4 family uses %v, expected the IPv4 endpoint", ep)
+	}
+
+	v4only := &LeaseAttrs{PublicIP: mustParseIP4("203.0.113.7")}
+	if ep := v4only.Endpoint(true); ep != nil {
+		t.Errorf("node without PublicIPv6 has IPv6 endpoint %v", ep)
+	}
+
+	// survives encoding
+	data, err := json.Marshal(dual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &LeaseAttrs{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.PublicIPv6.Equal(v6) || decoded.Unknown != nil {
+		t.Errorf("PublicIPv6 did not survive encoding: %s", data)
+	}
+}
+
+func TestAcquireLeaseEndpoints(t *testing.T) {
+	ctx := context.Background()
+	sm := &EtcdManager{registry: newMockRegistry(1000, `{ "Network": "10.3.0.0/16" }`, nil), keyFunc: SubnetKey}
+
+	if _, err := sm.AcquireLease(ctx, "", &LeaseAttrs{}); err != ErrNoEndpoint {
+		t.Errorf("AcquireLease without endpoints: expected ErrNoEndpoint, got %v", err)
+	}
+	if _, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIPv6: net.ParseIP("1.2.3.4")}); err == nil {
+		t.Error("AcquireLease accepted an IPv4 PublicIPv6")
+	}
+
+	l, err := sm.AcquireLease(ctx, "", &LeaseAttrs{PublicIPv6: net.ParseIP("2001:db8::7")})
+	if err != nil {
+		t.Fatalf("AcquireLease with only an IPv6 endpoint failed: %v", err)
+	}
+	if !l.Attrs.Endpoint(true).Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("lease has IPv6 endpoint %v", l.Attrs.Endpoint(true))
+	}
+}
+
+func TestParsePublicIPv6(t *testing.T) {
+	pip, err := ParsePublicIPv6("2001:db8::7")
+	if err != nil {
+		t.Fatalf("ParsePublicIPv6 failed: %v", err)
+	}
+	if !pip.Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("ParsePublicIPv6 returned %v", pip)
+	}
+
+	for _, s := range []string{"203.0.113.7", "::", "::1", "fe80::1", "ff02::1", "bogus"} {
+		if _, err := ParsePublicIPv6(s); err == nil {
+			t.Errorf("ParsePublicIPv6 accepted %q", s)
+		}
+	}
+}
+
+func TestAcquireLeaseEpoch(t *testing.T) {
+	sm := newEtcdManager(newDummyRegistry(0))
+	ctx := context.Background()
+
+	attrs := LeaseAttrs{PublicIP: mustParseIP4("1.2.3.4")}
+	l1, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l1.Attrs.Epoch == 0 {
+		t.Fatal("lease acquired without an epoch")
+	}
+
+	// reacquiring bumps it
+	l2, err := sm.AcquireLease(ctx, "", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l2.Subnet.Equal(l1.Subnet) || l2.Attrs.Epoch <= l1.Attrs.Epoch {
+		t.Errorf("reacquired %v with epoch %v after %v with epoch %v", l2.Subnet, l2.Attrs.Epoch, l1.Subnet, l1.Attrs.Epoch)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	for _, l := range wr.Snapshot {
+		if l.Subnet.Equal(l2.Subnet) && l.Attrs.Epoch != l2.Attrs.Epoch {
+			t.Errorf("stored epoch %v differs from the acquired %v", l.Attrs.Epoch, l2.Attrs.Epoch)
+		}
+	}
+
+	// a subnet taken over by another node gets a higher epoch
+	if err := sm.RevokeLease(ctx, "", l2.Subnet); err != nil {
+		t.Fatal("RevokeLease failed: ", err)
+	}
+	other := LeaseAttrs{PublicIP: mustParseIP4("5.6.7.8")}
+	l3, err := sm.AcquireLease(ctx, "", &other)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l3.Attrs.Epoch <= l2.Attrs.Epoch {
+		t.Errorf("epoch %v of the new lease is not above %v", l3.Attrs.Epoch, l2.Attrs.Epoch)
+	}
 }
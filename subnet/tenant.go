@@ -0,0 +1,102 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// tenantsDir is where the networks of tenants are kept, under the prefix
+const tenantsDir = "_tenants"
+
+// ValidateTenant checks that tenant can scope network names: it must not
+// be empty nor contain '/' or whitespace
+func ValidateTenant(tenant string) error {
+	switch {
+	case tenant == "":
+		return fmt.Errorf("tenant must not be empty")
+	case strings.ContainsAny(tenant, "/ \t\n\r\v\f"):
+		return fmt.Errorf("tenant %q must not contain '/' or whitespace", tenant)
+	}
+	return nil
+}
+
+// TenantNetwork is the name network of tenant is stored under, e.g.
+// "_tenants/blue/default" for network "default" and "_tenants/blue" for
+// the unnamed one. Tenants can't contain '/', so the networks of two
+// tenants never share keys.
+func TenantNetwork(tenant, network string) string {
+	if network == "" {
+		return tenantsDir + "/" + tenant
+	}
+	return tenantsDir + "/" + tenant + "/" + network
+}
+
+// tenantManager scopes the networks of every call to a tenant
+type tenantManager struct {
+	sm     Manager
+	tenant string
+}
+
+// NewTenantManager returns a Manager for the networks of tenant in sm,
+// which reaches no other networks whatever the names asked for
+func NewTenantManager(sm Manager, tenant string) Manager {
+	return &tenantManager{sm: sm, tenant: tenant}
+}
+
+func (m *tenantManager) network(network string) string {
+	return TenantNetwork(m.tenant, network)
+}
+
+func (m *tenantManager) GetNetworkConfig(ctx context.Context, network string) (*Config, error) {
+	return m.sm.GetNetworkConfig(ctx, m.network(network))
+}
+
+func (m *tenantManager) GetNetworkStats(ctx context.Context, network string) (*NetworkStats, error) {
+	return m.sm.GetNetworkStats(ctx, m.network(network))
+}
+
+func (m *tenantManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
+	return m.sm.AcquireLease(ctx, m.network(network), attrs)
+}
+
+func (m *tenantManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	return m.sm.RenewLease(ctx, m.network(network), lease)
+}
+
+func (m *tenantManager) UpdateLeaseAttrs(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs) (*Lease, error) {
+	return m.sm.UpdateLeaseAttrs(ctx, m.network(network), sn, attrs)
+}
+
+func (m *tenantManager) GetLease(ctx context.Context, network string, sn ip.IP4Net) (*Lease, error) {
+	return m.sm.GetLease(ctx, m.network(network), sn)
+}
+
+func (m *tenantManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	return m.sm.RevokeLease(ctx, m.network(network), sn)
+}
+
+func (m *tenantManager) DrainLease(ctx context.Context, network string, sn ip.IP4Net, r *Reservation) error {
+	return m.sm.DrainLease(ctx, m.network(network), sn, r)
+}
+
+func (m *tenantManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (WatchResult, error) {
+	return m.sm.WatchLeases(ctx, m.network(network), cursor)
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares flannel versions (e.g. "0.5.0+git") by their
+// numeric components, ignoring any suffix. It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	av, bv := versionParts(a), versionParts(b)
+	for i := 0; i < len(av) || i < len(bv); i++ {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "+-"); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := []int{}
+	for _, s := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// clusterVersion returns the lowest version of the lease holders and the
+// features they all support. A holder not advertising its version (an
+// older agent) makes both unknown.
+func clusterVersion(leases []Lease) (string, []string) {
+	if len(leases) == 0 {
+		return "", nil
+	}
+
+	min := ""
+	common := map[string]bool{}
+	for i, l := range leases {
+		if l.Attrs == nil || l.Attrs.Version == "" {
+			return "", nil
+		}
+
+		if min == "" || CompareVersions(l.Attrs.Version, min) < 0 {
+			min = l.Attrs.Version
+		}
+
+		supported := map[string]bool{}
+		for _, f := range l.Attrs.Features {
+			supported[f] = i == 0 || common[f]
+		}
+		common = supported
+	}
+
+	features := []string{}
+	for f, ok := range common {
+		if ok {
+			features = append(features, f)
+		}
+	}
+	sort.Strings(features)
+	return min, features
+}
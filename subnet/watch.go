@@ -15,43 +15,144 @@
 package subnet
 
 import (
+	"bytes"
 	"time"
 
 	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/errlog"
+	"github.com/coreos/flannel/pkg/ip"
 )
 
+// backoff between attempts to re-establish a failed watch
+var (
+	watchRetryInitial = time.Second
+	watchRetryMax     = 30 * time.Second
+)
+
+// replaced in tests
+var watchRetryAfter = time.After
+
 // WatchLeases performs a long term watch of the given network's subnet leases
 // and communicates addition/deletion events on receiver channel. It takes care
 // of handling "fall-behind" logic where the history window has advanced too far
 // and it needs to diff the latest snapshot with its saved state and generate events
+//
+// A failed watch is retried with exponential backoff, picking up from the
+// last cursor so that no events are lost. Only when the cursor has expired
+// (ErrCursorExpired) does it fall back to a snapshot.
+//
+// If sm implements Coalescer, events are buffered for its window and
+// delivered as a single batch with the net effect. If it implements
+// Bufferer, events are queued for a slow receiver as configured.
 func WatchLeases(ctx context.Context, sm Manager, network string, receiver chan []Event) {
+	watchLeases(ctx, sm, network, receiver, false, nil)
+}
+
+// WatchLeasesMarked is WatchLeases ending the batch of the leases that
+// exist when the watch starts with a SnapshotDone event. It is sent once,
+// later resyncs only bring the changes.
+func WatchLeasesMarked(ctx context.Context, sm Manager, network string, receiver chan []Event) {
+	watchLeases(ctx, sm, network, receiver, true, nil)
+}
+
+// SplitSnapshotDone returns batch without the SnapshotDone event that
+// ends it, if any, and whether it did
+func SplitSnapshotDone(batch []Event) ([]Event, bool) {
+	if n := len(batch); n > 0 && batch[n-1].Type == SnapshotDone {
+		return batch[:n-1], true
+	}
+	return batch, false
+}
+
+// watchLeases is WatchLeases, telling stalled (if set) whether each
+// result was marked Stalled before passing it on
+func watchLeases(ctx context.Context, sm Manager, network string, receiver chan []Event, mark bool, stalled func(bool)) {
+	if b, ok := sm.(Bufferer); ok {
+		if size, policy := b.WatchBuffer(); size > 0 {
+			snapshot := func(ctx context.Context) ([]Lease, error) {
+				res, err := sm.WatchLeases(ctx, network, nil)
+				return res.Snapshot, err
+			}
+			buffered := make(chan []Event)
+			go bufferEvents(ctx, buffered, receiver, size, policy, snapshot)
+			receiver = buffered
+		}
+	}
+
+	if c, ok := sm.(Coalescer); ok && c.CoalesceWindow() > 0 {
+		batches := make(chan []Event)
+		go coalesceEvents(ctx, batches, receiver, c.CoalesceWindow())
+		receiver = batches
+	}
+
 	lw := &leaseWatcher{}
 	var cursor interface{}
+	delay := watchRetryInitial
+	marked := !mark
+	errs := errlog.NewLimiter(errlog.DefaultInterval)
 
 	for {
 		res, err := sm.WatchLeases(ctx, network, cursor)
-		if err != nil {
-			if err == context.Canceled || err == context.DeadlineExceeded {
+		switch {
+		case err == nil:
+
+		case err == context.Canceled || err == context.DeadlineExceeded:
+			return
+
+		case err == ErrCursorExpired:
+			log.Warningf("Watch of subnet leases fell behind the history window, resyncing")
+			cursor = nil
+			continue
+
+		default:
+			errs.Errorf("watch", "Watch subnets (retrying): %v", err)
+
+			select {
+			case <-watchRetryAfter(delay):
+			case <-ctx.Done():
 				return
 			}
 
-			log.Errorf("Watch subnets: %v", err)
-			time.Sleep(time.Second)
+			if delay *= 2; delay > watchRetryMax {
+				delay = watchRetryMax
+			}
 			continue
 		}
 		cursor = res.Cursor
+		delay = watchRetryInitial
+		errs.Clear("watch")
+		if res.Stalled {
+			errs.Warningf("stalled", "Server can't reach etcd, the leases of network %q may be out of date", network)
+		} else {
+			errs.Clear("stalled")
+		}
+		if stalled != nil {
+			stalled(res.Stalled)
+		}
 
 		batch := []Event{}
 
-		if len(res.Snapshot) > 0 {
+		// an empty (but non-nil) snapshot means all leases are gone
+		if res.Snapshot != nil {
 			batch = lw.reset(res.Snapshot)
 		} else {
 			batch = lw.update(res.Events)
 		}
 
+		// the first result is the snapshot, even if an empty
+		// one comes as nil
+		if !marked {
+			batch = append(batch, Event{Type: SnapshotDone})
+			marked = true
+		}
+
 		if batch != nil {
-			receiver <- batch
+			select {
+			case receiver <- batch:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -69,19 +170,24 @@ func (lw *leaseWatcher) reset(leases []Lease) []Event {
 			if ol.Subnet.Equal(nl.Subnet) {
 				lw.leases = deleteLease(lw.leases, i)
 				found = true
+
+				if attrsChanged(ol.Attrs, nl.Attrs) {
+					// lease was updated in place (e.g. new PublicIP)
+					batch = append(batch, Event{Type: SubnetAdded, Lease: nl})
+				}
 				break
 			}
 		}
 
 		if !found {
 			// new lease
-			batch = append(batch, Event{SubnetAdded, nl})
+			batch = append(batch, Event{Type: SubnetAdded, Lease: nl})
 		}
 	}
 
 	// everything left in sm.leases has been deleted
 	for _, l := range lw.leases {
-		batch = append(batch, Event{SubnetRemoved, l})
+		batch = append(batch, Event{Type: SubnetRemoved, Lease: l})
 	}
 
 	lw.leases = leases
@@ -98,7 +204,7 @@ func (lw *leaseWatcher) update(events []Event) []Event {
 			batch = append(batch, lw.add(&e.Lease))
 
 		case SubnetRemoved:
-			batch = append(batch, lw.remove(&e.Lease))
+			batch = append(batch, lw.remove(&e.Lease, e.Reason))
 		}
 	}
 
@@ -109,24 +215,40 @@ func (lw *leaseWatcher) add(lease *Lease) Event {
 	for i, l := range lw.leases {
 		if l.Subnet.Equal(lease.Subnet) {
 			lw.leases[i] = *lease
-			return Event{SubnetAdded, lw.leases[i]}
+			return Event{Type: SubnetAdded, Lease: lw.leases[i]}
 		}
 	}
 
 	lw.leases = append(lw.leases, *lease)
-	return Event{SubnetAdded, lw.leases[len(lw.leases)-1]}
+	return Event{Type: SubnetAdded, Lease: lw.leases[len(lw.leases)-1]}
 }
 
-func (lw *leaseWatcher) remove(lease *Lease) Event {
+func (lw *leaseWatcher) remove(lease *Lease, reason EventReason) Event {
 	for i, l := range lw.leases {
 		if l.Subnet.Equal(lease.Subnet) {
 			lw.leases = deleteLease(lw.leases, i)
-			return Event{SubnetRemoved, l}
+			return Event{Type: SubnetRemoved, Lease: l, Reason: reason}
 		}
 	}
 
 	log.Errorf("Removed subnet (%s) was not found", lease.Subnet)
-	return Event{SubnetRemoved, *lease}
+	return Event{Type: SubnetRemoved, Lease: *lease, Reason: reason}
+}
+
+func (lw *leaseWatcher) has(sn ip.IP4Net) bool {
+	for _, l := range lw.leases {
+		if l.Subnet.Equal(sn) {
+			return true
+		}
+	}
+	return false
+}
+
+func attrsChanged(x, y *LeaseAttrs) bool {
+	if x == nil || y == nil {
+		return x != y
+	}
+	return x.PublicIP != y.PublicIP || x.BackendType != y.BackendType || !bytes.Equal(x.BackendData, y.BackendData)
 }
 
 func deleteLease(l []Lease, i int) []Lease {
@@ -0,0 +1,356 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// flakyWatchRegistry keeps a history of subnet changes and serves watches
+// from it like etcd does. Watches can be made to fail (as when etcd goes
+// away) and the history can be compacted.
+type flakyWatchRegistry struct {
+	*mockSubnetRegistry
+
+	mu        sync.Mutex
+	history   []*etcd.Response
+	changed   chan struct{}
+	drops     int
+	compacted uint64
+	watches   []uint64
+	snapshots int
+}
+
+func newFlakyWatchRegistry() *flakyWatchRegistry {
+	return &flakyWatchRegistry{
+		mockSubnetRegistry: newDummyRegistry(0),
+		changed:            make(chan struct{}),
+	}
+}
+
+func (r *flakyWatchRegistry) getSubnets(ctx context.Context, network string) (*etcd.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.snapshots++
+	return r.mockSubnetRegistry.getSubnets(ctx, network)
+}
+
+func (r *flakyWatchRegistry) watchSubnets(ctx context.Context, network string, since uint64) (*etcd.Response, error) {
+	r.mu.Lock()
+	r.watches = append(r.watches, since)
+
+	for {
+		if r.drops > 0 {
+			r.drops--
+			r.mu.Unlock()
+			return nil, errors.New("connection reset by peer")
+		}
+
+		if since < r.compacted {
+			r.mu.Unlock()
+			return nil, &etcd.EtcdError{ErrorCode: etcdEventIndexCleared}
+		}
+
+		for _, resp := range r.history {
+			if resp.Node.ModifiedIndex >= since {
+				r.mu.Unlock()
+				return resp, nil
+			}
+		}
+
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		r.mu.Lock()
+	}
+}
+
+// record runs f, which changes subnets, under the lock and moves the
+// resulting events into the history
+func (r *flakyWatchRegistry) record(f func(*mockSubnetRegistry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f(r.mockSubnetRegistry)
+	for len(r.events) > 0 {
+		// the mock reuses nodes across changes, keep a copy
+		resp := *<-r.events
+		node := *resp.Node
+		resp.Node = &node
+		r.history = append(r.history, &resp)
+	}
+	r.wake()
+}
+
+// setDrops makes the next n watches fail, starting with any in progress
+func (r *flakyWatchRegistry) setDrops(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drops = n
+	r.wake()
+}
+
+func (r *flakyWatchRegistry) wake() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// compact drops all history recorded so far
+func (r *flakyWatchRegistry) compact() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compacted = r.index + 1
+	r.history = nil
+}
+
+func (r *flakyWatchRegistry) stats() ([]uint64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]uint64{}, r.watches...), r.snapshots
+}
+
+type retryRecorder struct {
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (rr *retryRecorder) after(d time.Duration) <-chan time.Time {
+	rr.mu.Lock()
+	rr.delays = append(rr.delays, d)
+	rr.mu.Unlock()
+	return time.After(time.Millisecond)
+}
+
+func (rr *retryRecorder) get() []time.Duration {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return append([]time.Duration{}, rr.delays...)
+}
+
+func withRecordedRetries() (*retryRecorder, func()) {
+	initial, max, after := watchRetryInitial, watchRetryMax, watchRetryAfter
+	rr := &retryRecorder{}
+	watchRetryInitial, watchRetryMax, watchRetryAfter = 10*time.Millisecond, 40*time.Millisecond, rr.after
+	return rr, func() {
+		watchRetryInitial, watchRetryMax, watchRetryAfter = initial, max, after
+	}
+}
+
+func nextBatch(t *testing.T, events chan []Event) []Event {
+	select {
+	case batch := <-events:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for watch events")
+		return nil
+	}
+}
+
+func TestWatchLeasesReconnect(t *testing.T) {
+	rr, restore := withRecordedRetries()
+	defer restore()
+
+	r := newFlakyWatchRegistry()
+	sm := newEtcdManager(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm, "", events)
+
+	// skip over the initial snapshot
+	nextBatch(t, events)
+
+	r.setDrops(5)
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.createSubnet(ctx, "", "10.3.3.0-24", `{"PublicIP": "1.1.1.1"}`, 0)
+	})
+
+	batch := nextBatch(t, events)
+	if len(batch) != 1 || batch[0].Type != SubnetAdded || batch[0].Lease.Key() != "10.3.3.0-24" {
+		t.Fatalf("Watch produced wrong events after reconnecting: %v", batch)
+	}
+
+	expected := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+	}
+	if delays := rr.get(); !reflect.DeepEqual(delays, expected) {
+		t.Errorf("Watch retried after %v, expected %v", delays, expected)
+	}
+
+	// the watch has to resume where it left off
+	watches, snapshots := r.stats()
+	if snapshots != 1 {
+		t.Errorf("Watch took %v snapshots, expected just the initial one", snapshots)
+	}
+	for _, since := range watches[:len(expected)+1] {
+		if since != watches[0] {
+			t.Errorf("Watch did not resume from the same index: %v", watches)
+			break
+		}
+	}
+
+	// a successful watch resets the backoff
+	r.setDrops(1)
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.expireSubnet("10.3.3.0-24")
+	})
+
+	batch = nextBatch(t, events)
+	if len(batch) != 1 || batch[0].Type != SubnetRemoved || batch[0].Lease.Key() != "10.3.3.0-24" {
+		t.Fatalf("Watch produced wrong events after reconnecting: %v", batch)
+	}
+	if delays := rr.get(); delays[len(delays)-1] != 10*time.Millisecond {
+		t.Errorf("Watch did not reset its backoff: %v", delays)
+	}
+}
+
+func TestWatchLeasesCursorExpired(t *testing.T) {
+	rr, restore := withRecordedRetries()
+	defer restore()
+
+	r := newFlakyWatchRegistry()
+	sm := newEtcdManager(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.createSubnet(ctx, "", "10.3.3.0-24", `{"PublicIP": "1.1.1.1"}`, 0)
+	})
+	r.compact()
+
+	if _, err := sm.WatchLeases(ctx, "", wr.Cursor); err != ErrCursorExpired {
+		t.Fatalf("WatchLeases with a compacted cursor returned %v, expected ErrCursorExpired", err)
+	}
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm, "", events)
+	nextBatch(t, events)
+
+	// the watcher's cursor is compacted away while it is disconnected
+	r.setDrops(1)
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.expireSubnet("10.3.1.0-24")
+	})
+	r.compact()
+
+	batch := nextBatch(t, events)
+	if len(batch) != 1 || batch[0].Type != SubnetRemoved || batch[0].Lease.Key() != "10.3.1.0-24" {
+		t.Fatalf("Resync produced wrong events: %v", batch)
+	}
+
+	if _, snapshots := r.stats(); snapshots != 3 {
+		t.Errorf("Expected a resync snapshot, got %v snapshots in total", snapshots)
+	}
+	if delays := rr.get(); len(delays) != 1 {
+		t.Errorf("Resync should not be delayed, backed off %v", delays)
+	}
+}
+
+func countSnapshotDone(batch []Event) int {
+	n := 0
+	for _, e := range batch {
+		if e.Type == SnapshotDone {
+			n++
+		}
+	}
+	return n
+}
+
+// coalescingManager makes watchers buffer events for window
+type coalescingManager struct {
+	Manager
+	window time.Duration
+}
+
+func (m *coalescingManager) CoalesceWindow() time.Duration {
+	return m.window
+}
+
+func TestWatchLeasesMarked(t *testing.T) {
+	_, restore := withRecordedRetries()
+	defer restore()
+
+	for _, coalesce := range []bool{false, true} {
+		r := newFlakyWatchRegistry()
+		var sm Manager = newEtcdManager(r)
+		if coalesce {
+			sm = &coalescingManager{sm, 10 * time.Millisecond}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		events := make(chan []Event)
+		go WatchLeasesMarked(ctx, sm, "", events)
+
+		batch := nextBatch(t, events)
+		leases, done := SplitSnapshotDone(batch)
+		if !done || countSnapshotDone(leases) != 0 {
+			t.Fatalf("coalesce=%v: expected the snapshot to end with a single marker, got %v", coalesce, batch)
+		}
+		if len(leases) != len(r.subnets.Nodes) {
+			t.Errorf("coalesce=%v: expected the %v initial leases before the marker, got %v", coalesce, len(r.subnets.Nodes), leases)
+		}
+
+		// a resync snapshot brings no second marker
+		r.setDrops(1)
+		r.record(func(msr *mockSubnetRegistry) {
+			msr.expireSubnet("10.3.1.0-24")
+		})
+		r.compact()
+
+		batch = nextBatch(t, events)
+		if countSnapshotDone(batch) != 0 || len(batch) != 1 || batch[0].Type != SubnetRemoved {
+			t.Errorf("coalesce=%v: expected only the removal after the resync, got %v", coalesce, batch)
+		}
+		cancel()
+	}
+
+	// unmarked watches are unchanged
+	r := newFlakyWatchRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, newEtcdManager(r), "", events)
+	if batch := nextBatch(t, events); countSnapshotDone(batch) != 0 {
+		t.Errorf("WatchLeases sent a marker: %v", batch)
+	}
+}
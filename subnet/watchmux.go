@@ -0,0 +1,343 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+var (
+	// number of event batches kept for subscribers to catch up on,
+	// one that falls further behind gets ErrCursorExpired
+	watchMuxBacklog = 1000
+	// how long the upstream watch of a network outlives its last
+	// subscriber
+	watchMuxLinger = time.Minute
+)
+
+// WatchMux is a Manager that serves all WatchLeases calls for a network
+// from a single upstream watch of the wrapped Manager. Subscribers pull at
+// their own pace: a slow one does not hold up the others, it eventually
+// gets ErrCursorExpired and starts over with the current snapshot.
+// The event log is compacted as it grows, so one catching up is served
+// the net effect of what it missed rather than every event in between.
+// Reconnecting the upstream watch is taken care of by subnet.WatchLeases
+// and is invisible to subscribers. Once ctx is done, snapshots are taken
+// from the wrapped Manager directly.
+type WatchMux struct {
+	Manager
+
+	ctx     context.Context
+	mux     sync.Mutex
+	watches map[string]*muxedWatch
+	gen     uint64
+}
+
+func NewWatchMux(ctx context.Context, sm Manager) *WatchMux {
+	return &WatchMux{
+		Manager: sm,
+		ctx:     ctx,
+		watches: make(map[string]*muxedWatch),
+	}
+}
+
+// muxCursor is where a subscriber is in the event log of a muxedWatch
+type muxCursor struct {
+	gen uint64
+	seq uint64
+}
+
+func (c muxCursor) String() string {
+	return fmt.Sprintf("%v.%v", c.gen, c.seq)
+}
+
+func parseMuxCursor(cursor interface{}) (muxCursor, error) {
+	switch c := cursor.(type) {
+	case muxCursor:
+		return c, nil
+	case string:
+		mc := muxCursor{}
+		if _, err := fmt.Sscanf(c, "%d.%d", &mc.gen, &mc.seq); err != nil {
+			return mc, fmt.Errorf("failed to parse cursor: %v", err)
+		}
+		return mc, nil
+	default:
+		return muxCursor{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+}
+
+type muxedWatch struct {
+	gen    uint64
+	cancel context.CancelFunc
+
+	// the fields below are guarded by WatchMux.mux
+	subscribers int
+	linger      *time.Timer
+	ready       bool
+	leases      leaseWatcher
+	// log[i] is the batch of sequence number first+i
+	log     [][]Event
+	first   uint64
+	changed chan struct{}
+	// latest[sn] is the sequence number of the batch holding the
+	// (only remaining) event of sn, born[sn] that of the batch it
+	// appeared in if it was not around before
+	latest map[ip.IP4Net]uint64
+	born   map[ip.IP4Net]uint64
+	// whether the upstream server can't reach etcd, and how many
+	// results it marked so
+	stalled bool
+	stalls  uint64
+}
+
+func (w *muxedWatch) next() uint64 {
+	return w.first + uint64(len(w.log))
+}
+
+// appendCompacted appends batch to the log, dropping the events it
+// supersedes: earlier ones for the same subnets, in the log or in batch
+// itself. A cursor that would have been served a dropped event is also
+// served the one that superseded it, so the final state of every subnet
+// is preserved for all subscribers. It has to be called before the
+// batch is applied to w.leases.
+func (w *muxedWatch) appendCompacted(batch []Event) {
+	seq := w.next()
+
+	last := make(map[ip.IP4Net]int)
+	for i, e := range batch {
+		last[e.Lease.Subnet] = i
+	}
+
+	compacted := make([]Event, 0, len(last))
+	for i, e := range batch {
+		sn := e.Lease.Subnet
+		if last[sn] != i {
+			continue
+		}
+		if s, ok := w.latest[sn]; ok {
+			w.log[s-w.first] = withoutSubnet(w.log[s-w.first], sn)
+		} else {
+			delete(w.born, sn)
+			if !w.leases.has(sn) {
+				w.born[sn] = seq
+			}
+		}
+		w.latest[sn] = seq
+		compacted = append(compacted, e)
+	}
+	w.log = append(w.log, compacted)
+
+	if excess := len(w.log) - watchMuxBacklog; excess > 0 {
+		for _, b := range w.log[:excess] {
+			for _, e := range b {
+				delete(w.latest, e.Lease.Subnet)
+				delete(w.born, e.Lease.Subnet)
+			}
+		}
+		w.log = w.log[excess:]
+		w.first += uint64(excess)
+	}
+}
+
+// since returns the events of the log from seq on, leaving out removals
+// of subnets that appeared after it
+func (w *muxedWatch) since(seq uint64) []Event {
+	events := []Event{}
+	for _, batch := range w.log[seq-w.first:] {
+		for _, e := range batch {
+			if b, ok := w.born[e.Lease.Subnet]; ok && e.Type == SubnetRemoved && seq <= b {
+				continue
+			}
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// withoutSubnet returns a copy of batch without the event of sn
+func withoutSubnet(batch []Event, sn ip.IP4Net) []Event {
+	out := make([]Event, 0, len(batch))
+	for _, e := range batch {
+		if e.Lease.Subnet != sn {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// subscribe returns the watch of network, starting it if need be
+func (m *WatchMux) subscribe(network string) *muxedWatch {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	w, ok := m.watches[network]
+	if !ok {
+		m.gen++
+		ctx, cancel := context.WithCancel(m.ctx)
+		w = &muxedWatch{
+			gen:     m.gen,
+			cancel:  cancel,
+			changed: make(chan struct{}),
+			latest:  make(map[ip.IP4Net]uint64),
+			born:    make(map[ip.IP4Net]uint64),
+		}
+		m.watches[network] = w
+		go m.run(ctx, network, w)
+	}
+
+	if w.linger != nil {
+		w.linger.Stop()
+		w.linger = nil
+	}
+	w.subscribers++
+	return w
+}
+
+func (m *WatchMux) unsubscribe(network string, w *muxedWatch) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if w.subscribers--; w.subscribers > 0 {
+		return
+	}
+
+	w.linger = time.AfterFunc(watchMuxLinger, func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+
+		if w.subscribers == 0 && m.watches[network] == w {
+			delete(m.watches, network)
+			w.cancel()
+		}
+	})
+}
+
+// setStalled records whether the upstream server of w can reach etcd,
+// waking the subscribers with each result it marked Stalled
+func (m *WatchMux) setStalled(w *muxedWatch, stalled bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if w.stalled == stalled && !stalled {
+		return
+	}
+	w.stalled = stalled
+	if stalled {
+		w.stalls++
+	}
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// run feeds the events of the upstream watch into the log of w
+func (m *WatchMux) run(ctx context.Context, network string, w *muxedWatch) {
+	batches := make(chan []Event)
+	go watchLeases(ctx, m.Manager, network, batches, false, func(stalled bool) { m.setStalled(w, stalled) })
+
+	for {
+		select {
+		case batch := <-batches:
+			m.mux.Lock()
+			if len(batch) > 0 {
+				w.appendCompacted(batch)
+			}
+			w.leases.update(batch)
+			w.ready = true
+			close(w.changed)
+			w.changed = make(chan struct{})
+			m.mux.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *WatchMux) WatchLeases(ctx context.Context, network string, cursor interface{}) (WatchResult, error) {
+	if m.ctx.Err() != nil {
+		// no more upstream watches, but snapshots are still
+		// needed on the way out (e.g. to drain leases)
+		if cursor == nil {
+			return m.Manager.WatchLeases(ctx, network, nil)
+		}
+		return WatchResult{}, m.ctx.Err()
+	}
+
+	var c muxCursor
+	if cursor != nil {
+		var err error
+		if c, err = parseMuxCursor(cursor); err != nil {
+			return WatchResult{}, err
+		}
+	}
+
+	w := m.subscribe(network)
+	defer m.unsubscribe(network, w)
+
+	m.mux.Lock()
+	stalls := w.stalls
+	for {
+		switch {
+		case !w.ready:
+
+		case cursor == nil:
+			snapshot := append([]Lease{}, w.leases.leases...)
+			next := w.next()
+			stalled := w.stalled
+			m.mux.Unlock()
+			return WatchResult{Snapshot: snapshot, Cursor: muxCursor{w.gen, next}, Stalled: stalled}, nil
+
+		case c.gen != w.gen || c.seq < w.first || c.seq > w.next():
+			m.mux.Unlock()
+			log.Warningf("Lease watch subscriber of network %q fell behind, it has to resync", network)
+			return WatchResult{}, ErrCursorExpired
+
+		case c.seq < w.next():
+			events := w.since(c.seq)
+			next := w.next()
+			if len(events) > 0 {
+				stalled := w.stalled
+				m.mux.Unlock()
+				return WatchResult{Events: events, Cursor: muxCursor{w.gen, next}, Stalled: stalled}, nil
+			}
+			// all it missed came and went, nothing to tell
+			c.seq = next
+		}
+
+		if w.ready && w.stalled && w.stalls != stalls {
+			// as the upstream server does, tell a waiting
+			// subscriber right away that it may be out of date
+			m.mux.Unlock()
+			return WatchResult{Events: []Event{}, Cursor: c, Stalled: true}, nil
+		}
+
+		changed := w.changed
+		m.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return WatchResult{}, ctx.Err()
+		}
+
+		m.mux.Lock()
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// countingManager counts the watches started (from a snapshot) on it
+type countingManager struct {
+	Manager
+
+	mu        sync.Mutex
+	snapshots int
+}
+
+func (m *countingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (WatchResult, error) {
+	if cursor == nil {
+		m.mu.Lock()
+		m.snapshots++
+		m.mu.Unlock()
+	}
+	return m.Manager.WatchLeases(ctx, network, cursor)
+}
+
+func (m *countingManager) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshots
+}
+
+func TestWatchMuxFanOut(t *testing.T) {
+	_, restore := withRecordedRetries()
+	defer restore()
+
+	r := newFlakyWatchRegistry()
+	upstream := &countingManager{Manager: newEtcdManager(r)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := NewWatchMux(ctx, upstream)
+
+	subscribers := make([]chan []Event, 3)
+	for i := range subscribers {
+		subscribers[i] = make(chan []Event)
+		go WatchLeases(ctx, sm, "", subscribers[i])
+	}
+
+	// one that never reads must not hold up the others
+	go WatchLeases(ctx, sm, "", make(chan []Event))
+
+	for _, events := range subscribers {
+		if batch := nextBatch(t, events); len(batch) != 4 {
+			t.Errorf("Initial snapshot has %v leases, expected 4", len(batch))
+		}
+	}
+
+	// each change is read by all before the next so that
+	// none of them is served a compacted delta
+	changes := []func(){
+		func() {
+			r.record(func(msr *mockSubnetRegistry) {
+				msr.createSubnet(ctx, "", "10.3.3.0-24", `{"PublicIP": "1.1.1.1"}`, 0)
+			})
+		},
+		func() {
+			r.record(func(msr *mockSubnetRegistry) {
+				msr.expireSubnet("10.3.1.0-24")
+			})
+		},
+		func() {
+			// the upstream watch reconnects without the subscribers noticing
+			r.setDrops(2)
+			r.record(func(msr *mockSubnetRegistry) {
+				msr.expireSubnet("10.3.3.0-24")
+			})
+		},
+	}
+
+	expected := []EventType{SubnetAdded, SubnetRemoved, SubnetRemoved}
+	types := make([][]EventType, len(subscribers))
+	streams := make([][]string, len(subscribers))
+	for _, change := range changes {
+		change()
+		for i, events := range subscribers {
+			for _, e := range nextBatch(t, events) {
+				types[i] = append(types[i], e.Type)
+				streams[i] = append(streams[i], e.Lease.Key())
+			}
+		}
+	}
+	for i := range subscribers {
+		if !reflect.DeepEqual(types[i], expected) {
+			t.Errorf("Subscriber %v got events %v, expected %v", i, types[i], expected)
+		}
+	}
+
+	for i := range streams[1:] {
+		if !reflect.DeepEqual(streams[i+1], streams[0]) {
+			t.Errorf("Subscriber %v got %v, subscriber 0 got %v", i+1, streams[i+1], streams[0])
+		}
+	}
+
+	if n := upstream.count(); n != 1 {
+		t.Errorf("%v upstream watches were started, expected 1", n)
+	}
+}
+
+func TestWatchMuxResync(t *testing.T) {
+	backlog := watchMuxBacklog
+	watchMuxBacklog = 2
+	defer func() { watchMuxBacklog = backlog }()
+
+	r := newFlakyWatchRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := NewWatchMux(ctx, newEtcdManager(r))
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	// fall further behind than the backlog
+	for _, sn := range []string{"10.3.1.0-24", "10.3.2.0-24", "10.3.4.0-24"} {
+		r.record(func(msr *mockSubnetRegistry) {
+			msr.expireSubnet(sn)
+		})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = sm.WatchLeases(ctx, "", wr.Cursor)
+		if err == ErrCursorExpired || time.Now().After(deadline) {
+			break
+		}
+		// events may still be on their way to the mux
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != ErrCursorExpired {
+		t.Fatalf("WatchLeases with a cursor past the backlog returned %v, expected ErrCursorExpired", err)
+	}
+
+	wr, err = sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Snapshot) != 1 || wr.Snapshot[0].Key() != "10.3.5.0-24" {
+		t.Errorf("Resync snapshot is %v, expected just 10.3.5.0-24", wr.Snapshot)
+	}
+}
+
+// waitForLog waits for n batches past cursor to reach the log
+func waitForLog(t *testing.T, sm *WatchMux, cursor interface{}, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sm.mux.Lock()
+		logged := sm.watches[""].next() - cursor.(muxCursor).seq
+		sm.mux.Unlock()
+		if logged == uint64(n) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v of %v changes reached the log", logged, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchMuxCompaction(t *testing.T) {
+	r := newFlakyWatchRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := NewWatchMux(ctx, newEtcdManager(r))
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	// it misses all of these
+	changes := 0
+	for i := 0; i < 20; i++ {
+		r.record(func(msr *mockSubnetRegistry) {
+			msr.createSubnet(ctx, "", "10.3.3.0-24", `{"PublicIP": "1.1.1.1"}`, 0)
+		})
+		r.record(func(msr *mockSubnetRegistry) {
+			msr.expireSubnet("10.3.3.0-24")
+		})
+		changes += 2
+	}
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.expireSubnet("10.3.1.0-24")
+	})
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.createSubnet(ctx, "", "10.3.3.0-24", `{"PublicIP": "1.1.1.2"}`, 0)
+	})
+	changes += 2
+
+	waitForLog(t, sm, wr.Cursor, changes)
+
+	wr, err = sm.WatchLeases(ctx, "", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	if len(wr.Events) != 2 {
+		t.Fatalf("Expected the compacted delta of 2 events, got %v", wr.Events)
+	}
+	if e := wr.Events[0]; e.Type != SubnetRemoved || e.Lease.Key() != "10.3.1.0-24" {
+		t.Errorf("Expected 10.3.1.0-24 to be removed, got %v", e)
+	}
+	e := wr.Events[1]
+	if e.Type != SubnetAdded || e.Lease.Key() != "10.3.3.0-24" {
+		t.Errorf("Expected 10.3.3.0-24 to be added, got %v", e)
+	}
+	if e.Lease.Attrs == nil || e.Lease.Attrs.PublicIP.String() != "1.1.1.2" {
+		t.Errorf("Expected the last lease of 10.3.3.0-24, got %v", e.Lease.Attrs)
+	}
+}
+
+func TestWatchMuxCompactionHidesTransients(t *testing.T) {
+	r := newFlakyWatchRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := NewWatchMux(ctx, newEtcdManager(r))
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		r.record(func(msr *mockSubnetRegistry) {
+			msr.createSubnet(ctx, "", "10.3.3.0-24", `{"PublicIP": "1.1.1.1"}`, 0)
+		})
+		r.record(func(msr *mockSubnetRegistry) {
+			msr.expireSubnet("10.3.3.0-24")
+		})
+	}
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.expireSubnet("10.3.1.0-24")
+	})
+
+	waitForLog(t, sm, wr.Cursor, 11)
+
+	// 10.3.3.0/24 came and went, its removal is of no interest
+	wr, err = sm.WatchLeases(ctx, "", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Lease.Key() != "10.3.1.0-24" {
+		t.Errorf("Expected just the removal of 10.3.1.0-24, got %v", wr.Events)
+	}
+}
+
+// stallingManager serves stalled results, as a server out of touch with
+// etcd does, while stalled is set
+type stallingManager struct {
+	Manager
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func (m *stallingManager) setStalled(stalled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stalled = stalled
+}
+
+func (m *stallingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (WatchResult, error) {
+	m.mu.Lock()
+	stalled := m.stalled
+	m.mu.Unlock()
+	if !stalled || cursor == nil {
+		return m.Manager.WatchLeases(ctx, network, cursor)
+	}
+
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+		return WatchResult{}, ctx.Err()
+	}
+	return WatchResult{Cursor: cursor, Stalled: true}, nil
+}
+
+func TestWatchMuxStalled(t *testing.T) {
+	r := newFlakyWatchRegistry()
+	upstream := &stallingManager{Manager: newEtcdManager(r)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := NewWatchMux(ctx, upstream)
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if wr.Stalled {
+		t.Errorf("Snapshot is stalled before the upstream watch is")
+	}
+
+	// the upstream watch stalls once this change wakes it
+	upstream.setStalled(true)
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.expireSubnet("10.3.2.0-24")
+	})
+
+	wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer wcancel()
+	res, err := sm.WatchLeases(wctx, "", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if res.Stalled || len(res.Events) != 1 {
+		t.Fatalf("Expected the change before the stall, got %+v", res)
+	}
+	wr = res
+
+	if res, err = sm.WatchLeases(wctx, "", wr.Cursor); err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if !res.Stalled || len(res.Events) != 0 {
+		t.Errorf("Expected a stalled result without events, got %+v", res)
+	}
+
+	if res, err = sm.WatchLeases(ctx, "", nil); err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if !res.Stalled {
+		t.Errorf("Snapshot of a stalled upstream watch is not stalled")
+	}
+
+	upstream.setStalled(false)
+	r.record(func(msr *mockSubnetRegistry) {
+		msr.expireSubnet("10.3.1.0-24")
+	})
+
+	// the stalled results still on their way come first
+	cursor := wr.Cursor
+	for {
+		if res, err = sm.WatchLeases(wctx, "", cursor); err != nil {
+			t.Fatalf("WatchLeases failed: %v", err)
+		}
+		if len(res.Events) > 0 {
+			break
+		}
+		cursor = res.Cursor
+	}
+	if res.Stalled {
+		t.Errorf("Events after the upstream watch recovered are stalled")
+	}
+	if e := res.Events[0]; e.Type != SubnetRemoved || e.Lease.Key() != "10.3.1.0-24" {
+		t.Errorf("Expected 10.3.1.0-24 to be removed, got %v", e)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Configs, leases and watch results are encoded (in etcd and by the /v1
+// API) with the names of the Go fields, e.g. "PublicIP". The json tags
+// of the types pin them, and like the fields themselves (see attrs.go)
+// they never change.
+//
+// Clients in other languages may use the snake_case names below instead,
+// e.g. "public_ip": they are accepted wherever the Go names are, and
+// MarshalSnakeCase encodes them. The fields of Event and WatchResult are
+// named in lower case already.
+
+// wireNames are the snake_case names of the fields of a type
+type wireNames struct {
+	// snake_case name by Go name
+	snake map[string]string
+	// Go name by snake_case name
+	goName map[string]string
+	// names of the fields holding (arrays of) objects of their own
+	nested map[string]*wireNames
+}
+
+func newWireNames(snake map[string]string, nested map[string]*wireNames) *wireNames {
+	n := &wireNames{snake: snake, goName: make(map[string]string), nested: nested}
+	for g, s := range snake {
+		n.goName[s] = g
+	}
+	return n
+}
+
+var (
+	configNames = newWireNames(map[string]string{
+		"Network":       "network",
+		"SubnetMin":     "subnet_min",
+		"SubnetMax":     "subnet_max",
+		"SubnetLen":     "subnet_len",
+		"Backend":       "backend",
+		"Allocation":    "allocation",
+		"GatewayOffset": "gateway_offset",
+		"Pools":         "pools",
+		inheritKey:      "inherits",
+	}, nil)
+
+	weightedIPNames = newWireNames(map[string]string{
+		"IP":     "ip",
+		"Weight": "weight",
+	}, nil)
+
+	leaseAttrsNames = newWireNames(map[string]string{
+		"PublicIP":       "public_ip",
+		"BackendType":    "backend_type",
+		"BackendData":    "backend_data",
+		"SubnetBlocks":   "subnet_blocks",
+		"PublicIPs":      "public_ips",
+		"PublicIPv6":     "public_ipv6",
+		"AvoidSubnets":   "avoid_subnets",
+		"Zone":           "zone",
+		"Pool":           "pool",
+		"Tenant":         "tenant",
+		"Hostname":       "hostname",
+		"PublicHostname": "public_hostname",
+		"Version":        "version",
+		"Features":       "features",
+		"Backends":       "backends",
+		"Ready":          "ready",
+		"Epoch":          "epoch",
+	}, map[string]*wireNames{"PublicIPs": weightedIPNames})
+
+	leaseNames = newWireNames(map[string]string{
+		"Subnet":     "subnet",
+		"Attrs":      "attrs",
+		"Expiration": "expiration",
+	}, map[string]*wireNames{"Attrs": leaseAttrsNames})
+
+	eventNames = newWireNames(nil, map[string]*wireNames{"lease": leaseNames})
+
+	watchResultNames = newWireNames(nil, map[string]*wireNames{
+		"events":   eventNames,
+		"snapshot": leaseNames,
+	})
+)
+
+// canonical returns the Go name of the field named name
+func (n *wireNames) canonical(name string) string {
+	if g, ok := n.goName[name]; ok {
+		return g
+	}
+	return name
+}
+
+// fromSnakeCase renames the snake_case keys of the JSON object b to the
+// Go names, for decoding into the type. Of a field given under both
+// names the Go one wins. Nested objects are left to their own types.
+func (n *wireNames) fromSnakeCase(b []byte) ([]byte, error) {
+	// the names that differ other than in case all have an underscore
+	if bytes.IndexByte(b, '_') < 0 {
+		return b, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		// not an object, for the decoder to complain about
+		return b, nil
+	}
+
+	renamed := false
+	for k, v := range fields {
+		g := n.canonical(k)
+		if g == k {
+			continue
+		}
+		if _, ok := fields[g]; !ok {
+			fields[g] = v
+		}
+		delete(fields, k)
+		renamed = true
+	}
+	if !renamed {
+		return b, nil
+	}
+	return json.Marshal(fields)
+}
+
+// toSnakeCase renames the keys of b, an object of the type or an array
+// of them, to the snake_case names, along with those of nested objects
+func (n *wireNames) toSnakeCase(b []byte) ([]byte, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return b, nil
+	}
+
+	switch b[0] {
+	case '[':
+		var elems []json.RawMessage
+		if err := json.Unmarshal(b, &elems); err != nil {
+			return nil, err
+		}
+		for i, e := range elems {
+			var err error
+			if elems[i], err = n.toSnakeCase(e); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(elems)
+
+	case '{':
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+		renamed := make(map[string]json.RawMessage, len(fields))
+		for k, v := range fields {
+			if nested, ok := n.nested[k]; ok {
+				var err error
+				if v, err = nested.toSnakeCase(v); err != nil {
+					return nil, err
+				}
+			}
+			if s, ok := n.snake[k]; ok {
+				k = s
+			}
+			renamed[k] = v
+		}
+		return json.Marshal(renamed)
+	}
+
+	// null
+	return b, nil
+}
+
+// MarshalSnakeCase encodes v like json.Marshal, but with the snake_case
+// names of the fields of configs, leases and watch results. Other values
+// are encoded as they are.
+func MarshalSnakeCase(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var names *wireNames
+	switch v.(type) {
+	case Config, *Config:
+		names = configNames
+	case LeaseAttrs, *LeaseAttrs:
+		names = leaseAttrsNames
+	case Lease, *Lease, []Lease:
+		names = leaseNames
+	case Event, *Event, []Event:
+		names = eventNames
+	case WatchResult, *WatchResult:
+		names = watchResultNames
+	default:
+		return b, nil
+	}
+	return names.toSnakeCase(b)
+}
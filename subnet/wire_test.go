@@ -0,0 +1,114 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func TestLeaseAttrsSnakeCase(t *testing.T) {
+	ready := true
+	goNames := `{"PublicIP": "1.1.1.1", "BackendType": "vxlan", "BackendData": {"VtepMAC":"aa:bb:cc:00:00:01"},
+		"PublicIPs": [{"IP": "1.1.1.1", "Weight": 2}], "PublicHostname": "node-a.example.com", "Ready": true, "Epoch": 7}`
+	snakeNames := `{"public_ip": "1.1.1.1", "backend_type": "vxlan", "backend_data": {"VtepMAC":"aa:bb:cc:00:00:01"},
+		"public_ips": [{"ip": "1.1.1.1", "weight": 2}], "public_hostname": "node-a.example.com", "ready": true, "epoch": 7}`
+
+	expected := LeaseAttrs{
+		PublicIP:       ip.FromIP([]byte{1, 1, 1, 1}),
+		BackendType:    "vxlan",
+		BackendData:    json.RawMessage(`{"VtepMAC":"aa:bb:cc:00:00:01"}`),
+		PublicIPs:      []WeightedIP{{IP: ip.FromIP([]byte{1, 1, 1, 1}), Weight: 2}},
+		PublicHostname: "node-a.example.com",
+		Ready:          &ready,
+		Epoch:          7,
+	}
+
+	for _, s := range []string{goNames, snakeNames} {
+		var attrs LeaseAttrs
+		if err := json.Unmarshal([]byte(s), &attrs); err != nil {
+			t.Fatalf("Failed to decode %v: %v", s, err)
+		}
+		if !reflect.DeepEqual(attrs, expected) {
+			t.Errorf("Decoding %v: expected %+v, got %+v", s, expected, attrs)
+		}
+	}
+
+	// the Go name wins over the snake_case one
+	var attrs LeaseAttrs
+	if err := json.Unmarshal([]byte(`{"PublicIP": "1.1.1.1", "public_ip": "2.2.2.2"}`), &attrs); err != nil {
+		t.Fatal(err)
+	}
+	if attrs.PublicIP.String() != "1.1.1.1" || attrs.Unknown != nil {
+		t.Errorf("Decoding both names: got %v, unknown %v", attrs.PublicIP, attrs.Unknown)
+	}
+}
+
+func TestConfigSnakeCase(t *testing.T) {
+	cfg, err := ParseConfig(`{"network": "10.3.0.0/16", "subnet_len": 26, "gateway_offset": 2, "backend": {"Type":"vxlan"}}`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.Network.String() != "10.3.0.0/16" || cfg.SubnetLen != 26 || cfg.GatewayOffset != 2 || string(cfg.Backend) != `{"Type":"vxlan"}` {
+		t.Errorf("ParseConfig of snake_case names: got %+v", cfg)
+	}
+
+	// a child config overrides base keys under either name
+	merged, err := mergeConfig(configObject{"SubnetLen": json.RawMessage("24")}, configObject{"subnet_len": json.RawMessage("26")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 1 || string(merged["subnet_len"]) != "26" {
+		t.Errorf("mergeConfig across names: got %v", merged)
+	}
+}
+
+func TestMarshalSnakeCase(t *testing.T) {
+	l := Lease{
+		Subnet:     ip.IP4Net{IP: ip.FromIP([]byte{10, 1, 5, 0}), PrefixLen: 24},
+		Attrs:      &LeaseAttrs{PublicIP: ip.FromIP([]byte{1, 1, 1, 1}), BackendType: "vxlan", BackendData: json.RawMessage(`{"VtepMAC":"aa:bb:cc:00:00:01"}`)},
+		Expiration: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	wr := WatchResult{Events: []Event{{Type: SubnetAdded, Lease: l}}, Snapshot: []Lease{l}, Cursor: "5"}
+
+	data, err := MarshalSnakeCase(wr)
+	if err != nil {
+		t.Fatalf("MarshalSnakeCase failed: %v", err)
+	}
+
+	s := string(data)
+	for _, name := range []string{`"public_ip":`, `"backend_type":`, `"backend_data":`, `"subnet":`, `"expiration":`, `"events":`, `"snapshot":`} {
+		if !strings.Contains(s, name) {
+			t.Errorf("Expected %v in %v", name, s)
+		}
+	}
+	// the data of the backend is its own
+	if strings.Contains(s, "PublicIP") || !strings.Contains(s, `"VtepMAC"`) {
+		t.Errorf("Unexpected field names in %v", s)
+	}
+
+	var decoded WatchResult
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode %v: %v", s, err)
+	}
+	if !reflect.DeepEqual(decoded, wr) {
+		t.Errorf("Round trip: expected %+v, got %+v", wr, decoded)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// subnetInfo is what the subnet file of a network holds
+type subnetInfo struct {
+	// the gateway of the subnet of this host with its prefix
+	Subnet ip.IP4Net
+	// the address reserved for this host in Subnet
+	Gateway ip.IP4
+	MTU     int
+	IPMasq  bool
+	// the bridge flannel configured with Subnet, if any
+	Bridge string `json:",omitempty"`
+}
+
+// subnetInfos serves the subnetInfo of every initialized network as
+// JSON, keyed by network name ("" with a single network)
+type subnetInfos struct {
+	mux   sync.Mutex
+	nets  map[string]subnetInfo
+	files *subnetFiles
+}
+
+func newSubnetInfos() *subnetInfos {
+	return &subnetInfos{
+		nets:  make(map[string]subnetInfo),
+		files: newSubnetFiles(opts.fileDebounce),
+	}
+}
+
+// set records the info of network and returns those of all the networks
+func (s *subnetInfos) set(network string, info subnetInfo) map[string]subnetInfo {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.nets[network] = info
+
+	nets := make(map[string]subnetInfo, len(s.nets))
+	for n, i := range s.nets {
+		nets[n] = i
+	}
+	return nets
+}
+
+func (s *subnetInfos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.nets)
+}
+
+// publishSubnet makes the subnet of network available on /subnets and,
+// unless disabled, in its subnet file. With a management network, the
+// subnet file covers both networks and is written once both are known.
+func publishSubnet(infos *subnetInfos, network string, sn *backend.SubnetDef) error {
+	info := subnetInfo{Subnet: sn.Net, Gateway: sn.Gateway, MTU: sn.MTU, IPMasq: opts.ipMasq}
+	info.Subnet.IP = sn.Gateway
+	if network == "" {
+		info.Bridge = opts.bridge
+	}
+	nets := infos.set(network, info)
+
+	switch {
+	case !opts.writeSubnetFile:
+		return nil
+
+	case isMultiNetwork():
+		return infos.files.write(filepath.Join(opts.subnetDir, network)+".env", subnetFileContent(info, nil))
+
+	case opts.mgmtNetwork != "":
+		pod, ok := nets[""]
+		mgmt, mok := nets[opts.mgmtNetwork]
+		if !ok || !mok {
+			return nil
+		}
+		return infos.files.write(opts.subnetFile, subnetFileContent(pod, &mgmt))
+
+	default:
+		return infos.files.write(opts.subnetFile, subnetFileContent(info, nil))
+	}
+}
+
+// replaced in tests
+var writeFile = writeFileAtomic
+
+// subnetFiles writes the subnet files, leaving alone those that hold
+// the content already. With a window, each file is written at most once
+// per window: a write goes through if the file was not written within
+// the window, the ones that come in meanwhile are merged into a single
+// write of the last content at its end. Downstream consumers watching
+// the files (e.g. with inotify) are so spared a rewrite per change.
+type subnetFiles struct {
+	window time.Duration
+
+	mux sync.Mutex
+	// per path, when it was last written and
+	// the content waiting for the window to end
+	written map[string]time.Time
+	pending map[string][]byte
+}
+
+func newSubnetFiles(window time.Duration) *subnetFiles {
+	return &subnetFiles{
+		window:  window,
+		written: make(map[string]time.Time),
+		pending: make(map[string][]byte),
+	}
+}
+
+// write writes data to path now or, if it was written within the window,
+// at its end. Only errors of writes that happen now are returned.
+func (f *subnetFiles) write(path string, data []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if _, ok := f.pending[path]; ok {
+		f.pending[path] = data
+		return nil
+	}
+
+	if wait := f.window - time.Since(f.written[path]); f.window > 0 && wait > 0 {
+		f.pending[path] = data
+		time.AfterFunc(wait, func() { f.flush(path) })
+		return nil
+	}
+
+	return f.writeLocked(path, data)
+}
+
+func (f *subnetFiles) flush(path string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	data := f.pending[path]
+	delete(f.pending, path)
+	if err := f.writeLocked(path, data); err != nil {
+		log.Errorf("Failed to write %v: %v", path, err)
+	}
+}
+
+// writeLocked writes data to path unless it holds data already; f.mux is held
+func (f *subnetFiles) writeLocked(path string, data []byte) error {
+	if cur, err := ioutil.ReadFile(path); err == nil && bytes.Equal(cur, data) {
+		return nil
+	}
+
+	if err := writeFile(path, data); err != nil {
+		return err
+	}
+	f.written[path] = time.Now()
+	return nil
+}
@@ -15,3 +15,8 @@
 package main
 
 const Version = "0.5.0+git"
+
+// Features lists the optional lease attributes this version acts on in the
+// leases of its peers, advertised in its leases (with Version) so that
+// operators can tell when an attribute is safe to use across a cluster
+var Features = []string{"public-ips", "public-hostname", "ready", "tenant", "epoch", "public-ipv6"}